@@ -1,6 +1,10 @@
 package gordp
 
 import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
 	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/glog"
 	"github.com/kdsmith18542/gordp/proto/nla"
@@ -33,42 +37,99 @@ func (c *Client) switchNLA() {
 	// 读取 PubKeyAuth
 	tsReq := &nla.TSRequest{}
 	tsReq.Read(c.stream)
+	core.ThrowIf(tsReq.ErrorCode != 0, fmt.Errorf("credssp error %#x", uint32(tsReq.ErrorCode)))
 	glog.Debug("PubKeyAuth:", tsReq.PubKeyAuth)
 
 	// 发送 Credentials
+	tCred := c.tsCredentials(challenge.Must.NegotiateFlags&nla.NTLMSSP_NEGOTIATE_UNICODE != 0)
+	authInfo := auth.Optional.NtlmSec.Serialize(tCred.Serialize())
+	nla.NewTsRequest().SetAuthInfo(authInfo).Write(c.stream)
+}
+
+// tsCredentials returns the credentials CredSSP delegates to the server,
+// all empty in Restricted Admin mode
+// See [MS-CSSP] 2.2.1.2.1
+func (c *Client) tsCredentials(unicode bool) nla.TSCredentials {
 	tpCred := nla.TSPasswordCreds{
 		DomainName: []byte(""),
-		UserName:   []byte(c.option.UserName),
-		Password:   []byte(c.option.Password),
+		UserName:   []byte(""),
+		Password:   []byte(""),
 	}
-	if challenge.Must.NegotiateFlags&nla.NTLMSSP_NEGOTIATE_UNICODE != 0 {
-		tpCred.UserName = core.UnicodeEncode(c.option.UserName)
-		tpCred.Password = core.UnicodeEncode(c.option.Password)
+	if !c.option.RestrictedAdmin {
+		tpCred.UserName = []byte(c.option.UserName)
+		tpCred.Password = []byte(c.option.Password)
+		if unicode {
+			tpCred.UserName = core.UnicodeEncode(c.option.UserName)
+			tpCred.Password = core.UnicodeEncode(c.option.Password)
+		}
 	}
-	tCred := nla.TSCredentials{CredType: 1, Credentials: tpCred.Serialize()}
-	authInfo := auth.Optional.NtlmSec.Serialize(tCred.Serialize())
-	nla.NewTsRequest().SetAuthInfo(authInfo).Write(c.stream)
+	return nla.TSCredentials{CredType: 1, Credentials: tpCred.Serialize()}
+}
+
+// negotiationFlags returns the flags of the negotiation request, asking
+// for the mode of Option.RestrictedAdmin
+func (c *Client) negotiationFlags() uint8 {
+	var flags uint8
+	if c.option.RestrictedAdmin {
+		flags |= connPdu.RESTRICTED_ADMIN_MODE_REQUIRED
+	}
+	return flags
+}
+
+// checkNegotiation throws unless the server agreed to the mode asked for
+// in the negotiation request, which need NLA
+func (c *Client) checkNegotiation(rsp *connPdu.Negotiation) {
+	if c.negotiationFlags() == 0 {
+		return
+	}
+	core.ThrowIf(rsp.Result != connPdu.PROTOCOL_HYBRID, fmt.Errorf("server picked protocol %#x, not NLA", rsp.Result))
+	core.ThrowIf(c.option.RestrictedAdmin && rsp.Flag&connPdu.RESTRICTED_ADMIN_MODE_SUPPORTED == 0,
+		"server does not support restricted admin mode")
+}
+
+// tlsConfig returns the TLS settings of the connection, a copy of
+// Option.TLSConfig naming the server of Addr unless it names one, or
+// core.DefaultTLSConfig without it
+func (c *Client) tlsConfig() *tls.Config {
+	if c.option.TLSConfig == nil {
+		return core.DefaultTLSConfig()
+	}
+	config := c.option.TLSConfig.Clone()
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(c.option.Addr); err == nil {
+			config.ServerName = host
+		}
+	}
+	return config
 }
 
 // Connection Sequence
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/023f1e69-cfe8-4ee6-9ee0-7e759fb4e4ee
 func (c *Client) negotiation() {
-	reqPdu := connPdu.NewClientConnectionRequestPDU()
-	reqPdu.Write(c.stream)
-
 	resPdu := &connPdu.ServerConnectionConfirmPDU{}
-	resPdu.Read(c.stream)
-
-	switch resPdu.ProtocolNeg.Result {
-	case connPdu.PROTOCOL_RDP:
-	case connPdu.PROTOCOL_SSL:
-		c.stream.SwitchSSL()
-	case connPdu.PROTOCOL_HYBRID:
-		c.stream.SwitchSSL()
-		c.switchNLA()
-	default:
-		core.Throw("invalid protocol")
-	}
+	connectStep(ErrProtocolNegotiation, func() {
+		reqPdu := connPdu.NewClientConnectionRequestPDU()
+		if flags := c.negotiationFlags(); flags != 0 {
+			// no credentials for a server that would not take the mode
+			reqPdu.ProtocolNeg.Flag = flags
+			reqPdu.ProtocolNeg.Result = connPdu.PROTOCOL_HYBRID
+		}
+		reqPdu.Write(c.stream)
+
+		resPdu.Read(c.stream)
+		c.checkNegotiation(&resPdu.ProtocolNeg)
+
+		switch resPdu.ProtocolNeg.Result {
+		case connPdu.PROTOCOL_RDP:
+		case connPdu.PROTOCOL_SSL, connPdu.PROTOCOL_HYBRID:
+			c.stream.SwitchSSL(c.tlsConfig())
+		default:
+			core.Throw("invalid protocol")
+		}
+	})
 
 	c.selectProtocol = resPdu.ProtocolNeg.Result
+	if c.selectProtocol == connPdu.PROTOCOL_HYBRID {
+		connectStep(ErrAuthFailed, c.switchNLA)
+	}
 }
@@ -1,12 +1,17 @@
 package gordp
 
 import (
+	"errors"
+	"fmt"
+
+	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/glog"
+	"github.com/kdsmith18542/gordp/proto/mcs"
 	"github.com/kdsmith18542/gordp/proto/pdu/mcsPdu"
 )
 
 func (c *Client) basicSettingsExchange() {
-	mcsReqPdu := mcsPdu.NewClientMcsConnectInitialPdu(c.selectProtocol)
+	mcsReqPdu := c.newConnectInitial()
 	mcsReqPdu.Write(c.stream)
 	glog.Debugf("send connect initial pdu ok.")
 
@@ -15,4 +20,95 @@ func (c *Client) basicSettingsExchange() {
 	glog.Debugf("receive connect response pdu ok")
 	glog.Debugf("rdp version: client=%0#x, server=%0#x", mcsReqPdu.ClientCoreData.Version, mcsResPdu.ServerCoreData.Version)
 	c.serverVersion = mcsResPdu.ServerCoreData.Version
+	c.serverSecurity = mcsResPdu.ServerSecurityData
+	c.bindStaticChannels(mcsResPdu.ServerNetworkData.ChannelIdArray)
+}
+
+// newConnectInitial builds the MCS Connect Initial PDU offering the
+// channels and transports the client was set up with
+func (c *Client) newConnectInitial() *mcsPdu.ClientMcsConnectInitialPDU {
+	mcsReqPdu := mcsPdu.NewClientMcsConnectInitialPdu(c.selectProtocol)
+	for _, ch := range c.staticChannels {
+		mcsReqPdu.ClientNetworkData.AddChannel(ch.Name, mcs.CHANNEL_OPTION_INITIALIZED)
+	}
+	width, height, colorDepth, err := c.desktopSettings()
+	core.ThrowError(err)
+	coreData := mcsReqPdu.ClientCoreData
+	coreData.DesktopWidth, coreData.DesktopHeight = width, height
+	// 32 bpp has no high color depth of its own but is asked for with a flag
+	// See [MS-RDPBCGR] 2.2.1.3.2
+	coreData.HighColorDepth = min(colorDepth, mcs.HIGH_COLOR_24BPP)
+	if colorDepth == 32 {
+		coreData.EarlyCapabilityFlags |= mcs.RNS_UD_CS_WANT_32BPP_SESSION
+	}
+	c.setKeyboard(&coreData.KbdLayout, &coreData.KeyboardType, &coreData.KeyboardSubType)
+	if len(c.monitors) > 0 {
+		mcsReqPdu.ClientMonitorData = mcs.NewClientMonitorData(c.monitors)
+		mcsReqPdu.ClientMonitorExtendedData = mcs.NewClientMonitorExtendedData(c.monitors)
+		coreData.EarlyCapabilityFlags |= mcs.RNS_UD_CS_SUPPORT_MONITOR_LAYOUT_PDU
+	}
+	return mcsReqPdu
+}
+
+// setKeyboard sets the keyboard layout, type and subtype the client
+// announces, in the client core data and again in the input capability set,
+// to those of Option.KeyboardLayout. Japanese layouts need the Japanese
+// keyboard type too. See [MS-RDPBCGR] 2.2.1.3.2
+func (c *Client) setKeyboard(layout, kbdType, subType *uint32) {
+	*layout = c.option.KeyboardLayout
+	if *layout == 0 {
+		*layout = mcs.US
+	}
+	if *layout&0xFFFF == mcs.JAPANESE {
+		*kbdType, *subType = mcs.KT_JAPANESE, 2 // 106/109 keys
+	}
+}
+
+// Desktop size and color depth used when the Option leaves them unset
+const (
+	DefaultWidth      = 1024
+	DefaultHeight     = 768
+	DefaultColorDepth = 32
+)
+
+// ErrDisplaySettings is returned by Connect when Option.Width,
+// Option.Height or Option.ColorDepth is out of range
+var ErrDisplaySettings = errors.New("invalid display settings")
+
+// desktopSettings returns the desktop size and color depth the client asks
+// for, the size being that of all monitors if any are set
+func (c *Client) desktopSettings() (uint16, uint16, uint16, error) {
+	width, height, colorDepth := c.option.Width, c.option.Height, c.option.ColorDepth
+	if width == 0 {
+		width = DefaultWidth
+	}
+	if height == 0 {
+		height = DefaultHeight
+	}
+	if colorDepth == 0 {
+		colorDepth = DefaultColorDepth
+	}
+	if width < 0 || height < 0 || width > mcs.MaxDesktopSize || height > mcs.MaxDesktopSize {
+		return 0, 0, 0, fmt.Errorf("%w: desktop size %dx%d", ErrDisplaySettings, width, height)
+	}
+	switch colorDepth {
+	case 8, 15, 16, 24, 32:
+	default:
+		return 0, 0, 0, fmt.Errorf("%w: color depth %d, not one of 8, 15, 16, 24 and 32", ErrDisplaySettings, colorDepth)
+	}
+	if len(c.monitors) > 0 {
+		w, h := virtualDesktopSize(c.monitors)
+		return w, h, uint16(colorDepth), nil
+	}
+	return uint16(width), uint16(height), uint16(colorDepth), nil
+}
+
+// virtualDesktopSize returns the size of the rectangle bounding all monitors
+func virtualDesktopSize(monitors []mcs.MonitorLayout) (uint16, uint16) {
+	left, top, right, bottom := monitors[0].Left, monitors[0].Top, monitors[0].Right, monitors[0].Bottom
+	for _, m := range monitors {
+		left, top = min(left, m.Left), min(top, m.Top)
+		right, bottom = max(right, m.Right), max(bottom, m.Bottom)
+	}
+	return uint16(right - left + 1), uint16(bottom - top + 1)
 }
@@ -34,4 +34,13 @@ func (c *Client) channelConnect() {
 
 	c.joinChannel(c.userId, mcs.MCS_CHANNEL_GLOBAL) // join channel `global`
 	c.joinChannel(c.userId, mcsAUcf.McsAUcf.UserId) // join channel `user`
+	for _, ch := range c.staticChannels {
+		if ch.ID == 0 {
+			continue
+		}
+		c.joinChannel(c.userId, ch.ID)
+		if err := c.vcHandlers[ch.Name].OnChannelOpen(ch.ID, ch.Name); err != nil {
+			glog.Warnf("virtual channel %s: %v", ch.Name, err)
+		}
+	}
 }
@@ -1 +1,37 @@
 package gordp
+
+import (
+	"crypto/rand"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/glog"
+	"github.com/kdsmith18542/gordp/proto/mcs"
+	"github.com/kdsmith18542/gordp/proto/pdu/connPdu"
+	"github.com/kdsmith18542/gordp/proto/pdu/secPdu"
+	"github.com/kdsmith18542/gordp/proto/sec"
+)
+
+// securityCommencement sets up Standard RDP Security when the server chose
+// it over TLS and encrypts: the client random goes to the server encrypted
+// with the key of its certificate, and both sides derive the session keys
+// from it and the server random.
+// See [MS-RDPBCGR] 5.3.2
+func (c *Client) securityCommencement() {
+	c.encryption = nil
+	security := &c.serverSecurity
+	if c.selectProtocol != connPdu.PROTOCOL_RDP || security.EncryptionMethod == mcs.ENCRYPTION_METHOD_NONE {
+		return
+	}
+	key, err := security.ServerCertificate.PublicKey()
+	core.ThrowError(err)
+	clientRandom := make([]byte, sec.ClientRandomLength)
+	_, err = rand.Read(clientRandom)
+	core.ThrowError(err)
+	encryption, err := sec.NewClientEncryption(security.EncryptionMethod, clientRandom, security.ServerRandom)
+	core.ThrowError(err)
+
+	glog.Debugf("standard rdp security: method %#x, level %v", security.EncryptionMethod, security.EncryptionLevel)
+	exchange := secPdu.NewSecurityExchangePDU(sec.EncryptClientRandom(key, clientRandom))
+	c.writeMcsData(mcs.MCS_CHANNEL_GLOBAL, exchange.Serialize())
+	c.encryption = encryption
+}
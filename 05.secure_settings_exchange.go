@@ -1,24 +1,30 @@
 package gordp
 
 import (
-	"github.com/kdsmith18542/gordp/proto/mcs"
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/core/compression"
 	"github.com/kdsmith18542/gordp/proto/pdu/licPdu"
 )
 
 func (c *Client) sendClientInfo() {
-	clientInfo := licPdu.NewClientInfoPDU(c.userId, c.option.UserName, c.option.Password)
-	clientInfo.Write(c.stream)
-
-	// Send Monitor Layout PDU if multi-monitor is configured
-	if len(c.monitors) > 0 {
-		pdu := &mcs.MonitorLayoutPDU{
-			UserDataHeader: mcs.UserDataHeader{
-				Type: mcs.CS_MONITOR,
-				Len:  uint16(8 + len(c.monitors)*40), // 8 bytes header + 40 bytes per monitor
-			},
-			NumMonitors: uint32(len(c.monitors)),
-			Monitors:    c.monitors,
-		}
-		c.stream.Write(pdu.Serialize())
+	password := c.option.Password
+	if c.option.RestrictedAdmin {
+		// the server logs on with the identity NLA proved
+		password = ""
+	}
+	clientInfo := licPdu.NewClientInfoPDU(c.userId, c.option.UserName, password)
+	core.ThrowError(clientInfo.InfoPacket.SetAlternateShell(c.option.AlternateShell, c.option.WorkingDir))
+	if c.option.RemoteApp != nil {
+		core.ThrowError(c.option.RemoteApp.exec().Validate())
+		clientInfo.InfoPacket.Flag |= licPdu.INFO_RAIL
 	}
+	c.bulk = nil
+	c.fpFragments.Reset()
+	if c.option.BulkCompression {
+		// MPPC, the only compression the decompressor decodes
+		clientInfo.InfoPacket.SetCompression(compression.PACKET_COMPR_TYPE_64K)
+		c.bulk = compression.NewDecompressor()
+	}
+	clientInfo.Encryption = c.encryption
+	clientInfo.Write(c.stream)
 }
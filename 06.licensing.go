@@ -3,6 +3,6 @@ package gordp
 import "github.com/kdsmith18542/gordp/proto/pdu/licPdu"
 
 func (c *Client) readLicensing() {
-	licensing := licPdu.ServerLicensingPDU{}
+	licensing := licPdu.ServerLicensingPDU{Encryption: c.encryption}
 	licensing.Read(c.stream)
 }
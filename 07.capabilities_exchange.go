@@ -1,12 +1,260 @@
 package gordp
 
 import (
+	"errors"
+	"fmt"
+
+	"github.com/kdsmith18542/gordp/proto/capability"
+	"github.com/kdsmith18542/gordp/proto/mcs"
 	"github.com/kdsmith18542/gordp/proto/t128"
 )
 
+// ErrServerLimits is returned for desktop and monitor layouts the server
+// announced it cannot take
+var ErrServerLimits = errors.New("exceeds the limits of the server")
+
+// the offscreen bitmap cache of Option.OffscreenCacheSize and
+// Option.OffscreenCacheEntries left zero
+const (
+	DefaultOffscreenCacheSize    = 7680
+	DefaultOffscreenCacheEntries = 100
+)
+
+// Capabilities is the list of capability sets the client confirms to the
+// server, handed to Option.CapabilityOverride before it is sent
+type Capabilities struct {
+	Sets []capability.TsCapsSet
+}
+
+// Find returns the capability set of the given CAPSTYPE_*, or nil
+func (c *Capabilities) Find(typ uint16) capability.TsCapsSet {
+	for _, set := range c.Sets {
+		if set != nil && set.Type() == typ {
+			return set
+		}
+	}
+	return nil
+}
+
+// General returns the general capability set, or nil
+func (c *Capabilities) General() *capability.TsGeneralCapabilitySet {
+	set, _ := c.Find(capability.CAPSTYPE_GENERAL).(*capability.TsGeneralCapabilitySet)
+	return set
+}
+
+// Bitmap returns the bitmap capability set, or nil
+func (c *Capabilities) Bitmap() *capability.TsBitmapCapabilitySet {
+	set, _ := c.Find(capability.CAPSTYPE_BITMAP).(*capability.TsBitmapCapabilitySet)
+	return set
+}
+
 func (c *Client) capabilitiesExchange() {
-	demandActivePDU := t128.ReadExpectedPDU(c.stream, t128.PDUTYPE_DEMANDACTIVEPDU).(*t128.TsDemandActivePduData)
-	confirmActivePduData := t128.NewTsConfirmActivePduData(demandActivePDU)
+	// static channel data may come first
+	data := c.readMcsData()
+	for data == nil {
+		data = c.readMcsData()
+	}
+	demandActivePDU := t128.ParseExpectedPDU(data, t128.PDUTYPE_DEMANDACTIVEPDU).(*t128.TsDemandActivePduData)
+	confirmActivePduData := c.newConfirmActive(demandActivePDU)
 	c.shareId = demandActivePDU.SharedId
-	t128.WritePDU(c.stream, c.userId, confirmActivePduData)
+	c.desktopWidth, c.desktopHeight, c.bitsPerPixel = desktopSize(demandActivePDU.CapabilitySets, confirmActivePduData.CapabilitySets)
+	c.relativeMouse = relativeMouse(demandActivePDU.CapabilitySets) && relativeMouse(confirmActivePduData.CapabilitySets)
+	c.keyMu.Lock()
+	c.relativeMode = c.relativeMode && c.relativeMouse
+	c.keyMu.Unlock()
+	c.frameAck = frameAcknowledge(demandActivePDU.CapabilitySets) && frameAcknowledge(confirmActivePduData.CapabilitySets)
+	c.resetOrders()
+	c.resetPointer()
+	limits := serverLimits(demandActivePDU.CapabilitySets)
+	c.serverLimits = &limits
+	c.writePdu(confirmActivePduData)
+}
+
+// ServerLimits are the limits the server announced, which desktop and
+// monitor layout changes are checked against
+type ServerLimits struct {
+	// DesktopResize is whether the desktop may change size during the
+	// session, from the bitmap capability set
+	DesktopResize bool
+
+	// MaxRequestSize is the largest fast-path update the server reassembles
+	// from fragments, from the multifragment update capability set, and
+	// VCChunkSize the size of the static virtual channel chunks it takes,
+	// from the virtual channel capability set; 0 when not announced
+	MaxRequestSize uint32
+	VCChunkSize    uint32
+
+	// MaxMonitors and MaxMonitorArea, in pixels, bound the layouts sent over
+	// the display control channel; 0 until the server opened it
+	// See [MS-RDPEDISP] 2.2.2.1
+	MaxMonitors    uint32
+	MaxMonitorArea uint64
+}
+
+// serverLimits reads the limits among the capability sets of the Demand
+// Active PDU
+func serverLimits(sets []capability.TsCapsSet) ServerLimits {
+	limits := ServerLimits{}
+	for _, set := range sets {
+		switch set := set.(type) {
+		case *capability.TsBitmapCapabilitySet:
+			limits.DesktopResize = set.DesktopResizeFlag != 0
+		case *capability.TsMultiFragmentUpdateCapabilitySet:
+			limits.MaxRequestSize = set.MaxRequestSize
+		case *capability.TsVirtualChannelCapabilitySet:
+			limits.VCChunkSize = set.VCChunkSize
+		}
+	}
+	return limits
+}
+
+// ServerLimits returns the limits the server announced, and whether it has
+// yet: they come with its Demand Active PDU, and the monitor limits once it
+// opened the display control channel.
+func (c *Client) ServerLimits() (ServerLimits, bool) {
+	if c.serverLimits == nil {
+		return ServerLimits{}, false
+	}
+	limits := *c.serverLimits
+	if caps, ok := c.displayManager.Caps(); ok {
+		limits.MaxMonitors = caps.MaxNumMonitors
+		limits.MaxMonitorArea = uint64(caps.MaxMonitorAreaFactorA) * uint64(caps.MaxMonitorAreaFactorB) * uint64(caps.MaxNumMonitors)
+	}
+	return limits, true
+}
+
+// checkServerLimits returns an error wrapping ErrServerLimits if monitors
+// is a layout the server announced it cannot take. Layouts are not checked
+// before the server announced its limits.
+func (c *Client) checkServerLimits(monitors []mcs.MonitorLayout) error {
+	limits, ok := c.ServerLimits()
+	if !ok || len(monitors) == 0 {
+		return nil
+	}
+	width, height := virtualDesktopSize(monitors)
+	if !limits.DesktopResize && (width != c.desktopWidth || height != c.desktopHeight) {
+		return fmt.Errorf("%w: desktop of %dx%d, the server does not resize it from %dx%d",
+			ErrServerLimits, width, height, c.desktopWidth, c.desktopHeight)
+	}
+	if limits.MaxMonitors != 0 && uint32(len(monitors)) > limits.MaxMonitors {
+		return fmt.Errorf("%w: %d monitors, at most %d", ErrServerLimits, len(monitors), limits.MaxMonitors)
+	}
+	var area uint64
+	for _, m := range monitors {
+		area += uint64(m.Right-m.Left+1) * uint64(m.Bottom-m.Top+1)
+	}
+	if limits.MaxMonitorArea != 0 && area > limits.MaxMonitorArea {
+		return fmt.Errorf("%w: monitors of %d pixels, at most %d", ErrServerLimits, area, limits.MaxMonitorArea)
+	}
+	return nil
+}
+
+// newConfirmActive builds the Confirm Active PDU and applies the caller's
+// capability override, if any
+func (c *Client) newConfirmActive(demandActivePDU *t128.TsDemandActivePduData) *t128.TsConfirmActivePduData {
+	confirmActivePduData := t128.NewTsConfirmActivePduData(demandActivePDU)
+	// the same size and depth as in the client core data
+	caps := &Capabilities{Sets: confirmActivePduData.CapabilitySets}
+	if bmp := caps.Bitmap(); bmp != nil {
+		if width, height, colorDepth, err := c.desktopSettings(); err == nil {
+			bmp.DesktopWidth, bmp.DesktopHeight, bmp.PreferredBitsPerPixel = width, height, colorDepth
+		}
+	}
+	if c.option.DrawingOrders {
+		supportDrawingOrders(confirmActivePduData.CapabilitySets)
+	}
+	if c.option.PersistentBitmapCache {
+		usePersistentBitmapCache(confirmActivePduData.CapabilitySets)
+	}
+	if offscreen, ok := caps.Find(capability.CAPSTYPE_OFFSCREENCACHE).(*capability.TsOffscreenCapabilitySet); ok {
+		if c.option.DrawingOrders {
+			offscreen.SupportLevel = t128.OFFSCREEN_SUPPORT_LEVEL_DEFAULT
+		}
+		offscreen.CacheSize, offscreen.CacheEntries = c.offscreenCacheSettings()
+	}
+	if frames := c.maxUnacknowledgedFrames(); frames > 0 {
+		caps.Sets = append(caps.Sets,
+			&capability.TsSurfCmdsCapabilitySet{CmdFlags: capability.SURFCMDS_SETSURFACEBITS | capability.SURFCMDS_FRAMEMARKER},
+			&capability.TsFrameAcknowledgeCapabilitySet{MaxUnacknowledgedFrameCount: uint32(frames)})
+		confirmActivePduData.CapabilitySets = caps.Sets
+	}
+	if vc, ok := caps.Find(capability.CAPSTYPE_VIRTUALCHANNEL).(*capability.TsVirtualChannelCapabilitySet); ok && c.maxPDUSize() != 0 {
+		vc.VCChunkSize = min(vc.VCChunkSize, uint32(c.maxPDUSize()-channelPDUOverhead))
+	}
+	if c.option.RemoteApp != nil {
+		caps.Sets = append(caps.Sets, capability.NewWindowListCapabilitySet())
+		confirmActivePduData.CapabilitySets = caps.Sets
+	}
+	if input, ok := caps.Find(capability.CAPSTYPE_INPUT).(*capability.TsInputCapabilitySet); ok {
+		c.setKeyboard(&input.KeyboardLayout, &input.KeyboardType, &input.KeyboardSubType)
+		if relativeMouse(demandActivePDU.CapabilitySets) {
+			input.Flags |= capability.INPUT_FLAG_MOUSE_RELATIVE
+		}
+	}
+	if c.option.CapabilityOverride != nil {
+		c.option.CapabilityOverride(caps)
+		confirmActivePduData.CapabilitySets = caps.Sets
+	}
+	return confirmActivePduData
+}
+
+// offscreenCacheSettings returns the size in kilobytes and number of
+// entries of the offscreen bitmap cache
+// See [MS-RDPBCGR] 2.2.7.1.9
+func (c *Client) offscreenCacheSettings() (uint16, uint16) {
+	size, entries := c.option.OffscreenCacheSize, c.option.OffscreenCacheEntries
+	if size == 0 {
+		size = DefaultOffscreenCacheSize
+	}
+	if entries == 0 {
+		entries = DefaultOffscreenCacheEntries
+	}
+	return min(size, capability.MaxOffscreenCacheSize), min(entries, capability.MaxOffscreenCacheEntries)
+}
+
+// maxUnacknowledgedFrames returns the frames the server may send ahead of
+// the acknowledgements, 0 when not acknowledging frames
+func (c *Client) maxUnacknowledgedFrames() int {
+	return max(c.option.MaxUnacknowledgedFrames, 0)
+}
+
+// usePersistentBitmapCache replaces the bitmap cache capability with its
+// second revision, the first one that can mark caches persistent
+func usePersistentBitmapCache(sets []capability.TsCapsSet) {
+	for i, set := range sets {
+		if rev1, ok := set.(*capability.TsBitmapCacheCapabilitySet); ok {
+			sets[i] = capability.NewTsBitmapCacheCapabilitySetRev2(true,
+				uint32(rev1.Cache0Entries), uint32(rev1.Cache1Entries), uint32(rev1.Cache2Entries))
+		}
+	}
+}
+
+// relativeMouse reports whether the input capability set among sets takes
+// relative pointer events
+func relativeMouse(sets []capability.TsCapsSet) bool {
+	caps := &Capabilities{Sets: sets}
+	input, ok := caps.Find(capability.CAPSTYPE_INPUT).(*capability.TsInputCapabilitySet)
+	return ok && input.Flags&capability.INPUT_FLAG_MOUSE_RELATIVE != 0
+}
+
+// frameAcknowledge reports whether sets has the frame acknowledge
+// capability set, which the server and the client both announce for
+// frames to be acknowledged
+// See [MS-RDPRFX] 2.2.1.3
+func frameAcknowledge(sets []capability.TsCapsSet) bool {
+	caps := &Capabilities{Sets: sets}
+	return caps.Find(capability.CAPSSETTYPE_FRAME_ACKNOWLEDGE) != nil
+}
+
+// desktopSize returns the desktop size and color depth announced by the
+// server, falling back to the ones the client asks for
+func desktopSize(sets ...[]capability.TsCapsSet) (uint16, uint16, uint16) {
+	for _, caps := range sets {
+		for _, cap := range caps {
+			if bmp, ok := cap.(*capability.TsBitmapCapabilitySet); ok && bmp.DesktopWidth != 0 && bmp.DesktopHeight != 0 {
+				return bmp.DesktopWidth, bmp.DesktopHeight, bmp.PreferredBitsPerPixel
+			}
+		}
+	}
+	return 0, 0, 0
 }
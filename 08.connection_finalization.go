@@ -1,20 +1,164 @@
 package gordp
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/glog"
 	"github.com/kdsmith18542/gordp/proto/t128"
 )
 
+// Errors reported by Connect when the server does not follow the connection
+// finalization sequence.
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/023f1e69-cfe8-4ee6-9ee0-7e759fb4e4ee
+var (
+	ErrServerSynchronizeMissing  = errors.New("server synchronize pdu not received")
+	ErrServerCooperateMissing    = errors.New("server control cooperate pdu not received")
+	ErrServerGrantControlMissing = errors.New("server control granted control pdu not received")
+	ErrServerFontMapMissing      = errors.New("server font map pdu not received")
+
+	// ErrActivationIncomplete is returned when the finalization sequence
+	// does not end within Option.ActivationTimeout
+	ErrActivationIncomplete = errors.New("session activation incomplete")
+)
+
+// DefaultActivationTimeout is the ActivationTimeout used when the option is
+// not set
+var DefaultActivationTimeout = 10 * time.Second
+
+// finalizationStep describes one server PDU the client waits for
+type finalizationStep struct {
+	err   error
+	match func(pdu t128.DataPDU) bool
+}
+
 func (c *Client) sendClientFinalization() {
-	t128.WriteDataPdu(c.stream, c.userId, c.shareId, t128.NewTsSynchronizePduData(c.userId))
-	t128.WriteDataPdu(c.stream, c.userId, c.shareId, &t128.TsControlPDU{Action: t128.CTRLACTION_COOPERATE})
-	t128.WriteDataPdu(c.stream, c.userId, c.shareId, &t128.TsControlPDU{Action: t128.CTRLACTION_REQUEST_CONTROL})
-	t128.WriteDataPdu(c.stream, c.userId, c.shareId, &t128.TsFontListPDU{ListFlags: 0x0003, EntrySize: 0x0032})
-
-	t128.ReadExpectedDataPDU(c.stream, t128.PDUTYPE2_SYNCHRONIZE)
-	ctlPdu1 := t128.ReadExpectedDataPDU(c.stream, t128.PDUTYPE2_CONTROL).(*t128.TsControlPDU)
-	core.ThrowIf(ctlPdu1.Action != t128.CTRLACTION_COOPERATE, "server action is not `COOPERATE`")
-	ctlPdu2 := t128.ReadExpectedDataPDU(c.stream, t128.PDUTYPE2_CONTROL).(*t128.TsControlPDU)
-	core.ThrowIf(ctlPdu2.Action != t128.CTRLACTION_GRANTED_CONTROL, "server action is not `GRANTED_CONTROL`")
-	t128.ReadExpectedDataPDU(c.stream, t128.PDUTYPE2_FONTMAP)
+	c.writeDataPdu(t128.NewTsSynchronizePduData(c.userId))
+	c.writeDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_COOPERATE})
+	c.writeDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_REQUEST_CONTROL})
+	if c.option.PersistentBitmapCache {
+		pdus := c.bitmapCacheManager.PersistentListPDUs()
+		for _, pdu := range pdus {
+			c.writeDataPdu(pdu)
+		}
+		c.usePersistentCells(pdus)
+	}
+	c.writeDataPdu(&t128.TsFontListPDU{ListFlags: 0x0003, EntrySize: 0x0032})
+
+	steps := []finalizationStep{
+		{ErrServerSynchronizeMissing, func(pdu t128.DataPDU) bool {
+			_, ok := pdu.(*t128.TsSynchronizePduData)
+			return ok
+		}},
+		{ErrServerCooperateMissing, isControlAction(t128.CTRLACTION_COOPERATE)},
+		{ErrServerGrantControlMissing, isControlAction(t128.CTRLACTION_GRANTED_CONTROL)},
+		{ErrServerFontMapMissing, func(pdu t128.DataPDU) bool {
+			_, ok := pdu.(*t128.TsFontMapPDU)
+			return ok
+		}},
+	}
+	timeout := c.option.ActivationTimeout
+	if timeout == 0 {
+		timeout = DefaultActivationTimeout
+	}
+	c.readBy = time.Now().Add(timeout)
+	defer func() {
+		c.readBy = time.Time{}
+		_ = c.setReadDeadline(time.Time{})
+	}()
+
+	// graphics and input only work once the font map arrived
+	for _, step := range steps {
+		if err := core.Try(func() { c.awaitFinalizationPdu(step) }); err != nil {
+			if core.IsTimeout(err) {
+				core.ThrowError(fmt.Errorf("%w after %v: %w: %w", ErrActivationIncomplete, timeout, step.err, err))
+			}
+			core.ThrowError(err)
+		}
+	}
+	glog.Debugf("connection finalization ok")
+
+	c.logonMu.Lock()
+	c.connectedAt = time.Now()
+	c.logonMu.Unlock()
+	c.framesDecoded.Store(0)
+	c.frameBytes.Store(0)
+	c.vcManager.ResetStats()
+	c.dvcManager.ResetStats()
+	c.connected.Store(true)
+}
+
+// Connected reports whether the session is active: the server finished the
+// connection finalization with its Font Map PDU, so graphics flow and input
+// is accepted, and the session loop has not ended since
+func (c *Client) Connected() bool {
+	return c.connected.Load()
+}
+
+func isControlAction(action uint16) func(pdu t128.DataPDU) bool {
+	return func(pdu t128.DataPDU) bool {
+		ctl, ok := pdu.(*t128.TsControlPDU)
+		return ok && ctl.Action == action
+	}
+}
+
+// awaitFinalizationPdu reads server PDUs until the one described by step
+// arrives. Informational PDUs that servers are allowed to interleave are
+// skipped; anything else out of order aborts the connection with step.err.
+func (c *Client) awaitFinalizationPdu(step finalizationStep) {
+	for {
+		switch p := c.readPdu().(type) {
+		case nil:
+			// static channel data, handled by readPdu
+		case *t128.TsDataPduData:
+			if p.Pdu == nil {
+				glog.Debugf("skip pdutype2 [%x] during finalization", p.Header.PDUType2)
+				continue
+			}
+			if step.match(p.Pdu) {
+				return
+			}
+			switch pdu := p.Pdu.(type) {
+			case *t128.TsSaveSessionInfoPDU:
+				c.handleSaveSessionInfo(pdu)
+				continue
+			case *t128.TsSetErrorInfoPDU:
+				c.handleSetErrorInfo(pdu)
+				continue
+			case *t128.TsSetKeyboardIndicatorsPDU:
+				c.handleKeyboardIndicators(pdu)
+				continue
+			case *t128.TsPlaySoundPDU:
+				c.handlePlaySound(pdu)
+				continue
+			}
+			core.ThrowError(fmt.Errorf("%w: got %s", step.err, describeDataPdu(p.Pdu)))
+		case *t128.TsFpUpdatePDU:
+			glog.Debugf("skip fastpath update during finalization")
+		default:
+			core.ThrowError(fmt.Errorf("%w: got %T", step.err, p))
+		}
+	}
+}
+
+// sendInitialRefresh asks the server to repaint the whole desktop, unless
+// disabled with Option.RequestInitialRefresh
+func (c *Client) sendInitialRefresh() {
+	if c.option.RequestInitialRefresh != nil && !*c.option.RequestInitialRefresh {
+		return
+	}
+	if c.desktopWidth == 0 || c.desktopHeight == 0 {
+		glog.Debugf("desktop size unknown, skip initial refresh")
+		return
+	}
+	c.writeDataPdu(t128.NewTsRefreshRectPDU(c.desktopWidth, c.desktopHeight))
+}
+
+func describeDataPdu(pdu t128.DataPDU) string {
+	if ctl, ok := pdu.(*t128.TsControlPDU); ok {
+		return fmt.Sprintf("control pdu with action %#x", ctl.Action)
+	}
+	return fmt.Sprintf("%T", pdu)
 }
@@ -1,50 +1,579 @@
 package gordp
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"time"
 
 	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/glog"
+	"github.com/kdsmith18542/gordp/proto/mcs"
+	"github.com/kdsmith18542/gordp/proto/sec"
 	"github.com/kdsmith18542/gordp/proto/t128"
+	"github.com/kdsmith18542/gordp/proto/virtualchannel"
+	"github.com/kdsmith18542/gordp/proto/x224"
 )
 
 func (c *Client) readPdu() t128.PDU {
 	glog.Debugf("before peek")
 	defer func() { glog.Debugf("exit readPDU") }()
+	var pdu t128.PDU
+	c.applyReadDeadline()
 	d := c.stream.Peek(1)
+	c.checkInboundLength(d[0])
 	switch d[0] {
 	case 3:
 		glog.Debugf("read tpkt pdu begin")
-		return t128.ReadPDU(c.stream)
+		if data := c.readMcsData(); data != nil {
+			pdu = t128.ParsePDUWith(data, c.bulk)
+		}
 	case 0:
 		glog.Debugf("read fastpath pdu begin")
-		return t128.ReadFastPathPDU(c.stream)
+		defer c.tapRead()()
+		pdu = t128.ReadFastPathPDUSecured(c.stream, c.bulk, &c.fpFragments, c.encryption)
 	default:
 		core.Throw("invalid package")
 	}
+	c.lastRead.Store(time.Now().UnixNano())
+	c.completePing(pdu)
+	c.countFrame(pdu)
+	return pdu
+}
+
+// checkInboundLength throws a core.LengthError if the PDU about to be read,
+// starting with first, declares a length beyond Option.MaxInboundPDUSize
+func (c *Client) checkInboundLength(first byte) {
+	limit := c.option.MaxInboundPDUSize
+	if limit <= 0 {
+		return
+	}
+	var length int
+	switch first {
+	case 3:
+		length = int(binary.BigEndian.Uint16(c.stream.Peek(4)[2:])) // TPKT
+	case 0:
+		// fast-path, a PER length of one or two bytes
+		d := c.stream.Peek(2)
+		length = int(d[1])
+		if d[1]&0x80 != 0 {
+			d = c.stream.Peek(3)
+			length = int(d[1]&^0x80)<<8 | int(d[2])
+		}
+	default:
+		return
+	}
+	core.CheckLength("PDU", length, 0, limit)
+}
+
+// readMcsData reads one MCS Send Data Indication and returns its data, or
+// nil when it came on a registered static channel and was handled here
+func (c *Client) readMcsData() []byte {
+	tapped := c.tapRead()
+	channelId, data := (&mcs.ReceiveDataResponse{}).Read(c.stream)
+	tapped()
+	if c.encryption != nil {
+		_, data = sec.ReadSecured(bytes.NewReader(data), c.encryption)
+	}
+	if ch := c.staticChannel(channelId); ch != nil {
+		c.handleStaticChannelData(ch, data)
+		return nil
+	}
+	return data
+}
+
+// writeMcsData sends data on channelId in a single write, behind a security
+// header and encrypted under Standard RDP Security. Writers take turns, as
+// the server decrypts PDUs in the order they were encrypted.
+func (c *Client) writeMcsData(channelId uint16, data []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.encryption != nil {
+		buff := new(bytes.Buffer)
+		sec.WriteSecured(buff, 0, data, c.encryption)
+		data = buff.Bytes()
+	}
+	buff := new(bytes.Buffer)
+	x224.Write(buff, mcs.NewSendDataRequest(c.userId, channelId).Serialize(data))
+	c.tapPDU(DirectionOutbound, buff.Bytes())
+	_, err := c.stream.Write(buff.Bytes())
+	core.ThrowError(err)
+}
+
+// MinPDUSize is the smallest Option.MaxPDUSize honored, so a PDU still
+// carries some channel data besides its headers
+const MinPDUSize = 256
+
+// channelPDUOverhead is the most the headers of a PDU on a virtual channel
+// add to the channel data: TPKT, X.224, MCS Send Data Request, a FIPS
+// security header and CHANNEL_PDU_HEADER
+const channelPDUOverhead = 4 + 3 + 8 + 16 + 8
+
+// maxPDUSize returns the cap on the size of the PDUs sent, 0 for none
+func (c *Client) maxPDUSize() int {
+	if c.option.MaxPDUSize <= 0 {
+		return 0
+	}
+	return max(c.option.MaxPDUSize, MinPDUSize)
+}
+
+// channelChunkSize returns the most channel data one chunk carries: the
+// chunk size the server announced, CHANNEL_CHUNK_LENGTH without, within
+// Option.MaxPDUSize
+// See [MS-RDPBCGR] 3.1.5.2.1
+func (c *Client) channelChunkSize() int {
+	size := virtualchannel.CHANNEL_CHUNK_LENGTH
+	if c.serverLimits != nil && c.serverLimits.VCChunkSize != 0 {
+		size = int(c.serverLimits.VCChunkSize)
+	}
+	if limit := c.maxPDUSize(); limit != 0 {
+		size = min(size, limit-channelPDUOverhead)
+	}
+	return size
+}
+
+// directions of a PDU handed to Option.OnRawPDU
+const (
+	DirectionInbound  = "inbound"
+	DirectionOutbound = "outbound"
+)
+
+// DumpPCAP writes every PDU received or sent from now on, from the
+// capabilities exchange on, to w as a pcap capture, as TCP segments of port 3389 that Wireshark decodes as RDP,
+// until the client is closed or DumpPCAP is called again. TLS is left out,
+// so the PDUs can be read even where the connection was encrypted. A nil w
+// stops dumping.
+func (c *Client) DumpPCAP(w io.Writer) error {
+	if w == nil {
+		c.pcap.Store(nil)
+		return nil
+	}
+	pcap, err := core.NewPcapWriter(w)
+	if err != nil {
+		return err
+	}
+	c.pcap.Store(pcap)
 	return nil
 }
 
-func (c *Client) sendMouseEvent(pointerFlags uint16, xPos, yPos uint16) error {
-	pdu := t128.NewFastPathMouseInputPDU(pointerFlags, xPos, yPos)
-	data := pdu.Serialize()
-	glog.Debugf("send mouse event data: %v - %x:", len(data), data)
-	_, err := c.stream.Write(data)
+// tapping reports whether PDUs are handed to Option.OnRawPDU or DumpPCAP
+func (c *Client) tapping() bool {
+	return c.option.OnRawPDU != nil || c.pcap.Load() != nil
+}
+
+// tapRead records the PDU read until the returned func is called and then
+// taps it, even if it could not be parsed
+func (c *Client) tapRead() func() {
+	if !c.tapping() {
+		return func() {}
+	}
+	stop := c.stream.Record()
+	return func() {
+		if data := stop(); len(data) > 0 {
+			c.tapPDU(DirectionInbound, data)
+		}
+	}
+}
+
+// tapPDU hands a PDU to Option.OnRawPDU and DumpPCAP. A capture that
+// cannot be written stops.
+func (c *Client) tapPDU(direction string, data []byte) {
+	if c.option.OnRawPDU != nil {
+		c.option.OnRawPDU(direction, data)
+	}
+	if pcap := c.pcap.Load(); pcap != nil {
+		if err := pcap.WritePacket(time.Now(), direction == DirectionOutbound, data); err != nil {
+			glog.Warnf("pcap dump stopped: %v", err)
+			c.pcap.CompareAndSwap(pcap, nil)
+		}
+	}
+}
+
+// writePdu sends pdu on the global channel
+func (c *Client) writePdu(pdu t128.PDU) {
+	c.writeMcsData(mcs.MCS_CHANNEL_GLOBAL, t128.SerializePDU(c.userId, pdu))
+}
+
+// writeDataPdu sends pdu as a data PDU of the share
+func (c *Client) writeDataPdu(pdu t128.DataPDU) {
+	c.writePdu(t128.NewDataPdu(pdu, c.shareId))
+}
+
+// applyReadDeadline bounds the next PDU read by Option.ReadTimeout and by
+// the deadline of the step of the connection sequence in progress
+func (c *Client) applyReadDeadline() {
+	deadline := c.readBy
+	if c.option.ReadTimeout > 0 {
+		if d := time.Now().Add(c.option.ReadTimeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	if !deadline.IsZero() {
+		core.ThrowError(c.setReadDeadline(deadline))
+	}
+}
+
+// setReadDeadline sets the read deadline of the stream to t, or to now
+// when reads are being interrupted, see interruptReads
+func (c *Client) setReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	if c.readCtx != nil && c.readCtx.Err() != nil {
+		t = time.Now()
+	}
+	return c.stream.SetReadDeadline(t)
+}
+
+// interruptReads makes reads return at once, blocked ones included, when
+// ctx is done or the client is cancelled or closed, by moving the read
+// deadline to now. It returns a context done in either case, for
+// contextError, and a function that stops watching.
+func (c *Client) interruptReads(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	stopClient := context.AfterFunc(c.ctx, cancel)
+
+	c.deadlineMu.Lock()
+	c.readCtx = ctx
+	c.deadlineMu.Unlock()
+	stop := context.AfterFunc(ctx, func() {
+		c.deadlineMu.Lock()
+		defer c.deadlineMu.Unlock()
+		if c.readCtx == ctx {
+			_ = c.stream.SetReadDeadline(time.Now())
+		}
+	})
+	return ctx, func() {
+		stopClient()
+		stop()
+		c.deadlineMu.Lock()
+		defer c.deadlineMu.Unlock()
+		if ctx.Err() != nil {
+			// the reads were interrupted, the stream may be used again
+			_ = c.stream.SetReadDeadline(time.Time{})
+		}
+		c.readCtx = nil
+		cancel()
+	}
+}
+
+// contextError reports a read interrupted because ctx is done as ctx.Err()
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil && core.IsTimeout(err) {
+		return fmt.Errorf("%w: %w", ctx.Err(), err)
+	}
 	return err
 }
 
+// Ping measures the round-trip time to the server. RDP has no echo request,
+// so it asks the server to repaint a single pixel and the time until the
+// next update arrives is taken as the round trip; on a busy screen an
+// update already in flight may answer first. The result is reported to
+// Option.OnRoundTrip and RoundTripTime by Run.
+func (c *Client) Ping() error {
+	pdu := &t128.TsRefreshRectPDU{AreasToRefresh: []t128.TsRectangle16{{}}}
+	c.pingMu.Lock()
+	c.pingSent = time.Now()
+	c.pingMu.Unlock()
+	return core.Try(func() { c.writeDataPdu(pdu) })
+}
+
+// ErrConnectionLost is returned by Run when Option.KeepAliveInterval is set
+// and the server stops answering
+var ErrConnectionLost = errors.New("connection lost")
+
+// keepAliveMisses is how many keepalive intervals may pass without anything
+// received before the connection is considered lost
+const keepAliveMisses = 3
+
+// startKeepAlive pings the server every Option.KeepAliveInterval while a
+// session loop runs. Once nothing has been received for keepAliveMisses
+// intervals it closes the stream, so that the blocked read fails and the
+// loop ends. The returned function stops it.
+func (c *Client) startKeepAlive(ctx context.Context) (stop func()) {
+	c.connLost.Store(false)
+	interval := c.option.KeepAliveInterval
+	if interval <= 0 {
+		return func() {}
+	}
+	c.lastRead.Store(time.Now().UnixNano())
+
+	done := make(chan struct{})
+	stream := c.stream
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			idle := time.Since(time.Unix(0, c.lastRead.Load()))
+			if idle >= keepAliveMisses*interval {
+				glog.Warnf("nothing received for %v, closing the connection", idle)
+				c.connLost.Store(true)
+				stream.Close()
+				return
+			}
+			// a write blocked on a dead connection must not hold up the
+			// check above, and is abandoned when the stream is closed
+			if c.keepAlivePing.CompareAndSwap(false, true) {
+				go func() {
+					defer c.keepAlivePing.Store(false)
+					if err := c.Ping(); err != nil {
+						glog.Debugf("keepalive ping failed: %v", err)
+					}
+				}()
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// keepAliveError replaces the error of a session loop ended by the
+// keepalive with ErrConnectionLost
+func (c *Client) keepAliveError(err error) error {
+	if err != nil && c.connLost.Load() {
+		return fmt.Errorf("%w: nothing received for %v", ErrConnectionLost, keepAliveMisses*c.option.KeepAliveInterval)
+	}
+	return err
+}
+
+// RoundTripTime returns the last round-trip time measured by Ping, or zero
+// before the first answer
+func (c *Client) RoundTripTime() time.Duration {
+	c.pingMu.Lock()
+	defer c.pingMu.Unlock()
+	return c.rtt
+}
+
+// ConnectionStats is what the connection carried so far, see Stats
+type ConnectionStats struct {
+	BytesSent     uint64 // inside TLS when it protects the connection
+	BytesReceived uint64
+
+	// FramesDecoded counts the graphics updates with bitmap data, and
+	// AverageFrameSize is their encoded bitmap data in bytes on average
+	FramesDecoded    uint64
+	AverageFrameSize float64
+
+	CacheHitRate float64       // percent of bitmap cache lookups that hit
+	Uptime       time.Duration // since the connection finalization, zero when not connected
+}
+
+// Stats returns what the connection carried so far, counted as PDUs are
+// read and written. The counts start over when the client reconnects. It
+// may be called from any goroutine while Run is active.
+func (c *Client) Stats() ConnectionStats {
+	var stats ConnectionStats
+	if c.stream != nil {
+		stats.BytesReceived, stats.BytesSent = c.stream.Counts()
+	}
+	stats.FramesDecoded = c.framesDecoded.Load()
+	if stats.FramesDecoded > 0 {
+		stats.AverageFrameSize = float64(c.frameBytes.Load()) / float64(stats.FramesDecoded)
+	}
+	cache := c.bitmapCacheManager.GetCacheStats()
+	if hits, misses := cache["hits"].(int), cache["misses"].(int); hits+misses > 0 {
+		stats.CacheHitRate = float64(hits) / float64(hits+misses) * 100
+	}
+	if c.Connected() {
+		c.logonMu.Lock()
+		stats.Uptime = time.Since(c.connectedAt)
+		c.logonMu.Unlock()
+	}
+	return stats
+}
+
+// ChannelStats is what a virtual channel carried, see Client.ChannelStats
+type ChannelStats struct {
+	virtualchannel.ChannelStats
+
+	Dynamic    bool    // a dynamic channel, carried by the drdynvc static channel
+	Throughput float64 // bytes per second both ways, on average
+}
+
+// ChannelStats returns what each virtual channel carried so far, by
+// channel name: the static channels and the dynamic channels opened,
+// including those closed since. Data of dynamic channels counts on the
+// drdynvc channel as well. The counts start over when the client
+// reconnects. It may be called from any goroutine while Run is active.
+func (c *Client) ChannelStats() map[string]ChannelStats {
+	now := time.Now()
+	stats := make(map[string]ChannelStats)
+	for name, s := range c.vcManager.Stats() {
+		stats[name] = ChannelStats{ChannelStats: s, Throughput: s.Throughput(now)}
+	}
+	for name, s := range c.dvcManager.Stats() {
+		stats[name] = ChannelStats{ChannelStats: s, Dynamic: true, Throughput: s.Throughput(now)}
+	}
+	return stats
+}
+
+// countFrame counts pdu for Stats and Option.OnFrameDecoded if it is a
+// graphics update with bitmap data
+func (c *Client) countFrame(pdu t128.PDU) {
+	p, ok := pdu.(*t128.TsFpUpdatePDU)
+	if !ok {
+		return
+	}
+	size, frame := 0, false
+	switch pp := p.PDU.(type) {
+	case *t128.TsFpUpdateBitmap:
+		for _, v := range pp.Rectangles {
+			size += len(v.BitmapDataStream)
+		}
+		frame = len(pp.Rectangles) > 0
+	case *t128.TsFpUpdateSurfaceCommands:
+		for _, cmd := range pp.Commands {
+			if sc, ok := cmd.(*t128.TsSetSurfaceBitsCommand); ok {
+				size += len(sc.BitmapData.BitmapData)
+				frame = true
+			}
+		}
+	}
+	if frame {
+		c.framesDecoded.Add(1)
+		c.frameBytes.Add(uint64(size))
+		if c.option.OnFrameDecoded != nil {
+			c.option.OnFrameDecoded()
+		}
+	}
+}
+
+// completePing ends an outstanding Ping when an update arrives
+func (c *Client) completePing(pdu t128.PDU) {
+	switch p := pdu.(type) {
+	case *t128.TsFpUpdatePDU:
+	case *t128.TsDataPduData:
+		if _, ok := p.Pdu.(*t128.TsUpdatePDU); !ok {
+			return
+		}
+	default:
+		return
+	}
+
+	c.pingMu.Lock()
+	if c.pingSent.IsZero() {
+		c.pingMu.Unlock()
+		return
+	}
+	c.rtt = time.Since(c.pingSent)
+	c.pingSent = time.Time{}
+	rtt := c.rtt
+	c.pingMu.Unlock()
+
+	glog.Debugf("round-trip time: %v", rtt)
+	if c.option.OnRoundTrip != nil {
+		c.option.OnRoundTrip(rtt)
+	}
+}
+
+func (c *Client) sendMouseEvent(pointerFlags uint16, xPos, yPos uint16) error {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	return c.sendPointerEvent(pointerFlags, xPos, yPos)
+}
+
+// sendPointerEvent sends a pointer event with keyMu held
+func (c *Client) sendPointerEvent(pointerFlags uint16, xPos, yPos uint16) error {
+	glog.Debugf("send mouse event: %#x at %d,%d", pointerFlags, xPos, yPos)
+	c.pointerX, c.pointerY = xPos, yPos
+	return c.sendInputEvent(t128.NewFastPathPointerEvent(pointerFlags, xPos, yPos))
+}
+
 // SendMouseMoveEvent sends a mouse movement event
 func (c *Client) SendMouseMoveEvent(xPos, yPos uint16) error {
 	return c.sendMouseEvent(t128.PTRFLAGS_MOVE, xPos, yPos)
 }
 
-// SendMouseMoveRelative sends a relative mouse movement event
+// SendMouseMoveOnMonitor moves the mouse to a point given relative to the
+// top-left corner of one of the monitors set with Option.Monitors or
+// SetMonitors, monitorIndex being its index there. Pointer positions are
+// relative to the top-left corner of the virtual desktop spanning all
+// monitors, which need not be a monitor's corner.
+func (c *Client) SendMouseMoveOnMonitor(monitorIndex int, localX, localY uint16) error {
+	x, y, err := c.monitorToDesktop(monitorIndex, localX, localY)
+	if err != nil {
+		return err
+	}
+	return c.SendMouseMoveEvent(x, y)
+}
+
+// monitorToDesktop translates monitor-local coordinates to the virtual
+// desktop
+func (c *Client) monitorToDesktop(monitorIndex int, localX, localY uint16) (uint16, uint16, error) {
+	if monitorIndex < 0 || monitorIndex >= len(c.monitors) {
+		return 0, 0, fmt.Errorf("unknown monitor %d of %d", monitorIndex, len(c.monitors))
+	}
+	m := c.monitors[monitorIndex]
+	if int32(localX) > m.Right-m.Left || int32(localY) > m.Bottom-m.Top {
+		return 0, 0, fmt.Errorf("point %d,%d outside monitor %d of %dx%d",
+			localX, localY, monitorIndex, m.Right-m.Left+1, m.Bottom-m.Top+1)
+	}
+	left, top := m.Left, m.Top
+	for _, other := range c.monitors {
+		left, top = min(left, other.Left), min(top, other.Top)
+	}
+	return uint16(m.Left - left + int32(localX)), uint16(m.Top - top + int32(localY)), nil
+}
+
+// ErrRelativeMouseUnsupported is returned by SetRelativeMouseMode when the
+// server does not take relative pointer events
+var ErrRelativeMouseUnsupported = errors.New("server does not support relative mouse events")
+
+// SetRelativeMouseMode makes SendMouseRelative send the distances it is
+// given as they are, as games and other applications that capture the
+// pointer expect, instead of moving the pointer to a position. The server
+// announces whether it takes such events during Connect; if it does not,
+// enabling returns ErrRelativeMouseUnsupported and the client stays in
+// absolute mode, where SendMouseRelative still moves the pointer by the
+// distance but stops at the edges of the desktop.
+func (c *Client) SetRelativeMouseMode(enabled bool) error {
+	if enabled && !c.relativeMouse {
+		return ErrRelativeMouseUnsupported
+	}
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	c.relativeMode = enabled
+	return nil
+}
+
+// RelativeMouseMode reports whether SendMouseRelative sends relative
+// pointer events
+func (c *Client) RelativeMouseMode() bool {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	return c.relativeMode
+}
+
+// SendMouseRelative moves the pointer by dx, dy. See SetRelativeMouseMode.
+func (c *Client) SendMouseRelative(dx, dy int16) error {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	if c.relativeMode {
+		return c.sendInputEvent(t128.NewFastPathRelPointerEvent(t128.PTRFLAGS_MOVE, dx, dy))
+	}
+	maxX, maxY := int32(math.MaxUint16), int32(math.MaxUint16)
+	if c.desktopWidth != 0 && c.desktopHeight != 0 {
+		maxX, maxY = int32(c.desktopWidth)-1, int32(c.desktopHeight)-1
+	}
+	x := min(max(int32(c.pointerX)+int32(dx), 0), maxX)
+	y := min(max(int32(c.pointerY)+int32(dy), 0), maxY)
+	return c.sendPointerEvent(t128.PTRFLAGS_MOVE, uint16(x), uint16(y))
+}
+
+// SendMouseMoveRelative moves the pointer by deltaX, deltaY, as
+// SendMouseRelative does
 func (c *Client) SendMouseMoveRelative(deltaX, deltaY int16) error {
-	// For relative movement, we need to calculate the new position
-	// This is a simplified implementation - in a full implementation,
-	// you would track the current mouse position
-	return c.sendMouseEvent(t128.PTRFLAGS_MOVE, uint16(deltaX), uint16(deltaY))
+	return c.SendMouseRelative(deltaX, deltaY)
 }
 
 // SendMouseLeftDownEvent sends a left mouse button down event
@@ -142,18 +671,12 @@ func (c *Client) SendMouseButtonEvent(button t128.MouseButton, down bool, xPos,
 
 // SendMouseWheelEvent sends a vertical mouse wheel event
 func (c *Client) SendMouseWheelEvent(wheelDelta int16, xPos, yPos uint16) error {
-	event := t128.NewFastPathMouseWheelEvent(wheelDelta, xPos, yPos)
-	data := event.Serialize()
-	_, err := c.stream.Write(data)
-	return err
+	return c.sendInputEvent(t128.NewFastPathMouseWheelEvent(wheelDelta, xPos, yPos))
 }
 
 // SendMouseHorizontalWheelEvent sends a horizontal mouse wheel event
 func (c *Client) SendMouseHorizontalWheelEvent(wheelDelta int16, xPos, yPos uint16) error {
-	event := t128.NewFastPathMouseHorizontalWheelEvent(wheelDelta, xPos, yPos)
-	data := event.Serialize()
-	_, err := c.stream.Write(data)
-	return err
+	return c.sendInputEvent(t128.NewFastPathMouseHorizontalWheelEvent(wheelDelta, xPos, yPos))
 }
 
 // SendMouseDoubleClickEvent sends a double-click event for the specified button
@@ -252,3 +775,179 @@ func (c *Client) SendMouseScrollEvent(direction t128.ScrollDirection, amount int
 
 	return c.SendMouseWheelEvent(wheelDelta, xPos, yPos)
 }
+
+// DefaultLogonTimeout is the LogonTimeout used when the option is not set
+var DefaultLogonTimeout = 10 * time.Second
+
+// LogonInfo is a logon, or a logon error or warning, reported by the server
+type LogonInfo struct {
+	InfoType   uint32 // t128.INFOTYPE_*
+	SessionId  uint32
+	Domain     string
+	UserName   string
+	ReceivedAt time.Time
+
+	// Error is the logon error or warning of t128.INFOTYPE_LOGON_EXTENDED_INFO
+	// notifications, e.g. a wrong password or one about to expire, nil if
+	// there is none
+	Error *t128.TsLogonErrorsInfo
+}
+
+// OnLogonInfo registers fn to be called from Run with every logon
+// notification of the server: the logon itself, with the account logged on
+// to when the server tells it, and logon errors and warnings. Only logons
+// are kept for LogonInfo.
+func (c *Client) OnLogonInfo(fn func(info LogonInfo)) {
+	c.logonMu.Lock()
+	defer c.logonMu.Unlock()
+	c.onLogonInfo = fn
+}
+
+// LogonInfo returns the logon reported by the server, or nil if none has
+// been received yet. Plain notifications carry no account details.
+func (c *Client) LogonInfo() *LogonInfo {
+	c.logonMu.Lock()
+	defer c.logonMu.Unlock()
+	if c.logonInfo == nil {
+		return nil
+	}
+	info := *c.logonInfo
+	return &info
+}
+
+// IsAtLogonScreen reports whether the session appears to be waiting at the
+// logon screen, e.g. because auto-logon failed: the connection has been up
+// for Option.LogonTimeout without the server reporting a logon. This relies
+// on the server sending logon notifications (requested by the client info
+// flags), not on looking at the screen. Automation can use it to decide
+// whether to type credentials.
+func (c *Client) IsAtLogonScreen() bool {
+	timeout := c.option.LogonTimeout
+	if timeout == 0 {
+		timeout = DefaultLogonTimeout
+	}
+	c.logonMu.Lock()
+	defer c.logonMu.Unlock()
+	if c.logonInfo != nil || c.connectedAt.IsZero() {
+		return false
+	}
+	return time.Since(c.connectedAt) >= timeout
+}
+
+func (c *Client) handleSaveSessionInfo(pdu *t128.TsSaveSessionInfoPDU) {
+	if !pdu.IsLogon() && pdu.InfoType != t128.INFOTYPE_LOGON_EXTENDED_INFO {
+		glog.Debugf("save session info type %d", pdu.InfoType)
+		return
+	}
+	account, err := pdu.LogonInfo()
+	if err != nil {
+		glog.Warnf("invalid logon info: %v", err)
+	}
+	info := LogonInfo{
+		InfoType:   pdu.InfoType,
+		SessionId:  account.SessionId,
+		Domain:     account.Domain,
+		UserName:   account.UserName,
+		ReceivedAt: time.Now(),
+		Error:      account.Error,
+	}
+	if info.Error != nil {
+		glog.Infof("logon error reported: %s", info.Error)
+	} else {
+		glog.Debugf("logon reported, type %d, session %d", pdu.InfoType, account.SessionId)
+	}
+
+	c.logonMu.Lock()
+	if pdu.IsLogon() {
+		stored := info
+		c.logonInfo = &stored
+	}
+	onLogonInfo := c.onLogonInfo
+	c.logonMu.Unlock()
+	if onLogonInfo != nil {
+		onLogonInfo(info)
+	}
+}
+
+// OnBeep registers fn to be called from Run when the server plays a beep,
+// with its frequency in hertz and its duration in milliseconds, so a
+// front-end can sound the bell of the remote session
+func (c *Client) OnBeep(fn func(frequency, durationMs uint32)) {
+	c.onBeep = fn
+}
+
+func (c *Client) handlePlaySound(pdu *t128.TsPlaySoundPDU) {
+	glog.Debugf("beep at %d Hz for %d ms", pdu.Frequency, pdu.Duration)
+	if c.onBeep != nil {
+		c.onBeep(pdu.Frequency, pdu.Duration)
+	}
+}
+
+// handleSetErrorInfo keeps the reason the server gives for ending the
+// session, to report it when the connection goes down
+func (c *Client) handleSetErrorInfo(pdu *t128.TsSetErrorInfoPDU) {
+	c.errorInfo = *pdu
+	if pdu.ErrorInfo == t128.ERRINFO_NONE {
+		return
+	}
+	glog.Infof("server disconnect reason %#x: %s", pdu.ErrorInfo, pdu.Reason())
+	if c.option.OnDisconnectReason != nil {
+		c.option.OnDisconnectReason(pdu.ErrorInfo, pdu.Reason())
+	}
+}
+
+// DisconnectInfo tells Option.OnDisconnect why a session ended
+type DisconnectInfo struct {
+	// ErrorInfo is the last code the server sent in a Set Error Info PDU,
+	// t128.ERRINFO_NONE if it sent none
+	ErrorInfo uint32
+
+	// Reason describes ErrorInfo
+	Reason string
+
+	// ReconnectExpected is set when the server ended the session for a
+	// reason the session survives, so connecting again resumes it
+	ReconnectExpected bool
+
+	// Err is the error the session loop stopped with. A disconnect
+	// announced by the server is a *mcs.DisconnectUltimatumError, wrapped
+	// in an *ErrServerDisconnect when the server sent an error info code.
+	Err error
+}
+
+// reconnectAfter handles the end of a session loop. It reports the
+// disconnect and, when the server expects it and Option.AutoReconnect is
+// set, reconnects. A nil result means the session is running again.
+func (c *Client) reconnectAfter(ctx context.Context, err error) error {
+	if ctx.Err() != nil || c.ctx.Err() != nil {
+		return err
+	}
+
+	info := DisconnectInfo{
+		ErrorInfo:         c.errorInfo.ErrorInfo,
+		Reason:            c.errorInfo.Reason(),
+		ReconnectExpected: c.errorInfo.ReconnectExpected(),
+		Err:               err,
+	}
+	glog.Debugf("disconnected, error info %#x: %v", info.ErrorInfo, err)
+	if c.option.OnDisconnect != nil {
+		c.option.OnDisconnect(info)
+	}
+	if !info.ReconnectExpected || !c.option.AutoReconnect {
+		return err
+	}
+
+	glog.Infof("server expects a reconnect (error info %#x), reconnecting", info.ErrorInfo)
+	if c.stream != nil {
+		c.stream.Close()
+	}
+	c.errorInfo = t128.TsSetErrorInfoPDU{}
+	c.palette = nil
+	c.logonMu.Lock()
+	c.logonInfo = nil
+	c.logonMu.Unlock()
+	if rerr := c.connect(); rerr != nil {
+		return fmt.Errorf("auto-reconnect failed: %w", rerr)
+	}
+	return nil
+}
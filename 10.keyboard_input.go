@@ -1,75 +1,327 @@
 package gordp
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf16"
 
 	"github.com/kdsmith18542/gordp/proto/t128"
 )
 
 // SendKeyEvent sends a keyboard event to the RDP server.
 func (c *Client) SendKeyEvent(keyCode uint8, down bool, modifiers t128.ModifierKey) error {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
 	// Handle modifier keys first if needed
-	if modifiers.Shift {
-		event := t128.NewFastPathKeyboardEvent(t128.VK_SHIFT, true)
-		if err := c.sendInputEvent(event); err != nil {
-			return err
+	for _, m := range modifierVKs {
+		if *m.flag(&modifiers) {
+			if err := c.sendVirtualKey(m.vk, true); err != nil {
+				return err
+			}
 		}
 	}
-	if modifiers.Control {
-		event := t128.NewFastPathKeyboardEvent(t128.VK_CONTROL, true)
-		if err := c.sendInputEvent(event); err != nil {
-			return err
+
+	// Send the actual key event
+	if err := c.sendVirtualKey(keyCode, down); err != nil {
+		return err
+	}
+	if down {
+		c.trackToggleKey(keyCode)
+	}
+
+	// Release modifier keys if they were pressed
+	for _, m := range modifierVKs {
+		if *m.flag(&modifiers) {
+			_ = c.sendVirtualKey(m.vk, false) // Best effort
 		}
 	}
-	if modifiers.Alt {
-		event := t128.NewFastPathKeyboardEvent(t128.VK_MENU, true)
-		if err := c.sendInputEvent(event); err != nil {
+
+	return nil
+}
+
+// SendKeyPress sends a key press and release event.
+func (c *Client) SendKeyPress(keyCode uint8, modifiers t128.ModifierKey) error {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	if err := c.sendKeyDown(keyCode, modifiers); err != nil {
+		return err
+	}
+	return c.sendKeyUp(keyCode)
+}
+
+// modifierVK ties a modifier flag to the virtual key that holds it
+type modifierVK struct {
+	vk   uint8
+	flag func(m *t128.ModifierKey) *bool
+}
+
+var modifierVKs = []modifierVK{
+	{t128.VK_SHIFT, func(m *t128.ModifierKey) *bool { return &m.Shift }},
+	{t128.VK_CONTROL, func(m *t128.ModifierKey) *bool { return &m.Control }},
+	{t128.VK_MENU, func(m *t128.ModifierKey) *bool { return &m.Alt }},
+	{t128.VK_LWIN, func(m *t128.ModifierKey) *bool { return &m.Meta }},
+}
+
+// modifierFlag returns the modifier flag a virtual key controls, if any
+func modifierFlag(m *t128.ModifierKey, vk uint8) *bool {
+	switch vk {
+	case t128.VK_SHIFT, t128.VK_LSHIFT, t128.VK_RSHIFT:
+		return &m.Shift
+	case t128.VK_CONTROL, t128.VK_LCONTROL, t128.VK_RCONTROL:
+		return &m.Control
+	case t128.VK_MENU, t128.VK_LMENU, t128.VK_RMENU:
+		return &m.Alt
+	case t128.VK_LWIN, t128.VK_RWIN:
+		return &m.Meta
+	}
+	return nil
+}
+
+// SendKeyDown presses a key and keeps it held until SendKeyUp. Modifiers in
+// mod that are not already held are pressed first and released again by the
+// matching SendKeyUp.
+func (c *Client) SendKeyDown(vk uint8, mod t128.ModifierKey) error {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	return c.sendKeyDown(vk, mod)
+}
+
+func (c *Client) sendKeyDown(vk uint8, mod t128.ModifierKey) error {
+	added := c.pressedKeys[vk] // keep what an earlier down (auto-repeat) pressed
+	for _, m := range modifierVKs {
+		if !*m.flag(&mod) || *m.flag(&c.modifierKeys) {
+			continue
+		}
+		if err := c.sendVirtualKey(m.vk, true); err != nil {
 			return err
 		}
+		*m.flag(&c.modifierKeys) = true
+		*m.flag(&added) = true
+	}
+
+	if err := c.sendVirtualKey(vk, true); err != nil {
+		return err
+	}
+	if flag := modifierFlag(&c.modifierKeys, vk); flag != nil {
+		*flag = true
 	}
-	if modifiers.Meta {
-		event := t128.NewFastPathKeyboardEvent(t128.VK_LWIN, true)
-		if err := c.sendInputEvent(event); err != nil {
+	if _, held := c.pressedKeys[vk]; !held {
+		c.trackToggleKey(vk) // auto-repeat does not toggle again
+	}
+	c.pressedKeys[vk] = added
+	return nil
+}
+
+// SendKeyUp releases a key pressed with SendKeyDown, along with the modifiers
+// that were pressed for it.
+func (c *Client) SendKeyUp(vk uint8) error {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	return c.sendKeyUp(vk)
+}
+
+func (c *Client) sendKeyUp(vk uint8) error {
+	if err := c.sendVirtualKey(vk, false); err != nil {
+		return err
+	}
+	if flag := modifierFlag(&c.modifierKeys, vk); flag != nil {
+		*flag = false
+	}
+	added := c.pressedKeys[vk]
+	delete(c.pressedKeys, vk)
+
+	for i := len(modifierVKs) - 1; i >= 0; i-- {
+		m := modifierVKs[i]
+		if !*m.flag(&added) || !*m.flag(&c.modifierKeys) {
+			continue
+		}
+		if err := c.sendVirtualKey(m.vk, false); err != nil {
 			return err
 		}
+		*m.flag(&c.modifierKeys) = false
 	}
+	return nil
+}
 
-	// Send the actual key event
-	event := t128.NewFastPathKeyboardEvent(keyCode, down)
-	if err := c.sendInputEvent(event); err != nil {
-		return err
+// sendVirtualKey presses or releases the key of the virtual key code vk,
+// sending its scancode
+func (c *Client) sendVirtualKey(vk uint8, down bool) error {
+	event, ok := t128.NewFastPathVirtualKeyEvent(vk, down)
+	if !ok {
+		return fmt.Errorf("virtual key %#x: no scancode", vk)
 	}
+	return c.sendInputEvent(event)
+}
 
-	// Release modifier keys if they were pressed
-	if modifiers.Shift {
-		event := t128.NewFastPathKeyboardEvent(t128.VK_SHIFT, false)
-		_ = c.sendInputEvent(event) // Best effort
+// ReleaseAllKeys releases every key and modifier the client believes is held,
+// e.g. when the front-end loses focus and key-up events may have been lost.
+func (c *Client) ReleaseAllKeys() error {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	var firstErr error
+	release := func(vk uint8) {
+		if err := c.sendVirtualKey(vk, false); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	if modifiers.Control {
-		event := t128.NewFastPathKeyboardEvent(t128.VK_CONTROL, false)
-		_ = c.sendInputEvent(event) // Best effort
+	for vk := range c.pressedKeys {
+		if modifierFlag(&t128.ModifierKey{}, vk) == nil {
+			release(vk)
+		}
 	}
-	if modifiers.Alt {
-		event := t128.NewFastPathKeyboardEvent(t128.VK_MENU, false)
-		_ = c.sendInputEvent(event) // Best effort
+	for vk := range c.pressedKeys {
+		if modifierFlag(&t128.ModifierKey{}, vk) != nil {
+			release(vk)
+		}
 	}
-	if modifiers.Meta {
-		event := t128.NewFastPathKeyboardEvent(t128.VK_LWIN, false)
-		_ = c.sendInputEvent(event) // Best effort
+	for i := len(modifierVKs) - 1; i >= 0; i-- {
+		m := modifierVKs[i]
+		if *m.flag(&c.modifierKeys) {
+			release(m.vk)
+		}
 	}
+	c.pressedKeys = make(map[uint8]t128.ModifierKey)
+	c.modifierKeys = t128.ModifierKey{}
+	return firstErr
+}
 
-	return nil
+// ToggleKeys is the state of the lock keys on the server
+type ToggleKeys struct {
+	CapsLock   bool
+	NumLock    bool
+	ScrollLock bool
 }
 
-// SendKeyPress sends a key press and release event.
-func (c *Client) SendKeyPress(keyCode uint8, modifiers t128.ModifierKey) error {
-	if err := c.SendKeyEvent(keyCode, true, modifiers); err != nil {
+// flags returns the sync event flags of the keys that are on
+func (k ToggleKeys) flags() uint8 {
+	var flags uint8
+	if k.CapsLock {
+		flags |= t128.FASTPATH_INPUT_SYNC_CAPS_LOCK
+	}
+	if k.NumLock {
+		flags |= t128.FASTPATH_INPUT_SYNC_NUM_LOCK
+	}
+	if k.ScrollLock {
+		flags |= t128.FASTPATH_INPUT_SYNC_SCROLL_LOCK
+	}
+	return flags
+}
+
+// SyncToggleKeys sets CapsLock, NumLock and ScrollLock on the server, e.g.
+// to match the keyboard of the front-end. The server also takes every key
+// to be released, so the client forgets the keys it held.
+func (c *Client) SyncToggleKeys(caps, num, scroll bool) error {
+	return c.syncToggleKeys(ToggleKeys{CapsLock: caps, NumLock: num, ScrollLock: scroll})
+}
+
+func (c *Client) syncToggleKeys(keys ToggleKeys) error {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	if err := c.sendInputEvent(t128.NewFastPathSyncEvent(keys.flags())); err != nil {
 		return err
 	}
-	return c.SendKeyEvent(keyCode, false, modifiers)
+	c.setToggleKeys(keys)
+	c.pressedKeys = make(map[uint8]t128.ModifierKey)
+	c.modifierKeys = t128.ModifierKey{}
+	return nil
+}
+
+// ToggleKeys returns the lock keys the client believes are on, as last
+// synchronized or reported by the server and switched by key presses since
+func (c *Client) ToggleKeys() ToggleKeys {
+	c.toggleMu.Lock()
+	defer c.toggleMu.Unlock()
+	return c.toggleKeys
+}
+
+func (c *Client) setToggleKeys(keys ToggleKeys) {
+	c.toggleMu.Lock()
+	defer c.toggleMu.Unlock()
+	c.toggleKeys = keys
+}
+
+// OnKeyboardIndicators registers fn to be called with the lock keys that
+// are on whenever the server reports its keyboard LEDs, e.g. after a sync or
+// a lock key press, so a front-end can show the actual state. ToggleKeys
+// follows the reports too.
+func (c *Client) OnKeyboardIndicators(fn func(caps, num, scroll bool)) {
+	c.onIndicators = fn
+}
+
+func (c *Client) handleKeyboardIndicators(pdu *t128.TsSetKeyboardIndicatorsPDU) {
+	keys := ToggleKeys{
+		CapsLock:   pdu.LedFlags&t128.TS_SYNC_CAPS_LOCK != 0,
+		NumLock:    pdu.LedFlags&t128.TS_SYNC_NUM_LOCK != 0,
+		ScrollLock: pdu.LedFlags&t128.TS_SYNC_SCROLL_LOCK != 0,
+	}
+	c.setToggleKeys(keys)
+	if c.onIndicators != nil {
+		c.onIndicators(keys.CapsLock, keys.NumLock, keys.ScrollLock)
+	}
+}
+
+// trackToggleKey switches the recorded state of a lock key pressed down
+func (c *Client) trackToggleKey(vk uint8) {
+	c.toggleMu.Lock()
+	defer c.toggleMu.Unlock()
+	switch vk {
+	case t128.VK_CAPITAL:
+		c.toggleKeys.CapsLock = !c.toggleKeys.CapsLock
+	case t128.VK_NUMLOCK:
+		c.toggleKeys.NumLock = !c.toggleKeys.NumLock
+	case t128.VK_SCROLL:
+		c.toggleKeys.ScrollLock = !c.toggleKeys.ScrollLock
+	}
+}
+
+// ModifierState is a snapshot of the modifier keys held on the server
+type ModifierState t128.ModifierKey
+
+// SaveModifierState returns the modifiers currently held, to be restored with
+// RestoreModifierState once a nested sequence of key events is done.
+func (c *Client) SaveModifierState() ModifierState {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	return ModifierState(c.modifierKeys)
+}
+
+// RestoreModifierState presses and releases modifiers until exactly those in
+// state are held. Modifiers are released before any is pressed, so a
+// shortcut is never formed by accident.
+func (c *Client) RestoreModifierState(state ModifierState) error {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	target := t128.ModifierKey(state)
+	for i := len(modifierVKs) - 1; i >= 0; i-- {
+		m := modifierVKs[i]
+		if !*m.flag(&c.modifierKeys) || *m.flag(&target) {
+			continue
+		}
+		if err := c.sendVirtualKey(m.vk, false); err != nil {
+			return err
+		}
+		*m.flag(&c.modifierKeys) = false
+		// the modifier is up now, whichever key held it
+		for vk := range c.pressedKeys {
+			if flag := modifierFlag(&c.modifierKeys, vk); flag == m.flag(&c.modifierKeys) {
+				delete(c.pressedKeys, vk)
+			}
+		}
+	}
+	for _, m := range modifierVKs {
+		if *m.flag(&c.modifierKeys) || !*m.flag(&target) {
+			continue
+		}
+		if err := c.sendVirtualKey(m.vk, true); err != nil {
+			return err
+		}
+		*m.flag(&c.modifierKeys) = true
+		c.pressedKeys[m.vk] = t128.ModifierKey{}
+	}
+	return nil
 }
 
 // SendString sends a string of characters as key events.
@@ -167,48 +419,94 @@ func (c *Client) SendKeyCombo(keyCode uint8, ctrl, alt, shift, meta bool) error
 	return c.SendKeyPress(keyCode, modifiers)
 }
 
-// SendUnicodeString sends a Unicode string with proper IME support
+// SendUnicodeString types text as Unicode keyboard events, so it comes out
+// the same whatever the keyboard layout of the session. It is
+// PasteText without options.
 func (c *Client) SendUnicodeString(text string) error {
-	for _, char := range text {
-		// Handle Unicode characters that might need special handling
-		if char > 127 {
-			// For extended Unicode characters, we might need to use Unicode input
-			// This is a simplified implementation - in a full implementation,
-			// you would need to handle IME and Unicode input properly
-			if err := c.SendUnicodeChar(char); err != nil {
-				return err
-			}
-		} else {
-			// Use regular ASCII input for basic characters
-			if err := c.SendString(string(char)); err != nil {
-				return err
-			}
-		}
-	}
-	return nil
+	return c.PasteText(text, PasteOptions{})
 }
 
-// SendUnicodeChar sends a single Unicode character
+// SendUnicodeChar types a single character as Unicode keyboard events
 func (c *Client) SendUnicodeChar(char rune) error {
-	// This is a simplified implementation
-	// In a full implementation, you would need to handle IME and Unicode input
-	// For now, we'll try to map it to available keys or skip it
-	keyCode, ok := t128.KeyMap[char]
-	if !ok {
-		// Try uppercase version
-		keyCode, ok = t128.KeyMap[unicode.ToUpper(char)]
-		if !ok {
-			// Skip unsupported Unicode characters
+	return c.PasteText(string(char), PasteOptions{})
+}
+
+// PasteOptions tune how PasteText types text
+type PasteOptions struct {
+	// Delay, if set, is waited between characters, for applications that
+	// drop input arriving faster. Zero sends the whole text at once, in as
+	// few Fast-Path input PDUs as it fits in.
+	Delay time.Duration
+}
+
+// PasteText types s into the session as Unicode keyboard events, e.g. to
+// fill in forms. Tabs and line breaks press the Tab and Enter keys instead,
+// so they move between fields and submit as typed ones would. Characters
+// outside the Basic Multilingual Plane are sent as surrogate pairs.
+// Input held back by Option.InputFlushInterval is flushed first.
+func (c *Client) PasteText(s string, opts PasteOptions) error {
+	chars := pasteEvents(s)
+	if c.option.InputFlushInterval > 0 {
+		if err := c.FlushInput(); err != nil {
+			return err
+		}
+	}
+
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	if opts.Delay <= 0 {
+		var events []t128.TsFpInputEvent
+		for _, char := range chars {
+			events = append(events, char...)
+		}
+		if len(events) == 0 {
 			return nil
 		}
+		return c.writeInputEvents(events)
 	}
 
-	modifiers := t128.ModifierKey{}
-	if unicode.IsUpper(char) {
-		modifiers.Shift = true
+	timer := time.NewTimer(opts.Delay)
+	defer timer.Stop()
+	for i, char := range chars {
+		if i > 0 {
+			timer.Reset(opts.Delay)
+			select {
+			case <-timer.C:
+			case <-c.ctx.Done():
+				return c.ctx.Err()
+			}
+		}
+		if err := c.writeInputEvents(char); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return c.SendKeyPress(keyCode, modifiers)
+// pasteEvents returns the events that type each character of s: a press
+// and release of every UTF-16 code unit, or of the Tab or Enter key
+func pasteEvents(s string) [][]t128.TsFpInputEvent {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	chars := make([][]t128.TsFpInputEvent, 0, len(s))
+	for _, char := range s {
+		var events []t128.TsFpInputEvent
+		switch char {
+		case '\t', '\n', '\r':
+			key, _ := t128.ScanCodeLayoutUS.Lookup(char)
+			events = []t128.TsFpInputEvent{
+				t128.NewFastPathScanCodeEvent(key.ScanCode, true, false),
+				t128.NewFastPathScanCodeEvent(key.ScanCode, false, false),
+			}
+		default:
+			for _, code := range utf16.Encode([]rune{char}) {
+				events = append(events,
+					t128.NewFastPathUnicodeEvent(code, true),
+					t128.NewFastPathUnicodeEvent(code, false))
+			}
+		}
+		chars = append(chars, events)
+	}
+	return chars
 }
 
 // SendExtendedKey sends an extended key with proper scancode handling
@@ -380,24 +678,176 @@ func (c *Client) SendKeyRepeat(keyCode uint8, count int, modifiers t128.Modifier
 	return nil
 }
 
-// sendInputEvent sends a single input event to the server.
+// SendScanCode sends a raw keyboard scancode, bypassing virtual key mapping.
+// A 0xE0 or 0xE1 prefix in the high byte implies the matching extended flag.
+func (c *Client) SendScanCode(code uint16, down bool, extended bool) error {
+	return c.sendInputEvent(t128.NewFastPathScanCodeEvent(code, down, extended))
+}
+
+// SendStringWithLayout types text by pressing the physical keys that produce
+// each character on layout. Unlike SendString this works for non-US layouts,
+// as long as layout matches the keyboard layout of the remote session.
+func (c *Client) SendStringWithLayout(text string, layout *t128.ScanCodeLayout) error {
+	if layout == nil {
+		return fmt.Errorf("keyboard layout must be non-nil")
+	}
+
+	// Resolve every character first so nothing is typed on failure
+	keys := make([]t128.ScanCodeKey, 0, len(text))
+	for _, char := range text {
+		key, ok := layout.Lookup(char)
+		if !ok {
+			return fmt.Errorf("character %q is not on the %s keyboard layout", char, layout.Name)
+		}
+		keys = append(keys, key)
+	}
+
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	for _, key := range keys {
+		if err := c.sendScanCodeKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendScanCodeKey presses and releases a layout key with its modifiers held
+func (c *Client) sendScanCodeKey(key t128.ScanCodeKey) error {
+	send := func(code uint16, down bool) error {
+		return c.sendInputEvent(t128.NewFastPathScanCodeEvent(code, down, false))
+	}
+	var modifiers []uint16
+	if key.Shift {
+		modifiers = append(modifiers, t128.SCANCODE_LSHIFT)
+	}
+	if key.AltGr {
+		modifiers = append(modifiers, t128.SCANCODE_ALTGR)
+	}
+
+	for _, m := range modifiers {
+		if err := send(m, true); err != nil {
+			return err
+		}
+	}
+	if err := send(key.ScanCode, true); err != nil {
+		return err
+	}
+	if err := send(key.ScanCode, false); err != nil {
+		return err
+	}
+	for i := len(modifiers) - 1; i >= 0; i-- {
+		if err := send(modifiers[i], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxInputEvents is the most events a Fast-Path input PDU counts in its
+// header
+const maxInputEvents = 15
+
+// sendInputEvent sends an input event to the server, or queues it for the
+// next flush if Option.InputFlushInterval is set
 func (c *Client) sendInputEvent(event t128.TsFpInputEvent) error {
-	pdu := &t128.TsFpInputPdu{
-		Header: t128.FpInputHeader{
-			NumEvents: 1,
-		},
-		NumEvents:     1,
-		FpInputEvents: []t128.TsFpInputEvent{event},
+	if c.option.InputFlushInterval <= 0 {
+		return c.writeInputEvents([]t128.TsFpInputEvent{event})
+	}
+	c.inputMu.Lock()
+	defer c.inputMu.Unlock()
+	if err := c.inputErr; err != nil {
+		c.inputErr = nil
+		return err
+	}
+	if n := len(c.inputQueue); n > 0 && mergeInput(c.inputQueue[n-1], event) {
+		c.inputQueue[n-1] = event
+	} else {
+		c.inputQueue = append(c.inputQueue, event)
+	}
+	if c.inputTimer == nil {
+		c.inputTimer = time.AfterFunc(c.option.InputFlushInterval, c.flushInputLater)
 	}
+	return nil
+}
 
+// FlushInput sends the input held back by Option.InputFlushInterval right
+// away, e.g. before waiting for the server to react to it. It also returns
+// the error of an earlier flush that failed.
+func (c *Client) FlushInput() error {
+	c.inputMu.Lock()
+	defer c.inputMu.Unlock()
+	if c.inputTimer != nil {
+		c.inputTimer.Stop()
+		c.inputTimer = nil
+	}
+	err := c.inputErr
+	c.inputErr = nil
+	if len(c.inputQueue) > 0 {
+		err = errors.Join(err, c.writeInputEvents(c.inputQueue))
+		c.inputQueue = nil
+	}
+	return err
+}
+
+// flushInputLater flushes the queued input when the flush interval ends
+func (c *Client) flushInputLater() {
+	c.inputMu.Lock()
+	defer c.inputMu.Unlock()
+	c.inputTimer = nil
+	if len(c.inputQueue) == 0 {
+		return
+	}
+	if err := c.writeInputEvents(c.inputQueue); err != nil {
+		c.inputErr = err
+	}
+	c.inputQueue = nil
+}
+
+// writeInputEvents sends the events in as few Fast-Path input PDUs as they
+// fit in, with a single write
+func (c *Client) writeInputEvents(events []t128.TsFpInputEvent) error {
 	// Get the current stream
 	stream := c.stream
 	if stream == nil {
 		return fmt.Errorf("no active connection")
 	}
 
-	// Serialize and send the PDU
-	data := pdu.Serialize()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	var data []byte
+	for len(events) > 0 {
+		n := min(len(events), maxInputEvents)
+		pdu := &t128.TsFpInputPdu{FpInputEvents: events[:n]}
+		serialized := pdu.SerializeEncrypted(c.encryption)
+		c.tapPDU(DirectionOutbound, serialized)
+		data = append(data, serialized...)
+		events = events[n:]
+	}
 	_, err := stream.Write(data)
 	return err
 }
+
+// mergeInput reports whether event can replace the queued last one, which
+// is the case for two pointer moves: the server only needs where the
+// pointer ended up, or how far it went in all. A relative move is updated to
+// cover both.
+func mergeInput(last, event t128.TsFpInputEvent) bool {
+	switch e := event.(type) {
+	case *t128.TsFpPointerEvent:
+		l, ok := last.(*t128.TsFpPointerEvent)
+		return ok && l.PointerFlags == t128.PTRFLAGS_MOVE && e.PointerFlags == t128.PTRFLAGS_MOVE
+	case *t128.TsFpRelPointerEvent:
+		l, ok := last.(*t128.TsFpRelPointerEvent)
+		if !ok || l.PointerFlags != t128.PTRFLAGS_MOVE || e.PointerFlags != t128.PTRFLAGS_MOVE {
+			return false
+		}
+		x, y := int32(l.XDelta)+int32(e.XDelta), int32(l.YDelta)+int32(e.YDelta)
+		if x != int32(int16(x)) || y != int32(int16(y)) {
+			return false
+		}
+		e.XDelta, e.YDelta = int16(x), int16(y)
+		return true
+	}
+	return false
+}
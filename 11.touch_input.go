@@ -0,0 +1,17 @@
+package gordp
+
+import (
+	"github.com/kdsmith18542/gordp/proto/rdpei"
+)
+
+// SendTouchFrame sends one frame of multi-touch contacts over the RDPEI
+// channel. It returns rdpei.ErrNotReady until the server has opened the
+// channel, in which case callers may fall back to mouse events.
+func (c *Client) SendTouchFrame(contacts []rdpei.TouchContact) error {
+	return c.touchManager.SendTouchFrame(contacts)
+}
+
+// TouchReady reports whether the server accepts multi-touch input
+func (c *Client) TouchReady() bool {
+	return c.touchManager.Ready()
+}
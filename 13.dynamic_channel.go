@@ -0,0 +1,367 @@
+package gordp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/kdsmith18542/gordp/glog"
+	"github.com/kdsmith18542/gordp/proto/drdynvc"
+	"github.com/kdsmith18542/gordp/proto/virtualchannel"
+)
+
+// ErrDynamicChannelClosed is returned when sending on a dynamic channel
+// that is not open, either not yet or no more
+var ErrDynamicChannelClosed = errors.New("dynamic channel not open")
+
+// ErrDynamicChannelOverrun is returned by the Read of a channel dialed with
+// DialDynamicChannel that was closed because its reader fell behind
+var ErrDynamicChannelOverrun = errors.New("dynamic channel reader fell behind")
+
+// maxDialedChannelBuffer is how much data received on a channel dialed with
+// DialDynamicChannel is kept for its reader
+const maxDialedChannelBuffer = 4 << 20
+
+// DynamicChannel is a dynamic virtual channel the server creates for a
+// listener of the client, see OpenDynamicChannel, e.g. for a companion
+// application on the server
+type DynamicChannel struct {
+	client *Client
+	name   string
+
+	mu      sync.Mutex
+	id      uint32 // given by the server, 0 until created
+	open    bool
+	closing bool
+	closed  bool
+	onData  func([]byte)
+	opened  chan struct{} // closed once the server opened the channel
+	done    chan struct{} // closed once the channel is closed
+}
+
+// OpenDynamicChannel listens for the dynamic channel name, which the server
+// creates once an application on the server opens it, e.g. with
+// WTSVirtualChannelOpenEx, and the client accepts. It returns right away and
+// may be called before Connect; the channel is usable once Opened is closed,
+// which takes the session loop of Run. Channels the server creates that
+// nobody listens for are declined, and a name is listened for by one
+// channel at a time, until it is closed.
+func (c *Client) OpenDynamicChannel(name string) (*DynamicChannel, error) {
+	if name == "" {
+		return nil, fmt.Errorf("dynamic channel name must not be empty")
+	}
+	if c.channelDisabled(virtualchannel.CHANNEL_NAME_DRDYNVC) {
+		return nil, fmt.Errorf("dynamic channel %s: virtual channel %s is disabled", name, virtualchannel.CHANNEL_NAME_DRDYNVC)
+	}
+	ch := &DynamicChannel{
+		client: c,
+		name:   name,
+		opened: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	c.dvcMu.Lock()
+	defer c.dvcMu.Unlock()
+	if _, ok := c.dvcHandlers[name]; ok {
+		return nil, fmt.Errorf("dynamic channel %s already has a listener", name)
+	}
+	c.dvcHandlers[name] = &dynamicChannelHandler{ch}
+	return ch, nil
+}
+
+// RegisterFileTransfer serves the file transfers of manager on the dynamic
+// channel virtualchannel.FileTransferChannelName, which the server creates
+// once its side of the transfers opens it. It may be called before Connect.
+func (c *Client) RegisterFileTransfer(manager *virtualchannel.AdvancedFileTransferManager) error {
+	if manager == nil {
+		return fmt.Errorf("file transfer manager must be non-nil")
+	}
+	if c.channelDisabled(virtualchannel.CHANNEL_NAME_DRDYNVC) {
+		return fmt.Errorf("file transfer: virtual channel %s is disabled", virtualchannel.CHANNEL_NAME_DRDYNVC)
+	}
+	manager.SetTransport(c.SendDynamicVirtualChannelData)
+	return c.RegisterDynamicVirtualChannelHandler(virtualchannel.FileTransferChannelName, manager)
+}
+
+// DialDynamicChannel listens for the dynamic channel name as
+// OpenDynamicChannel does, waits for the server to open it and returns it as
+// a stream. Each
+// Write is sent as one message, in as many fragments as it takes; Read
+// returns the messages received in order, reassembled, and io.EOF once the
+// server closed the channel. The session loop of Run must be running for
+// the channel to open. The session loop does not wait for the reader: up to
+// 4 MiB received is kept unread, beyond that the channel is closed and Read
+// returns ErrDynamicChannelOverrun once what was kept is read.
+func (c *Client) DialDynamicChannel(name string) (io.ReadWriteCloser, error) {
+	ch, err := c.OpenDynamicChannel(name)
+	if err != nil {
+		return nil, err
+	}
+	conn := &dynamicChannelConn{ch: ch, limit: maxDialedChannelBuffer, ready: make(chan struct{}, 1), closed: make(chan struct{})}
+	ch.OnData(conn.push)
+	select {
+	case <-ch.Opened():
+		return conn, nil
+	case <-ch.Done():
+		return nil, fmt.Errorf("%w: %s closed before it was opened", ErrDynamicChannelClosed, name)
+	case <-c.ctx.Done():
+		_ = ch.Close()
+		return nil, fmt.Errorf("dynamic channel %s: %w", name, c.ctx.Err())
+	}
+}
+
+// dynamicChannelConn reads and writes a DynamicChannel as a stream
+type dynamicChannelConn struct {
+	ch *DynamicChannel
+
+	mu        sync.Mutex
+	pending   [][]byte      // messages received and not yet read
+	size      int           // bytes pending
+	limit     int           // of size, beyond which the channel is closed
+	err       error         // ErrDynamicChannelOverrun once closed for it
+	ready     chan struct{} // signalled once a message is received
+	closed    chan struct{} // closed by Close
+	closeOnce sync.Once
+}
+
+// push queues a message received from the session loop, which must not
+// wait for a reader. A reader that falls more than limit behind loses the
+// channel.
+func (conn *dynamicChannelConn) push(data []byte) {
+	conn.mu.Lock()
+	if conn.err != nil {
+		conn.mu.Unlock()
+		return
+	}
+	if conn.size+len(data) > conn.limit {
+		conn.err = ErrDynamicChannelOverrun
+		conn.mu.Unlock()
+		glog.Warnf("dynamic channel %s: closing, %d bytes not read", conn.ch.name, conn.size)
+		if err := conn.ch.Close(); err != nil {
+			glog.Warnf("dynamic channel %s: %v", conn.ch.name, err)
+		}
+	} else {
+		conn.pending = append(conn.pending, data)
+		conn.size += len(data)
+		conn.mu.Unlock()
+	}
+	select {
+	case conn.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next copies what it can of the oldest message to p, reporting whether
+// there was one, or returns why there will be none
+func (conn *dynamicChannelConn) next(p []byte) (int, bool, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if len(conn.pending) == 0 {
+		return 0, false, conn.err
+	}
+	n := copy(p, conn.pending[0])
+	conn.size -= n
+	if n < len(conn.pending[0]) {
+		conn.pending[0] = conn.pending[0][n:]
+	} else {
+		conn.pending[0] = nil
+		conn.pending = conn.pending[1:]
+	}
+	return n, true, nil
+}
+
+func (conn *dynamicChannelConn) Read(p []byte) (int, error) {
+	for {
+		select {
+		case <-conn.closed:
+			return 0, net.ErrClosed
+		default:
+		}
+		if n, ok, err := conn.next(p); ok || err != nil {
+			return n, err
+		}
+		select {
+		case <-conn.ready:
+		case <-conn.closed:
+		case <-conn.ch.Done():
+			// what was received before the channel closed is still read
+			if n, ok, err := conn.next(p); ok || err != nil {
+				return n, err
+			}
+			return 0, io.EOF
+		}
+	}
+}
+
+func (conn *dynamicChannelConn) Write(p []byte) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := conn.ch.Send(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the channel, failing pending and later reads and writes
+func (conn *dynamicChannelConn) Close() error {
+	var err error
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+		err = conn.ch.Close()
+	})
+	return err
+}
+
+// Name returns the name of the channel
+func (ch *DynamicChannel) Name() string {
+	return ch.name
+}
+
+// ID returns the channel id the server gave the channel, 0 until it
+// created the channel
+func (ch *DynamicChannel) ID() uint32 {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.id
+}
+
+// Opened returns a channel closed once the server opened the channel
+func (ch *DynamicChannel) Opened() <-chan struct{} {
+	return ch.opened
+}
+
+// Done returns a channel closed once the channel is closed, by either
+// side, or the server refused it
+func (ch *DynamicChannel) Done() <-chan struct{} {
+	return ch.done
+}
+
+// OnData sets fn to be called from the session loop with every message
+// received on the channel, reassembled from its fragments
+func (ch *DynamicChannel) OnData(fn func([]byte)) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.onData = fn
+}
+
+// Send sends data on the open channel, split into as many data messages
+// as it takes
+func (ch *DynamicChannel) Send(data []byte) error {
+	ch.mu.Lock()
+	open, id := ch.open, ch.id
+	ch.mu.Unlock()
+	if !open {
+		return fmt.Errorf("%w: %s", ErrDynamicChannelClosed, ch.name)
+	}
+	for _, msg := range drdynvc.DataMessages(id, data) {
+		if err := ch.client.SendVirtualChannelData("drdynvc", msg.Serialize(), 0); err != nil {
+			return err
+		}
+	}
+	ch.client.dvcManager.CountSent(id, len(data))
+	return nil
+}
+
+// Close asks the server to close the channel, or stops listening for it if
+// the server did not create it yet. Sending fails from now on.
+func (ch *DynamicChannel) Close() error {
+	ch.mu.Lock()
+	done := ch.closing || ch.closed
+	ch.open, ch.closing = false, true
+	id := ch.id
+	ch.mu.Unlock()
+	if done {
+		return nil
+	}
+	if id == 0 {
+		ch.finish()
+		return nil
+	}
+	req := &drdynvc.CloseRequest{ChannelId: id}
+	msg := &drdynvc.DynamicVirtualChannelMessage{MessageType: drdynvc.DVCCLOSE_REQ, Data: req.Serialize()}
+	return ch.client.SendVirtualChannelData("drdynvc", msg.Serialize(), 0)
+}
+
+// finish marks the channel closed and stops listening for it
+func (ch *DynamicChannel) finish() {
+	c := ch.client
+	c.dvcMu.Lock()
+	if h, ok := c.dvcHandlers[ch.name].(*dynamicChannelHandler); ok && h.ch == ch {
+		delete(c.dvcHandlers, ch.name)
+	}
+	c.dvcMu.Unlock()
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.open = false
+	if !ch.closed {
+		ch.closed = true
+		close(ch.done)
+	}
+}
+
+// dynamicChannelHandler feeds the events of the session loop to a
+// DynamicChannel
+type dynamicChannelHandler struct {
+	ch *DynamicChannel
+}
+
+func (h *dynamicChannelHandler) OnChannelCreated(channelId uint32, channelName string) error {
+	h.ch.mu.Lock()
+	defer h.ch.mu.Unlock()
+	if h.ch.id != 0 || h.ch.closing || h.ch.closed {
+		return fmt.Errorf("dynamic channel %s already created", channelName)
+	}
+	h.ch.id = channelId
+	return nil
+}
+
+func (h *dynamicChannelHandler) OnChannelOpened(channelId uint32) error {
+	h.ch.mu.Lock()
+	defer h.ch.mu.Unlock()
+	if !h.ch.open && !h.ch.closing && !h.ch.closed {
+		h.ch.open = true
+		close(h.ch.opened)
+	}
+	return nil
+}
+
+func (h *dynamicChannelHandler) OnChannelClosed(channelId uint32) error {
+	h.ch.finish()
+	return nil
+}
+
+func (h *dynamicChannelHandler) OnDataReceived(channelId uint32, data []byte) error {
+	h.ch.mu.Lock()
+	fn := h.ch.onData
+	h.ch.mu.Unlock()
+	if fn != nil {
+		fn(data)
+	}
+	return nil
+}
+
+// drdynvcHandler hands the messages of the drdynvc static channel to the
+// dynamic channels they carry
+type drdynvcHandler struct {
+	c *Client
+}
+
+func (h *drdynvcHandler) HandleData(channelID uint16, data []byte) error {
+	return h.c.handleDynamicVirtualChannel(data)
+}
+
+func (h *drdynvcHandler) OnChannelOpen(channelID uint16, channelName string) error {
+	return nil
+}
+
+func (h *drdynvcHandler) OnChannelClose(channelID uint16) error {
+	return nil
+}
@@ -0,0 +1,102 @@
+package gordp
+
+import (
+	"errors"
+	"time"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/proto/t128"
+)
+
+// DefaultLogoffTimeout bounds how long Logoff waits for the server to answer
+// its Shutdown Request PDU
+var DefaultLogoffTimeout = 10 * time.Second
+
+// Errors returned by Logoff
+var (
+	ErrNotConnected  = errors.New("not connected")
+	ErrLogoffDenied  = errors.New("server denied the shutdown request")
+	ErrLogoffTimeout = errors.New("timed out waiting for the server to end the session")
+)
+
+// Logoff asks the server to end the session with a Shutdown Request PDU,
+// waits for it to deactivate the session or close the connection, and then
+// closes the client. A server may refuse with a Shutdown Request Denied
+// PDU, Windows does while a user is logged on, in which case the session
+// stays on the server, disconnected, and Logoff returns ErrLogoffDenied.
+// The answer is read by Run if it is running, else by Logoff itself.
+func (c *Client) Logoff() error {
+	if !c.connected.Load() {
+		return ErrNotConnected
+	}
+	reply := make(chan error, 1)
+	c.logoffMu.Lock()
+	c.logoffReply = reply
+	c.logoffMu.Unlock()
+	defer func() {
+		c.logoffMu.Lock()
+		c.logoffReply = nil
+		c.logoffMu.Unlock()
+	}()
+
+	err := core.Try(func() { c.writeDataPdu(&t128.TsShutdownRequestPDU{}) })
+	if err != nil {
+		return err
+	}
+	if !c.running.Load() {
+		go c.awaitLogoff()
+	}
+
+	timer := time.NewTimer(DefaultLogoffTimeout)
+	defer timer.Stop()
+	select {
+	case err = <-reply:
+	case <-timer.C:
+		err = ErrLogoffTimeout
+	case <-c.ctx.Done():
+		err = c.ctx.Err()
+	}
+	c.Close()
+	return err
+}
+
+// awaitLogoff reads PDUs until the server answers a Shutdown Request PDU,
+// for when no session loop does
+func (c *Client) awaitLogoff() {
+	_ = core.Try(func() {
+		for !c.logoffAnswer(c.readPdu()) {
+		}
+	})
+	c.answerLogoff(nil)
+}
+
+// logoffAnswer reports whether pdu answers a Shutdown Request PDU, handing
+// the answer to Logoff
+func (c *Client) logoffAnswer(pdu t128.PDU) bool {
+	var err error
+	switch p := pdu.(type) {
+	case *t128.TsDeactivateAllPDU:
+	case *t128.TsDataPduData:
+		if _, ok := p.Pdu.(*t128.TsShutdownDeniedPDU); !ok {
+			return false
+		}
+		err = ErrLogoffDenied
+	default:
+		return false
+	}
+	c.answerLogoff(err)
+	return true
+}
+
+// answerLogoff hands err to Logoff, if it is waiting. The session ending
+// answers with nil.
+func (c *Client) answerLogoff(err error) {
+	c.logoffMu.Lock()
+	defer c.logoffMu.Unlock()
+	if c.logoffReply != nil {
+		select {
+		case c.logoffReply <- err:
+		default:
+		}
+	}
+}
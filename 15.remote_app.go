@@ -0,0 +1,100 @@
+package gordp
+
+import (
+	"github.com/kdsmith18542/gordp/glog"
+	"github.com/kdsmith18542/gordp/proto/rail"
+	"github.com/kdsmith18542/gordp/proto/virtualchannel"
+)
+
+// RemoteApp is the program of a RemoteApp session, see Option.RemoteApp
+type RemoteApp struct {
+	// Program is the path of the program or file to open on the server, or
+	// the alias of a published program with its "||" prefix, e.g.
+	// "||notepad"
+	Program    string
+	WorkingDir string
+	Arguments  string
+}
+
+// exec returns the request to start the program
+func (app *RemoteApp) exec() *rail.Exec {
+	return &rail.Exec{ExeOrFile: app.Program, WorkingDir: app.WorkingDir, Arguments: app.Arguments}
+}
+
+// RailHandler is told about the windows of a RemoteApp session, to show
+// each of them as a window of its own. Only the fields named in the
+// FieldsPresent of an order are set, the others keep their last value.
+type RailHandler interface {
+	// OnExecResult is called with the outcome of starting the program
+	OnExecResult(result *rail.ExecResult)
+	OnWindowCreated(order *rail.WindowOrder)
+	// OnWindowUpdated is called when a window moved, was resized or
+	// changed otherwise
+	OnWindowUpdated(order *rail.WindowOrder)
+	OnWindowDeleted(windowId uint32)
+	OnWindowIcon(windowId uint32, icon *rail.Icon)
+}
+
+// SetRailHandler sets the handler told about the windows of the RemoteApp
+// session, see Option.RemoteApp. Call it before Run.
+func (c *Client) SetRailHandler(handler RailHandler) {
+	c.railHandler = handler
+}
+
+// registerRemoteApp offers the rail channel the program of
+// Option.RemoteApp is started on
+func (c *Client) registerRemoteApp() {
+	app := c.option.RemoteApp
+	if app == nil {
+		return
+	}
+	c.railManager = rail.NewManager(*app.exec(), func() (uint16, uint16) {
+		return c.desktopWidth, c.desktopHeight
+	}, func(data []byte) error {
+		return c.SendVirtualChannelData(rail.CHANNEL_NAME, data,
+			virtualchannel.CHANNEL_FLAG_FIRST|virtualchannel.CHANNEL_FLAG_LAST)
+	})
+	c.railManager.OnExecResult(func(result *rail.ExecResult) {
+		if c.railHandler != nil {
+			c.railHandler.OnExecResult(result)
+		}
+	})
+	c.railIcons = make(map[uint32]*rail.Icon)
+	if err := c.RegisterStaticChannel(rail.CHANNEL_NAME, c.railManager); err != nil {
+		glog.Warnf("remote application: %v", err)
+	}
+}
+
+// handleWindowOrder reports a window order of RemoteApp to the RailHandler,
+// keeping the icons the server caches
+func (c *Client) handleWindowOrder(order *rail.WindowOrder) {
+	if icon := order.Icon; icon != nil {
+		// icons are cached unless their entry is 0xFFFF
+		// See [MS-RDPERP] 2.2.1.2.3
+		key := uint32(icon.CacheId)<<16 | uint32(icon.CacheEntry)
+		if icon.Cached() {
+			if icon = c.railIcons[key]; icon == nil {
+				glog.Warnf("window %#x: icon %d of cache %d not cached", order.WindowId, order.Icon.CacheEntry, order.Icon.CacheId)
+				return
+			}
+		} else if icon.CacheEntry != 0xFFFF && c.railIcons != nil {
+			c.railIcons[key] = icon
+		}
+		if c.railHandler != nil {
+			c.railHandler.OnWindowIcon(order.WindowId, icon)
+		}
+		return
+	}
+	glog.Debugf("window %#x order %#x", order.WindowId, order.FieldsPresent)
+	if c.railHandler == nil {
+		return
+	}
+	switch {
+	case order.Deleted():
+		c.railHandler.OnWindowDeleted(order.WindowId)
+	case order.New():
+		c.railHandler.OnWindowCreated(order)
+	default:
+		c.railHandler.OnWindowUpdated(order)
+	}
+}
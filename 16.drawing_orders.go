@@ -0,0 +1,255 @@
+package gordp
+
+import (
+	"image"
+	"image/draw"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/glog"
+	"github.com/kdsmith18542/gordp/proto/bitmap"
+	"github.com/kdsmith18542/gordp/proto/capability"
+	"github.com/kdsmith18542/gordp/proto/orders"
+	"github.com/kdsmith18542/gordp/proto/rail"
+	"github.com/kdsmith18542/gordp/proto/t128"
+)
+
+// drawingOrders are the OrderSupport indexes of the primary drawing orders
+// the client paints, announced in the order capability set
+var drawingOrders = []int{
+	capability.TS_NEG_DSTBLT_INDEX,
+	capability.TS_NEG_PATBLT_INDEX,
+	capability.TS_NEG_SCRBLT_INDEX,
+	capability.TS_NEG_MEMBLT_INDEX,
+	capability.TS_NEG_MEM3BLT_INDEX,
+	capability.TS_NEG_LINETO_INDEX,
+	capability.TS_NEG_GLYPH_INDEX_INDEX,
+}
+
+// supportDrawingOrders announces the drawing orders of drawingOrders, and
+// the glyph caches of their text
+func supportDrawingOrders(sets []capability.TsCapsSet) {
+	caps := &Capabilities{Sets: sets}
+	if order, ok := caps.Find(capability.CAPSTYPE_ORDER).(*capability.TsOrderCapabilitySet); ok {
+		for _, i := range drawingOrders {
+			order.OrderSupport[i] = 1
+		}
+	}
+	for i, set := range sets {
+		if _, ok := set.(*capability.TsGlyphCacheCapabilitySet); ok {
+			sets[i] = capability.NewTsGlyphCacheCapabilitySet()
+		}
+	}
+}
+
+// resetOrders starts reading drawing orders anew, as the server does after
+// the capabilities exchange. Orders paint on the framebuffer when it is
+// enabled and, with Option.DrawingOrders, on a desktop of the client's own
+// otherwise, which bitmap updates are composited into too so that orders
+// copying the desktop see them.
+func (c *Client) resetOrders() {
+	c.orderDecoder = orders.NewDecoder()
+	c.painter = orders.NewPainter()
+	c.painter.BitsPerPixel = int(c.bitsPerPixel)
+	c.painter.Bitmap = c.cachedBitmap
+	size, entries := c.offscreenCacheSettings()
+	c.painter.OffscreenCacheSize, c.painter.OffscreenCacheEntries = int(size)*1024, int(entries)
+	c.forgetBitmapCells(false)
+	c.canvas = nil
+	if c.framebuffer == nil && c.option.DrawingOrders {
+		c.canvas = bitmap.NewFramebuffer(int(c.desktopWidth), int(c.desktopHeight))
+	}
+}
+
+// desktop returns the surface drawing orders paint on, nil when they are
+// not painted
+func (c *Client) desktop() *bitmap.Framebuffer {
+	if c.framebuffer != nil {
+		return c.framebuffer
+	}
+	return c.canvas
+}
+
+// canvasProcessor composites every bitmap into the desktop drawing orders
+// paint on when the framebuffer is not enabled
+type canvasProcessor struct {
+	c    *Client
+	next Processor
+}
+
+func (p *canvasProcessor) ProcessBitmap(option *bitmap.Option, bmp *bitmap.BitMap) {
+	if canvas := p.c.canvas; canvas != nil {
+		canvas.ApplyUpdate(option, bmp)
+	}
+	if p.next != nil {
+		p.next.ProcessBitmap(option, bmp)
+	}
+}
+
+func (c *Client) withCanvas(processor Processor) Processor {
+	return &canvasProcessor{c: c, next: processor}
+}
+
+// handleOrders paints the drawing orders of an Orders update and hands
+// what each changed to processor, and the window orders of RemoteApp to the
+// RailHandler
+func (c *Client) handleOrders(processor Processor, update *t128.TsFpUpdateOrders) {
+	if c.orderDecoder == nil {
+		c.resetOrders()
+	}
+	list, err := c.orderDecoder.Read(update.OrderData, int(update.NumberOrders))
+	if err != nil {
+		glog.Warnf("invalid drawing order: %v", err)
+	}
+	c.painter.Palette = c.palette
+	desktop := c.desktop()
+	for _, order := range list {
+		if cache, ok := order.(*orders.CacheBitmap); ok {
+			c.cacheBitmap(cache)
+			continue
+		}
+		if window, ok := order.(*orders.Window); ok {
+			windows, err := rail.ReadWindowOrders(window.Data, 1)
+			if err != nil {
+				glog.Warnf("invalid window order: %v", err)
+			}
+			for _, order := range windows {
+				c.handleWindowOrder(order)
+			}
+			continue
+		}
+
+		if desktop == nil {
+			continue
+		}
+		var changed image.Rectangle
+		desktop.Paint(func(img *image.RGBA) { changed = c.painter.Paint(img, order) })
+		if changed.Empty() {
+			continue
+		}
+		processor.ProcessBitmap(&bitmap.Option{
+			Top:         changed.Min.Y,
+			Left:        changed.Min.X,
+			Width:       changed.Dx(),
+			Height:      changed.Dy(),
+			BitPerPixel: 32,
+		}, &bitmap.BitMap{Image: desktop.SnapshotRect(changed)})
+	}
+}
+
+// cacheBitmap decodes the bitmap of a Cache Bitmap order and stores it in
+// the bitmap cache as RGBA pixels, keyed by its persistent key or by its
+// pixels when it has none. The cell the server put it in is remembered for
+// the MemBlt orders of the connection, so a cache shared through
+// Option.SharedCache keeps the cells of each connection apart, and the
+// bitmap is pinned while the cell refers to it so that another connection
+// does not evict it.
+func (c *Client) cacheBitmap(o *orders.CacheBitmap) {
+	option := &bitmap.Option{
+		Width:        int(o.Width),
+		Height:       int(o.Height),
+		BitPerPixel:  o.BitsPerPixel,
+		Data:         o.Data,
+		Uncompressed: !o.Compressed,
+	}
+	// the depth of the session when the order leaves it out, or gives 16
+	// bits for 15
+	if option.BitPerPixel == 0 || option.BitPerPixel == 16 && c.bitsPerPixel == 15 {
+		option.BitPerPixel = int(c.bitsPerPixel)
+	}
+	if option.BitPerPixel <= 8 {
+		option.Palette = c.palette
+	}
+	var bmp *bitmap.BitMap
+	if err := core.Try(func() { bmp = bitmap.Decode(option) }); err != nil {
+		glog.Warnf("bitmap %d of cache %d: %v", o.CacheIndex, o.CacheId, err)
+		return
+	}
+	img := image.NewRGBA(image.Rect(0, 0, option.Width, option.Height))
+	draw.Draw(img, img.Rect, bmp.Image, bmp.Image.Bounds().Min, draw.Src)
+
+	key := uint64(o.Key2)<<32 | uint64(o.Key1)
+	if key == 0 {
+		key = t128.GenerateCacheKey(img.Pix, o.Width, o.Height, 32)
+	}
+	if c.bitmapCacheManager.PutCachedBitmap(uint16(o.CacheId), uint32(key), uint32(key>>32), &t128.TsBitmapData{
+		Width:            o.Width,
+		Height:           o.Height,
+		BitsPerPixel:     32,
+		BitmapDataStream: img.Pix,
+	}) {
+		c.cellsMu.Lock()
+		c.setBitmapCell(o.CacheId, o.CacheIndex, key)
+		c.cellsMu.Unlock()
+	}
+}
+
+// cachedBitmap returns the bitmap stored in a cell by cacheBitmap, nil if
+// there is none
+func (c *Client) cachedBitmap(cacheId uint8, index uint16) *image.RGBA {
+	c.cellsMu.Lock()
+	key, ok := c.bitmapCells[bitmapCell(cacheId, index)]
+	c.cellsMu.Unlock()
+	if !ok {
+		return nil
+	}
+	bmp := c.bitmapCacheManager.GetCachedBitmap(uint16(cacheId), index, uint32(key), uint32(key>>32))
+	if bmp == nil || bmp.BitsPerPixel != 32 || len(bmp.BitmapDataStream) != 4*int(bmp.Width)*int(bmp.Height) {
+		return nil
+	}
+	return &image.RGBA{
+		Pix:    bmp.BitmapDataStream,
+		Stride: 4 * int(bmp.Width),
+		Rect:   image.Rect(0, 0, int(bmp.Width), int(bmp.Height)),
+	}
+}
+
+// bitmapCell returns the key of a cell of the bitmap cache in bitmapCells
+func bitmapCell(cacheId uint8, index uint16) uint32 {
+	return uint32(cacheId)<<16 | uint32(index)
+}
+
+// setBitmapCell makes a cell refer to the bitmap of key, pinning it in the
+// cache in place of the bitmap the cell referred to. cellsMu must be held.
+func (c *Client) setBitmapCell(cacheId uint8, index uint16, key uint64) {
+	if c.bitmapCells == nil {
+		c.bitmapCells = make(map[uint32]uint64)
+	}
+	cell := bitmapCell(cacheId, index)
+	if old, ok := c.bitmapCells[cell]; ok {
+		c.bitmapCacheManager.UnpinCachedBitmap(uint16(cacheId), uint32(old), uint32(old>>32), false)
+	}
+	c.bitmapCacheManager.PinCachedBitmap(uint16(cacheId), uint32(key), uint32(key>>32))
+	c.bitmapCells[cell] = key
+}
+
+// forgetBitmapCells empties the cells, unpinning their bitmaps. With drop
+// the bitmaps are removed from the cache too, unless another client sharing
+// it refers to them.
+func (c *Client) forgetBitmapCells(drop bool) {
+	c.cellsMu.Lock()
+	defer c.cellsMu.Unlock()
+	for cell, key := range c.bitmapCells {
+		c.bitmapCacheManager.UnpinCachedBitmap(uint16(cell>>16), uint32(key), uint32(key>>32), drop)
+	}
+	c.bitmapCells = make(map[uint32]uint64)
+}
+
+// usePersistentCells fills the cells of the bitmap cache with the bitmaps
+// whose keys the client sent in pdus, which the server numbers in the order
+// of the keys
+// See [MS-RDPBCGR] 2.2.1.17.1
+func (c *Client) usePersistentCells(pdus []*t128.TsBitmapCachePersistentListPDU) {
+	c.cellsMu.Lock()
+	defer c.cellsMu.Unlock()
+	var next [5]uint16
+	for _, pdu := range pdus {
+		entries := pdu.Entries
+		for id, count := range pdu.NumEntries {
+			for _, entry := range entries[:min(int(count), len(entries))] {
+				c.setBitmapCell(uint8(id), next[id], uint64(entry.Key2)<<32|uint64(entry.Key1))
+				next[id]++
+			}
+			entries = entries[min(int(count), len(entries)):]
+		}
+	}
+}
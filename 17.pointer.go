@@ -0,0 +1,62 @@
+package gordp
+
+import (
+	"image"
+
+	"github.com/kdsmith18542/gordp/glog"
+	"github.com/kdsmith18542/gordp/proto/bitmap"
+	"github.com/kdsmith18542/gordp/proto/t128"
+)
+
+// PointerProcessor is a Processor that Run also tells of the pointer the
+// server shows, each time its shape or position changes. A hidden or
+// default pointer is for the client to draw, e.g. with a cursor of the
+// window showing the desktop.
+type PointerProcessor interface {
+	Processor
+	ProcessPointer(pointer *bitmap.Pointer)
+}
+
+// resetPointer forgets the pointer shapes cached, as the server does after
+// the capabilities exchange
+func (c *Client) resetPointer() {
+	c.pointer = bitmap.Pointer{}
+	c.pointerCache = [t128.ColorPointerCacheSize]*bitmap.Pointer{}
+}
+
+// handlePointer applies a pointer update and hands the pointer to the
+// recording of StartRecording and to the processor of Run, if it is a
+// PointerProcessor
+func (c *Client) handlePointer(update t128.UpdatePDU) {
+	switch u := update.(type) {
+	case *t128.TsFpUpdatePointerPosition:
+		c.pointer.Position = image.Pt(int(u.X), int(u.Y))
+	case *t128.TsFpUpdateSystemPointer:
+		c.pointer = bitmap.Pointer{Position: c.pointer.Position, Hidden: u.SystemPointerType == t128.SYSPTR_NULL}
+	case *t128.TsFpUpdatePointer:
+		if int(u.CacheIndex) >= len(c.pointerCache) {
+			glog.Warnf("pointer cache index %d out of range", u.CacheIndex)
+			return
+		}
+		shape := &bitmap.Pointer{Image: u.Image(c.palette), HotSpot: image.Pt(int(u.HotSpotX), int(u.HotSpotY))}
+		c.pointerCache[u.CacheIndex] = shape
+		c.pointer = bitmap.Pointer{Image: shape.Image, HotSpot: shape.HotSpot, Position: c.pointer.Position}
+	case *t128.TsFpUpdateCachedPointer:
+		if int(u.CacheIndex) >= len(c.pointerCache) || c.pointerCache[u.CacheIndex] == nil {
+			glog.Warnf("pointer cache index %d not cached", u.CacheIndex)
+			return
+		}
+		shape := c.pointerCache[u.CacheIndex]
+		c.pointer = bitmap.Pointer{Image: shape.Image, HotSpot: shape.HotSpot, Position: c.pointer.Position}
+	default:
+		return
+	}
+	if rec := c.recorder.Load(); rec != nil {
+		pointer := c.pointer
+		rec.ProcessPointer(&pointer)
+	}
+	if c.pointerProcessor != nil {
+		pointer := c.pointer
+		c.pointerProcessor.ProcessPointer(&pointer)
+	}
+}
@@ -0,0 +1,73 @@
+// Package compression implements the receiving side of RDP bulk compression
+// (MS-RDPBCGR 3.1.8): MPPC for RDP 4.0 and 5.0, the types the client
+// advertises. NCRUSH (RDP 6.0) and XCRUSH (RDP 6.1) are not implemented,
+// PDUs compressed with them fail with ErrUnsupported.
+package compression
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Compression types, carried in the low bits of the compression flags
+const (
+	PACKET_COMPR_TYPE_8K    = 0x0
+	PACKET_COMPR_TYPE_64K   = 0x1
+	PACKET_COMPR_TYPE_RDP6  = 0x2
+	PACKET_COMPR_TYPE_RDP61 = 0x3
+
+	CompressionTypeMask = 0x0F
+)
+
+// Compression flags
+const (
+	PACKET_COMPRESSED = 0x20
+	PACKET_AT_FRONT   = 0x40
+	PACKET_FLUSHED    = 0x80
+)
+
+var (
+	// ErrCorrupt is returned for compressed data that does not decode
+	// against the current history
+	ErrCorrupt = errors.New("corrupt compressed data")
+
+	// ErrUnsupported is returned for a compression type that cannot be decoded
+	ErrUnsupported = errors.New("unsupported compression type")
+)
+
+// Decompressor keeps the history shared by all compressed PDUs received on a
+// connection. PDUs must be passed in the order they arrive, and a
+// Decompressor must not be used by more than one goroutine at a time.
+type Decompressor struct {
+	mppc8K  *mppc
+	mppc64K *mppc
+}
+
+// NewDecompressor creates a decompressor with empty history
+func NewDecompressor() *Decompressor {
+	return &Decompressor{}
+}
+
+// Decompress returns the payload of a PDU received with the given
+// compression flags. Uncompressed payloads are returned as is, after the
+// history has been reset if the flags ask for it.
+func (d *Decompressor) Decompress(data []byte, flags uint8) ([]byte, error) {
+	if flags&(PACKET_COMPRESSED|PACKET_AT_FRONT|PACKET_FLUSHED) == 0 {
+		return data, nil
+	}
+
+	switch flags & CompressionTypeMask {
+	case PACKET_COMPR_TYPE_8K:
+		if d.mppc8K == nil {
+			d.mppc8K = newMPPC(false)
+		}
+		return d.mppc8K.decompress(data, flags)
+	case PACKET_COMPR_TYPE_64K:
+		if d.mppc64K == nil {
+			d.mppc64K = newMPPC(true)
+		}
+		return d.mppc64K.decompress(data, flags)
+	default:
+		return nil, fmt.Errorf("%w: %#x", ErrUnsupported, flags&CompressionTypeMask)
+	}
+}
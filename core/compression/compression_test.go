@@ -0,0 +1,233 @@
+package compression
+
+import (
+	"bytes"
+	"math/bits"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type bitWriter struct {
+	buf []byte
+	n   int
+}
+
+func (w *bitWriter) write(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v>>i&1 == 1 {
+			w.buf[len(w.buf)-1] |= 0x80 >> (w.n % 8)
+		}
+		w.n++
+	}
+}
+
+// mppcEncoder compresses the way a server would, so the decoder can be
+// checked against every token it may meet
+type mppcEncoder struct {
+	big     bool
+	history []byte
+}
+
+func (e *mppcEncoder) encode(data []byte) []byte {
+	maxDist, maxLen := 8191, 8191
+	if e.big {
+		maxDist, maxLen = 65535, 65535
+	}
+	start := len(e.history)
+	e.history = append(e.history, data...)
+	all := e.history
+
+	// most recent positions of each 3-byte prefix
+	candidates := map[[3]byte][]int{}
+	index := func(pos int) {
+		if pos+3 <= len(all) {
+			key := [3]byte(all[pos : pos+3])
+			candidates[key] = append(candidates[key], pos)
+		}
+	}
+	for pos := 0; pos < start; pos++ {
+		index(pos)
+	}
+
+	w := &bitWriter{}
+	for pos := start; pos < len(all); {
+		bestLen, bestDist := 0, 0
+		if pos+3 <= len(all) {
+			list := candidates[[3]byte(all[pos:pos+3])]
+			for i := len(list) - 1; i >= 0 && i >= len(list)-16; i-- {
+				src := list[i]
+				if pos-src > maxDist {
+					break
+				}
+				n := 0
+				for pos+n < len(all) && n < maxLen && all[src+n] == all[pos+n] {
+					n++
+				}
+				if n > bestLen {
+					bestLen, bestDist = n, pos-src
+				}
+			}
+		}
+
+		if bestLen < 3 {
+			if b := all[pos]; b < 0x80 {
+				w.write(uint32(b), 8)
+			} else {
+				w.write(0b10, 2)
+				w.write(uint32(b&0x7F), 7)
+			}
+			index(pos)
+			pos++
+			continue
+		}
+
+		e.writeOffset(w, bestDist)
+		if bestLen == 3 {
+			w.write(0, 1)
+		} else {
+			k := bits.Len(uint(bestLen)) - 2
+			w.write(1<<(k+1)-2, k+1) // k ones and a zero
+			w.write(uint32(bestLen-1<<(k+1)), k+1)
+		}
+		for i := 0; i < bestLen; i++ {
+			index(pos + i)
+		}
+		pos += bestLen
+	}
+	return w.buf
+}
+
+func (e *mppcEncoder) writeOffset(w *bitWriter, d int) {
+	switch {
+	case e.big && d < 64:
+		w.write(0b11111, 5)
+		w.write(uint32(d), 6)
+	case e.big && d < 320:
+		w.write(0b11110, 5)
+		w.write(uint32(d-64), 8)
+	case e.big && d < 2368:
+		w.write(0b1110, 4)
+		w.write(uint32(d-320), 11)
+	case e.big:
+		w.write(0b110, 3)
+		w.write(uint32(d-2368), 16)
+	case d < 64:
+		w.write(0b1111, 4)
+		w.write(uint32(d), 6)
+	case d < 320:
+		w.write(0b1110, 4)
+		w.write(uint32(d-64), 8)
+	default:
+		w.write(0b110, 3)
+		w.write(uint32(d-320), 13)
+	}
+}
+
+// screenData mimics update payloads: runs, repeats and some noise
+func screenData(rnd *rand.Rand, n int) []byte {
+	data := make([]byte, 0, n)
+	for len(data) < n {
+		switch rnd.Intn(3) {
+		case 0:
+			data = append(data, bytes.Repeat([]byte{byte(rnd.Intn(256))}, 1+rnd.Intn(300))...)
+		case 1:
+			if len(data) > 0 {
+				src := rnd.Intn(len(data))
+				end := min(len(data), src+3+rnd.Intn(200))
+				data = append(data, data[src:end]...)
+			}
+		default:
+			for i := rnd.Intn(32); i >= 0; i-- {
+				data = append(data, byte(rnd.Intn(256)))
+			}
+		}
+	}
+	return data[:n]
+}
+
+func TestMPPCKnownAnswer(t *testing.T) {
+	d := NewDecompressor()
+	// literals a, b, c then copy-offset 3 with length-of-match 6
+	out, err := d.Decompress([]byte{0x61, 0x62, 0x63, 0xf0, 0xe8}, PACKET_COMPRESSED|PACKET_COMPR_TYPE_8K)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("abcabcabc"), out)
+
+	// a literal above 0x7F followed by one below, with 7 bits of padding
+	out, err = d.Decompress([]byte{0xb4, 0xa0, 0x80}, PACKET_COMPRESSED|PACKET_COMPR_TYPE_8K)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xe9, 'A'}, out)
+}
+
+func TestMPPCRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		typ     uint8
+		big     bool
+		packets []int
+	}{
+		{"RDP4", PACKET_COMPR_TYPE_8K, false, []int{3000, 2000, 3000}},
+		{"RDP5", PACKET_COMPR_TYPE_64K, true, []int{20000, 15000, 30000}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			enc := &mppcEncoder{big: tc.big}
+			d := NewDecompressor()
+			for i, size := range tc.packets {
+				data := screenData(rnd, size)
+				if i > 0 {
+					// repeat part of an earlier packet to match across PDUs
+					copy(data[100:], enc.history[:500])
+				}
+				compressed := enc.encode(data)
+				assert.Less(t, len(compressed), len(data))
+
+				out, err := d.Decompress(compressed, PACKET_COMPRESSED|tc.typ)
+				require.NoError(t, err, "packet %d", i)
+				assert.Equal(t, data, out, "packet %d", i)
+			}
+		})
+	}
+}
+
+func TestMPPCLongMatch(t *testing.T) {
+	data := append([]byte("xyz"), bytes.Repeat([]byte{0xAA}, 40000)...)
+	enc := &mppcEncoder{big: true}
+	out, err := NewDecompressor().Decompress(enc.encode(data), PACKET_COMPRESSED|PACKET_COMPR_TYPE_64K)
+	require.NoError(t, err)
+	assert.Equal(t, data, out)
+}
+
+func TestMPPCFlags(t *testing.T) {
+	d := NewDecompressor()
+	enc := &mppcEncoder{}
+	first := []byte("the quick brown fox")
+	_, err := d.Decompress(enc.encode(first), PACKET_COMPRESSED|PACKET_COMPR_TYPE_8K)
+	require.NoError(t, err)
+
+	// uncompressed payloads pass through untouched
+	out, err := d.Decompress([]byte("raw"), PACKET_COMPR_TYPE_8K)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("raw"), out)
+
+	// a match into the history fails once the history is flushed
+	second := enc.encode([]byte("quick brown"))
+	_, err = d.Decompress(second, PACKET_COMPRESSED|PACKET_FLUSHED|PACKET_COMPR_TYPE_8K)
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	// a copy-offset reaching back before the start of the history
+	_, err = d.Decompress([]byte{0x61, 0xff, 0xff}, PACKET_COMPRESSED|PACKET_FLUSHED|PACKET_COMPR_TYPE_8K)
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestDecompressUnsupported(t *testing.T) {
+	for _, typ := range []uint8{PACKET_COMPR_TYPE_RDP6, PACKET_COMPR_TYPE_RDP61} {
+		_, err := NewDecompressor().Decompress([]byte{1, 2, 3}, PACKET_COMPRESSED|typ)
+		assert.ErrorIs(t, err, ErrUnsupported)
+	}
+}
@@ -0,0 +1,170 @@
+package compression
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// bitReader reads a bit stream most significant bit first
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (b *bitReader) remaining() int {
+	return len(b.data)*8 - b.pos
+}
+
+// read returns the next n bits, n <= 32
+func (b *bitReader) read(n int) (uint32, bool) {
+	if n > b.remaining() {
+		return 0, false
+	}
+	var v uint32
+	for i := 0; i < n; i++ {
+		bit := b.data[b.pos>>3] >> (7 - b.pos&7) & 1
+		v = v<<1 | uint32(bit)
+		b.pos++
+	}
+	return v, true
+}
+
+// ones counts and consumes leading 1 bits, up to max, along with the 0
+// terminating them when fewer than max are found
+func (b *bitReader) ones(max int) (int, bool) {
+	for n := 0; n < max; n++ {
+		bit, ok := b.read(1)
+		if !ok {
+			return 0, false
+		}
+		if bit == 0 {
+			return n, true
+		}
+	}
+	return max, true
+}
+
+// mppc decodes RDP 4.0 (8K history) and RDP 5.0 (64K history) bulk compression
+type mppc struct {
+	big     bool // RDP 5.0
+	history []byte
+	offset  int
+}
+
+func newMPPC(big bool) *mppc {
+	size := 8192
+	if big {
+		size = 65536
+	}
+	return &mppc{big: big, history: make([]byte, size)}
+}
+
+// copyOffset reads the encoded distance back into the history
+func (m *mppc) copyOffset(br *bitReader) (int, bool) {
+	// the leading 11 of the copy-offset prefix is already consumed
+	if m.big {
+		switch n, ok := br.ones(3); {
+		case !ok:
+			return 0, false
+		case n == 3: // 11111
+			v, ok := br.read(6)
+			return int(v), ok
+		case n == 2: // 11110
+			v, ok := br.read(8)
+			return int(v) + 64, ok
+		case n == 1: // 1110
+			v, ok := br.read(11)
+			return int(v) + 320, ok
+		default: // 110
+			v, ok := br.read(16)
+			return int(v) + 2368, ok
+		}
+	}
+	switch n, ok := br.ones(2); {
+	case !ok:
+		return 0, false
+	case n == 2: // 1111
+		v, ok := br.read(6)
+		return int(v), ok
+	case n == 1: // 1110
+		v, ok := br.read(8)
+		return int(v) + 64, ok
+	default: // 110
+		v, ok := br.read(13)
+		return int(v) + 320, ok
+	}
+}
+
+// matchLength reads the length-of-match: a 0 stands for 3, otherwise k 1s
+// and a 0 are followed by k+1 bits added to 2^(k+1)
+func (m *mppc) matchLength(br *bitReader) (int, bool) {
+	max := 11
+	if m.big {
+		max = 15
+	}
+	k, ok := br.ones(max + 1)
+	if !ok || k > max {
+		return 0, false
+	}
+	if k == 0 {
+		return 3, true
+	}
+	v, ok := br.read(k + 1)
+	return 1<<(k+1) + int(v), ok
+}
+
+func (m *mppc) decompress(data []byte, flags uint8) ([]byte, error) {
+	if flags&PACKET_AT_FRONT != 0 {
+		m.offset = 0
+	}
+	if flags&PACKET_FLUSHED != 0 {
+		m.offset = 0
+		clear(m.history)
+	}
+	if flags&PACKET_COMPRESSED == 0 {
+		return data, nil
+	}
+
+	start := m.offset
+	br := &bitReader{data: data}
+	// fewer than 8 bits left is padding, as the shortest token is a literal
+	for br.remaining() >= 8 {
+		if m.offset >= len(m.history) {
+			return nil, fmt.Errorf("%w: history overflow", ErrCorrupt)
+		}
+		first, _ := br.read(1)
+		if first == 0 {
+			v, _ := br.read(7)
+			m.history[m.offset] = byte(v)
+			m.offset++
+			continue
+		}
+		second, _ := br.read(1)
+		if second == 0 {
+			v, _ := br.read(7)
+			m.history[m.offset] = 0x80 | byte(v)
+			m.offset++
+			continue
+		}
+
+		distance, ok := m.copyOffset(br)
+		if !ok {
+			return nil, fmt.Errorf("%w: truncated copy-offset", ErrCorrupt)
+		}
+		length, ok := m.matchLength(br)
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid length-of-match", ErrCorrupt)
+		}
+		src := m.offset - distance
+		if distance == 0 || src < 0 || m.offset+length > len(m.history) {
+			return nil, fmt.Errorf("%w: match outside history", ErrCorrupt)
+		}
+		// matches may overlap the bytes they produce, so copy one at a time
+		for i := 0; i < length; i++ {
+			m.history[m.offset+i] = m.history[src+i]
+		}
+		m.offset += length
+	}
+
+	return bytes.Clone(m.history[start:m.offset]), nil
+}
@@ -35,6 +35,19 @@ func UnicodeEncode(p string) []byte {
 	return convertUTF16ToLittleEndianBytes(utf16.Encode([]rune(p)))
 }
 
+// UnicodeDecode decodes utf-16le, stopping at the first null character
+func UnicodeDecode(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		v := binary.LittleEndian.Uint16(b[i:])
+		if v == 0 {
+			break
+		}
+		u = append(u, v)
+	}
+	return string(utf16.Decode(u))
+}
+
 // NTOWFv2 Version 2 of NTLM hash function
 func NTOWFv2(password, user, domain string) []byte {
 	return HMAC_MD5(MD4(UnicodeEncode(password)), UnicodeEncode(strings.ToUpper(user)+domain))
@@ -2,6 +2,7 @@ package core
 
 import (
 	"fmt"
+	"runtime"
 	"runtime/debug"
 )
 
@@ -59,6 +60,26 @@ func Try(fn func()) (err error) {
 	return nil
 }
 
+// TryRead calls fn, which reads a message, returning what it throws on a
+// malformed message as an error like Try. Runtime errors are not
+// recovered: no message should cause them, so they panic on as the bug
+// they are, e.g. to fail a fuzz test.
+func TryRead(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(runtime.Error); ok {
+				panic(e)
+			} else if e, ok := r.(error); ok {
+				err = fmt.Errorf("recovered from panic: %w", e)
+			} else {
+				err = fmt.Errorf("recovered from panic: %v", r)
+			}
+		}
+	}()
+	fn()
+	return nil
+}
+
 // TryWithContext executes a function with context and recovers from panics
 func TryWithContext(ctx interface{ Done() <-chan struct{} }, fn func()) (err error) {
 	defer func() {
@@ -98,6 +119,16 @@ func WrapErrorWithContextf(err error, format string, args ...interface{}) error
 	return fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), err)
 }
 
+// TryCatch executes fn, handing what it panics with, if anything, to catch
+func TryCatch(fn func(), catch func(e any)) {
+	defer func() {
+		if e := recover(); e != nil {
+			catch(e)
+		}
+	}()
+	fn()
+}
+
 // IsContextError checks if an error is a context cancellation error
 func IsContextError(err error) bool {
 	if err == nil {
@@ -3,10 +3,39 @@ package core
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"math"
 )
 
+// LengthError is thrown for a length field of a PDU out of bounds, before
+// anything is allocated from it, e.g. one of a broken or hostile peer
+type LengthError struct {
+	Field    string // what the length is of, e.g. "TPKT"
+	Length   int
+	Min, Max int
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("%s length %d out of bounds, %d to %d", e.Field, e.Length, e.Min, e.Max)
+}
+
+// CheckLength throws a LengthError if length is not within lo and hi
+func CheckLength(field string, length, lo, hi int) {
+	if length < lo || length > hi {
+		ThrowError(&LengthError{Field: field, Length: length, Min: lo, Max: hi})
+	}
+}
+
+// ReadBytes reads length bytes. For readers telling how much they hold,
+// like bytes.Reader, a length beyond it throws a LengthError rather than
+// allocating.
 func ReadBytes(r io.Reader, length int) []byte {
+	limit := math.MaxInt
+	if l, ok := r.(interface{ Len() int }); ok {
+		limit = l.Len()
+	}
+	CheckLength("data", length, 0, limit)
 	data := make([]byte, length)
 	return ReadFull(r, data)
 }
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// the addresses a PcapWriter gives the two ends of the connection, the
+// server listening on the RDP port so that Wireshark decodes the packets
+var (
+	pcapClientAddr = [4]byte{10, 0, 0, 1}
+	pcapServerAddr = [4]byte{10, 0, 0, 2}
+)
+
+const (
+	pcapClientPort = 49152
+	pcapServerPort = 3389
+)
+
+const (
+	pcapLinkTypeIPv4 = 228
+	pcapHeaderSize   = 40 // of the IPv4 and TCP headers of a packet
+	pcapMaxSegment   = 0xFFFF - pcapHeaderSize
+)
+
+// PcapWriter writes data sent either way on a connection as a pcap
+// capture. Each write becomes a TCP segment, or several if it does not fit
+// in one, of a connection that has no handshake in the capture.
+// See https://www.tcpdump.org/linktypes/LINKTYPE_IPV4.html
+type PcapWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	seq [2]uint32 // the next sequence numbers of the client and the server
+	id  uint16
+}
+
+// NewPcapWriter writes the header of the capture to w
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	header := make([]byte, 0, 24)
+	header = binary.LittleEndian.AppendUint32(header, 0xA1B2C3D4)
+	header = binary.LittleEndian.AppendUint16(header, 2) // version 2.4
+	header = binary.LittleEndian.AppendUint16(header, 4)
+	header = binary.LittleEndian.AppendUint32(header, 0) // UTC
+	header = binary.LittleEndian.AppendUint32(header, 0) // accuracy
+	header = binary.LittleEndian.AppendUint32(header, 0xFFFF)
+	header = binary.LittleEndian.AppendUint32(header, pcapLinkTypeIPv4)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w, seq: [2]uint32{1, 1}}, nil
+}
+
+// WritePacket writes data sent at t, by the client if outbound and by the
+// server otherwise
+func (p *PcapWriter) WritePacket(t time.Time, outbound bool, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(data) > 0 {
+		n := min(len(data), pcapMaxSegment)
+		if _, err := p.w.Write(p.packet(t, outbound, data[:n])); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// packet returns the record of a segment carrying data
+func (p *PcapWriter) packet(t time.Time, outbound bool, data []byte) []byte {
+	src, dst, srcPort, dstPort, from := pcapServerAddr, pcapClientAddr, pcapServerPort, pcapClientPort, 1
+	if outbound {
+		src, dst, srcPort, dstPort, from = pcapClientAddr, pcapServerAddr, pcapClientPort, pcapServerPort, 0
+	}
+	size := pcapHeaderSize + len(data)
+	b := make([]byte, 0, 16+size)
+	b = binary.LittleEndian.AppendUint32(b, uint32(t.Unix()))
+	b = binary.LittleEndian.AppendUint32(b, uint32(t.Nanosecond()/1000))
+	b = binary.LittleEndian.AppendUint32(b, uint32(size))
+	b = binary.LittleEndian.AppendUint32(b, uint32(size))
+
+	ip := len(b)
+	b = append(b, 0x45, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(size))
+	b = binary.BigEndian.AppendUint16(b, p.id)
+	b = append(b, 0x40, 0, 64, 6, 0, 0) // don't fragment, TTL, TCP
+	b = append(b, src[:]...)
+	b = append(b, dst[:]...)
+	binary.BigEndian.PutUint16(b[ip+10:], ipChecksum(b[ip:]))
+	p.id++
+
+	b = binary.BigEndian.AppendUint16(b, uint16(srcPort))
+	b = binary.BigEndian.AppendUint16(b, uint16(dstPort))
+	b = binary.BigEndian.AppendUint32(b, p.seq[from])
+	b = binary.BigEndian.AppendUint32(b, p.seq[1-from])
+	b = append(b, 5<<4, 0x18) // 20 bytes of header, PSH and ACK
+	b = binary.BigEndian.AppendUint16(b, 0xFFFF)
+	b = append(b, 0, 0, 0, 0) // checksum left out, urgent pointer
+	p.seq[from] += uint32(len(data))
+	return append(b, data...)
+}
+
+// ipChecksum returns the checksum of an IPv4 header
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xFFFF {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
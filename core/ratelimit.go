@@ -0,0 +1,87 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter paces writes to a number of bytes per second with a token
+// bucket holding up to one second of bytes. A write larger than that is let
+// through and paid for by the writes after it, so nothing is ever dropped or
+// split. The zero value, like a limit of zero, does not limit.
+type RateLimiter struct {
+	mu     sync.Mutex
+	limit  int64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter of bytesPerSec, zero or less for none
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetLimit(bytesPerSec)
+	return l
+}
+
+// SetLimit changes the limit to bytesPerSec, zero or less for none. Writes
+// already waiting keep their delay.
+func (l *RateLimiter) SetLimit(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit <= 0 {
+		// a new limit starts with a full bucket
+		l.tokens = float64(bytesPerSec)
+	}
+	l.limit = max(bytesPerSec, 0)
+	l.tokens = min(l.tokens, float64(l.limit))
+	l.last = time.Now()
+}
+
+// Limit returns the limit in bytes per second, zero for none
+func (l *RateLimiter) Limit() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// Reserve takes n bytes from the bucket, returning how long to wait before
+// writing them
+func (l *RateLimiter) Reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit <= 0 {
+		return 0
+	}
+	now := time.Now()
+	rate := float64(l.limit)
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*rate, rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / rate * float64(time.Second))
+}
+
+// Wait reserves n bytes and sleeps until they may be written
+func (l *RateLimiter) Wait(n int) {
+	_ = l.WaitContext(context.Background(), n)
+}
+
+// WaitContext reserves n bytes and sleeps until they may be written or ctx
+// is done, returning the error of ctx then
+func (l *RateLimiter) WaitContext(ctx context.Context, n int) error {
+	d := l.Reserve(n)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -2,11 +2,16 @@ package core
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kdsmith18542/gordp/glog"
@@ -19,37 +24,231 @@ type Stream struct {
 
 	r func([]byte) (int, error)
 	w func([]byte) (int, error)
+
+	// serializes writes, which may come from other goroutines than the
+	// one reading, e.g. input events and keepalive pings
+	wmu sync.Mutex
+
+	// paces writes while set, until ctx is done
+	limiter atomic.Pointer[RateLimiter]
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	// retries failed reads while set
+	retry    *ReadRetry
+	retryCtx context.Context
+
+	// copies what is read while set, see Record
+	rec *bytes.Buffer
+
+	// bytes read and written, see Counts
+	read, written atomic.Uint64
+}
+
+// ReadRetry retries reads that fail with a transient error, e.g. a read
+// timeout on a lossy link. Only reads are retried: a read that failed
+// consumed nothing, while a failed write may have sent part of a PDU.
+type ReadRetry struct {
+	// Attempts is how many times one failed read is retried
+	Attempts int
+
+	// Backoff is the pause before each retry
+	Backoff time.Duration
+
+	// Retryable reports whether an error is transient. nil retries
+	// timeouts, see IsTimeout.
+	Retryable func(err error) bool
+
+	// Timeout bounds each retry of a read that timed out, whose deadline
+	// has passed. The deadline of the context of SetReadRetry bounds them
+	// too; with neither a retry waits until the context is done.
+	Timeout time.Duration
+}
+
+// deadline returns the read deadline of a retry within ctx
+func (r *ReadRetry) deadline(ctx context.Context) time.Time {
+	var t time.Time
+	if r.Timeout > 0 {
+		t = time.Now().Add(r.Timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (t.IsZero() || d.Before(t)) {
+		t = d
+	}
+	return t
+}
+
+// IsTimeout reports whether err is a network timeout
+func IsTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// SetReadRetry makes failed reads retry with r until ctx is done. A nil r
+// turns retrying off.
+func (s *Stream) SetReadRetry(ctx context.Context, r *ReadRetry) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s.retry, s.retryCtx = r, ctx
+}
+
+// retryRead reports whether a read that failed with err should be tried
+// again, after waiting for the backoff
+func (s *Stream) retryRead(attempt int, err error) bool {
+	r := s.retry
+	if r == nil || attempt >= r.Attempts || s.retryCtx.Err() != nil {
+		return false
+	}
+	retryable := r.Retryable
+	if retryable == nil {
+		retryable = IsTimeout
+	}
+	if !retryable(err) {
+		return false
+	}
+	glog.Debugf("read failed, retry %v of %v: %v", attempt+1, r.Attempts, err)
+	select {
+	case <-time.After(r.Backoff):
+	case <-s.retryCtx.Done():
+		return false
+	}
+	if !IsTimeout(err) {
+		return true
+	}
+	// the deadline that failed the read has passed and would fail the
+	// retry at once
+	if s.c.SetReadDeadline(r.deadline(s.retryCtx)) != nil {
+		return false
+	}
+	if s.retryCtx.Err() != nil {
+		// done while the deadline was set, which may have undone the
+		// interruption of the read
+		_ = s.c.SetReadDeadline(time.Now())
+		return false
+	}
+	return true
 }
 
 func (s *Stream) Read(b []byte) (n int, err error) {
-	return s.r(b)
+	for attempt := 0; ; attempt++ {
+		n, err = s.r(b)
+		if err == nil || n > 0 || !s.retryRead(attempt, err) {
+			if s.rec != nil && n > 0 {
+				s.rec.Write(b[:n])
+			}
+			s.read.Add(uint64(n))
+			return n, err
+		}
+	}
+}
+
+// Record copies everything read from the stream from now on, until the
+// returned func is called, which returns what was read in between. Only the
+// goroutine reading may record.
+func (s *Stream) Record() (stop func() []byte) {
+	rec := new(bytes.Buffer)
+	s.rec = rec
+	return func() []byte {
+		s.rec = nil
+		return rec.Bytes()
+	}
 }
 
 func (s *Stream) Write(b []byte) (n int, err error) {
-	return s.w(b)
+	// paced before taking wmu, so that a write waiting for the limiter
+	// does not hold up Peek or SetRateLimiter, and given up once the
+	// stream is closed
+	if l := s.limiter.Load(); l != nil {
+		if err := l.WaitContext(s.ctx, len(b)); err != nil {
+			return 0, err
+		}
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	n, err = s.w(b)
+	s.written.Add(uint64(n))
+	return n, err
+}
+
+// Counts returns how many bytes were read from and written to the stream,
+// after TLS decryption and before encryption when it is switched on
+func (s *Stream) Counts() (read, written uint64) {
+	return s.read.Load(), s.written.Load()
+}
+
+// SetRateLimiter paces writes with l, which may be shared with other streams
+// to limit them together. A nil l turns pacing off.
+func (s *Stream) SetRateLimiter(l *RateLimiter) {
+	s.limiter.Store(l)
+}
+
+// SetContext makes writes waiting for the rate limiter give up once ctx is
+// done, as they do once the stream is closed
+func (s *Stream) SetContext(ctx context.Context) {
+	context.AfterFunc(ctx, s.cancel)
 }
 
 func (s *Stream) Peek(n int) []byte {
 	if s.b == nil {
+		s.wmu.Lock()
 		s.b = bufio.NewReadWriter(bufio.NewReader(s.c), bufio.NewWriter(s.c))
 		s.r = func(b []byte) (int, error) { return s.b.Read(b) }
-		s.w = func(b []byte) (int, error) { return s.b.Write(b) }
+		s.w = func(b []byte) (int, error) {
+			// flush every write, PDUs must not sit in the buffer
+			n, err := s.b.Write(b)
+			if err == nil {
+				err = s.b.Flush()
+			}
+			return n, err
+		}
+		s.wmu.Unlock()
 	}
 	d, err := s.b.Peek(n)
+	for attempt := 0; err != nil && s.retryRead(attempt, err); attempt++ {
+		d, err = s.b.Peek(n)
+	}
 	ThrowError(err)
 	return d
 }
 
-func (s *Stream) SwitchSSL() {
-	config := &tls.Config{
+// DefaultTLSConfig returns the TLS settings SwitchSSL uses when given none:
+// TLS 1.2 or later, and for TLS 1.2 only ECDHE key exchange with AEAD
+// ciphers. RDP servers mostly present self-signed certificates, so the
+// certificate is not verified.
+func DefaultTLSConfig() *tls.Config {
+	return &tls.Config{
 		InsecureSkipVerify: true,
-		MinVersion:         tls.VersionTLS10,
-		MaxVersion:         tls.VersionTLS13,
+		MinVersion:         tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+}
+
+// SwitchSSL runs the TLS handshake with config, DefaultTLSConfig when nil,
+// and carries the stream over TLS from then on
+func (s *Stream) SwitchSSL(config *tls.Config) {
+	if config == nil {
+		config = DefaultTLSConfig()
 	}
 	tlsConn := tls.Client(s.c, config)
 	ThrowError(tlsConn.Handshake())
 	s.c = tlsConn
-	glog.Debug("switch to SSL ok")
+	state := tlsConn.ConnectionState()
+	glog.Infof("switch to SSL ok: %s, %s", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+}
+
+// TLSState returns the state of the TLS connection, false before SwitchSSL
+func (s *Stream) TLSState() (tls.ConnectionState, bool) {
+	if c, ok := s.c.(*tls.Conn); ok {
+		return c.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
 }
 
 func (s *Stream) PubKey() []byte {
@@ -80,7 +279,20 @@ func (s *Stream) ChannelBindingToken() []byte {
 	return nil
 }
 
+// SetReadDeadline makes reads fail with a timeout from t on, the zero
+// time removes the deadline
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	return s.c.SetReadDeadline(t)
+}
+
+// SetWriteDeadline makes writes fail with a timeout from t on, the zero
+// time removes the deadline
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	return s.c.SetWriteDeadline(t)
+}
+
 func (s *Stream) Close() {
+	s.cancel()
 	_ = s.c.Close()
 }
 
@@ -89,10 +301,54 @@ func GetCurrentTimestamp() int64 {
 	return time.Now().UnixMilli()
 }
 
-func NewStream(addr string, tmOut time.Duration) *Stream {
+// TCPOptions are the socket options NewStream sets on the connection
+type TCPOptions struct {
+	// NoDelay sends small writes, e.g. input events, right away instead of
+	// batching them with Nagle's algorithm
+	NoDelay bool
+
+	// KeepAlive is the interval of TCP keepalive probes, which detect a
+	// peer that went away. Zero keeps the default of net.Dial, every 15
+	// seconds, a negative value turns them off.
+	KeepAlive time.Duration
+}
+
+// SetTCPOptions applies opts to conn, doing nothing unless it is a TCP
+// connection
+func SetTCPOptions(conn net.Conn, opts TCPOptions) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcp.SetNoDelay(opts.NoDelay); err != nil {
+		return err
+	}
+	switch {
+	case opts.KeepAlive < 0:
+		return tcp.SetKeepAlive(false)
+	case opts.KeepAlive > 0:
+		if err := tcp.SetKeepAlive(true); err != nil {
+			return err
+		}
+		return tcp.SetKeepAlivePeriod(opts.KeepAlive)
+	}
+	return nil
+}
+
+func NewStream(addr string, tmOut time.Duration, opts TCPOptions) *Stream {
 	conn, err := net.DialTimeout("tcp", addr, tmOut)
 	ThrowError(err)
+	if err := SetTCPOptions(conn, opts); err != nil {
+		_ = conn.Close()
+		ThrowError(err)
+	}
+	return NewStreamFromConn(conn)
+}
+
+// NewStreamFromConn wraps an already established connection
+func NewStreamFromConn(conn net.Conn) *Stream {
 	s := &Stream{c: conn}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 	s.r = func(b []byte) (int, error) { return s.c.Read(b) }
 	s.w = func(b []byte) (int, error) { return s.c.Write(b) }
 	return s
@@ -0,0 +1,97 @@
+package gordp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/proto/t128"
+)
+
+// Reasons a connection fails, returned wrapped by Connect and Run so the
+// cause can be told with errors.Is, e.g. to tell the user why
+var (
+	// ErrAuthFailed is returned when Network Level Authentication fails,
+	// e.g. because of a wrong user name or password
+	ErrAuthFailed = errors.New("authentication failed")
+
+	// ErrProtocolNegotiation is returned when client and server agree on
+	// no security protocol, e.g. the server requires one the client lacks
+	ErrProtocolNegotiation = errors.New("protocol negotiation failed")
+
+	// ErrConnectionTimeout is returned when the server could not be
+	// reached or stopped answering within the timeout or context deadline
+	ErrConnectionTimeout = errors.New("connection timed out")
+
+	// ErrServerRedirect is returned when the server redirects the client
+	// to another host, e.g. a session broker, which is not supported
+	ErrServerRedirect = t128.ErrServerRedirect
+
+	// ErrLicensing is returned when the server refuses to license the
+	// client
+	ErrLicensing = errors.New("licensing failed")
+)
+
+// ErrServerDisconnect is returned when the server ended the connection
+// after telling why in a Set Error Info PDU. It matches errors.Is with an
+// *ErrServerDisconnect of the same Code, or of Code 0 for any code:
+//
+//	errors.Is(err, &ErrServerDisconnect{Code: t128.ERRINFO_IDLE_TIMEOUT})
+type ErrServerDisconnect struct {
+	// Code is the error info code, see the t128.ERRINFO_ constants
+	Code uint32
+
+	// Reason describes Code
+	Reason string
+
+	// Err is the error the connection ended with
+	Err error
+}
+
+func (e *ErrServerDisconnect) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("server disconnected: %s (%#x)", e.Reason, e.Code)
+	}
+	return fmt.Sprintf("server disconnected: %s (%#x): %v", e.Reason, e.Code, e.Err)
+}
+
+func (e *ErrServerDisconnect) Unwrap() error {
+	return e.Err
+}
+
+func (e *ErrServerDisconnect) Is(target error) bool {
+	t, ok := target.(*ErrServerDisconnect)
+	return ok && (t.Code == 0 || t.Code == e.Code)
+}
+
+// connectStep runs one step of the connection sequence, marking what it
+// throws with the failure reason kind
+func connectStep(kind error, step func()) {
+	if err := core.Try(step); err != nil {
+		core.ThrowError(fmt.Errorf("%w: %w", kind, err))
+	}
+}
+
+// connectError marks an error Connect stopped with as a timeout when it
+// is one, and as a server disconnect when the server said why
+func (c *Client) connectError(err error) error {
+	// a read interrupted by Cancel or Close is no timeout
+	if core.IsTimeout(err) && !errors.Is(err, ErrConnectionTimeout) && !errors.Is(err, context.Canceled) {
+		err = fmt.Errorf("%w: %w", ErrConnectionTimeout, err)
+	}
+	return c.sessionError(err)
+}
+
+// sessionError wraps err in an *ErrServerDisconnect when the server sent
+// a Set Error Info PDU before the connection ended
+func (c *Client) sessionError(err error) error {
+	if err == nil || c.errorInfo.ErrorInfo == t128.ERRINFO_NONE {
+		return err
+	}
+	return &ErrServerDisconnect{
+		Code:   c.errorInfo.ErrorInfo,
+		Reason: c.errorInfo.Reason(),
+		Err:    err,
+	}
+}
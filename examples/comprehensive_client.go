@@ -354,8 +354,6 @@ func (h *ComprehensiveClipboardHandler) OnFormatDataResponse(formatID clipboard.
 	switch formatID {
 	case clipboard.CLIPRDR_FORMAT_UNICODETEXT:
 		log.Printf("Text data: %s", string(data))
-	case clipboard.CLIPRDR_FORMAT_HTML:
-		log.Printf("HTML data: %s", string(data))
 	case clipboard.CLIPRDR_FORMAT_RAW_BITMAP:
 		log.Printf("Bitmap data: %d bytes", len(data))
 	default:
@@ -365,6 +363,11 @@ func (h *ComprehensiveClipboardHandler) OnFormatDataResponse(formatID clipboard.
 	return nil
 }
 
+func (h *ComprehensiveClipboardHandler) OnHTMLData(html string, sourceURL string) error {
+	log.Printf("HTML data from %q: %s", sourceURL, html)
+	return nil
+}
+
 func (h *ComprehensiveClipboardHandler) OnFileContentsRequest(streamID uint32, listIndex uint32, dwFlags uint32, nPositionLow uint32, nPositionHigh uint32, cbRequested uint32, clipDataID uint32) error {
 	log.Printf("File contents request: streamID=%d, listIndex=%d, flags=%d, position=%d, requested=%d, clipDataID=%d",
 		streamID, listIndex, dwFlags, (uint64(nPositionHigh)<<32)|uint64(nPositionLow), cbRequested, clipDataID)
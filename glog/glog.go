@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync/atomic"
 )
 
 type LEVEL int
@@ -19,8 +21,54 @@ const (
 var (
 	logger *log.Logger
 	level  = DEBUG
+
+	// set with Use, taking the place of logger
+	custom atomic.Pointer[Logger]
 )
 
+// Logger receives the log output of gordp in place of the standard logger,
+// e.g. an adapter to zap or logrus. Messages below the level set with
+// SetLevel are dropped before they reach it.
+type Logger interface {
+	Debugf(format string, v ...any)
+	Infof(format string, v ...any)
+	Warnf(format string, v ...any)
+	Errorf(format string, v ...any)
+}
+
+// Discard is a Logger that drops everything
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Debugf(string, ...any) {}
+func (discard) Infof(string, ...any)  {}
+func (discard) Warnf(string, ...any)  {}
+func (discard) Errorf(string, ...any) {}
+
+// Use routes all logging, the structured logging of GetStructuredLogger
+// included, to l. A nil l restores the standard logger of SetLogger.
+func Use(l Logger) {
+	if l == nil {
+		custom.Store(nil)
+		return
+	}
+	custom.Store(&l)
+}
+
+// current returns the Logger set with Use, nil for the standard logger
+func current() Logger {
+	if l := custom.Load(); l != nil {
+		return *l
+	}
+	return nil
+}
+
+// sprint formats v as Debug and the others print it
+func sprint(v []any) string {
+	return strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+}
+
 func init() {
 	logger = log.New(os.Stdout, "", 0)
 	logger.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
@@ -43,48 +91,80 @@ func logPrint(prefix string, v ...any) {
 
 func Debug(v ...any) {
 	if level <= DEBUG {
+		if l := current(); l != nil {
+			l.Debugf("%s", sprint(v))
+			return
+		}
 		logPrint("[DEBUG]", v)
 	}
 }
 
 func Debugf(f string, v ...interface{}) {
 	if level <= DEBUG {
+		if l := current(); l != nil {
+			l.Debugf(f, v...)
+			return
+		}
 		logPrint("[DEBUG]", fmt.Sprintf(f, v...))
 	}
 }
 
 func Info(v ...any) {
-	if level <= DEBUG {
+	if level <= INFO {
+		if l := current(); l != nil {
+			l.Infof("%s", sprint(v))
+			return
+		}
 		logPrint("[INFO]", v)
 	}
 }
 
 func Infof(f string, v ...interface{}) {
-	if level <= DEBUG {
+	if level <= INFO {
+		if l := current(); l != nil {
+			l.Infof(f, v...)
+			return
+		}
 		logPrint("[INFO]", fmt.Sprintf(f, v...))
 	}
 }
 
 func Warn(v ...any) {
-	if level <= DEBUG {
+	if level <= WARN {
+		if l := current(); l != nil {
+			l.Warnf("%s", sprint(v))
+			return
+		}
 		logPrint("[WARN]", v)
 	}
 }
 
 func Warnf(f string, v ...interface{}) {
-	if level <= DEBUG {
+	if level <= WARN {
+		if l := current(); l != nil {
+			l.Warnf(f, v...)
+			return
+		}
 		logPrint("[WARN]", fmt.Sprintf(f, v...))
 	}
 }
 
 func Error(v ...any) {
-	if level <= DEBUG {
+	if level <= ERROR {
+		if l := current(); l != nil {
+			l.Errorf("%s", sprint(v))
+			return
+		}
 		logPrint("[ERROR]", v)
 	}
 }
 
 func Errorf(f string, v ...interface{}) {
-	if level <= DEBUG {
+	if level <= ERROR {
+		if l := current(); l != nil {
+			l.Errorf(f, v...)
+			return
+		}
 		logPrint("[ERROR]", fmt.Sprintf(f, v...))
 	}
 }
@@ -0,0 +1,72 @@
+package glog
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingLogger keeps what it is given, prefixed with the level
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (r *recordingLogger) record(prefix, f string, v ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, prefix+" "+fmt.Sprintf(f, v...))
+}
+
+func (r *recordingLogger) Debugf(f string, v ...any) { r.record("D", f, v...) }
+func (r *recordingLogger) Infof(f string, v ...any)  { r.record("I", f, v...) }
+func (r *recordingLogger) Warnf(f string, v ...any)  { r.record("W", f, v...) }
+func (r *recordingLogger) Errorf(f string, v ...any) { r.record("E", f, v...) }
+
+func TestUse(t *testing.T) {
+	t.Cleanup(func() {
+		Use(nil)
+		SetLevel(DEBUG)
+	})
+	r := &recordingLogger{}
+	Use(r)
+
+	Debugf("a %d", 1)
+	Info("b", 2)
+	Warnf("c")
+	Error("d")
+	GetStructuredLogger().WarnStructured("e", map[string]interface{}{"y": 2, "x": "1"})
+	want := []string{"D a 1", "I b 2", "W c", "E d", "W e x=1 y=2"}
+	if strings.Join(r.lines, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", r.lines, want)
+	}
+
+	// the level filters before the logger
+	r.lines = nil
+	SetLevel(WARN)
+	Debug("dropped")
+	Infof("dropped")
+	Warn("kept")
+	Errorf("kept")
+	if len(r.lines) != 2 {
+		t.Errorf("got %q, want the warning and the error", r.lines)
+	}
+
+	// a structured logger of its own keeps its output
+	r.lines = nil
+	own := NewStructuredLogger(nil, DEBUG)
+	if own.followUse {
+		t.Error("expected only the global structured logger to follow Use")
+	}
+
+	Use(Discard)
+	Error("discarded")
+	Use(nil)
+	if current() != nil {
+		t.Error("expected Use(nil) to restore the standard logger")
+	}
+	if len(r.lines) != 0 {
+		t.Errorf("got %q after replacing the logger", r.lines)
+	}
+}
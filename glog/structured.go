@@ -2,8 +2,11 @@ package glog
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -24,6 +27,9 @@ type StructuredLogger struct {
 	logger *log.Logger
 	level  LEVEL
 	output *os.File
+
+	// logs to the Logger set with Use instead, when there is one
+	followUse bool
 }
 
 // NewStructuredLogger creates a new structured logger
@@ -44,6 +50,10 @@ func (sl *StructuredLogger) logStructured(level LEVEL, message string, fields ma
 	if level < sl.level {
 		return
 	}
+	if l := current(); l != nil && sl.followUse {
+		logFields(l, level, message, fields)
+		return
+	}
 
 	entry := LogEntry{
 		Timestamp: time.Now(),
@@ -63,6 +73,32 @@ func (sl *StructuredLogger) logStructured(level LEVEL, message string, fields ma
 	sl.logger.Println(string(jsonData))
 }
 
+// logFields logs message to l at level, followed by the fields as sorted
+// key=value pairs
+func logFields(l Logger, level LEVEL, message string, fields map[string]interface{}) {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(message)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, fields[k])
+	}
+
+	switch level {
+	case DEBUG:
+		l.Debugf("%s", b.String())
+	case INFO:
+		l.Infof("%s", b.String())
+	case WARN:
+		l.Warnf("%s", b.String())
+	default:
+		l.Errorf("%s", b.String())
+	}
+}
+
 // levelToString converts LEVEL to string
 func levelToString(level LEVEL) string {
 	switch level {
@@ -180,6 +216,7 @@ var structuredLogger *StructuredLogger
 
 func init() {
 	structuredLogger = NewStructuredLogger(nil, DEBUG)
+	structuredLogger.followUse = true
 }
 
 // SetStructuredLogger sets the global structured logger
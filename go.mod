@@ -4,8 +4,10 @@ go 1.21
 
 require (
 	github.com/huin/asn1ber v0.0.0-20120622192748-af09f62e6358
+	github.com/jezek/xgb v1.1.1
 	github.com/stretchr/testify v1.8.4
 	golang.org/x/crypto v0.17.0
+	golang.org/x/image v0.14.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -22,18 +22,39 @@ package gordp
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/core/compression"
 	"github.com/kdsmith18542/gordp/glog"
 	"github.com/kdsmith18542/gordp/proto/bitmap"
 	"github.com/kdsmith18542/gordp/proto/clipboard"
 	"github.com/kdsmith18542/gordp/proto/device"
 	"github.com/kdsmith18542/gordp/proto/drdynvc"
 	"github.com/kdsmith18542/gordp/proto/mcs"
+	"github.com/kdsmith18542/gordp/proto/orders"
+	"github.com/kdsmith18542/gordp/proto/pdu/connPdu"
+	"github.com/kdsmith18542/gordp/proto/rail"
+	"github.com/kdsmith18542/gordp/proto/rdpedisp"
+	"github.com/kdsmith18542/gordp/proto/rdpei"
+	"github.com/kdsmith18542/gordp/proto/sec"
 	"github.com/kdsmith18542/gordp/proto/t128"
 	"github.com/kdsmith18542/gordp/proto/virtualchannel"
+	"github.com/kdsmith18542/gordp/replay"
 )
 
 type Option struct {
@@ -43,14 +64,409 @@ type Option struct {
 
 	ConnectTimeout time.Duration
 
-	// Multi-monitor configuration (optional)
+	// Multi-monitor configuration (optional), used as is. See
+	// Client.SetMonitors for checking it.
 	Monitors []mcs.MonitorLayout
+
+	// RequestInitialRefresh asks the server to repaint the whole desktop right
+	// after connecting, so the first full frame arrives without waiting for
+	// the screen to change. nil means true.
+	RequestInitialRefresh *bool
+
+	// CapabilityOverride, if set, is called with the client capability sets
+	// just before the Confirm Active PDU is sent, so individual fields can be
+	// adjusted to work around server interop issues. Capability sets are not
+	// validated afterwards; inconsistent values can make the server drop the
+	// connection.
+	CapabilityOverride func(caps *Capabilities)
+
+	// ClipboardFormatListDebounce is the window within which identical
+	// clipboard format lists from the server are reported once. Zero uses
+	// clipboard.DefaultFormatListDebounce, a negative value disables it.
+	ClipboardFormatListDebounce time.Duration
+
+	// LogonTimeout is how long the server may take after connecting to
+	// report a logon before IsAtLogonScreen assumes the logon screen is
+	// showing. Zero uses DefaultLogonTimeout.
+	LogonTimeout time.Duration
+
+	// OnDisconnect, if set, is called from Run when the connection ends
+	// for any reason other than the client being closed or cancelled
+	OnDisconnect func(info DisconnectInfo)
+
+	// AutoReconnect reconnects right away when the server ends the session
+	// expecting a reconnect (see DisconnectInfo.ReconnectExpected), after
+	// which Run carries on with the new connection instead of returning.
+	AutoReconnect bool
+
+	// BulkCompression asks the server to compress updates with RDP 5.0
+	// bulk compression (MPPC with a 64K history), trading some CPU for
+	// bandwidth. The RDP 6.0 and 6.1 levels (NCRUSH and XCRUSH) are not
+	// decoded, so they are not asked for.
+	BulkCompression bool
+
+	// OnRoundTrip, if set, is called from Run with each round-trip time
+	// measured by Ping, e.g. to feed performance.AdvancedPerformanceManager.RecordLatency
+	OnRoundTrip func(rtt time.Duration)
+
+	// OnFrameDecoded, if set, is called from Run with each graphics update
+	// decoded, as counted by Stats, e.g. to feed
+	// performance.AdvancedPerformanceManager.RecordFrame
+	OnFrameDecoded func()
+
+	// KeepAliveInterval, if set, makes Run ping the server at this
+	// interval, and end with ErrConnectionLost when nothing has been
+	// received for three intervals, e.g. because the network went away
+	// without the TCP connection being closed.
+	KeepAliveInterval time.Duration
+
+	// AlternateShell, if set, is the program started on logon instead of
+	// the desktop, e.g. for single-application sessions without RAIL.
+	// WorkingDir is the directory it starts in. Each is limited to
+	// licPdu.MaxShellLength bytes in UTF-16, including the terminator.
+	AlternateShell string
+	WorkingDir     string
+
+	// HandshakeReadRetry, if set, retries reads that fail with a transient
+	// error while connecting, including when reconnecting, within the
+	// context of the connect. Writes are never retried.
+	HandshakeReadRetry *core.ReadRetry
+
+	// OnDisconnectReason, if set, is called as soon as the server says why
+	// it is about to end the session, with the error info code and its
+	// description, see t128.TsSetErrorInfoPDU.Reason
+	OnDisconnectReason func(code uint32, reason string)
+
+	// ToggleKeys is the state of the lock keys set on the server when the
+	// session starts. Client.SyncToggleKeys and lock key presses change
+	// it, and a reconnect restores the changed state.
+	ToggleKeys ToggleKeys
+
+	// ActivationTimeout bounds how long Connect waits for the server to
+	// finish the connection finalization with its Font Map PDU before
+	// failing with ErrActivationIncomplete. Zero uses
+	// DefaultActivationTimeout.
+	ActivationTimeout time.Duration
+
+	// ReadTimeout, if set, bounds every PDU read, failing with a timeout
+	// error instead of waiting forever on a server that stopped sending.
+	// Servers send nothing while the screen is still, so a session that
+	// may be idle for longer needs KeepAliveInterval set below it.
+	ReadTimeout time.Duration
+
+	// TCPNoDelay turns off Nagle's algorithm on the connection, so input
+	// events are not held back to be batched. nil means true.
+	TCPNoDelay *bool
+
+	// TCPKeepAlive is the interval of TCP keepalive probes on the
+	// connection, which detect a server that went away while idle. Zero
+	// keeps the default of net.Dial, every 15 seconds, a negative value
+	// turns them off.
+	TCPKeepAlive time.Duration
+
+	// DecodeWorkers is how many goroutines decode the bitmap tiles of one
+	// update at once. The tiles still reach the Processor one at a time
+	// and in the order the server sent them. 0 or 1 decodes them on the
+	// Run goroutine.
+	DecodeWorkers int
+
+	// PersistentBitmapCache advertises the bitmap cache as kept across
+	// sessions and lists the keys it holds to the server, which then
+	// draws those bitmaps from the cache instead of sending them again.
+	// Load the cache of an earlier session with BitmapCache().LoadFromDisk
+	// before Connect and save it with SaveToDisk once the session ended.
+	PersistentBitmapCache bool
+
+	// SharedCache, if set, is the bitmap cache of the client instead of
+	// one of its own, shared with the other clients given the same, e.g.
+	// sessions proxied to one desktop, which keeps tiles they all receive
+	// once. The client holds a reference to it until Close.
+	SharedCache *t128.SharedBitmapCache
+
+	// OnProgress, if set, is called from Connect as each phase of the
+	// connection sequence starts, with one of the Stage constants, e.g.
+	// to show progress or tell where a slow handshake is waiting
+	OnProgress func(stage string)
+
+	// InputFlushInterval, if set, holds keyboard and mouse input for up to
+	// this long and sends what gathered in one Fast-Path input PDU, with
+	// runs of pointer moves merged into one, to spare the wire
+	// during drags. Client.FlushInput sends it at once, as does Close.
+	// Zero sends every event as it comes.
+	InputFlushInterval time.Duration
+
+	// Width and Height are the desktop size asked of the server, in
+	// pixels. Zero uses DefaultWidth and DefaultHeight. With Monitors
+	// set the size is that of the monitor layout instead.
+	Width, Height int
+
+	// ColorDepth is the color depth asked of the server in bits per
+	// pixel, one of 8, 15, 16, 24 and 32. Zero uses DefaultColorDepth.
+	ColorDepth int
+
+	// RemoteApp, if set, runs the session as a RemoteApp session (MS-RDPERP)
+	// showing the windows of this program rather than a desktop. The
+	// windows are reported to the handler set with SetRailHandler.
+	RemoteApp *RemoteApp
+
+	// KeyboardLayout is the keyboard layout identifier (KLID) of the
+	// session, one of the mcs layout constants such as mcs.GERMAN, or the
+	// KbdLayout of a t128.ScanCodeLayout. The server translates scancodes
+	// with it, so dead keys and AltGr combinations typed with SendScanCode
+	// or SendStringWithLayout come out as on a local keyboard of that
+	// layout. Zero uses mcs.US.
+	KeyboardLayout uint32
+
+	// DrawingOrders asks the server for drawing orders (MS-RDPEGDI), the
+	// fills, copies, lines and text Run paints on the desktop itself,
+	// rather than for bitmaps only. Run then also composites every bitmap
+	// into a desktop of its own when the framebuffer is not enabled, for
+	// the orders copying from it. An order the client cannot read drops
+	// the rest of its update.
+	DrawingOrders bool
+
+	// OffscreenCacheSize and OffscreenCacheEntries bound the offscreen
+	// bitmap cache, in kilobytes and bitmaps, and are announced to the
+	// server so it keeps its offscreen surfaces within them. The server
+	// only draws offscreen with DrawingOrders. Zero uses
+	// DefaultOffscreenCacheSize and DefaultOffscreenCacheEntries, larger
+	// values than the protocol allows, 7680 KB and 500 entries, are capped.
+	OffscreenCacheSize    uint16
+	OffscreenCacheEntries uint16
+
+	// MaxUnacknowledgedFrames is how many frames the server may send
+	// before the client acknowledged the first of them. Run acknowledges
+	// each frame once it has been drawn, so a server pacing its output by
+	// the acknowledgements does not overrun a slow client. The surface
+	// commands the frames are made of are announced with it. Zero, the
+	// default, leaves frames unacknowledged.
+	MaxUnacknowledgedFrames int
+
+	// OnRawPDU, if set, is called with every PDU received or sent from
+	// the capabilities exchange on, direction being DirectionInbound or
+	// DirectionOutbound, as it is on the wire apart from TLS. It is called
+	// from the goroutine reading or writing the PDU and must not keep data.
+	// See also DumpPCAP.
+	OnRawPDU func(direction string, data []byte)
+
+	// Logger, if set, receives all log output, see SetLogger. Logging is
+	// shared by every client of the process, so this replaces the logger
+	// of those created before too.
+	Logger glog.Logger
+
+	// DisabledChannels names virtual channels the client must not use,
+	// e.g. "cliprdr" and "rdpdr" where clipboard and drive redirection
+	// have to stay off. They are left out of the default channels, cannot
+	// be registered with RegisterStaticChannel and so are never offered
+	// to the server. Names are not case sensitive.
+	DisabledChannels []string
+
+	// TLSConfig, if set, is used for the TLS handshake when the server
+	// picks TLS or NLA security, e.g. to restrict the versions and cipher
+	// suites or to verify the certificate against RootCAs. Without
+	// ServerName set, the host of Addr is used. nil uses
+	// core.DefaultTLSConfig, TLS 1.2 or later without verifying the
+	// certificate.
+	TLSConfig *tls.Config
+
+	// MaxPDUSize, if set, caps the size in bytes of the PDUs the client
+	// sends, for gateways that choke on large ones. Virtual channel data
+	// goes in smaller chunks, whose size is announced in the virtual
+	// channel capability set; input PDUs always stay below MinPDUSize.
+	// PDUs of the share channel, like the Confirm Active PDU, cannot be
+	// split and go whole. Values below MinPDUSize use MinPDUSize.
+	MaxPDUSize int
+
+	// MaxInboundPDUSize, if set, is the largest PDU the client reads, in
+	// bytes. A server declaring a larger one fails Run with a
+	// core.LengthError before anything is allocated for it. Zero allows
+	// any size the protocol does, 65535 bytes.
+	MaxInboundPDUSize int
+
+	// RestrictedAdmin connects in Restricted Admin mode: the server logs
+	// on with the network identity NLA proved, and neither CredSSP nor the
+	// client info packet carry the password, so a compromised host cannot
+	// reuse it. The server has to offer NLA and support the mode,
+	// otherwise Connect fails with ErrProtocolNegotiation.
+	//
+	// Remote Credential Guard, which keeps credentials off the host too, is
+	// not supported: it needs a Kerberos logon and the client authenticates
+	// with NTLM only.
+	RestrictedAdmin bool
+}
+
+// SetLogger routes the log output of gordp to l, e.g. an adapter to zap or
+// logrus, or glog.Discard to silence it. nil restores the default of
+// printing to standard output. glog.SetLevel still filters what reaches l.
+func SetLogger(l glog.Logger) {
+	glog.Use(l)
 }
 
+// Processor receives the bitmap updates of the session from Run, on the
+// Run goroutine. Client.Updates delivers them on a channel instead, for
+// consumers with a render loop of their own; use one or the other.
 type Processor interface {
 	ProcessBitmap(*bitmap.Option, *bitmap.BitMap)
 }
 
+// BitmapUpdate is a decoded bitmap update, see Client.Updates. Option
+// tells where on the desktop Bitmap goes.
+type BitmapUpdate struct {
+	Option *bitmap.Option
+	Bitmap *bitmap.BitMap
+}
+
+// updatesBuffer is how many bitmap updates the channel of Client.Updates
+// holds before Run waits for them to be received
+const updatesBuffer = 64
+
+// updatesProcessor publishes every bitmap to the channel of Client.Updates,
+// if there is one, after handing it to the user's processor
+type updatesProcessor struct {
+	c    *Client
+	ctx  context.Context
+	next Processor
+}
+
+func (p *updatesProcessor) ProcessBitmap(option *bitmap.Option, bmp *bitmap.BitMap) {
+	if p.next != nil {
+		p.next.ProcessBitmap(option, bmp)
+	}
+	p.c.updatesMu.Lock()
+	updates := p.c.updates
+	p.c.updatesMu.Unlock()
+	if updates == nil {
+		return
+	}
+	// A full channel holds up Run, and so the reading of the connection,
+	// until the consumer catches up. Updates cannot be dropped, as each
+	// draws over the ones before it.
+	select {
+	case updates <- BitmapUpdate{Option: option, Bitmap: bmp}:
+	case <-p.ctx.Done():
+	case <-p.c.ctx.Done():
+	}
+}
+
+// framebufferProcessor composites every bitmap into the client framebuffer
+// before handing it to the user's processor
+type framebufferProcessor struct {
+	fb   *bitmap.Framebuffer
+	next Processor
+}
+
+func (p *framebufferProcessor) ProcessBitmap(option *bitmap.Option, bmp *bitmap.BitMap) {
+	p.fb.ApplyUpdate(option, bmp)
+	if p.next != nil {
+		p.next.ProcessBitmap(option, bmp)
+	}
+}
+
+// Frame is the part of the desktop a frame of updates changed, see OnFrame
+type Frame struct {
+	// ID is that of the frame markers the server put around the updates,
+	// 0 for updates it sent without them
+	ID uint32
+	// Rects are the changed rectangles, merged where they touch so that
+	// none overlap
+	Rects []image.Rectangle
+}
+
+// maxFrameRects is how many rectangles a Frame has at most, a frame
+// changing more scattered regions has their bounding box instead
+const maxFrameRects = 64
+
+// frameProcessor gathers the rectangles drawn by Run into frames for
+// OnFrame. A frame ends with the end marker of the server or, outside of
+// markers, with the update.
+type frameProcessor struct {
+	c       *Client
+	onFrame func(Frame)
+	id      uint32
+	open    bool // between the begin and end markers of a frame
+	rects   []image.Rectangle
+	next    Processor
+}
+
+func (p *frameProcessor) ProcessBitmap(option *bitmap.Option, bmp *bitmap.BitMap) {
+	r := image.Rect(option.Left, option.Top, option.Left+option.Width, option.Top+option.Height)
+	if p.c.desktopWidth != 0 && p.c.desktopHeight != 0 {
+		r = r.Intersect(image.Rect(0, 0, int(p.c.desktopWidth), int(p.c.desktopHeight)))
+	}
+	if !r.Empty() {
+		p.rects = append(p.rects, r)
+	}
+	if p.next != nil {
+		p.next.ProcessBitmap(option, bmp)
+	}
+}
+
+// marker begins or ends a frame. A frame begun while another is open, its
+// end marker lost, ends the open one first.
+func (p *frameProcessor) marker(cmd *t128.TsFrameMarkerCommand) {
+	switch cmd.FrameAction {
+	case t128.SURFACECMD_FRAMEACTION_BEGIN:
+		p.flush(p.open)
+		p.id, p.open = cmd.FrameId, true
+	case t128.SURFACECMD_FRAMEACTION_END:
+		p.id = cmd.FrameId
+		p.flush(true)
+	}
+}
+
+// endUpdate ends the frame of an update sent outside of frame markers
+func (p *frameProcessor) endUpdate() {
+	if !p.open {
+		p.flush(false)
+	}
+}
+
+// flush hands the frame gathered so far to onFrame, if it changed anything
+// or marked is set
+func (p *frameProcessor) flush(marked bool) {
+	if marked || len(p.rects) > 0 {
+		p.onFrame(Frame{ID: p.id, Rects: coalesceRects(p.rects)})
+	}
+	p.id, p.open, p.rects = 0, false, nil
+}
+
+// coalesceRects merges the rectangles that overlap or touch into their
+// bounding boxes until none do, and into one bounding box altogether if
+// more than maxFrameRects are left
+func coalesceRects(rects []image.Rectangle) []image.Rectangle {
+	out := make([]image.Rectangle, 0, len(rects))
+	for _, r := range rects {
+		// out holds no two rectangles that touch, so only those r grows
+		// to reach need to be looked at again
+		for merged := true; merged; {
+			merged = false
+			for i := 0; i < len(out); i++ {
+				if o := out[i]; r.Min.X <= o.Max.X && o.Min.X <= r.Max.X && r.Min.Y <= o.Max.Y && o.Min.Y <= r.Max.Y {
+					r = r.Union(o)
+					out[i] = out[len(out)-1]
+					out = out[:len(out)-1]
+					merged = true
+					i--
+				}
+			}
+		}
+		out = append(out, r)
+	}
+	if len(out) > maxFrameRects {
+		bounds := image.Rectangle{}
+		for _, r := range out {
+			bounds = bounds.Union(r)
+		}
+		out = []image.Rectangle{bounds}
+	}
+	return out
+}
+
+// Client is a connection to an RDP server. Connect sets up the session and
+// Run reads what the server sends. The input methods, such as SendKeyDown,
+// SendScanCode and SendMouseMoveEvent, may be called from other goroutines,
+// e.g. the UI thread of a front-end, while Run is active: PDU writes are
+// serialized and the key and pointer state they track is locked.
 type Client struct {
 	option Option
 
@@ -58,30 +474,85 @@ type Client struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	//conn   net.Conn // TCP连接
+	conn   net.Conn // from NewClientWithConn, until Connect takes it
 	stream *core.Stream
 
+	// paces writes to the stream, see SetBandwidthLimit
+	bandwidth core.RateLimiter
+
 	// from negotiation
 	selectProtocol uint32 // 协商RDP协议，0:rdp, 1:ssl, 2:hybrid
 	userId         uint16
 	shareId        uint32
 	serverVersion  uint32 // 服务端RDP版本号
 
-	// input state
+	// from basic settings exchange, the encryption the server chose for
+	// Standard RDP Security
+	serverSecurity mcs.ServerSecurityData
+
+	// Standard RDP Security, nil when TLS protects the connection or the
+	// server does not encrypt
+	encryption *sec.Encryption
+
+	// writeMu is held for every PDU written once connected, so PDUs sent
+	// from several goroutines at once never interleave on the stream and
+	// reach the server in the order they were encrypted in
+	writeMu sync.Mutex
+
+	// from capabilities exchange
+	desktopWidth  uint16
+	desktopHeight uint16
+	bitsPerPixel  uint16
+	relativeMouse bool          // both sides take relative pointer events
+	frameAck      bool          // both sides take frame acknowledgements
+	serverLimits  *ServerLimits // nil until announced
+
+	// input state. keyMu is held by the input methods while they send
+	// their events, so that those of two calls do not interleave, and
+	// guards the state they track. toggleMu guards toggleKeys, which Run
+	// updates too, and is never held while writing.
+	keyMu        sync.Mutex
 	modifierKeys t128.ModifierKey
+	pressedKeys  map[uint8]t128.ModifierKey // held keys and the modifiers pressed for them
+	relativeMode bool                       // see SetRelativeMouseMode
+	pointerX     uint16                     // last absolute pointer position
+	pointerY     uint16
+	toggleMu     sync.Mutex
+	toggleKeys   ToggleKeys
+	onIndicators func(caps, num, scroll bool) // see OnKeyboardIndicators
+
+	// input held back by Option.InputFlushInterval
+	inputMu    sync.Mutex
+	inputQueue []t128.TsFpInputEvent
+	inputTimer *time.Timer
+	inputErr   error // of the last timed flush, returned by the next send
 
 	// Virtual channel support
 	vcManager  *virtualchannel.VirtualChannelManager
 	vcHandlers map[string]virtualchannel.VirtualChannelHandler
 
+	// static channels offered to the server, the default ones and those of
+	// RegisterStaticChannel
+	staticChannels []*virtualchannel.VirtualChannel
+
 	// Dynamic virtual channel support
 	dvcManager *drdynvc.DynamicVirtualChannelManager
 
-	// Dynamic virtual channel custom handlers
+	// Dynamic virtual channel custom handlers, the listeners for the
+	// channels the server creates
+	dvcMu       sync.Mutex // guards dvcHandlers
 	dvcHandlers map[string]drdynvc.DynamicVirtualChannelHandler
 
-	// Bitmap cache and compression support
+	// Multi-touch input over the RDPEI dynamic virtual channel
+	touchManager *rdpei.TouchManager
+
+	// Monitor layout changes over the RDPEDISP dynamic virtual channel
+	displayManager *rdpedisp.DisplayManager
+
+	// Bitmap cache and compression support, from Option.SharedCache when
+	// set, whose reference releaseCache drops once
 	bitmapCacheManager *t128.BitmapCacheManager
+	releaseCache       sync.Once
 
 	// Offscreen bitmap support
 	offscreenBitmapManager *t128.OffscreenBitmapManager
@@ -93,9 +564,102 @@ type Client struct {
 
 	// Multi-monitor configuration
 	monitors []mcs.MonitorLayout
+
+	// Composited desktop, when enabled
+	framebuffer *bitmap.Framebuffer
+
+	// Drawing orders: their decoder and painter, and the desktop they paint
+	// on when the framebuffer is not enabled
+	orderDecoder *orders.Decoder
+	painter      *orders.Painter
+	canvas       *bitmap.Framebuffer
+	cellsMu      sync.Mutex
+	bitmapCells  map[uint32]uint64 // bitmap cache key of each cell, see bitmapCell
+
+	onFrame func(Frame)     // see OnFrame
+	frames  *frameProcessor // of the Run in progress, nil without onFrame
+
+	// bitmap updates published by Run, see Updates
+	updatesMu sync.Mutex
+	updates   chan BitmapUpdate
+
+	// Active palette for 8bpp bitmaps, from palette updates
+	palette color.Palette
+
+	// Pointer the server shows, the shapes it cached, and the processor of
+	// Run told of it, see PointerProcessor
+	pointer          bitmap.Pointer
+	pointerCache     [t128.ColorPointerCacheSize]*bitmap.Pointer
+	pointerProcessor PointerProcessor
+
+	// Last Set Error Info PDU of the connection, and how to reconnect
+	errorInfo t128.TsSetErrorInfoPDU
+	connect   func() error
+
+	// Decompresses server PDUs when bulk compression is negotiated
+	bulk *compression.Decompressor
+
+	// Fast-path update fragments received so far
+	fpFragments t128.FpFragments
+
+	// Round trip measured by Ping
+	pingMu   sync.Mutex
+	pingSent time.Time
+	rtt      time.Duration
+
+	// Keepalive state: when the server was last heard from, in Unix
+	// nanoseconds, and whether the keepalive gave up on the connection
+	lastRead      atomic.Int64
+	connLost      atomic.Bool
+	keepAlivePing atomic.Bool // a keepalive ping is being written
+
+	// capture written by DumpPCAP, nil when not dumping
+	pcap atomic.Pointer[core.PcapWriter]
+
+	// recording written by StartRecording, nil when not recording
+	recorder atomic.Pointer[replay.Recorder]
+
+	// graphics updates with bitmap data read on this connection and the
+	// bytes of their bitmap data, see Stats
+	framesDecoded atomic.Uint64
+	frameBytes    atomic.Uint64
+
+	// set from the end of the connection finalization until the session ends
+	connected atomic.Bool
+
+	// set while Run or RunWithContext reads PDUs
+	running atomic.Bool
+
+	// where the answer to the Shutdown Request PDU of Logoff goes
+	logoffMu    sync.Mutex
+	logoffReply chan error
+
+	// read deadline of the connection sequence step in progress
+	readBy time.Time
+
+	// done interrupts reads, see interruptReads; guarded by deadlineMu
+	// together with the read deadline of the stream
+	deadlineMu sync.Mutex
+	readCtx    context.Context
+
+	// Logon state from Save Session Info PDUs
+	logonMu     sync.Mutex
+	connectedAt time.Time
+	logonInfo   *LogonInfo
+	onLogonInfo func(info LogonInfo) // see OnLogonInfo
+
+	onBeep func(frequency, durationMs uint32) // see OnBeep
+
+	// RemoteApp windows, see Option.RemoteApp
+	railManager *rail.Manager
+	railHandler RailHandler
+	railIcons   map[uint32]*rail.Icon // by cache id and entry
 }
 
 func NewClient(opt *Option) *Client {
+	if opt.Logger != nil {
+		SetLogger(opt.Logger)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	c := &Client{
 		option: Option{
@@ -104,50 +668,95 @@ func NewClient(opt *Option) *Client {
 			Password:       opt.Password,
 			ConnectTimeout: opt.ConnectTimeout,
 			Monitors:       opt.Monitors,
+
+			RequestInitialRefresh: opt.RequestInitialRefresh,
+			CapabilityOverride:    opt.CapabilityOverride,
+
+			ClipboardFormatListDebounce: opt.ClipboardFormatListDebounce,
+			LogonTimeout:                opt.LogonTimeout,
+			BulkCompression:             opt.BulkCompression,
+			OnDisconnect:                opt.OnDisconnect,
+			AutoReconnect:               opt.AutoReconnect,
+			OnRoundTrip:                 opt.OnRoundTrip,
+			OnFrameDecoded:              opt.OnFrameDecoded,
+			KeepAliveInterval:           opt.KeepAliveInterval,
+			AlternateShell:              opt.AlternateShell,
+			WorkingDir:                  opt.WorkingDir,
+			HandshakeReadRetry:          opt.HandshakeReadRetry,
+			OnDisconnectReason:          opt.OnDisconnectReason,
+			ToggleKeys:                  opt.ToggleKeys,
+			ActivationTimeout:           opt.ActivationTimeout,
+			ReadTimeout:                 opt.ReadTimeout,
+			TCPNoDelay:                  opt.TCPNoDelay,
+			TCPKeepAlive:                opt.TCPKeepAlive,
+			DecodeWorkers:               opt.DecodeWorkers,
+			PersistentBitmapCache:       opt.PersistentBitmapCache,
+			OnProgress:                  opt.OnProgress,
+			InputFlushInterval:          opt.InputFlushInterval,
+			Width:                       opt.Width,
+			Height:                      opt.Height,
+			ColorDepth:                  opt.ColorDepth,
+			KeyboardLayout:              opt.KeyboardLayout,
+			DrawingOrders:               opt.DrawingOrders,
+			OffscreenCacheSize:          opt.OffscreenCacheSize,
+			OffscreenCacheEntries:       opt.OffscreenCacheEntries,
+			MaxUnacknowledgedFrames:     opt.MaxUnacknowledgedFrames,
+			OnRawPDU:                    opt.OnRawPDU,
+			SharedCache:                 opt.SharedCache,
+			RemoteApp:                   opt.RemoteApp,
+			Logger:                      opt.Logger,
+			DisabledChannels:            opt.DisabledChannels,
+			TLSConfig:                   opt.TLSConfig,
+			MaxPDUSize:                  opt.MaxPDUSize,
+			MaxInboundPDUSize:           opt.MaxInboundPDUSize,
+			RestrictedAdmin:             opt.RestrictedAdmin,
 		},
 		ctx:      ctx,
 		cancel:   cancel,
 		monitors: opt.Monitors,
+
+		pressedKeys: make(map[uint8]t128.ModifierKey),
+		toggleKeys:  opt.ToggleKeys,
 	}
 	if c.option.ConnectTimeout == 0 {
 		c.option.ConnectTimeout = 5 * time.Second
 	}
+	c.connect = c.Connect
 	c.vcManager = virtualchannel.NewVirtualChannelManager()
 	c.vcHandlers = make(map[string]virtualchannel.VirtualChannelHandler)
 	c.dvcManager = drdynvc.NewDynamicVirtualChannelManager()
 	c.dvcHandlers = make(map[string]drdynvc.DynamicVirtualChannelHandler)
-	c.bitmapCacheManager = t128.NewBitmapCacheManager()
-	c.offscreenBitmapManager = t128.NewOffscreenBitmapManager(7680, 100) // Default values
-	c.clipboardManager = clipboard.NewClipboardManager(nil)
+	c.touchManager = rdpei.NewTouchManager(c.SendDynamicVirtualChannelData)
+	c.dvcHandlers[rdpei.CHANNEL_NAME] = c.touchManager
+	c.displayManager = rdpedisp.NewDisplayManager(c.SendDynamicVirtualChannelData)
+	c.dvcHandlers[rdpedisp.CHANNEL_NAME] = c.displayManager
+	c.bitmapCacheManager = c.newBitmapCache()
+	c.offscreenBitmapManager = t128.NewOffscreenBitmapManager(c.offscreenCacheSettings())
+	c.clipboardManager = c.newClipboardManager(nil)
 	c.deviceManager = device.NewDeviceManager(nil)
+	c.deviceManager.SetTransport(c.sendDeviceData)
 
-	// Register default virtual channels
-	_ = c.vcManager.RegisterChannel(&virtualchannel.VirtualChannel{
-		ID:    1,
-		Name:  virtualchannel.CHANNEL_NAME_CLIPRDR,
-		Flags: virtualchannel.CHANNEL_FLAG_FIRST | virtualchannel.CHANNEL_FLAG_LAST,
-	})
-	_ = c.vcManager.RegisterChannel(&virtualchannel.VirtualChannel{
-		ID:    2,
-		Name:  virtualchannel.CHANNEL_NAME_RDPSND,
-		Flags: virtualchannel.CHANNEL_FLAG_FIRST | virtualchannel.CHANNEL_FLAG_LAST,
-	})
-	_ = c.vcManager.RegisterChannel(&virtualchannel.VirtualChannel{
-		ID:    3,
-		Name:  virtualchannel.CHANNEL_NAME_DRDYNVC,
-		Flags: virtualchannel.CHANNEL_FLAG_FIRST | virtualchannel.CHANNEL_FLAG_LAST,
-	})
-	_ = c.vcManager.RegisterChannel(&virtualchannel.VirtualChannel{
-		ID:    4,
-		Name:  virtualchannel.CHANNEL_NAME_RDPDR,
-		Flags: virtualchannel.CHANNEL_FLAG_FIRST | virtualchannel.CHANNEL_FLAG_LAST,
-	})
+	c.registerDefaultChannels()
+	c.registerRemoteApp()
+
+	return c
+}
 
+// NewClientWithConn creates a client that runs the connection sequence over
+// conn instead of dialing Option.Addr, e.g. a tunnelled connection or the
+// in-memory server of package testutil. Only the first Connect uses conn,
+// a reconnect dials Option.Addr.
+func NewClientWithConn(conn net.Conn, opt *Option) *Client {
+	c := NewClient(opt)
+	c.conn = conn
 	return c
 }
 
 // NewClientWithContext creates a new client with a custom context
 func NewClientWithContext(ctx context.Context, opt *Option) *Client {
+	if opt.Logger != nil {
+		SetLogger(opt.Logger)
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	c := &Client{
 		option: Option{
@@ -156,44 +765,76 @@ func NewClientWithContext(ctx context.Context, opt *Option) *Client {
 			Password:       opt.Password,
 			ConnectTimeout: opt.ConnectTimeout,
 			Monitors:       opt.Monitors,
+
+			RequestInitialRefresh: opt.RequestInitialRefresh,
+			CapabilityOverride:    opt.CapabilityOverride,
+
+			ClipboardFormatListDebounce: opt.ClipboardFormatListDebounce,
+			LogonTimeout:                opt.LogonTimeout,
+			BulkCompression:             opt.BulkCompression,
+			OnDisconnect:                opt.OnDisconnect,
+			AutoReconnect:               opt.AutoReconnect,
+			OnRoundTrip:                 opt.OnRoundTrip,
+			OnFrameDecoded:              opt.OnFrameDecoded,
+			KeepAliveInterval:           opt.KeepAliveInterval,
+			AlternateShell:              opt.AlternateShell,
+			WorkingDir:                  opt.WorkingDir,
+			HandshakeReadRetry:          opt.HandshakeReadRetry,
+			OnDisconnectReason:          opt.OnDisconnectReason,
+			ToggleKeys:                  opt.ToggleKeys,
+			ActivationTimeout:           opt.ActivationTimeout,
+			ReadTimeout:                 opt.ReadTimeout,
+			TCPNoDelay:                  opt.TCPNoDelay,
+			TCPKeepAlive:                opt.TCPKeepAlive,
+			DecodeWorkers:               opt.DecodeWorkers,
+			PersistentBitmapCache:       opt.PersistentBitmapCache,
+			OnProgress:                  opt.OnProgress,
+			InputFlushInterval:          opt.InputFlushInterval,
+			Width:                       opt.Width,
+			Height:                      opt.Height,
+			ColorDepth:                  opt.ColorDepth,
+			KeyboardLayout:              opt.KeyboardLayout,
+			DrawingOrders:               opt.DrawingOrders,
+			OffscreenCacheSize:          opt.OffscreenCacheSize,
+			OffscreenCacheEntries:       opt.OffscreenCacheEntries,
+			MaxUnacknowledgedFrames:     opt.MaxUnacknowledgedFrames,
+			OnRawPDU:                    opt.OnRawPDU,
+			SharedCache:                 opt.SharedCache,
+			RemoteApp:                   opt.RemoteApp,
+			Logger:                      opt.Logger,
+			DisabledChannels:            opt.DisabledChannels,
+			TLSConfig:                   opt.TLSConfig,
+			MaxPDUSize:                  opt.MaxPDUSize,
+			MaxInboundPDUSize:           opt.MaxInboundPDUSize,
+			RestrictedAdmin:             opt.RestrictedAdmin,
 		},
 		ctx:      ctx,
 		cancel:   cancel,
 		monitors: opt.Monitors,
+
+		pressedKeys: make(map[uint8]t128.ModifierKey),
+		toggleKeys:  opt.ToggleKeys,
 	}
 	if c.option.ConnectTimeout == 0 {
 		c.option.ConnectTimeout = 5 * time.Second
 	}
+	c.connect = c.Connect
 	c.vcManager = virtualchannel.NewVirtualChannelManager()
 	c.vcHandlers = make(map[string]virtualchannel.VirtualChannelHandler)
 	c.dvcManager = drdynvc.NewDynamicVirtualChannelManager()
 	c.dvcHandlers = make(map[string]drdynvc.DynamicVirtualChannelHandler)
-	c.bitmapCacheManager = t128.NewBitmapCacheManager()
-	c.offscreenBitmapManager = t128.NewOffscreenBitmapManager(7680, 100) // Default values
-	c.clipboardManager = clipboard.NewClipboardManager(nil)
+	c.touchManager = rdpei.NewTouchManager(c.SendDynamicVirtualChannelData)
+	c.dvcHandlers[rdpei.CHANNEL_NAME] = c.touchManager
+	c.displayManager = rdpedisp.NewDisplayManager(c.SendDynamicVirtualChannelData)
+	c.dvcHandlers[rdpedisp.CHANNEL_NAME] = c.displayManager
+	c.bitmapCacheManager = c.newBitmapCache()
+	c.offscreenBitmapManager = t128.NewOffscreenBitmapManager(c.offscreenCacheSettings())
+	c.clipboardManager = c.newClipboardManager(nil)
 	c.deviceManager = device.NewDeviceManager(nil)
+	c.deviceManager.SetTransport(c.sendDeviceData)
 
-	// Register default virtual channels
-	_ = c.vcManager.RegisterChannel(&virtualchannel.VirtualChannel{
-		ID:    1,
-		Name:  virtualchannel.CHANNEL_NAME_CLIPRDR,
-		Flags: virtualchannel.CHANNEL_FLAG_FIRST | virtualchannel.CHANNEL_FLAG_LAST,
-	})
-	_ = c.vcManager.RegisterChannel(&virtualchannel.VirtualChannel{
-		ID:    2,
-		Name:  virtualchannel.CHANNEL_NAME_RDPSND,
-		Flags: virtualchannel.CHANNEL_FLAG_FIRST | virtualchannel.CHANNEL_FLAG_LAST,
-	})
-	_ = c.vcManager.RegisterChannel(&virtualchannel.VirtualChannel{
-		ID:    3,
-		Name:  virtualchannel.CHANNEL_NAME_DRDYNVC,
-		Flags: virtualchannel.CHANNEL_FLAG_FIRST | virtualchannel.CHANNEL_FLAG_LAST,
-	})
-	_ = c.vcManager.RegisterChannel(&virtualchannel.VirtualChannel{
-		ID:    4,
-		Name:  virtualchannel.CHANNEL_NAME_RDPDR,
-		Flags: virtualchannel.CHANNEL_FLAG_FIRST | virtualchannel.CHANNEL_FLAG_LAST,
-	})
+	c.registerDefaultChannels()
+	c.registerRemoteApp()
 
 	return c
 }
@@ -204,10 +845,30 @@ func NewClientWithContext(ctx context.Context, opt *Option) *Client {
 //	c.conn = conn
 //}
 
+// Phases of the connection sequence, as reported to Option.OnProgress
+const (
+	StageNegotiation           = "negotiation"
+	StageBasicSettingsExchange = "basicSettingsExchange"
+	StageChannelConnect        = "channelConnect"
+	StageSecurityCommencement  = "securityCommencement"
+	StageSendClientInfo        = "sendClientInfo"
+	StageLicensing             = "licensing"
+	StageCapabilities          = "capabilities"
+	StageFinalization          = "finalization"
+)
+
+// progress reports the start of a connection phase to Option.OnProgress
+func (c *Client) progress(stage string) {
+	if c.option.OnProgress != nil {
+		c.option.OnProgress(stage)
+	}
+}
+
 // Connect
 // https://www.cyberark.com/resources/threat-research-blog/explain-like-i-m-5-remote-desktop-protocol-rdp
 func (c *Client) Connect() error {
-	return core.Try(func() {
+	ctx := c.ctx
+	err := core.Try(func() {
 		// Check if context is cancelled
 		select {
 		case <-c.ctx.Done():
@@ -215,20 +876,40 @@ func (c *Client) Connect() error {
 		default:
 		}
 
-		c.stream = core.NewStream(c.option.Addr, c.option.ConnectTimeout)
+		c.connected.Store(false)
+		c.stream = c.dial()
+		var stopInterrupt func()
+		ctx, stopInterrupt = c.interruptReads(ctx)
+		defer stopInterrupt()
+		// only the handshake reads are retried, see Option.HandshakeReadRetry
+		c.stream.SetReadRetry(ctx, c.option.HandshakeReadRetry)
+		defer c.stream.SetReadRetry(nil, nil)
+		c.progress(StageNegotiation)
 		c.negotiation()
+		c.progress(StageBasicSettingsExchange)
 		c.basicSettingsExchange()
+		c.progress(StageChannelConnect)
 		c.channelConnect()
+		c.progress(StageSecurityCommencement)
+		c.securityCommencement()
+		c.progress(StageSendClientInfo)
 		c.sendClientInfo()
-		c.readLicensing()
+		c.progress(StageLicensing)
+		connectStep(ErrLicensing, c.readLicensing)
+		c.progress(StageCapabilities)
 		c.capabilitiesExchange()
+		c.progress(StageFinalization)
 		c.sendClientFinalization()
+		// a reconnect starts with the lock keys the session had
+		core.ThrowError(c.syncToggleKeys(c.ToggleKeys()))
+		c.sendInitialRefresh()
 	})
+	return c.connectError(contextError(ctx, err))
 }
 
 // ConnectWithContext connects with a custom context
 func (c *Client) ConnectWithContext(ctx context.Context) error {
-	return core.Try(func() {
+	err := core.Try(func() {
 		// Check if context is cancelled
 		select {
 		case <-ctx.Done():
@@ -236,22 +917,98 @@ func (c *Client) ConnectWithContext(ctx context.Context) error {
 		default:
 		}
 
-		c.stream = core.NewStream(c.option.Addr, c.option.ConnectTimeout)
+		c.connected.Store(false)
+		c.stream = c.dial()
+		var stopInterrupt func()
+		ctx, stopInterrupt = c.interruptReads(ctx)
+		defer stopInterrupt()
+		// only the handshake reads are retried, see Option.HandshakeReadRetry
+		c.stream.SetReadRetry(ctx, c.option.HandshakeReadRetry)
+		defer c.stream.SetReadRetry(nil, nil)
+		c.progress(StageNegotiation)
 		c.negotiation()
+		c.progress(StageBasicSettingsExchange)
 		c.basicSettingsExchange()
+		c.progress(StageChannelConnect)
 		c.channelConnect()
+		c.progress(StageSecurityCommencement)
+		c.securityCommencement()
+		c.progress(StageSendClientInfo)
 		c.sendClientInfo()
-		c.readLicensing()
+		c.progress(StageLicensing)
+		connectStep(ErrLicensing, c.readLicensing)
+		c.progress(StageCapabilities)
 		c.capabilitiesExchange()
+		c.progress(StageFinalization)
 		c.sendClientFinalization()
+		// a reconnect starts with the lock keys the session had
+		core.ThrowError(c.syncToggleKeys(c.ToggleKeys()))
+		c.sendInitialRefresh()
 	})
+	return c.connectError(contextError(ctx, err))
+}
+
+// dial connects to Option.Addr, unless the client was given a connection
+// by NewClientWithConn that no Connect used yet
+func (c *Client) dial() *core.Stream {
+	var stream *core.Stream
+	if conn := c.conn; conn != nil {
+		c.conn = nil
+		stream = core.NewStreamFromConn(conn)
+	} else {
+		stream = core.NewStream(c.option.Addr, c.option.ConnectTimeout, c.tcpOptions())
+	}
+	stream.SetRateLimiter(&c.bandwidth)
+	stream.SetContext(c.ctx)
+	return stream
+}
+
+// SetBandwidthLimit paces everything the client sends to at most
+// bytesPerSec bytes per second, zero or less for no limit. Writes over the
+// limit are delayed, never dropped, so input may lag behind but arrives
+// whole. It may be called at any time and holds across reconnects, e.g. with
+// the limit of a performance.AdvancedPerformanceManager.
+func (c *Client) SetBandwidthLimit(bytesPerSec int64) {
+	c.bandwidth.SetLimit(bytesPerSec)
+}
+
+// tcpOptions returns the socket options set with Option.TCPNoDelay and
+// Option.TCPKeepAlive
+func (c *Client) tcpOptions() core.TCPOptions {
+	return core.TCPOptions{
+		NoDelay:   c.option.TCPNoDelay == nil || *c.option.TCPNoDelay,
+		KeepAlive: c.option.TCPKeepAlive,
+	}
 }
 
 func (c *Client) Close() {
+	if err := c.FlushInput(); err != nil {
+		glog.Warnf("input: %v", err)
+	}
+	c.connected.Store(false)
+	c.pcap.Store(nil)
+	if err := c.StopRecording(); err != nil {
+		glog.Warnf("recording: %v", err)
+	}
 	c.cancel() // Cancel the context
+	if shared := c.option.SharedCache; shared != nil {
+		c.releaseCache.Do(func() {
+			c.forgetBitmapCells(false)
+			shared.Release()
+		})
+	}
 	c.stream.Close()
 }
 
+// newBitmapCache returns the bitmap cache of a new client, a reference to
+// Option.SharedCache when set
+func (c *Client) newBitmapCache() *t128.BitmapCacheManager {
+	if shared := c.option.SharedCache; shared != nil {
+		return shared.Acquire()
+	}
+	return t128.NewBitmapCacheManager()
+}
+
 // Context returns the client's context
 func (c *Client) Context() context.Context {
 	return c.ctx
@@ -272,13 +1029,53 @@ func (c *Client) GetBitmapCacheStats() map[string]interface{} {
 	return c.bitmapCacheManager.GetCacheStats()
 }
 
-// ClearBitmapCache clears all bitmap caches
+// ClearBitmapCache clears the bitmap cache of the client. With
+// Option.SharedCache only the bitmaps no other client refers to are
+// dropped.
 func (c *Client) ClearBitmapCache() {
+	if c.option.SharedCache != nil {
+		c.forgetBitmapCells(true)
+		return
+	}
+	c.forgetBitmapCells(false)
 	c.bitmapCacheManager.ClearCache()
 }
 
+// BitmapCache gives access to the bitmap cache, e.g. to keep it across
+// sessions with SaveToDisk and LoadFromDisk
+func (c *Client) BitmapCache() *t128.BitmapCacheManager {
+	return c.bitmapCacheManager
+}
+
+// OffscreenSurfaces gives access to the offscreen surfaces created by the
+// server with surface commands, e.g. to list or dump them when debugging
+func (c *Client) OffscreenSurfaces() *t128.OffscreenBitmapManager {
+	return c.offscreenBitmapManager
+}
+
+// Run reads the session until it ends, handing bitmap updates to processor,
+// which may be nil when they are received from Updates instead, and the
+// pointer to it too if it is a PointerProcessor
 func (c *Client) Run(processor Processor) error {
-	return core.Try(func() {
+	c.pointerProcessor, _ = processor.(PointerProcessor)
+	processor = c.withFrames(c.withFramebuffer(c.withCanvas(c.withRecording(c.withUpdates(c.ctx, processor)))))
+	defer c.closeUpdates()
+	for {
+		if err := c.reconnectAfter(c.ctx, c.run(processor)); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) run(processor Processor) error {
+	defer c.startKeepAlive(c.ctx)()
+	defer c.connected.Store(false)
+	defer c.answerLogoff(nil)
+	c.running.Store(true)
+	defer c.running.Store(false)
+	ctx, stopInterrupt := c.interruptReads(c.ctx)
+	defer stopInterrupt()
+	err := core.Try(func() {
 		for {
 			// Check if context is cancelled
 			select {
@@ -288,106 +1085,91 @@ func (c *Client) Run(processor Processor) error {
 			}
 
 			pdu := c.readPdu()
+			c.logoffAnswer(pdu)
 			switch p := pdu.(type) {
 			case *t128.TsFpUpdatePDU:
-				if p.Length == 0 {
+				// fragments and updates without data but the system pointers
+				if p.PDU == nil {
 					break
 				}
 				switch pp := p.PDU.(type) {
 				case *t128.TsFpUpdateBitmap:
+					options := make([]*bitmap.Option, 0, len(pp.Rectangles))
 					for _, v := range pp.Rectangles {
-						// Process bitmap through cache manager for optimization
-						optimizedBitmap, cached := c.bitmapCacheManager.OptimizeBitmapData(&v)
-
-						option := &bitmap.Option{
-							Top:         int(optimizedBitmap.DestTop),  // for position
-							Left:        int(optimizedBitmap.DestLeft), // for position
-							Width:       int(optimizedBitmap.Width),
-							Height:      int(optimizedBitmap.Height),
-							BitPerPixel: int(optimizedBitmap.BitsPerPixel),
-							Data:        optimizedBitmap.BitmapDataStream,
+						// The cache manager may rewrite the tile it is given,
+						// so it gets a copy and the server's data is decoded
+						tile := v
+						if _, cached := c.bitmapCacheManager.OptimizeBitmapData(&tile); cached {
+							glog.Debugf("Using cached bitmap: %dx%d", v.Width, v.Height)
 						}
 
-						if cached {
-							glog.Debugf("Using cached bitmap: %dx%d", option.Width, option.Height)
-						}
-
-						if optimizedBitmap.BitsPerPixel == 32 {
-							processor.ProcessBitmap(option, bitmap.NewBitMapFromRDP6(option))
-						} else {
-							processor.ProcessBitmap(option, bitmap.NewBitmapFromRLE(option))
-						}
-					}
-				case *t128.TsFpUpdateCachedBitmap:
-					for _, v := range pp.Rectangles {
-						glog.Debugf("Cached bitmap update: cache=%d, index=%d, key=%08X%08X",
-							v.CacheId, v.CacheIndex, v.Key1, v.Key2)
-
-						// Retrieve cached bitmap from cache manager
-						cachedBitmap := c.bitmapCacheManager.GetCachedBitmap(uint16(v.CacheId), v.CacheIndex, v.Key1, v.Key2)
-						if cachedBitmap != nil {
-							option := &bitmap.Option{
-								Top:         int(v.DestTop),
-								Left:        int(v.DestLeft),
-								Width:       int(cachedBitmap.Width),
-								Height:      int(cachedBitmap.Height),
-								BitPerPixel: int(cachedBitmap.BitsPerPixel),
-								Data:        cachedBitmap.BitmapDataStream,
-							}
-							processor.ProcessBitmap(option, bitmap.NewBitmapFromRLE(option))
-							glog.Debugf("Retrieved cached bitmap: %dx%d", option.Width, option.Height)
-						} else {
-							glog.Warnf("Cached bitmap not found: cache=%d, index=%d", v.CacheId, v.CacheIndex)
-						}
+						options = append(options, &bitmap.Option{
+							Top:          int(v.DestTop),  // for position
+							Left:         int(v.DestLeft), // for position
+							Width:        int(v.Width),
+							Height:       int(v.Height),
+							BitPerPixel:  int(v.BitsPerPixel),
+							Data:         v.BitmapDataStream,
+							Uncompressed: v.Flags&t128.BITMAP_COMPRESSION == 0,
+						})
 					}
+					c.processBitmaps(processor, options)
+				case *t128.TsUpdatePalette:
+					c.palette = pp.Palette()
+				case *t128.TsFpUpdatePointerPosition, *t128.TsFpUpdateSystemPointer, *t128.TsFpUpdatePointer, *t128.TsFpUpdateCachedPointer:
+					c.handlePointer(pp)
 				case *t128.TsFpUpdateSurfaceCommands:
-					for _, cmd := range pp.Commands {
-						switch sc := cmd.(type) {
-						case *t128.TsSetSurfaceBitsCommand:
-							option := &bitmap.Option{
-								Top:         int(sc.DestTop),
-								Left:        int(sc.DestLeft),
-								Width:       int(sc.BitmapData.Width),
-								Height:      int(sc.BitmapData.Height),
-								BitPerPixel: int(sc.BitmapData.BitsPerPixel),
-								Data:        sc.BitmapData.BitmapDataStream,
-							}
-							if sc.BitmapData.BitsPerPixel == 32 {
-								processor.ProcessBitmap(option, bitmap.NewBitMapFromRDP6(option))
-							} else {
-								processor.ProcessBitmap(option, bitmap.NewBitmapFromRLE(option))
-							}
-						case *t128.TsCreateSurfaceCommand:
-							c.offscreenBitmapManager.ProcessOffscreenBitmap(&t128.TsOffscreenBitmapData{
-								CacheId:    0, // For now, single cache
-								CacheIndex: sc.SurfaceId,
-								Width:      sc.Width,
-								Height:     sc.Height,
-								Bpp:        uint16(sc.PixelFormat),
-								Data:       sc.SurfaceData,
-							})
-							glog.Debugf("CreateSurface: ID=%d, %dx%d", sc.SurfaceId, sc.Width, sc.Height)
-						case *t128.TsDeleteSurfaceCommand:
-							c.offscreenBitmapManager.RemoveOffscreenBitmap(sc.SurfaceId)
-							glog.Debugf("DeleteSurface: ID=%d", sc.SurfaceId)
-						default:
-							glog.Debugf("Unhandled surface command: %T", sc)
-						}
-					}
+					c.processSurfaceCommands(processor, pp.Commands)
+				case *t128.TsFpUpdateOrders:
+					c.handleOrders(processor, pp)
 				default:
 					glog.Debugf("pdutype2: %T", pp)
 				}
-			default:
-				// Attempt to process as a virtual channel packet
-				c.tryHandleVirtualChannelPDU(pdu)
+				if c.frames != nil {
+					c.frames.endUpdate()
+				}
+			case *t128.TsDataPduData:
+				switch pp := p.Pdu.(type) {
+				case *t128.TsSaveSessionInfoPDU:
+					c.handleSaveSessionInfo(pp)
+				case *t128.TsSetErrorInfoPDU:
+					c.handleSetErrorInfo(pp)
+				case *t128.TsSetKeyboardIndicatorsPDU:
+					c.handleKeyboardIndicators(pp)
+				case *t128.TsPlaySoundPDU:
+					c.handlePlaySound(pp)
+				case *t128.TsUpdatePDU:
+					if pp.Palette != nil {
+						c.palette = pp.Palette.Palette()
+					}
+				}
 			}
 		}
 	})
+	return c.sessionError(c.keepAliveError(contextError(ctx, err)))
 }
 
 // RunWithContext runs the RDP session with a custom context
 func (c *Client) RunWithContext(ctx context.Context, processor Processor) error {
-	return core.Try(func() {
+	c.pointerProcessor, _ = processor.(PointerProcessor)
+	processor = c.withFrames(c.withFramebuffer(c.withCanvas(c.withRecording(c.withUpdates(ctx, processor)))))
+	defer c.closeUpdates()
+	for {
+		if err := c.reconnectAfter(ctx, c.runWithContext(ctx, processor)); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) runWithContext(ctx context.Context, processor Processor) error {
+	defer c.startKeepAlive(ctx)()
+	defer c.connected.Store(false)
+	defer c.answerLogoff(nil)
+	c.running.Store(true)
+	defer c.running.Store(false)
+	ctx, stopInterrupt := c.interruptReads(ctx)
+	defer stopInterrupt()
+	err := core.Try(func() {
 		for {
 			// Check if context is cancelled
 			select {
@@ -399,195 +1181,304 @@ func (c *Client) RunWithContext(ctx context.Context, processor Processor) error
 			}
 
 			pdu := c.readPdu()
+			c.logoffAnswer(pdu)
 			switch p := pdu.(type) {
 			case *t128.TsFpUpdatePDU:
-				if p.Length == 0 {
+				// fragments and updates without data but the system pointers
+				if p.PDU == nil {
 					break
 				}
 				switch pp := p.PDU.(type) {
 				case *t128.TsFpUpdateBitmap:
+					options := make([]*bitmap.Option, 0, len(pp.Rectangles))
 					for _, v := range pp.Rectangles {
-						// Process bitmap through cache manager for optimization
-						optimizedBitmap, cached := c.bitmapCacheManager.OptimizeBitmapData(&v)
-
-						option := &bitmap.Option{
-							Top:         int(optimizedBitmap.DestTop),  // for position
-							Left:        int(optimizedBitmap.DestLeft), // for position
-							Width:       int(optimizedBitmap.Width),
-							Height:      int(optimizedBitmap.Height),
-							BitPerPixel: int(optimizedBitmap.BitsPerPixel),
-							Data:        optimizedBitmap.BitmapDataStream,
+						// The cache manager may rewrite the tile it is given,
+						// so it gets a copy and the server's data is decoded
+						tile := v
+						if _, cached := c.bitmapCacheManager.OptimizeBitmapData(&tile); cached {
+							glog.Debugf("Using cached bitmap: %dx%d", v.Width, v.Height)
 						}
 
-						if cached {
-							glog.Debugf("Using cached bitmap: %dx%d", option.Width, option.Height)
-						}
-
-						if optimizedBitmap.BitsPerPixel == 32 {
-							processor.ProcessBitmap(option, bitmap.NewBitMapFromRDP6(option))
-						} else {
-							processor.ProcessBitmap(option, bitmap.NewBitmapFromRLE(option))
-						}
-					}
-				case *t128.TsFpUpdateCachedBitmap:
-					for _, v := range pp.Rectangles {
-						glog.Debugf("Cached bitmap update: cache=%d, index=%d, key=%08X%08X",
-							v.CacheId, v.CacheIndex, v.Key1, v.Key2)
-
-						// Retrieve cached bitmap from cache manager
-						cachedBitmap := c.bitmapCacheManager.GetCachedBitmap(uint16(v.CacheId), v.CacheIndex, v.Key1, v.Key2)
-						if cachedBitmap != nil {
-							option := &bitmap.Option{
-								Top:         int(v.DestTop),
-								Left:        int(v.DestLeft),
-								Width:       int(cachedBitmap.Width),
-								Height:      int(cachedBitmap.Height),
-								BitPerPixel: int(cachedBitmap.BitsPerPixel),
-								Data:        cachedBitmap.BitmapDataStream,
-							}
-							processor.ProcessBitmap(option, bitmap.NewBitmapFromRLE(option))
-							glog.Debugf("Retrieved cached bitmap: %dx%d", option.Width, option.Height)
-						} else {
-							glog.Warnf("Cached bitmap not found: cache=%d, index=%d", v.CacheId, v.CacheIndex)
-						}
+						options = append(options, &bitmap.Option{
+							Top:          int(v.DestTop),  // for position
+							Left:         int(v.DestLeft), // for position
+							Width:        int(v.Width),
+							Height:       int(v.Height),
+							BitPerPixel:  int(v.BitsPerPixel),
+							Data:         v.BitmapDataStream,
+							Uncompressed: v.Flags&t128.BITMAP_COMPRESSION == 0,
+						})
 					}
+					c.processBitmaps(processor, options)
+				case *t128.TsUpdatePalette:
+					c.palette = pp.Palette()
+				case *t128.TsFpUpdatePointerPosition, *t128.TsFpUpdateSystemPointer, *t128.TsFpUpdatePointer, *t128.TsFpUpdateCachedPointer:
+					c.handlePointer(pp)
 				case *t128.TsFpUpdateSurfaceCommands:
-					for _, cmd := range pp.Commands {
-						switch sc := cmd.(type) {
-						case *t128.TsSetSurfaceBitsCommand:
-							option := &bitmap.Option{
-								Top:         int(sc.DestTop),
-								Left:        int(sc.DestLeft),
-								Width:       int(sc.BitmapData.Width),
-								Height:      int(sc.BitmapData.Height),
-								BitPerPixel: int(sc.BitmapData.BitsPerPixel),
-								Data:        sc.BitmapData.BitmapDataStream,
-							}
-							if sc.BitmapData.BitsPerPixel == 32 {
-								processor.ProcessBitmap(option, bitmap.NewBitMapFromRDP6(option))
-							} else {
-								processor.ProcessBitmap(option, bitmap.NewBitmapFromRLE(option))
-							}
-						case *t128.TsCreateSurfaceCommand:
-							c.offscreenBitmapManager.ProcessOffscreenBitmap(&t128.TsOffscreenBitmapData{
-								CacheId:    0, // For now, single cache
-								CacheIndex: sc.SurfaceId,
-								Width:      sc.Width,
-								Height:     sc.Height,
-								Bpp:        uint16(sc.PixelFormat),
-								Data:       sc.SurfaceData,
-							})
-							glog.Debugf("CreateSurface: ID=%d, %dx%d", sc.SurfaceId, sc.Width, sc.Height)
-						case *t128.TsDeleteSurfaceCommand:
-							c.offscreenBitmapManager.RemoveOffscreenBitmap(sc.SurfaceId)
-							glog.Debugf("DeleteSurface: ID=%d", sc.SurfaceId)
-						default:
-							glog.Debugf("Unhandled surface command: %T", sc)
-						}
-					}
+					c.processSurfaceCommands(processor, pp.Commands)
+				case *t128.TsFpUpdateOrders:
+					c.handleOrders(processor, pp)
 				default:
 					glog.Debugf("pdutype2: %T", pp)
 				}
-			default:
-				// Attempt to process as a virtual channel packet
-				c.tryHandleVirtualChannelPDU(pdu)
+				if c.frames != nil {
+					c.frames.endUpdate()
+				}
+			case *t128.TsDataPduData:
+				switch pp := p.Pdu.(type) {
+				case *t128.TsSaveSessionInfoPDU:
+					c.handleSaveSessionInfo(pp)
+				case *t128.TsSetErrorInfoPDU:
+					c.handleSetErrorInfo(pp)
+				case *t128.TsSetKeyboardIndicatorsPDU:
+					c.handleKeyboardIndicators(pp)
+				case *t128.TsPlaySoundPDU:
+					c.handlePlaySound(pp)
+				case *t128.TsUpdatePDU:
+					if pp.Palette != nil {
+						c.palette = pp.Palette.Palette()
+					}
+				}
 			}
 		}
 	})
+	return c.sessionError(c.keepAliveError(contextError(ctx, err)))
 }
 
-// tryHandleVirtualChannelPDU attempts to parse and dispatch a virtual channel packet
-func (c *Client) tryHandleVirtualChannelPDU(pdu interface{}) {
-	if pdu == nil {
-		return
-	}
-	// Only handle PDUs that are []byte or have a Data field
-	var data []byte
-	switch v := pdu.(type) {
-	case []byte:
-		data = v
-	case interface{ Data() []byte }:
-		data = v.Data()
-	default:
-		return
+// clipboardChannel hands the messages of the cliprdr channel to the
+// clipboard manager
+type clipboardChannel struct {
+	c *Client
+}
+
+func (h *clipboardChannel) HandleData(channelID uint16, data []byte) error {
+	c := h.c
+	msg, err := clipboard.ReadClipboardMessage(bytes.NewReader(data))
+	if err != nil {
+		return err
 	}
-	if len(data) < 10 { // Minimum size for a virtual channel packet header
-		return
+	glog.GetStructuredLogger().InfoStructured("Received clipboard message", map[string]interface{}{
+		"type":   msg.MessageType,
+		"length": msg.DataLength,
+	})
+	// requests for what the app put on the clipboard are answered here
+	if response := c.clipboardManager.LocalDataResponse(msg); response != nil {
+		if err := c.sendClipboardMessage(response); err != nil {
+			glog.Warnf("failed to send clipboard data: %v", err)
+		}
+		return nil
 	}
-	packet, err := virtualchannel.ReadVirtualChannelPacket(bytes.NewReader(data))
+	return c.clipboardManager.ProcessMessage(msg)
+}
+
+func (h *clipboardChannel) OnChannelOpen(channelID uint16, channelName string) error {
+	return nil
+}
+
+func (h *clipboardChannel) OnChannelClose(channelID uint16) error {
+	return nil
+}
+
+// deviceChannel hands the messages of the rdpdr channel to the device
+// manager
+type deviceChannel struct {
+	c *Client
+}
+
+func (h *deviceChannel) HandleData(channelID uint16, data []byte) error {
+	msg, err := device.ReadDeviceMessage(bytes.NewReader(data))
 	if err != nil {
-		return
+		return err
 	}
-	ch, ok := c.vcManager.GetChannel(packet.ChannelID)
+	glog.GetStructuredLogger().InfoStructured("Received device message", map[string]interface{}{
+		"component_id": msg.ComponentID,
+		"packet_id":    msg.PacketID,
+		"data_length":  len(msg.Data),
+	})
+	return h.c.deviceManager.ProcessMessage(msg)
+}
+
+func (h *deviceChannel) OnChannelOpen(channelID uint16, channelName string) error {
+	return nil
+}
+
+func (h *deviceChannel) OnChannelClose(channelID uint16) error {
+	return nil
+}
+
+// SetVirtualChannelMaxMessageSize limits the size of reassembled messages
+// on a named virtual channel, 0 restores virtualchannel.DefaultMaxMessageSize
+func (c *Client) SetVirtualChannelMaxMessageSize(channelName string, size uint32) error {
+	ch, ok := c.vcManager.GetChannelByName(channelName)
 	if !ok {
-		return
+		return fmt.Errorf("unknown virtual channel: %s", channelName)
 	}
-	if ch.Name == virtualchannel.CHANNEL_NAME_CLIPRDR {
-		// Route to clipboard manager
-		msg, err := clipboard.ReadClipboardMessage(bytes.NewReader(packet.Data))
-		if err == nil {
-			glog.GetStructuredLogger().InfoStructured("Received clipboard message", map[string]interface{}{
-				"type":   msg.MessageType,
-				"length": msg.DataLength,
-			})
-			_ = c.clipboardManager.ProcessMessage(msg)
+	return c.vcManager.SetMaxMessageSize(ch.ID, size)
+}
+
+// maxStaticChannels is the number of static virtual channels a client may
+// offer, CHANNEL_MAX_COUNT
+const maxStaticChannels = 31
+
+// registerDefaultChannels registers the channels every client has, but for
+// those in Option.DisabledChannels. They are offered to the server and
+// joined like the channels of RegisterStaticChannel, and so are usable once
+// connected.
+func (c *Client) registerDefaultChannels() {
+	for _, channel := range []struct {
+		name    string
+		handler virtualchannel.VirtualChannelHandler
+	}{
+		{virtualchannel.CHANNEL_NAME_CLIPRDR, &clipboardChannel{c}},
+		{virtualchannel.CHANNEL_NAME_RDPSND, virtualchannel.NewDefaultVirtualChannelHandler(c.vcManager)},
+		{virtualchannel.CHANNEL_NAME_DRDYNVC, &drdynvcHandler{c}},
+		{virtualchannel.CHANNEL_NAME_RDPDR, &deviceChannel{c}},
+	} {
+		if c.channelDisabled(channel.name) {
+			continue
 		}
-		return
+		c.staticChannels = append(c.staticChannels, &virtualchannel.VirtualChannel{
+			Name:  channel.name,
+			Flags: virtualchannel.CHANNEL_FLAG_FIRST | virtualchannel.CHANNEL_FLAG_LAST,
+		})
+		c.vcHandlers[channel.name] = channel.handler
 	}
-	if ch.Name == virtualchannel.CHANNEL_NAME_RDPDR {
-		// Route to device manager
-		msg, err := device.ReadDeviceMessage(bytes.NewReader(packet.Data))
-		if err == nil {
-			glog.GetStructuredLogger().InfoStructured("Received device message", map[string]interface{}{
-				"component_id": msg.ComponentID,
-				"packet_id":    msg.PacketID,
-				"data_length":  len(msg.Data),
-			})
-			_ = c.deviceManager.ProcessMessage(msg)
+}
+
+// channelDisabled reports whether name is in Option.DisabledChannels
+func (c *Client) channelDisabled(name string) bool {
+	for _, disabled := range c.option.DisabledChannels {
+		if strings.EqualFold(disabled, name) {
+			return true
 		}
-		return
-	}
-	handler, ok := c.vcHandlers[ch.Name]
-	if !ok {
-		handler = virtualchannel.NewDefaultVirtualChannelHandler(c.vcManager)
 	}
-	_ = handler.HandleData(packet.ChannelID, packet.Data)
+	return false
 }
 
-// SendVirtualChannelData sends data on a named virtual channel
-func (c *Client) SendVirtualChannelData(channelName string, data []byte, flags uint32) error {
-	ch, ok := c.vcManager.GetChannelByName(channelName)
-	if !ok {
-		return fmt.Errorf("unknown virtual channel: %s", channelName)
+// RegisterStaticChannel offers the server a static virtual channel of the
+// given name, e.g. one a line-of-business application on the server opens
+// with WTSVirtualChannelOpen. The name is at most 7 ASCII characters. The
+// channel is joined on Connect, and handler gets its messages, reassembled,
+// from the session loop. It must be called before Connect.
+func (c *Client) RegisterStaticChannel(name string, handler virtualchannel.VirtualChannelHandler) error {
+	if c.stream != nil {
+		return fmt.Errorf("static channel %s registered after connecting", name)
 	}
-	packet := &virtualchannel.VirtualChannelPacket{
-		Length:    uint32(len(data)),
-		Flags:     flags,
-		ChannelID: ch.ID,
-		Data:      data,
+	if name == "" || len(name) > 7 {
+		return fmt.Errorf("invalid static channel name %q", name)
 	}
-	serialized := packet.Serialize()
-	mcsReq := mcs.NewSendDataRequest(c.userId, ch.ID)
-	_, err := c.stream.Write(mcsReq.Serialize(serialized))
-	return err
+	for _, r := range name {
+		if r < 0x20 || r > 0x7E {
+			return fmt.Errorf("invalid static channel name %q", name)
+		}
+	}
+	if handler == nil {
+		return fmt.Errorf("static channel %s has no handler", name)
+	}
+	if c.channelDisabled(name) {
+		return fmt.Errorf("virtual channel %s is disabled", name)
+	}
+	// channel names are not case sensitive
+	for _, ch := range append(c.vcManager.ListChannels(), c.staticChannels...) {
+		if strings.EqualFold(ch.Name, name) {
+			return fmt.Errorf("virtual channel %s already registered", name)
+		}
+	}
+	if len(c.staticChannels) >= maxStaticChannels {
+		return fmt.Errorf("too many static channels, at most %d", maxStaticChannels)
+	}
+	c.staticChannels = append(c.staticChannels, &virtualchannel.VirtualChannel{
+		Name:  name,
+		Flags: virtualchannel.CHANNEL_FLAG_FIRST | virtualchannel.CHANNEL_FLAG_LAST,
+	})
+	c.vcHandlers[name] = handler
+	return nil
 }
 
-// Add helper to VirtualChannelManager to get channel by name
+// bindStaticChannels assigns the static channels the MCS channel ids the
+// server gave them, in the order they were offered
+func (c *Client) bindStaticChannels(ids []uint16) {
+	for i, ch := range c.staticChannels {
+		if i >= len(ids) || ids[i] == 0 {
+			glog.Warnf("static channel %s not available", ch.Name)
+			ch.ID = 0
+			continue
+		}
+		if existing, ok := c.vcManager.GetChannel(ids[i]); !ok || existing != ch {
+			ch.ID = ids[i]
+			core.ThrowError(c.vcManager.RegisterChannel(ch))
+		}
+	}
+}
 
-func (c *Client) dispatchVirtualChannelData(packet *virtualchannel.VirtualChannelPacket) error {
-	// Check if this is a dynamic virtual channel
-	if packet.ChannelID == 3 { // drdynvc channel ID
-		return c.handleDynamicVirtualChannel(packet.Data)
+// staticChannel returns the registered static channel joined as channelId
+func (c *Client) staticChannel(channelId uint16) *virtualchannel.VirtualChannel {
+	for _, ch := range c.staticChannels {
+		if ch.ID != 0 && ch.ID == channelId {
+			return ch
+		}
 	}
+	return nil
+}
 
-	// Handle regular virtual channels
-	handler, exists := c.vcHandlers[fmt.Sprintf("channel_%d", packet.ChannelID)]
-	if !exists {
-		// Use default handler
-		handler = virtualchannel.NewDefaultVirtualChannelHandler(c.vcManager)
+// handleStaticChannelData reassembles a chunk received on a registered
+// static channel, and hands complete messages to its handler
+func (c *Client) handleStaticChannelData(ch *virtualchannel.VirtualChannel, data []byte) {
+	packet := &virtualchannel.VirtualChannelPacket{ChannelID: ch.ID}
+	r := bytes.NewReader(data)
+	core.ReadLE(r, &packet.Length) // CHANNEL_PDU_HEADER
+	core.ReadLE(r, &packet.Flags)
+	packet.Data = data[8:]
+
+	message, err := c.vcManager.Reassemble(packet)
+	if err != nil {
+		glog.Warnf("virtual channel %s: %v", ch.Name, err)
+		return
+	}
+	if message == nil {
+		return // more chunks to come
+	}
+	if err := c.vcHandlers[ch.Name].HandleData(ch.ID, message); err != nil {
+		c.vcManager.CountError(ch.ID)
+		glog.Warnf("virtual channel %s: %v", ch.Name, err)
 	}
+}
 
-	return handler.HandleData(packet.ChannelID, packet.Data)
+// SendVirtualChannelData sends data on a named virtual channel, in as many
+// chunks as it takes. flags other than CHANNEL_FLAG_FIRST and
+// CHANNEL_FLAG_LAST, which are set on the chunks, go on every chunk.
+func (c *Client) SendVirtualChannelData(channelName string, data []byte, flags uint32) error {
+	if c.stream == nil {
+		return fmt.Errorf("virtual channel %s: no active connection", channelName)
+	}
+	ch, ok := c.vcManager.GetChannelByName(channelName)
+	if !ok {
+		return fmt.Errorf("unknown virtual channel: %s", channelName)
+	}
+	// chunks of at most the chunk size, the first and last flagged
+	size := c.channelChunkSize()
+	flags &^= virtualchannel.CHANNEL_FLAG_FIRST | virtualchannel.CHANNEL_FLAG_LAST
+	for pos := 0; pos == 0 || pos < len(data); pos += size {
+		end := min(pos+size, len(data))
+		chunkFlags := flags
+		if pos == 0 {
+			chunkFlags |= virtualchannel.CHANNEL_FLAG_FIRST
+		}
+		if end == len(data) {
+			chunkFlags |= virtualchannel.CHANNEL_FLAG_LAST
+		}
+		// CHANNEL_PDU_HEADER, without the channel id VirtualChannelPacket carries
+		// See [MS-RDPBCGR] 2.2.6.1.1
+		buff := new(bytes.Buffer)
+		core.WriteLE(buff, uint32(len(data)))
+		core.WriteLE(buff, chunkFlags)
+		core.WriteFull(buff, data[pos:end])
+		if err := core.Try(func() { c.writeMcsData(ch.ID, buff.Bytes()) }); err != nil {
+			return err
+		}
+	}
+	c.vcManager.CountSent(ch.ID, len(data))
+	return nil
 }
 
 // handleDynamicVirtualChannel handles dynamic virtual channel messages
@@ -611,7 +1502,7 @@ func (c *Client) handleDynamicVirtualChannel(data []byte) error {
 	case drdynvc.DVCCLOSE_RSP:
 		return c.handleCloseResponse(msg.Data)
 	case drdynvc.DVCDATA_FIRST, drdynvc.DVCDATA, drdynvc.DVCDATA_LAST, drdynvc.DVCDATA_FIRST_LAST:
-		return c.handleDataMessage(msg.Data)
+		return c.handleDataMessage(msg.MessageType, msg.Data)
 	default:
 		glog.Debugf("Unknown dynamic virtual channel message type: 0x%02x", msg.MessageType)
 		return nil
@@ -628,33 +1519,42 @@ func (c *Client) handleCreateRequest(data []byte) error {
 		"channel_name": req.ChannelName,
 		"channel_id":   req.ChannelId,
 	})
-	// Use custom handler if registered
+	// channels nobody listens for are declined
+	c.dvcMu.Lock()
 	handler, ok := c.dvcHandlers[req.ChannelName]
+	c.dvcMu.Unlock()
+	status := uint32(drdynvc.DVCCREATE_SUCCESS)
 	if !ok {
-		handler = drdynvc.NewDefaultDynamicVirtualChannelHandler()
-	}
-	err = c.dvcManager.RegisterChannelWithID(req.ChannelId, req.ChannelName, handler)
-	if err != nil {
-		glog.GetStructuredLogger().ErrorStructured("Failed to register DVC", err, map[string]interface{}{
-			"channel_name": req.ChannelName,
-			"channel_id":   req.ChannelId,
-		})
-	}
-	if handler != nil {
-		handler.OnChannelCreated(req.ChannelId, req.ChannelName)
+		glog.Infof("declining dynamic channel %s, no listener", req.ChannelName)
+		status = drdynvc.DVCCREATE_FAILED
+	} else if err := handler.OnChannelCreated(req.ChannelId, req.ChannelName); err != nil {
+		glog.Warnf("declining dynamic channel %s: %v", req.ChannelName, err)
+		status = drdynvc.DVCCREATE_FAILED
+	} else {
+		err = c.dvcManager.RegisterChannelWithID(req.ChannelId, req.ChannelName, handler)
+		if err != nil {
+			glog.GetStructuredLogger().ErrorStructured("Failed to register DVC", err, map[string]interface{}{
+				"channel_name": req.ChannelName,
+				"channel_id":   req.ChannelId,
+			})
+		}
 	}
 	// Send create response
 	resp := &drdynvc.CreateResponse{
 		RequestId: req.RequestId,
 		ChannelId: req.ChannelId,
-		Status:    drdynvc.DVCCREATE_SUCCESS,
+		Status:    status,
 	}
 	respData := resp.Serialize()
 	dvcMsg := &drdynvc.DynamicVirtualChannelMessage{
 		MessageType: drdynvc.DVCCREATE_RSP,
 		Data:        respData,
 	}
-	return c.SendVirtualChannelData("drdynvc", dvcMsg.Serialize(), 0)
+	if err := c.SendVirtualChannelData("drdynvc", dvcMsg.Serialize(), 0); err != nil || status != drdynvc.DVCCREATE_SUCCESS {
+		return err
+	}
+	// open once the server knows, so nothing is sent on it before
+	return handler.OnChannelOpened(req.ChannelId)
 }
 
 // handleCreateResponse handles a dynamic virtual channel create response
@@ -682,7 +1582,21 @@ func (c *Client) handleCreateResponse(data []byte) error {
 		return c.SendVirtualChannelData("drdynvc", dvcMsg.Serialize(), 0)
 	}
 
-	return nil
+	return c.closeDynamicChannel(resp.ChannelId)
+}
+
+// closeDynamicChannel tells the handler of a channel that it was closed,
+// or refused, and forgets the channel
+func (c *Client) closeDynamicChannel(channelId uint32) error {
+	channel, exists := c.dvcManager.GetChannel(channelId)
+	if !exists {
+		return nil
+	}
+	c.dvcManager.RemoveChannel(channelId)
+	if channel.Handler == nil {
+		return nil
+	}
+	return channel.Handler.OnChannelClosed(channelId)
 }
 
 // handleOpenRequest handles a dynamic virtual channel open request
@@ -725,8 +1639,9 @@ func (c *Client) handleOpenResponse(data []byte) error {
 		if exists && channel.Handler != nil {
 			return channel.Handler.OnChannelOpened(resp.ChannelId)
 		}
+		return nil
 	}
-	return nil
+	return c.closeDynamicChannel(resp.ChannelId)
 }
 
 // handleCloseRequest handles a dynamic virtual channel close request
@@ -751,7 +1666,10 @@ func (c *Client) handleCloseRequest(data []byte) error {
 		Data:        respData,
 	}
 
-	return c.SendVirtualChannelData("drdynvc", dvcMsg.Serialize(), 0)
+	if err := c.SendVirtualChannelData("drdynvc", dvcMsg.Serialize(), 0); err != nil {
+		return err
+	}
+	return c.closeDynamicChannel(req.ChannelId)
 }
 
 // handleCloseResponse handles a dynamic virtual channel close response
@@ -765,16 +1683,14 @@ func (c *Client) handleCloseResponse(data []byte) error {
 		"status":     resp.Status,
 	})
 	if resp.Status == drdynvc.DVCCLOSE_SUCCESS {
-		channel, exists := c.dvcManager.GetChannel(resp.ChannelId)
-		if exists && channel.Handler != nil {
-			return channel.Handler.OnChannelClosed(resp.ChannelId)
-		}
+		return c.closeDynamicChannel(resp.ChannelId)
 	}
 	return nil
 }
 
-// handleDataMessage handles a dynamic virtual channel data message
-func (c *Client) handleDataMessage(data []byte) error {
+// handleDataMessage handles a dynamic virtual channel data message of
+// type typ, one fragment of a message
+func (c *Client) handleDataMessage(typ uint8, data []byte) error {
 	msg, err := drdynvc.ParseDataMessage(data)
 	if err != nil {
 		return fmt.Errorf("failed to parse data message: %w", err)
@@ -782,12 +1698,37 @@ func (c *Client) handleDataMessage(data []byte) error {
 
 	glog.Debugf("Dynamic virtual channel data message: ID: %d, %d bytes", msg.ChannelId, len(msg.Data))
 
-	// Forward data to channel handler
+	// Forward data to channel handler once complete
 	channel, exists := c.dvcManager.GetChannel(msg.ChannelId)
-	if exists && channel.Handler != nil {
-		return channel.Handler.OnDataReceived(msg.ChannelId, msg.Data)
+	if !exists || channel.Handler == nil {
+		return nil
+	}
+	message, err := channel.Reassemble(typ, msg.Data)
+	c.dvcManager.CountReceived(msg.ChannelId, len(msg.Data), message != nil, err)
+	if message == nil {
+		return err
 	}
+	if err := channel.Handler.OnDataReceived(msg.ChannelId, message); err != nil {
+		c.dvcManager.CountError(msg.ChannelId)
+		return err
+	}
+	return nil
+}
 
+// SendDynamicVirtualChannelData sends data on an open dynamic virtual channel
+func (c *Client) SendDynamicVirtualChannelData(channelId uint32, data []byte) error {
+	msg := &drdynvc.DataMessage{
+		ChannelId: channelId,
+		Data:      data,
+	}
+	dvcMsg := &drdynvc.DynamicVirtualChannelMessage{
+		MessageType: drdynvc.DVCDATA_FIRST_LAST,
+		Data:        msg.Serialize(),
+	}
+	if err := c.SendVirtualChannelData("drdynvc", dvcMsg.Serialize(), 0); err != nil {
+		return err
+	}
+	c.dvcManager.CountSent(channelId, len(data))
 	return nil
 }
 
@@ -796,7 +1737,9 @@ func (c *Client) RegisterDynamicVirtualChannelHandler(channelName string, handle
 	if channelName == "" || handler == nil {
 		return fmt.Errorf("channel name and handler must be non-nil")
 	}
+	c.dvcMu.Lock()
 	c.dvcHandlers[channelName] = handler
+	c.dvcMu.Unlock()
 	glog.GetStructuredLogger().InfoStructured("Registered DVC handler", map[string]interface{}{
 		"channel_name": channelName,
 	})
@@ -806,7 +1749,7 @@ func (c *Client) RegisterDynamicVirtualChannelHandler(channelName string, handle
 // ListDynamicVirtualChannels returns a list of currently open DVCs
 func (c *Client) ListDynamicVirtualChannels() []string {
 	channels := []string{}
-	for _, ch := range c.dvcManager.Channels {
+	for _, ch := range c.dvcManager.List() {
 		channels = append(channels, ch.ChannelName)
 	}
 	return channels
@@ -817,28 +1760,85 @@ func (c *Client) RegisterClipboardHandler(handler clipboard.ClipboardHandler) er
 	if handler == nil {
 		return fmt.Errorf("clipboard handler must be non-nil")
 	}
-	c.clipboardManager = clipboard.NewClipboardManager(handler)
+	c.clipboardManager = c.newClipboardManager(handler)
 	glog.GetStructuredLogger().InfoStructured("Registered clipboard handler", map[string]interface{}{})
 	return nil
 }
 
-// IsClipboardChannelOpen returns true if the cliprdr channel is registered and ready
+// newClipboardManager creates a clipboard manager configured from the options
+func (c *Client) newClipboardManager(handler clipboard.ClipboardHandler) *clipboard.ClipboardManager {
+	manager := clipboard.NewClipboardManager(handler)
+	if d := c.option.ClipboardFormatListDebounce; d != 0 {
+		manager.SetFormatListDebounce(max(d, 0))
+	}
+	return manager
+}
+
+// IsClipboardChannelOpen returns true if the server joined the cliprdr
+// channel
 func (c *Client) IsClipboardChannelOpen() bool {
 	_, ok := c.vcManager.GetChannelByName(virtualchannel.CHANNEL_NAME_CLIPRDR)
 	return ok
 }
 
+// ClipboardFormats returns the formats the server's clipboard offers, as
+// last announced. Their data stays on the server until RequestClipboardData.
+func (c *Client) ClipboardFormats() []clipboard.ClipboardFormat {
+	return c.clipboardManager.AvailableFormats()
+}
+
+// RequestClipboardData asks the server for its clipboard data in format,
+// e.g. when the user pastes. As in RDP's delayed rendering, a copy on the
+// server only announces formats, so large data such as images is not
+// transferred unless asked for. The data is passed to the clipboard handler,
+// see RegisterClipboardHandler. Formats the server does not offer fail with
+// clipboard.ErrFormatUnavailable.
+func (c *Client) RequestClipboardData(format clipboard.ClipboardFormat) error {
+	msg, err := c.clipboardManager.RequestFormatData(format)
+	if err != nil {
+		return err
+	}
+	return c.sendClipboardMessage(msg)
+}
+
+// SetClipboardText puts text on the clipboard of the session, as if copied
+// on the server. The server is told of the CF_UNICODETEXT and asks for it
+// when pasted, which is answered without the clipboard handler.
+func (c *Client) SetClipboardText(text string) error {
+	return c.sendClipboardMessage(c.clipboardManager.SetLocalData(map[clipboard.ClipboardFormat][]byte{
+		clipboard.CLIPRDR_FORMAT_UNICODETEXT: clipboard.EncodeUnicodeText(text),
+	}))
+}
+
+// SetClipboardImage puts img on the clipboard of the session like
+// SetClipboardText, as CF_PNG and the CF_DIB Windows applications paste
+func (c *Client) SetClipboardImage(img image.Image) error {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return fmt.Errorf("failed to encode clipboard image: %w", err)
+	}
+	return c.sendClipboardMessage(c.clipboardManager.SetLocalData(map[clipboard.ClipboardFormat][]byte{
+		clipboard.CLIPRDR_FORMAT_PNG: buf.Bytes(),
+	}))
+}
+
+// sendClipboardMessage sends msg on the cliprdr channel
+func (c *Client) sendClipboardMessage(msg *clipboard.ClipboardMessage) error {
+	return c.SendVirtualChannelData(virtualchannel.CHANNEL_NAME_CLIPRDR, msg.Serialize(),
+		virtualchannel.CHANNEL_FLAG_FIRST|virtualchannel.CHANNEL_FLAG_LAST)
+}
+
 // RegisterDeviceHandler allows users to register a custom device handler
 func (c *Client) RegisterDeviceHandler(handler device.DeviceHandler) error {
 	if handler == nil {
 		return fmt.Errorf("device handler must be non-nil")
 	}
-	c.deviceManager = device.NewDeviceManager(handler)
+	c.deviceManager.SetHandler(handler)
 	glog.GetStructuredLogger().InfoStructured("Registered device handler", map[string]interface{}{})
 	return nil
 }
 
-// IsDeviceChannelOpen returns true if the rdpdr channel is registered and ready
+// IsDeviceChannelOpen returns true if the server joined the rdpdr channel
 func (c *Client) IsDeviceChannelOpen() bool {
 	_, ok := c.vcManager.GetChannelByName(virtualchannel.CHANNEL_NAME_RDPDR)
 	return ok
@@ -861,13 +1861,70 @@ func (c *Client) GetDeviceStats() map[string]interface{} {
 
 // SendDeviceMessage sends a device message on the rdpdr channel
 func (c *Client) SendDeviceMessage(msg *device.DeviceMessage) error {
-	return c.SendVirtualChannelData(virtualchannel.CHANNEL_NAME_RDPDR, msg.Serialize(), 0)
+	return c.deviceManager.SendMessage(msg)
 }
 
-// AnnounceDevice announces a new device for redirection
+// OnDeviceMessage registers fn to be called with every message received on
+// the rdpdr channel
+func (c *Client) OnDeviceMessage(fn func(*device.DeviceMessage)) {
+	c.deviceManager.OnMessage(fn)
+}
+
+// sendDeviceData is the rdpdr transport of the device manager
+func (c *Client) sendDeviceData(data []byte) error {
+	if c.stream == nil || !c.IsDeviceChannelOpen() {
+		return device.ErrChannelNotOpen
+	}
+	return c.SendVirtualChannelData(virtualchannel.CHANNEL_NAME_RDPDR, data, 0)
+}
+
+// AnnounceDevice redirects a new device, as AddDevice does
 func (c *Client) AnnounceDevice(deviceType device.DeviceType, preferredDosName, deviceData string) error {
-	msg := c.deviceManager.CreateDeviceAnnounceMessage(deviceType, preferredDosName, deviceData)
-	return c.SendDeviceMessage(msg)
+	return c.AddDevice(&device.DeviceAnnounce{
+		DeviceType:       deviceType,
+		PreferredDosName: preferredDosName,
+		DeviceData:       deviceData,
+	})
+}
+
+// AddDevice redirects a device, setting its DeviceID. Devices added before
+// connecting are announced once the server has set up the rdpdr channel,
+// and those plugged in later, e.g. a USB drive, at once, as mstsc does on
+// hotplug. OnDeviceReply tells when the server has taken it.
+func (c *Client) AddDevice(announce *device.DeviceAnnounce) error {
+	return c.deviceManager.AddDevice(announce)
+}
+
+// RemoveDevice tells the server the devices of deviceIDs, added before, are
+// gone, e.g. unplugged
+func (c *Client) RemoveDevice(deviceIDs ...uint32) error {
+	return c.deviceManager.WithdrawDevice(deviceIDs...)
+}
+
+// OnDeviceReply registers fn to be called with every answer of the server
+// to a device announcement, e.g. of AddDevice. A ResultCode other than 0
+// (STATUS_SUCCESS) means the server did not take the device.
+func (c *Client) OnDeviceReply(fn func(*device.DeviceReplyAnnounce)) {
+	c.deviceManager.OnDeviceReply(fn)
+}
+
+// RedirectSmartCard makes card available in the session, e.g. for smart
+// card logon and signing: it announces a smart card device and passes the
+// PC/SC calls of the server on to card. It takes over the device handler,
+// which keeps the requests of other devices, so RegisterDeviceHandler
+// must come first.
+func (c *Client) RedirectSmartCard(card device.SmartCard) error {
+	_, err := device.RedirectSmartCard(c.deviceManager, card)
+	return err
+}
+
+// RedirectSerialPort makes port available in the session as the COM port
+// name, e.g. "COM1": it announces a serial port device, reads and writes
+// port as the server does, and sets it up, if control is not nil, as the
+// server asks. As RedirectSmartCard, it comes after RegisterDeviceHandler.
+// Closing the returned redirector closes port.
+func (c *Client) RedirectSerialPort(name string, port io.ReadWriteCloser, control device.SerialControl) (*device.SerialRedirector, error) {
+	return device.RedirectSerialPort(c.deviceManager, name, port, control)
 }
 
 // SendPrinterData sends printer data to the server
@@ -876,8 +1933,24 @@ func (c *Client) SendPrinterData(jobID uint32, data []byte, flags uint32) error
 	return c.SendDeviceMessage(msg)
 }
 
-// SetMonitors sets the multi-monitor layout for the client
-func (c *Client) SetMonitors(monitors []mcs.MonitorLayout) {
+// SetMonitors sets the multi-monitor layout for the client, returning an
+// error, and keeping the current layout, if mcs.ValidateMonitors rejects it
+// or, once connected, it exceeds the ServerLimits. mcs.ArrangeMonitors
+// fixes up a layout whose monitors overlap or do not touch.
+func (c *Client) SetMonitors(monitors []mcs.MonitorLayout) error {
+	if err := mcs.ValidateMonitors(monitors); err != nil {
+		return err
+	}
+	if err := c.checkServerLimits(monitors); err != nil {
+		return err
+	}
+	c.monitors = monitors
+	return nil
+}
+
+// SetMonitorsUnchecked sets the multi-monitor layout as is, for servers
+// known to accept layouts SetMonitors refuses
+func (c *Client) SetMonitorsUnchecked(monitors []mcs.MonitorLayout) {
 	c.monitors = monitors
 }
 
@@ -885,3 +1958,417 @@ func (c *Client) SetMonitors(monitors []mcs.MonitorLayout) {
 func (c *Client) GetMonitors() []mcs.MonitorLayout {
 	return c.monitors
 }
+
+// SetOrientation rotates the monitor at monitorIndex of the layout, e.g. as
+// a tablet is turned, to orientation, one of mcs.ORIENTATION_*, and asks the
+// server to change the desktop to match over the display control channel.
+// Turning between landscape and portrait swaps the width and height of the
+// monitor. Without a layout set by SetMonitors the desktop is taken as the
+// single monitor 0. It fails with rdpedisp.ErrNotReady until the server has
+// opened the channel and with ErrServerLimits for a layout beyond the
+// ServerLimits, and keeps the current layout on error.
+func (c *Client) SetOrientation(monitorIndex int, orientation uint32) error {
+	switch orientation {
+	case mcs.ORIENTATION_LANDSCAPE, mcs.ORIENTATION_PORTRAIT,
+		mcs.ORIENTATION_LANDSCAPE_FLIPPED, mcs.ORIENTATION_PORTRAIT_FLIPPED:
+	default:
+		return fmt.Errorf("invalid orientation %d", orientation)
+	}
+	monitors := slices.Clone(c.monitors)
+	if len(monitors) == 0 {
+		monitors = []mcs.MonitorLayout{{
+			Right:  int32(c.desktopWidth) - 1,
+			Bottom: int32(c.desktopHeight) - 1,
+			Flags:  mcs.TS_MONITOR_PRIMARY,
+		}}
+	}
+	if monitorIndex < 0 || monitorIndex >= len(monitors) {
+		return fmt.Errorf("monitor %d of %d: %w", monitorIndex, len(monitors), mcs.ErrMonitorCount)
+	}
+
+	m := &monitors[monitorIndex]
+	current := m.Orientation
+	if current == 1 { // MonitorLayout's own value for portrait
+		current = mcs.ORIENTATION_PORTRAIT
+	}
+	if (current/90)%2 != (orientation/90)%2 {
+		width, height := m.Right-m.Left+1, m.Bottom-m.Top+1
+		m.Right, m.Bottom = m.Left+height-1, m.Top+width-1
+		m.PhysicalWidthMm, m.PhysicalHeightMm = m.PhysicalHeightMm, m.PhysicalWidthMm
+	}
+	m.Orientation = orientation
+	if len(monitors) > 1 {
+		arranged, err := mcs.ArrangeMonitors(monitors)
+		if err != nil {
+			return err
+		}
+		monitors = arranged
+	}
+
+	if err := c.checkServerLimits(monitors); err != nil {
+		return err
+	}
+	if err := c.displayManager.SendMonitorLayout(monitors); err != nil {
+		return err
+	}
+	c.monitors = monitors
+	return nil
+}
+
+// ResizeDesktop asks the server to change the desktop to a single monitor of
+// width x height over the display control channel, e.g. as the window
+// showing the session is resized. The width must be even and both 200 to
+// 8192 pixels. As SetOrientation, it fails with rdpedisp.ErrNotReady until
+// the server has opened the channel and with ErrServerLimits for a size
+// beyond the ServerLimits, and keeps the current layout on error.
+func (c *Client) ResizeDesktop(width, height uint16) error {
+	monitors := []mcs.MonitorLayout{{
+		Right:  int32(width) - 1,
+		Bottom: int32(height) - 1,
+		Flags:  mcs.TS_MONITOR_PRIMARY,
+	}}
+	if err := c.checkServerLimits(monitors); err != nil {
+		return err
+	}
+	if err := c.displayManager.SendMonitorLayout(monitors); err != nil {
+		return err
+	}
+	c.monitors = monitors
+	return nil
+}
+
+// SessionInfo is what client and server agreed on while connecting
+type SessionInfo struct {
+	Protocol      uint32 // security protocol, one of connPdu.PROTOCOL_*
+	ServerVersion uint32 // RDP version of the server, one of mcs.RDP_VERSION_*
+	DesktopWidth  uint16
+	DesktopHeight uint16
+	BitsPerPixel  uint16
+	Channels      []ChannelInfo // joined static and created dynamic channels
+}
+
+// ChannelInfo is a virtual channel of the session
+type ChannelInfo struct {
+	Name    string
+	ID      uint32
+	Dynamic bool
+}
+
+// ProtocolName returns the name of the security protocol: "rdp", "ssl",
+// "hybrid" or "hybrid_ex"
+func (s *SessionInfo) ProtocolName() string {
+	switch s.Protocol {
+	case connPdu.PROTOCOL_RDP:
+		return "rdp"
+	case connPdu.PROTOCOL_SSL:
+		return "ssl"
+	case connPdu.PROTOCOL_HYBRID:
+		return "hybrid"
+	case connPdu.PROTOCOL_HYBRID_EX:
+		return "hybrid_ex"
+	}
+	return fmt.Sprintf("protocol %#x", s.Protocol)
+}
+
+// SessionInfo returns the parameters of the session negotiated by Connect,
+// e.g. to size a canvas to the desktop. It is the zero value before Connect.
+func (c *Client) SessionInfo() SessionInfo {
+	info := SessionInfo{
+		Protocol:      c.selectProtocol,
+		ServerVersion: c.serverVersion,
+		DesktopWidth:  c.desktopWidth,
+		DesktopHeight: c.desktopHeight,
+		BitsPerPixel:  c.bitsPerPixel,
+	}
+	for _, ch := range c.staticChannels {
+		if ch.ID != 0 {
+			info.Channels = append(info.Channels, ChannelInfo{Name: ch.Name, ID: uint32(ch.ID)})
+		}
+	}
+	dynamic := c.dvcManager.List()
+	sort.Slice(dynamic, func(i, j int) bool { return dynamic[i].ChannelId < dynamic[j].ChannelId })
+	for _, ch := range dynamic {
+		info.Channels = append(info.Channels, ChannelInfo{Name: ch.ChannelName, ID: ch.ChannelId, Dynamic: true})
+	}
+	return info
+}
+
+// EnableFramebuffer makes Run composite every bitmap update into a
+// width x height framebuffer, which is returned. The processor passed to Run
+// still receives each rectangle and may be nil.
+func (c *Client) EnableFramebuffer(width, height int) *bitmap.Framebuffer {
+	c.framebuffer = bitmap.NewFramebuffer(width, height)
+	return c.framebuffer
+}
+
+// OnFrame makes Run gather the rectangles of the desktop each frame of
+// updates changes and call fn with them once the frame is complete, e.g. to
+// send only what changed of the framebuffer on to a web client. Frames
+// follow the frame markers of the server where it sends them and are each
+// update otherwise. fn is called on the Run goroutine, after the processor
+// and the framebuffer have been given the bitmaps of the frame. Call it
+// before Run.
+func (c *Client) OnFrame(fn func(Frame)) {
+	c.onFrame = fn
+}
+
+// StartRecording records every bitmap update Run gets from now on, be it
+// a bitmap, cached bitmap, surface command or drawing order, to w with the
+// time it came, until StopRecording or Close. The recording is of the
+// desktop size negotiated by Connect and plays back with replay.Replay or
+// a replay.Player. The pointer shapes and positions of the server are
+// recorded too.
+func (c *Client) StartRecording(w io.Writer) error {
+	if c.desktopWidth == 0 || c.desktopHeight == 0 {
+		return fmt.Errorf("recording: desktop size not known before Connect")
+	}
+	rec, err := replay.NewRecorder(w, int(c.desktopWidth), int(c.desktopHeight))
+	if err != nil {
+		return err
+	}
+	if old := c.recorder.Swap(rec); old != nil {
+		_ = old.Close()
+	}
+	return nil
+}
+
+// StopRecording ends the recording of StartRecording and flushes it to its
+// writer, returning the first error writing it
+func (c *Client) StopRecording() error {
+	if rec := c.recorder.Swap(nil); rec != nil {
+		return rec.Close()
+	}
+	return nil
+}
+
+// recorderProcessor hands every bitmap to the recorder of StartRecording,
+// if there is one, before handing it to the user's processor
+type recorderProcessor struct {
+	c    *Client
+	next Processor
+}
+
+func (p *recorderProcessor) ProcessBitmap(option *bitmap.Option, bmp *bitmap.BitMap) {
+	if rec := p.c.recorder.Load(); rec != nil {
+		rec.ProcessBitmap(option, bmp)
+	}
+	if p.next != nil {
+		p.next.ProcessBitmap(option, bmp)
+	}
+}
+
+func (c *Client) withRecording(processor Processor) Processor {
+	return &recorderProcessor{c: c, next: processor}
+}
+
+// Framebuffer returns the framebuffer enabled with EnableFramebuffer, or nil
+func (c *Client) Framebuffer() *bitmap.Framebuffer {
+	return c.framebuffer
+}
+
+// DefaultScreenshotTimeout bounds how long CaptureScreenshot waits for the
+// first full frame
+var DefaultScreenshotTimeout = 10 * time.Second
+
+// Errors returned by CaptureScreenshot
+var (
+	ErrFramebufferDisabled = errors.New("framebuffer not enabled, call EnableFramebuffer before Run")
+	ErrScreenshotTimeout   = errors.New("timed out waiting for a full frame")
+)
+
+// CaptureScreenshot returns the composited desktop encoded as PNG. It waits
+// until updates have covered the whole desktop at least once, for up to
+// DefaultScreenshotTimeout.
+func (c *Client) CaptureScreenshot() ([]byte, error) {
+	fb := c.framebuffer
+	if fb == nil {
+		return nil, ErrFramebufferDisabled
+	}
+	timer := time.NewTimer(DefaultScreenshotTimeout)
+	defer timer.Stop()
+	select {
+	case <-fb.Complete():
+	case <-timer.C:
+		return nil, ErrScreenshotTimeout
+	case <-c.ctx.Done():
+		return nil, c.ctx.Err()
+	}
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, fb.Snapshot()); err != nil {
+		return nil, fmt.Errorf("encode screenshot: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Updates returns a channel that Run sends the bitmap updates of the session
+// to, as an alternative to a Processor, and closes when it returns. Run
+// waits while the channel is full, so it must be received from steadily.
+// Updates before the first call are not sent.
+func (c *Client) Updates() <-chan BitmapUpdate {
+	c.updatesMu.Lock()
+	defer c.updatesMu.Unlock()
+	if c.updates == nil {
+		c.updates = make(chan BitmapUpdate, updatesBuffer)
+	}
+	return c.updates
+}
+
+// closeUpdates closes the channel of Updates once Run is done with it
+func (c *Client) closeUpdates() {
+	c.updatesMu.Lock()
+	defer c.updatesMu.Unlock()
+	if c.updates != nil {
+		close(c.updates)
+		c.updates = nil
+	}
+}
+
+func (c *Client) withUpdates(ctx context.Context, processor Processor) Processor {
+	return &updatesProcessor{c: c, ctx: ctx, next: processor}
+}
+
+func (c *Client) withFramebuffer(processor Processor) Processor {
+	if c.framebuffer == nil {
+		return processor
+	}
+	return &framebufferProcessor{fb: c.framebuffer, next: processor}
+}
+
+func (c *Client) withFrames(processor Processor) Processor {
+	if c.onFrame == nil {
+		c.frames = nil
+		return processor
+	}
+	c.frames = &frameProcessor{c: c, onFrame: c.onFrame, next: processor}
+	return c.frames
+}
+
+// processBitmap decodes a bitmap update and hands it to processor. Tiles of
+// different color depths may follow each other within one update, so only
+// those of 8bpp or less are given the palette.
+func (c *Client) processBitmap(processor Processor, option *bitmap.Option) {
+	if option.BitPerPixel <= 8 {
+		option.Palette = c.palette
+	}
+	processor.ProcessBitmap(option, bitmap.Decode(option))
+}
+
+// processSurfaceCommands applies surface commands in order. Offscreen
+// surfaces mapped to the desktop are redrawn where a blit changed them.
+func (c *Client) processSurfaceCommands(processor Processor, commands []t128.SurfaceCommand) {
+	surfaces := c.offscreenBitmapManager
+	for _, cmd := range commands {
+		switch sc := cmd.(type) {
+		case *t128.TsSetSurfaceBitsCommand:
+			bd := sc.BitmapData
+			if bd.CodecID != t128.CODEC_ID_NONE {
+				glog.Debugf("surface bits with codec %d skipped", bd.CodecID)
+				continue
+			}
+			option := &bitmap.Option{
+				Top:         int(sc.DestTop),
+				Left:        int(sc.DestLeft),
+				Width:       int(bd.Width),
+				Height:      int(bd.Height),
+				BitPerPixel: int(bd.Bpp),
+				Data:        bd.BitmapData,
+			}
+			processor.ProcessBitmap(option, bitmap.NewBitMapFromRaw(option))
+		case *t128.TsFrameMarkerCommand:
+			if c.frames != nil {
+				c.frames.marker(sc)
+			}
+			if c.frameAck && sc.FrameAction == t128.SURFACECMD_FRAMEACTION_END {
+				c.writeDataPdu(&t128.TsFrameAcknowledgePDU{FrameId: sc.FrameId})
+			}
+		case *t128.TsCreateSurfaceCommand:
+			surfaces.CreateSurface(sc)
+			glog.Debugf("CreateSurface: ID=%d, %dx%d", sc.SurfaceId, sc.Width, sc.Height)
+			c.outputSurface(processor, sc.SurfaceId, image.Rect(0, 0, int(sc.Width), int(sc.Height)))
+		case *t128.TsDeleteSurfaceCommand:
+			surfaces.RemoveOffscreenBitmap(sc.SurfaceId)
+			glog.Debugf("DeleteSurface: ID=%d", sc.SurfaceId)
+		case *t128.TsMapSurfaceToOutputCommand:
+			surfaces.MapToOutput(sc.SurfaceId, image.Pt(int(sc.OutputOriginX), int(sc.OutputOriginY)))
+			glog.Debugf("MapSurfaceToOutput: ID=%d at %d,%d", sc.SurfaceId, sc.OutputOriginX, sc.OutputOriginY)
+			c.outputSurface(processor, sc.SurfaceId, image.Rect(0, 0, math.MaxUint16, math.MaxUint16))
+		case *t128.TsSurfaceToSurfaceCommand:
+			if r, ok := surfaces.SurfaceToSurface(sc); ok {
+				c.outputSurface(processor, sc.DestSurfaceId, r)
+			} else {
+				glog.Warnf("SurfaceToSurface: unknown surface %d or %d", sc.SourceSurfaceId, sc.DestSurfaceId)
+			}
+		case *t128.TsSurfaceToCacheCommand:
+			if !surfaces.SurfaceToCache(sc) {
+				glog.Warnf("SurfaceToCache: unknown surface %d", sc.SurfaceId)
+			}
+		case *t128.TsCacheToSurfaceCommand:
+			if r, ok := surfaces.CacheToSurface(sc); ok {
+				c.outputSurface(processor, sc.SurfaceId, r)
+			} else {
+				glog.Warnf("CacheToSurface: unknown slot %d or surface %d", sc.CacheSlot, sc.SurfaceId)
+			}
+		default:
+			glog.Debugf("Unhandled surface command: %T", sc)
+		}
+	}
+}
+
+// outputSurface draws the part r of surface id to the desktop, if the
+// surface is mapped to it
+func (c *Client) outputSurface(processor Processor, id uint16, r image.Rectangle) {
+	dest, bm, ok := c.offscreenBitmapManager.OutputRegion(id, r)
+	if !ok {
+		return
+	}
+	processor.ProcessBitmap(&bitmap.Option{
+		Top:         dest.Min.Y,
+		Left:        dest.Min.X,
+		Width:       dest.Dx(),
+		Height:      dest.Dy(),
+		BitPerPixel: 32,
+	}, bm)
+}
+
+// processBitmaps decodes the tiles of one update with up to DecodeWorkers
+// goroutines and hands them to processor in order. The bitmap cache has
+// already been looked up and filled tile by tile while options were built,
+// so tiles taken from the cache see the entries of the tiles before them
+// and only the decoding itself runs concurrently. A tile that fails to
+// decode is thrown once the tiles before it have been processed, as when
+// decoding serially.
+func (c *Client) processBitmaps(processor Processor, options []*bitmap.Option) {
+	workers := min(c.option.DecodeWorkers, len(options))
+	if workers <= 1 {
+		for _, option := range options {
+			c.processBitmap(processor, option)
+		}
+		return
+	}
+
+	for _, option := range options {
+		if option.BitPerPixel <= 8 {
+			option.Palette = c.palette
+		}
+	}
+	bitmaps := make([]*bitmap.BitMap, len(options))
+	errs := make([]error, len(options))
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1) - 1); i < len(options); i = int(next.Add(1) - 1) {
+				errs[i] = core.Try(func() { bitmaps[i] = bitmap.Decode(options[i]) })
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, option := range options {
+		core.ThrowError(errs[i])
+		processor.ProcessBitmap(option, bitmaps[i])
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/kdsmith18542/gordp/proto/mcs"
 	"github.com/kdsmith18542/gordp/proto/t128"
 	"github.com/kdsmith18542/gordp/proto/virtualchannel"
+	"github.com/kdsmith18542/gordp/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -899,7 +900,7 @@ func TestMultiMonitorNegotiation(t *testing.T) {
 		},
 	}
 
-	client.SetMonitors(monitors)
+	assert.NoError(t, client.SetMonitors(monitors))
 
 	// Verify monitor layout was set
 	assert.Equal(t, 1, len(client.monitors), "Should have 1 monitor")
@@ -912,8 +913,8 @@ func TestMultiMonitorNegotiation(t *testing.T) {
 		{
 			Left:               0,
 			Top:                0,
-			Right:              1920,
-			Bottom:             1080,
+			Right:              1919,
+			Bottom:             1079,
 			Flags:              0x01, // Primary
 			MonitorIndex:       0,
 			PhysicalWidthMm:    520,
@@ -925,8 +926,8 @@ func TestMultiMonitorNegotiation(t *testing.T) {
 		{
 			Left:               1920,
 			Top:                0,
-			Right:              3840,
-			Bottom:             1080,
+			Right:              3839,
+			Bottom:             1079,
 			Flags:              0x00, // Secondary
 			MonitorIndex:       1,
 			PhysicalWidthMm:    520,
@@ -937,7 +938,7 @@ func TestMultiMonitorNegotiation(t *testing.T) {
 		},
 	}
 
-	client.SetMonitors(dualMonitors)
+	assert.NoError(t, client.SetMonitors(dualMonitors))
 
 	// Verify dual monitor layout was set
 	assert.Equal(t, 2, len(client.monitors), "Should have 2 monitors")
@@ -1055,10 +1056,10 @@ func TestMonitorLayoutValidation(t *testing.T) {
 	})
 
 	// Test empty monitor list
-	client.SetMonitors([]mcs.MonitorLayout{})
+	assert.NoError(t, client.SetMonitors([]mcs.MonitorLayout{}))
 	assert.Equal(t, 0, len(client.monitors), "Should have 0 monitors")
 
-	// Test invalid monitor geometry (negative coordinates)
+	// Test invalid monitor geometry (primary not at the origin)
 	invalidMonitors := []mcs.MonitorLayout{
 		{
 			Left:   -100,
@@ -1069,29 +1070,83 @@ func TestMonitorLayoutValidation(t *testing.T) {
 		},
 	}
 
-	client.SetMonitors(invalidMonitors)
-	assert.Equal(t, 1, len(client.monitors), "Should still set the monitor")
+	assert.ErrorIs(t, client.SetMonitors(invalidMonitors), mcs.ErrMonitorGeometry)
+	assert.Equal(t, 0, len(client.monitors), "Should keep the previous layout")
 
 	// Test overlapping monitors
 	overlappingMonitors := []mcs.MonitorLayout{
 		{
 			Left:   0,
 			Top:    0,
-			Right:  1920,
-			Bottom: 1080,
+			Right:  1919,
+			Bottom: 1079,
 			Flags:  0x01,
 		},
 		{
 			Left:   1000, // Overlaps with first monitor
 			Top:    0,
-			Right:  2920,
-			Bottom: 1080,
+			Right:  2919,
+			Bottom: 1079,
 			Flags:  0x00,
 		},
 	}
 
-	client.SetMonitors(overlappingMonitors)
+	assert.ErrorIs(t, client.SetMonitors(overlappingMonitors), mcs.ErrMonitorsOverlap)
+	assert.Equal(t, 0, len(client.monitors), "Should keep the previous layout")
+
+	// Test the permissive path
+	client.SetMonitorsUnchecked(overlappingMonitors)
 	assert.Equal(t, 2, len(client.monitors), "Should set both monitors")
+
+	// Test primary monitor count
+	noPrimary := []mcs.MonitorLayout{{Right: 1919, Bottom: 1079}}
+	assert.ErrorIs(t, client.SetMonitors(noPrimary), mcs.ErrMonitorPrimary)
+	twoPrimaries := []mcs.MonitorLayout{
+		{Right: 1919, Bottom: 1079, Flags: 0x01},
+		{Left: 1920, Right: 3839, Bottom: 1079, Flags: 0x01},
+	}
+	assert.ErrorIs(t, client.SetMonitors(twoPrimaries), mcs.ErrMonitorPrimary)
+
+	// Test the virtual desktop size limit
+	tooWide := []mcs.MonitorLayout{
+		{Right: 1919, Bottom: 1079, Flags: 0x01},
+		{Left: 30848, Right: 32767, Bottom: 1079},
+	}
+	assert.ErrorIs(t, client.SetMonitors(tooWide), mcs.ErrDesktopTooLarge)
+	assert.Equal(t, 2, len(client.monitors), "Should keep the previous layout")
+}
+
+// TestArrangeMonitors tests snapping secondary monitors against the primary
+func TestArrangeMonitors(t *testing.T) {
+	// overlapping and apart, with the primary off the origin
+	monitors := []mcs.MonitorLayout{
+		{Left: 2000, Top: 10, Right: 3279, Bottom: 1033},              // right
+		{Left: 100, Top: 100, Right: 2019, Bottom: 1179, Flags: 0x01}, // primary
+		{Left: -2000, Top: 0, Right: -1001, Bottom: 999},              // left
+		{Left: 4000, Top: 0, Right: 4799, Bottom: 599},                // right, further away
+		{Left: 500, Top: 1500, Right: 2419, Bottom: 2579},             // below
+		{Left: 100, Top: -3000, Right: 1379, Bottom: -2001},           // above
+	}
+
+	arranged, err := mcs.ArrangeMonitors(monitors)
+	assert.NoError(t, err)
+	assert.NoError(t, mcs.ValidateMonitors(arranged))
+	corners := make([][4]int32, len(arranged))
+	for i, m := range arranged {
+		corners[i] = [4]int32{m.Left, m.Top, m.Right, m.Bottom}
+	}
+	assert.Equal(t, [][4]int32{
+		{1920, 0, 3199, 1023},
+		{0, 0, 1919, 1079},
+		{-1000, 0, -1, 999},
+		{3200, 0, 3999, 599},
+		{0, 1080, 1919, 2159},
+		{0, -1000, 1279, -1},
+	}, corners)
+	assert.Equal(t, int32(2000), monitors[0].Left, "Should not change the layout passed in")
+
+	_, err = mcs.ArrangeMonitors([]mcs.MonitorLayout{{Right: 1919, Bottom: 1079}})
+	assert.ErrorIs(t, err, mcs.ErrMonitorPrimary)
 }
 
 // TestHighDPIMonitorLayout tests high DPI monitor configurations
@@ -1107,8 +1162,8 @@ func TestHighDPIMonitorLayout(t *testing.T) {
 		{
 			Left:               0,
 			Top:                0,
-			Right:              1920,
-			Bottom:             1080,
+			Right:              1919,
+			Bottom:             1079,
 			Flags:              0x01,
 			MonitorIndex:       0,
 			PhysicalWidthMm:    520,
@@ -1120,8 +1175,8 @@ func TestHighDPIMonitorLayout(t *testing.T) {
 		{
 			Left:               1920,
 			Top:                0,
-			Right:              3840,
-			Bottom:             1080,
+			Right:              3839,
+			Bottom:             1079,
 			Flags:              0x00,
 			MonitorIndex:       1,
 			PhysicalWidthMm:    520,
@@ -1132,7 +1187,7 @@ func TestHighDPIMonitorLayout(t *testing.T) {
 		},
 	}
 
-	client.SetMonitors(highDPIMonitors)
+	assert.NoError(t, client.SetMonitors(highDPIMonitors))
 	assert.Equal(t, 2, len(client.monitors), "Should have 2 monitors")
 	assert.Equal(t, uint32(200), client.monitors[0].DesktopScaleFactor, "First monitor should have 200% scaling")
 	assert.Equal(t, uint32(125), client.monitors[1].DesktopScaleFactor, "Second monitor should have 125% scaling")
@@ -1154,7 +1209,7 @@ func TestHighDPIMonitorLayout(t *testing.T) {
 		},
 	}
 
-	client.SetMonitors(portraitMonitors)
+	assert.NoError(t, client.SetMonitors(portraitMonitors))
 	assert.Equal(t, 1, len(client.monitors), "Should have 1 monitor")
 	assert.Equal(t, uint32(1), client.monitors[0].Orientation, "Monitor should be portrait")
 }
@@ -1229,8 +1284,8 @@ func TestMultiMonitorClientIntegration(t *testing.T) {
 		{
 			Left:               0,
 			Top:                0,
-			Right:              1920,
-			Bottom:             1080,
+			Right:              1919,
+			Bottom:             1079,
 			Flags:              0x01,
 			MonitorIndex:       0,
 			PhysicalWidthMm:    520,
@@ -1242,8 +1297,8 @@ func TestMultiMonitorClientIntegration(t *testing.T) {
 		{
 			Left:               1920,
 			Top:                0,
-			Right:              3840,
-			Bottom:             1080,
+			Right:              3839,
+			Bottom:             1079,
 			Flags:              0x00,
 			MonitorIndex:       1,
 			PhysicalWidthMm:    520,
@@ -1261,7 +1316,7 @@ func TestMultiMonitorClientIntegration(t *testing.T) {
 	})
 
 	// Set monitor layout
-	client.SetMonitors(monitors)
+	assert.NoError(t, client.SetMonitors(monitors))
 
 	// Verify monitor layout is set
 	assert.Equal(t, 2, len(client.monitors), "Client should have 2 monitors configured")
@@ -1289,7 +1344,7 @@ func TestMultiMonitorClientIntegration(t *testing.T) {
 		},
 	}
 
-	client.SetMonitors(updatedMonitors)
+	assert.NoError(t, client.SetMonitors(updatedMonitors))
 	assert.Equal(t, 1, len(client.monitors), "Client should have 1 monitor after update")
 	assert.Equal(t, int32(2560), client.monitors[0].Right, "Monitor should be updated")
 	assert.Equal(t, uint32(150), client.monitors[0].DesktopScaleFactor, "DPI should be updated")
@@ -1320,7 +1375,7 @@ func TestMonitorLayoutEdgeCases(t *testing.T) {
 		},
 	}
 
-	client.SetMonitors(largeMonitors)
+	assert.NoError(t, client.SetMonitors(largeMonitors))
 	assert.Equal(t, 1, len(client.monitors), "Should have 1 monitor")
 	assert.Equal(t, int32(8192), client.monitors[0].Right, "Large resolution should be supported")
 	assert.Equal(t, uint32(300), client.monitors[0].DesktopScaleFactor, "High DPI should be supported")
@@ -1342,18 +1397,23 @@ func TestMonitorLayoutEdgeCases(t *testing.T) {
 		},
 	}
 
-	client.SetMonitors(zeroMonitors)
+	// Right and Bottom are inclusive, so this is a single pixel
+	assert.NoError(t, client.SetMonitors(zeroMonitors))
 	assert.Equal(t, 1, len(client.monitors), "Should still set the monitor")
 
+	// Test an empty monitor
+	emptyMonitors := []mcs.MonitorLayout{{Right: -1, Bottom: -1, Flags: 0x01}}
+	assert.ErrorIs(t, client.SetMonitors(emptyMonitors), mcs.ErrMonitorGeometry)
+
 	// Test maximum number of monitors (reasonable limit)
 	maxMonitors := make([]mcs.MonitorLayout, 16) // 16 monitors
 	for i := 0; i < 16; i++ {
 		maxMonitors[i] = mcs.MonitorLayout{
 			Left:               int32(i * 1920),
 			Top:                0,
-			Right:              int32((i + 1) * 1920),
-			Bottom:             1080,
-			Flags:              uint32(i), // Only first one is primary
+			Right:              int32((i+1)*1920 - 1),
+			Bottom:             1079,
+			Flags:              0,
 			MonitorIndex:       uint32(i),
 			PhysicalWidthMm:    520,
 			PhysicalHeightMm:   320,
@@ -1363,39 +1423,126 @@ func TestMonitorLayoutEdgeCases(t *testing.T) {
 		}
 	}
 
-	client.SetMonitors(maxMonitors)
+	maxMonitors[0].Flags = 0x01 // Only first one is primary
+
+	assert.NoError(t, client.SetMonitors(maxMonitors))
 	assert.Equal(t, 16, len(client.monitors), "Should have 16 monitors")
+
+	// Test one monitor too many
+	tooMany := append(maxMonitors, mcs.MonitorLayout{Top: 1080, Right: 1919, Bottom: 2159})
+	assert.ErrorIs(t, client.SetMonitors(tooMany), mcs.ErrMonitorCount)
 }
 
-func TestIntegration_BasicRdpSession(t *testing.T) {
-	// This is a placeholder integration test.
-	// In a real test, you would spin up a mock RDP server or use a test server.
-	// Here, we just check that the client can be constructed and run without panic for a short time.
+// chanVCHandler passes the messages of a static channel on to a channel
+type chanVCHandler chan []byte
 
-	opt := &Option{
-		Addr:     "127.0.0.1:3389", // Use a test server or mock
+func (h chanVCHandler) HandleData(channelID uint16, data []byte) error {
+	h <- data
+	return nil
+}
+
+func (h chanVCHandler) OnChannelOpen(channelID uint16, channelName string) error {
+	return nil
+}
+
+func (h chanVCHandler) OnChannelClose(channelID uint16) error {
+	return nil
+}
+
+// TestIntegration_BasicRdpSession connects to the in-memory server of
+// package testutil and exchanges messages on a static channel
+func TestIntegration_BasicRdpSession(t *testing.T) {
+	server := testutil.NewServer()
+	client := NewClientWithConn(server.Pipe(), &Option{
+		Addr:     "testutil",
 		UserName: "testuser",
 		Password: "testpass",
+		Width:    800,
+		Height:   600,
+	})
+	messages := make(chanVCHandler, 1)
+	assert.NoError(t, client.RegisterStaticChannel("ECHO", messages))
+	if !assert.NoError(t, client.Connect()) {
+		return
+	}
+	assert.True(t, client.Connected())
+	assert.Equal(t, uint16(800), server.ClientCoreData().DesktopWidth)
+	info := client.SessionInfo()
+	assert.Equal(t, uint16(800), info.DesktopWidth)
+	assert.Equal(t, uint16(600), info.DesktopHeight)
+	limits, ok := client.ServerLimits()
+	assert.True(t, ok)
+	assert.True(t, limits.DesktopResize)
+	assert.Equal(t, uint32(1600), limits.VCChunkSize)
+
+	done := make(chan error, 1)
+	go func() { done <- client.Run(nil) }()
+
+	receive := func() []byte {
+		select {
+		case data := <-messages:
+			return data
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message from the server")
+			return nil
+		}
 	}
+	assert.NoError(t, client.SendVirtualChannelData("ECHO", []byte("ping"),
+		virtualchannel.CHANNEL_FLAG_FIRST|virtualchannel.CHANNEL_FLAG_LAST))
+	assert.Equal(t, []byte("ping"), receive())
 
-	client := NewClient(opt)
-	assert.NotNil(t, client)
+	// the server sends long messages in chunks
+	long := bytes.Repeat([]byte("0123456789"), 500)
+	assert.NoError(t, server.SendChannelData("ECHO", long))
+	assert.Equal(t, long, receive())
 
-	done := make(chan struct{})
-	go func() {
-		_ = client.Run(nil) // Run with nil processor for now
-		close(done)
-	}()
+	client.Close()
+	<-done
+	<-server.Done()
+	assert.NoError(t, server.Err())
+}
 
-	select {
-	case <-done:
-		// Finished (likely error, but that's OK for now)
-	case <-time.After(2 * time.Second):
-		// Timeout, forcibly close
+func TestIntegration_StandardRdpSecurity(t *testing.T) {
+	for _, method := range []uint32{mcs.ENCRYPTION_METHOD_40BIT, mcs.ENCRYPTION_METHOD_56BIT, mcs.ENCRYPTION_METHOD_128BIT} {
+		t.Run(fmt.Sprintf("method %#x", method), func(t *testing.T) {
+			server := testutil.NewServer()
+			server.EncryptionMethod = method
+			client := NewClientWithConn(server.Pipe(), &Option{Addr: "testutil", UserName: "testuser", Password: "testpass"})
+			messages := make(chanVCHandler, 1)
+			assert.NoError(t, client.RegisterStaticChannel("ECHO", messages))
+			if !assert.NoError(t, client.Connect()) {
+				return
+			}
+			assert.NotNil(t, client.encryption)
+			done := make(chan error, 1)
+			go func() { done <- client.Run(nil) }()
+
+			// slow-path PDUs, fast-path input and channel data in both
+			// directions all decrypt on the other side
+			assert.NoError(t, client.SendMouseMoveEvent(10, 20))
+			assert.NoError(t, client.Ping())
+			receive := func() []byte {
+				select {
+				case data := <-messages:
+					return data
+				case <-time.After(5 * time.Second):
+					t.Fatal("no message from the server")
+					return nil
+				}
+			}
+			assert.NoError(t, client.SendVirtualChannelData("ECHO", []byte("ping"),
+				virtualchannel.CHANNEL_FLAG_FIRST|virtualchannel.CHANNEL_FLAG_LAST))
+			assert.Equal(t, []byte("ping"), receive())
+			long := bytes.Repeat([]byte("0123456789"), 500)
+			assert.NoError(t, server.SendChannelData("ECHO", long))
+			assert.Equal(t, long, receive())
+
+			client.Close()
+			<-done
+			<-server.Done()
+			assert.NoError(t, server.Err())
+		})
 	}
-
-	// If we reach here, the client ran without panic
-	assert.True(t, true)
 }
 
 // TestMultiMonitorCapabilityFlag tests that the multi-monitor capability flag is set correctly
@@ -1405,8 +1552,8 @@ func TestMultiMonitorCapabilityFlag(t *testing.T) {
 		{
 			Left:               0,
 			Top:                0,
-			Right:              1920,
-			Bottom:             1080,
+			Right:              1919,
+			Bottom:             1079,
 			Flags:              0x01,
 			MonitorIndex:       0,
 			PhysicalWidthMm:    520,
@@ -1424,12 +1571,43 @@ func TestMultiMonitorCapabilityFlag(t *testing.T) {
 		Monitors: monitors,
 	})
 
-	// Verify that the multi-monitor capability flag should be set in the client core data
+	// Verify that the multi-monitor capability flag is set in the client core data
 	// This flag indicates support for the Monitor Layout PDU
 	assert.True(t, len(client.monitors) > 0, "Client should have monitors configured")
-
-	// Note: The actual flag setting would happen during connection negotiation
-	// This test verifies that the client is properly configured for multi-monitor support
+	pdu := client.newConnectInitial()
+	coreData := pdu.ClientCoreData
+	assert.NotZero(t, coreData.EarlyCapabilityFlags&mcs.RNS_UD_CS_SUPPORT_MONITOR_LAYOUT_PDU, "Monitor layout flag should be set")
+	assert.Equal(t, uint16(1920), coreData.DesktopWidth, "Desktop should span the monitors")
+	assert.Equal(t, uint16(1080), coreData.DesktopHeight, "Desktop should span the monitors")
+
+	// Verify the client data sent to the server carries the monitor blocks
+	buff := new(bytes.Buffer)
+	pdu.Write(buff)
+	monitorBlock := []byte{
+		0x05, 0xC0, 0x20, 0x00, // CS_MONITOR, 32 bytes
+		0x00, 0x00, 0x00, 0x00, // flags
+		0x01, 0x00, 0x00, 0x00, // monitorCount
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // left, top
+		0x7F, 0x07, 0x00, 0x00, 0x37, 0x04, 0x00, 0x00, // right, bottom
+		0x01, 0x00, 0x00, 0x00, // TS_MONITOR_PRIMARY
+	}
+	assert.True(t, bytes.Contains(buff.Bytes(), monitorBlock), "Client data should contain the monitor block")
+	monitorExBlock := []byte{
+		0x08, 0xC0, 0x24, 0x00, // CS_MONITOR_EX, 36 bytes
+		0x00, 0x00, 0x00, 0x00, // flags
+		0x14, 0x00, 0x00, 0x00, // monitorAttributeSize
+		0x01, 0x00, 0x00, 0x00, // monitorCount
+		0x08, 0x02, 0x00, 0x00, 0x40, 0x01, 0x00, 0x00, // physical size
+		0x00, 0x00, 0x00, 0x00, // landscape
+		0x64, 0x00, 0x00, 0x00, 0x64, 0x00, 0x00, 0x00, // scale factors
+	}
+	assert.True(t, bytes.Contains(buff.Bytes(), monitorExBlock), "Client data should contain the monitor attributes")
+
+	// Without monitors neither block is sent
+	plain := NewClient(&Option{Addr: "localhost:3389"}).newConnectInitial()
+	assert.Nil(t, plain.ClientMonitorData)
+	assert.Nil(t, plain.ClientMonitorExtendedData)
+	assert.Zero(t, plain.ClientCoreData.EarlyCapabilityFlags&mcs.RNS_UD_CS_SUPPORT_MONITOR_LAYOUT_PDU)
 }
 
 // TestClipboardFunctionality tests clipboard functionality
@@ -1532,10 +1710,10 @@ func TestDeviceRedirection(t *testing.T) {
 	})
 
 	t.Run("DeviceTypes", func(t *testing.T) {
-		assert.Equal(t, device.DeviceType(0x00000001), device.DeviceTypePrinter)
-		assert.Equal(t, device.DeviceType(0x00000002), device.DeviceTypeDrive)
-		assert.Equal(t, device.DeviceType(0x00000003), device.DeviceTypePort)
-		assert.Equal(t, device.DeviceType(0x00000004), device.DeviceTypeSmartCard)
+		assert.Equal(t, device.DeviceType(0x00000004), device.DeviceTypePrinter)
+		assert.Equal(t, device.DeviceType(0x00000008), device.DeviceTypeDrive)
+		assert.Equal(t, device.DeviceType(0x00000001), device.DeviceTypePort)
+		assert.Equal(t, device.DeviceType(0x00000020), device.DeviceTypeSmartCard)
 		assert.Equal(t, device.DeviceType(0x00000005), device.DeviceTypeAudio)
 		assert.Equal(t, device.DeviceType(0x00000006), device.DeviceTypeVideo)
 		assert.Equal(t, device.DeviceType(0x00000007), device.DeviceTypeUSB)
@@ -1885,24 +2063,24 @@ func TestConfigurationManagement(t *testing.T) {
 			{
 				Left:   0,
 				Top:    0,
-				Right:  1920,
-				Bottom: 1080,
+				Right:  1919,
+				Bottom: 1079,
 				Flags:  0x01, // Primary monitor
 			},
 			{
 				Left:   1920,
 				Top:    0,
-				Right:  3840,
-				Bottom: 1080,
+				Right:  3839,
+				Bottom: 1079,
 				Flags:  0,
 			},
 		}
 
-		client.SetMonitors(monitors)
+		assert.NoError(t, client.SetMonitors(monitors))
 		retrieved := client.GetMonitors()
 		assert.Len(t, retrieved, 2)
-		assert.Equal(t, int32(1920), retrieved[0].Right)
-		assert.Equal(t, int32(1080), retrieved[0].Bottom)
+		assert.Equal(t, int32(1919), retrieved[0].Right)
+		assert.Equal(t, int32(1079), retrieved[0].Bottom)
 		assert.Equal(t, uint32(0x01), retrieved[0].Flags)
 	})
 }
@@ -1938,9 +2116,9 @@ func TestIntegrationScenarios(t *testing.T) {
 		err = client.RegisterDeviceHandler(device.NewDefaultDeviceHandler())
 		assert.NoError(t, err)
 
-		// Test handler registration
-		assert.True(t, client.IsClipboardChannelOpen())
-		assert.True(t, client.IsDeviceChannelOpen())
+		// The channels only open once the server joins them
+		assert.False(t, client.IsClipboardChannelOpen())
+		assert.False(t, client.IsDeviceChannelOpen())
 	})
 }
 
@@ -1,17 +1,53 @@
 package gordp
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
 	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/core/compression"
 	"github.com/kdsmith18542/gordp/proto/bitmap"
+	"github.com/kdsmith18542/gordp/proto/capability"
 	"github.com/kdsmith18542/gordp/proto/clipboard"
 	"github.com/kdsmith18542/gordp/proto/device"
+	"github.com/kdsmith18542/gordp/proto/drdynvc"
+	"github.com/kdsmith18542/gordp/proto/fastpath"
 	"github.com/kdsmith18542/gordp/proto/mcs"
+	"github.com/kdsmith18542/gordp/proto/mcs/per"
+	"github.com/kdsmith18542/gordp/proto/nla"
+	"github.com/kdsmith18542/gordp/proto/orders"
+	"github.com/kdsmith18542/gordp/proto/pdu/connPdu"
+	"github.com/kdsmith18542/gordp/proto/pdu/licPdu"
+	"github.com/kdsmith18542/gordp/proto/rail"
+	"github.com/kdsmith18542/gordp/proto/rdpedisp"
+	"github.com/kdsmith18542/gordp/proto/sec"
 	"github.com/kdsmith18542/gordp/proto/t128"
+	"github.com/kdsmith18542/gordp/proto/virtualchannel"
+	"github.com/kdsmith18542/gordp/proto/x224"
+	"github.com/kdsmith18542/gordp/replay"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // TestClientCreationAndConfiguration tests client creation and configuration
@@ -87,39 +123,24 @@ func TestVirtualChannelManagement(t *testing.T) {
 	})
 
 	t.Run("DefaultVirtualChannels", func(t *testing.T) {
-		// Check that default virtual channels are registered
-		channels := client.vcManager.ListChannels()
-		assert.Len(t, channels, 4)
-
-		// Check specific channels
-		cliprdr, exists := client.vcManager.GetChannelByName("cliprdr")
-		assert.True(t, exists)
-		assert.NotNil(t, cliprdr)
-		assert.Equal(t, uint16(1), cliprdr.ID)
-
-		rdpsnd, exists := client.vcManager.GetChannelByName("rdpsnd")
-		assert.True(t, exists)
-		assert.NotNil(t, rdpsnd)
-		assert.Equal(t, uint16(2), rdpsnd.ID)
-
-		drdynvc, exists := client.vcManager.GetChannelByName("drdynvc")
-		assert.True(t, exists)
-		assert.NotNil(t, drdynvc)
-		assert.Equal(t, uint16(3), drdynvc.ID)
-
-		rdpdr, exists := client.vcManager.GetChannelByName("rdpdr")
-		assert.True(t, exists)
-		assert.NotNil(t, rdpdr)
-		assert.Equal(t, uint16(4), rdpdr.ID)
+		// The default channels are offered to the server, which gives them
+		// their ids when it binds them
+		assert.Empty(t, client.vcManager.ListChannels())
+		network := client.newConnectInitial().ClientNetworkData
+		assert.Equal(t, uint32(4), network.ChannelCount)
+		for i, name := range []string{"cliprdr", "rdpsnd", "drdynvc", "rdpdr"} {
+			assert.Equal(t, name+"\x00", string(network.ChannelDefArray[i].Name[:len(name)+1]))
+		}
 	})
 
 	t.Run("DynamicVirtualChannelRegistration", func(t *testing.T) {
 		handler := &testDVCHandler{}
 		err := client.RegisterDynamicVirtualChannelHandler("TEST_CHANNEL", handler)
 		assert.NoError(t, err)
+		assert.Contains(t, client.dvcHandlers, "TEST_CHANNEL")
 
-		channels := client.ListDynamicVirtualChannels()
-		assert.Contains(t, channels, "TEST_CHANNEL")
+		// listed once the server creates it
+		assert.Empty(t, client.ListDynamicVirtualChannels())
 	})
 
 	t.Run("VirtualChannelDataSending", func(t *testing.T) {
@@ -192,25 +213,122 @@ func TestMonitorManagement(t *testing.T) {
 
 	t.Run("MonitorConfiguration", func(t *testing.T) {
 		monitors := []mcs.MonitorLayout{
-			{Left: 0, Top: 0, Right: 1920, Bottom: 1080, Flags: 0x01},
-			{Left: 1920, Top: 0, Right: 3840, Bottom: 1080, Flags: 0x00},
+			{Left: 0, Top: 0, Right: 1919, Bottom: 1079, Flags: 0x01},
+			{Left: 1920, Top: 0, Right: 3839, Bottom: 1079, Flags: 0x00},
 		}
 
-		client.SetMonitors(monitors)
+		assert.NoError(t, client.SetMonitors(monitors))
 		retrieved := client.GetMonitors()
 		assert.Len(t, retrieved, 2)
-		assert.Equal(t, int32(1920), retrieved[0].Right)
-		assert.Equal(t, int32(1080), retrieved[0].Bottom)
+		assert.Equal(t, int32(1919), retrieved[0].Right)
+		assert.Equal(t, int32(1079), retrieved[0].Bottom)
 		assert.Equal(t, uint32(0x01), retrieved[0].Flags)
 	})
 
 	t.Run("EmptyMonitorConfiguration", func(t *testing.T) {
-		client.SetMonitors(nil)
+		assert.NoError(t, client.SetMonitors(nil))
 		retrieved := client.GetMonitors()
 		assert.Empty(t, retrieved)
 	})
 }
 
+// TestSetOrientation tests rotating a monitor over the display control channel
+func TestSetOrientation(t *testing.T) {
+	client := NewClient(&Option{Addr: "localhost:3389", UserName: "test", Password: "test"})
+	client.desktopWidth, client.desktopHeight = 1920, 1080
+	var layouts [][]byte
+	client.displayManager = rdpedisp.NewDisplayManager(func(channelId uint32, data []byte) error {
+		layouts = append(layouts, data)
+		return nil
+	})
+
+	assert.ErrorIs(t, client.SetOrientation(0, mcs.ORIENTATION_PORTRAIT), rdpedisp.ErrNotReady)
+	assert.Empty(t, client.GetMonitors())
+
+	caps := new(bytes.Buffer)
+	core.WriteLE(caps, rdpedisp.DisplayControlHeader{Type: rdpedisp.DISPLAYCONTROL_PDU_TYPE_CAPS, Length: 20})
+	core.WriteLE(caps, rdpedisp.Caps{MaxNumMonitors: 16, MaxMonitorAreaFactorA: 8192, MaxMonitorAreaFactorB: 8192})
+	require.NoError(t, client.displayManager.OnDataReceived(1, caps.Bytes()))
+
+	// the desktop becomes monitor 0, turned to portrait
+	require.NoError(t, client.SetOrientation(0, mcs.ORIENTATION_PORTRAIT))
+	monitors := client.GetMonitors()
+	require.Len(t, monitors, 1)
+	assert.Equal(t, mcs.MonitorLayout{Right: 1079, Bottom: 1919, Flags: mcs.TS_MONITOR_PRIMARY, Orientation: mcs.ORIENTATION_PORTRAIT}, monitors[0])
+	require.Len(t, layouts, 1)
+	assert.Equal(t, rdpedisp.NewMonitorLayoutPdu(monitors), layouts[0])
+
+	// flipping keeps the size
+	require.NoError(t, client.SetOrientation(0, mcs.ORIENTATION_PORTRAIT_FLIPPED))
+	assert.Equal(t, int32(1079), client.GetMonitors()[0].Right)
+
+	// a second monitor is moved to stay next to the rotated primary one
+	require.NoError(t, client.SetMonitors([]mcs.MonitorLayout{
+		{Right: 1919, Bottom: 1079, Flags: mcs.TS_MONITOR_PRIMARY, PhysicalWidthMm: 520, PhysicalHeightMm: 290},
+		{Left: 1920, Right: 3839, Bottom: 1079},
+	}))
+	require.NoError(t, client.SetOrientation(0, mcs.ORIENTATION_PORTRAIT))
+	monitors = client.GetMonitors()
+	assert.Equal(t, int32(1919), monitors[0].Bottom)
+	assert.Equal(t, uint32(290), monitors[0].PhysicalWidthMm)
+	assert.Equal(t, int32(1080), monitors[1].Left)
+
+	assert.Error(t, client.SetOrientation(0, 45))
+	assert.ErrorIs(t, client.SetOrientation(2, mcs.ORIENTATION_LANDSCAPE), mcs.ErrMonitorCount)
+	assert.Len(t, layouts, 3)
+}
+
+// TestServerLimits tests checking layouts against the limits of the server
+func TestServerLimits(t *testing.T) {
+	client := NewClient(&Option{Addr: "localhost:3389", UserName: "test", Password: "test"})
+	client.desktopWidth, client.desktopHeight = 1024, 768
+	var layouts int
+	client.displayManager = rdpedisp.NewDisplayManager(func(channelId uint32, data []byte) error {
+		layouts++
+		return nil
+	})
+	double := []mcs.MonitorLayout{
+		{Right: 1023, Bottom: 767, Flags: mcs.TS_MONITOR_PRIMARY},
+		{Left: 1024, Right: 2047, Bottom: 767},
+	}
+
+	// nothing is checked before the server announced its limits
+	_, ok := client.ServerLimits()
+	assert.False(t, ok)
+	require.NoError(t, client.SetMonitors(double))
+
+	limits := serverLimits([]capability.TsCapsSet{
+		&capability.TsBitmapCapabilitySet{DesktopWidth: 1024, DesktopHeight: 768},
+		&capability.TsMultiFragmentUpdateCapabilitySet{MaxRequestSize: 0x3F0000},
+		&capability.TsVirtualChannelCapabilitySet{VCChunkSize: 1600},
+	})
+	assert.Equal(t, ServerLimits{MaxRequestSize: 0x3F0000, VCChunkSize: 1600}, limits)
+	client.serverLimits = &limits
+	assert.ErrorIs(t, client.SetMonitors(double), ErrServerLimits)
+	assert.NoError(t, client.SetMonitors(double[:1]))
+	assert.ErrorIs(t, client.ResizeDesktop(1280, 720), ErrServerLimits)
+	assert.Zero(t, layouts)
+
+	limits.DesktopResize = true
+	caps := new(bytes.Buffer)
+	core.WriteLE(caps, rdpedisp.DisplayControlHeader{Type: rdpedisp.DISPLAYCONTROL_PDU_TYPE_CAPS, Length: 20})
+	core.WriteLE(caps, rdpedisp.Caps{MaxNumMonitors: 2, MaxMonitorAreaFactorA: 1280, MaxMonitorAreaFactorB: 720})
+	require.NoError(t, client.displayManager.OnDataReceived(1, caps.Bytes()))
+	got, ok := client.ServerLimits()
+	assert.True(t, ok)
+	assert.Equal(t, uint32(2), got.MaxMonitors)
+	assert.Equal(t, uint64(2*1280*720), got.MaxMonitorArea)
+
+	require.NoError(t, client.ResizeDesktop(1280, 720))
+	assert.Equal(t, 1, layouts)
+	assert.Equal(t, int32(1279), client.GetMonitors()[0].Right)
+	assert.ErrorIs(t, client.ResizeDesktop(1281, 720), mcs.ErrMonitorGeometry)
+	assert.ErrorIs(t, client.ResizeDesktop(2560, 1440), ErrServerLimits)
+	assert.ErrorIs(t, client.SetMonitors(append(slices.Clone(double), mcs.MonitorLayout{Left: 2048, Right: 2559, Bottom: 767})), ErrServerLimits)
+	assert.Equal(t, 1, layouts)
+	assert.Equal(t, int32(1279), client.GetMonitors()[0].Right)
+}
+
 // TestContextManagement tests context management
 func TestContextManagement(t *testing.T) {
 	client := NewClient(&Option{
@@ -354,15 +472,15 @@ func TestDeviceOperations(t *testing.T) {
 	})
 
 	t.Run("DeviceAnnouncement", func(t *testing.T) {
+		// kept until the server sets up the rdpdr channel
 		err := client.AnnounceDevice(device.DeviceTypePrinter, "TEST_PRINTER", "test data")
-		assert.Error(t, err)
-		assert.Contains(t, err.Error(), "no active connection")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, client.GetDeviceCount())
 	})
 
 	t.Run("PrinterDataSending", func(t *testing.T) {
 		err := client.SendPrinterData(1, []byte("test data"), 0)
-		assert.Error(t, err)
-		assert.Contains(t, err.Error(), "no active connection")
+		assert.ErrorIs(t, err, device.ErrChannelNotOpen)
 	})
 }
 
@@ -399,6 +517,10 @@ func (h *testClipboardHandler) OnFormatDataResponse(formatID clipboard.Clipboard
 	return nil
 }
 
+func (h *testClipboardHandler) OnHTMLData(html string, sourceURL string) error {
+	return nil
+}
+
 func (h *testClipboardHandler) OnFileContentsRequest(streamID uint32, listIndex uint32, dwFlags uint32, nPositionLow uint32, nPositionHigh uint32, cbRequested uint32, clipDataID uint32) error {
 	return nil
 }
@@ -452,3 +574,3345 @@ type testProcessor struct {
 func (p *testProcessor) ProcessBitmap(option *bitmap.Option, bitmap *bitmap.BitMap) {
 	p.processCount++
 }
+
+// TestConnectionFinalization drives the finalization sequence against the mock server
+func TestConnectionFinalization(t *testing.T) {
+	// readClientSequence consumes the four PDUs the client sends and checks their order
+	readClientSequence := func(t *testing.T, server *mockServer) {
+		sync := server.ReadDataPdu()
+		assert.Equal(t, uint8(t128.PDUTYPE2_SYNCHRONIZE), sync.Header.PDUType2)
+		assert.Equal(t, uint32(mockShareId), sync.Header.SharedId)
+
+		cooperate := server.ReadDataPdu()
+		assert.Equal(t, uint8(t128.PDUTYPE2_CONTROL), cooperate.Header.PDUType2)
+		assert.Equal(t, uint16(t128.CTRLACTION_COOPERATE), cooperate.Pdu.(*t128.TsControlPDU).Action)
+
+		request := server.ReadDataPdu()
+		assert.Equal(t, uint8(t128.PDUTYPE2_CONTROL), request.Header.PDUType2)
+		assert.Equal(t, uint16(t128.CTRLACTION_REQUEST_CONTROL), request.Pdu.(*t128.TsControlPDU).Action)
+
+		fontList := server.ReadDataPdu()
+		assert.Equal(t, uint8(t128.PDUTYPE2_FONTLIST), fontList.Header.PDUType2)
+	}
+
+	t.Run("FullSequence", func(t *testing.T) {
+		client, server := newMockSession(t)
+		done := server.serve(func() {
+			readClientSequence(t, server)
+			server.WriteDataPdu(t128.NewTsSynchronizePduData(mockUserId))
+			server.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_COOPERATE})
+			// servers may interleave informational PDUs
+			server.WriteDataPdu(&t128.TsSetErrorInfoPDU{})
+			server.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_GRANTED_CONTROL, GrantId: mockUserId, ControlId: mockServerChannel})
+			server.WriteDataPdu(&t128.TsFontMapPDU{MapFlags: 0x0003, EntrySize: 0x0004})
+		})
+
+		err := core.Try(client.sendClientFinalization)
+		assert.NoError(t, err)
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("StaticChannelData", func(t *testing.T) {
+		client := NewClient(&Option{Addr: "mock:3389"})
+		handler := &testVCHandler{}
+		assert.NoError(t, client.RegisterStaticChannel("LOBDATA", handler))
+		server := newMockServer(t, client)
+		done := server.serve(func() {
+			readClientSequence(t, server)
+			server.WriteDataPdu(t128.NewTsSynchronizePduData(mockUserId))
+			// channel data is handled, not taken for an out of order PDU
+			header := binary.LittleEndian.AppendUint32(nil, 2)
+			header = binary.LittleEndian.AppendUint32(header, virtualchannel.CHANNEL_FLAG_FIRST|virtualchannel.CHANNEL_FLAG_LAST)
+			server.WriteMcsData(staticChannelId(client, "LOBDATA"), append(header, 'h', 'i'))
+			server.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_COOPERATE})
+			server.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_GRANTED_CONTROL, GrantId: mockUserId, ControlId: mockServerChannel})
+			server.WriteDataPdu(&t128.TsFontMapPDU{MapFlags: 0x0003, EntrySize: 0x0004})
+		})
+
+		assert.NoError(t, core.Try(client.sendClientFinalization))
+		assert.NoError(t, <-done)
+		assert.Equal(t, [][]byte{[]byte("hi")}, handler.messages)
+	})
+
+	t.Run("MissingGrantedControl", func(t *testing.T) {
+		client, server := newMockSession(t)
+		done := server.serve(func() {
+			readClientSequence(t, server)
+			server.WriteDataPdu(t128.NewTsSynchronizePduData(mockUserId))
+			server.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_COOPERATE})
+			server.WriteDataPdu(&t128.TsFontMapPDU{MapFlags: 0x0003, EntrySize: 0x0004})
+		})
+
+		err := core.Try(client.sendClientFinalization)
+		assert.ErrorIs(t, err, ErrServerGrantControlMissing)
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("MissingSynchronize", func(t *testing.T) {
+		client, server := newMockSession(t)
+		done := server.serve(func() {
+			readClientSequence(t, server)
+			server.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_COOPERATE})
+		})
+
+		err := core.Try(client.sendClientFinalization)
+		assert.ErrorIs(t, err, ErrServerSynchronizeMissing)
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("WaitsForFontMap", func(t *testing.T) {
+		client, server := newMockSession(t)
+		release := make(chan struct{})
+		done := server.serve(func() {
+			readClientSequence(t, server)
+			server.WriteDataPdu(t128.NewTsSynchronizePduData(mockUserId))
+			server.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_COOPERATE})
+			server.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_GRANTED_CONTROL, GrantId: mockUserId, ControlId: mockServerChannel})
+			<-release
+			server.WriteDataPdu(&t128.TsFontMapPDU{MapFlags: 0x0003, EntrySize: 0x0004})
+		})
+
+		finished := make(chan error, 1)
+		go func() { finished <- core.Try(client.sendClientFinalization) }()
+		select {
+		case err := <-finished:
+			t.Fatalf("finalization ended before the font map: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		assert.False(t, client.Connected())
+
+		close(release)
+		assert.NoError(t, <-finished)
+		assert.NoError(t, <-done)
+		assert.True(t, client.Connected())
+	})
+
+	t.Run("FontMapTimeout", func(t *testing.T) {
+		client, server := newMockSession(t)
+		client.option.ActivationTimeout = 20 * time.Millisecond
+		done := server.serve(func() {
+			readClientSequence(t, server)
+			server.WriteDataPdu(t128.NewTsSynchronizePduData(mockUserId))
+			server.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_COOPERATE})
+			server.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_GRANTED_CONTROL, GrantId: mockUserId, ControlId: mockServerChannel})
+		})
+
+		err := core.Try(client.sendClientFinalization)
+		assert.ErrorIs(t, err, ErrActivationIncomplete)
+		assert.ErrorIs(t, err, ErrServerFontMapMissing)
+		assert.False(t, client.Connected())
+		assert.NoError(t, <-done)
+	})
+}
+
+// TestScanCodeInput tests raw scancode and layout-aware string input
+func TestScanCodeInput(t *testing.T) {
+	t.Run("SendScanCode", func(t *testing.T) {
+		client, server := newMockSession(t)
+		done := server.serve(func() {
+			_, data := server.ReadFastPathInput()
+			assert.Equal(t, []byte{t128.FASTPATH_INPUT_KBDFLAGS_EXTENDED, 0x48}, data)
+			_, data = server.ReadFastPathInput()
+			assert.Equal(t, []byte{t128.FASTPATH_INPUT_KBDFLAGS_RELEASE, 0x1E}, data)
+		})
+		assert.NoError(t, client.SendScanCode(0xE048, true, false))
+		assert.NoError(t, client.SendScanCode(0x1E, false, false))
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("SendStringWithLayout", func(t *testing.T) {
+		client, server := newMockSession(t)
+		var got [][]byte
+		done := server.serve(func() {
+			// é: one key; A: shift + key; @: AltGr + key
+			for i := 0; i < 2+4+4; i++ {
+				_, data := server.ReadFastPathInput()
+				got = append(got, data)
+			}
+		})
+		assert.NoError(t, client.SendStringWithLayout("éA@", t128.ScanCodeLayoutFR))
+		assert.NoError(t, <-done)
+		assert.Equal(t, [][]byte{
+			{0x00, 0x03}, {0x01, 0x03},
+			{0x00, 0x2A}, {0x00, 0x10}, {0x01, 0x10}, {0x01, 0x2A},
+			{0x02, 0x38}, {0x00, 0x0B}, {0x01, 0x0B}, {0x03, 0x38},
+		}, got)
+	})
+
+	t.Run("UnmappedCharacter", func(t *testing.T) {
+		client, _ := newMockSession(t)
+		// nothing is read on the server side, so any write would block
+		err := client.SendStringWithLayout("aж", t128.ScanCodeLayoutDE)
+		assert.Error(t, err)
+	})
+
+	t.Run("LayoutsDiffer", func(t *testing.T) {
+		us, _ := t128.ScanCodeLayoutUS.Lookup('y')
+		de, _ := t128.ScanCodeLayoutDE.Lookup('y')
+		assert.Equal(t, uint16(0x15), us.ScanCode)
+		assert.Equal(t, uint16(0x2C), de.ScanCode)
+	})
+}
+
+// TestInitialRefresh checks the full-desktop refresh sent after finalization
+func TestInitialRefresh(t *testing.T) {
+	t.Run("SentAfterFinalization", func(t *testing.T) {
+		client, server := newMockSession(t)
+		client.desktopWidth, client.desktopHeight = 1920, 1080
+		done := server.serve(func() {
+			server.Finalize()
+			refresh := server.ReadDataPdu()
+			assert.Equal(t, uint8(t128.PDUTYPE2_REFRESH_RECT), refresh.Header.PDUType2)
+			pdu := refresh.Pdu.(*t128.TsRefreshRectPDU)
+			assert.Equal(t, uint8(1), pdu.NumberOfAreas)
+			assert.Equal(t, []t128.TsRectangle16{{Left: 0, Top: 0, Right: 1919, Bottom: 1079}}, pdu.AreasToRefresh)
+		})
+
+		err := core.Try(func() {
+			client.sendClientFinalization()
+			client.sendInitialRefresh()
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		client, _ := newMockSession(t)
+		disabled := false
+		client.option.RequestInitialRefresh = &disabled
+		client.desktopWidth, client.desktopHeight = 1920, 1080
+		// nothing reads the pipe, so a write would block the test
+		assert.NoError(t, core.Try(client.sendInitialRefresh))
+	})
+}
+
+// TestKeyDownUp checks held keys and modifier tracking
+func TestKeyDownUp(t *testing.T) {
+	// scancode events: eventFlags 0 for a press, KBDFLAGS_RELEASE for a release
+	press := func(scanCode byte) []byte { return []byte{0x00, scanCode} }
+	release := func(scanCode byte) []byte { return []byte{0x01, scanCode} }
+	const shift, a, b, ctrl, alt, c, w = 0x2A, 0x1E, 0x30, 0x1D, 0x38, 0x2E, 0x11
+
+	t.Run("HoldShiftAcrossKeys", func(t *testing.T) {
+		client, server := newMockSession(t)
+		var got [][]byte
+		done := server.serve(func() {
+			for i := 0; i < 6; i++ {
+				_, data := server.ReadFastPathInput()
+				got = append(got, data)
+			}
+		})
+		assert.NoError(t, client.SendKeyDown(t128.VK_SHIFT, t128.ModifierKey{}))
+		assert.True(t, client.modifierKeys.Shift)
+		// Shift is already held, so the press must not re-send or release it
+		assert.NoError(t, client.SendKeyPress(t128.VK_A, t128.ModifierKey{Shift: true}))
+		assert.True(t, client.modifierKeys.Shift)
+		assert.NoError(t, client.SendKeyPress(t128.VK_B, t128.ModifierKey{}))
+		assert.NoError(t, client.SendKeyUp(t128.VK_SHIFT))
+		assert.False(t, client.modifierKeys.Shift)
+		assert.NoError(t, <-done)
+
+		assert.Equal(t, [][]byte{
+			press(shift),
+			press(a), release(a),
+			press(b), release(b),
+			release(shift),
+		}, got)
+		assert.Empty(t, client.pressedKeys)
+	})
+
+	t.Run("ModifiersReleasedWithKey", func(t *testing.T) {
+		client, server := newMockSession(t)
+		var got [][]byte
+		done := server.serve(func() {
+			for i := 0; i < 6; i++ {
+				_, data := server.ReadFastPathInput()
+				got = append(got, data)
+			}
+		})
+		assert.NoError(t, client.SendKeyDown(t128.VK_C, t128.ModifierKey{Control: true, Alt: true}))
+		assert.Equal(t, t128.ModifierKey{Control: true, Alt: true}, client.modifierKeys)
+		assert.NoError(t, client.SendKeyUp(t128.VK_C))
+		assert.Equal(t, t128.ModifierKey{}, client.modifierKeys)
+		assert.NoError(t, <-done)
+
+		assert.Equal(t, [][]byte{
+			press(ctrl), press(alt),
+			press(c), release(c),
+			release(alt), release(ctrl),
+		}, got)
+	})
+
+	t.Run("ReleaseAllKeys", func(t *testing.T) {
+		client, server := newMockSession(t)
+		var got [][]byte
+		done := server.serve(func() {
+			for i := 0; i < 4; i++ {
+				_, data := server.ReadFastPathInput()
+				got = append(got, data)
+			}
+		})
+		assert.NoError(t, client.SendKeyDown(t128.VK_W, t128.ModifierKey{Shift: true}))
+		assert.NoError(t, client.ReleaseAllKeys())
+		assert.NoError(t, <-done)
+
+		assert.Equal(t, [][]byte{press(shift), press(w), release(w), release(shift)}, got)
+		assert.Empty(t, client.pressedKeys)
+		assert.Equal(t, t128.ModifierKey{}, client.modifierKeys)
+	})
+
+	t.Run("ExtendedKeys", func(t *testing.T) {
+		client, server := newMockSession(t)
+		var got [][]byte
+		done := server.serve(func() {
+			for i := 0; i < 2; i++ {
+				_, data := server.ReadFastPathInput()
+				got = append(got, data)
+			}
+		})
+		assert.NoError(t, client.SendKeyPress(t128.VK_RCONTROL, t128.ModifierKey{}))
+		assert.NoError(t, <-done)
+		// KBDFLAGS_EXTENDED, with KBDFLAGS_RELEASE on the release
+		assert.Equal(t, [][]byte{{0x02, 0x1D}, {0x03, 0x1D}}, got)
+
+		assert.Error(t, client.SendKeyDown(0xFF, t128.ModifierKey{}), "no scancode")
+		assert.Empty(t, client.pressedKeys)
+	})
+}
+
+// TestModifierState checks that restoring a saved state undoes nested modifier changes
+func TestModifierState(t *testing.T) {
+	// scancode events: eventFlags 0 for a press, KBDFLAGS_RELEASE for a release
+	press := func(scanCode byte) []byte { return []byte{0x00, scanCode} }
+	release := func(scanCode byte) []byte { return []byte{0x01, scanCode} }
+	const shift, ctrl = 0x2A, 0x1D
+
+	client, server := newMockSession(t)
+	var got [][]byte
+	done := server.serve(func() {
+		for i := 0; i < 6; i++ {
+			_, data := server.ReadFastPathInput()
+			got = append(got, data)
+		}
+	})
+	assert.NoError(t, client.SendKeyDown(t128.VK_SHIFT, t128.ModifierKey{}))
+	saved := client.SaveModifierState()
+	assert.Equal(t, ModifierState{Shift: true}, saved)
+
+	// a nested step swaps Shift for Control and leaves it held
+	assert.NoError(t, client.SendKeyDown(t128.VK_CONTROL, t128.ModifierKey{}))
+	assert.NoError(t, client.SendKeyUp(t128.VK_SHIFT))
+	assert.Equal(t, ModifierState{Control: true}, client.SaveModifierState())
+
+	assert.NoError(t, client.RestoreModifierState(saved))
+	assert.Equal(t, saved, client.SaveModifierState())
+	// restoring the current state sends nothing
+	assert.NoError(t, client.RestoreModifierState(saved))
+
+	assert.NoError(t, client.SendKeyUp(t128.VK_SHIFT))
+	assert.NoError(t, <-done)
+
+	assert.Equal(t, [][]byte{
+		press(shift),
+		press(ctrl), release(shift),
+		// restored: Control released before Shift is pressed again
+		release(ctrl), press(shift),
+		release(shift),
+	}, got)
+	assert.Empty(t, client.pressedKeys)
+	assert.Equal(t, t128.ModifierKey{}, client.modifierKeys)
+}
+
+// TestCapabilityOverride checks that the override reaches the serialized Confirm Active PDU
+func TestCapabilityOverride(t *testing.T) {
+	client := NewClient(&Option{
+		Addr: "mock:3389",
+		CapabilityOverride: func(caps *Capabilities) {
+			caps.Bitmap().DesktopResizeFlag = 0
+			caps.General().ExtraFlags &^= capability.NO_BITMAP_COMPRESSION_HDR
+		},
+	})
+	demand := &t128.TsDemandActivePduData{SharedId: mockShareId}
+	confirm := client.newConfirmActive(demand)
+
+	decoded := (&t128.TsConfirmActivePduData{}).Read(bytes.NewReader(confirm.Serialize())).(*t128.TsConfirmActivePduData)
+	caps := &Capabilities{Sets: decoded.CapabilitySets}
+	assert.NotNil(t, caps.Bitmap())
+	assert.Equal(t, uint16(0), caps.Bitmap().DesktopResizeFlag)
+	assert.Equal(t, uint16(0), caps.General().ExtraFlags&capability.NO_BITMAP_COMPRESSION_HDR)
+
+	// without an override the defaults are sent unchanged
+	confirm = NewClient(&Option{Addr: "mock:3389"}).newConfirmActive(demand)
+	assert.Equal(t, uint16(0x0001), (&Capabilities{Sets: confirm.CapabilitySets}).Bitmap().DesktopResizeFlag)
+}
+
+// TestFramebufferProcessor checks that Run composites before calling the user processor
+func TestFramebufferProcessor(t *testing.T) {
+	client := NewClient(&Option{Addr: "mock:3389"})
+	processor := &testProcessor{}
+	assert.Equal(t, processor, client.withFramebuffer(processor))
+	assert.Nil(t, client.Framebuffer())
+
+	fb := client.EnableFramebuffer(8, 8)
+	assert.Same(t, fb, client.Framebuffer())
+	wrapped := client.withFramebuffer(processor)
+
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.White)
+	wrapped.ProcessBitmap(&bitmap.Option{Left: 3, Top: 4, Width: 2, Height: 2}, &bitmap.BitMap{Image: img})
+	assert.Equal(t, 1, processor.processCount)
+	assert.Equal(t, color.RGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF}, fb.Snapshot().At(3, 4))
+
+	// a nil processor is allowed when only the framebuffer is wanted
+	client.withFramebuffer(nil).ProcessBitmap(&bitmap.Option{Width: 2, Height: 2}, &bitmap.BitMap{Image: img})
+}
+
+// TestCaptureScreenshot checks the PNG capture of the composited desktop
+func TestCaptureScreenshot(t *testing.T) {
+	client := NewClient(&Option{Addr: "mock:3389"})
+	_, err := client.CaptureScreenshot()
+	assert.ErrorIs(t, err, ErrFramebufferDisabled)
+
+	timeout := DefaultScreenshotTimeout
+	DefaultScreenshotTimeout = 100 * time.Millisecond
+	defer func() { DefaultScreenshotTimeout = timeout }()
+
+	fb := client.EnableFramebuffer(4, 2)
+	processor := client.withFramebuffer(nil)
+	half := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	processor.ProcessBitmap(&bitmap.Option{Width: 2, Height: 2}, &bitmap.BitMap{Image: half})
+	_, err = client.CaptureScreenshot()
+	assert.ErrorIs(t, err, ErrScreenshotTimeout)
+
+	// the second half arrives while the capture is waiting
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		other := image.NewRGBA(image.Rect(0, 0, 2, 2))
+		other.Set(1, 1, color.White)
+		processor.ProcessBitmap(&bitmap.Option{Left: 2, Width: 2, Height: 2}, &bitmap.BitMap{Image: other})
+	}()
+	data, err := client.CaptureScreenshot()
+	assert.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, fb.Snapshot().Bounds(), img.Bounds())
+	r, g, b, _ := img.At(3, 1).RGBA()
+	assert.Equal(t, [3]uint32{0xFFFF, 0xFFFF, 0xFFFF}, [3]uint32{r, g, b})
+}
+
+// TestIsAtLogonScreen checks the logon screen heuristic driven by Save
+// Session Info PDUs
+func TestIsAtLogonScreen(t *testing.T) {
+	t.Run("NoLogonInfo", func(t *testing.T) {
+		client, server := newMockSession(t)
+		client.option.LogonTimeout = 20 * time.Millisecond
+		assert.False(t, client.IsAtLogonScreen(), "not connected yet")
+
+		done := server.serve(server.Finalize)
+		assert.NoError(t, core.Try(client.sendClientFinalization))
+		assert.NoError(t, <-done)
+		assert.False(t, client.IsAtLogonScreen(), "still within the logon window")
+
+		time.Sleep(30 * time.Millisecond)
+		assert.True(t, client.IsAtLogonScreen())
+		assert.Nil(t, client.LogonInfo())
+	})
+
+	t.Run("PlainNotifyDuringFinalization", func(t *testing.T) {
+		client, server := newMockSession(t)
+		client.option.LogonTimeout = time.Nanosecond
+		done := server.serve(func() {
+			for i := 0; i < 4; i++ {
+				server.ReadDataPdu()
+			}
+			server.WriteDataPdu(t128.NewTsSynchronizePduData(mockUserId))
+			server.WriteDataPdu(&t128.TsSaveSessionInfoPDU{InfoType: t128.INFOTYPE_LOGON_PLAINNOTIFY, InfoData: make([]byte, 576)})
+			server.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_COOPERATE})
+			server.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_GRANTED_CONTROL, GrantId: mockUserId, ControlId: mockServerChannel})
+			server.WriteDataPdu(&t128.TsFontMapPDU{MapFlags: 0x0003, EntrySize: 0x0004})
+		})
+		assert.NoError(t, core.Try(client.sendClientFinalization))
+		assert.NoError(t, <-done)
+
+		assert.False(t, client.IsAtLogonScreen())
+		info := client.LogonInfo()
+		if assert.NotNil(t, info) {
+			assert.Equal(t, uint32(t128.INFOTYPE_LOGON_PLAINNOTIFY), info.InfoType)
+		}
+	})
+
+	t.Run("LogonLongWhileRunning", func(t *testing.T) {
+		client, server := newMockSession(t)
+		client.option.LogonTimeout = time.Nanosecond
+		client.connectedAt = time.Now()
+
+		domain := append(core.UnicodeEncode("CORP"), 0, 0)
+		user := append(core.UnicodeEncode("alice"), 0, 0)
+		buf := new(bytes.Buffer)
+		core.WriteLE(buf, uint16(1))  // Version
+		core.WriteLE(buf, uint32(18)) // Size
+		core.WriteLE(buf, uint32(3))  // SessionId
+		core.WriteLE(buf, uint32(len(domain)))
+		core.WriteLE(buf, uint32(len(user)))
+		buf.Write(make([]byte, 558))
+		buf.Write(domain)
+		buf.Write(user)
+
+		done := server.serve(func() {
+			server.WriteDataPdu(&t128.TsSaveSessionInfoPDU{InfoType: t128.INFOTYPE_LOGON_LONG, InfoData: buf.Bytes()})
+		})
+		go func() { _ = client.Run(nil) }()
+		assert.NoError(t, <-done)
+
+		assert.Eventually(t, func() bool { return client.LogonInfo() != nil }, time.Second, time.Millisecond)
+		assert.False(t, client.IsAtLogonScreen())
+		info := client.LogonInfo()
+		assert.Equal(t, uint32(3), info.SessionId)
+		assert.Equal(t, "CORP", info.Domain)
+		assert.Equal(t, "alice", info.UserName)
+	})
+}
+
+// TestOnLogonInfo checks that logons and logon errors reach OnLogonInfo
+func TestOnLogonInfo(t *testing.T) {
+	client, server := newMockSession(t)
+	client.option.LogonTimeout = time.Nanosecond
+	client.connectedAt = time.Now()
+	infos := make(chan LogonInfo, 2)
+	kept := make(chan bool, 2)
+	client.OnLogonInfo(func(info LogonInfo) {
+		infos <- info
+		kept <- client.LogonInfo() != nil
+	})
+
+	// an auto-reconnect cookie, then a password about to expire
+	buf := new(bytes.Buffer)
+	core.WriteLE(buf, uint16(50))
+	core.WriteLE(buf, uint32(t128.LOGON_EX_AUTORECONNECTCOOKIE|t128.LOGON_EX_LOGONERRORS))
+	core.WriteLE(buf, uint32(28))
+	buf.Write(make([]byte, 28))
+	core.WriteLE(buf, uint32(8))
+	core.WriteLE(buf, uint32(t128.LOGON_MSG_SESSION_CONTINUE))
+	core.WriteLE(buf, uint32(t128.LOGON_WARNING))
+	buf.Write(make([]byte, 570))
+
+	done := server.serve(func() {
+		server.WriteDataPdu(&t128.TsSaveSessionInfoPDU{InfoType: t128.INFOTYPE_LOGON_EXTENDED_INFO, InfoData: buf.Bytes()})
+		server.WriteDataPdu(&t128.TsSaveSessionInfoPDU{InfoType: t128.INFOTYPE_LOGON_PLAINNOTIFY, InfoData: make([]byte, 576)})
+	})
+	go func() { _ = client.Run(nil) }()
+	assert.NoError(t, <-done)
+
+	var info LogonInfo
+	select {
+	case info = <-infos:
+	case <-time.After(time.Second):
+		t.Fatal("no logon error")
+	}
+	assert.Equal(t, uint32(t128.INFOTYPE_LOGON_EXTENDED_INFO), info.InfoType)
+	if assert.NotNil(t, info.Error) {
+		assert.Equal(t, t128.TsLogonErrorsInfo{ErrorNotificationType: t128.LOGON_MSG_SESSION_CONTINUE, ErrorNotificationData: t128.LOGON_WARNING}, *info.Error)
+		assert.Equal(t, "the logon continues in the session", info.Error.String())
+	}
+	assert.False(t, <-kept, "logon errors are not a logon")
+
+	select {
+	case info = <-infos:
+	case <-time.After(time.Second):
+		t.Fatal("no logon")
+	}
+	assert.Equal(t, uint32(t128.INFOTYPE_LOGON_PLAINNOTIFY), info.InfoType)
+	assert.Nil(t, info.Error)
+	assert.True(t, <-kept)
+
+	assert.Equal(t, "wrong user name or password", t128.TsLogonErrorsInfo{ErrorNotificationType: t128.LOGON_FAILED_BAD_PASSWORD}.String())
+	assert.Equal(t, "the logon failed and the session is ending: the password must be changed",
+		t128.TsLogonErrorsInfo{ErrorNotificationType: t128.LOGON_MSG_SESSION_TERMINATE, ErrorNotificationData: t128.LOGON_FAILED_UPDATE_PASSWORD}.String())
+}
+
+// mppcLiterals encodes data as bulk compressed literals
+func mppcLiterals(data []byte) []byte {
+	var bits []byte
+	for _, b := range data {
+		if b < 0x80 {
+			bits = append(bits, 0, b>>6&1, b>>5&1, b>>4&1, b>>3&1, b>>2&1, b>>1&1, b&1)
+		} else {
+			bits = append(bits, 1, 0, b>>6&1, b>>5&1, b>>4&1, b>>3&1, b>>2&1, b>>1&1, b&1)
+		}
+	}
+	out := make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		out[i/8] |= bit << (7 - i%8)
+	}
+	return out
+}
+
+// TestBulkCompression checks that bulk compression is advertised and that
+// compressed fast-path and slow-path PDUs are decompressed
+func TestBulkCompression(t *testing.T) {
+	client, server := newMockSession(t)
+	client.option.BulkCompression = true
+
+	palette := &t128.TsUpdatePalette{
+		UpdateType:     t128.UPDATETYPE_PALETTE,
+		PaletteEntries: []t128.TsPaletteEntry{{Red: 0xFF}, {Green: 0x80, Blue: 0x7F}},
+	}
+	var infoFlags uint32
+	done := server.serve(func() {
+		_, data := server.ReadMcsData()
+		infoFlags = binary.LittleEndian.Uint32(data[8:]) // after the security header and code page
+
+		compressed := mppcLiterals(palette.Serialize())
+		update := []byte{t128.FASTPATH_UPDATETYPE_PALETTE | t128.FASTPATH_OUTPUT_COMPRESSION_USED<<6,
+			compression.PACKET_COMPRESSED | compression.PACKET_FLUSHED | compression.PACKET_COMPR_TYPE_64K}
+		update = binary.LittleEndian.AppendUint16(update, uint16(len(compressed)))
+		fastpath.Write(server.Conn, append(update, compressed...))
+
+		body := t128.NewTsSynchronizePduData(mockUserId).Serialize()
+		dataPdu := &t128.TsDataPduData{PduData: mppcLiterals(body)}
+		dataPdu.Header = t128.TsShareDataHeader{
+			SharedId:           mockShareId,
+			StreamId:           t128.STREAM_LOW,
+			UncompressedLength: uint16(len(body) + 4),
+			PDUType2:           t128.PDUTYPE2_SYNCHRONIZE,
+			CompressedType:     compression.PACKET_COMPRESSED | compression.PACKET_COMPR_TYPE_64K,
+			CompressedLength:   uint16(len(dataPdu.PduData) + 4),
+		}
+		data = dataPdu.Serialize()
+		header := t128.TsShareControlHeader{
+			PDUType:     t128.PDUTYPE_DATAPDU,
+			PDUSource:   mockServerChannel,
+			TotalLength: uint16(len(data) + 6),
+		}
+		server.WriteMcsData(mcs.MCS_CHANNEL_GLOBAL, append(header.Serialize(), data...))
+	})
+	assert.NoError(t, core.Try(client.sendClientInfo))
+
+	var fp, slow t128.PDU
+	assert.NoError(t, core.Try(func() {
+		fp = client.readPdu()
+		slow = client.readPdu()
+	}))
+	assert.NoError(t, <-done)
+
+	assert.NotZero(t, infoFlags&licPdu.INFO_COMPRESSION)
+	assert.Equal(t, uint32(compression.PACKET_COMPR_TYPE_64K), infoFlags&licPdu.CompressionTypeMask>>9)
+
+	if assert.IsType(t, &t128.TsFpUpdatePDU{}, fp) {
+		assert.Equal(t, palette.PaletteEntries, fp.(*t128.TsFpUpdatePDU).PDU.(*t128.TsUpdatePalette).PaletteEntries)
+	}
+	if assert.IsType(t, &t128.TsDataPduData{}, slow) {
+		assert.Equal(t, &t128.TsSynchronizePduData{MessageType: 1, TargetUser: mockUserId}, slow.(*t128.TsDataPduData).Pdu)
+	}
+}
+
+// TestFastPathFragments checks that an update fragmented over several
+// fast-path PDUs is parsed once its last fragment is read
+func TestFastPathFragments(t *testing.T) {
+	client, server := newMockSession(t)
+
+	palette := &t128.TsUpdatePalette{
+		UpdateType:     t128.UPDATETYPE_PALETTE,
+		PaletteEntries: []t128.TsPaletteEntry{{Red: 0xFF}, {Green: 0x80, Blue: 0x7F}, {Blue: 1}},
+	}
+	data := palette.Serialize()
+	fragments := [][]byte{data[:4], data[4:9], data[9:]}
+	done := server.serve(func() {
+		for i, fragmentation := range []uint8{t128.FASTPATH_FRAGMENT_FIRST, t128.FASTPATH_FRAGMENT_NEXT, t128.FASTPATH_FRAGMENT_LAST} {
+			update := []byte{t128.FASTPATH_UPDATETYPE_PALETTE | fragmentation<<4}
+			update = binary.LittleEndian.AppendUint16(update, uint16(len(fragments[i])))
+			fastpath.Write(server.Conn, append(update, fragments[i]...))
+		}
+		// a fragment out of sequence is dropped
+		update := binary.LittleEndian.AppendUint16([]byte{t128.FASTPATH_UPDATETYPE_PALETTE | t128.FASTPATH_FRAGMENT_LAST<<4}, 4)
+		fastpath.Write(server.Conn, append(update, data[:4]...))
+	})
+
+	var pdus []t128.PDU
+	assert.NoError(t, core.Try(func() {
+		for i := 0; i < 4; i++ {
+			pdus = append(pdus, client.readPdu())
+		}
+	}))
+	assert.NoError(t, <-done)
+
+	if assert.Len(t, pdus, 4) {
+		assert.Nil(t, pdus[0].(*t128.TsFpUpdatePDU).PDU)
+		assert.Nil(t, pdus[1].(*t128.TsFpUpdatePDU).PDU)
+		if assert.IsType(t, &t128.TsUpdatePalette{}, pdus[2].(*t128.TsFpUpdatePDU).PDU) {
+			assert.Equal(t, palette.PaletteEntries, pdus[2].(*t128.TsFpUpdatePDU).PDU.(*t128.TsUpdatePalette).PaletteEntries)
+		}
+		assert.Nil(t, pdus[3].(*t128.TsFpUpdatePDU).PDU)
+	}
+}
+
+// TestOnFrame checks that the rectangles drawn are handed on per frame,
+// following the frame markers where there are some
+func TestOnFrame(t *testing.T) {
+	client := NewClient(&Option{Addr: "localhost:3389", UserName: "test", Password: "test"})
+	client.desktopWidth, client.desktopHeight = 1024, 768
+	var frames []Frame
+	client.OnFrame(func(f Frame) { frames = append(frames, f) })
+	processor := client.withFrames(nil)
+	draw := func(left, top, width, height int) {
+		processor.ProcessBitmap(&bitmap.Option{Left: left, Top: top, Width: width, Height: height}, nil)
+	}
+	marker := func(action uint16, id uint32) {
+		client.processSurfaceCommands(processor, []t128.SurfaceCommand{&t128.TsFrameMarkerCommand{FrameAction: action, FrameId: id}})
+	}
+
+	// an update outside of markers is a frame, tiles past the desktop clipped
+	draw(0, 0, 64, 64)
+	draw(64, 0, 64, 64)
+	draw(1000, 720, 64, 64)
+	client.frames.endUpdate()
+	assert.Equal(t, []Frame{{Rects: []image.Rectangle{image.Rect(0, 0, 128, 64), image.Rect(1000, 720, 1024, 768)}}}, frames)
+
+	// a marked frame spans updates
+	frames = nil
+	marker(t128.SURFACECMD_FRAMEACTION_BEGIN, 7)
+	draw(0, 0, 10, 10)
+	client.frames.endUpdate()
+	draw(5, 5, 10, 10)
+	client.frames.endUpdate()
+	assert.Empty(t, frames)
+	marker(t128.SURFACECMD_FRAMEACTION_END, 7)
+	assert.Equal(t, []Frame{{ID: 7, Rects: []image.Rectangle{image.Rect(0, 0, 15, 15)}}}, frames)
+
+	// marked frames are handed on even when empty, updates without changes not
+	frames = nil
+	marker(t128.SURFACECMD_FRAMEACTION_BEGIN, 8)
+	marker(t128.SURFACECMD_FRAMEACTION_END, 8)
+	client.frames.endUpdate()
+	assert.Equal(t, []Frame{{ID: 8, Rects: []image.Rectangle{}}}, frames)
+
+	// without OnFrame nothing is gathered
+	client.OnFrame(nil)
+	assert.Nil(t, client.withFrames(nil))
+	assert.Nil(t, client.frames)
+}
+
+func TestCoalesceRects(t *testing.T) {
+	// two rectangles joined by a third one between them
+	assert.Equal(t, []image.Rectangle{image.Rect(0, 0, 30, 10)},
+		coalesceRects([]image.Rectangle{image.Rect(0, 0, 10, 10), image.Rect(20, 0, 30, 10), image.Rect(10, 0, 20, 10)}))
+
+	var scattered []image.Rectangle
+	for i := 0; i <= maxFrameRects; i++ {
+		scattered = append(scattered, image.Rect(i*10, i*10, i*10+5, i*10+5))
+	}
+	assert.Len(t, coalesceRects(scattered[:maxFrameRects]), maxFrameRects)
+	assert.Equal(t, []image.Rectangle{image.Rect(0, 0, maxFrameRects*10+5, maxFrameRects*10+5)}, coalesceRects(scattered))
+}
+
+// TestAutoReconnect checks that a disconnect the server expects to be
+// followed by a reconnect does not end Run when AutoReconnect is set
+func TestAutoReconnect(t *testing.T) {
+	client, server := newMockSession(t)
+	client.option.AutoReconnect = true
+	var infos []DisconnectInfo
+	client.option.OnDisconnect = func(info DisconnectInfo) {
+		infos = append(infos, info)
+	}
+
+	disconnect := func(s *mockServer, errorInfo uint32) {
+		s.WriteDataPdu(&t128.TsSetErrorInfoPDU{ErrorInfo: errorInfo})
+		x224.Write(s.Conn, []byte{0x21, 0x80}) // Disconnect Provider Ultimatum, rn-user-requested
+	}
+	first := server.serve(func() { disconnect(server, t128.ERRINFO_SERVER_DWM_CRASH) })
+
+	var second <-chan error
+	reconnects := 0
+	client.connect = func() error {
+		reconnects++
+		next, server := newMockSession(t)
+		client.stream = next.stream
+		second = server.serve(func() {
+			server.WriteDataPdu(&t128.TsSaveSessionInfoPDU{InfoType: t128.INFOTYPE_LOGON_PLAINNOTIFY, InfoData: make([]byte, 576)})
+			disconnect(server, t128.ERRINFO_LOGOFF_BY_USER)
+		})
+		return nil
+	}
+
+	err := client.Run(nil)
+	assert.NoError(t, <-first)
+	assert.NoError(t, <-second)
+
+	var ultimatum *mcs.DisconnectUltimatumError
+	if assert.ErrorAs(t, err, &ultimatum) {
+		assert.Equal(t, uint8(mcs.RN_USER_REQUESTED), ultimatum.Reason)
+	}
+	assert.Equal(t, 1, reconnects)
+	if assert.Len(t, infos, 2) {
+		assert.Equal(t, uint32(t128.ERRINFO_SERVER_DWM_CRASH), infos[0].ErrorInfo)
+		assert.True(t, infos[0].ReconnectExpected)
+		assert.Equal(t, uint32(t128.ERRINFO_LOGOFF_BY_USER), infos[1].ErrorInfo)
+		assert.False(t, infos[1].ReconnectExpected)
+		assert.Equal(t, err, infos[1].Err)
+	}
+	// the session after the reconnect was read
+	assert.NotNil(t, client.LogonInfo())
+
+	t.Run("Disabled", func(t *testing.T) {
+		client, server := newMockSession(t)
+		client.connect = func() error {
+			t.Error("unexpected reconnect")
+			return nil
+		}
+		done := server.serve(func() { disconnect(server, t128.ERRINFO_SERVER_DWM_CRASH) })
+		assert.Error(t, client.Run(nil))
+		assert.NoError(t, <-done)
+	})
+}
+
+// TestPing checks that the round trip ends with the server's next update
+func TestPing(t *testing.T) {
+	client, server := newMockSession(t)
+	var rtts []time.Duration
+	client.option.OnRoundTrip = func(rtt time.Duration) {
+		rtts = append(rtts, rtt)
+	}
+
+	done := server.serve(func() {
+		refresh := server.ReadDataPdu()
+		if assert.Equal(t, uint8(t128.PDUTYPE2_REFRESH_RECT), refresh.Header.PDUType2) {
+			assert.Equal(t, []t128.TsRectangle16{{}}, refresh.Pdu.(*t128.TsRefreshRectPDU).AreasToRefresh)
+		}
+		time.Sleep(10 * time.Millisecond)
+		server.WriteDataPdu(t128.NewTsSynchronizePduData(mockUserId))
+
+		palette := &t128.TsUpdatePalette{UpdateType: t128.UPDATETYPE_PALETTE, PaletteEntries: []t128.TsPaletteEntry{{Red: 0xFF}}}
+		data := palette.Serialize()
+		update := binary.LittleEndian.AppendUint16([]byte{t128.FASTPATH_UPDATETYPE_PALETTE}, uint16(len(data)))
+		fastpath.Write(server.Conn, append(update, data...))
+	})
+	assert.NoError(t, client.Ping())
+
+	assert.NoError(t, core.Try(func() { client.readPdu() }))
+	assert.Zero(t, client.RoundTripTime(), "only an update answers the ping")
+	assert.NoError(t, core.Try(func() { client.readPdu() }))
+	assert.NoError(t, <-done)
+
+	assert.GreaterOrEqual(t, client.RoundTripTime(), 10*time.Millisecond)
+	assert.Equal(t, []time.Duration{client.RoundTripTime()}, rtts)
+}
+
+// TestStats checks the bytes, frames and uptime Stats reports for what Run
+// read
+func TestStats(t *testing.T) {
+	client, server := newMockSession(t)
+	var frames atomic.Int32
+	client.option.OnFrameDecoded = func() { frames.Add(1) }
+	client.logonMu.Lock()
+	client.connectedAt = time.Now().Add(-time.Minute)
+	client.logonMu.Unlock()
+	client.connected.Store(true)
+	assert.GreaterOrEqual(t, client.Stats().Uptime, time.Minute)
+
+	bitmapUpdate := func(tiles ...[]byte) []byte {
+		update := binary.LittleEndian.AppendUint16(nil, t128.UPDATETYPE_BITMAP)
+		update = binary.LittleEndian.AppendUint16(update, uint16(len(tiles)))
+		for i, tile := range tiles {
+			for _, v := range []uint16{uint16(i * 2), 0, uint16(i*2 + 1), 0, 2, 1, 8,
+				t128.BITMAP_COMPRESSION | t128.NO_BITMAP_COMPRESSION_HDR, uint16(len(tile))} {
+				update = binary.LittleEndian.AppendUint16(update, v)
+			}
+			update = append(update, tile...)
+		}
+		return append(binary.LittleEndian.AppendUint16([]byte{t128.FASTPATH_UPDATETYPE_BITMAP}, uint16(len(update))), update...)
+	}
+	palette := (&t128.TsUpdatePalette{UpdateType: t128.UPDATETYPE_PALETTE, PaletteEntries: []t128.TsPaletteEntry{{}}}).Serialize()
+
+	var sent bytes.Buffer
+	fastpath.Write(&sent, bitmapUpdate([]byte{0x82, 1, 0}, []byte{0x82, 0, 1}))
+	fastpath.Write(&sent, append(binary.LittleEndian.AppendUint16([]byte{t128.FASTPATH_UPDATETYPE_PALETTE}, uint16(len(palette))), palette...))
+	fastpath.Write(&sent, bitmapUpdate([]byte{0x82, 1, 0}))
+	done := server.serve(func() {
+		_, err := server.Conn.Write(sent.Bytes())
+		assert.NoError(t, err)
+		server.ReadFastPathInput()
+		server.Conn.Close()
+	})
+	input := make(chan error)
+	go func() {
+		// sent once Run read the updates, so the server reads it after them
+		for client.Stats().FramesDecoded < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		input <- client.SendMouseMoveEvent(1, 1)
+	}()
+	assert.Error(t, client.Run(nil))
+	assert.NoError(t, <-done)
+	assert.NoError(t, <-input)
+
+	stats := client.Stats()
+	assert.Equal(t, uint64(sent.Len()), stats.BytesReceived)
+	assert.NotZero(t, stats.BytesSent)
+	assert.Equal(t, uint64(2), stats.FramesDecoded)
+	assert.Equal(t, int32(2), frames.Load(), "OnFrameDecoded is called with each frame decoded")
+	assert.Equal(t, 4.5, stats.AverageFrameSize, "the bitmap data of both updates, 6 and 3 bytes")
+	cache := client.GetBitmapCacheStats()
+	if hits, misses := cache["hits"].(int), cache["misses"].(int); hits+misses > 0 {
+		assert.Equal(t, float64(hits)/float64(hits+misses)*100, stats.CacheHitRate)
+	}
+	assert.Zero(t, stats.Uptime, "not connected once Run ended")
+}
+
+// TestFrameAcknowledge checks that frames are acknowledged at their end
+// marker once both sides announced frame acknowledgement
+func TestFrameAcknowledge(t *testing.T) {
+	demand := &t128.TsDemandActivePduData{SharedId: mockShareId}
+	for _, tc := range []struct {
+		frames int
+		want   uint32
+	}{{0, 0}, {5, 5}, {-1, 0}} {
+		client := NewClient(&Option{Addr: "mock:3389", MaxUnacknowledgedFrames: tc.frames})
+		caps := &Capabilities{Sets: client.newConfirmActive(demand).CapabilitySets}
+		ack, _ := caps.Find(capability.CAPSSETTYPE_FRAME_ACKNOWLEDGE).(*capability.TsFrameAcknowledgeCapabilitySet)
+		if tc.want == 0 {
+			assert.Nil(t, ack)
+			assert.Nil(t, caps.Find(capability.CAPSETTYPE_SURFACE_COMMANDS))
+			continue
+		}
+		if assert.NotNil(t, ack) {
+			assert.Equal(t, tc.want, ack.MaxUnacknowledgedFrameCount)
+		}
+		surfCmds := caps.Find(capability.CAPSETTYPE_SURFACE_COMMANDS).(*capability.TsSurfCmdsCapabilitySet)
+		assert.Equal(t, uint32(capability.SURFCMDS_SETSURFACEBITS|capability.SURFCMDS_FRAMEMARKER), surfCmds.CmdFlags)
+	}
+
+	client, server := newMockSession(t)
+	client.frameAck = true
+	done := server.serve(func() {
+		ack := server.ReadDataPdu()
+		if assert.Equal(t, uint8(t128.PDUTYPE2_FRAME_ACKNOWLEDGE), ack.Header.PDUType2) {
+			assert.Equal(t, uint32(9), ack.Pdu.(*t128.TsFrameAcknowledgePDU).FrameId)
+		}
+	})
+	client.processSurfaceCommands(nil, []t128.SurfaceCommand{
+		&t128.TsFrameMarkerCommand{FrameAction: t128.SURFACECMD_FRAMEACTION_BEGIN, FrameId: 9},
+		&t128.TsFrameMarkerCommand{FrameAction: t128.SURFACECMD_FRAMEACTION_END, FrameId: 9},
+	})
+	assert.NoError(t, <-done)
+}
+
+// TestOnRawPDU checks that PDUs are tapped as they are on the wire and
+// dumped as a pcap capture
+func TestOnRawPDU(t *testing.T) {
+	client, server := newMockSession(t)
+	type rawPDU struct {
+		direction string
+		data      []byte
+	}
+	var raw []rawPDU
+	client.option.OnRawPDU = func(direction string, data []byte) {
+		raw = append(raw, rawPDU{direction, slices.Clone(data)})
+	}
+	capture := new(bytes.Buffer)
+	assert.NoError(t, client.DumpPCAP(capture))
+
+	palette := (&t128.TsUpdatePalette{UpdateType: t128.UPDATETYPE_PALETTE}).Serialize()
+	update := binary.LittleEndian.AppendUint16([]byte{t128.FASTPATH_UPDATETYPE_PALETTE}, uint16(len(palette)))
+	done := server.serve(func() {
+		server.ReadDataPdu()
+		server.WriteDataPdu(t128.NewTsSynchronizePduData(mockUserId))
+		fastpath.Write(server.Conn, append(update, palette...))
+	})
+	assert.NoError(t, client.Ping())
+	assert.NoError(t, core.Try(func() { client.readPdu() }))
+	assert.NoError(t, core.Try(func() { client.readPdu() }))
+	assert.NoError(t, <-done)
+
+	require.Len(t, raw, 3)
+	for i, direction := range []string{DirectionOutbound, DirectionInbound, DirectionInbound} {
+		assert.Equal(t, direction, raw[i].direction)
+	}
+	for _, pdu := range raw[:2] {
+		assert.Equal(t, byte(3), pdu.data[0], "tpkt")
+		assert.Equal(t, len(pdu.data), int(binary.BigEndian.Uint16(pdu.data[2:])))
+	}
+	assert.Equal(t, byte(0), raw[2].data[0], "fast-path")
+	assert.True(t, bytes.HasSuffix(raw[2].data, append(update, palette...)))
+
+	data := capture.Bytes()
+	require.Greater(t, len(data), 24)
+	assert.Equal(t, uint32(0xA1B2C3D4), binary.LittleEndian.Uint32(data))
+	assert.Equal(t, uint32(228), binary.LittleEndian.Uint32(data[20:]), "raw IPv4")
+	data = data[24:]
+	for _, pdu := range raw {
+		require.GreaterOrEqual(t, len(data), 16)
+		size := int(binary.LittleEndian.Uint32(data[8:]))
+		packet := data[16 : 16+size]
+		dstPort := binary.BigEndian.Uint16(packet[22:])
+		assert.Equal(t, pdu.direction == DirectionOutbound, dstPort == 3389)
+		assert.Equal(t, pdu.data, packet[40:])
+		data = data[16+size:]
+	}
+	assert.Empty(t, data)
+
+	assert.NoError(t, client.DumpPCAP(nil))
+	assert.Nil(t, client.pcap.Load())
+}
+
+// TestAlternateShell checks the alternate shell and working directory in
+// the client info packet
+func TestAlternateShell(t *testing.T) {
+	client, server := newMockSession(t)
+	client.option.UserName = "user"
+	client.option.AlternateShell = `C:\Windows\notepad.exe`
+	client.option.WorkingDir = `C:\Users\Öffentlich`
+
+	var data []byte
+	done := server.serve(func() { _, data = server.ReadMcsData() })
+	assert.NoError(t, core.Try(client.sendClientInfo))
+	assert.NoError(t, <-done)
+
+	// security header, code page, flags, then the five lengths
+	cb := func(i int) int { return int(binary.LittleEndian.Uint16(data[12+2*i:])) }
+	shell := core.UnicodeEncode(client.option.AlternateShell)
+	dir := core.UnicodeEncode(client.option.WorkingDir)
+	assert.Equal(t, len(shell), cb(3))
+	assert.Equal(t, len(dir), cb(4))
+
+	offset := 22 + cb(0) + 2 + cb(1) + 2 + cb(2) + 2
+	assert.Equal(t, append(shell, 0, 0), data[offset:offset+cb(3)+2])
+	offset += cb(3) + 2
+	assert.Equal(t, append(dir, 0, 0), data[offset:offset+cb(4)+2])
+
+	t.Run("TooLong", func(t *testing.T) {
+		client, _ := newMockSession(t)
+		// 256 characters are 512 bytes before the terminator
+		client.option.WorkingDir = strings.Repeat("x", 256)
+		// nothing reads the pipe, so sending would block the test
+		err := core.Try(client.sendClientInfo)
+		assert.ErrorContains(t, err, "working directory")
+	})
+}
+
+func TestRestrictedAdmin(t *testing.T) {
+	// negotiate answers the connection request with a response of flags
+	// and protocol, returning the request
+	negotiate := func(client *Client, server *mockServer, flags uint8, protocol uint32) (connPdu.Negotiation, error) {
+		var req connPdu.Negotiation
+		done := server.serve(func() {
+			typ, data := x224.ReadConfirm(server.Conn)
+			assert.Equal(t, uint8(x224.TPDU_CONNECTION_REQUEST), typ)
+			core.ReadLE(bytes.NewReader(data[len(data)-8:]), &req)
+			rsp := connPdu.Negotiation{Type: connPdu.TYPE_RDP_NEG_RSP, Flag: flags, Length: 8, Result: protocol}
+			x224.Connect(server.Conn, x224.TPDU_CONNECTION_CONFIRM, core.ToLE(&rsp))
+		})
+		err := core.Try(client.negotiation)
+		assert.NoError(t, <-done)
+		return req, err
+	}
+
+	client, server := newMockSession(t)
+	client.option.RestrictedAdmin = true
+	req, err := negotiate(client, server, 0, connPdu.PROTOCOL_SSL)
+	assert.ErrorIs(t, err, ErrProtocolNegotiation)
+	assert.Equal(t, uint8(connPdu.RESTRICTED_ADMIN_MODE_REQUIRED), req.Flag)
+	assert.Equal(t, uint32(connPdu.PROTOCOL_HYBRID), req.Result, "only NLA is offered")
+
+	client, server = newMockSession(t)
+	client.option.RestrictedAdmin = true
+	_, err = negotiate(client, server, connPdu.EXTENDED_CLIENT_DATA_SUPPORTED, connPdu.PROTOCOL_HYBRID)
+	assert.ErrorIs(t, err, ErrProtocolNegotiation)
+	assert.ErrorContains(t, err, "restricted admin")
+
+	// CredSSP delegates empty credentials
+	client, server = newMockSession(t)
+	client.option.UserName, client.option.Password = "admin", "secret"
+	var creds nla.TSPasswordCreds
+	_, err = asn1.Unmarshal(client.tsCredentials(true).Credentials, &creds)
+	require.NoError(t, err)
+	assert.Equal(t, core.UnicodeEncode("secret"), creds.Password)
+	client.option.RestrictedAdmin = true
+	_, err = asn1.Unmarshal(client.tsCredentials(true).Credentials, &creds)
+	require.NoError(t, err)
+	assert.Empty(t, creds.UserName)
+	assert.Empty(t, creds.Password)
+
+	// and the client info packet no password
+	var data []byte
+	done := server.serve(func() { _, data = server.ReadMcsData() })
+	assert.NoError(t, core.Try(client.sendClientInfo))
+	assert.NoError(t, <-done)
+	cb := func(i int) int { return int(binary.LittleEndian.Uint16(data[12+2*i:])) }
+	assert.Equal(t, len(core.UnicodeEncode("admin")), cb(1))
+	assert.Zero(t, cb(2))
+	assert.NotContains(t, string(data), string(core.UnicodeEncode("secret")))
+}
+
+type recordingProcessor struct {
+	options []*bitmap.Option
+	bitmaps []*bitmap.BitMap
+}
+
+func (p *recordingProcessor) ProcessBitmap(option *bitmap.Option, bmp *bitmap.BitMap) {
+	p.options = append(p.options, option)
+	p.bitmaps = append(p.bitmaps, bmp)
+}
+
+// TestMixedDepthBitmaps checks that one update may mix tiles of different
+// color depths, with only the 8bpp ones using the palette
+func TestMixedDepthBitmaps(t *testing.T) {
+	client, server := newMockSession(t)
+	palette := &t128.TsUpdatePalette{
+		UpdateType:     t128.UPDATETYPE_PALETTE,
+		PaletteEntries: []t128.TsPaletteEntry{{}, {Red: 0x12, Green: 0x34, Blue: 0x56}},
+	}
+
+	// 2x1 tiles, interleaved RLE color images and an RDP 6.0 bitmap with alpha
+	tiles := []struct {
+		bpp  uint16
+		data []byte
+		want [2]color.RGBA
+	}{
+		{8, []byte{0x82, 1, 0}, [2]color.RGBA{{0x12, 0x34, 0x56, 0xFF}, {0, 0, 0, 0xFF}}},
+		{32, []byte{0x20, 0x80, 0xFF, 1, 2, 3, 4, 5, 6}, [2]color.RGBA{{1, 3, 5, 0x80}, {2, 4, 6, 0xFF}}},
+		{16, []byte{0x82, 0x00, 0xF8, 0x01, 0x00}, [2]color.RGBA{{0xF8, 0, 0, 0xFF}, {0, 0, 8, 0xFF}}},
+		{24, []byte{0x82, 0x01, 0x00, 0x00, 0x56, 0x34, 0x12}, [2]color.RGBA{{0, 0, 1, 0xFF}, {0x12, 0x34, 0x56, 0xFF}}},
+		{8, []byte{0x82, 0, 1}, [2]color.RGBA{{0, 0, 0, 0xFF}, {0x12, 0x34, 0x56, 0xFF}}},
+	}
+	update := binary.LittleEndian.AppendUint16(nil, t128.UPDATETYPE_BITMAP)
+	update = binary.LittleEndian.AppendUint16(update, uint16(len(tiles)))
+	for i, tile := range tiles {
+		left := uint16(i * 2)
+		for _, v := range []uint16{left, 0, left + 1, 0, 2, 1, tile.bpp,
+			t128.BITMAP_COMPRESSION | t128.NO_BITMAP_COMPRESSION_HDR, uint16(len(tile.data))} {
+			update = binary.LittleEndian.AppendUint16(update, v)
+		}
+		update = append(update, tile.data...)
+	}
+
+	fastPathUpdate := func(code uint8, data []byte) []byte {
+		return append(binary.LittleEndian.AppendUint16([]byte{code}, uint16(len(data))), data...)
+	}
+	done := server.serve(func() {
+		fastpath.Write(server.Conn, fastPathUpdate(t128.FASTPATH_UPDATETYPE_PALETTE, palette.Serialize()))
+		fastpath.Write(server.Conn, fastPathUpdate(t128.FASTPATH_UPDATETYPE_BITMAP, update))
+		x224.Write(server.Conn, []byte{0x21, 0x80}) // Disconnect Provider Ultimatum ends Run
+	})
+	processor := &recordingProcessor{}
+	assert.Error(t, client.Run(processor))
+	assert.NoError(t, <-done)
+
+	if !assert.Len(t, processor.bitmaps, len(tiles)) {
+		return
+	}
+	for i, tile := range tiles {
+		option := processor.options[i]
+		assert.Equal(t, i*2, option.Left)
+		assert.Equal(t, tile.bpp == 8, option.Palette != nil, "tile %d palette", i)
+		img := processor.bitmaps[i].Image
+		for x, want := range tile.want {
+			assert.Equal(t, want, color.RGBAModel.Convert(img.At(x, 0)), "tile %d (%dbpp) pixel %d", i, tile.bpp, x)
+		}
+	}
+}
+
+func TestUpdates(t *testing.T) {
+	client, server := newMockSession(t)
+
+	// more one-tile updates than the channel holds, so Run has to wait
+	count := updatesBuffer + 16
+	done := server.serve(func() {
+		for i := 0; i < count; i++ {
+			update := binary.LittleEndian.AppendUint16(nil, t128.UPDATETYPE_BITMAP)
+			for _, v := range []uint16{1, uint16(i), 0, uint16(i), 0, 1, 1, 24,
+				t128.BITMAP_COMPRESSION | t128.NO_BITMAP_COMPRESSION_HDR, 4} {
+				update = binary.LittleEndian.AppendUint16(update, v)
+			}
+			update = append(update, 0x81, 0x00, 0x00, 0xFF) // one red pixel
+			fastpath.Write(server.Conn, append(binary.LittleEndian.AppendUint16([]byte{t128.FASTPATH_UPDATETYPE_BITMAP}, uint16(len(update))), update...))
+		}
+		x224.Write(server.Conn, []byte{0x21, 0x80}) // Disconnect Provider Ultimatum ends Run
+	})
+
+	updates := client.Updates()
+	runErr := make(chan error, 1)
+	go func() { runErr <- client.Run(nil) }()
+	var lefts []int
+	for update := range updates {
+		lefts = append(lefts, update.Option.Left)
+		assert.Equal(t, color.RGBA{0xFF, 0, 0, 0xFF}, color.RGBAModel.Convert(update.Bitmap.Image.At(0, 0)))
+	}
+	assert.Error(t, <-runErr)
+	assert.NoError(t, <-done)
+	if assert.Len(t, lefts, count) {
+		for i, left := range lefts {
+			assert.Equal(t, i, left)
+		}
+	}
+}
+
+// TestKeepAlive checks that Run gives up on a server that stops answering
+func TestKeepAlive(t *testing.T) {
+	client, server := newMockSession(t)
+	interval := 20 * time.Millisecond
+	client.option.KeepAliveInterval = interval
+
+	var answered time.Time
+	pings := 0
+	done := server.serve(func() {
+		// answer the first ping, then keep reading without answering
+		refresh := server.ReadDataPdu()
+		assert.Equal(t, uint8(t128.PDUTYPE2_REFRESH_RECT), refresh.Header.PDUType2)
+		pings++
+		palette := (&t128.TsUpdatePalette{UpdateType: t128.UPDATETYPE_PALETTE, PaletteEntries: []t128.TsPaletteEntry{{}}}).Serialize()
+		fastpath.Write(server.Conn, append(binary.LittleEndian.AppendUint16([]byte{t128.FASTPATH_UPDATETYPE_PALETTE}, uint16(len(palette))), palette...))
+		answered = time.Now()
+		for {
+			server.ReadDataPdu()
+			pings++
+		}
+	})
+
+	err := client.Run(nil)
+	assert.ErrorIs(t, err, ErrConnectionLost)
+	assert.Error(t, <-done, "the client closes the connection")
+	assert.GreaterOrEqual(t, time.Since(answered), keepAliveMisses*interval)
+	assert.GreaterOrEqual(t, pings, 2)
+	assert.NotZero(t, client.RoundTripTime())
+}
+
+// timeoutError is a transient net.Error
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// flakyConn fails the given number of reads with a timeout before reading
+type flakyConn struct {
+	net.Conn
+	drops int
+}
+
+func (c *flakyConn) Read(b []byte) (int, error) {
+	if c.drops > 0 {
+		c.drops--
+		return 0, timeoutError{}
+	}
+	return c.Conn.Read(b)
+}
+
+func TestHandshakeReadRetry(t *testing.T) {
+	negotiate := func(t *testing.T, retry *core.ReadRetry) (*Client, error) {
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() {
+			_ = clientConn.Close()
+			_ = serverConn.Close()
+		})
+		c := NewClient(&Option{Addr: "mock:3389", HandshakeReadRetry: retry})
+		c.stream = core.NewStreamFromConn(&flakyConn{Conn: clientConn, drops: 1})
+		c.stream.SetReadRetry(context.Background(), c.option.HandshakeReadRetry)
+
+		go func() {
+			_ = core.Try(func() {
+				typ, _ := x224.ReadConfirm(serverConn)
+				assert.Equal(t, uint8(x224.TPDU_CONNECTION_REQUEST), typ)
+				nego := []byte{connPdu.TYPE_RDP_NEG_RSP, 0, 8, 0}
+				nego = binary.LittleEndian.AppendUint32(nego, connPdu.PROTOCOL_RDP)
+				x224.Connect(serverConn, x224.TPDU_CONNECTION_CONFIRM, nego)
+			})
+		}()
+		return c, core.Try(c.negotiation)
+	}
+
+	c, err := negotiate(t, &core.ReadRetry{Attempts: 2, Backoff: time.Millisecond})
+	assert.NoError(t, err)
+	assert.Equal(t, connPdu.PROTOCOL_RDP, c.selectProtocol)
+
+	t.Run("NoRetry", func(t *testing.T) {
+		_, err := negotiate(t, nil)
+		assert.True(t, core.IsTimeout(err))
+	})
+}
+
+// TestReadRetryDeadline checks that a read retried after a real timeout
+// gets a new deadline rather than failing on the one that passed
+func TestReadRetryDeadline(t *testing.T) {
+	read := func(t *testing.T, ctx context.Context, retry *core.ReadRetry, after time.Duration) error {
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() {
+			_ = clientConn.Close()
+			_ = serverConn.Close()
+		})
+		stream := core.NewStreamFromConn(clientConn)
+		stream.SetReadRetry(ctx, retry)
+		require.NoError(t, stream.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+		go func() {
+			time.Sleep(after)
+			_, _ = serverConn.Write([]byte{1})
+		}()
+		_, err := stream.Read(make([]byte, 1))
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, read(t, ctx, &core.ReadRetry{Attempts: 1}, 50*time.Millisecond), "bounded by the context")
+	assert.NoError(t, read(t, context.Background(), &core.ReadRetry{Attempts: 3, Timeout: 30 * time.Millisecond}, 50*time.Millisecond))
+
+	start := time.Now()
+	err := read(t, context.Background(), &core.ReadRetry{Attempts: 2, Timeout: 20 * time.Millisecond}, time.Second)
+	assert.True(t, core.IsTimeout(err))
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "each retry is bounded by Timeout")
+
+	short, cancel := context.WithTimeout(context.Background(), 40*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	err = read(t, short, &core.ReadRetry{Attempts: 5}, time.Second)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "the retries end with the context")
+}
+
+// TestConnectErrors checks that connection failures can be told apart
+// with errors.Is
+func TestConnectErrors(t *testing.T) {
+	t.Run("ProtocolNegotiation", func(t *testing.T) {
+		client, server := newMockSession(t)
+		done := server.serve(func() {
+			x224.ReadConfirm(server.Conn)
+			failure := []byte{connPdu.TYPE_RDP_NEG_FAILURE, 0, 8, 0}
+			failure = binary.LittleEndian.AppendUint32(failure, connPdu.HYBRID_REQUIRED_BY_SERVER)
+			x224.Connect(server.Conn, x224.TPDU_CONNECTION_CONFIRM, failure)
+		})
+		err := client.connectError(core.Try(client.negotiation))
+		assert.ErrorIs(t, err, ErrProtocolNegotiation)
+		assert.ErrorContains(t, err, "negotiation failure: 0x5")
+		assert.NotErrorIs(t, err, ErrAuthFailed)
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("Licensing", func(t *testing.T) {
+		client, server := newMockSession(t)
+		done := server.serve(func() {
+			alert := binary.LittleEndian.AppendUint16(nil, sec.SEC_LICENSE_PKT)
+			alert = append(alert, 0, 0, licPdu.ERROR_ALERT, 0x03, 16, 0)
+			alert = binary.LittleEndian.AppendUint32(alert, licPdu.ERR_INVALID_CLIENT)
+			alert = binary.LittleEndian.AppendUint32(alert, licPdu.ST_TOTAL_ABORT)
+			server.WriteMcsData(mcs.MCS_CHANNEL_GLOBAL, alert)
+		})
+		err := client.connectError(core.Try(func() { connectStep(ErrLicensing, client.readLicensing) }))
+		assert.ErrorIs(t, err, ErrLicensing)
+		assert.ErrorContains(t, err, "license error 0x8")
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		client := NewClient(&Option{Addr: "mock:3389"})
+		err := client.connectError(core.Try(func() { core.ThrowError(timeoutError{}) }))
+		assert.ErrorIs(t, err, ErrConnectionTimeout)
+	})
+
+	t.Run("ServerDisconnect", func(t *testing.T) {
+		client, server := newMockSession(t)
+		done := server.serve(func() {
+			server.WriteDataPdu(&t128.TsSetErrorInfoPDU{ErrorInfo: t128.ERRINFO_IDLE_TIMEOUT})
+			x224.Write(server.Conn, []byte{0x21, 0x80}) // Disconnect Provider Ultimatum
+		})
+		err := client.Run(nil)
+		assert.NoError(t, <-done)
+		assert.ErrorIs(t, err, &ErrServerDisconnect{})
+		assert.ErrorIs(t, err, &ErrServerDisconnect{Code: t128.ERRINFO_IDLE_TIMEOUT})
+		assert.NotErrorIs(t, err, &ErrServerDisconnect{Code: t128.ERRINFO_LOGOFF_BY_USER})
+		var disconnect *ErrServerDisconnect
+		if assert.ErrorAs(t, err, &disconnect) {
+			assert.Equal(t, "the idle session limit was reached", disconnect.Reason)
+		}
+		var ultimatum *mcs.DisconnectUltimatumError
+		assert.ErrorAs(t, err, &ultimatum)
+	})
+
+	t.Run("ServerRedirect", func(t *testing.T) {
+		client, server := newMockSession(t)
+		done := server.serve(func() {
+			header := t128.TsShareControlHeader{PDUType: t128.PDUTYPE_SERVER_REDIR_PKT, PDUSource: mockServerChannel, TotalLength: 6}
+			server.WriteMcsData(mcs.MCS_CHANNEL_GLOBAL, header.Serialize())
+		})
+		assert.ErrorIs(t, client.Run(nil), ErrServerRedirect)
+		assert.NoError(t, <-done)
+	})
+}
+
+// TestDisconnectReason checks that the reason the server gives for ending
+// the session is reported as it arrives and with the disconnect
+func TestDisconnectReason(t *testing.T) {
+	client, server := newMockSession(t)
+	type reason struct {
+		code   uint32
+		reason string
+	}
+	var reasons []reason
+	client.option.OnDisconnectReason = func(code uint32, text string) {
+		reasons = append(reasons, reason{code, text})
+	}
+	var info DisconnectInfo
+	client.option.OnDisconnect = func(i DisconnectInfo) { info = i }
+
+	done := server.serve(func() {
+		server.WriteDataPdu(&t128.TsSetErrorInfoPDU{ErrorInfo: t128.ERRINFO_NONE})
+		server.WriteDataPdu(&t128.TsSetErrorInfoPDU{ErrorInfo: t128.ERRINFO_LICENSE_NO_LICENSE})
+		x224.Write(server.Conn, []byte{0x21, 0x80}) // Disconnect Provider Ultimatum
+	})
+	err := client.Run(nil)
+	assert.NoError(t, <-done)
+
+	want := "no client access licenses are available"
+	assert.Equal(t, []reason{{t128.ERRINFO_LICENSE_NO_LICENSE, want}}, reasons)
+	assert.ErrorContains(t, err, want)
+	assert.Equal(t, uint32(t128.ERRINFO_LICENSE_NO_LICENSE), info.ErrorInfo)
+	assert.Equal(t, want, info.Reason)
+
+	assert.Contains(t, (&t128.TsSetErrorInfoPDU{ErrorInfo: 0x10F0}).Reason(), "protocol error 0x10f0")
+	assert.Equal(t, "unknown error info 0x999", (&t128.TsSetErrorInfoPDU{ErrorInfo: 0x999}).Reason())
+}
+
+// TestToggleKeys checks that the lock keys are synchronized and tracked
+func TestToggleKeys(t *testing.T) {
+	initial := ToggleKeys{NumLock: true}
+	assert.Equal(t, initial, NewClient(&Option{ToggleKeys: initial}).ToggleKeys())
+
+	client, server := newMockSession(t)
+	client.toggleKeys = initial
+
+	var got [][]byte
+	done := server.serve(func() {
+		for i := 0; i < 5; i++ {
+			_, data := server.ReadFastPathInput()
+			got = append(got, data)
+		}
+	})
+	// as sent at session start
+	assert.NoError(t, client.syncToggleKeys(client.toggleKeys))
+	assert.NoError(t, client.SendKeyDown(t128.VK_CAPITAL, t128.ModifierKey{}))
+	assert.NoError(t, client.SendKeyDown(t128.VK_CAPITAL, t128.ModifierKey{}), "auto-repeat")
+	assert.Equal(t, ToggleKeys{CapsLock: true, NumLock: true}, client.ToggleKeys())
+	assert.NoError(t, client.SendKeyEvent(t128.VK_CAPITAL, true, t128.ModifierKey{}))
+	assert.Equal(t, ToggleKeys{NumLock: true}, client.ToggleKeys())
+
+	assert.NoError(t, client.SyncToggleKeys(false, false, true))
+	assert.NoError(t, <-done)
+	assert.Equal(t, ToggleKeys{ScrollLock: true}, client.ToggleKeys())
+	assert.Empty(t, client.pressedKeys, "the server releases all keys on sync")
+
+	sync := byte(t128.FASTPATH_INPUT_EVENT_SYNC << 5)
+	if assert.Len(t, got, 5) {
+		assert.Equal(t, []byte{sync | t128.FASTPATH_INPUT_SYNC_NUM_LOCK}, got[0])
+		// presses of the CapsLock scancode, eventFlags 0
+		for _, press := range got[1:4] {
+			assert.Equal(t, []byte{0x00, 0x3A}, press)
+		}
+		assert.Equal(t, []byte{sync | t128.FASTPATH_INPUT_SYNC_SCROLL_LOCK}, got[4])
+	}
+}
+
+// TestKeyboardIndicators checks that the lock keys the server reports reach
+// the callback and ToggleKeys, also during connection finalization
+func TestKeyboardIndicators(t *testing.T) {
+	client, server := newMockSession(t)
+	var got []ToggleKeys
+	client.OnKeyboardIndicators(func(caps, num, scroll bool) {
+		got = append(got, ToggleKeys{CapsLock: caps, NumLock: num, ScrollLock: scroll})
+	})
+
+	done := server.serve(func() {
+		for i := 0; i < 4; i++ {
+			server.ReadDataPdu()
+		}
+		server.WriteDataPdu(t128.NewTsSynchronizePduData(mockUserId))
+		server.WriteDataPdu(&t128.TsSetKeyboardIndicatorsPDU{LedFlags: t128.TS_SYNC_NUM_LOCK})
+		server.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_COOPERATE})
+		server.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_GRANTED_CONTROL, GrantId: mockUserId, ControlId: mockServerChannel})
+		server.WriteDataPdu(&t128.TsFontMapPDU{MapFlags: 0x0003, EntrySize: 0x0004})
+	})
+	assert.NoError(t, core.Try(client.sendClientFinalization))
+	assert.NoError(t, <-done)
+	assert.Equal(t, ToggleKeys{NumLock: true}, client.ToggleKeys())
+
+	done = server.serve(func() {
+		server.WriteDataPdu(&t128.TsSetKeyboardIndicatorsPDU{
+			LedFlags: t128.TS_SYNC_CAPS_LOCK | t128.TS_SYNC_SCROLL_LOCK | t128.TS_SYNC_KANA_LOCK,
+		})
+		server.Conn.Close()
+	})
+	assert.Error(t, client.Run(nil))
+	assert.NoError(t, <-done)
+	assert.Equal(t, []ToggleKeys{{NumLock: true}, {CapsLock: true, ScrollLock: true}}, got)
+	assert.Equal(t, ToggleKeys{CapsLock: true, ScrollLock: true}, client.ToggleKeys())
+}
+
+// TestOnBeep checks that beeps of the server reach the callback
+func TestOnBeep(t *testing.T) {
+	client, server := newMockSession(t)
+	type beep struct{ frequency, duration uint32 }
+	var got []beep
+	client.OnBeep(func(frequency, durationMs uint32) {
+		got = append(got, beep{frequency, durationMs})
+	})
+
+	done := server.serve(func() {
+		server.WriteDataPdu(&t128.TsPlaySoundPDU{Duration: 200, Frequency: 800})
+		server.WriteDataPdu(&t128.TsPlaySoundPDU{Duration: 50, Frequency: 440})
+		server.Conn.Close()
+	})
+	assert.Error(t, client.Run(nil))
+	assert.NoError(t, <-done)
+	assert.Equal(t, []beep{{800, 200}, {440, 50}}, got)
+}
+
+// TestConcurrentInput sends input from several goroutines while Run reads
+// keyboard indicators that change the same state, and checks that the
+// events of each call reach the server in one piece
+func TestConcurrentInput(t *testing.T) {
+	client, server := newMockSession(t)
+	const presses = 20
+	keys := []uint8{t128.VK_A, t128.VK_B, t128.VK_C}
+	event := func(vk uint8, down bool) string {
+		e, _ := t128.NewFastPathVirtualKeyEvent(vk, down)
+		return string(e.Serialize())
+	}
+
+	var received []string
+	read := server.serve(func() {
+		for i := 0; i < len(keys)*presses*4+presses; i++ {
+			_, data := server.ReadFastPathInput()
+			received = append(received, string(data))
+		}
+	})
+	written := server.serve(func() {
+		for i := 0; i < presses; i++ {
+			server.WriteDataPdu(&t128.TsSetKeyboardIndicatorsPDU{LedFlags: uint16(i % 2 * t128.TS_SYNC_CAPS_LOCK)})
+		}
+	})
+	ran := make(chan error, 1)
+	go func() { ran <- client.Run(nil) }()
+
+	var wg sync.WaitGroup
+	for _, vk := range keys {
+		vk := vk
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < presses; i++ {
+				assert.NoError(t, client.SendKeyPress(vk, t128.ModifierKey{Shift: true}))
+				client.ToggleKeys()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < presses; i++ {
+			assert.NoError(t, client.SendMouseRelative(1, 1))
+		}
+	}()
+	wg.Wait()
+	assert.NoError(t, <-read)
+	assert.NoError(t, <-written)
+	server.Conn.Close()
+	assert.Error(t, <-ran)
+
+	var keyEvents []string
+	for _, e := range received {
+		if len(e) == len(event(t128.VK_SHIFT, true)) { // not a pointer move
+			keyEvents = append(keyEvents, e)
+		}
+	}
+	require.Len(t, keyEvents, len(keys)*presses*4)
+	for i := 0; i < len(keyEvents); i += 4 {
+		press := keyEvents[i : i+4]
+		vk := slices.IndexFunc(keys, func(vk uint8) bool { return press[1] == event(vk, true) })
+		if assert.GreaterOrEqual(t, vk, 0, "press %d", i/4) {
+			assert.Equal(t, []string{event(t128.VK_SHIFT, true), event(keys[vk], true), event(keys[vk], false), event(t128.VK_SHIFT, false)}, press)
+		}
+	}
+	assert.Equal(t, ModifierState{}, client.SaveModifierState())
+}
+
+// TestInputFlushInterval checks that held back input goes out in one PDU,
+// with pointer moves merged, on FlushInput or when the interval ends
+func TestInputFlushInterval(t *testing.T) {
+	client, server := newMockSession(t)
+	client.option.InputFlushInterval = time.Hour
+
+	move := func(x, y uint16) []byte {
+		return t128.NewFastPathPointerEvent(t128.PTRFLAGS_MOVE, x, y).Serialize()
+	}
+	click := t128.NewFastPathPointerEvent(t128.PTRFLAGS_DOWN|t128.PTRFLAGS_BUTTON1, 3, 3).Serialize()
+
+	type input struct {
+		header t128.FpInputHeader
+		data   []byte
+	}
+	read := func(n int) <-chan error {
+		return server.serve(func() {
+			var got []input
+			for i := 0; i < n; i++ {
+				header, data := server.ReadFastPathInput()
+				got = append(got, input{header, data})
+			}
+			switch n {
+			case 1:
+				assert.Equal(t, uint8(3), got[0].header.NumEvents)
+				assert.Equal(t, bytes.Join([][]byte{move(2, 2), click, move(5, 5)}, nil), got[0].data)
+			case 2:
+				assert.Equal(t, uint8(15), got[0].header.NumEvents)
+				assert.Equal(t, uint8(5), got[1].header.NumEvents)
+			}
+		})
+	}
+
+	done := read(1)
+	for i := uint16(0); i < 3; i++ {
+		assert.NoError(t, client.SendMouseMoveEvent(i, i))
+	}
+	assert.NoError(t, client.SendMouseLeftDownEvent(3, 3))
+	assert.NoError(t, client.SendMouseMoveEvent(4, 4))
+	assert.NoError(t, client.SendMouseMoveEvent(5, 5))
+	assert.NoError(t, client.FlushInput())
+	assert.NoError(t, <-done)
+	assert.NoError(t, client.FlushInput(), "nothing left to send")
+
+	// more events than a PDU holds
+	done = read(2)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, client.SendKeyPress(t128.VK_A, t128.ModifierKey{}))
+	}
+	assert.NoError(t, client.FlushInput())
+	assert.NoError(t, <-done)
+
+	client.option.InputFlushInterval = 10 * time.Millisecond
+	done = server.serve(func() {
+		header, data := server.ReadFastPathInput()
+		assert.Equal(t, uint8(1), header.NumEvents)
+		assert.Equal(t, move(7, 7), data)
+	})
+	assert.NoError(t, client.SendMouseMoveEvent(6, 6))
+	assert.NoError(t, client.SendMouseMoveEvent(7, 7))
+	assert.NoError(t, <-done)
+
+	// Close sends what is still held back
+	client.option.InputFlushInterval = time.Hour
+	done = server.serve(func() {
+		_, data := server.ReadFastPathInput()
+		assert.Equal(t, move(8, 8), data)
+	})
+	assert.NoError(t, client.SendMouseMoveEvent(8, 8))
+	client.Close()
+	assert.NoError(t, <-done)
+	client.inputMu.Lock()
+	assert.Nil(t, client.inputTimer, "the flush timer is stopped")
+	client.inputMu.Unlock()
+}
+
+// TestPasteText checks that pasted text goes out as Unicode events, batched
+// unless a delay is asked for
+func TestPasteText(t *testing.T) {
+	client, server := newMockSession(t)
+	client.option.InputFlushInterval = time.Hour
+
+	done := server.serve(func() {
+		header, _ := server.ReadFastPathInput()
+		assert.Equal(t, uint8(1), header.NumEvents, "queued input goes first")
+		header, data := server.ReadFastPathInput()
+		assert.Equal(t, uint8(12), header.NumEvents)
+		assert.Equal(t, []byte{
+			0x80, 0xE9, 0x00, 0x81, 0xE9, 0x00, // é
+			0x80, 0x3D, 0xD8, 0x81, 0x3D, 0xD8, 0x80, 0x00, 0xDE, 0x81, 0x00, 0xDE, // 😀 as a surrogate pair
+			0x00, 0x1C, 0x01, 0x1C, // Enter
+			0x80, 0x62, 0x00, 0x81, 0x62, 0x00, // b
+			0x00, 0x0F, 0x01, 0x0F, // Tab
+		}, data)
+	})
+	assert.NoError(t, client.SendMouseMoveEvent(1, 1))
+	assert.NoError(t, client.PasteText("é😀\r\nb\t", PasteOptions{}))
+	assert.NoError(t, <-done)
+
+	const delay = 20 * time.Millisecond
+	var times []time.Time
+	done = server.serve(func() {
+		for i := 0; i < 3; i++ {
+			header, data := server.ReadFastPathInput()
+			times = append(times, time.Now())
+			assert.Equal(t, uint8(2), header.NumEvents)
+			assert.Equal(t, []byte{0x80, "xyz"[i], 0x00, 0x81, "xyz"[i], 0x00}, data)
+		}
+	})
+	assert.NoError(t, client.PasteText("xyz", PasteOptions{Delay: delay}))
+	assert.NoError(t, <-done)
+	assert.GreaterOrEqual(t, times[2].Sub(times[0]), 2*delay)
+
+	// closing the client stops a slow paste
+	done = server.serve(func() {
+		server.ReadFastPathInput()
+		client.cancel()
+	})
+	assert.ErrorIs(t, client.PasteText("xyz", PasteOptions{Delay: time.Hour}), context.Canceled)
+	assert.NoError(t, <-done)
+}
+
+// TestRelativeMouseMode checks that relative pointer events are offered and
+// sent only when the server takes them, and emulated otherwise
+func TestRelativeMouseMode(t *testing.T) {
+	client, server := newMockSession(t)
+	demand := &t128.TsDemandActivePduData{SharedId: mockShareId}
+	input := (&Capabilities{Sets: client.newConfirmActive(demand).CapabilitySets}).Find(capability.CAPSTYPE_INPUT)
+	assert.Zero(t, input.(*capability.TsInputCapabilitySet).Flags&capability.INPUT_FLAG_MOUSE_RELATIVE)
+
+	assert.ErrorIs(t, client.SetRelativeMouseMode(true), ErrRelativeMouseUnsupported)
+	assert.False(t, client.RelativeMouseMode())
+
+	var got [][]byte
+	done := server.serve(func() {
+		for i := 0; i < 4; i++ {
+			_, data := server.ReadFastPathInput()
+			got = append(got, data)
+		}
+	})
+	client.desktopWidth, client.desktopHeight = 100, 50
+	assert.NoError(t, client.SendMouseMoveEvent(90, 40))
+	assert.NoError(t, client.SendMouseRelative(20, -5), "stops at the edge")
+	assert.NoError(t, client.SendMouseMoveRelative(-200, 3))
+
+	serverInput := capability.NewTsInputCapabilitySet()
+	serverInput.Flags |= capability.INPUT_FLAG_MOUSE_RELATIVE
+	demand.CapabilitySets = []capability.TsCapsSet{serverInput}
+	confirm := client.newConfirmActive(demand)
+	client.relativeMouse = relativeMouse(demand.CapabilitySets) && relativeMouse(confirm.CapabilitySets)
+	assert.True(t, client.relativeMouse)
+	assert.NoError(t, client.SetRelativeMouseMode(true))
+	assert.True(t, client.RelativeMouseMode())
+	assert.NoError(t, client.SendMouseRelative(-3, 4))
+	assert.NoError(t, <-done)
+
+	move := func(x, y uint16) []byte {
+		return t128.NewFastPathPointerEvent(t128.PTRFLAGS_MOVE, x, y).Serialize()
+	}
+	assert.Equal(t, [][]byte{
+		move(90, 40), move(99, 35), move(0, 38),
+		{t128.FASTPATH_INPUT_EVENT_RELMOUSE << 5, 0x00, 0x08, 0xFD, 0xFF, 0x04, 0x00},
+	}, got)
+
+	// queued relative moves add up
+	client.option.InputFlushInterval = time.Hour
+	done = server.serve(func() {
+		header, data := server.ReadFastPathInput()
+		assert.Equal(t, uint8(1), header.NumEvents)
+		assert.Equal(t, t128.NewFastPathRelPointerEvent(t128.PTRFLAGS_MOVE, 30000, -2).Serialize(), data)
+	})
+	assert.NoError(t, client.SendMouseRelative(20000, -1))
+	assert.NoError(t, client.SendMouseRelative(10000, -1))
+	assert.NoError(t, client.FlushInput())
+	assert.NoError(t, <-done)
+}
+
+// TestReadTimeout checks that a server that stops sending does not block
+// the session loop forever
+func TestReadTimeout(t *testing.T) {
+	client, _ := newMockSession(t)
+	client.option.ReadTimeout = 20 * time.Millisecond
+	start := time.Now()
+	err := client.Run(nil)
+	assert.True(t, core.IsTimeout(err), "got %v", err)
+	assert.Less(t, time.Since(start), time.Second)
+
+	t.Run("Cancel", func(t *testing.T) {
+		client, server := newMockSession(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		err := client.RunWithContext(ctx, nil)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		// the connection is still usable
+		done := server.serve(func() { server.WriteDataPdu(t128.NewTsSynchronizePduData(mockUserId)) })
+		assert.NoError(t, core.Try(func() { client.readPdu() }))
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("ClientCancel", func(t *testing.T) {
+		// Cancel stops RunWithContext too, though its context lives on
+		client, _ := newMockSession(t)
+		client.option.ReadTimeout = time.Hour
+		time.AfterFunc(20*time.Millisecond, client.Cancel)
+		start := time.Now()
+		err := client.RunWithContext(context.Background(), nil)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("CancelBeforeDeadline", func(t *testing.T) {
+		// a cancel is not undone by the deadline of the next read
+		client, _ := newMockSession(t)
+		client.option.ReadTimeout = time.Hour
+		ctx, stop := client.interruptReads(client.ctx)
+		defer stop()
+		client.Cancel()
+		<-ctx.Done()
+		start := time.Now()
+		err := core.Try(func() { client.readPdu() })
+		assert.True(t, core.IsTimeout(err), "got %v", err)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("Connect", func(t *testing.T) {
+		// a server that never answers the connection request
+		local, remote := net.Pipe()
+		defer remote.Close()
+		go func() { _, _ = io.Copy(io.Discard, remote) }()
+		client := NewClientWithConn(local, &Option{Addr: "mock:3389"})
+		time.AfterFunc(20*time.Millisecond, client.Cancel)
+		start := time.Now()
+		err := client.Connect()
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.NotErrorIs(t, err, ErrConnectionTimeout)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+}
+
+// TestSendMouseMoveOnMonitor checks that monitor-local points are sent in
+// virtual desktop coordinates
+func TestSendMouseMoveOnMonitor(t *testing.T) {
+	client, server := newMockSession(t)
+	// the second monitor is left of the primary one, so the virtual
+	// desktop starts at its corner
+	assert.NoError(t, client.SetMonitors([]mcs.MonitorLayout{
+		{Left: 0, Top: 0, Right: 1919, Bottom: 1079, Flags: 0x01},
+		{Left: -1280, Top: 56, Right: -1, Bottom: 1079},
+	}))
+
+	var got [][]byte
+	done := server.serve(func() {
+		for i := 0; i < 2; i++ {
+			_, data := server.ReadFastPathInput()
+			got = append(got, data)
+		}
+	})
+	assert.NoError(t, client.SendMouseMoveOnMonitor(1, 100, 50))
+	assert.NoError(t, client.SendMouseMoveOnMonitor(0, 10, 20))
+	assert.NoError(t, <-done)
+
+	move := func(x, y uint16) []byte {
+		data := []byte{t128.FASTPATH_INPUT_EVENT_MOUSE << 5}
+		data = binary.LittleEndian.AppendUint16(data, t128.PTRFLAGS_MOVE)
+		data = binary.LittleEndian.AppendUint16(data, x)
+		return binary.LittleEndian.AppendUint16(data, y)
+	}
+	assert.Equal(t, [][]byte{move(100, 106), move(1290, 20)}, got)
+
+	assert.Error(t, client.SendMouseMoveOnMonitor(2, 0, 0))
+	assert.Error(t, client.SendMouseMoveOnMonitor(1, 1280, 0))
+}
+
+// testVCHandler collects the messages of a static channel
+type testVCHandler struct {
+	messages [][]byte
+}
+
+func (h *testVCHandler) HandleData(channelID uint16, data []byte) error {
+	h.messages = append(h.messages, data)
+	return nil
+}
+
+func (h *testVCHandler) OnChannelOpen(channelID uint16, channelName string) error {
+	return nil
+}
+
+func (h *testVCHandler) OnChannelClose(channelID uint16) error {
+	return nil
+}
+
+// TestRegisterStaticChannel checks that a registered channel is offered to
+// the server and gets the data sent on the channel id the server gave it
+func TestRegisterStaticChannel(t *testing.T) {
+	client := NewClient(&Option{Addr: "mock:3389"})
+	handler := &testVCHandler{}
+	assert.NoError(t, client.RegisterStaticChannel("LOBDATA", handler))
+	assert.Error(t, client.RegisterStaticChannel("lobdata", handler))
+	assert.Error(t, client.RegisterStaticChannel("CLIPRDR", handler))
+	assert.Error(t, client.RegisterStaticChannel("TOOLONGNAME", handler))
+	assert.Error(t, client.RegisterStaticChannel("NOHANDL", nil))
+
+	// offered after the default channels
+	network := client.newConnectInitial().ClientNetworkData
+	assert.Equal(t, uint32(5), network.ChannelCount)
+	assert.Equal(t, "LOBDATA\x00", string(network.ChannelDefArray[4].Name[:]))
+	assert.Equal(t, []byte{
+		0x03, 0xC0, 0x44, 0x00, 0x05, 0x00, 0x00, 0x00,
+		'c', 'l', 'i', 'p', 'r', 'd', 'r', 0x00, 0x00, 0x00, 0x00, 0x80,
+		'r', 'd', 'p', 's', 'n', 'd', 0x00, 0x00, 0x00, 0x00, 0x00, 0x80,
+		'd', 'r', 'd', 'y', 'n', 'v', 'c', 0x00, 0x00, 0x00, 0x00, 0x80,
+		'r', 'd', 'p', 'd', 'r', 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80,
+		'L', 'O', 'B', 'D', 'A', 'T', 'A', 0x00, 0x00, 0x00, 0x00, 0x80,
+	}, network.Serialize())
+
+	server := newMockServer(t, client)
+	assert.Error(t, client.RegisterStaticChannel("LATER", handler))
+	id := staticChannelId(client, "LOBDATA")
+	assert.Equal(t, uint16(mockFirstChannel+4), id)
+
+	message := []byte("hello from the server")
+	done := server.serve(func() {
+		// CHANNEL_PDU_HEADER, then the chunk
+		first := binary.LittleEndian.AppendUint32(nil, uint32(len(message)))
+		first = binary.LittleEndian.AppendUint32(first, virtualchannel.CHANNEL_FLAG_FIRST)
+		server.WriteMcsData(id, append(first, message[:5]...))
+		last := binary.LittleEndian.AppendUint32(nil, uint32(len(message)))
+		last = binary.LittleEndian.AppendUint32(last, virtualchannel.CHANNEL_FLAG_LAST)
+		server.WriteMcsData(id, append(last, message[5:]...))
+	})
+	for i := 0; i < 2; i++ {
+		var pdu t128.PDU
+		assert.NoError(t, core.Try(func() { pdu = client.readPdu() }))
+		assert.Nil(t, pdu)
+	}
+	assert.NoError(t, <-done)
+	assert.Equal(t, [][]byte{message}, handler.messages)
+
+	// sent with an 8 byte CHANNEL_PDU_HEADER, no channel id in it
+	var channelId uint16
+	var data []byte
+	done = server.serve(func() { channelId, data = server.ReadMcsData() })
+	assert.NoError(t, client.SendVirtualChannelData("LOBDATA", []byte("reply"), 0))
+	assert.NoError(t, <-done)
+	assert.Equal(t, id, channelId)
+	header := binary.LittleEndian.AppendUint32(nil, 5)
+	header = binary.LittleEndian.AppendUint32(header, virtualchannel.CHANNEL_FLAG_FIRST|virtualchannel.CHANNEL_FLAG_LAST)
+	assert.Equal(t, append(header, "reply"...), data)
+
+	stats := client.ChannelStats()["LOBDATA"]
+	assert.False(t, stats.Dynamic)
+	assert.Equal(t, uint64(len(message)), stats.BytesReceived)
+	assert.Equal(t, uint64(1), stats.MessagesReceived)
+	assert.Zero(t, stats.Errors)
+	assert.False(t, stats.LastActivity.IsZero())
+}
+
+// railRecorder records what a RailHandler is told
+type railRecorder struct {
+	events []string
+	icons  []*rail.Icon
+}
+
+func (r *railRecorder) OnExecResult(result *rail.ExecResult) {
+	r.events = append(r.events, "exec "+result.String())
+}
+
+func (r *railRecorder) OnWindowCreated(order *rail.WindowOrder) {
+	r.events = append(r.events, "created "+order.Title)
+}
+
+func (r *railRecorder) OnWindowUpdated(order *rail.WindowOrder) {
+	r.events = append(r.events, fmt.Sprintf("updated %v", order.Bounds()))
+}
+
+func (r *railRecorder) OnWindowDeleted(windowId uint32) {
+	r.events = append(r.events, fmt.Sprintf("deleted %#x", windowId))
+}
+
+func (r *railRecorder) OnWindowIcon(windowId uint32, icon *rail.Icon) {
+	r.events = append(r.events, fmt.Sprintf("icon %#x", windowId))
+	r.icons = append(r.icons, icon)
+}
+
+// TestRemoteApp checks that a RemoteApp session offers the rail channel and
+// the window list capability, and reports the windows of the server
+func TestRemoteApp(t *testing.T) {
+	client := NewClient(&Option{Addr: "mock:3389", RemoteApp: &RemoteApp{Program: "||notepad"}})
+	network := client.newConnectInitial().ClientNetworkData
+	assert.Equal(t, "rail\x00\x00\x00\x00", string(network.ChannelDefArray[network.ChannelCount-1].Name[:]))
+	demand := &t128.TsDemandActivePduData{SharedId: mockShareId}
+	caps := &Capabilities{Sets: client.newConfirmActive(demand).CapabilitySets}
+	assert.NotNil(t, caps.Find(capability.CAPSTYPE_WINDOW))
+	assert.Nil(t, (&Capabilities{Sets: NewClient(&Option{Addr: "mock:3389"}).newConfirmActive(demand).CapabilitySets}).Find(capability.CAPSTYPE_WINDOW))
+
+	handler := &railRecorder{}
+	client.SetRailHandler(handler)
+	server := newMockServer(t, client)
+
+	windowOrder := func(fields uint32, body []byte) []byte {
+		order := []byte{rail.TS_ALTSEC_WINDOW<<2 | rail.TS_SECONDARY}
+		order = binary.LittleEndian.AppendUint16(order, uint16(11+len(body)))
+		order = binary.LittleEndian.AppendUint32(order, rail.WINDOW_ORDER_TYPE_WINDOW|fields)
+		order = binary.LittleEndian.AppendUint32(order, 0x42)
+		return append(order, body...)
+	}
+	title := append([]byte{4, 0}, core.UnicodeEncode("ed")...)
+	moved := binary.LittleEndian.AppendUint32(nil, 10)
+	moved = binary.LittleEndian.AppendUint32(moved, 20)
+	moved = binary.LittleEndian.AppendUint32(moved, 300)
+	moved = binary.LittleEndian.AppendUint32(moved, 200)
+	icon := []byte{3, 0, 0, 32, 1, 0, 1, 0, 4, 0, 4, 0, 0, 0, 0, 0, 1, 2, 3, 0xFF}
+	orders := bytes.Join([][]byte{
+		windowOrder(rail.WINDOW_ORDER_STATE_NEW|rail.WINDOW_ORDER_FIELD_TITLE, title),
+		windowOrder(rail.WINDOW_ORDER_FIELD_WNDOFFSET|rail.WINDOW_ORDER_FIELD_WNDSIZE, moved),
+		windowOrder(rail.WINDOW_ORDER_ICON, icon),
+		windowOrder(rail.WINDOW_ORDER_CACHEDICON, []byte{3, 0, 0}),
+		windowOrder(rail.WINDOW_ORDER_STATE_DELETED, nil),
+	}, nil)
+	update := append(binary.LittleEndian.AppendUint16(nil, 5), orders...)
+
+	done := server.serve(func() {
+		header := []byte{t128.FASTPATH_UPDATETYPE_ORDERS}
+		fastpath.Write(server.Conn, append(binary.LittleEndian.AppendUint16(header, uint16(len(update))), update...))
+		server.Conn.Close()
+	})
+	assert.Error(t, client.Run(nil))
+	assert.NoError(t, <-done)
+	assert.Equal(t, []string{"created ed", "updated (10,20)-(310,220)", "icon 0x42", "icon 0x42", "deleted 0x42"}, handler.events)
+	if assert.Len(t, handler.icons, 2) {
+		assert.Same(t, handler.icons[0], handler.icons[1], "cached icon")
+	}
+
+	err := core.Try(NewClient(&Option{Addr: "mock:3389", RemoteApp: &RemoteApp{}}).sendClientInfo)
+	assert.ErrorContains(t, err, "without a program")
+}
+
+// TestDrawingOrders checks that the drawing orders are announced with
+// Option.DrawingOrders only, and that Run paints them on a desktop of its
+// own, bitmaps of the bitmap cache included, and hands what they changed to
+// the processor
+func TestDrawingOrders(t *testing.T) {
+	demand := &t128.TsDemandActivePduData{SharedId: mockShareId}
+	caps := &Capabilities{Sets: NewClient(&Option{Addr: "mock:3389"}).newConfirmActive(demand).CapabilitySets}
+	order := caps.Find(capability.CAPSTYPE_ORDER).(*capability.TsOrderCapabilitySet)
+	assert.Equal(t, uint8(0), order.OrderSupport[capability.TS_NEG_GLYPH_INDEX_INDEX])
+	assert.Equal(t, uint8(0), order.OrderSupport[capability.TS_NEG_MEMBLT_INDEX])
+	glyphs := caps.Find(capability.CAPSTYPE_GLYPHCACHE).(*capability.TsGlyphCacheCapabilitySet)
+	assert.Equal(t, uint16(capability.GLYPH_SUPPORT_NONE), glyphs.GlyphSupportLevel)
+	client := NewClient(&Option{Addr: "mock:3389"})
+	client.resetOrders()
+	assert.Nil(t, client.canvas)
+
+	option := &Option{Addr: "mock:3389", DrawingOrders: true, OffscreenCacheSize: 16}
+	caps = &Capabilities{Sets: NewClient(option).newConfirmActive(demand).CapabilitySets}
+	order = caps.Find(capability.CAPSTYPE_ORDER).(*capability.TsOrderCapabilitySet)
+	assert.Equal(t, uint8(1), order.OrderSupport[capability.TS_NEG_GLYPH_INDEX_INDEX])
+	assert.Equal(t, uint8(1), order.OrderSupport[capability.TS_NEG_MEMBLT_INDEX])
+	assert.Equal(t, uint8(0), order.OrderSupport[capability.TS_NEG_POLYLINE_INDEX])
+	glyphs = caps.Find(capability.CAPSTYPE_GLYPHCACHE).(*capability.TsGlyphCacheCapabilitySet)
+	assert.Equal(t, uint16(capability.GLYPH_SUPPORT_FULL), glyphs.GlyphSupportLevel)
+
+	client = NewClient(option)
+	server := newMockServer(t, client)
+	client.desktopWidth, client.desktopHeight, client.bitsPerPixel = 16, 8, 32
+	// a red square, then a copy of it further right
+	update := binary.LittleEndian.AppendUint16(nil, 4)
+	update = append(update, orders.TS_STANDARD|orders.TS_TYPE_CHANGE, orders.TS_ENC_OPAQUERECT_ORDER, 0x7F)
+	for _, v := range []uint16{2, 2, 4, 4} {
+		update = binary.LittleEndian.AppendUint16(update, v)
+	}
+	update = append(update, 0xFF, 0, 0)
+	update = append(update, orders.TS_STANDARD|orders.TS_TYPE_CHANGE, orders.TS_ENC_SCRBLT_ORDER, 0x7F)
+	for _, v := range []uint16{10, 2, 4, 4} {
+		update = binary.LittleEndian.AppendUint16(update, v)
+	}
+	update = append(update, orders.ROP3_SRCCOPY, 2, 0, 2, 0)
+	// a blue and green bitmap cached in cell 5 of cache 1, then copied to
+	// the top left corner
+	cache := []byte{2, 1, 8, 5, 0xFF, 0, 0, 0, 0, 0xFF, 0, 0}
+	update = append(update, orders.TS_STANDARD|orders.TS_SECONDARY, byte(len(cache)-7), 0)
+	update = binary.LittleEndian.AppendUint16(update, 1|0x6<<3)
+	update = append(update, orders.TS_CACHE_BITMAP_UNCOMPRESSED_REV2)
+	update = append(update, cache...)
+	update = append(update, orders.TS_STANDARD|orders.TS_TYPE_CHANGE, orders.TS_ENC_MEMBLT_ORDER, 0xFF, 0x01)
+	for _, v := range []uint16{1, 0, 0, 2, 1} {
+		update = binary.LittleEndian.AppendUint16(update, v)
+	}
+	update = append(update, orders.ROP3_SRCCOPY, 0, 0, 0, 0, 5, 0)
+
+	done := server.serve(func() {
+		header := []byte{t128.FASTPATH_UPDATETYPE_ORDERS}
+		fastpath.Write(server.Conn, append(binary.LittleEndian.AppendUint16(header, uint16(len(update))), update...))
+		server.Conn.Close()
+	})
+	processor := &recordingProcessor{}
+	assert.Error(t, client.Run(processor))
+	assert.NoError(t, <-done)
+	require.Len(t, processor.options, 3)
+	assert.Equal(t, bitmap.Option{Left: 2, Top: 2, Width: 4, Height: 4, BitPerPixel: 32}, *processor.options[0])
+	assert.Equal(t, bitmap.Option{Left: 10, Top: 2, Width: 4, Height: 4, BitPerPixel: 32}, *processor.options[1])
+	assert.Equal(t, bitmap.Option{Width: 2, Height: 1, BitPerPixel: 32}, *processor.options[2])
+	assert.Equal(t, color.RGBA{B: 0xFF, A: 0xFF}, processor.bitmaps[2].Image.At(0, 0))
+	assert.Equal(t, color.RGBA{G: 0xFF, A: 0xFF}, processor.bitmaps[2].Image.At(1, 0))
+	assert.EqualValues(t, 1, client.BitmapCache().GetCacheStats()["stores"])
+	red := color.RGBA{R: 0xFF, A: 0xFF}
+	assert.Equal(t, red, processor.bitmaps[1].Image.At(3, 3))
+	assert.Equal(t, red, client.canvas.Snapshot().At(13, 5))
+	assert.Equal(t, color.RGBA{A: 0xFF}, client.canvas.Snapshot().At(14, 5))
+	assert.Equal(t, 16*1024, client.painter.OffscreenCacheSize)
+}
+
+// TestDisabledChannels checks that disabled channels are neither set up nor
+// offered to the server
+func TestDisabledChannels(t *testing.T) {
+	client := NewClient(&Option{Addr: "mock:3389", DisabledChannels: []string{"CLIPRDR", "rdpdr"}})
+	assert.False(t, client.IsClipboardChannelOpen())
+	assert.Error(t, client.SendVirtualChannelData(virtualchannel.CHANNEL_NAME_CLIPRDR, []byte{1}, 0))
+
+	handler := &testVCHandler{}
+	assert.Error(t, client.RegisterStaticChannel("cliprdr", handler))
+	assert.Error(t, client.RegisterStaticChannel("RDPDR", handler))
+	assert.Equal(t, []byte{
+		0x03, 0xC0, 0x20, 0x00, 0x02, 0x00, 0x00, 0x00,
+		'r', 'd', 'p', 's', 'n', 'd', 0x00, 0x00, 0x00, 0x00, 0x00, 0x80,
+		'd', 'r', 'd', 'y', 'n', 'v', 'c', 0x00, 0x00, 0x00, 0x00, 0x80,
+	}, client.newConnectInitial().ClientNetworkData.Serialize())
+
+	// without drdynvc no dynamic channel is listened for
+	client = NewClient(&Option{Addr: "mock:3389", DisabledChannels: []string{"DRDYNVC"}})
+	network := client.newConnectInitial().ClientNetworkData
+	assert.Equal(t, uint32(3), network.ChannelCount)
+	for _, def := range network.ChannelDefArray {
+		assert.NotEqual(t, "drdynvc\x00", string(def.Name[:]))
+	}
+	_, err := client.OpenDynamicChannel("telemetry")
+	assert.Error(t, err)
+}
+
+// TestDynamicChannel drives a dynamic channel the client listens for
+// through create, fragmented data both ways and close
+func TestDynamicChannel(t *testing.T) {
+	client, server := newMockSession(t)
+	drdynvcId := staticChannelId(client, virtualchannel.CHANNEL_NAME_DRDYNVC)
+
+	// readDVC reads one drdynvc message sent by the client
+	readDVC := func() *drdynvc.DynamicVirtualChannelMessage {
+		channelId, data := server.ReadMcsData()
+		assert.Equal(t, drdynvcId, channelId)
+		// CHANNEL_PDU_HEADER, then the chunk
+		assert.Equal(t, len(data)-8, int(binary.LittleEndian.Uint32(data)))
+		msg, err := drdynvc.ReadDynamicVirtualChannelMessage(bytes.NewReader(data[8:]))
+		assert.NoError(t, err)
+		return msg
+	}
+	// fromServer hands a drdynvc message to the client as the session loop would
+	fromServer := func(typ uint8, data []byte) {
+		msg := &drdynvc.DynamicVirtualChannelMessage{MessageType: typ, Data: data}
+		assert.NoError(t, client.handleDynamicVirtualChannel(msg.Serialize()))
+	}
+	// create has the server create the channel name as id, returning the
+	// status the client answered with
+	create := func(name string, id uint32) uint32 {
+		var rsp *drdynvc.CreateResponse
+		done := server.serve(func() {
+			msg := readDVC()
+			assert.Equal(t, uint8(drdynvc.DVCCREATE_RSP), msg.MessageType)
+			rsp, _ = drdynvc.ParseCreateResponse(msg.Data)
+		})
+		fromServer(drdynvc.DVCCREATE_REQ, (&drdynvc.CreateRequest{RequestId: 9, ChannelId: id, ChannelName: name}).Serialize())
+		require.NoError(t, <-done)
+		require.NotNil(t, rsp)
+		assert.Equal(t, id, rsp.ChannelId)
+		return rsp.Status
+	}
+
+	ch, err := client.OpenDynamicChannel("telemetry")
+	require.NoError(t, err)
+	_, err = client.OpenDynamicChannel("telemetry")
+	assert.Error(t, err, "a name has one listener")
+	assert.Zero(t, ch.ID())
+	assert.ErrorIs(t, ch.Send([]byte("early")), ErrDynamicChannelClosed)
+
+	assert.Equal(t, uint32(drdynvc.DVCCREATE_FAILED), create("nobody", 6), "nobody listens")
+	assert.NotContains(t, client.ListDynamicVirtualChannels(), "nobody")
+	assert.Equal(t, uint32(drdynvc.DVCCREATE_SUCCESS), create("telemetry", 7))
+	assert.Equal(t, uint32(7), ch.ID())
+	select {
+	case <-ch.Opened():
+	default:
+		t.Fatal("channel not opened")
+	}
+	assert.Equal(t, uint32(drdynvc.DVCCREATE_FAILED), create("telemetry", 8), "the listener has its channel")
+
+	// a large write goes out in fragments
+	payload := bytes.Repeat([]byte("0123456789"), 400)
+	var types []uint8
+	var sent []byte
+	done := server.serve(func() {
+		for len(sent) < len(payload) {
+			msg := readDVC()
+			data, err := drdynvc.ParseDataMessage(msg.Data)
+			assert.NoError(t, err)
+			assert.Equal(t, ch.ID(), data.ChannelId)
+			types = append(types, msg.MessageType)
+			sent = append(sent, data.Data...)
+		}
+	})
+	assert.NoError(t, ch.Send(payload))
+	assert.NoError(t, <-done)
+	assert.Equal(t, []uint8{drdynvc.DVCDATA_FIRST, drdynvc.DVCDATA, drdynvc.DVCDATA_LAST}, types)
+	assert.Equal(t, payload, sent)
+
+	// and comes in reassembled
+	var received [][]byte
+	ch.OnData(func(data []byte) { received = append(received, data) })
+	for i, typ := range []uint8{drdynvc.DVCDATA_FIRST, drdynvc.DVCDATA, drdynvc.DVCDATA_LAST} {
+		fromServer(typ, (&drdynvc.DataMessage{ChannelId: ch.ID(), Data: payload[i*1000 : (i+1)*1000]}).Serialize())
+	}
+	fromServer(drdynvc.DVCDATA_FIRST_LAST, (&drdynvc.DataMessage{ChannelId: ch.ID(), Data: []byte("ping")}).Serialize())
+	assert.Equal(t, [][]byte{payload[:3000], []byte("ping")}, received)
+
+	stats := client.ChannelStats()
+	assert.True(t, stats["telemetry"].Dynamic)
+	assert.Equal(t, uint64(len(payload)), stats["telemetry"].BytesSent)
+	assert.Equal(t, uint64(1), stats["telemetry"].MessagesSent)
+	assert.Equal(t, uint64(3004), stats["telemetry"].BytesReceived)
+	assert.Equal(t, uint64(2), stats["telemetry"].MessagesReceived)
+	assert.Greater(t, stats["telemetry"].Throughput, 0.0)
+	// the drdynvc channel carried the fragments and the channel requests
+	assert.Greater(t, stats[virtualchannel.CHANNEL_NAME_DRDYNVC].BytesSent, uint64(len(payload)))
+	assert.False(t, stats[virtualchannel.CHANNEL_NAME_DRDYNVC].Dynamic)
+
+	done = server.serve(func() {
+		assert.Equal(t, uint8(drdynvc.DVCCLOSE_REQ), readDVC().MessageType)
+	})
+	assert.NoError(t, ch.Close())
+	assert.NoError(t, <-done)
+	assert.ErrorIs(t, ch.Send(payload), ErrDynamicChannelClosed)
+	fromServer(drdynvc.DVCCLOSE_RSP, (&drdynvc.CloseResponse{ChannelId: ch.ID()}).Serialize())
+	select {
+	case <-ch.Done():
+	default:
+		t.Fatal("channel not closed")
+	}
+	assert.NotContains(t, client.ListDynamicVirtualChannels(), "telemetry")
+	assert.Equal(t, uint64(3004), client.ChannelStats()["telemetry"].BytesReceived, "closed channels keep their counts")
+
+	// a closed channel no more listens, nor does one closed before it was
+	// created, which sends nothing
+	ch, err = client.OpenDynamicChannel("telemetry")
+	require.NoError(t, err)
+	assert.NoError(t, ch.Close())
+	select {
+	case <-ch.Done():
+	default:
+		t.Fatal("channel not closed")
+	}
+	assert.Equal(t, uint32(drdynvc.DVCCREATE_FAILED), create("telemetry", 10))
+}
+
+func TestDialDynamicChannel(t *testing.T) {
+	client, server := newMockSession(t)
+
+	readDVC := func() *drdynvc.DynamicVirtualChannelMessage {
+		_, data := server.ReadMcsData()
+		msg, err := drdynvc.ReadDynamicVirtualChannelMessage(bytes.NewReader(data[8:]))
+		assert.NoError(t, err)
+		return msg
+	}
+	fromServer := func(typ uint8, data []byte) {
+		msg := &drdynvc.DynamicVirtualChannelMessage{MessageType: typ, Data: data}
+		assert.NoError(t, client.handleDynamicVirtualChannel(msg.Serialize()))
+	}
+	listening := func(name string) bool {
+		client.dvcMu.Lock()
+		defer client.dvcMu.Unlock()
+		_, ok := client.dvcHandlers[name]
+		return ok
+	}
+	type dialed struct {
+		conn io.ReadWriteCloser
+		err  error
+	}
+
+	// dial dials name, which the server creates as id
+	dial := func(name string, id uint32) io.ReadWriteCloser {
+		result := make(chan dialed, 1)
+		go func() {
+			conn, err := client.DialDynamicChannel(name)
+			result <- dialed{conn, err}
+		}()
+		for !listening(name) {
+			time.Sleep(time.Millisecond)
+		}
+		select {
+		case d := <-result:
+			t.Fatalf("dial ended before the channel was created: %v", d.err)
+		case <-time.After(20 * time.Millisecond):
+		}
+		done := server.serve(func() {
+			assert.Equal(t, uint8(drdynvc.DVCCREATE_RSP), readDVC().MessageType)
+		})
+		fromServer(drdynvc.DVCCREATE_REQ, (&drdynvc.CreateRequest{RequestId: 1, ChannelId: id, ChannelName: name}).Serialize())
+		require.NoError(t, <-done)
+		d := <-result
+		require.NoError(t, d.err)
+		return d.conn
+	}
+
+	const id uint32 = 5
+	conn := dial("echo", id)
+
+	// a write is one message, fragmented as it takes
+	payload := bytes.Repeat([]byte("0123456789"), 400)
+	var sent []byte
+	done := server.serve(func() {
+		for len(sent) < len(payload) {
+			data, err := drdynvc.ParseDataMessage(readDVC().Data)
+			assert.NoError(t, err)
+			assert.Equal(t, id, data.ChannelId)
+			sent = append(sent, data.Data...)
+		}
+	})
+	n, err := conn.Write(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, len(payload), n)
+	assert.NoError(t, <-done)
+	assert.Equal(t, payload, sent)
+
+	// messages are read in order, across short reads
+	fromServer(drdynvc.DVCDATA_FIRST_LAST, (&drdynvc.DataMessage{ChannelId: id, Data: []byte("hello")}).Serialize())
+	fromServer(drdynvc.DVCDATA_FIRST_LAST, (&drdynvc.DataMessage{ChannelId: id, Data: []byte(" world")}).Serialize())
+	buff := make([]byte, 3)
+	n, err = conn.Read(buff)
+	assert.NoError(t, err)
+	assert.Equal(t, "hel", string(buff[:n]))
+
+	// a read waits for a message
+	go fromServer(drdynvc.DVCDATA_FIRST_LAST, (&drdynvc.DataMessage{ChannelId: id, Data: []byte("!")}).Serialize())
+	rest := make([]byte, 0, 16)
+	for len(rest) < len("lo world!") {
+		n, err = conn.Read(buff)
+		require.NoError(t, err)
+		rest = append(rest, buff[:n]...)
+	}
+	assert.Equal(t, "lo world!", string(rest))
+
+	// closed by the server, what is left is read before io.EOF
+	fromServer(drdynvc.DVCDATA_FIRST_LAST, (&drdynvc.DataMessage{ChannelId: id, Data: []byte("bye")}).Serialize())
+	done = server.serve(func() {
+		assert.Equal(t, uint8(drdynvc.DVCCLOSE_RSP), readDVC().MessageType)
+	})
+	fromServer(drdynvc.DVCCLOSE_REQ, (&drdynvc.CloseRequest{ChannelId: id}).Serialize())
+	assert.NoError(t, <-done)
+	data, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "bye", string(data))
+	_, err = conn.Write([]byte("late"))
+	assert.ErrorIs(t, err, ErrDynamicChannelClosed)
+
+	assert.NoError(t, conn.Close())
+	_, err = conn.Read(buff)
+	assert.ErrorIs(t, err, net.ErrClosed)
+
+	// a reader that falls behind loses the channel, but for what was kept
+	conn = dial("flood", 6)
+	conn.(*dynamicChannelConn).limit = 8
+	fromServer(drdynvc.DVCDATA_FIRST_LAST, (&drdynvc.DataMessage{ChannelId: 6, Data: []byte("12345")}).Serialize())
+	done = server.serve(func() {
+		assert.Equal(t, uint8(drdynvc.DVCCLOSE_REQ), readDVC().MessageType)
+	})
+	fromServer(drdynvc.DVCDATA_FIRST_LAST, (&drdynvc.DataMessage{ChannelId: 6, Data: []byte("6789")}).Serialize())
+	assert.NoError(t, <-done)
+	fromServer(drdynvc.DVCDATA_FIRST_LAST, (&drdynvc.DataMessage{ChannelId: 6, Data: []byte("late")}).Serialize())
+	data, err = io.ReadAll(conn)
+	assert.ErrorIs(t, err, ErrDynamicChannelOverrun)
+	assert.Equal(t, "12345", string(data))
+}
+
+// TestRegisterFileTransfer checks that the file transfers of a manager are
+// served on their dynamic channel once the server creates it
+func TestRegisterFileTransfer(t *testing.T) {
+	client, server := newMockSession(t)
+	manager := virtualchannel.NewAdvancedFileTransferManager()
+	manager.SetDirectory(t.TempDir())
+	require.NoError(t, client.RegisterFileTransfer(manager))
+
+	readDVC := func() *drdynvc.DynamicVirtualChannelMessage {
+		_, data := server.ReadMcsData()
+		msg, err := drdynvc.ReadDynamicVirtualChannelMessage(bytes.NewReader(data[8:]))
+		assert.NoError(t, err)
+		return msg
+	}
+	fromServer := func(typ uint8, data []byte) error {
+		msg := &drdynvc.DynamicVirtualChannelMessage{MessageType: typ, Data: data}
+		return client.handleDynamicVirtualChannel(msg.Serialize())
+	}
+	done := server.serve(func() {
+		assert.Equal(t, uint8(drdynvc.DVCCREATE_RSP), readDVC().MessageType)
+	})
+	request := &drdynvc.CreateRequest{RequestId: 1, ChannelId: 3, ChannelName: virtualchannel.FileTransferChannelName}
+	require.NoError(t, fromServer(drdynvc.DVCCREATE_REQ, request.Serialize()))
+	require.NoError(t, <-done)
+
+	// the error response to a download goes back on the channel
+	done = server.serve(func() {
+		data, err := drdynvc.ParseDataMessage(readDVC().Data)
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint32(3), data.ChannelId)
+			assert.Contains(t, string(data.Data), "file not found")
+		}
+	})
+	download := &drdynvc.DataMessage{ChannelId: 3, Data: []byte(`{"action":"download","filename":"missing"}`)}
+	assert.Error(t, fromServer(drdynvc.DVCDATA_FIRST_LAST, download.Serialize()))
+	assert.NoError(t, <-done)
+
+	client = NewClient(&Option{Addr: "mock:3389", DisabledChannels: []string{virtualchannel.CHANNEL_NAME_DRDYNVC}})
+	assert.Error(t, client.RegisterFileTransfer(manager))
+}
+
+func TestStartRecording(t *testing.T) {
+	client := NewClient(&Option{Addr: "mock:3389"})
+	assert.Error(t, client.StartRecording(io.Discard), "no desktop size before Connect")
+	client.desktopWidth, client.desktopHeight = 256, 128
+	fb := client.EnableFramebuffer(256, 128)
+	processor := client.withFramebuffer(client.withRecording(nil))
+
+	buff := new(bytes.Buffer)
+	require.NoError(t, client.StartRecording(buff))
+	client.processBitmaps(processor, decodeTestTiles(4, 32))
+	require.NoError(t, client.StopRecording())
+	client.processBitmaps(processor, decodeTestTiles(1, 64))
+
+	played := &recordingProcessor{}
+	require.NoError(t, replay.Replay(bytes.NewReader(buff.Bytes()), played))
+	assert.Len(t, played.bitmaps, 4, "updates after StopRecording are not recorded")
+	replayed := bitmap.NewFramebuffer(256, 128)
+	for i := range played.bitmaps {
+		replayed.ApplyUpdate(played.options[i], played.bitmaps[i])
+	}
+	recorded := bitmap.NewFramebuffer(256, 128)
+	for _, option := range decodeTestTiles(4, 32) {
+		recorded.ApplyUpdate(option, bitmap.Decode(option))
+	}
+	assert.Equal(t, recorded.Snapshot(), replayed.Snapshot())
+	assert.NotEqual(t, fb.Snapshot(), replayed.Snapshot())
+}
+
+// pointerRecorder records the pointers it is given besides the updates
+type pointerRecorder struct {
+	recordingProcessor
+	pointers []bitmap.Pointer
+}
+
+func (p *pointerRecorder) ProcessPointer(pointer *bitmap.Pointer) {
+	p.pointers = append(p.pointers, *pointer)
+}
+
+func TestPointerUpdates(t *testing.T) {
+	client, server := newMockSession(t)
+	client.desktopWidth, client.desktopHeight = 64, 48
+	buff := new(bytes.Buffer)
+	require.NoError(t, client.StartRecording(buff))
+
+	// a 1x2 monochrome pointer cached in cell 2, white over black
+	shape := []byte{1, 0, 2, 0, 0, 0, 0, 0, 1, 0, 2, 0, 0, 0, 4, 0, 0x80, 0, 0, 0}
+	fastPathUpdate := func(code uint8, data []byte) []byte {
+		return append(binary.LittleEndian.AppendUint16([]byte{code}, uint16(len(data))), data...)
+	}
+	done := server.serve(func() {
+		fastpath.Write(server.Conn, fastPathUpdate(t128.FASTPATH_UPDATETYPE_POINTER, shape))
+		fastpath.Write(server.Conn, fastPathUpdate(t128.FASTPATH_UPDATETYPE_PTR_POSITION, []byte{10, 0, 20, 0}))
+		fastpath.Write(server.Conn, fastPathUpdate(t128.FASTPATH_UPDATETYPE_PTR_NULL, nil))
+		fastpath.Write(server.Conn, fastPathUpdate(t128.FASTPATH_UPDATETYPE_CACHED, []byte{7, 0})) // not cached
+		fastpath.Write(server.Conn, fastPathUpdate(t128.FASTPATH_UPDATETYPE_CACHED, []byte{2, 0}))
+		fastpath.Write(server.Conn, fastPathUpdate(t128.FASTPATH_UPDATETYPE_PTR_DEFAULT, nil))
+		x224.Write(server.Conn, []byte{0x21, 0x80}) // Disconnect Provider Ultimatum ends Run
+	})
+	processor := &pointerRecorder{}
+	assert.Error(t, client.Run(processor))
+	assert.NoError(t, <-done)
+	require.NoError(t, client.StopRecording())
+
+	img := image.NewRGBA(image.Rect(0, 0, 1, 2))
+	img.SetRGBA(0, 0, color.RGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF})
+	img.SetRGBA(0, 1, color.RGBA{A: 0xFF})
+	want := []bitmap.Pointer{
+		{Image: img},
+		{Image: img, Position: image.Pt(10, 20)},
+		{Hidden: true, Position: image.Pt(10, 20)},
+		{Image: img, Position: image.Pt(10, 20)},
+		{Position: image.Pt(10, 20)},
+	}
+	assert.Equal(t, want, processor.pointers)
+
+	played := &replayedPointers{}
+	require.NoError(t, replay.Replay(bytes.NewReader(buff.Bytes()), played))
+	assert.Equal(t, want, played.pointers)
+}
+
+// replayedPointers collects the pointers of a recording
+type replayedPointers struct {
+	pointers []bitmap.Pointer
+}
+
+func (p *replayedPointers) ProcessBitmap(*bitmap.Option, *bitmap.BitMap) {}
+
+func (p *replayedPointers) ProcessPointer(pointer *bitmap.Pointer) {
+	p.pointers = append(p.pointers, *pointer)
+}
+
+// decodeTestTiles makes n uncompressed 32bpp tiles of size x size pixels,
+// each overlapping the one before so the order they are applied in shows
+func decodeTestTiles(n, size int) []*bitmap.Option {
+	options := make([]*bitmap.Option, n)
+	for i := range options {
+		data := make([]byte, 1+3*size*size)
+		for j := 1; j < len(data); j++ {
+			data[j] = byte(i*31 + j*7)
+		}
+		options[i] = &bitmap.Option{
+			Left: i * size / 2, Top: i * size / 4,
+			Width: size, Height: size, BitPerPixel: 32, Data: data,
+		}
+	}
+	return options
+}
+
+// orderProcessor records the tiles in the order they are processed
+type orderProcessor struct {
+	lefts []int
+}
+
+func (p *orderProcessor) ProcessBitmap(option *bitmap.Option, _ *bitmap.BitMap) {
+	p.lefts = append(p.lefts, option.Left)
+}
+
+func TestDecodeWorkers(t *testing.T) {
+	decode := func(workers int, options []*bitmap.Option) (image.Image, []int) {
+		client := NewClient(&Option{Addr: "mock:3389", DecodeWorkers: workers})
+		fb := client.EnableFramebuffer(256, 128)
+		processor := &orderProcessor{}
+		client.processBitmaps(client.withFramebuffer(processor), options)
+		return fb.Snapshot(), processor.lefts
+	}
+
+	serial, serialOrder := decode(0, decodeTestTiles(16, 32))
+	parallel, parallelOrder := decode(4, decodeTestTiles(16, 32))
+	assert.Equal(t, serialOrder, parallelOrder)
+	assert.Equal(t, serial, parallel)
+
+	// a broken tile is thrown after the tiles before it were processed
+	options := decodeTestTiles(8, 16)
+	options[5].Data = options[5].Data[:10]
+	processor := &orderProcessor{}
+	client := NewClient(&Option{Addr: "mock:3389", DecodeWorkers: 3})
+	err := core.Try(func() { client.processBitmaps(processor, options) })
+	assert.Error(t, err)
+	assert.Equal(t, []int{0, 8, 16, 24, 32}, processor.lefts)
+}
+
+func BenchmarkDecodeWorkers(b *testing.B) {
+	options := decodeTestTiles(32, 64)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			client := NewClient(&Option{Addr: "mock:3389", DecodeWorkers: workers})
+			client.EnableFramebuffer(1100, 600)
+			processor := client.withFramebuffer(nil)
+			for i := 0; i < b.N; i++ {
+				client.processBitmaps(processor, options)
+			}
+		})
+	}
+}
+
+func TestSurfaceCommandsBlit(t *testing.T) {
+	client := NewClient(&Option{Addr: "mock:3389"})
+	fb := client.EnableFramebuffer(16, 8)
+	processor := &testProcessor{}
+	red := color.RGBA{R: 0xFF, A: 0xFF}
+
+	client.processSurfaceCommands(client.withFramebuffer(processor), []t128.SurfaceCommand{
+		// a 1x1 red surface copied through a cache slot onto a 4x4 one
+		&t128.TsCreateSurfaceCommand{SurfaceId: 1, Width: 1, Height: 1, PixelFormat: t128.PIXEL_FORMAT_XRGB_8888,
+			SurfaceData: []byte{0x00, 0x00, 0xFF, 0x00}},
+		&t128.TsCreateSurfaceCommand{SurfaceId: 2, Width: 4, Height: 4, PixelFormat: t128.PIXEL_FORMAT_XRGB_8888},
+		&t128.TsSurfaceToCacheCommand{SurfaceId: 1, CacheSlot: 0, SourceRect: t128.Rectangle{Right: 1, Bottom: 1}},
+		&t128.TsCacheToSurfaceCommand{CacheSlot: 0, SurfaceId: 2, DestRect: t128.Rectangle{Left: 1, Top: 2, Right: 2, Bottom: 3}},
+	})
+	assert.Equal(t, 0, processor.processCount, "no surface is on the desktop yet")
+
+	client.processSurfaceCommands(client.withFramebuffer(processor), []t128.SurfaceCommand{
+		&t128.TsMapSurfaceToOutputCommand{SurfaceId: 2, OutputOriginX: 8, OutputOriginY: 2},
+		&t128.TsSurfaceToSurfaceCommand{SourceSurfaceId: 1, DestSurfaceId: 2,
+			SourceRect: t128.Rectangle{Right: 1, Bottom: 1}, DestRect: t128.Rectangle{Left: 3, Top: 3, Right: 4, Bottom: 4}},
+	})
+	assert.Equal(t, 2, processor.processCount)
+	snapshot := fb.Snapshot()
+	assert.Equal(t, red, snapshot.At(9, 4))
+	assert.Equal(t, red, snapshot.At(11, 5))
+	assert.Equal(t, color.RGBA{A: 0xFF}, snapshot.At(8, 2))
+}
+
+// TestSurfaceBits checks that uncompressed surface bits are drawn top-down
+// and bitmaps of a codec the client does not decode are skipped
+func TestSurfaceBits(t *testing.T) {
+	client := NewClient(&Option{Addr: "mock:3389"})
+	fb := client.EnableFramebuffer(4, 4)
+	processor := &testProcessor{}
+
+	client.processSurfaceCommands(client.withFramebuffer(processor), []t128.SurfaceCommand{
+		&t128.TsSetSurfaceBitsCommand{DestLeft: 1, DestTop: 2, BitmapData: t128.TsBitmapDataEx{
+			Bpp: 32, CodecID: t128.CODEC_ID_NONE, Width: 1, Height: 2,
+			BitmapData: []byte{0x00, 0x00, 0xFF, 0x00, 0xFF, 0x00, 0x00, 0x00},
+		}},
+		&t128.TsSetSurfaceBitsCommand{BitmapData: t128.TsBitmapDataEx{
+			Bpp: 32, CodecID: 3, Width: 4, Height: 4, BitmapData: []byte{0xAA, 0xBB, 0xCC},
+		}},
+	})
+	assert.Equal(t, 1, processor.processCount)
+	snapshot := fb.Snapshot()
+	assert.Equal(t, color.RGBA{R: 0xFF, A: 0xFF}, snapshot.At(1, 2))
+	assert.Equal(t, color.RGBA{B: 0xFF, A: 0xFF}, snapshot.At(1, 3))
+}
+
+func TestPersistentBitmapCache(t *testing.T) {
+	demand := &t128.TsDemandActivePduData{SharedId: mockShareId}
+	caps := &Capabilities{Sets: NewClient(&Option{Addr: "mock:3389"}).newConfirmActive(demand).CapabilitySets}
+	assert.NotNil(t, caps.Find(capability.CAPSTYPE_BITMAPCACHE))
+	assert.Nil(t, caps.Find(capability.CAPSTYPE_BITMAPCACHE_REV2))
+
+	client, server := newMockSession(t)
+	client.option.PersistentBitmapCache = true
+	caps = &Capabilities{Sets: client.newConfirmActive(demand).CapabilitySets}
+	assert.Nil(t, caps.Find(capability.CAPSTYPE_BITMAPCACHE))
+	rev2, _ := caps.Find(capability.CAPSTYPE_BITMAPCACHE_REV2).(*capability.TsBitmapCacheCapabilitySetRev2)
+	if assert.NotNil(t, rev2) {
+		assert.Equal(t, uint16(capability.PERSISTENT_KEYS_EXPECTED_FLAG), rev2.CacheFlags)
+		assert.Equal(t, uint8(3), rev2.NumCellCaches)
+		assert.Equal(t, uint32(capability.BITMAP_CACHE_PERSISTENT|600), rev2.BitmapCache0CellInfo)
+	}
+
+	// the keys of a cache kept from an earlier session go to the server
+	// between the control and font list PDUs
+	client.BitmapCache().ProcessBitmap([]byte{1, 2, 3, 4}, 2, 1, 16)
+	key := t128.GenerateCacheKey([]byte{1, 2, 3, 4}, 2, 1, 16)
+	done := server.serve(func() {
+		for i := 0; i < 3; i++ {
+			server.ReadDataPdu()
+		}
+		list, ok := server.ReadDataPdu().Pdu.(*t128.TsBitmapCachePersistentListPDU)
+		if assert.True(t, ok) {
+			assert.Equal(t, []t128.TsBitmapCachePersistentEntry{{Key1: uint32(key), Key2: uint32(key >> 32)}}, list.Entries)
+		}
+		assert.Equal(t, uint8(t128.PDUTYPE2_FONTLIST), server.ReadDataPdu().Header.PDUType2)
+		server.WriteDataPdu(t128.NewTsSynchronizePduData(mockUserId))
+		server.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_COOPERATE})
+		server.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_GRANTED_CONTROL, GrantId: mockUserId, ControlId: mockServerChannel})
+		server.WriteDataPdu(&t128.TsFontMapPDU{MapFlags: 0x0003, EntrySize: 0x0004})
+	})
+	assert.NoError(t, core.Try(client.sendClientFinalization))
+	assert.NoError(t, <-done)
+	assert.Equal(t, map[uint32]uint64{0: key}, client.bitmapCells, "the server numbers the keys sent")
+}
+
+// TestSessionInfo checks that the negotiated parameters are reported
+func TestSessionInfo(t *testing.T) {
+	client := NewClient(&Option{Addr: "mock:3389", DisabledChannels: []string{"cliprdr", "rdpsnd", "rdpdr"}})
+	assert.Equal(t, SessionInfo{}, client.SessionInfo())
+
+	assert.NoError(t, client.RegisterStaticChannel("LOBDATA", &testVCHandler{}))
+	assert.NoError(t, client.RegisterStaticChannel("MISSING", &testVCHandler{}))
+	client.bindStaticChannels([]uint16{1003, 1004, 0})
+	assert.NoError(t, client.dvcManager.RegisterChannelWithID(1, "ECHO", nil))
+	client.selectProtocol = connPdu.PROTOCOL_HYBRID
+	client.serverVersion = mcs.RDP_VERSION_10_7
+	bmp := capability.NewTsBitmapCapabilitySet()
+	bmp.DesktopWidth, bmp.DesktopHeight, bmp.PreferredBitsPerPixel = 1920, 1080, 32
+	client.desktopWidth, client.desktopHeight, client.bitsPerPixel = desktopSize([]capability.TsCapsSet{bmp})
+
+	info := client.SessionInfo()
+	assert.Equal(t, SessionInfo{
+		Protocol:      connPdu.PROTOCOL_HYBRID,
+		ServerVersion: mcs.RDP_VERSION_10_7,
+		DesktopWidth:  1920,
+		DesktopHeight: 1080,
+		BitsPerPixel:  32,
+		Channels: []ChannelInfo{
+			{Name: virtualchannel.CHANNEL_NAME_DRDYNVC, ID: 1003},
+			{Name: "LOBDATA", ID: 1004},
+			{Name: "ECHO", ID: 1, Dynamic: true},
+		},
+	}, info)
+	assert.Equal(t, "hybrid", info.ProtocolName())
+}
+
+func TestConnectProgress(t *testing.T) {
+	for name, connect := range map[string]func(*Client) error{
+		"Connect":            (*Client).Connect,
+		"ConnectWithContext": func(c *Client) error { return c.ConnectWithContext(context.Background()) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer ln.Close()
+
+			// the server negotiates, then hangs up on the basic settings
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				_ = core.Try(func() {
+					x224.ReadConfirm(conn)
+					nego := []byte{connPdu.TYPE_RDP_NEG_RSP, 0, 8, 0}
+					nego = binary.LittleEndian.AppendUint32(nego, connPdu.PROTOCOL_RDP)
+					x224.Connect(conn, x224.TPDU_CONNECTION_CONFIRM, nego)
+					x224.Read(conn)
+				})
+			}()
+
+			var stages []string
+			client := NewClient(&Option{
+				Addr:           ln.Addr().String(),
+				ConnectTimeout: time.Second,
+				OnProgress:     func(stage string) { stages = append(stages, stage) },
+			})
+			assert.Error(t, connect(client))
+			assert.Equal(t, []string{StageNegotiation, StageBasicSettingsExchange}, stages)
+		})
+	}
+}
+
+func TestLogoff(t *testing.T) {
+	// connected returns a session past the connection finalization
+	connected := func(t *testing.T) (*Client, *mockServer) {
+		client, server := newMockSession(t)
+		done := server.serve(server.Finalize)
+		assert.NoError(t, core.Try(client.sendClientFinalization))
+		assert.NoError(t, <-done)
+		return client, server
+	}
+	// readShutdownRequest consumes the client's Shutdown Request PDU
+	readShutdownRequest := func(t *testing.T, server *mockServer) {
+		request := server.ReadDataPdu()
+		assert.Equal(t, uint8(t128.PDUTYPE2_SHUTDOWN_REQUEST), request.Header.PDUType2)
+	}
+
+	t.Run("NotConnected", func(t *testing.T) {
+		client, _ := newMockSession(t)
+		assert.ErrorIs(t, client.Logoff(), ErrNotConnected)
+	})
+
+	t.Run("DeniedWhileRunning", func(t *testing.T) {
+		client, server := connected(t)
+		ran := make(chan error, 1)
+		go func() { ran <- client.Run(nil) }()
+		for !client.running.Load() {
+			time.Sleep(time.Millisecond)
+		}
+		done := server.serve(func() {
+			readShutdownRequest(t, server)
+			server.WriteDataPdu(&t128.TsShutdownDeniedPDU{})
+		})
+		assert.ErrorIs(t, client.Logoff(), ErrLogoffDenied)
+		assert.NoError(t, <-done)
+		assert.Error(t, <-ran, "Run ends once Logoff closed the client")
+	})
+
+	t.Run("DeactivateAll", func(t *testing.T) {
+		client, server := connected(t)
+		done := server.serve(func() {
+			readShutdownRequest(t, server)
+			body := (&t128.TsDeactivateAllPDU{SharedId: mockShareId, SourceDescriptor: []byte{0}}).Serialize()
+			header := t128.TsShareControlHeader{PDUType: t128.PDUTYPE_DEACTIVATEALLPDU, PDUSource: mockServerChannel, TotalLength: uint16(len(body) + 6)}
+			server.WriteMcsData(mcs.MCS_CHANNEL_GLOBAL, append(header.Serialize(), body...))
+		})
+		assert.NoError(t, client.Logoff())
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("ServerHangsUp", func(t *testing.T) {
+		client, server := connected(t)
+		done := server.serve(func() {
+			readShutdownRequest(t, server)
+			server.Conn.Close()
+		})
+		assert.NoError(t, client.Logoff())
+		assert.NoError(t, <-done)
+	})
+}
+
+func TestDisplaySettings(t *testing.T) {
+	demand := &t128.TsDemandActivePduData{SharedId: mockShareId}
+	client := NewClient(&Option{Addr: "mock:3389"})
+	coreData := client.newConnectInitial().ClientCoreData
+	assert.Equal(t, uint16(DefaultWidth), coreData.DesktopWidth)
+	assert.Equal(t, uint16(DefaultHeight), coreData.DesktopHeight)
+	assert.Equal(t, uint16(mcs.HIGH_COLOR_24BPP), coreData.HighColorDepth)
+	assert.NotZero(t, coreData.EarlyCapabilityFlags&mcs.RNS_UD_CS_WANT_32BPP_SESSION)
+	bmp := (&Capabilities{Sets: client.newConfirmActive(demand).CapabilitySets}).Bitmap()
+	assert.Equal(t, uint16(DefaultWidth), bmp.DesktopWidth)
+	assert.Equal(t, uint16(DefaultHeight), bmp.DesktopHeight)
+	assert.Equal(t, uint16(DefaultColorDepth), bmp.PreferredBitsPerPixel)
+	assert.Equal(t, uint16(1), bmp.BitmapCompressionFlag)
+
+	client = NewClient(&Option{Addr: "mock:3389", Width: 1920, Height: 1200, ColorDepth: 16})
+	coreData = client.newConnectInitial().ClientCoreData
+	assert.Equal(t, uint16(1920), coreData.DesktopWidth)
+	assert.Equal(t, uint16(1200), coreData.DesktopHeight)
+	assert.Equal(t, uint16(mcs.HIGH_COLOR_16BPP), coreData.HighColorDepth)
+	assert.Zero(t, coreData.EarlyCapabilityFlags&mcs.RNS_UD_CS_WANT_32BPP_SESSION)
+	bmp = (&Capabilities{Sets: client.newConfirmActive(demand).CapabilitySets}).Bitmap()
+	assert.Equal(t, uint16(1920), bmp.DesktopWidth)
+	assert.Equal(t, uint16(16), bmp.PreferredBitsPerPixel)
+
+	for _, opt := range []*Option{
+		{Addr: "mock:3389", ColorDepth: 12},
+		{Addr: "mock:3389", Width: -1},
+		{Addr: "mock:3389", Height: mcs.MaxDesktopSize + 1},
+	} {
+		err := core.Try(func() { NewClient(opt).newConnectInitial() })
+		assert.ErrorIs(t, err, ErrDisplaySettings)
+	}
+}
+
+func TestKeyboardLayout(t *testing.T) {
+	demand := &t128.TsDemandActivePduData{SharedId: mockShareId}
+	for _, tc := range []struct {
+		layout, want, kbdType uint32
+	}{
+		{0, mcs.US, mcs.KT_IBM_101_102_KEYS},
+		{t128.ScanCodeLayoutDE.KbdLayout, mcs.GERMAN, mcs.KT_IBM_101_102_KEYS},
+		{mcs.JAPANESE, mcs.JAPANESE, mcs.KT_JAPANESE},
+	} {
+		client := NewClient(&Option{Addr: "mock:3389", KeyboardLayout: tc.layout})
+		coreData := client.newConnectInitial().ClientCoreData
+		assert.Equal(t, tc.want, coreData.KbdLayout)
+		assert.Equal(t, tc.kbdType, coreData.KeyboardType)
+		input := (&Capabilities{Sets: client.newConfirmActive(demand).CapabilitySets}).Find(capability.CAPSTYPE_INPUT).(*capability.TsInputCapabilitySet)
+		assert.Equal(t, tc.want, input.KeyboardLayout)
+		assert.Equal(t, tc.kbdType, input.KeyboardType)
+		assert.Equal(t, coreData.KeyboardSubType, input.KeyboardSubType)
+	}
+}
+
+func TestOffscreenCacheSettings(t *testing.T) {
+	demand := &t128.TsDemandActivePduData{SharedId: mockShareId}
+	for _, tc := range []struct {
+		size, entries         uint16
+		wantSize, wantEntries uint16
+	}{
+		{0, 0, DefaultOffscreenCacheSize, DefaultOffscreenCacheEntries},
+		{2048, 50, 2048, 50},
+		{10000, 1000, capability.MaxOffscreenCacheSize, capability.MaxOffscreenCacheEntries},
+	} {
+		client := NewClient(&Option{Addr: "mock:3389", DrawingOrders: true, OffscreenCacheSize: tc.size, OffscreenCacheEntries: tc.entries})
+		offscreen := (&Capabilities{Sets: client.newConfirmActive(demand).CapabilitySets}).Find(capability.CAPSTYPE_OFFSCREENCACHE).(*capability.TsOffscreenCapabilitySet)
+		assert.Equal(t, uint32(t128.OFFSCREEN_SUPPORT_LEVEL_DEFAULT), offscreen.SupportLevel)
+		assert.Equal(t, tc.wantSize, offscreen.CacheSize)
+		assert.Equal(t, tc.wantEntries, offscreen.CacheEntries)
+		_, maxEntries := client.OffscreenSurfaces().GetStats()
+		assert.Equal(t, tc.wantEntries, maxEntries)
+	}
+
+	// without drawing orders there is nothing to draw offscreen with
+	client := NewClient(&Option{Addr: "mock:3389"})
+	offscreen := (&Capabilities{Sets: client.newConfirmActive(demand).CapabilitySets}).Find(capability.CAPSTYPE_OFFSCREENCACHE).(*capability.TsOffscreenCapabilitySet)
+	assert.Equal(t, uint32(t128.OFFSCREEN_SUPPORT_LEVEL_NONE), offscreen.SupportLevel)
+}
+
+// TestSharedCache checks that clients given one Option.SharedCache keep a
+// tile they both receive once, and hold the cache until closed
+func TestSharedCache(t *testing.T) {
+	shared := t128.NewSharedBitmapCache()
+	update := binary.LittleEndian.AppendUint16(nil, t128.UPDATETYPE_BITMAP)
+	update = binary.LittleEndian.AppendUint16(update, 1)
+	for _, v := range []uint16{0, 0, 1, 0, 2, 1, 8, t128.BITMAP_COMPRESSION | t128.NO_BITMAP_COMPRESSION_HDR, 3} {
+		update = binary.LittleEndian.AppendUint16(update, v)
+	}
+	update = append(update, 0x82, 1, 0)
+
+	var clients []*Client
+	for i := 0; i < 2; i++ {
+		client := NewClient(&Option{Addr: "mock:3389", SharedCache: shared})
+		server := newMockServer(t, client)
+		done := server.serve(func() {
+			fastpath.Write(server.Conn, append(binary.LittleEndian.AppendUint16([]byte{t128.FASTPATH_UPDATETYPE_BITMAP}, uint16(len(update))), update...))
+			server.Conn.Close()
+		})
+		assert.Error(t, client.Run(nil))
+		assert.NoError(t, <-done)
+		clients = append(clients, client)
+	}
+	assert.Same(t, clients[0].BitmapCache(), clients[1].BitmapCache())
+	stats := shared.Manager().GetCacheStats()
+	assert.Equal(t, 1, stats["stores"], "the tile is kept once")
+	assert.Equal(t, 1, stats["hits"], "the second session finds it")
+
+	assert.Equal(t, 2, shared.Refs())
+	clients[0].Close()
+	clients[0].Close()
+	assert.Equal(t, 1, shared.Refs(), "a client releases its reference once")
+	clients[1].Close()
+	assert.Zero(t, shared.Refs())
+	assert.Zero(t, shared.Manager().GetCacheStats()["cache_0"].(map[string]interface{})["entries"])
+}
+
+// TestSharedCacheEviction checks that a client sharing Option.SharedCache
+// does not evict the bitmaps the cells of another one refer to, and clears
+// only its own
+func TestSharedCacheEviction(t *testing.T) {
+	shared := t128.NewSharedBitmapCache()
+	a := NewClient(&Option{Addr: "mock:3389", SharedCache: shared})
+	b := NewClient(&Option{Addr: "mock:3389", SharedCache: shared})
+	pixel := func(key uint32, index uint16) *orders.CacheBitmap {
+		return &orders.CacheBitmap{CacheId: 2, CacheIndex: index, Key1: key, Width: 1, Height: 1, BitsPerPixel: 32,
+			Data: []byte{byte(key), 0x00, 0xFF, 0x00}}
+	}
+
+	a.cacheBitmap(pixel(1, 0))
+	// b stores more bitmaps than the cache holds, through a few cells
+	for i := 0; i < 200; i++ {
+		b.cacheBitmap(pixel(uint32(100+i), uint16(i%10)))
+	}
+	stats := shared.Manager().GetCacheStats()
+	assert.Equal(t, 100, stats["cache_2"].(map[string]interface{})["entries"])
+	assert.NotZero(t, stats["evictions"])
+	if img := a.cachedBitmap(2, 0); assert.NotNil(t, img, "evicted by the other client") {
+		assert.Equal(t, color.RGBA{R: 0xFF, B: 0x01, A: 0xFF}, img.At(0, 0))
+	}
+	for i := 0; i < 10; i++ {
+		assert.NotNil(t, b.cachedBitmap(2, uint16(i)))
+	}
+
+	b.ClearBitmapCache()
+	assert.Nil(t, b.cachedBitmap(2, 0))
+	assert.NotNil(t, a.cachedBitmap(2, 0), "cleared by the other client")
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	client := NewClientWithConn(local, &Option{Addr: "mock:3389"})
+	client.SetBandwidthLimit(10000)
+	stream := client.dial()
+	defer stream.Close()
+
+	received := make(chan []byte)
+	go func() {
+		data := make([]byte, 0, 12000)
+		buf := make([]byte, 4096)
+		for len(data) < cap(data) {
+			n, err := remote.Read(buf)
+			if err != nil {
+				break
+			}
+			data = append(data, buf[:n]...)
+		}
+		received <- data
+	}()
+
+	payload := bytes.Repeat([]byte("0123456789"), 1200)
+	start := time.Now()
+	_, err := stream.Write(payload[:10000]) // a second's worth goes right away
+	assert.NoError(t, err)
+	_, err = stream.Write(payload[10000:])
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond, "2000 bytes over the limit take 200ms")
+	assert.Equal(t, payload, <-received, "pacing delays data but keeps it whole")
+
+	client.SetBandwidthLimit(0)
+	start = time.Now()
+	go func() { _, _ = remote.Read(make([]byte, len(payload))) }()
+	_, err = stream.Write(payload)
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+}
+
+// TestBandwidthLimitCancel checks that a write waiting for the bandwidth
+// limit gives up on Close or Cancel, without holding up the stream meanwhile
+func TestBandwidthLimitCancel(t *testing.T) {
+	for name, stop := range map[string]func(c *Client, s *core.Stream){
+		"Close":  func(c *Client, s *core.Stream) { s.Close() },
+		"Cancel": func(c *Client, s *core.Stream) { c.Cancel() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer remote.Close()
+			go func() { _, _ = io.Copy(io.Discard, remote) }()
+			client := NewClientWithConn(local, &Option{Addr: "mock:3389"})
+			client.SetBandwidthLimit(1000)
+			stream := client.dial()
+			defer stream.Close()
+			_, err := stream.Write(make([]byte, 1000))
+			require.NoError(t, err)
+
+			waiting := make(chan error)
+			go func() {
+				_, err := stream.Write(make([]byte, 10000)) // ten seconds over the limit
+				waiting <- err
+			}()
+			time.Sleep(50 * time.Millisecond)
+			// lifted, the limit lets other writes through while the first
+			// one keeps its delay
+			client.SetBandwidthLimit(0)
+			start := time.Now()
+			_, err = stream.Write([]byte{1})
+			assert.NoError(t, err)
+			assert.Less(t, time.Since(start), time.Second)
+			stop(client, stream)
+			assert.ErrorIs(t, <-waiting, context.Canceled)
+			assert.Less(t, time.Since(start), time.Second)
+		})
+	}
+}
+
+// recordingClipboardHandler records the clipboard data it is given
+type recordingClipboardHandler struct {
+	clipboard.DefaultClipboardHandler
+	formats [][]clipboard.ClipboardFormat
+	data    map[clipboard.ClipboardFormat][]byte
+}
+
+func (h *recordingClipboardHandler) OnFormatList(formats []clipboard.ClipboardFormat) error {
+	h.formats = append(h.formats, formats)
+	return nil
+}
+
+func (h *recordingClipboardHandler) OnFormatDataResponse(formatID clipboard.ClipboardFormat, data []byte) error {
+	h.data[formatID] = data
+	return nil
+}
+
+func TestRequestClipboardData(t *testing.T) {
+	client, server := newMockSession(t)
+	handler := &recordingClipboardHandler{data: map[clipboard.ClipboardFormat][]byte{}}
+	assert.NoError(t, client.RegisterClipboardHandler(handler))
+	cliprdr, _ := client.vcManager.GetChannelByName(virtualchannel.CHANNEL_NAME_CLIPRDR)
+
+	assert.Empty(t, client.ClipboardFormats())
+	assert.ErrorIs(t, client.RequestClipboardData(clipboard.CLIPRDR_FORMAT_UNICODETEXT), clipboard.ErrFormatUnavailable)
+
+	// a copy on the server announces formats, and nothing is fetched
+	list := client.clipboardManager.CreateFormatListMessage([]clipboard.ClipboardFormat{clipboard.CLIPRDR_FORMAT_UNICODETEXT, clipboard.CLIPRDR_FORMAT_DIB})
+	assert.NoError(t, client.clipboardManager.ProcessMessage(list))
+	want := []clipboard.ClipboardFormat{clipboard.CLIPRDR_FORMAT_UNICODETEXT, clipboard.CLIPRDR_FORMAT_DIB, clipboard.CLIPRDR_FORMAT_PNG}
+	assert.Equal(t, [][]clipboard.ClipboardFormat{want}, handler.formats)
+	assert.Equal(t, want, client.ClipboardFormats())
+	assert.Empty(t, handler.data)
+
+	// until the app asks for the data
+	var request *clipboard.ClipboardMessage
+	done := server.serve(func() {
+		channelId, data := server.ReadMcsData()
+		assert.Equal(t, cliprdr.ID, channelId)
+		flags := binary.LittleEndian.Uint32(data[4:])
+		assert.Equal(t, uint32(virtualchannel.CHANNEL_FLAG_FIRST|virtualchannel.CHANNEL_FLAG_LAST), flags)
+		var err error
+		request, err = clipboard.ReadClipboardMessage(bytes.NewReader(data[8:]))
+		assert.NoError(t, err)
+	})
+	assert.NoError(t, client.RequestClipboardData(clipboard.CLIPRDR_FORMAT_UNICODETEXT))
+	assert.NoError(t, <-done)
+	assert.Equal(t, clipboard.CLIPRDR_MSG_TYPE_FORMAT_DATA_REQUEST, request.MessageType)
+	assert.Equal(t, uint32(clipboard.CLIPRDR_FORMAT_UNICODETEXT), binary.LittleEndian.Uint32(request.Data))
+
+	response := client.clipboardManager.CreateFormatDataResponseMessage(clipboard.CLIPRDR_FORMAT_UNICODETEXT, []byte("pasted"))
+	assert.NoError(t, client.clipboardManager.ProcessMessage(response))
+	assert.Equal(t, []byte("pasted"), handler.data[clipboard.CLIPRDR_FORMAT_UNICODETEXT])
+	assert.ErrorIs(t, client.RequestClipboardData(clipboard.CLIPRDR_FORMAT_HTML), clipboard.ErrFormatUnavailable)
+}
+
+func TestSetClipboardText(t *testing.T) {
+	client, server := newMockSession(t)
+	handler := &recordingClipboardHandler{data: map[clipboard.ClipboardFormat][]byte{}}
+	assert.NoError(t, client.RegisterClipboardHandler(handler))
+	cliprdr, _ := client.vcManager.GetChannelByName(virtualchannel.CHANNEL_NAME_CLIPRDR)
+	readMessage := func() *clipboard.ClipboardMessage {
+		channelId, data := server.ReadMcsData()
+		assert.Equal(t, cliprdr.ID, channelId)
+		msg, err := clipboard.ReadClipboardMessage(bytes.NewReader(data[8:]))
+		assert.NoError(t, err)
+		return msg
+	}
+
+	// a copy on the client announces the text
+	var list *clipboard.ClipboardMessage
+	done := server.serve(func() { list = readMessage() })
+	assert.NoError(t, client.SetClipboardText("copied\nhere"))
+	assert.NoError(t, <-done)
+	assert.Equal(t, clipboard.CLIPRDR_MSG_TYPE_FORMAT_LIST, list.MessageType)
+	assert.Equal(t, uint32(clipboard.CLIPRDR_FORMAT_UNICODETEXT), binary.LittleEndian.Uint32(list.Data))
+
+	// and a paste on the server is answered with it, not by the handler
+	request := client.clipboardManager.CreateFormatDataRequestMessage(clipboard.CLIPRDR_FORMAT_UNICODETEXT).Serialize()
+	var response *clipboard.ClipboardMessage
+	done = server.serve(func() {
+		// CHANNEL_PDU_HEADER, then the message
+		header := binary.LittleEndian.AppendUint32(nil, uint32(len(request)))
+		header = binary.LittleEndian.AppendUint32(header, virtualchannel.CHANNEL_FLAG_FIRST|virtualchannel.CHANNEL_FLAG_LAST)
+		server.WriteMcsData(cliprdr.ID, append(header, request...))
+		response = readMessage()
+	})
+	assert.NoError(t, core.Try(func() { client.readPdu() }))
+	assert.NoError(t, <-done)
+	assert.Equal(t, clipboard.CLIPRDR_MSG_TYPE_FORMAT_DATA_RESPONSE, response.MessageType)
+	assert.Equal(t, uint32(clipboard.CLIPRDR_FORMAT_UNICODETEXT), binary.LittleEndian.Uint32(response.Data))
+	assert.Equal(t, "copied\nhere", clipboard.DecodeUnicodeText(response.Data[4:]))
+
+	// an image is offered as PNG and DIB
+	done = server.serve(func() { list = readMessage() })
+	assert.NoError(t, client.SetClipboardImage(image.NewRGBA(image.Rect(0, 0, 2, 2))))
+	assert.NoError(t, <-done)
+	assert.Equal(t, []byte{0x13, 0, 0, 0, 0x08, 0, 0, 0}, list.Data)
+}
+
+// TestDeviceChannel checks that the rdpdr channel the server joins is set
+// up as it asks, and that devices added before are announced on it
+func TestDeviceChannel(t *testing.T) {
+	client, server := newMockSession(t)
+	assert.NoError(t, client.AnnounceDevice(device.DeviceTypeSmartCard, "SCARD", ""))
+	rdpdr := staticChannelId(client, virtualchannel.CHANNEL_NAME_RDPDR)
+	exchange := func(msg *device.DeviceMessage, replies int) []*device.DeviceMessage {
+		var got []*device.DeviceMessage
+		data := msg.Serialize()
+		done := server.serve(func() {
+			// CHANNEL_PDU_HEADER, then the message
+			header := binary.LittleEndian.AppendUint32(nil, uint32(len(data)))
+			header = binary.LittleEndian.AppendUint32(header, virtualchannel.CHANNEL_FLAG_FIRST|virtualchannel.CHANNEL_FLAG_LAST)
+			server.WriteMcsData(rdpdr, append(header, data...))
+			for i := 0; i < replies; i++ {
+				channelId, data := server.ReadMcsData()
+				assert.Equal(t, rdpdr, channelId)
+				reply, err := device.ReadDeviceMessage(bytes.NewReader(data[8:]))
+				assert.NoError(t, err)
+				got = append(got, reply)
+			}
+		})
+		assert.NoError(t, core.Try(func() { client.readPdu() }))
+		assert.NoError(t, <-done)
+		return got
+	}
+	message := func(packetID device.CoreMessageType, data []byte) *device.DeviceMessage {
+		return &device.DeviceMessage{ComponentID: device.RDPDR_CTYP_CORE, PacketID: uint16(packetID), Data: data}
+	}
+
+	replies := exchange(message(device.PAKID_CORE_SERVER_ANNOUNCE, []byte{0x01, 0x00, 0x0D, 0x00, 0x02, 0x00, 0x00, 0x00}), 2)
+	assert.Equal(t, uint16(device.PAKID_CORE_CLIENTID_CONFIRM), replies[0].PacketID)
+	assert.Equal(t, []byte{0x01, 0x00, 0x0C, 0x00, 0x02, 0x00, 0x00, 0x00}, replies[0].Data)
+	assert.Equal(t, uint16(device.PAKID_CORE_CLIENT_NAME), replies[1].PacketID)
+	replies = exchange(message(device.PAKID_CORE_SERVER_CAPABILITY, []byte{0x00, 0x00, 0x00, 0x00}), 1)
+	assert.Equal(t, uint16(device.PAKID_CORE_CLIENT_CAPABILITY), replies[0].PacketID)
+	replies = exchange(message(device.PAKID_CORE_CLIENTID_CONFIRM, []byte{0x01, 0x00, 0x0C, 0x00, 0x02, 0x00, 0x00, 0x00}), 1)
+	assert.Equal(t, uint16(device.PAKID_CORE_DEVICE_ANNOUNCE), replies[0].PacketID)
+	assert.Equal(t, []byte{
+		0x01, 0x00, 0x00, 0x00,
+		0x20, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		'S', 'C', 'A', 'R', 'D', 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	}, replies[0].Data)
+}
+
+// testLogger records the messages it is given
+type testLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) log(f string, v ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(f, v...))
+}
+
+func (l *testLogger) Debugf(f string, v ...any) { l.log(f, v...) }
+func (l *testLogger) Infof(f string, v ...any)  { l.log(f, v...) }
+func (l *testLogger) Warnf(f string, v ...any)  { l.log(f, v...) }
+func (l *testLogger) Errorf(f string, v ...any) { l.log(f, v...) }
+
+func TestOptionLogger(t *testing.T) {
+	t.Cleanup(func() { SetLogger(nil) })
+	logger := &testLogger{}
+	NewClient(&Option{Addr: "mock:3389", Logger: logger})
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	assert.Contains(t, logger.messages, "Bitmap cache manager initialized with 3 caches")
+}
+
+// tlsCertificate returns a self-signed certificate for the TLS servers of
+// tests
+func tlsCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "rdp.example.com"},
+		DNSNames:     []string{"rdp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSConfig(t *testing.T) {
+	cert := tlsCertificate(t)
+	handshake := func(opt *Option, server *tls.Config) (tls.ConnectionState, error) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		go func() {
+			defer serverConn.Close()
+			_ = tls.Server(serverConn, server).Handshake()
+		}()
+		stream := core.NewStreamFromConn(clientConn)
+		err := core.Try(func() { stream.SwitchSSL(NewClient(opt).tlsConfig()) })
+		state, _ := stream.TLSState()
+		return state, err
+	}
+
+	t.Run("default refuses TLS 1.1", func(t *testing.T) {
+		_, err := handshake(&Option{Addr: "rdp.example.com:3389"}, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS10,
+			MaxVersion:   tls.VersionTLS11,
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("default refuses weak cipher suites", func(t *testing.T) {
+		_, err := handshake(&Option{Addr: "rdp.example.com:3389"}, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MaxVersion:   tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("default", func(t *testing.T) {
+		state, err := handshake(&Option{Addr: "rdp.example.com:3389"}, &tls.Config{Certificates: []tls.Certificate{cert}})
+		require.NoError(t, err)
+		assert.Equal(t, uint16(tls.VersionTLS13), state.Version)
+	})
+
+	t.Run("option", func(t *testing.T) {
+		roots := x509.NewCertPool()
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		roots.AddCert(leaf)
+		opt := &Option{Addr: "rdp.example.com:3389", TLSConfig: &tls.Config{
+			RootCAs:      roots,
+			MinVersion:   tls.VersionTLS12,
+			MaxVersion:   tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+		}}
+		state, err := handshake(opt, &tls.Config{Certificates: []tls.Certificate{cert}})
+		require.NoError(t, err)
+		assert.Equal(t, uint16(tls.VersionTLS12), state.Version)
+		assert.Equal(t, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, state.CipherSuite)
+		assert.Equal(t, "rdp.example.com", state.ServerName)
+		assert.Empty(t, opt.TLSConfig.ServerName, "the option is left as it is")
+
+		// the certificate is verified against the name of Addr
+		opt.Addr = "other.example.com:3389"
+		_, err = handshake(opt, &tls.Config{Certificates: []tls.Certificate{cert}})
+		assert.Error(t, err)
+	})
+}
+
+func TestMaxPDUSize(t *testing.T) {
+	client, server := newMockSession(t)
+	var sizes []int
+	client.option.OnRawPDU = func(direction string, data []byte) { sizes = append(sizes, len(data)) }
+	cliprdr, _ := client.vcManager.GetChannelByName(virtualchannel.CHANNEL_NAME_CLIPRDR)
+
+	// send sends data on cliprdr and returns the flags and data of the chunks
+	send := func(data []byte) ([]uint32, []byte) {
+		var flags []uint32
+		var received []byte
+		done := server.serve(func() {
+			for len(received) < len(data) {
+				channelId, chunk := server.ReadMcsData()
+				assert.Equal(t, cliprdr.ID, channelId)
+				assert.Equal(t, uint32(len(data)), binary.LittleEndian.Uint32(chunk))
+				flags = append(flags, binary.LittleEndian.Uint32(chunk[4:]))
+				received = append(received, chunk[8:]...)
+			}
+		})
+		require.NoError(t, client.SendVirtualChannelData(virtualchannel.CHANNEL_NAME_CLIPRDR, data, virtualchannel.CHANNEL_FLAG_SHOW_PROTOCOL))
+		require.NoError(t, <-done)
+		return flags, received
+	}
+	data := bytes.Repeat([]byte("0123456789"), 400)
+
+	// chunks of CHANNEL_CHUNK_LENGTH by default
+	flags, received := send(data)
+	assert.Equal(t, data, received)
+	assert.Equal(t, []uint32{
+		virtualchannel.CHANNEL_FLAG_FIRST | virtualchannel.CHANNEL_FLAG_SHOW_PROTOCOL,
+		virtualchannel.CHANNEL_FLAG_SHOW_PROTOCOL,
+		virtualchannel.CHANNEL_FLAG_LAST | virtualchannel.CHANNEL_FLAG_SHOW_PROTOCOL,
+	}, flags)
+
+	// within the cap
+	client.option.MaxPDUSize = 512
+	sizes = nil
+	flags, received = send(data)
+	assert.Equal(t, data, received)
+	assert.Len(t, flags, 9)
+	for _, size := range sizes {
+		assert.LessOrEqual(t, size, 512)
+	}
+
+	// small caps are raised to MinPDUSize
+	client.option.MaxPDUSize = 10
+	assert.Equal(t, MinPDUSize-channelPDUOverhead, client.channelChunkSize())
+
+	// and the chunk size is announced
+	client.option.MaxPDUSize = 512
+	confirm := client.newConfirmActive(&t128.TsDemandActivePduData{SharedId: mockShareId})
+	vc := (&Capabilities{Sets: confirm.CapabilitySets}).Find(capability.CAPSTYPE_VIRTUALCHANNEL).(*capability.TsVirtualChannelCapabilitySet)
+	assert.Equal(t, uint32(512-channelPDUOverhead), vc.VCChunkSize)
+}
+
+func TestInboundPDUSize(t *testing.T) {
+	client, server := newMockSession(t)
+	var lengthErr *core.LengthError
+
+	// a send data indication longer than its PDU
+	done := server.serve(func() {
+		buff := new(bytes.Buffer)
+		mcs.WriteMcsPduHeader(buff, mcs.MCS_PDUTYPE_SEND_DATA_INDICATION, 0)
+		per.WriteInteger16(buff, mockServerChannel-mcs.MCS_CHANNEL_USERID_BASE)
+		per.WriteInteger16(buff, mcs.MCS_CHANNEL_GLOBAL)
+		per.WriteInteger8(buff, 0x70)
+		per.WriteLength(buff, 0x4000)
+		buff.WriteString("short")
+		x224.Write(server.Conn, buff.Bytes())
+	})
+	err := core.Try(func() { client.readPdu() })
+	require.ErrorAs(t, err, &lengthErr)
+	assert.Equal(t, 0x4000, lengthErr.Length)
+	assert.NoError(t, <-done)
+
+	// a fast-path PDU shorter than its header
+	done = server.serve(func() {
+		_, err := server.Conn.Write([]byte{0x00, 0x01})
+		assert.NoError(t, err)
+	})
+	err = core.Try(func() { client.readPdu() })
+	require.ErrorAs(t, err, &lengthErr)
+	assert.Equal(t, "fast-path", lengthErr.Field)
+	assert.NoError(t, <-done)
+
+	// PDUs above Option.MaxInboundPDUSize are refused from their header
+	client.option.MaxInboundPDUSize = 1024
+	for _, header := range [][]byte{{0x03, 0x00, 0x08, 0x00}, {0x00, 0x88, 0x00}} {
+		server = newMockServer(t, client)
+		done = server.serve(func() {
+			_, err := server.Conn.Write(header)
+			assert.NoError(t, err)
+		})
+		err = core.Try(func() { client.readPdu() })
+		require.ErrorAs(t, err, &lengthErr)
+		assert.Equal(t, 0x800, lengthErr.Length)
+		assert.Equal(t, 1024, lengthErr.Max)
+		assert.NoError(t, <-done)
+	}
+
+	// smaller ones are read
+	server = newMockServer(t, client)
+	done = server.serve(func() {
+		fastpath.Write(server.Conn, []byte{t128.FASTPATH_UPDATETYPE_SYNCHRONIZE, 0x00, 0x00})
+	})
+	assert.NoError(t, core.Try(func() { client.readPdu() }))
+	assert.NoError(t, <-done)
+}
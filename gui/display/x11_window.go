@@ -0,0 +1,381 @@
+package display
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"math/bits"
+	"sync"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xproto"
+	"github.com/kdsmith18542/gordp"
+	"github.com/kdsmith18542/gordp/proto/bitmap"
+	"github.com/kdsmith18542/gordp/proto/t128"
+)
+
+// InputSink receives the keyboard and mouse input of an X11Window
+type InputSink interface {
+	MouseMove(x, y int) error
+	MouseButton(button t128.MouseButton, down bool, x, y int) error
+	MouseWheel(delta int, horizontal bool, x, y int) error
+	ScanCode(code uint16, down bool) error
+}
+
+// ClientInput returns an InputSink sending input to client
+func ClientInput(client *gordp.Client) InputSink {
+	return clientInput{client}
+}
+
+type clientInput struct {
+	client *gordp.Client
+}
+
+func (c clientInput) MouseMove(x, y int) error {
+	return c.client.SendMouseMoveEvent(uint16(x), uint16(y))
+}
+
+func (c clientInput) MouseButton(button t128.MouseButton, down bool, x, y int) error {
+	return c.client.SendMouseButtonEvent(button, down, uint16(x), uint16(y))
+}
+
+func (c clientInput) MouseWheel(delta int, horizontal bool, x, y int) error {
+	if horizontal {
+		return c.client.SendMouseHorizontalWheelEvent(int16(delta), uint16(x), uint16(y))
+	}
+	return c.client.SendMouseWheelEvent(int16(delta), uint16(x), uint16(y))
+}
+
+func (c clientInput) ScanCode(code uint16, down bool) error {
+	return c.client.SendScanCode(code, down, false)
+}
+
+// putImageHeader is the size in bytes of a PutImage request without its
+// data
+const putImageHeader = 24
+
+// X11Window shows the remote desktop in a window on the X server of
+// $DISPLAY. It speaks the X protocol itself, so it needs neither a GUI
+// toolkit nor cgo. It is a gordp.Processor drawing every bitmap update into
+// the window, and sends the keyboard and mouse input on the window to an
+// InputSink, keys by scancode so the layout of the session applies.
+type X11Window struct {
+	conn       *xgb.Conn
+	window     xproto.Window
+	gc         xproto.Gcontext
+	depth      byte
+	format     pixelFormat
+	maxRequest int // bytes
+	protocols  xproto.Atom
+	delete     xproto.Atom
+
+	mu      sync.Mutex
+	surface *image.RGBA
+
+	sink      InputSink
+	closeOnce sync.Once
+}
+
+// NewX11Window opens a black width x height window titled title, sending
+// its input to sink. Run handles its events.
+func NewX11Window(width, height int, title string, sink InputSink) (*X11Window, error) {
+	conn, err := xgb.NewConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the X server: %w", err)
+	}
+	w, err := newX11Window(conn, width, height, title, sink)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func newX11Window(conn *xgb.Conn, width, height int, title string, sink InputSink) (*X11Window, error) {
+	if width <= 0 || height <= 0 || width > 0xFFFF || height > 0xFFFF {
+		return nil, fmt.Errorf("invalid window size %dx%d", width, height)
+	}
+	setup := xproto.Setup(conn)
+	screen := setup.DefaultScreen(conn)
+	format, err := newPixelFormat(setup, screen)
+	if err != nil {
+		return nil, err
+	}
+	w := &X11Window{
+		conn:       conn,
+		depth:      screen.RootDepth,
+		format:     format,
+		maxRequest: int(setup.MaximumRequestLength) * 4,
+		surface:    image.NewRGBA(image.Rect(0, 0, width, height)),
+		sink:       sink,
+	}
+	if putImageHeader+width*4 > w.maxRequest {
+		return nil, fmt.Errorf("window width %d exceeds the X request size", width)
+	}
+	draw.Draw(w.surface, w.surface.Bounds(), image.Black, image.Point{}, draw.Src)
+
+	if w.window, err = xproto.NewWindowId(conn); err != nil {
+		return nil, err
+	}
+	if w.gc, err = xproto.NewGcontextId(conn); err != nil {
+		return nil, err
+	}
+	events := uint32(xproto.EventMaskExposure | xproto.EventMaskKeyPress | xproto.EventMaskKeyRelease |
+		xproto.EventMaskButtonPress | xproto.EventMaskButtonRelease | xproto.EventMaskPointerMotion)
+	err = xproto.CreateWindowChecked(conn, screen.RootDepth, w.window, screen.Root, 0, 0, uint16(width), uint16(height), 0,
+		xproto.WindowClassInputOutput, screen.RootVisual, xproto.CwBackPixel|xproto.CwEventMask,
+		[]uint32{screen.BlackPixel, events}).Check()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the window: %w", err)
+	}
+	xproto.CreateGC(conn, w.gc, xproto.Drawable(w.window), 0, nil)
+	xproto.ChangeProperty(conn, xproto.PropModeReplace, w.window, xproto.AtomWmName, xproto.AtomString, 8,
+		uint32(len(title)), []byte(title))
+
+	// ask the window manager for a message rather than a killed connection
+	// when the window is closed
+	if w.protocols, err = internAtom(conn, "WM_PROTOCOLS"); err != nil {
+		return nil, err
+	}
+	if w.delete, err = internAtom(conn, "WM_DELETE_WINDOW"); err != nil {
+		return nil, err
+	}
+	xproto.ChangeProperty(conn, xproto.PropModeReplace, w.window, w.protocols, xproto.AtomAtom, 32, 1,
+		binary.LittleEndian.AppendUint32(nil, uint32(w.delete)))
+
+	xproto.MapWindow(conn, w.window)
+	return w, nil
+}
+
+func internAtom(conn *xgb.Conn, name string) (xproto.Atom, error) {
+	reply, err := xproto.InternAtom(conn, false, uint16(len(name)), name).Reply()
+	if err != nil {
+		return 0, fmt.Errorf("failed to intern atom %s: %w", name, err)
+	}
+	return reply.Atom, nil
+}
+
+// ProcessBitmap draws a bitmap update into the window
+func (w *X11Window) ProcessBitmap(option *bitmap.Option, bmp *bitmap.BitMap) {
+	if option == nil || bmp == nil || bmp.Image == nil {
+		return
+	}
+	r := image.Rect(option.Left, option.Top, option.Left+option.Width, option.Top+option.Height)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r = r.Intersect(w.surface.Bounds())
+	if r.Empty() {
+		return
+	}
+	draw.Draw(w.surface, r, bmp.Image, bmp.Image.Bounds().Min, draw.Src)
+	w.put(r)
+}
+
+// put sends the r part of the surface to the window, in as many PutImage
+// requests as the maximum request size of the server needs. The caller
+// holds w.mu.
+func (w *X11Window) put(r image.Rectangle) {
+	rows := (w.maxRequest - putImageHeader) / (r.Dx() * 4)
+	for y := r.Min.Y; y < r.Max.Y; y += rows {
+		strip := image.Rect(r.Min.X, y, r.Max.X, min(y+rows, r.Max.Y))
+		xproto.PutImage(w.conn, xproto.ImageFormatZPixmap, xproto.Drawable(w.window), w.gc,
+			uint16(strip.Dx()), uint16(strip.Dy()), int16(strip.Min.X), int16(strip.Min.Y), 0, w.depth,
+			w.format.encode(w.surface, strip))
+	}
+}
+
+// Run handles the events of the window until it is closed, by the user or
+// Close, or the connection to the X server is lost. It returns the first
+// error of the InputSink.
+func (w *X11Window) Run() error {
+	for {
+		ev, xerr := w.conn.WaitForEvent()
+		if ev == nil && xerr == nil {
+			return nil
+		}
+		if ev == nil {
+			// an error of a request not checked; the window goes on
+			continue
+		}
+		closed, err := w.handleEvent(ev)
+		if err != nil || closed {
+			w.Close()
+			return err
+		}
+	}
+}
+
+// Close closes the window and the connection to the X server
+func (w *X11Window) Close() error {
+	w.closeOnce.Do(func() {
+		xproto.DestroyWindow(w.conn, w.window)
+		w.conn.Close()
+	})
+	return nil
+}
+
+// handleEvent passes the input of ev to the sink and repaints what ev
+// exposed, reporting whether the user closed the window
+func (w *X11Window) handleEvent(ev xgb.Event) (closed bool, err error) {
+	switch e := ev.(type) {
+	case xproto.ExposeEvent:
+		w.mu.Lock()
+		r := image.Rect(int(e.X), int(e.Y), int(e.X)+int(e.Width), int(e.Y)+int(e.Height)).Intersect(w.surface.Bounds())
+		if !r.Empty() {
+			w.put(r)
+		}
+		w.mu.Unlock()
+	case xproto.KeyPressEvent:
+		if code, ok := x11ScanCode(e.Detail); ok {
+			err = w.sink.ScanCode(code, true)
+		}
+	case xproto.KeyReleaseEvent:
+		if code, ok := x11ScanCode(e.Detail); ok {
+			err = w.sink.ScanCode(code, false)
+		}
+	case xproto.MotionNotifyEvent:
+		x, y := w.clamp(e.EventX, e.EventY)
+		err = w.sink.MouseMove(x, y)
+	case xproto.ButtonPressEvent:
+		err = w.button(e.Detail, true, e.EventX, e.EventY)
+	case xproto.ButtonReleaseEvent:
+		err = w.button(e.Detail, false, e.EventX, e.EventY)
+	case xproto.ClientMessageEvent:
+		closed = e.Type == w.protocols && xproto.Atom(e.Data.Data32[0]) == w.delete
+	}
+	return closed, err
+}
+
+// button passes a press or release of X pointer button to the sink:
+// buttons 4 to 7 are the clicks of the vertical and horizontal wheel, 8 and
+// 9 the back and forward buttons
+func (w *X11Window) button(button xproto.Button, down bool, ex, ey int16) error {
+	x, y := w.clamp(ex, ey)
+	switch button {
+	case 1:
+		return w.sink.MouseButton(t128.MouseButtonLeft, down, x, y)
+	case 2:
+		return w.sink.MouseButton(t128.MouseButtonMiddle, down, x, y)
+	case 3:
+		return w.sink.MouseButton(t128.MouseButtonRight, down, x, y)
+	case 8:
+		return w.sink.MouseButton(t128.MouseButtonX1, down, x, y)
+	case 9:
+		return w.sink.MouseButton(t128.MouseButtonX2, down, x, y)
+	}
+	if !down {
+		return nil
+	}
+	switch button {
+	case 4:
+		return w.sink.MouseWheel(120, false, x, y)
+	case 5:
+		return w.sink.MouseWheel(-120, false, x, y)
+	case 6:
+		return w.sink.MouseWheel(-120, true, x, y)
+	case 7:
+		return w.sink.MouseWheel(120, true, x, y)
+	}
+	return nil
+}
+
+// clamp keeps a pointer position on the desktop, as a drag out of the
+// window reports positions off it
+func (w *X11Window) clamp(x, y int16) (int, int) {
+	bounds := w.surface.Bounds()
+	return min(max(int(x), 0), bounds.Dx()-1), min(max(int(y), 0), bounds.Dy()-1)
+}
+
+// x11ExtendedScanCodes maps the X keycodes of the keys whose scancodes
+// carry the 0xE0 prefix. X servers number keys by Linux input code plus 8.
+var x11ExtendedScanCodes = map[xproto.Keycode]uint16{
+	104: 0xE01C, // keypad Enter
+	105: 0xE01D, // right Ctrl
+	106: 0xE035, // keypad /
+	107: 0xE037, // Print Screen
+	108: 0xE038, // right Alt
+	110: 0xE047, // Home
+	111: 0xE048, // Up
+	112: 0xE049, // Page Up
+	113: 0xE04B, // Left
+	114: 0xE04D, // Right
+	115: 0xE04F, // End
+	116: 0xE050, // Down
+	117: 0xE051, // Page Down
+	118: 0xE052, // Insert
+	119: 0xE053, // Delete
+	133: 0xE05B, // left Windows
+	134: 0xE05C, // right Windows
+	135: 0xE05D, // Menu
+}
+
+// x11ScanCode returns the scancode (set 1) of the key of an X keycode.
+// Linux input codes 1 to 88 are the scancodes themselves.
+func x11ScanCode(keycode xproto.Keycode) (uint16, bool) {
+	if keycode >= 9 && keycode <= 96 {
+		return uint16(keycode - 8), true
+	}
+	code, ok := x11ExtendedScanCodes[keycode]
+	return code, ok
+}
+
+// pixelFormat packs colors into the pixels of a TrueColor visual
+type pixelFormat struct {
+	red, green, blue uint32 // masks of the visual
+	order            binary.AppendByteOrder
+}
+
+// newPixelFormat returns the format of the root visual of screen, which
+// must be TrueColor with 32 bits per pixel
+func newPixelFormat(setup *xproto.SetupInfo, screen *xproto.ScreenInfo) (pixelFormat, error) {
+	var f pixelFormat
+	bpp := 0
+	for _, format := range setup.PixmapFormats {
+		if format.Depth == screen.RootDepth {
+			bpp = int(format.BitsPerPixel)
+		}
+	}
+	if bpp != 32 {
+		return f, fmt.Errorf("unsupported X pixmap format: depth %d at %d bits per pixel", screen.RootDepth, bpp)
+	}
+	for _, depth := range screen.AllowedDepths {
+		for _, visual := range depth.Visuals {
+			if visual.VisualId == screen.RootVisual && visual.Class == xproto.VisualClassTrueColor {
+				f.red, f.green, f.blue = visual.RedMask, visual.GreenMask, visual.BlueMask
+			}
+		}
+	}
+	if f.red == 0 || f.green == 0 || f.blue == 0 {
+		return f, fmt.Errorf("unsupported X visual: not TrueColor")
+	}
+	f.order = binary.LittleEndian
+	if setup.ImageByteOrder == xproto.ImageOrderMSBFirst {
+		f.order = binary.BigEndian
+	}
+	return f, nil
+}
+
+// encode returns the pixels of the r part of img as ZPixmap image data
+func (f pixelFormat) encode(img *image.RGBA, r image.Rectangle) []byte {
+	data := make([]byte, 0, r.Dx()*r.Dy()*4)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			p := channel(img.Pix[i], f.red) | channel(img.Pix[i+1], f.green) | channel(img.Pix[i+2], f.blue)
+			data = f.order.AppendUint32(data, p)
+		}
+	}
+	return data
+}
+
+// channel places the 8-bit value v in the bits of mask
+func channel(v uint8, mask uint32) uint32 {
+	width := bits.OnesCount32(mask)
+	value := uint32(v)
+	if width < 8 {
+		value >>= 8 - width
+	}
+	return value << bits.TrailingZeros32(mask) & mask
+}
@@ -0,0 +1,253 @@
+package display
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xproto"
+	"github.com/kdsmith18542/gordp/proto/bitmap"
+	"github.com/kdsmith18542/gordp/proto/t128"
+)
+
+type recordingSink struct {
+	events []string
+}
+
+func (s *recordingSink) MouseMove(x, y int) error {
+	s.events = append(s.events, fmt.Sprintf("move %d,%d", x, y))
+	return nil
+}
+
+func (s *recordingSink) MouseButton(button t128.MouseButton, down bool, x, y int) error {
+	s.events = append(s.events, fmt.Sprintf("button %d %v %d,%d", button, down, x, y))
+	return nil
+}
+
+func (s *recordingSink) MouseWheel(delta int, horizontal bool, x, y int) error {
+	s.events = append(s.events, fmt.Sprintf("wheel %d %v %d,%d", delta, horizontal, x, y))
+	return nil
+}
+
+func (s *recordingSink) ScanCode(code uint16, down bool) error {
+	s.events = append(s.events, fmt.Sprintf("key 0x%X %v", code, down))
+	return nil
+}
+
+// putImage is a PutImage request received by a fakeX
+type putImage struct {
+	rect image.Rectangle
+	data []byte
+}
+
+// fakeX is an X server with a single 24-bit TrueColor screen that answers
+// the requests of an X11Window and records the images put
+type fakeX struct {
+	conn net.Conn
+	mu   sync.Mutex // serializes writes
+	puts chan putImage
+}
+
+const (
+	fakeRoot   = 0x100
+	fakeVisual = 0x21
+
+	// opcodes of the requests a fakeX answers
+	opInternAtom    = 16
+	opGetInputFocus = 43
+	opPutImage      = 72
+)
+
+// newFakeX returns an X connection to a fake server
+func newFakeX(t *testing.T, maxRequest uint16) (*xgb.Conn, *fakeX) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	x := &fakeX{conn: server, puts: make(chan putImage, 64)}
+	go x.serve(maxRequest)
+	conn, err := xgb.NewConnNet(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	return conn, x
+}
+
+func (x *fakeX) write(b []byte) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.conn.Write(b)
+}
+
+func (x *fakeX) serve(maxRequest uint16) {
+	var head [12]byte
+	if _, err := io.ReadFull(x.conn, head[:]); err != nil {
+		return
+	}
+	auth := make([]byte, xgb.Pad(int(xgb.Get16(head[6:])))+xgb.Pad(int(xgb.Get16(head[8:]))))
+	io.ReadFull(x.conn, auth)
+
+	setup := xproto.SetupInfo{
+		Status:               1,
+		ProtocolMajorVersion: 11,
+		ResourceIdBase:       0x200000,
+		ResourceIdMask:       0x1FFFFF,
+		MaximumRequestLength: maxRequest,
+		RootsLen:             1,
+		PixmapFormatsLen:     1,
+		MinKeycode:           8,
+		MaxKeycode:           255,
+		PixmapFormats:        []xproto.Format{{Depth: 24, BitsPerPixel: 32, ScanlinePad: 32}},
+		Roots: []xproto.ScreenInfo{{
+			Root:             fakeRoot,
+			WidthInPixels:    1920,
+			HeightInPixels:   1080,
+			RootVisual:       fakeVisual,
+			RootDepth:        24,
+			AllowedDepthsLen: 1,
+			AllowedDepths: []xproto.DepthInfo{{Depth: 24, VisualsLen: 1, Visuals: []xproto.VisualInfo{{
+				VisualId: fakeVisual, Class: xproto.VisualClassTrueColor, BitsPerRgbValue: 8,
+				RedMask: 0xFF0000, GreenMask: 0x00FF00, BlueMask: 0x0000FF,
+			}}}},
+		}},
+	}
+	b := setup.Bytes()
+	xgb.Put16(b[6:], uint16((len(b)-8)/4))
+	x.write(b)
+
+	for seq := uint16(1); ; seq++ {
+		var req [4]byte
+		if _, err := io.ReadFull(x.conn, req[:]); err != nil {
+			return
+		}
+		body := make([]byte, int(xgb.Get16(req[2:]))*4-4)
+		if _, err := io.ReadFull(x.conn, body); err != nil {
+			return
+		}
+		reply := make([]byte, 32)
+		reply[0] = 1
+		xgb.Put16(reply[2:], seq)
+		switch req[0] {
+		case opInternAtom:
+			xgb.Put32(reply[8:], 0x40+uint32(seq))
+			x.write(reply)
+		case opGetInputFocus:
+			x.write(reply)
+		case opPutImage:
+			w, h := int(xgb.Get16(body[8:])), int(xgb.Get16(body[10:]))
+			left, top := int(int16(xgb.Get16(body[12:]))), int(int16(xgb.Get16(body[14:])))
+			x.puts <- putImage{image.Rect(left, top, left+w, top+h), body[20:]}
+		}
+	}
+}
+
+func TestX11Window(t *testing.T) {
+	// room for 4 rows of 16 pixels a request
+	conn, x := newFakeX(t, (putImageHeader+4*16*4)/4)
+	sink := &recordingSink{}
+	w, err := newX11Window(conn, 16, 12, "test", sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 16, 6))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	img.Set(0, 0, color.RGBA{R: 0x12, G: 0x34, B: 0x56, A: 0xFF})
+	w.ProcessBitmap(&bitmap.Option{Left: 0, Top: 3, Width: 16, Height: 6}, &bitmap.BitMap{Image: img})
+	var got []putImage
+	for _, want := range []image.Rectangle{image.Rect(0, 3, 16, 7), image.Rect(0, 7, 16, 9)} {
+		select {
+		case put := <-x.puts:
+			if put.rect != want {
+				t.Errorf("put %v, want %v", put.rect, want)
+			}
+			got = append(got, put)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no PutImage request")
+		}
+	}
+	if pixel := binary.LittleEndian.Uint32(got[0].data); pixel != 0x123456 {
+		t.Errorf("first pixel 0x%06X, want 0x123456", pixel)
+	}
+	if len(got[1].data) != 16*2*4 {
+		t.Errorf("%d bytes of image data, want %d", len(got[1].data), 16*2*4)
+	}
+
+	// an exposed window is painted again from the surface
+	w.handleEvent(xproto.ExposeEvent{X: 2, Y: 4, Width: 3, Height: 1})
+	select {
+	case put := <-x.puts:
+		if want := image.Rect(2, 4, 5, 5); put.rect != want {
+			t.Errorf("put %v, want %v", put.rect, want)
+		}
+		if !bytes.Equal(put.data, bytes.Repeat([]byte{0xFF, 0xFF, 0xFF, 0}, 3)) {
+			t.Errorf("exposed data % X", put.data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expose not repainted")
+	}
+
+	for _, ev := range []xgb.Event{
+		xproto.KeyPressEvent{Detail: 38}, // A
+		xproto.KeyReleaseEvent{Detail: 38},
+		xproto.KeyPressEvent{Detail: 111}, // Up
+		xproto.KeyPressEvent{Detail: 200}, // no key
+		xproto.MotionNotifyEvent{EventX: 5, EventY: 6},
+		xproto.MotionNotifyEvent{EventX: -3, EventY: 40}, // dragged off the window
+		xproto.ButtonPressEvent{Detail: 3, EventX: 1, EventY: 2},
+		xproto.ButtonReleaseEvent{Detail: 3, EventX: 1, EventY: 2},
+		xproto.ButtonPressEvent{Detail: 5, EventX: 1, EventY: 2},
+		xproto.ButtonReleaseEvent{Detail: 5, EventX: 1, EventY: 2},
+		xproto.ButtonPressEvent{Detail: 7, EventX: 1, EventY: 2},
+	} {
+		if closed, err := w.handleEvent(ev); closed || err != nil {
+			t.Fatalf("%v: closed %v, error %v", ev, closed, err)
+		}
+	}
+	want := []string{
+		"key 0x1E true", "key 0x1E false", "key 0xE048 true",
+		"move 5,6", "move 0,11",
+		fmt.Sprintf("button %d true 1,2", t128.MouseButtonRight),
+		fmt.Sprintf("button %d false 1,2", t128.MouseButtonRight),
+		"wheel -120 false 1,2", "wheel 120 true 1,2",
+	}
+	if fmt.Sprint(sink.events) != fmt.Sprint(want) {
+		t.Errorf("input %q, want %q", sink.events, want)
+	}
+
+	// closing the window ends Run
+	done := make(chan error, 1)
+	go func() { done <- w.Run() }()
+	msg := xproto.ClientMessageEvent{Format: 32, Window: w.window, Type: w.protocols,
+		Data: xproto.ClientMessageDataUnionData32New([]uint32{uint32(w.delete), 0, 0, 0, 0})}
+	x.write(msg.Bytes())
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return when the window was closed")
+	}
+}
+
+func TestX11WindowSize(t *testing.T) {
+	conn, _ := newFakeX(t, 0xFFFF)
+	for _, size := range [][2]int{{0, 0}, {640, 0}, {0, 480}, {-1, 480}, {0x10000, 480}} {
+		if _, err := newX11Window(conn, size[0], size[1], "test", &recordingSink{}); err == nil {
+			t.Errorf("%dx%d: no error", size[0], size[1])
+		}
+	}
+}
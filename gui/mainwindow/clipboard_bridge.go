@@ -0,0 +1,229 @@
+package mainwindow
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/png"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kdsmith18542/gordp"
+	"github.com/kdsmith18542/gordp/proto/clipboard"
+)
+
+// clipboardPollInterval is how often the host clipboard is checked for
+// changes, having no notification of them without a GUI toolkit
+const clipboardPollInterval = 500 * time.Millisecond
+
+// errImageUnsupported is returned by a host clipboard without images
+var errImageUnsupported = errors.New("clipboard images not supported on this platform")
+
+// systemClipboard is the clipboard of the host OS
+type systemClipboard interface {
+	ReadText() (string, error)
+	WriteText(text string) error
+	// ReadImage and WriteImage take images as PNG
+	ReadImage() ([]byte, error)
+	WriteImage(png []byte) error
+}
+
+// ClipboardBridge keeps the clipboards of the host and of the session in
+// step: a copy on the server is fetched and put on the host clipboard, and a
+// copy on the host is put on the session's. It is the clipboard handler of
+// the client, see gordp.Client.RegisterClipboardHandler.
+type ClipboardBridge struct {
+	clipboard.DefaultClipboardHandler
+
+	client *gordp.Client
+	system systemClipboard
+
+	// what was last on the host clipboard, so that a copy is not sent back
+	// to where it came from
+	mu        sync.Mutex
+	lastText  string
+	lastImage []byte
+	stop      chan struct{}
+}
+
+// NewClipboardBridge creates a bridge between the host clipboard and the
+// session of client
+func NewClipboardBridge(client *gordp.Client) *ClipboardBridge {
+	return &ClipboardBridge{client: client, system: commandClipboard{}}
+}
+
+// OnFormatList fetches the text or, without any, the image the server copied
+func (b *ClipboardBridge) OnFormatList(formats []clipboard.ClipboardFormat) error {
+	for _, format := range []clipboard.ClipboardFormat{clipboard.CLIPRDR_FORMAT_UNICODETEXT, clipboard.CLIPRDR_FORMAT_PNG} {
+		for _, offered := range formats {
+			if offered == format {
+				return b.client.RequestClipboardData(format)
+			}
+		}
+	}
+	return nil
+}
+
+// OnFormatDataResponse puts what the server copied on the host clipboard
+func (b *ClipboardBridge) OnFormatDataResponse(formatID clipboard.ClipboardFormat, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch formatID {
+	case clipboard.CLIPRDR_FORMAT_UNICODETEXT:
+		b.lastText = clipboard.DecodeUnicodeText(data)
+		return b.system.WriteText(b.lastText)
+	case clipboard.CLIPRDR_FORMAT_PNG:
+		b.lastImage = data
+		return b.system.WriteImage(data)
+	}
+	return nil
+}
+
+// Start sends copies on the host to the session until Stop
+func (b *ClipboardBridge) Start() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stop != nil {
+		return
+	}
+	b.stop = make(chan struct{})
+	go b.poll(b.stop)
+}
+
+// Stop stops sending copies on the host to the session
+func (b *ClipboardBridge) Stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stop != nil {
+		close(b.stop)
+		b.stop = nil
+	}
+}
+
+// poll checks the host clipboard for copies until stop is closed
+func (b *ClipboardBridge) poll(stop chan struct{}) {
+	ticker := time.NewTicker(clipboardPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := b.sync(); err != nil {
+			fmt.Printf("Clipboard: %v\n", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync sends the host clipboard to the session if it changed since last
+// seen. Text goes first, an image only when there is no text.
+func (b *ClipboardBridge) sync() error {
+	if text, err := b.system.ReadText(); err == nil && text != "" {
+		b.mu.Lock()
+		changed := text != b.lastText
+		b.lastText = text
+		b.mu.Unlock()
+		if changed {
+			return b.client.SetClipboardText(text)
+		}
+		return nil
+	}
+
+	data, err := b.system.ReadImage()
+	if err != nil || len(data) == 0 {
+		return nil // no image either
+	}
+	b.mu.Lock()
+	changed := !bytes.Equal(data, b.lastImage)
+	b.lastImage = data
+	b.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to decode clipboard image: %w", err)
+	}
+	return b.client.SetClipboardImage(img)
+}
+
+// commandClipboard is the host clipboard through the command-line tools of
+// the platform: pbcopy and pbpaste on macOS, PowerShell on Windows, and
+// wl-clipboard or xclip elsewhere. Images need wl-clipboard or xclip.
+type commandClipboard struct{}
+
+// wayland reports whether to use wl-clipboard rather than xclip
+func wayland() bool {
+	return os.Getenv("WAYLAND_DISPLAY") != ""
+}
+
+func (commandClipboard) ReadText() (string, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return runOutput("pbpaste")
+	case "windows":
+		text, err := runOutput("powershell", "-NoProfile", "-Command", "Get-Clipboard -Raw")
+		return strings.TrimSuffix(text, "\r\n"), err
+	}
+	if wayland() {
+		return runOutput("wl-paste", "--no-newline", "--type", "text/plain")
+	}
+	return runOutput("xclip", "-selection", "clipboard", "-out", "-target", "UTF8_STRING")
+}
+
+func (commandClipboard) WriteText(text string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return runInput([]byte(text), "pbcopy")
+	case "windows":
+		return runInput([]byte(text), "powershell", "-NoProfile", "-Command", "Set-Clipboard -Value ([Console]::In.ReadToEnd())")
+	}
+	if wayland() {
+		return runInput([]byte(text), "wl-copy", "--type", "text/plain")
+	}
+	return runInput([]byte(text), "xclip", "-selection", "clipboard", "-in", "-target", "UTF8_STRING")
+}
+
+func (commandClipboard) ReadImage() ([]byte, error) {
+	switch {
+	case runtime.GOOS == "darwin" || runtime.GOOS == "windows":
+		return nil, errImageUnsupported
+	case wayland():
+		return exec.Command("wl-paste", "--type", "image/png").Output()
+	}
+	return exec.Command("xclip", "-selection", "clipboard", "-out", "-target", "image/png").Output()
+}
+
+func (commandClipboard) WriteImage(png []byte) error {
+	switch {
+	case runtime.GOOS == "darwin" || runtime.GOOS == "windows":
+		return errImageUnsupported
+	case wayland():
+		return runInput(png, "wl-copy", "--type", "image/png")
+	}
+	return runInput(png, "xclip", "-selection", "clipboard", "-in", "-target", "image/png")
+}
+
+// runOutput runs a command and returns its output
+func runOutput(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return string(out), nil
+}
+
+// runInput runs a command with input on its standard input
+func runInput(input []byte, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
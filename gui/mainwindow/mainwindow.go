@@ -27,6 +27,8 @@ type MainWindow struct {
 	connectionDialog *connection.ConnectionDialog
 	settingsDialog   *settings.SettingsDialog
 	displayWidget    *display.RDPDisplayWidget
+	window           *display.X11Window
+	clipboardBridge  *ClipboardBridge
 
 	// RDP client and connection
 	client       *gordp.Client
@@ -219,8 +221,8 @@ func (w *MainWindow) connect() {
 	startTime := time.Now()
 	w.connectionError = nil
 
-	// Create context for connection
-	w.clientCtx, w.clientCancel = context.WithTimeout(context.Background(), 30*time.Second)
+	// Create context for the session; ConnectTimeout bounds the connection
+	w.clientCtx, w.clientCancel = context.WithCancel(context.Background())
 
 	// Get monitor configuration
 	monitors := w.getMonitorConfiguration()
@@ -234,6 +236,8 @@ func (w *MainWindow) connect() {
 		ConnectTimeout: 10 * time.Second,
 		Monitors:       monitors,
 	})
+	w.clipboardBridge = NewClipboardBridge(w.client)
+	w.client.RegisterClipboardHandler(w.clipboardBridge)
 	w.clientMu.Unlock()
 
 	// Update handlers with the new client
@@ -266,6 +270,25 @@ func (w *MainWindow) connect() {
 	// Start performance monitoring
 	w.performanceMonitor.StartMonitoring()
 
+	// Open the window onto the desktop, at the size the server gave
+	info := w.client.SessionInfo()
+	width, height := int(info.DesktopWidth), int(info.DesktopHeight)
+	if width == 0 || height == 0 {
+		width, height = gordp.DefaultWidth, gordp.DefaultHeight
+	}
+	window, err := display.NewX11Window(width, height, "GoRDP - "+config.Address, display.ClientInput(w.client))
+	if err != nil {
+		fmt.Printf("Warning: Failed to open the desktop window: %v\n", err)
+	} else {
+		w.clientMu.Lock()
+		w.window = window
+		w.clientMu.Unlock()
+		go w.runWindow(window)
+	}
+
+	// Share the clipboard with the host
+	w.clipboardBridge.Start()
+
 	// Start RDP session in a goroutine
 	go w.runRDPSession()
 
@@ -273,6 +296,20 @@ func (w *MainWindow) connect() {
 	fmt.Println("RDP session started. Use the menu to manage the connection.")
 }
 
+// runWindow handles the events of the desktop window, disconnecting when
+// the user closes it
+func (w *MainWindow) runWindow(window *display.X11Window) {
+	if err := window.Run(); err != nil {
+		fmt.Printf("Desktop window: %v\n", err)
+	}
+	w.clientMu.RLock()
+	current := w.window == window
+	w.clientMu.RUnlock()
+	if current {
+		w.disconnect()
+	}
+}
+
 // runRDPSession runs the RDP session with bitmap processing
 func (w *MainWindow) runRDPSession() {
 	// Create bitmap processor
@@ -319,8 +356,16 @@ func (w *MainWindow) disconnect() {
 	// Stop performance monitoring
 	w.performanceMonitor.StopMonitoring()
 
-	// Close client
+	// Close client, the desktop window and the clipboard bridge
 	w.clientMu.Lock()
+	if w.clipboardBridge != nil {
+		w.clipboardBridge.Stop()
+		w.clipboardBridge = nil
+	}
+	if w.window != nil {
+		w.window.Close()
+		w.window = nil
+	}
 	if w.client != nil {
 		w.client.Close()
 		w.client = nil
@@ -698,10 +743,13 @@ func (p *MainWindowBitmapProcessor) ProcessBitmap(option *bitmap.Option, bitmap
 		p.startTime = time.Now()
 	}
 
-	// TODO: Update display widget when UpdateBitmap method is implemented
-	// if p.mainWindow.displayWidget != nil {
-	// 	p.mainWindow.displayWidget.UpdateBitmap(option, bitmap)
-	// }
+	// Draw the update into the desktop window
+	p.mainWindow.clientMu.RLock()
+	window := p.mainWindow.window
+	p.mainWindow.clientMu.RUnlock()
+	if window != nil {
+		window.ProcessBitmap(option, bitmap)
+	}
 
 	// TODO: Update performance statistics when UpdateFrameStats method is implemented
 	// if p.mainWindow.performanceMonitor != nil {
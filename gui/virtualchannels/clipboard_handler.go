@@ -126,8 +126,6 @@ func (h *ClipboardHandler) OnFormatDataResponse(formatID clipboard.ClipboardForm
 		if h.isEnabled && h.localClipboard != h.remoteClipboard {
 			h.updateLocalClipboard(h.remoteClipboard)
 		}
-	} else if formatID == clipboard.CLIPRDR_FORMAT_HTML {
-		fmt.Printf("Received clipboard HTML data from remote: %d bytes\n", len(data))
 	} else {
 		fmt.Printf("Received clipboard data from remote: format=%d (%s), %d bytes\n",
 			formatID, clipboard.GetFormatName(formatID), len(data))
@@ -136,6 +134,17 @@ func (h *ClipboardHandler) OnFormatDataResponse(formatID clipboard.ClipboardForm
 	return nil
 }
 
+// OnHTMLData handles clipboard HTML received from the remote, which is
+// cached without its CF_HTML header and wrapped again when sent back
+func (h *ClipboardHandler) OnHTMLData(html string, sourceURL string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.formatCache[clipboard.CLIPRDR_FORMAT_HTML] = []byte(html)
+	fmt.Printf("Received clipboard HTML data from remote: %d bytes\n", len(html))
+	return nil
+}
+
 // OnFileContentsRequest handles file contents request events
 func (h *ClipboardHandler) OnFileContentsRequest(streamID uint32, listIndex uint32, dwFlags uint32, nPositionLow uint32, nPositionHigh uint32, cbRequested uint32, clipDataID uint32) error {
 	h.mu.Lock()
@@ -676,21 +676,7 @@ func (h *DeviceHandler) RemoveDevice(deviceID uint32) error {
 		return fmt.Errorf("RDP client is not initialized")
 	}
 
-	// Construct a device removal message (using IOCTL or close message)
-	// For now, send a DEVICE_CLOSE message
-	msg := &device.DeviceMessage{
-		ComponentID: device.RDPDR_CTYP_CORE,
-		PacketID:    uint16(device.PAKID_CORE_DEVICE_CLOSE),
-		Data:        make([]byte, 4), // DeviceID
-	}
-	// Write DeviceID (little endian)
-	msg.Data[0] = byte(deviceID)
-	msg.Data[1] = byte(deviceID >> 8)
-	msg.Data[2] = byte(deviceID >> 16)
-	msg.Data[3] = byte(deviceID >> 24)
-
-	err := client.SendDeviceMessage(msg)
-	if err != nil {
+	if err := client.RemoveDevice(deviceID); err != nil {
 		return fmt.Errorf("failed to remove device: %w", err)
 	}
 
@@ -0,0 +1,188 @@
+package mobile
+
+import (
+	"image"
+	"image/draw"
+	"sync"
+	"time"
+)
+
+// QualityTier is a level of update quality the connection can be switched
+// to. A tier is usable while the network is within its thresholds; the
+// zero value of each setting leaves updates as MobileConfig has them.
+type QualityTier struct {
+	Name string `json:"name"`
+
+	// MaxLatency is the highest smoothed round-trip time the tier is used
+	// at, zero for any
+	MaxLatency time.Duration `json:"max_latency"`
+	// MinBandwidth is the lowest reported bandwidth in bytes per second the
+	// tier is used at, zero for any
+	MinBandwidth float64 `json:"min_bandwidth"`
+
+	// ColorDepth reduces the colors of updates to 16, 15 or 8 bits per
+	// pixel before encoding, which makes them compress better
+	ColorDepth int `json:"color_depth"`
+	// ImageQuality caps the JPEG quality of updates
+	ImageQuality int `json:"image_quality"`
+	// BitmapScale further scales updates down
+	BitmapScale float64 `json:"bitmap_scale"`
+	// MaxFrameRate is the most updates delivered per second; updates in
+	// between are merged and delivered together
+	MaxFrameRate float64 `json:"max_frame_rate"`
+}
+
+// DefaultQualityTiers returns the tiers used when MobileConfig has none,
+// best first: full quality on a fast network, then smaller, fewer and
+// coarser updates as it slows down
+func DefaultQualityTiers() []QualityTier {
+	return []QualityTier{
+		{Name: "high", MaxLatency: 100 * time.Millisecond, MinBandwidth: 1024 * 1024},
+		{Name: "medium", MaxLatency: 250 * time.Millisecond, MinBandwidth: 256 * 1024,
+			ImageQuality: 60, BitmapScale: 0.75, MaxFrameRate: 15},
+		{Name: "low", ColorDepth: 16, ImageQuality: 40, BitmapScale: 0.5, MaxFrameRate: 5},
+	}
+}
+
+// DefaultQualityUpgradeDelay is how long the network must allow a better
+// tier before the controller steps up to it
+const DefaultQualityUpgradeDelay = 10 * time.Second
+
+// DefaultQualityProbeInterval is how often the round-trip time is measured
+// for adaptive quality
+const DefaultQualityProbeInterval = 2 * time.Second
+
+// QualityController picks the quality tier of the connection from measured
+// round-trip times and reported bandwidth. It steps down as soon as the
+// network falls below the current tier, so that updates keep flowing
+// instead of freezing, and steps back up one tier at a time once the
+// network has stayed better for the upgrade delay.
+type QualityController struct {
+	mu sync.Mutex
+
+	tiers        []QualityTier
+	upgradeDelay time.Duration
+	current      int
+
+	// smoothed round-trip time and last reported bandwidth, zero until known
+	latency   time.Duration
+	bandwidth float64
+
+	// when the network first allowed a better tier than the current one
+	betterSince time.Time
+
+	onChange func(QualityTier)
+}
+
+// NewQualityController creates a controller over tiers, best first, starting
+// at the best one. Empty tiers are DefaultQualityTiers and a zero delay is
+// DefaultQualityUpgradeDelay.
+func NewQualityController(tiers []QualityTier, upgradeDelay time.Duration) *QualityController {
+	if len(tiers) == 0 {
+		tiers = DefaultQualityTiers()
+	}
+	if upgradeDelay <= 0 {
+		upgradeDelay = DefaultQualityUpgradeDelay
+	}
+	return &QualityController{tiers: tiers, upgradeDelay: upgradeDelay}
+}
+
+// OnChange sets the function called with the new tier when it changes
+func (q *QualityController) OnChange(fn func(QualityTier)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.onChange = fn
+}
+
+// Tier returns the current tier
+func (q *QualityController) Tier() QualityTier {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.tiers[q.current]
+}
+
+// ObserveLatency reports a round-trip time measured on the connection. It
+// is smoothed the way TCP smooths its round-trip time.
+func (q *QualityController) ObserveLatency(rtt time.Duration) {
+	q.observe(time.Now(), func() {
+		if q.latency == 0 {
+			q.latency = rtt
+		} else {
+			q.latency += (rtt - q.latency) / 8
+		}
+	})
+}
+
+// ObserveBandwidth reports the bandwidth of the network in bytes per second,
+// e.g. the estimate of the operating system for the active link
+func (q *QualityController) ObserveBandwidth(bytesPerSec float64) {
+	q.observe(time.Now(), func() { q.bandwidth = bytesPerSec })
+}
+
+// observe records a measurement at now and moves to the tier it allows
+func (q *QualityController) observe(now time.Time, record func()) {
+	q.mu.Lock()
+	record()
+	previous := q.current
+	switch target := q.target(); {
+	case target > q.current:
+		// the network got worse, step down at once
+		q.current = target
+		q.betterSince = time.Time{}
+	case target == q.current:
+		q.betterSince = time.Time{}
+	case q.betterSince.IsZero():
+		q.betterSince = now
+	case now.Sub(q.betterSince) >= q.upgradeDelay:
+		q.current--
+		q.betterSince = now
+	}
+	changed := q.current != previous
+	tier, onChange := q.tiers[q.current], q.onChange
+	q.mu.Unlock()
+
+	if changed && onChange != nil {
+		onChange(tier)
+	}
+}
+
+// target returns the best tier the current measurements allow
+func (q *QualityController) target() int {
+	for i, tier := range q.tiers {
+		if tier.MaxLatency > 0 && q.latency > tier.MaxLatency {
+			continue
+		}
+		if tier.MinBandwidth > 0 && q.bandwidth > 0 && q.bandwidth < tier.MinBandwidth {
+			continue
+		}
+		return i
+	}
+	return len(q.tiers) - 1
+}
+
+// reduceColors keeps the top bits of each channel of img for depth bits
+// per pixel, as 5-6-5 for 16, 5-5-5 for 15 and 3-3-2 for 8. Other depths
+// return img as is.
+func reduceColors(img image.Image, depth int) image.Image {
+	var mask [3]uint8
+	switch depth {
+	case 16:
+		mask = [3]uint8{0xF8, 0xFC, 0xF8}
+	case 15:
+		mask = [3]uint8{0xF8, 0xF8, 0xF8}
+	case 8:
+		mask = [3]uint8{0xE0, 0xE0, 0xC0}
+	default:
+		return img
+	}
+
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, img, b.Min, draw.Src)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		dst.Pix[i] &= mask[0]
+		dst.Pix[i+1] &= mask[1]
+		dst.Pix[i+2] &= mask[2]
+	}
+	return dst
+}
@@ -0,0 +1,134 @@
+package mobile
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kdsmith18542/gordp/proto/bitmap"
+)
+
+func TestQualityController(t *testing.T) {
+	q := NewQualityController(nil, 10*time.Second)
+	var changes []string
+	q.OnChange(func(tier QualityTier) { changes = append(changes, tier.Name) })
+	bandwidth := func(now time.Time, bytesPerSec float64) string {
+		q.observe(now, func() { q.bandwidth = bytesPerSec })
+		return q.Tier().Name
+	}
+
+	q.ObserveLatency(50 * time.Millisecond)
+	if got := q.Tier().Name; got != "high" {
+		t.Fatalf("fast network: %s", got)
+	}
+
+	// down at once, up one tier at a time after the delay
+	now := time.Now()
+	steps := []struct {
+		after     time.Duration
+		bandwidth float64
+		want      string
+	}{
+		{0, 100 * 1024, "low"},
+		{time.Second, 2 * 1024 * 1024, "low"},
+		{6 * time.Second, 2 * 1024 * 1024, "low"},
+		{11 * time.Second, 2 * 1024 * 1024, "medium"},
+		{15 * time.Second, 2 * 1024 * 1024, "medium"},
+		{21 * time.Second, 2 * 1024 * 1024, "high"},
+		{22 * time.Second, 512 * 1024, "medium"},
+	}
+	for _, step := range steps {
+		if got := bandwidth(now.Add(step.after), step.bandwidth); got != step.want {
+			t.Errorf("after %v at %v B/s: %s, want %s", step.after, step.bandwidth, got, step.want)
+		}
+	}
+	if want := []string{"low", "medium", "high", "medium"}; !slices.Equal(changes, want) {
+		t.Errorf("changes %v, want %v", changes, want)
+	}
+
+	// latency is smoothed, a single slow round trip is not enough
+	q.ObserveLatency(400 * time.Millisecond)
+	if q.latency >= 100*time.Millisecond {
+		t.Errorf("smoothed latency %v", q.latency)
+	}
+}
+
+func TestReduceColors(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	img.Set(0, 0, color.RGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF})
+	for depth, want := range map[int]color.RGBA{
+		16: {R: 0xF8, G: 0xFC, B: 0xF8, A: 0xFF},
+		15: {R: 0xF8, G: 0xF8, B: 0xF8, A: 0xFF},
+		8:  {R: 0xE0, G: 0xE0, B: 0xC0, A: 0xFF},
+		24: {R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF},
+	} {
+		if got := reduceColors(img, depth).At(0, 0); got != want {
+			t.Errorf("%d bpp: %v, want %v", depth, got, want)
+		}
+	}
+}
+
+func TestProcessBitmapFrameRate(t *testing.T) {
+	type delivery struct {
+		rect image.Rectangle
+		size image.Point
+	}
+	var mu sync.Mutex
+	var deliveries []delivery
+
+	mc := NewMobileClient()
+	cfg := DefaultMobileConfig()
+	cfg.AdaptiveQuality = true
+	cfg.QualityTiers = []QualityTier{{Name: "slow", MaxFrameRate: 10}}
+	mc.SetMobileConfig(cfg)
+	mc.viewport.RemoteWidth, mc.viewport.RemoteHeight = 64, 64
+	mc.callbacks.OnBitmapReceived = func(x, y, width, height int, data []byte) {
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		deliveries = append(deliveries, delivery{image.Rect(x, y, x+width, y+height), img.Bounds().Size()})
+	}
+
+	p := &MobileBitmapProcessor{client: mc}
+	update := func(x, y int) {
+		img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+		p.ProcessBitmap(&bitmap.Option{Left: x, Top: y, Width: 8, Height: 8}, &bitmap.BitMap{Image: img})
+	}
+	update(0, 0)
+	update(8, 0)
+	update(16, 8)
+	update(16, 8) // the same rectangle again
+
+	mu.Lock()
+	if len(deliveries) != 1 {
+		t.Fatalf("%d deliveries before the frame interval", len(deliveries))
+	}
+	mu.Unlock()
+
+	time.Sleep(300 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	// not their union, which takes in parts of the desktop never drawn
+	want := []delivery{
+		{image.Rect(0, 0, 8, 8), image.Pt(8, 8)},
+		{image.Rect(8, 0, 16, 8), image.Pt(8, 8)},
+		{image.Rect(16, 8, 24, 16), image.Pt(8, 8)},
+	}
+	if len(deliveries) != len(want) {
+		t.Fatalf("deliveries %v, want %v", deliveries, want)
+	}
+	for i := range want {
+		if deliveries[i] != want[i] {
+			t.Errorf("delivery %d: %v, want %v", i, deliveries[i], want[i])
+		}
+	}
+}
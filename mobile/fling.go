@@ -0,0 +1,97 @@
+package mobile
+
+import (
+	"math"
+	"time"
+)
+
+// Momentum of a fling
+const (
+	flingInterval  = 16 * time.Millisecond // between wheel events
+	flingFriction  = 4.0                   // decay of the speed, per second
+	flingStopSpeed = 60.0                  // wheel delta per second at which it stops
+)
+
+// fling is the momentum of a released swipe, scrolling ever less as the
+// speed decays
+type fling struct {
+	speedX, speedY float64 // wheel delta per second
+	restX, restY   float64 // delta scrolled but not yet sent
+}
+
+// newFling starts a fling from the release velocity of a swipe, in pixels
+// per second. Content follows the finger: swiping up scrolls down.
+func newFling(velocityX, velocityY, sensitivity float64) *fling {
+	return &fling{speedX: -velocityX * sensitivity, speedY: velocityY * sensitivity}
+}
+
+// step advances the fling by dt, returning the whole wheel deltas to send
+// and whether it has come to a stop
+func (f *fling) step(dt time.Duration) (deltaX, deltaY int, done bool) {
+	// the distance covered while the speed decays exponentially
+	decay := math.Exp(-flingFriction * dt.Seconds())
+	f.restX += f.speedX * (1 - decay) / flingFriction
+	f.restY += f.speedY * (1 - decay) / flingFriction
+	f.speedX *= decay
+	f.speedY *= decay
+
+	deltaX, deltaY = int(f.restX), int(f.restY)
+	f.restX -= float64(deltaX)
+	f.restY -= float64(deltaY)
+	return deltaX, deltaY, math.Hypot(f.speedX, f.speedY) < flingStopSpeed
+}
+
+// startFling scrolls with the momentum of f until it stops, another touch
+// goes down or the client disconnects. It is called with inputMutex held.
+func (mc *MobileClient) startFling(f *fling) {
+	mc.stopFling()
+	stop := make(chan struct{})
+	mc.flingStop = stop
+	go mc.runFling(f, stop)
+}
+
+// stopFling stops a running fling. It is called with inputMutex held.
+func (mc *MobileClient) stopFling() {
+	if mc.flingStop != nil {
+		close(mc.flingStop)
+		mc.flingStop = nil
+	}
+}
+
+// runFling sends the wheel events of a fling
+func (mc *MobileClient) runFling(f *fling, stop chan struct{}) {
+	ticker := time.NewTicker(flingInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-mc.ctx.Done():
+			return
+		case now := <-ticker.C:
+			deltaX, deltaY, done := f.step(now.Sub(last))
+			last = now
+
+			mc.inputMutex.Lock()
+			select {
+			case <-stop:
+				// stopped while waiting for the lock
+				mc.inputMutex.Unlock()
+				return
+			default:
+			}
+			var err error
+			if deltaX != 0 || deltaY != 0 {
+				err = mc.sendScrollEvent(deltaX, deltaY)
+			}
+			if err != nil || done {
+				mc.stopFling()
+			}
+			mc.inputMutex.Unlock()
+			if err != nil || done {
+				return
+			}
+		}
+	}
+}
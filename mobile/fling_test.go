@@ -0,0 +1,96 @@
+package mobile
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFling(t *testing.T) {
+	// swiping up at 2000 pixels per second scrolls down, for 2000/4 pixels
+	f := newFling(0, -2000, 1)
+	var total, first, steps int
+	for {
+		deltaX, deltaY, done := f.step(flingInterval)
+		if deltaX != 0 {
+			t.Fatalf("horizontal delta %d of a vertical fling", deltaX)
+		}
+		if deltaY > 0 {
+			t.Fatalf("delta %d, want downwards", deltaY)
+		}
+		if steps == 0 {
+			first = deltaY
+		}
+		total += deltaY
+		steps++
+		if done {
+			break
+		}
+		if steps > 1000 {
+			t.Fatal("fling does not stop")
+		}
+	}
+	if total > -480 || total < -500 {
+		t.Errorf("scrolled %d in all, want about -500", total)
+	}
+	if first > -20 {
+		t.Errorf("first delta %d, want the fastest", first)
+	}
+	if d := time.Duration(steps) * flingInterval; d > 2*time.Second {
+		t.Errorf("fling lasted %v", d)
+	}
+
+	// content follows the finger sideways too
+	if deltaX, _, _ := newFling(2000, 0, 1).step(flingInterval); deltaX >= 0 {
+		t.Errorf("swiping right scrolled %d, want left", deltaX)
+	}
+}
+
+func TestFlingStop(t *testing.T) {
+	mc := NewMobileClient()
+	mc.mobileConfig.FlingMinVelocity = 100
+
+	// a slow swipe does not fling, but presses an arrow key
+	if err := mc.handleSwipeGesture(map[string]interface{}{"direction": "up", "velocity_y": -50.0}); err == nil {
+		t.Fatal("slow swipe sent an arrow key without a connection")
+	}
+	mc.inputMutex.Lock()
+	flinging := mc.flingStop != nil
+	mc.inputMutex.Unlock()
+	if flinging {
+		t.Fatal("slow swipe flings")
+	}
+
+	// without a connection the fling stops at its first wheel event
+	mc.inputMutex.Lock()
+	mc.handleSwipeGesture(map[string]interface{}{"direction": "up", "velocity_y": -5000.0})
+	flinging = mc.flingStop != nil
+	mc.inputMutex.Unlock()
+	if !flinging {
+		t.Fatal("fast swipe does not fling")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		mc.inputMutex.Lock()
+		flinging = mc.flingStop != nil
+		mc.inputMutex.Unlock()
+		if !flinging {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("fling did not stop")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// stopping a fling ends its goroutine
+	mc.inputMutex.Lock()
+	mc.startFling(newFling(0, 5000, 1))
+	stop := mc.flingStop
+	mc.stopFling()
+	mc.inputMutex.Unlock()
+	select {
+	case <-stop:
+	default:
+		t.Error("fling not stopped")
+	}
+}
@@ -3,12 +3,17 @@ package mobile
 import (
 	"context"
 	"fmt"
+	"image"
+	"math"
 	"sync"
 	"time"
 
 	"github.com/kdsmith18542/gordp"
 	"github.com/kdsmith18542/gordp/config"
+	"github.com/kdsmith18542/gordp/glog"
 	"github.com/kdsmith18542/gordp/proto/bitmap"
+	"github.com/kdsmith18542/gordp/proto/mcs"
+	"github.com/kdsmith18542/gordp/proto/t128"
 )
 
 // MobileClient represents a mobile RDP client
@@ -29,6 +34,21 @@ type MobileClient struct {
 	inputStats        *InputStatistics
 	hapticFeedback    *HapticFeedback
 	mobileConfig      *MobileConfig
+
+	// Last pointer position sent, where scrolling happens
+	pointerX, pointerY uint16
+
+	// Mapping of touches onto the remote desktop
+	viewport Viewport
+
+	// Closed to stop the running fling, if any
+	flingStop chan struct{}
+
+	// Whether the device is on a cellular network
+	cellular bool
+
+	// Tier of update quality for the measured network
+	quality *QualityController
 }
 
 // TouchState tracks touch input state
@@ -126,6 +146,7 @@ type MobileCallbacks struct {
 	OnDisconnected   func()
 	OnHapticFeedback func(intensity float64, pattern []time.Duration)
 	OnGesture        func(gestureType int, data map[string]interface{})
+	OnQualityChange  func(tier QualityTier)
 }
 
 // NewMobileClient creates a new mobile RDP client
@@ -167,6 +188,7 @@ func NewMobileClient() *MobileClient {
 
 	// Initialize keyboard layout
 	client.initializeKeyboardLayout()
+	client.quality = client.newQualityController(client.mobileConfig)
 
 	return client
 }
@@ -207,6 +229,9 @@ func (mc *MobileClient) Connect(host, username, password string, port, width, he
 		UserName:       username,
 		Password:       password,
 		ConnectTimeout: 10 * time.Second,
+		Width:          width,
+		Height:         height,
+		OnRoundTrip:    mc.observeRoundTrip,
 	})
 
 	// Connect to server
@@ -219,12 +244,19 @@ func (mc *MobileClient) Connect(host, username, password string, port, width, he
 		return err
 	}
 
+	// the server may not give the size asked for
+	info := mc.client.SessionInfo()
+	mc.inputMutex.Lock()
+	mc.viewport.RemoteWidth, mc.viewport.RemoteHeight = int(info.DesktopWidth), int(info.DesktopHeight)
+	mc.inputMutex.Unlock()
+
 	mc.updateStatus(StatusConnected)
 	if mc.callbacks.OnConnected != nil {
 		mc.callbacks.OnConnected(width, height)
 	}
 
 	// Start RDP session
+	go mc.probeQuality()
 	processor := &MobileBitmapProcessor{client: mc}
 	if err := mc.client.RunWithContext(mc.ctx, processor); err != nil {
 		mc.lastError = err.Error()
@@ -307,7 +339,7 @@ func (mc *MobileClient) SendMouseMove(x, y int) error {
 	rdpX, rdpY := mc.convertCoordinates(x, y)
 
 	// Send mouse move event to RDP server
-	if err := mc.sendRDPMouseEvent(rdpX, rdpY, 0, false, false); err != nil {
+	if err := mc.sendRDPMouseEvent(rdpX, rdpY, 0, false); err != nil {
 		mc.updateInputStats(startTime, false)
 		return fmt.Errorf("failed to send mouse move: %w", err)
 	}
@@ -336,7 +368,7 @@ func (mc *MobileClient) SendMouseClick(button int, down bool, x, y int) error {
 	rdpButton := mc.convertButtonToRDP(button)
 
 	// Send mouse click event to RDP server
-	if err := mc.sendRDPMouseEvent(rdpX, rdpY, rdpButton, down, false); err != nil {
+	if err := mc.sendRDPMouseEvent(rdpX, rdpY, rdpButton, down); err != nil {
 		mc.updateInputStats(startTime, false)
 		return fmt.Errorf("failed to send mouse click: %w", err)
 	}
@@ -378,6 +410,9 @@ func (mc *MobileClient) SendTouch(x, y int, touchType int) error {
 
 // handleTouchDown processes touch down events
 func (mc *MobileClient) handleTouchDown(x, y int) error {
+	// Touching the screen catches a fling
+	mc.stopFling()
+
 	touchID := len(mc.touchState.ActiveTouches) + 1
 
 	touchPoint := &TouchPoint{
@@ -396,9 +431,9 @@ func (mc *MobileClient) handleTouchDown(x, y int) error {
 		return mc.SendMouseClick(0, true, x, y)
 	}
 
-	// Handle multi-touch gestures
+	// A second touch starts a multi-touch gesture
 	if len(mc.touchState.ActiveTouches) == 2 {
-		return mc.handleMultiTouchGesture()
+		mc.startMultiTouchGesture()
 	}
 
 	return nil
@@ -442,38 +477,63 @@ func (mc *MobileClient) handleTouchUp(x, y int) error {
 		return mc.SendMouseClick(0, false, x, y)
 	}
 
-	// Handle multi-touch gestures
+	// Lifting a finger ends a multi-touch gesture
 	if len(mc.touchState.ActiveTouches) == 1 {
-		return mc.handleMultiTouchGesture()
+		mc.gestureRecognizer.PinchStartDistance = 0
 	}
 
 	return nil
 }
 
-// handleMultiTouchGesture processes multi-touch gestures
-func (mc *MobileClient) handleMultiTouchGesture() error {
+// touchPair returns the two active touches of a multi-touch gesture in the
+// order they went down, so that the angle between them does not flip
+func (mc *MobileClient) touchPair() (*TouchPoint, *TouchPoint, bool) {
 	if len(mc.touchState.ActiveTouches) != 2 {
-		return nil
+		return nil, nil, false
 	}
-
 	var touches []*TouchPoint
 	for _, touch := range mc.touchState.ActiveTouches {
 		touches = append(touches, touch)
 	}
+	if touches[0].ID > touches[1].ID {
+		touches[0], touches[1] = touches[1], touches[0]
+	}
+	return touches[0], touches[1], true
+}
+
+// startMultiTouchGesture records the distance and angle between the touches
+// as a gesture starts, for its scale and rotation to be measured against
+func (mc *MobileClient) startMultiTouchGesture() {
+	first, second, ok := mc.touchPair()
+	if !ok {
+		return
+	}
+	angle := mc.calculateAngle(first, second)
+	mc.gestureRecognizer.PinchStartDistance = mc.calculateDistance(first, second)
+	mc.gestureRecognizer.PinchStartAngle = angle
+	mc.gestureRecognizer.RotationStartAngle = angle
+}
+
+// handleMultiTouchGesture processes multi-touch gestures
+func (mc *MobileClient) handleMultiTouchGesture() error {
+	first, second, ok := mc.touchPair()
+	if !ok {
+		return nil
+	}
 
 	// Calculate gesture parameters
-	distance := mc.calculateDistance(touches[0], touches[1])
-	angle := mc.calculateAngle(touches[0], touches[1])
+	distance := mc.calculateDistance(first, second)
+	angle := mc.calculateAngle(first, second)
 
 	// Detect pinch gesture
-	if mc.mobileConfig.EnablePinchGesture {
+	if mc.mobileConfig.EnablePinchGesture && mc.gestureRecognizer.PinchStartDistance > 0 {
 		if distance != mc.gestureRecognizer.PinchStartDistance {
 			scale := distance / mc.gestureRecognizer.PinchStartDistance
 			if scale > 1.1 || scale < 0.9 {
 				mc.triggerGesture(GesturePinch, map[string]interface{}{
 					"scale":    scale,
-					"center_x": (touches[0].X + touches[1].X) / 2,
-					"center_y": (touches[0].Y + touches[1].Y) / 2,
+					"center_x": (first.X + second.X) / 2,
+					"center_y": (first.Y + second.Y) / 2,
 				})
 			}
 		}
@@ -482,12 +542,13 @@ func (mc *MobileClient) handleMultiTouchGesture() error {
 	// Detect rotation gesture
 	if mc.mobileConfig.EnableRotateGesture {
 		if angle != mc.gestureRecognizer.RotationStartAngle {
-			rotation := angle - mc.gestureRecognizer.RotationStartAngle
+			// the shorter way round, within -180 to 180 degrees
+			rotation := math.Remainder(angle-mc.gestureRecognizer.RotationStartAngle, 360)
 			if rotation > mc.gestureRecognizer.RotationThreshold || rotation < -mc.gestureRecognizer.RotationThreshold {
 				mc.triggerGesture(GestureRotate, map[string]interface{}{
 					"rotation": rotation,
-					"center_x": (touches[0].X + touches[1].X) / 2,
-					"center_y": (touches[0].Y + touches[1].Y) / 2,
+					"center_x": (first.X + second.X) / 2,
+					"center_y": (first.Y + second.Y) / 2,
 				})
 			}
 		}
@@ -623,9 +684,18 @@ func (mc *MobileClient) handleRotateGesture(data map[string]interface{}) error {
 	}
 }
 
-// handleSwipeGesture processes swipe gestures
+// handleSwipeGesture processes swipe gestures. A swipe released faster than
+// FlingMinVelocity, as given by "velocity_x" and "velocity_y" in pixels per
+// second, flings the content with the mouse wheel; others press arrow keys.
 func (mc *MobileClient) handleSwipeGesture(data map[string]interface{}) error {
 	direction, _ := data["direction"].(string)
+	velocityX, _ := data["velocity_x"].(float64)
+	velocityY, _ := data["velocity_y"].(float64)
+
+	if mc.mobileConfig.FlingSensitivity > 0 && math.Hypot(velocityX, velocityY) > mc.mobileConfig.FlingMinVelocity {
+		mc.startFling(newFling(velocityX, velocityY, mc.mobileConfig.FlingSensitivity))
+		return nil
+	}
 
 	// Convert swipe to arrow keys
 	switch direction {
@@ -683,11 +753,64 @@ func (mc *MobileClient) GetInputStatistics() map[string]interface{} {
 	}
 }
 
+// SetScreenSize sets the size of the view showing the remote desktop, in
+// physical pixels, and the pixel density of the touch coordinates
+func (mc *MobileClient) SetScreenSize(width, height int, pixelDensity float64) {
+	mc.inputMutex.Lock()
+	defer mc.inputMutex.Unlock()
+	mc.viewport.ScreenWidth, mc.viewport.ScreenHeight = width, height
+	mc.viewport.PixelDensity = pixelDensity
+}
+
+// SetCellular tells whether the device is on a cellular network, where
+// updates are scaled and encoded by the cellular options of MobileConfig
+func (mc *MobileClient) SetCellular(cellular bool) {
+	mc.inputMutex.Lock()
+	defer mc.inputMutex.Unlock()
+	mc.cellular = cellular
+}
+
+// SetOrientation turns the remote desktop as the device is turned to
+// orientation, one of "landscape", "portrait", "landscape-flipped" and
+// "portrait-flipped", the names MobileUIManager.SetOrientation takes
+func (mc *MobileClient) SetOrientation(orientation string) error {
+	var degrees uint32
+	switch orientation {
+	case "landscape":
+		degrees = mcs.ORIENTATION_LANDSCAPE
+	case "portrait":
+		degrees = mcs.ORIENTATION_PORTRAIT
+	case "landscape-flipped":
+		degrees = mcs.ORIENTATION_LANDSCAPE_FLIPPED
+	case "portrait-flipped":
+		degrees = mcs.ORIENTATION_PORTRAIT_FLIPPED
+	default:
+		return fmt.Errorf("unknown orientation %q", orientation)
+	}
+
+	mc.inputMutex.Lock()
+	defer mc.inputMutex.Unlock()
+	if mc.client == nil || mc.status != StatusConnected {
+		return fmt.Errorf("not connected")
+	}
+	return mc.client.SetOrientation(0, degrees)
+}
+
+// SetZoom sets the zoom of the view and the remote pixel at its top-left
+// corner, e.g. as the MobileUIManager zoom changes
+func (mc *MobileClient) SetZoom(zoom, panX, panY float64) {
+	mc.inputMutex.Lock()
+	defer mc.inputMutex.Unlock()
+	mc.viewport.Zoom = zoom
+	mc.viewport.PanX, mc.viewport.PanY = panX, panY
+}
+
 // SetMobileConfig sets mobile-specific configuration
 func (mc *MobileClient) SetMobileConfig(config *MobileConfig) {
 	mc.inputMutex.Lock()
 	defer mc.inputMutex.Unlock()
 	mc.mobileConfig = config
+	mc.quality = mc.newQualityController(config)
 }
 
 // GetMobileConfig returns current mobile configuration
@@ -821,9 +944,7 @@ func (mc *MobileClient) applyModifierKeys(keyCode int) int {
 
 // convertCoordinates converts screen coordinates to RDP coordinates
 func (mc *MobileClient) convertCoordinates(x, y int) (int, int) {
-	// For now, assume 1:1 mapping
-	// In a full implementation, this would handle scaling and offset
-	return x, y
+	return mc.viewport.ToRemote(x, y)
 }
 
 // convertButtonToRDP converts button to RDP format
@@ -840,107 +961,323 @@ func (mc *MobileClient) convertButtonToRDP(button int) int {
 	}
 }
 
-// sendRDPKeyEvent sends key event to RDP server
+// sendRDPKeyEvent sends key event to RDP server. Modifiers arrive as key
+// events of their own, so the key is sent without any.
 func (mc *MobileClient) sendRDPKeyEvent(keyCode int, down bool) error {
-	// This would send the actual RDP key event
-	// For now, we'll use the existing RDP client methods
-	if mc.client != nil {
-		// Use the RDP client's input handling
-		// This is a placeholder - actual implementation would use RDP protocol
-		return nil
+	if mc.client == nil {
+		return fmt.Errorf("RDP client not available")
+	}
+	if keyCode < 0 || keyCode > 0xFF {
+		return fmt.Errorf("invalid virtual key code 0x%X", keyCode)
 	}
-	return fmt.Errorf("RDP client not available")
+	if down {
+		return mc.client.SendKeyDown(uint8(keyCode), t128.ModifierKey{})
+	}
+	return mc.client.SendKeyUp(uint8(keyCode))
 }
 
-// sendRDPMouseEvent sends mouse event to RDP server
-func (mc *MobileClient) sendRDPMouseEvent(x, y, button int, down, wheel bool) error {
-	// This would send the actual RDP mouse event
-	// For now, we'll use the existing RDP client methods
-	if mc.client != nil {
-		// Use the RDP client's input handling
-		// This is a placeholder - actual implementation would use RDP protocol
-		return nil
+// sendRDPMouseEvent sends mouse event to RDP server, a move for button 0
+func (mc *MobileClient) sendRDPMouseEvent(x, y, button int, down bool) error {
+	if mc.client == nil {
+		return fmt.Errorf("RDP client not available")
+	}
+	mc.pointerX, mc.pointerY = clampPosition(x), clampPosition(y)
+
+	switch button {
+	case 0:
+		return mc.client.SendMouseMoveEvent(mc.pointerX, mc.pointerY)
+	case 0x01:
+		return mc.client.SendMouseButtonEvent(t128.MouseButtonLeft, down, mc.pointerX, mc.pointerY)
+	case 0x02:
+		return mc.client.SendMouseButtonEvent(t128.MouseButtonRight, down, mc.pointerX, mc.pointerY)
+	case 0x04:
+		return mc.client.SendMouseButtonEvent(t128.MouseButtonMiddle, down, mc.pointerX, mc.pointerY)
+	default:
+		return fmt.Errorf("invalid mouse button 0x%X", button)
 	}
-	return fmt.Errorf("RDP client not available")
 }
 
-// sendScrollEvent sends scroll event to RDP server
-func (mc *MobileClient) sendScrollEvent(x, y int) error {
-	// This would send the actual RDP scroll event
-	// For now, we'll use the existing RDP client methods
-	if mc.client != nil {
-		// Use the RDP client's input handling
-		// This is a placeholder - actual implementation would use RDP protocol
-		return nil
+// sendScrollEvent sends scroll event to RDP server at the last pointer
+// position, deltaX and deltaY being wheel deltas (120 per notch, positive
+// for right and up)
+func (mc *MobileClient) sendScrollEvent(deltaX, deltaY int) error {
+	if mc.client == nil {
+		return fmt.Errorf("RDP client not available")
 	}
-	return fmt.Errorf("RDP client not available")
+	if deltaY != 0 {
+		if err := mc.client.SendMouseWheelEvent(clampWheelDelta(deltaY), mc.pointerX, mc.pointerY); err != nil {
+			return err
+		}
+	}
+	if deltaX != 0 {
+		return mc.client.SendMouseHorizontalWheelEvent(clampWheelDelta(deltaX), mc.pointerX, mc.pointerY)
+	}
+	return nil
+}
+
+// clampPosition limits a coordinate to the range of a pointer event
+func clampPosition(v int) uint16 {
+	return uint16(min(max(v, 0), math.MaxUint16))
+}
+
+// clampWheelDelta limits a wheel delta to what a pointer event can carry
+func clampWheelDelta(v int) int16 {
+	return int16(min(max(v, -255), 255))
 }
 
 // calculateDistance calculates distance between two touch points
 func (mc *MobileClient) calculateDistance(p1, p2 *TouchPoint) float64 {
-	dx := float64(p2.X - p1.X)
-	dy := float64(p2.Y - p1.Y)
-	return (dx*dx + dy*dy)
+	return math.Hypot(float64(p2.X-p1.X), float64(p2.Y-p1.Y))
 }
 
-// calculateAngle calculates angle between two touch points
+// calculateAngle calculates the angle in degrees of the line from p1 to p2
 func (mc *MobileClient) calculateAngle(p1, p2 *TouchPoint) float64 {
-	dx := float64(p2.X - p1.X)
-	dy := float64(p2.Y - p1.Y)
-	return atan2(dy, dx) * 180 / 3.14159
-}
-
-// atan2 calculates arctangent of y/x
-func atan2(y, x float64) float64 {
-	if x > 0 {
-		return atan(y / x)
-	} else if x < 0 && y >= 0 {
-		return atan(y/x) + 3.14159
-	} else if x < 0 && y < 0 {
-		return atan(y/x) - 3.14159
-	} else if x == 0 && y > 0 {
-		return 3.14159 / 2
-	} else if x == 0 && y < 0 {
-		return -3.14159 / 2
-	} else if x == 0 && y == 0 {
-		return 0
-	}
-	return 0
-}
-
-// atan calculates arctangent
-func atan(x float64) float64 {
-	// Simple approximation of arctangent
-	if x < -1 {
-		return -3.14159/2 - atan(1/x)
-	} else if x > 1 {
-		return 3.14159/2 - atan(1/x)
-	} else {
-		return x - x*x*x/3 + x*x*x*x*x/5 - x*x*x*x*x*x*x/7
-	}
+	return math.Atan2(float64(p2.Y-p1.Y), float64(p2.X-p1.X)) * 180 / math.Pi
 }
 
 // MobileBitmapProcessor processes bitmap data for mobile clients
 type MobileBitmapProcessor struct {
 	client *MobileClient
+
+	// Updates held back to keep within the frame rate of the quality tier,
+	// composited on the desktop until the rectangles they changed are
+	// delivered. Only those rectangles of frame hold the desktop.
+	mu         sync.Mutex
+	frame      *bitmap.Framebuffer
+	dirty      []image.Rectangle
+	lastSent   time.Time
+	flushTimer *time.Timer
+}
+
+// ProcessBitmap processes bitmap data and sends it to the mobile client.
+// When MobileConfig scales updates down, the image passed to
+// OnBitmapReceived is smaller than its rectangle and is drawn stretched.
+// Under a quality tier with a frame rate, updates are merged and delivered
+// from a timer rather than the session loop.
+func (p *MobileBitmapProcessor) ProcessBitmap(option *bitmap.Option, bm *bitmap.BitMap) {
+	if p.client.callbacks.OnBitmapReceived == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	tier := p.client.QualityTier()
+	width, height := p.client.remoteSize()
+	if tier.MaxFrameRate <= 0 || width <= 0 || height <= 0 {
+		if len(p.dirty) > 0 {
+			p.flushLocked()
+		}
+		p.deliver(option.Left, option.Top, option.Width, option.Height, bm)
+		return
+	}
+
+	if p.frame == nil || p.frame.Width() != width || p.frame.Height() != height {
+		p.frame = bitmap.NewFramebuffer(width, height)
+		p.dirty = nil
+	}
+	p.frame.ApplyUpdate(option, bm)
+	r := image.Rect(option.Left, option.Top, option.Left+option.Width, option.Top+option.Height)
+	p.addDirty(r.Intersect(image.Rect(0, 0, width, height)))
+
+	wait := time.Duration(float64(time.Second)/tier.MaxFrameRate) - time.Since(p.lastSent)
+	if wait <= 0 {
+		p.flushLocked()
+	} else if p.flushTimer == nil {
+		p.flushTimer = time.AfterFunc(wait, p.flush)
+	}
+}
+
+// flush delivers the updates held back
+func (p *MobileBitmapProcessor) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.flushTimer = nil
+	if len(p.dirty) > 0 {
+		p.flushLocked()
+	}
+}
+
+// addDirty adds r to the rectangles held back updates changed, leaving out
+// those within another. They are not merged, as their union may take in
+// parts of the desktop frame does not hold.
+func (p *MobileBitmapProcessor) addDirty(r image.Rectangle) {
+	if r.Empty() {
+		return
+	}
+	kept := p.dirty[:0]
+	for _, d := range p.dirty {
+		if r.In(d) {
+			return
+		}
+		if !d.In(r) {
+			kept = append(kept, d)
+		}
+	}
+	p.dirty = append(kept, r)
+}
+
+// flushLocked delivers the rectangles the held back updates changed, mu held
+func (p *MobileBitmapProcessor) flushLocked() {
+	dirty := p.dirty
+	p.dirty = nil
+	for _, r := range dirty {
+		p.deliver(r.Min.X, r.Min.Y, r.Dx(), r.Dy(), &bitmap.BitMap{Image: p.frame.SnapshotRect(r)})
+	}
+}
+
+// deliver encodes a bitmap as configured for the screen and network and
+// passes it to OnBitmapReceived
+func (p *MobileBitmapProcessor) deliver(x, y, width, height int, bm *bitmap.BitMap) {
+	p.lastSent = time.Now()
+
+	// Shrink the bitmap as configured for the screen and network
+	cfg := p.client.GetMobileConfig()
+	scale, quality := p.client.bitmapEncoding(cfg)
+	b := bm.Image.Bounds()
+	w, h := bitmapSize(b.Dx(), b.Dy(), scale, cfg.MaxBitmapDimension)
+	bm = bitmap.Resize(bm, w, h)
+	if depth := p.client.QualityTier().ColorDepth; depth > 0 {
+		bm = &bitmap.BitMap{Image: reduceColors(bm.Image, depth)}
+	}
+
+	// Encode the bitmap in the configured format for mobile transmission
+	var data []byte
+	switch cfg.ImageFormat {
+	case ImageFormatJPEG:
+		data = bm.ToJpeg(quality)
+	case ImageFormatWebP:
+		data = bm.ToWebP(quality)
+	default:
+		data = bm.ToPng()
+	}
+
+	p.client.callbacks.OnBitmapReceived(x, y, width, height, data)
+}
+
+// bitmapEncoding returns the scale and quality to encode updates at: the
+// scale the desktop is shown at when ScaleToScreen is set, the cellular
+// options on a cellular network and the limits of the quality tier
+func (mc *MobileClient) bitmapEncoding(cfg *MobileConfig) (float64, int) {
+	tier := mc.QualityTier()
+
+	mc.inputMutex.RLock()
+	defer mc.inputMutex.RUnlock()
+
+	scale, quality := 1.0, cfg.ImageQuality
+	if tier.BitmapScale > 0 {
+		scale = min(tier.BitmapScale, 1)
+	}
+	if tier.ImageQuality > 0 {
+		quality = min(quality, tier.ImageQuality)
+	}
+	if cfg.ScaleToScreen {
+		scale *= mc.viewport.displayScale()
+	}
+	if mc.cellular {
+		if cfg.CellularBitmapScale > 0 {
+			scale *= min(cfg.CellularBitmapScale, 1)
+		}
+		if cfg.CellularImageQuality > 0 {
+			quality = min(quality, cfg.CellularImageQuality)
+		}
+	}
+	return scale, quality
+}
+
+// remoteSize returns the size of the remote desktop, zero before connecting
+func (mc *MobileClient) remoteSize() (int, int) {
+	mc.inputMutex.RLock()
+	defer mc.inputMutex.RUnlock()
+	return mc.viewport.RemoteWidth, mc.viewport.RemoteHeight
+}
+
+// newQualityController creates the controller of the quality tiers of cfg,
+// telling OnQualityChange as the tier changes
+func (mc *MobileClient) newQualityController(cfg *MobileConfig) *QualityController {
+	q := NewQualityController(cfg.QualityTiers, cfg.QualityUpgradeDelay)
+	q.OnChange(func(tier QualityTier) {
+		glog.Infof("mobile: quality tier %q", tier.Name)
+		if mc.callbacks.OnQualityChange != nil {
+			mc.callbacks.OnQualityChange(tier)
+		}
+	})
+	return q
+}
+
+// QualityTier returns the tier of update quality the measured network
+// allows, the zero tier leaving updates alone when AdaptiveQuality is off
+func (mc *MobileClient) QualityTier() QualityTier {
+	mc.inputMutex.RLock()
+	q, adaptive := mc.quality, mc.mobileConfig.AdaptiveQuality
+	mc.inputMutex.RUnlock()
+	if !adaptive {
+		return QualityTier{}
+	}
+	return q.Tier()
+}
+
+// ReportBandwidth reports the bandwidth of the network in bytes per second
+// for AdaptiveQuality, e.g. the estimate of the operating system for the
+// active link
+func (mc *MobileClient) ReportBandwidth(bytesPerSec float64) {
+	mc.inputMutex.RLock()
+	q := mc.quality
+	mc.inputMutex.RUnlock()
+	q.ObserveBandwidth(bytesPerSec)
 }
 
-// ProcessBitmap processes bitmap data and sends it to the mobile client
-func (p *MobileBitmapProcessor) ProcessBitmap(option *bitmap.Option, bitmap *bitmap.BitMap) {
-	// Convert bitmap to PNG for mobile transmission
-	pngData := bitmap.ToPng()
+// observeRoundTrip feeds the round-trip times measured by the RDP client to
+// the quality controller
+func (mc *MobileClient) observeRoundTrip(rtt time.Duration) {
+	mc.inputMutex.RLock()
+	q := mc.quality
+	mc.inputMutex.RUnlock()
+	q.ObserveLatency(rtt)
+}
 
-	if p.client.callbacks.OnBitmapReceived != nil {
-		p.client.callbacks.OnBitmapReceived(
-			option.Left,
-			option.Top,
-			option.Width,
-			option.Height,
-			pngData,
-		)
+// probeQuality measures the round-trip time every QualityProbeInterval
+// while AdaptiveQuality is on, until the client is disconnected
+func (mc *MobileClient) probeQuality() {
+	interval := mc.GetMobileConfig().QualityProbeInterval
+	if interval <= 0 {
+		interval = DefaultQualityProbeInterval
 	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mc.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if mc.GetMobileConfig().AdaptiveQuality {
+			if err := mc.client.Ping(); err != nil {
+				glog.Debugf("mobile: quality probe: %v", err)
+			}
+		}
+	}
+}
+
+// bitmapSize returns the size of a width by height bitmap scaled by scale
+// and shrunk to fit within maxDimension, if set
+func bitmapSize(width, height int, scale float64, maxDimension int) (int, int) {
+	if maxDimension > 0 {
+		scale = min(scale, float64(maxDimension)/float64(max(width, height)))
+	}
+	if scale >= 1 {
+		return width, height
+	}
+	return max(1, int(math.Round(float64(width)*scale))), max(1, int(math.Round(float64(height)*scale)))
 }
 
+// Image formats used to deliver bitmaps to OnBitmapReceived
+const (
+	ImageFormatPNG  = "png"
+	ImageFormatJPEG = "jpeg"
+	ImageFormatWebP = "webp"
+)
+
 // MobileConfig contains mobile-specific configuration
 type MobileConfig struct {
 	EnableTouchInput          bool `json:"enable_touch_input"`
@@ -999,6 +1336,47 @@ type MobileConfig struct {
 	EnableTripleTapGesture    bool `json:"enable_triple_tap_gesture"`
 	EnableQuadrupleTapGesture bool `json:"enable_quadruple_tap_gesture"`
 	EnableQuintupleTapGesture bool `json:"enable_quintuple_tap_gesture"`
+
+	// ImageFormat is the encoding of bitmaps passed to OnBitmapReceived.
+	// JPEG is much smaller than PNG at the cost of some fidelity.
+	ImageFormat string `json:"image_format"`
+	// ImageQuality is the JPEG quality (1-100); for WebP, which is lossless,
+	// it selects compression effort
+	ImageQuality int `json:"image_quality"`
+
+	// MaxBitmapDimension is the largest width or height of a bitmap passed
+	// to OnBitmapReceived; larger updates are shrunk to fit, keeping their
+	// aspect ratio. Zero leaves them at full size.
+	MaxBitmapDimension int `json:"max_bitmap_dimension"`
+	// ScaleToScreen shrinks updates to the size the desktop is shown at on
+	// the screen set with SetScreenSize, when it is fitted smaller
+	ScaleToScreen bool `json:"scale_to_screen"`
+	// CellularBitmapScale further scales updates on a cellular network (see
+	// SetCellular); zero leaves them as they are
+	CellularBitmapScale float64 `json:"cellular_bitmap_scale"`
+	// CellularImageQuality replaces ImageQuality on a cellular network;
+	// zero keeps ImageQuality
+	CellularImageQuality int `json:"cellular_image_quality"`
+
+	// AdaptiveQuality switches updates between QualityTiers as the measured
+	// round-trip time and the bandwidth given to ReportBandwidth change
+	AdaptiveQuality bool `json:"adaptive_quality"`
+	// QualityTiers are the tiers of update quality, best first;
+	// DefaultQualityTiers when empty
+	QualityTiers []QualityTier `json:"quality_tiers"`
+	// QualityUpgradeDelay is how long the network must allow a better tier
+	// before switching to it; DefaultQualityUpgradeDelay when zero
+	QualityUpgradeDelay time.Duration `json:"quality_upgrade_delay"`
+	// QualityProbeInterval is how often the round-trip time is measured;
+	// DefaultQualityProbeInterval when zero
+	QualityProbeInterval time.Duration `json:"quality_probe_interval"`
+
+	// FlingSensitivity is the wheel delta a fast swipe scrolls for each
+	// pixel it would carry on for; zero turns fling scrolling off
+	FlingSensitivity float64 `json:"fling_sensitivity"`
+	// FlingMinVelocity is the release speed in pixels per second above
+	// which a swipe flings
+	FlingMinVelocity float64 `json:"fling_min_velocity"`
 }
 
 // DefaultMobileConfig returns default mobile configuration
@@ -1060,5 +1438,12 @@ func DefaultMobileConfig() *MobileConfig {
 		EnableTripleTapGesture:    false,
 		EnableQuadrupleTapGesture: false,
 		EnableQuintupleTapGesture: false,
+		ImageFormat:               ImageFormatPNG,
+		ImageQuality:              75,
+		CellularBitmapScale:       0.5,
+		CellularImageQuality:      50,
+		AdaptiveQuality:           false,
+		FlingSensitivity:          1.0,
+		FlingMinVelocity:          500,
 	}
 }
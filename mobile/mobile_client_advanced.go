@@ -312,6 +312,10 @@ type MobilePerformanceManager struct {
 	powerSaving     bool
 	dataSaving      bool
 
+	// Controller switching quality tiers on the latency and bandwidth
+	// metrics while adaptiveQuality is set
+	quality *QualityController
+
 	// Callbacks
 	onPerformanceChange func(map[string]float64)
 }
@@ -850,6 +854,14 @@ func (manager *MobileUIManager) SetOrientation(orientation string) {
 	}
 }
 
+// OnOrientationChange sets the function called as the orientation changes,
+// e.g. to turn the remote desktop with the device by MobileClient.SetOrientation
+func (manager *MobileUIManager) OnOrientationChange(fn func(string)) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	manager.onOrientationChange = fn
+}
+
 // SetTheme sets UI theme
 func (manager *MobileUIManager) SetTheme(theme string) {
 	manager.mutex.Lock()
@@ -1158,12 +1170,32 @@ func (manager *MobilePerformanceManager) UpdatePerformance(metrics map[string]fl
 		}
 	}
 
+	// Drive the quality tier from the network metrics
+	if manager.adaptiveQuality && manager.quality != nil {
+		if latency, ok := metrics["latency"]; ok {
+			manager.quality.ObserveLatency(time.Duration(latency * float64(time.Millisecond)))
+		}
+		if bandwidth, ok := metrics["bandwidth"]; ok {
+			manager.quality.ObserveBandwidth(bandwidth)
+		}
+	}
+
 	// Trigger callback
 	if manager.onPerformanceChange != nil {
 		manager.onPerformanceChange(metrics)
 	}
 }
 
+// SetQualityController sets the controller fed with the "latency" (in
+// milliseconds) and "bandwidth" (in bytes per second) metrics passed to
+// UpdatePerformance while adaptive quality is on
+func (manager *MobilePerformanceManager) SetQualityController(quality *QualityController) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	manager.quality = quality
+}
+
 // SetAdaptiveQuality sets adaptive quality
 func (manager *MobilePerformanceManager) SetAdaptiveQuality(enabled bool) {
 	manager.mutex.Lock()
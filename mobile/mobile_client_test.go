@@ -0,0 +1,87 @@
+package mobile
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistanceAndAngle(t *testing.T) {
+	mc := NewMobileClient()
+	p1 := &TouchPoint{X: 10, Y: 10}
+	p2 := &TouchPoint{X: 13, Y: 14}
+	if d := mc.calculateDistance(p1, p2); d != 5 {
+		t.Errorf("distance = %v, want 5", d)
+	}
+
+	for _, tt := range []struct {
+		x, y int
+		want float64
+	}{
+		{10, 0, 0}, {0, 10, 90}, {-10, 0, 180}, {0, -10, -90}, {-10, -10, -135},
+	} {
+		if a := mc.calculateAngle(&TouchPoint{}, &TouchPoint{X: tt.x, Y: tt.y}); math.Abs(a-tt.want) > 1e-9 {
+			t.Errorf("angle to (%d, %d) = %v, want %v", tt.x, tt.y, a, tt.want)
+		}
+	}
+}
+
+func TestMultiTouchGesture(t *testing.T) {
+	mc := NewMobileClient()
+	mc.mobileConfig.EnableRotateGesture = true
+	var gestures []int
+	var data []map[string]interface{}
+	mc.callbacks.OnGesture = func(gestureType int, d map[string]interface{}) {
+		gestures = append(gestures, gestureType)
+		data = append(data, d)
+	}
+
+	first := &TouchPoint{ID: 1, X: 100, Y: 100}
+	second := &TouchPoint{ID: 2, X: 200, Y: 100}
+	mc.touchState.ActiveTouches[1] = first
+	mc.touchState.ActiveTouches[2] = second
+	mc.startMultiTouchGesture()
+	if got := mc.gestureRecognizer.PinchStartDistance; got != 100 {
+		t.Fatalf("start distance = %v, want 100", got)
+	}
+
+	// a small move is measured against the start, and is no gesture
+	second.X = 205
+	mc.handleMultiTouchGesture()
+	if len(gestures) != 0 {
+		t.Fatalf("gestures = %v after a small move", gestures)
+	}
+
+	// spreading the fingers to twice the distance is a pinch of scale 2
+	second.X = 300
+	mc.handleMultiTouchGesture()
+	if len(gestures) != 1 || gestures[0] != GesturePinch {
+		t.Fatalf("gestures = %v, want a pinch", gestures)
+	}
+	if scale := data[0]["scale"].(float64); scale != 2 {
+		t.Errorf("scale = %v, want 2", scale)
+	}
+
+	// turning a quarter clockwise, without spreading, is a rotation of 90
+	gestures, data = nil, nil
+	second.X, second.Y = 100, 200
+	mc.handleMultiTouchGesture()
+	if len(gestures) != 1 || gestures[0] != GestureRotate {
+		t.Fatalf("gestures = %v, want a rotation", gestures)
+	}
+	if rotation := data[0]["rotation"].(float64); math.Abs(rotation-90) > 1e-9 {
+		t.Errorf("rotation = %v, want 90", rotation)
+	}
+
+	// crossing the negative x axis takes the shorter way round
+	gestures, data = nil, nil
+	first.X, first.Y = 0, 0
+	second.X, second.Y = -100, -1
+	mc.gestureRecognizer.RotationStartAngle = 160
+	mc.handleMultiTouchGesture()
+	if len(gestures) != 1 || gestures[0] != GestureRotate {
+		t.Fatalf("gestures = %v, want a rotation", gestures)
+	}
+	if rotation := data[0]["rotation"].(float64); rotation < 20 || rotation > 21 {
+		t.Errorf("rotation = %v, want about 20.6", rotation)
+	}
+}
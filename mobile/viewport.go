@@ -0,0 +1,74 @@
+package mobile
+
+// Viewport maps touches on the device screen onto the remote desktop. At a
+// zoom of 1 the desktop is fitted to the screen keeping its aspect ratio,
+// centred with bars on the sides that do not fill; zooming in scales it up
+// from there, and the pan picks the part of the desktop shown.
+type Viewport struct {
+	// ScreenWidth and ScreenHeight are the size of the view on the device,
+	// in physical pixels
+	ScreenWidth, ScreenHeight int
+	// PixelDensity is the physical pixels per unit of the touch
+	// coordinates, e.g. 2 on a 2x display reporting touches in points. Zero
+	// is taken as 1.
+	PixelDensity float64
+
+	// RemoteWidth and RemoteHeight are the size of the remote desktop
+	RemoteWidth, RemoteHeight int
+
+	// Zoom is the magnification of the fitted desktop, below 1 taken as 1
+	Zoom float64
+	// PanX and PanY are the remote pixel shown at the top-left corner of the
+	// view when zoomed in
+	PanX, PanY float64
+}
+
+// scale returns the physical screen pixels per remote pixel
+func (v *Viewport) scale() float64 {
+	fit := min(float64(v.ScreenWidth)/float64(v.RemoteWidth), float64(v.ScreenHeight)/float64(v.RemoteHeight))
+	return fit * max(v.Zoom, 1)
+}
+
+// displayScale returns the scale the desktop is shown at, at most 1, or 1
+// without a screen or remote size
+func (v *Viewport) displayScale() float64 {
+	if v.ScreenWidth <= 0 || v.ScreenHeight <= 0 || v.RemoteWidth <= 0 || v.RemoteHeight <= 0 {
+		return 1
+	}
+	return min(v.scale(), 1)
+}
+
+// ToRemote converts a touch position to a position on the remote desktop,
+// clamped to the desktop. Without a screen or remote size it is unchanged.
+func (v *Viewport) ToRemote(x, y int) (int, int) {
+	if v.ScreenWidth <= 0 || v.ScreenHeight <= 0 || v.RemoteWidth <= 0 || v.RemoteHeight <= 0 {
+		return x, y
+	}
+	density := v.PixelDensity
+	if density <= 0 {
+		density = 1
+	}
+	scale := v.scale()
+
+	// the desktop is centred on any axis it does not fill
+	offsetX := max(float64(v.ScreenWidth)-float64(v.RemoteWidth)*scale, 0) / 2
+	offsetY := max(float64(v.ScreenHeight)-float64(v.RemoteHeight)*scale, 0) / 2
+	panX, panY := v.pan(scale)
+
+	remoteX := panX + (float64(x)*density-offsetX)/scale
+	remoteY := panY + (float64(y)*density-offsetY)/scale
+	return clampInt(int(remoteX), v.RemoteWidth-1), clampInt(int(remoteY), v.RemoteHeight-1)
+}
+
+// pan returns the pan kept within the part of the desktop that can be
+// scrolled to at scale
+func (v *Viewport) pan(scale float64) (float64, float64) {
+	maxX := max(float64(v.RemoteWidth)-float64(v.ScreenWidth)/scale, 0)
+	maxY := max(float64(v.RemoteHeight)-float64(v.ScreenHeight)/scale, 0)
+	return min(max(v.PanX, 0), maxX), min(max(v.PanY, 0), maxY)
+}
+
+// clampInt limits v to 0 through upper
+func clampInt(v, upper int) int {
+	return min(max(v, 0), upper)
+}
@@ -0,0 +1,115 @@
+package mobile
+
+import "testing"
+
+func TestViewportToRemote(t *testing.T) {
+	tests := []struct {
+		name     string
+		viewport Viewport
+		x, y     int
+		wantX    int
+		wantY    int
+	}{
+		{
+			name:     "portrait centre",
+			viewport: Viewport{ScreenWidth: 1080, ScreenHeight: 1920, RemoteWidth: 1920, RemoteHeight: 1080},
+			x:        540, y: 960,
+			wantX: 960, wantY: 540,
+		},
+		{
+			name:     "portrait bar above the desktop",
+			viewport: Viewport{ScreenWidth: 1080, ScreenHeight: 1920, RemoteWidth: 1920, RemoteHeight: 1080},
+			x:        1080, y: 100,
+			wantX: 1919, wantY: 0,
+		},
+		{
+			name:     "landscape left edge",
+			viewport: Viewport{ScreenWidth: 2400, ScreenHeight: 1080, RemoteWidth: 1920, RemoteHeight: 1080},
+			x:        240, y: 0,
+			wantX: 0, wantY: 0,
+		},
+		{
+			name:     "landscape centre",
+			viewport: Viewport{ScreenWidth: 2400, ScreenHeight: 1080, RemoteWidth: 1920, RemoteHeight: 1080},
+			x:        1200, y: 540,
+			wantX: 960, wantY: 540,
+		},
+		{
+			name:     "2x density",
+			viewport: Viewport{ScreenWidth: 2160, ScreenHeight: 1215, PixelDensity: 2, RemoteWidth: 1920, RemoteHeight: 1080},
+			x:        960, y: 540,
+			wantX: 1706, wantY: 960,
+		},
+		{
+			name:     "zoomed and panned",
+			viewport: Viewport{ScreenWidth: 1920, ScreenHeight: 1080, RemoteWidth: 1920, RemoteHeight: 1080, Zoom: 2, PanX: 480, PanY: 270},
+			x:        1920, y: 1080,
+			wantX: 1440, wantY: 810,
+		},
+		{
+			name:     "pan past the desktop",
+			viewport: Viewport{ScreenWidth: 1920, ScreenHeight: 1080, RemoteWidth: 1920, RemoteHeight: 1080, Zoom: 2, PanX: 5000, PanY: 5000},
+			x:        0, y: 0,
+			wantX: 960, wantY: 540,
+		},
+		{
+			name:     "no sizes",
+			viewport: Viewport{},
+			x:        123, y: 456,
+			wantX: 123, wantY: 456,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, y := tt.viewport.ToRemote(tt.x, tt.y)
+			if x != tt.wantX || y != tt.wantY {
+				t.Errorf("ToRemote(%d, %d) = (%d, %d), want (%d, %d)", tt.x, tt.y, x, y, tt.wantX, tt.wantY)
+			}
+		})
+	}
+}
+
+func TestBitmapSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		scale         float64
+		maxDimension  int
+		wantW, wantH  int
+	}{
+		{"full size", 64, 64, 1, 0, 64, 64},
+		{"scaled", 1920, 1080, 0.5, 0, 960, 540},
+		{"fitted to the maximum", 1920, 1080, 1, 800, 800, 450},
+		{"scale smaller than the maximum", 1920, 1080, 0.25, 800, 480, 270},
+		{"within the maximum", 64, 32, 1, 800, 64, 32},
+		{"never empty", 100, 1, 0.1, 0, 10, 1},
+	}
+	for _, tt := range tests {
+		if w, h := bitmapSize(tt.width, tt.height, tt.scale, tt.maxDimension); w != tt.wantW || h != tt.wantH {
+			t.Errorf("%s: %dx%d, want %dx%d", tt.name, w, h, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestBitmapEncoding(t *testing.T) {
+	mc := NewMobileClient()
+	cfg := DefaultMobileConfig()
+	mc.SetScreenSize(960, 540, 1)
+	mc.viewport.RemoteWidth, mc.viewport.RemoteHeight = 1920, 1080
+
+	if scale, quality := mc.bitmapEncoding(cfg); scale != 1 || quality != cfg.ImageQuality {
+		t.Errorf("default: scale %v, quality %d", scale, quality)
+	}
+	cfg.ScaleToScreen = true
+	if scale, _ := mc.bitmapEncoding(cfg); scale != 0.5 {
+		t.Errorf("scaled to screen: %v", scale)
+	}
+	mc.SetZoom(4, 0, 0)
+	if scale, _ := mc.bitmapEncoding(cfg); scale != 1 {
+		t.Errorf("zoomed in: %v", scale)
+	}
+	mc.SetCellular(true)
+	if scale, quality := mc.bitmapEncoding(cfg); scale != cfg.CellularBitmapScale || quality != cfg.CellularImageQuality {
+		t.Errorf("cellular: scale %v, quality %d", scale, quality)
+	}
+}
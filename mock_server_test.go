@@ -0,0 +1,69 @@
+package gordp
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/testutil"
+)
+
+const (
+	mockUserId        = testutil.UserId
+	mockShareId       = testutil.ShareId
+	mockServerChannel = testutil.ServerChannel
+	mockFirstChannel  = 1004 // the id of the first static channel offered
+)
+
+// mockServer plays the server side of an already negotiated session over an
+// in-memory pipe with a testutil.Conn, so that the slow-path PDU sequencing
+// of the client can be driven without a real RDP host.
+type mockServer struct {
+	*testutil.Conn
+	t *testing.T
+}
+
+// newMockSession returns a client whose stream is wired to a mockServer
+func newMockSession(t *testing.T) (*Client, *mockServer) {
+	c := NewClient(&Option{Addr: "mock:3389", UserName: "test", Password: "test"})
+	return c, newMockServer(t, c)
+}
+
+// newMockServer wires the stream of c to a mockServer, as if connected,
+// with the static channels offered joined in order from mockFirstChannel
+func newMockServer(t *testing.T, c *Client) *mockServer {
+	clientConn, serverConn := net.Pipe()
+	c.stream = core.NewStreamFromConn(clientConn)
+	c.userId = mockUserId
+	c.shareId = mockShareId
+	ids := make([]uint16, len(c.staticChannels))
+	for i := range ids {
+		ids[i] = mockFirstChannel + uint16(i)
+	}
+	c.bindStaticChannels(ids)
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+		_ = serverConn.Close()
+	})
+	return &mockServer{Conn: testutil.NewConn(serverConn), t: t}
+}
+
+// staticChannelId returns the id of the static channel name of c
+func staticChannelId(c *Client, name string) uint16 {
+	for _, ch := range c.staticChannels {
+		if strings.EqualFold(ch.Name, name) {
+			return ch.ID
+		}
+	}
+	return 0
+}
+
+// serve runs fn on its own goroutine and returns a channel reporting any panic
+func (s *mockServer) serve(fn func()) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- core.Try(fn)
+	}()
+	return done
+}
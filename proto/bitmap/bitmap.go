@@ -2,7 +2,10 @@ package bitmap
 
 import (
 	"bytes"
+	"fmt"
 	"image"
+	"image/color"
+	"image/jpeg"
 	"image/png"
 
 	"github.com/kdsmith18542/gordp/core"
@@ -17,6 +20,13 @@ type Option struct {
 	Height      int    `json:"height"`
 	BitPerPixel int    `json:"-"`
 	Data        []byte `json:"-"`
+
+	// Palette maps the color indices of bitmaps with 8 or fewer bits per pixel
+	Palette color.Palette `json:"-"`
+
+	// Uncompressed marks Data as sent without compression, see
+	// NewBitMapFromUncompressed
+	Uncompressed bool `json:"-"`
 }
 
 type BitMap struct {
@@ -29,6 +39,14 @@ func (m *BitMap) ToPng() []byte {
 	return buf.Bytes()
 }
 
+// ToJpeg encodes the bitmap as JPEG. quality ranges from 1 to 100, higher is
+// better; values outside the range are clamped.
+func (m *BitMap) ToJpeg(quality int) []byte {
+	buf := new(bytes.Buffer)
+	core.ThrowError(jpeg.Encode(buf, m.Image, &jpeg.Options{Quality: quality}))
+	return buf.Bytes()
+}
+
 func NewBitMapFromRDP6(option *Option) *BitMap {
 	return (&BitMap{}).LoadRDP60(option)
 }
@@ -36,3 +54,80 @@ func NewBitMapFromRDP6(option *Option) *BitMap {
 func NewBitmapFromRLE(option *Option) *BitMap {
 	return (&BitMap{}).LoadRLE(option)
 }
+
+// Decode decodes a bitmap with the codec for its color depth: RDP 6.0 planar
+// for 32bpp, keeping the alpha plane if there is one, and interleaved RLE
+// for 8, 15, 16 and 24bpp, unless it is Uncompressed. Only 8bpp bitmaps look
+// at Palette.
+func Decode(option *Option) *BitMap {
+	if option.Uncompressed {
+		return NewBitMapFromUncompressed(option)
+	}
+	switch option.BitPerPixel {
+	case 32:
+		return NewBitMapFromRDP6(option)
+	case 8, 15, 16, 24:
+		return NewBitmapFromRLE(option)
+	default:
+		core.Throwf("unsupported color depth: %v bpp", option.BitPerPixel)
+		return nil
+	}
+}
+
+// NewBitMapFromUncompressed converts the pixels of a bitmap update the
+// server sent without compression, stored bottom-up with each row padded to
+// a multiple of four bytes
+// See [MS-RDPBCGR] 2.2.9.1.1.3.1.2.2
+func NewBitMapFromUncompressed(option *Option) *BitMap {
+	w, h, bpp := option.Width, option.Height, option.BitPerPixel
+	size := 4
+	if bpp != 32 {
+		size = getPixelSize(bpp)
+	}
+	row := w * size
+	stride := (row + 3) &^ 3
+	core.ThrowIf(h > 0 && len(option.Data) < stride*(h-1)+row,
+		fmt.Errorf("short uncompressed %vbpp bitmap: %v bytes for %vx%v", bpp, len(option.Data), w, h))
+
+	// top-down rows without padding, as NewBitMapFromRaw takes them
+	pixels := make([]byte, row*h)
+	for y := 0; y < h; y++ {
+		copy(pixels[y*row:(y+1)*row], option.Data[(h-1-y)*stride:])
+	}
+	raw := *option
+	raw.Data = pixels
+	return NewBitMapFromRaw(&raw)
+}
+
+// NewBitMapFromRaw converts uncompressed pixels stored top-down without row
+// padding, such as the contents of an offscreen surface. The alpha byte of
+// 32bpp pixels is ignored. Only 8bpp bitmaps look at Palette.
+func NewBitMapFromRaw(option *Option) *BitMap {
+	w, h, bpp := option.Width, option.Height, option.BitPerPixel
+	size := 4
+	if bpp != 32 {
+		size = getPixelSize(bpp)
+	}
+	stride := w * size
+	core.ThrowIf(len(option.Data) < stride*h,
+		fmt.Errorf("short %vbpp bitmap: %v bytes for %vx%v", bpp, len(option.Data), w, h))
+
+	if bpp == 32 {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for i := 0; i < w*h; i++ {
+			b, g, r := option.Data[i*4], option.Data[i*4+1], option.Data[i*4+2]
+			copy(img.Pix[i*4:], []byte{r, g, b, 0xFF})
+		}
+		return &BitMap{Image: img}
+	}
+
+	// the RLE converters take bottom-up rows
+	flipped := make([]byte, stride*h)
+	for y := 0; y < h; y++ {
+		copy(flipped[(h-1-y)*stride:], option.Data[y*stride:(y+1)*stride])
+	}
+	if bpp == 8 {
+		return &BitMap{Image: paletteToImage(w, h, flipped, option.Palette)}
+	}
+	return &BitMap{Image: rgbToImage(w, h, bpp, flipped)}
+}
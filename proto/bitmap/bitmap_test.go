@@ -1,12 +1,42 @@
 package bitmap
 
 import (
+	"bytes"
 	"image"
 	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math/rand"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/kdsmith18542/gordp/core"
 )
 
+// desktopBitmap draws something resembling screen content: a grainy
+// gradient wallpaper behind a window with a title bar and lines of text
+func desktopBitmap(w, h int) *BitMap {
+	r := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			n := r.Intn(8)
+			c := color.RGBA{uint8(40 + y*100/h + n), uint8(80 + x*60/w + n), uint8(160 - y*60/h + n), 0xff}
+			if x >= w/4 && x < w*3/4 && y >= h/4 && y < h*3/4 {
+				c = color.RGBA{0xf0, 0xf0, 0xf0, 0xff}
+				if y < h/4+12 {
+					c = color.RGBA{0x20, 0x50, uint8(0x90 + (x-w/4)/8), 0xff}
+				} else if (y-h/4)%14 < 9 && ((x*7+y*3)/5)%3 == 0 {
+					c = color.RGBA{0x10, 0x10, 0x10, 0xff}
+				}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return &BitMap{Image: img}
+}
+
 func TestBitMap_LoadRLE(t *testing.T) {
 	// Create a simple 2x2 bitmap with raw pixel data (not RLE)
 	// For 2x2 bitmap with 16-bit pixels: 4 pixels = 8 bytes
@@ -153,3 +183,298 @@ func TestBitMap_LoadRDP6_InvalidData(t *testing.T) {
 		Width: 2, Height: 2, BitPerPixel: 32, Data: data,
 	})
 }
+
+func TestBitMap_ToJpeg(t *testing.T) {
+	bitmap := desktopBitmap(320, 240)
+	pngSize := len(bitmap.ToPng())
+
+	high := bitmap.ToJpeg(90)
+	low := bitmap.ToJpeg(30)
+	t.Logf("png %d bytes, jpeg q90 %d bytes, jpeg q30 %d bytes", pngSize, len(high), len(low))
+	if len(low) >= len(high) {
+		t.Errorf("Expected quality 30 (%d bytes) to be smaller than quality 90 (%d bytes)", len(low), len(high))
+	}
+	if len(high) >= pngSize {
+		t.Errorf("Expected JPEG (%d bytes) to be smaller than PNG (%d bytes)", len(high), pngSize)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(low))
+	if err != nil {
+		t.Fatalf("Failed to decode JPEG: %v", err)
+	}
+	if img.Bounds() != bitmap.Image.Bounds() {
+		t.Errorf("Expected bounds %v, got %v", bitmap.Image.Bounds(), img.Bounds())
+	}
+}
+
+func TestBitMap_LoadRLE_Palette(t *testing.T) {
+	palette := make(color.Palette, 256)
+	for i := range palette {
+		palette[i] = color.RGBA{A: 255}
+	}
+	palette[1] = color.RGBA{R: 255, A: 255}
+	palette[2] = color.RGBA{G: 255, A: 255}
+	palette[3] = color.RGBA{B: 255, A: 255}
+	palette[4] = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+
+	// REGULAR_COLOR_IMAGE of 4 pixels, rows are stored bottom-up
+	option := &Option{Width: 2, Height: 2, BitPerPixel: 8, Data: []byte{0x84, 1, 2, 3, 4}, Palette: palette}
+	bitmap := NewBitmapFromRLE(option)
+
+	expected := map[image.Point]color.Color{
+		{0, 1}: palette[1],
+		{1, 1}: palette[2],
+		{0, 0}: palette[3],
+		{1, 0}: palette[4],
+	}
+	for p, want := range expected {
+		if got := bitmap.Image.At(p.X, p.Y); got != want {
+			t.Errorf("Pixel %v: expected %v, got %v", p, want, got)
+		}
+	}
+
+	// without a palette the indices come out as gray levels
+	option.Palette = nil
+	bitmap = NewBitmapFromRLE(option)
+	if got := bitmap.Image.At(0, 1); got != (color.Gray{Y: 1}) {
+		t.Errorf("Expected gray level 1, got %v", got)
+	}
+}
+
+// TestRLEDecompress decodes interleaved RLE streams of each color depth,
+// hand-encoded as in [MS-RDPBCGR] 2.2.9.1.1.3.1.2.4, against the pixels
+// they stand for, given bottom-up as the decoder writes them
+func TestRLEDecompress(t *testing.T) {
+	tests := []struct {
+		name string
+		w, h int
+		bpp  int
+		data []byte
+		want []uint32
+	}{
+		{"background runs on both first lines", 2, 2, 16,
+			[]byte{0x02, 0x02}, // REGULAR_BG_RUN of 2 twice
+			[]uint32{0, 0, 0, 0}},
+		{"background run continuing a background run", 2, 3, 16,
+			[]byte{0x62, 0x34, 0x12, 0x01, 0x01, 0x02}, // COLOR_RUN 0x1234, then BG_RUNs
+			[]uint32{0x1234, 0x1234, 0x1234, 0xEDCB, 0xEDCB, 0xEDCB}},
+		{"empty mega background run", 2, 1, 16,
+			[]byte{0xF0, 0x00, 0x00, 0x82, 0x11, 0x11, 0x22, 0x22},
+			[]uint32{0x1111, 0x2222}},
+		{"mega color and foreground runs", 3, 2, 15,
+			[]byte{0xF3, 0x03, 0x00, 0x1F, 0x00, 0xF1, 0x03, 0x00},
+			[]uint32{0x001F, 0x001F, 0x001F, 0x7FE0, 0x7FE0, 0x7FE0}},
+		{"set foreground and foreground/background image", 2, 2, 24,
+			[]byte{0xC2, 0x56, 0x34, 0x12, 0x40, 0x01, 0x01}, // LITE_SET_FG_FG_RUN, FGBG_IMAGE of 2
+			[]uint32{0x123456, 0x123456, 0, 0x123456}},
+		{"set foreground image of 8", 8, 1, 8,
+			[]byte{0xD1, 0x0F, 0xA5}, // LITE_SET_FG_FGBG_IMAGE, mask 10100101
+			[]uint32{0x0F, 0, 0x0F, 0, 0, 0x0F, 0, 0x0F}},
+		{"special foreground/background orders", 8, 3, 8,
+			[]byte{0x68, 0x0F, 0xF9, 0xFA},
+			[]uint32{0x0F, 0x0F, 0x0F, 0x0F, 0x0F, 0x0F, 0x0F, 0x0F,
+				0xF0, 0xF0, 0x0F, 0x0F, 0x0F, 0x0F, 0x0F, 0x0F,
+				0x0F, 0xF0, 0xF0, 0x0F, 0x0F, 0x0F, 0x0F, 0x0F}},
+		{"dithered runs", 4, 2, 15,
+			[]byte{0xF8, 0x02, 0x00, 0x00, 0x7C, 0xE0, 0x03, 0xE2, 0x1F, 0x00, 0xFF, 0x7F},
+			[]uint32{0x7C00, 0x03E0, 0x7C00, 0x03E0, 0x001F, 0x7FFF, 0x001F, 0x7FFF}},
+		{"white, black and mega color image", 2, 2, 24,
+			[]byte{0xFD, 0xFE, 0xF4, 0x02, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06},
+			[]uint32{0xFFFFFF, 0, 0x030201, 0x060504}},
+		{"foreground run after the first line", 2, 2, 16,
+			[]byte{0x82, 0x00, 0xF0, 0x0F, 0x00, 0x22}, // COLOR_IMAGE, then FG_RUN with white
+			[]uint32{0xF000, 0x000F, 0x0FFF, 0xFFF0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := new(bytes.Buffer)
+			for _, pixel := range tt.want {
+				writePixel(raw, pixel, tt.bpp)
+			}
+			var got, want image.Image
+			if err := core.Try(func() {
+				got = rleDecompress(tt.w, tt.h, tt.bpp, tt.data, nil)
+			}); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if tt.bpp == 8 {
+				want = paletteToImage(tt.w, tt.h, raw.Bytes(), nil)
+			} else {
+				want = rgbToImage(tt.w, tt.h, tt.bpp, raw.Bytes())
+			}
+			for y := 0; y < tt.h; y++ {
+				for x := 0; x < tt.w; x++ {
+					if got.At(x, y) != want.At(x, y) {
+						t.Errorf("pixel %d,%d: expected %v, got %v", x, y, want.At(x, y), got.At(x, y))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDecode_MixedDepths(t *testing.T) {
+	palette := color.Palette{color.RGBA{A: 255}, color.RGBA{R: 0x12, G: 0x34, B: 0x56, A: 255}}
+	red := color.RGBA{R: 0xF8, A: 255}
+
+	// 2x1 tiles as REGULAR_COLOR_IMAGE runs, or RDP6 planes with alpha for 32bpp
+	tiles := []struct {
+		bpp  int
+		data []byte
+		want [2]color.Color
+	}{
+		{8, []byte{0x82, 1, 0}, [2]color.Color{palette[1], palette[0]}},
+		{16, []byte{0x82, 0x00, 0xF8, 0x1F, 0x00}, [2]color.Color{red, color.RGBA{B: 0xF8, A: 255}}},
+		{32, []byte{0x20, 0x80, 0xFF, 0x10, 0x20, 0x30, 0x40, 0x50, 0x60},
+			[2]color.Color{color.RGBA{R: 0x10, G: 0x30, B: 0x50, A: 0x80}, color.RGBA{R: 0x20, G: 0x40, B: 0x60, A: 0xFF}}},
+		{24, []byte{0x82, 0x56, 0x34, 0x12, 0x00, 0x00, 0xFF}, [2]color.Color{color.RGBA{R: 0x12, G: 0x34, B: 0x56, A: 255}, color.RGBA{R: 0xFF, A: 255}}},
+		{15, []byte{0x82, 0x00, 0x7C, 0xE0, 0x03}, [2]color.Color{red, color.RGBA{G: 0xF8, A: 255}}},
+		{8, []byte{0x82, 0, 1}, [2]color.Color{palette[0], palette[1]}},
+	}
+	for i, tile := range tiles {
+		// every tile gets the palette, only 8bpp ones may use it
+		bitmap := Decode(&Option{Width: 2, Height: 1, BitPerPixel: tile.bpp, Data: tile.data, Palette: palette})
+		for x, want := range tile.want {
+			if got := color.RGBAModel.Convert(bitmap.Image.At(x, 0)); got != color.RGBAModel.Convert(want) {
+				t.Errorf("Tile %d (%dbpp) pixel %d: expected %v, got %v", i, tile.bpp, x, want, got)
+			}
+		}
+	}
+}
+
+func TestDecode_UnsupportedDepth(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("Expected panic for 4bpp bitmap")
+		}
+	}()
+	Decode(&Option{Width: 2, Height: 1, BitPerPixel: 4, Data: []byte{0x81, 0}})
+}
+
+func TestNewBitMapFromRaw(t *testing.T) {
+	// 1x2, top row first
+	tiles := []struct {
+		bpp  int
+		data []byte
+	}{
+		{32, []byte{0x00, 0x00, 0xF8, 0x00, 0xF8, 0x00, 0x00, 0x00}},
+		{24, []byte{0x00, 0x00, 0xF8, 0xF8, 0x00, 0x00}},
+		{16, []byte{0x00, 0xF8, 0x1F, 0x00}},
+	}
+	for _, tile := range tiles {
+		bitmap := NewBitMapFromRaw(&Option{Width: 1, Height: 2, BitPerPixel: tile.bpp, Data: tile.data})
+		if got := bitmap.Image.At(0, 0); got != (color.RGBA{R: 0xF8, A: 255}) {
+			t.Errorf("%dbpp top pixel: expected red, got %v", tile.bpp, got)
+		}
+		if got := bitmap.Image.At(0, 1); got != (color.RGBA{B: 0xF8, A: 255}) {
+			t.Errorf("%dbpp bottom pixel: expected blue, got %v", tile.bpp, got)
+		}
+	}
+}
+
+func TestNewBitMapFromUncompressed(t *testing.T) {
+	// 1x2, bottom row first, rows padded to four bytes
+	tiles := []struct {
+		bpp  int
+		data []byte
+	}{
+		{32, []byte{0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0xF8, 0x00}},
+		{24, []byte{0xF8, 0x00, 0x00, 0xFF, 0x00, 0x00, 0xF8}},
+		{16, []byte{0x1F, 0x00, 0xFF, 0xFF, 0x00, 0xF8}},
+	}
+	for _, tile := range tiles {
+		bitmap := Decode(&Option{Width: 1, Height: 2, BitPerPixel: tile.bpp, Data: tile.data, Uncompressed: true})
+		if got := bitmap.Image.At(0, 0); got != (color.RGBA{R: 0xF8, A: 255}) {
+			t.Errorf("%dbpp top pixel: expected red, got %v", tile.bpp, got)
+		}
+		if got := bitmap.Image.At(0, 1); got != (color.RGBA{B: 0xF8, A: 255}) {
+			t.Errorf("%dbpp bottom pixel: expected blue, got %v", tile.bpp, got)
+		}
+	}
+}
+
+func TestBitrateScaler(t *testing.T) {
+	desktop := desktopBitmap(320, 240)
+	frame := 100 * time.Millisecond
+
+	// re-stream the desktop at 10 fps until the scale settles
+	settle := func(s *BitrateScaler) float64 {
+		for i := 0; i < 20; i++ {
+			scaled := &BitMap{Image: Downscale(desktop.Image, s.Scale())}
+			s.Observe(len(scaled.ToJpeg(75)), frame)
+		}
+		return s.Scale()
+	}
+
+	full := len(desktop.ToJpeg(75)) * 8 * 10 / 1000 // kbps at full size
+	s := NewBitrateScaler(full / 4)
+	low := settle(s)
+	if low >= 0.9 || low <= DefaultMinScale {
+		t.Fatalf("expected a scale between %v and 0.9 for a quarter of %v kbps, got %v", DefaultMinScale, full, low)
+	}
+
+	s.SetTarget(full / 2)
+	high := settle(s)
+	if high <= low {
+		t.Errorf("raising the target should raise the scale: %v -> %v", low, high)
+	}
+
+	s.SetTarget(full / 8)
+	if lower := settle(s); lower >= high {
+		t.Errorf("lowering the target should lower the scale: %v -> %v", high, lower)
+	}
+
+	s.SetTarget(full * 2)
+	if got := settle(s); got != 1 {
+		t.Errorf("expected full size within the target, got %v", got)
+	}
+}
+
+func TestDownscale(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	draw.Draw(img, image.Rect(0, 0, 2, 2), image.NewUniform(color.RGBA{R: 200, A: 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(2, 0, 4, 2), image.NewUniform(color.RGBA{B: 100, A: 255}), image.Point{}, draw.Src)
+	img.Set(1, 1, color.RGBA{A: 255})
+
+	scaled := Downscale(img, 0.5)
+	if scaled.Bounds() != image.Rect(0, 0, 2, 1) {
+		t.Fatalf("unexpected bounds: %v", scaled.Bounds())
+	}
+	if got := scaled.At(0, 0); got != (color.RGBA{R: 150, A: 255}) {
+		t.Errorf("expected the average of the left block, got %v", got)
+	}
+	if got := scaled.At(1, 0); got != (color.RGBA{B: 100, A: 255}) {
+		t.Errorf("expected the right block, got %v", got)
+	}
+	if Downscale(img, 1) != image.Image(img) {
+		t.Errorf("expected the image as is at full scale")
+	}
+}
+
+func TestResize(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.RGBA{A: 255})
+	img.Set(1, 0, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+	bm := &BitMap{Image: img}
+
+	wider := Resize(bm, 4, 2)
+	if wider.Image.Bounds() != image.Rect(0, 0, 4, 2) {
+		t.Fatalf("unexpected bounds: %v", wider.Image.Bounds())
+	}
+	for x, want := range []uint8{0, 64, 191, 255} {
+		for y := 0; y < 2; y++ {
+			if got := wider.Image.At(x, y); got != (color.RGBA{R: want, G: want, B: want, A: 255}) {
+				t.Errorf("pixel (%d, %d): got %v, want grey %d", x, y, got, want)
+			}
+		}
+	}
+
+	desktop := desktopBitmap(64, 48)
+	small := Resize(desktop, 16, 12)
+	if small.Image.Bounds() != image.Rect(0, 0, 16, 12) {
+		t.Fatalf("unexpected bounds: %v", small.Image.Bounds())
+	}
+	if Resize(desktop, 64, 48) != desktop || Resize(desktop, 0, 12) != desktop {
+		t.Errorf("expected the bitmap as is for an unchanged or empty size")
+	}
+}
@@ -0,0 +1,129 @@
+package bitmap
+
+import (
+	"image"
+	"image/draw"
+	"sync"
+)
+
+// Framebuffer composites bitmap updates into a persistent desktop surface.
+// It is safe for concurrent use: updates are applied from the session loop
+// while consumers take snapshots from their own goroutines.
+type Framebuffer struct {
+	mu  sync.RWMutex
+	img *image.RGBA
+
+	// pixels not painted by any update yet; dropped once all are covered
+	uncovered []bool
+	remaining int
+	complete  chan struct{}
+}
+
+// NewFramebuffer creates a black width x height framebuffer
+func NewFramebuffer(width, height int) *Framebuffer {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.Black, image.Point{}, draw.Src)
+	f := &Framebuffer{
+		img:       img,
+		uncovered: make([]bool, width*height),
+		remaining: width * height,
+		complete:  make(chan struct{}),
+	}
+	for i := range f.uncovered {
+		f.uncovered[i] = true
+	}
+	if f.remaining == 0 {
+		close(f.complete)
+	}
+	return f
+}
+
+// Width returns the width of the surface in pixels
+func (f *Framebuffer) Width() int {
+	return f.img.Rect.Dx()
+}
+
+// Height returns the height of the surface in pixels
+func (f *Framebuffer) Height() int {
+	return f.img.Rect.Dy()
+}
+
+// Stride returns the number of bytes between vertically adjacent pixels
+func (f *Framebuffer) Stride() int {
+	return f.img.Stride
+}
+
+// ApplyUpdate blits a decoded bitmap rectangle at the position given by
+// option. Parts falling outside the surface are clipped.
+func (f *Framebuffer) ApplyUpdate(option *Option, bitmap *BitMap) {
+	if option == nil || bitmap == nil || bitmap.Image == nil {
+		return
+	}
+	src := bitmap.Image.Bounds()
+	dst := image.Rect(option.Left, option.Top, option.Left+option.Width, option.Top+option.Height)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	draw.Draw(f.img, dst, bitmap.Image, src.Min, draw.Src)
+	f.cover(dst.Intersect(src.Sub(src.Min).Add(dst.Min)))
+}
+
+// cover marks r as painted and signals Complete once every pixel has been
+func (f *Framebuffer) cover(r image.Rectangle) {
+	if f.uncovered == nil {
+		return
+	}
+	r = r.Intersect(f.img.Rect)
+	width := f.img.Rect.Dx()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := f.uncovered[y*width : (y+1)*width]
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if row[x] {
+				row[x] = false
+				f.remaining--
+			}
+		}
+	}
+	if f.remaining == 0 {
+		f.uncovered = nil
+		close(f.complete)
+	}
+}
+
+// Complete returns a channel closed once updates have painted every pixel
+// of the surface, i.e. a full frame has been received
+func (f *Framebuffer) Complete() <-chan struct{} {
+	return f.complete
+}
+
+// Snapshot returns a copy of the current surface
+func (f *Framebuffer) Snapshot() image.Image {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	img := &image.RGBA{
+		Pix:    make([]byte, len(f.img.Pix)),
+		Stride: f.img.Stride,
+		Rect:   f.img.Rect,
+	}
+	copy(img.Pix, f.img.Pix)
+	return img
+}
+
+// SnapshotRect returns a copy of the part r of the surface, with its origin
+// at 0, 0 like a decoded bitmap
+func (f *Framebuffer) SnapshotRect(r image.Rectangle) image.Image {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	r = r.Intersect(f.img.Rect)
+	img := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(img, img.Rect, f.img, r.Min, draw.Src)
+	return img
+}
+
+// Paint calls fn to draw on the surface itself, e.g. with drawing orders,
+// holding the lock so that no snapshot sees half of it. What fn changes
+// is not marked painted; apply it with ApplyUpdate for that.
+func (f *Framebuffer) Paint(fn func(img *image.RGBA)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn(f.img)
+}
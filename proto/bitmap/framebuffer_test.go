@@ -0,0 +1,110 @@
+package bitmap
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+var (
+	fbBlack = color.RGBA{A: 255}
+	fbRed   = color.RGBA{R: 255, A: 255}
+	fbBlue  = color.RGBA{B: 255, A: 255}
+	fbWhite = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+)
+
+func solidBitmap(w, h int, c color.Color) *BitMap {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return &BitMap{Image: img}
+}
+
+func TestFramebuffer_ApplyUpdate(t *testing.T) {
+	fb := NewFramebuffer(64, 32)
+	if fb.Width() != 64 || fb.Height() != 32 || fb.Stride() != 64*4 {
+		t.Fatalf("unexpected geometry: %dx%d stride %d", fb.Width(), fb.Height(), fb.Stride())
+	}
+
+	fb.ApplyUpdate(&Option{Left: 0, Top: 0, Width: 16, Height: 16}, solidBitmap(16, 16, fbRed))
+	// overlaps the first rectangle and runs off the right edge
+	fb.ApplyUpdate(&Option{Left: 8, Top: 8, Width: 64, Height: 8}, solidBitmap(64, 8, fbBlue))
+
+	snap := fb.Snapshot()
+	if snap.Bounds() != image.Rect(0, 0, 64, 32) {
+		t.Fatalf("unexpected snapshot bounds: %v", snap.Bounds())
+	}
+	for _, tc := range []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{0, 0, fbRed},
+		{15, 7, fbRed},
+		{7, 15, fbRed},
+		{8, 8, fbBlue},
+		{63, 15, fbBlue},
+		{20, 20, fbBlack},
+	} {
+		if got := snap.At(tc.x, tc.y); got != tc.want {
+			t.Errorf("pixel (%d,%d) = %v, want %v", tc.x, tc.y, got, tc.want)
+		}
+	}
+}
+
+func TestFramebuffer_SnapshotIsCopy(t *testing.T) {
+	fb := NewFramebuffer(4, 4)
+	snap := fb.Snapshot()
+	fb.ApplyUpdate(&Option{Width: 4, Height: 4}, solidBitmap(4, 4, color.White))
+	if got := snap.At(0, 0); got != fbBlack {
+		t.Errorf("earlier snapshot changed: %v", got)
+	}
+	if got := fb.Snapshot().At(0, 0); got != fbWhite {
+		t.Errorf("update not applied: %v", got)
+	}
+}
+
+func TestFramebuffer_SnapshotRect(t *testing.T) {
+	fb := NewFramebuffer(8, 8)
+	fb.ApplyUpdate(&Option{Left: 4, Top: 2, Width: 2, Height: 2}, solidBitmap(2, 2, fbRed))
+	snap := fb.SnapshotRect(image.Rect(3, 2, 6, 4))
+	if snap.Bounds() != image.Rect(0, 0, 3, 2) {
+		t.Fatalf("unexpected bounds: %v", snap.Bounds())
+	}
+	if got := snap.At(0, 0); got != fbBlack {
+		t.Errorf("pixel left of the update: %v", got)
+	}
+	if got := snap.At(1, 1); got != fbRed {
+		t.Errorf("pixel of the update: %v", got)
+	}
+	if got := fb.SnapshotRect(image.Rect(6, 6, 10, 10)).Bounds(); got != image.Rect(0, 0, 2, 2) {
+		t.Errorf("expected the rectangle clipped to the surface, got %v", got)
+	}
+}
+
+func TestFramebuffer_Complete(t *testing.T) {
+	fb := NewFramebuffer(8, 4)
+	isComplete := func() bool {
+		select {
+		case <-fb.Complete():
+			return true
+		default:
+			return false
+		}
+	}
+
+	fb.ApplyUpdate(&Option{Left: 0, Top: 0, Width: 4, Height: 4}, solidBitmap(4, 4, fbRed))
+	// repainting the same area must not count twice
+	fb.ApplyUpdate(&Option{Left: 0, Top: 0, Width: 4, Height: 4}, solidBitmap(4, 4, fbBlue))
+	if isComplete() {
+		t.Fatal("complete after covering half the surface")
+	}
+	// a bitmap smaller than its declared rectangle only covers what it paints
+	fb.ApplyUpdate(&Option{Left: 4, Top: 0, Width: 4, Height: 4}, solidBitmap(4, 2, fbBlue))
+	if isComplete() {
+		t.Fatal("complete with rows still unpainted")
+	}
+	fb.ApplyUpdate(&Option{Left: 4, Top: 2, Width: 8, Height: 2}, solidBitmap(8, 2, fbBlue))
+	if !isComplete() {
+		t.Fatal("not complete after covering every pixel")
+	}
+}
@@ -0,0 +1,18 @@
+package bitmap
+
+import "image"
+
+// Pointer is the mouse pointer the server shows: its shape and where it is
+// on the desktop
+type Pointer struct {
+	// Image is the shape, nil for the default pointer of the client
+	Image *image.RGBA
+
+	// HotSpot is the point of Image that is at Position
+	HotSpot image.Point
+
+	Position image.Point
+
+	// Hidden is set when the server hides the pointer
+	Hidden bool
+}
@@ -181,18 +181,28 @@ func peekPixel(r *bytes.Buffer, rowDelta int, bpp int) uint32 {
 }
 
 // 解压RLE格式Bitmap
-func rleDecompress(w, h, bpp int, data []byte) image.Image {
+// See [MS-RDPBCGR] 3.1.9
+func rleDecompress(w, h, bpp int, data []byte, palette color.Palette) image.Image {
 	r := bytes.NewReader(data)
 	whitePixel := getColorWhite(bpp)
 	blackPixel := getColorBlack()
 	fgPel := whitePixel // 背景色 --> MIX
+	rowDelta := w * getPixelSize(bpp)
 
 	dest := new(bytes.Buffer)
 
 	insertFgPel := false // for FILL
+	firstLine := true
 	//pixels := 0
 
 	for r.Len() > 0 {
+		// a background run on the second line does not continue one that
+		// ended the first line
+		if firstLine && dest.Len() >= rowDelta {
+			firstLine = false
+			insertFgPel = false
+		}
+
 		codeHeader := ReadByte(r)
 		code := extractCodeId(codeHeader)
 		//glog.Debugf("code: %s[%v]", codeMap[code], code)
@@ -203,16 +213,14 @@ func rleDecompress(w, h, bpp int, data []byte) image.Image {
 			//pixels += runLength
 			//glog.Debugf("+++ runLength: %v, pixels: %v", runLength, pixels)
 
-			pixel := peekPixel(dest, w*getPixelSize(bpp), bpp) // 查找上一行像素
-			if insertFgPel {                                   // FILL & lastcode == FILL
+			if insertFgPel { // FILL & lastcode == FILL
+				pixel := peekPixel(dest, rowDelta, bpp) // 查找上一行像素
 				writePixel(dest, pixel^fgPel, bpp)
-			} else { // FILL & lastcode != FILL
-				writePixel(dest, pixel, bpp)
+				runLength--
 			}
-			runLength--
 
 			for ; runLength > 0; runLength-- {
-				pixel := peekPixel(dest, w*getPixelSize(bpp), bpp) // 查找上一行像素
+				pixel := peekPixel(dest, rowDelta, bpp) // 查找上一行像素
 				writePixel(dest, pixel, bpp)
 			}
 
@@ -240,7 +248,7 @@ func rleDecompress(w, h, bpp int, data []byte) image.Image {
 			//glog.Debugf("+++ runLength: %v, pixels: %v", runLength, pixels)
 
 			for ; runLength > 0; runLength-- {
-				pixel := peekPixel(dest, w*getPixelSize(bpp), bpp) // 查找上一行像素
+				pixel := peekPixel(dest, rowDelta, bpp) // 查找上一行像素
 				writePixel(dest, pixel^fgPel, bpp)
 			}
 
@@ -287,7 +295,7 @@ func rleDecompress(w, h, bpp int, data []byte) image.Image {
 					cBits = runLength
 				}
 				for ; cBits > 0; cBits-- {
-					pixel := peekPixel(dest, w*getPixelSize(bpp), bpp) // 查找上一行像素
+					pixel := peekPixel(dest, rowDelta, bpp) // 查找上一行像素
 					if bitmask&0x1 > 0 {
 						// RDP FGBG: XOR with foreground color per spec
 						pixel ^= fgPel
@@ -304,7 +312,7 @@ func rleDecompress(w, h, bpp int, data []byte) image.Image {
 			cBits := 8
 			bitmask := g_MaskSpecialFgBg1
 			for ; cBits > 0; cBits-- {
-				pixel := peekPixel(dest, w*getPixelSize(bpp), bpp) // 查找上一行像素
+				pixel := peekPixel(dest, rowDelta, bpp) // 查找上一行像素
 				if bitmask&0x1 > 0 {
 					// RDP Special FGBG 1: XOR with foreground color per spec
 					pixel ^= fgPel
@@ -321,7 +329,7 @@ func rleDecompress(w, h, bpp int, data []byte) image.Image {
 			cBits := 8
 			bitmask := g_MaskSpecialFgBg2
 			for ; cBits > 0; cBits-- {
-				pixel := peekPixel(dest, w*getPixelSize(bpp), bpp) // 查找上一行像素
+				pixel := peekPixel(dest, rowDelta, bpp) // 查找上一行像素
 				if bitmask&0x1 > 0 {
 					// RDP Special FGBG 2: XOR with foreground color per spec
 					pixel ^= fgPel
@@ -349,20 +357,50 @@ func rleDecompress(w, h, bpp int, data []byte) image.Image {
 				code, codeHeader, runLength, data)
 		}
 	}
-	return rgb565ToImage(w, h, bpp, dest.Bytes())
+	if bpp <= 8 {
+		return paletteToImage(w, h, dest.Bytes(), palette)
+	}
+	return rgbToImage(w, h, bpp, dest.Bytes())
 }
 
-func rgb565ToImage(w int, h int, bpp int, data []byte) image.Image {
+// rgbToImage converts bottom-up 15bpp (RGB555), 16bpp (RGB565) or 24bpp
+// (BGR) pixels
+func rgbToImage(w int, h int, bpp int, data []byte) image.Image {
 	img := image.NewRGBA(image.Rect(0, 0, w, h))
 	r := bytes.NewReader(data)
 	for y := 1; y <= h; y++ {
 		for x := 0; x < w; x++ {
-			pixel := readPixel(r, 16)
-			// RGB565
-			r := uint8((pixel&0xF800)>>11) << 3
-			g := uint8((pixel&0x7E0)>>5) << 2
-			b := uint8(pixel&0x1F) << 3
-			img.Set(x, h-y, color.RGBA{R: r, G: g, B: b, A: 255})
+			pixel := readPixel(r, bpp)
+			var c color.RGBA
+			switch bpp {
+			case 15:
+				c = color.RGBA{R: uint8(pixel>>10&0x1F) << 3, G: uint8(pixel>>5&0x1F) << 3, B: uint8(pixel&0x1F) << 3}
+			case 16:
+				c = color.RGBA{R: uint8(pixel>>11&0x1F) << 3, G: uint8(pixel>>5&0x3F) << 2, B: uint8(pixel&0x1F) << 3}
+			default:
+				c = color.RGBA{R: uint8(pixel >> 16), G: uint8(pixel >> 8), B: uint8(pixel)}
+			}
+			c.A = 255
+			img.Set(x, h-y, c)
+		}
+	}
+	return img
+}
+
+// paletteToImage maps bottom-up 8bpp indices through palette. Without a
+// palette from the server the indices are shown as gray levels.
+func paletteToImage(w int, h int, data []byte, palette color.Palette) image.Image {
+	if len(palette) == 0 {
+		palette = make(color.Palette, 256)
+		for i := range palette {
+			palette[i] = color.Gray{Y: uint8(i)}
+		}
+	}
+	img := image.NewPaletted(image.Rect(0, 0, w, h), palette)
+	for y := 0; y < h && (y+1)*w <= len(data); y++ {
+		row := img.Pix[(h-1-y)*img.Stride:]
+		for x, index := range data[y*w : (y+1)*w] {
+			row[x] = min(index, uint8(len(palette)-1))
 		}
 	}
 	return img
@@ -370,6 +408,6 @@ func rgb565ToImage(w int, h int, bpp int, data []byte) image.Image {
 
 // LoadRLE 加载RLE格式的Bitmap数据
 func (m *BitMap) LoadRLE(option *Option) *BitMap {
-	m.Image = rleDecompress(option.Width, option.Height, option.BitPerPixel, option.Data)
+	m.Image = rleDecompress(option.Width, option.Height, option.BitPerPixel, option.Data, option.Palette)
 	return m
 }
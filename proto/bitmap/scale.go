@@ -0,0 +1,165 @@
+package bitmap
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"sync"
+	"time"
+)
+
+// DefaultMinScale is the smallest scale a BitrateScaler goes down to
+const DefaultMinScale = 0.25
+
+// BitrateScaler picks the scale to re-stream frames at, e.g. as MJPEG to a
+// browser, so that the encoded output stays within a target bitrate on a
+// slow downstream link. Encode each frame downscaled to Scale, with any
+// quality setting, and report its size with Observe.
+//
+// The size of an encoded frame is taken to grow with its area, so the
+// scale moves by the square root of how far the measured bitrate is off
+// the target, halfway at a time to ride out single busy frames.
+type BitrateScaler struct {
+	mu sync.Mutex
+
+	// TargetOutputBitrateKbps is the bitrate to stay within, 0 leaves
+	// frames at full size
+	TargetOutputBitrateKbps int
+
+	// MinScale is the smallest scale chosen, DefaultMinScale when 0
+	MinScale float64
+
+	scale float64
+}
+
+// NewBitrateScaler creates a scaler starting at full size
+func NewBitrateScaler(targetKbps int) *BitrateScaler {
+	return &BitrateScaler{TargetOutputBitrateKbps: targetKbps, scale: 1}
+}
+
+// SetTarget changes the target bitrate, e.g. when the viewer reports a
+// change in link speed
+func (s *BitrateScaler) SetTarget(kbps int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.TargetOutputBitrateKbps = kbps
+}
+
+// Scale returns the factor to scale the next frame by, in (0, 1]
+func (s *BitrateScaler) Scale() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scale == 0 || s.TargetOutputBitrateKbps <= 0 {
+		return 1
+	}
+	return s.scale
+}
+
+// Observe reports a frame encoded at the current scale to encodedBytes,
+// sent interval after the previous one
+func (s *BitrateScaler) Observe(encodedBytes int, interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scale == 0 {
+		s.scale = 1
+	}
+	if s.TargetOutputBitrateKbps <= 0 || encodedBytes <= 0 || interval <= 0 {
+		return
+	}
+
+	kbps := float64(encodedBytes) * 8 / interval.Seconds() / 1000
+	ideal := s.scale * math.Sqrt(float64(s.TargetOutputBitrateKbps)/kbps)
+	minScale := s.MinScale
+	if minScale <= 0 {
+		minScale = DefaultMinScale
+	}
+	s.scale = max(minScale, min(1, s.scale+(ideal-s.scale)/2))
+}
+
+// Downscale shrinks img by scale, averaging the source pixels each output
+// pixel covers. A scale of 1 or more returns img as is.
+func Downscale(img image.Image, scale float64) image.Image {
+	if scale >= 1 {
+		return img
+	}
+	b := img.Bounds()
+	w := max(1, int(float64(b.Dx())*scale))
+	h := max(1, int(float64(b.Dy())*scale))
+
+	src := toRGBA(img)
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(row[sx*4+c])
+					}
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			for c := 0; c < 4; c++ {
+				dst.Pix[y*dst.Stride+x*4+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// Resize scales bm to width by height with bilinear filtering, e.g. to
+// shrink updates for a small screen. A non-positive or unchanged size
+// returns bm as is.
+func Resize(bm *BitMap, width, height int) *BitMap {
+	b := bm.Image.Bounds()
+	if width <= 0 || height <= 0 || (width == b.Dx() && height == b.Dy()) {
+		return bm
+	}
+	return &BitMap{Image: resizeBilinear(bm.Image, width, height)}
+}
+
+// resizeBilinear samples img at the centre of each output pixel, weighting
+// the four source pixels around it by distance
+func resizeBilinear(img image.Image, w, h int) *image.RGBA {
+	src := toRGBA(img)
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		fy := min(max((float64(y)+0.5)*float64(sh)/float64(h)-0.5, 0), float64(sh-1))
+		y0 := int(fy)
+		y1, wy := min(y0+1, sh-1), fy-float64(y0)
+		for x := 0; x < w; x++ {
+			fx := min(max((float64(x)+0.5)*float64(sw)/float64(w)-0.5, 0), float64(sw-1))
+			x0 := int(fx)
+			x1, wx := min(x0+1, sw-1), fx-float64(x0)
+			for c := 0; c < 4; c++ {
+				p00 := float64(src.Pix[y0*src.Stride+x0*4+c])
+				p01 := float64(src.Pix[y0*src.Stride+x1*4+c])
+				p10 := float64(src.Pix[y1*src.Stride+x0*4+c])
+				p11 := float64(src.Pix[y1*src.Stride+x1*4+c])
+				top := p00 + (p01-p00)*wx
+				bottom := p10 + (p11-p10)*wx
+				dst.Pix[y*dst.Stride+x*4+c] = uint8(top + (bottom-top)*wy + 0.5)
+			}
+		}
+	}
+	return dst
+}
+
+// toRGBA returns img as an RGBA image with its origin at 0, 0, copying it
+// when it is not one
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	if src, ok := img.(*image.RGBA); ok && b.Min == (image.Point{}) {
+		return src
+	}
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Rect, img, b.Min, draw.Src)
+	return src
+}
@@ -0,0 +1,529 @@
+package bitmap
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"math/bits"
+	"sort"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// WebP output uses the lossless VP8L bitstream. Lossy VP8 would need a full
+// video encoder, and desktop content (text, flat areas, gradients) predicts
+// well enough that lossless output stays small.
+
+const (
+	vp8lSignature      = 0x2f
+	vp8lMaxImageSize   = 1 << 14
+	vp8lNumLiterals    = 256
+	vp8lNumLengthCodes = 24
+	vp8lNumDistCodes   = 40
+	vp8lMinMatch       = 3
+	vp8lMaxMatch       = 4096
+	vp8lMaxCodeLength  = 15
+	vp8lMaxLengthCode  = 7 // longest code of the code length code
+	vp8lNumPredictors  = 14
+	vp8lPredictorBits  = 4 // predictor blocks are 16x16 pixels
+)
+
+// transform types
+const (
+	vp8lPredictorTransform     = 0
+	vp8lSubtractGreenTransform = 2
+)
+
+// distance codes of the two neighbours used for backward references
+const (
+	vp8lDistUp   = 1 // (0,1): same column, previous row
+	vp8lDistLeft = 2 // (1,0): previous pixel
+)
+
+// order in which the code length code lengths are stored
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// ToWebP encodes the bitmap as a lossless WebP image. As with libwebp's
+// lossless mode, quality selects compression effort rather than fidelity:
+// below 50 every pixel is predicted from its left neighbour and stored as a
+// literal, from 50 up the best predictor is searched per block and repeated
+// runs become backward references.
+func (m *BitMap) ToWebP(quality int) []byte {
+	b := m.Image.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width <= 0 || height <= 0 || width > vp8lMaxImageSize || height > vp8lMaxImageSize {
+		core.Throw(fmt.Errorf("webp: invalid image size %dx%d", width, height))
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Rect, m.Image, b.Min, draw.Src)
+
+	argb := make([]uint32, width*height)
+	var alpha uint32
+	for i := range argb {
+		p := img.Pix[i*4 : i*4+4]
+		argb[i] = uint32(p[3])<<24 | uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+		if p[3] != 0xff {
+			alpha = 1
+		}
+	}
+	search := quality >= 50
+
+	w := &vp8lWriter{}
+	w.write(vp8lSignature, 8)
+	w.write(uint32(width-1), 14)
+	w.write(uint32(height-1), 14)
+	w.write(alpha, 1)
+	w.write(0, 3) // version
+
+	// the decoder undoes the transforms in reverse order
+	w.write(1, 1)
+	w.write(vp8lSubtractGreenTransform, 2)
+	vp8lSubtractGreen(argb)
+
+	w.write(1, 1)
+	w.write(vp8lPredictorTransform, 2)
+	w.write(vp8lPredictorBits-2, 3)
+	modes, residuals := vp8lPredict(argb, width, height, search)
+	w.writeImage(modes, vp8lSubSampleSize(width), false, search)
+
+	w.write(0, 1) // no more transforms
+	w.writeImage(residuals, width, true, search)
+	data := w.bytes()
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("RIFF")
+	core.WriteLE(buf, uint32(4+8+len(data)+len(data)&1))
+	buf.WriteString("WEBP")
+	buf.WriteString("VP8L")
+	core.WriteLE(buf, uint32(len(data)))
+	buf.Write(data)
+	if len(data)&1 == 1 {
+		buf.WriteByte(0) // chunks are padded to an even size
+	}
+	return buf.Bytes()
+}
+
+// vp8lSubtractGreen applies the subtract green transform in place
+func vp8lSubtractGreen(argb []uint32) {
+	for i, p := range argb {
+		g := p >> 8 & 0xff
+		argb[i] = p&0xff00ff00 | ((p>>16-g)&0xff)<<16 | (p-g)&0xff
+	}
+}
+
+func vp8lSubSampleSize(size int) int {
+	return (size + 1<<vp8lPredictorBits - 1) >> vp8lPredictorBits
+}
+
+// vp8lPredict picks a predictor mode for every block and returns the mode
+// image (modes live in the green channel) along with the residuals. Without
+// search every block uses the left pixel.
+func vp8lPredict(argb []uint32, width, height int, search bool) (modes, residuals []uint32) {
+	const size = 1 << vp8lPredictorBits
+	tilesX, tilesY := vp8lSubSampleSize(width), vp8lSubSampleSize(height)
+	modes = make([]uint32, tilesX*tilesY)
+	residuals = make([]uint32, len(argb))
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			x0, y0 := tx*size, ty*size
+			x1, y1 := min(x0+size, width), min(y0+size, height)
+			best := 1
+			if search {
+				bestCost := -1
+				for mode := 0; mode < vp8lNumPredictors; mode++ {
+					cost := 0
+					for y := y0; y < y1; y++ {
+						for x := x0; x < x1; x++ {
+							cost += vp8lResidualCost(vp8lSubPixels(argb[y*width+x], vp8lPrediction(argb, x, y, width, mode)))
+						}
+					}
+					if bestCost < 0 || cost < bestCost {
+						best, bestCost = mode, cost
+					}
+				}
+			}
+			modes[ty*tilesX+tx] = 0xff000000 | uint32(best)<<8
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					residuals[y*width+x] = vp8lSubPixels(argb[y*width+x], vp8lPrediction(argb, x, y, width, best))
+				}
+			}
+		}
+	}
+	return modes, residuals
+}
+
+// vp8lPrediction predicts the pixel at x, y from its already decoded
+// neighbours. The top row and left column have fixed predictors.
+func vp8lPrediction(argb []uint32, x, y, width, mode int) uint32 {
+	i := y*width + x
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return argb[i-1]
+	case x == 0:
+		return argb[i-width]
+	}
+	// for the rightmost column TR wraps to the leftmost pixel of this row
+	l, t, tl, tr := argb[i-1], argb[i-width], argb[i-width-1], argb[i-width+1]
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return vp8lAverage2(vp8lAverage2(l, tr), t)
+	case 6:
+		return vp8lAverage2(l, tl)
+	case 7:
+		return vp8lAverage2(l, t)
+	case 8:
+		return vp8lAverage2(tl, t)
+	case 9:
+		return vp8lAverage2(t, tr)
+	case 10:
+		return vp8lAverage2(vp8lAverage2(l, tl), vp8lAverage2(t, tr))
+	case 11:
+		return vp8lSelect(l, t, tl)
+	case 12:
+		return vp8lPerChannel(l, t, tl, func(a, b, c int) int { return a + b - c })
+	default:
+		return vp8lPerChannel(vp8lAverage2(l, t), tl, 0, func(a, b, _ int) int { return a + (a-b)/2 })
+	}
+}
+
+// vp8lAverage2 averages each channel, rounding down
+func vp8lAverage2(a, b uint32) uint32 {
+	return ((a^b)&0xfefefefe)>>1 + a&b
+}
+
+// vp8lSelect picks whichever of L and T is closer to the gradient estimate
+// L + T - TL
+func vp8lSelect(l, t, tl uint32) uint32 {
+	distL, distT := 0, 0
+	for shift := 0; shift < 32; shift += 8 {
+		distL += vp8lAbs(int(t>>shift&0xff) - int(tl>>shift&0xff))
+		distT += vp8lAbs(int(l>>shift&0xff) - int(tl>>shift&0xff))
+	}
+	if distL < distT {
+		return l
+	}
+	return t
+}
+
+// vp8lPerChannel applies f to every channel, clamping the result
+func vp8lPerChannel(a, b, c uint32, f func(a, b, c int) int) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		v := f(int(a>>shift&0xff), int(b>>shift&0xff), int(c>>shift&0xff))
+		out |= uint32(min(max(v, 0), 255)) << shift
+	}
+	return out
+}
+
+// vp8lSubPixels subtracts each channel of b from a, modulo 256
+func vp8lSubPixels(a, b uint32) uint32 {
+	alphaGreen := 0x00ff00ff + a&0xff00ff00 - b&0xff00ff00
+	redBlue := 0xff00ff00 + a&0x00ff00ff - b&0x00ff00ff
+	return alphaGreen&0xff00ff00 | redBlue&0x00ff00ff
+}
+
+// vp8lResidualCost estimates how expensive a residual is to code
+func vp8lResidualCost(residual uint32) int {
+	cost := 0
+	for shift := 0; shift < 32; shift += 8 {
+		cost += vp8lAbs(int(int8(residual >> shift)))
+	}
+	return cost
+}
+
+func vp8lAbs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// vp8lToken is either a literal pixel or, when length is set, a backward
+// reference copying length pixels from distCode
+type vp8lToken struct {
+	argb     uint32
+	length   int
+	distCode int
+}
+
+func vp8lTokenize(argb []uint32, width int, matches bool) []vp8lToken {
+	tokens := make([]vp8lToken, 0, len(argb))
+	for i := 0; i < len(argb); {
+		if matches {
+			length, distCode := 0, 0
+			if i >= width {
+				length, distCode = vp8lMatchLength(argb, i, width), vp8lDistUp
+			}
+			if i >= 1 {
+				if n := vp8lMatchLength(argb, i, 1); n > length {
+					length, distCode = n, vp8lDistLeft
+				}
+			}
+			if length >= vp8lMinMatch {
+				tokens = append(tokens, vp8lToken{length: length, distCode: distCode})
+				i += length
+				continue
+			}
+		}
+		tokens = append(tokens, vp8lToken{argb: argb[i]})
+		i++
+	}
+	return tokens
+}
+
+// vp8lMatchLength counts the pixels from i on that repeat those dist back
+func vp8lMatchLength(argb []uint32, i, dist int) int {
+	n := 0
+	for i+n < len(argb) && n < vp8lMaxMatch && argb[i+n] == argb[i+n-dist] {
+		n++
+	}
+	return n
+}
+
+// vp8lPrefix splits a length or distance code into its prefix symbol and
+// the extra bits following it
+func vp8lPrefix(v int) (code int, extraBits uint, extra uint32) {
+	v--
+	if v < 4 {
+		return v, 0, 0
+	}
+	highest := bits.Len(uint(v)) - 1
+	second := v >> (highest - 1) & 1
+	extraBits = uint(highest - 1)
+	return 2*highest + second, extraBits, uint32(v) & (1<<extraBits - 1)
+}
+
+// vp8lCode is a canonical prefix code
+type vp8lCode struct {
+	lengths []uint8
+	codes   []uint16 // bit reversed, the bitstream is read LSB first
+	single  bool     // a lone symbol is coded with zero bits
+}
+
+func newVP8LCode(hist []uint32, maxLength int) *vp8lCode {
+	c := &vp8lCode{lengths: make([]uint8, len(hist)), codes: make([]uint16, len(hist))}
+	var used []int
+	for s, n := range hist {
+		if n > 0 {
+			used = append(used, s)
+		}
+	}
+	if len(used) <= 1 {
+		c.single = true
+		if len(used) == 1 {
+			c.lengths[used[0]] = 1
+		} else {
+			c.lengths[0] = 1
+		}
+		return c
+	}
+	// flatten rare symbols until the tree fits in maxLength
+	for floor := uint32(1); !vp8lHuffmanLengths(hist, used, floor, maxLength, c.lengths); floor *= 2 {
+	}
+	var count [vp8lMaxCodeLength + 1]int
+	for _, l := range c.lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [vp8lMaxCodeLength + 1]int
+	code := 0
+	for l := 1; l <= vp8lMaxCodeLength; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	for s, l := range c.lengths {
+		if l > 0 {
+			c.codes[s] = bits.Reverse16(uint16(next[l])) >> (16 - l)
+			next[l]++
+		}
+	}
+	return c
+}
+
+// vp8lHuffmanLengths builds a Huffman tree over the used symbols, counting
+// each at least floor times. It fails if the tree is deeper than maxLength.
+func vp8lHuffmanLengths(hist []uint32, used []int, floor uint32, maxLength int, lengths []uint8) bool {
+	type node struct {
+		weight      uint64
+		left, right int // leaves have left < 0 and the symbol in right
+	}
+	nodes := make([]node, 0, 2*len(used)-1)
+	for _, s := range used {
+		nodes = append(nodes, node{uint64(max(hist[s], floor)), -1, s})
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].weight < nodes[j].weight })
+
+	// leaves and merged nodes are both consumed in increasing weight order
+	leaf, inner := 0, len(used)
+	lightest := func() int {
+		if leaf < len(used) && (inner == len(nodes) || nodes[leaf].weight <= nodes[inner].weight) {
+			leaf++
+			return leaf - 1
+		}
+		inner++
+		return inner - 1
+	}
+	for len(nodes) < cap(nodes) {
+		a, b := lightest(), lightest()
+		nodes = append(nodes, node{nodes[a].weight + nodes[b].weight, a, b})
+	}
+	depth := make([]int, len(nodes))
+	for i := len(nodes) - 1; i >= len(used); i-- {
+		depth[nodes[i].left] = depth[i] + 1
+		depth[nodes[i].right] = depth[i] + 1
+	}
+	for i := range used {
+		if depth[i] > maxLength {
+			return false
+		}
+	}
+	for i := range used {
+		lengths[nodes[i].right] = uint8(depth[i])
+	}
+	return true
+}
+
+// vp8lWriter packs bits LSB first
+type vp8lWriter struct {
+	buf  []byte
+	acc  uint64
+	nacc uint
+}
+
+func (w *vp8lWriter) write(v uint32, n uint) {
+	w.acc |= uint64(v) << w.nacc
+	w.nacc += n
+	for w.nacc >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nacc -= 8
+	}
+}
+
+func (w *vp8lWriter) bytes() []byte {
+	if w.nacc > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.nacc = 0, 0
+	}
+	return w.buf
+}
+
+// writeImage stores an entropy coded image; only the main image may carry
+// a meta prefix image
+func (w *vp8lWriter) writeImage(argb []uint32, width int, main bool, matches bool) {
+	tokens := vp8lTokenize(argb, width, matches)
+
+	// green (with length prefixes), red, blue, alpha, distance
+	hist := [5][]uint32{
+		make([]uint32, vp8lNumLiterals+vp8lNumLengthCodes),
+		make([]uint32, vp8lNumLiterals),
+		make([]uint32, vp8lNumLiterals),
+		make([]uint32, vp8lNumLiterals),
+		make([]uint32, vp8lNumDistCodes),
+	}
+	for _, t := range tokens {
+		if t.length == 0 {
+			hist[0][t.argb>>8&0xff]++
+			hist[1][t.argb>>16&0xff]++
+			hist[2][t.argb&0xff]++
+			hist[3][t.argb>>24]++
+			continue
+		}
+		lengthCode, _, _ := vp8lPrefix(t.length)
+		distCode, _, _ := vp8lPrefix(t.distCode)
+		hist[0][vp8lNumLiterals+lengthCode]++
+		hist[4][distCode]++
+	}
+	var codes [5]*vp8lCode
+	for i := range codes {
+		codes[i] = newVP8LCode(hist[i], vp8lMaxCodeLength)
+	}
+
+	w.write(0, 1) // no color cache
+	if main {
+		w.write(0, 1) // one prefix code group for the whole image
+	}
+	for _, c := range codes {
+		w.writeCode(c)
+	}
+	for _, t := range tokens {
+		if t.length == 0 {
+			w.writeSymbol(codes[0], int(t.argb>>8&0xff))
+			w.writeSymbol(codes[1], int(t.argb>>16&0xff))
+			w.writeSymbol(codes[2], int(t.argb&0xff))
+			w.writeSymbol(codes[3], int(t.argb>>24))
+			continue
+		}
+		code, extraBits, extra := vp8lPrefix(t.length)
+		w.writeSymbol(codes[0], vp8lNumLiterals+code)
+		w.write(extra, extraBits)
+		code, extraBits, extra = vp8lPrefix(t.distCode)
+		w.writeSymbol(codes[4], code)
+		w.write(extra, extraBits)
+	}
+}
+
+func (w *vp8lWriter) writeSymbol(c *vp8lCode, s int) {
+	if !c.single {
+		w.write(uint32(c.codes[s]), uint(c.lengths[s]))
+	}
+}
+
+// writeCode stores a prefix code, using the simple form for one or two
+// symbols below 256
+func (w *vp8lWriter) writeCode(c *vp8lCode) {
+	var used []int
+	for s, l := range c.lengths {
+		if l > 0 {
+			used = append(used, s)
+		}
+	}
+	if len(used) <= 2 && used[len(used)-1] < 256 {
+		w.write(1, 1)
+		w.write(uint32(len(used)-1), 1)
+		if used[0] <= 1 {
+			w.write(0, 1)
+			w.write(uint32(used[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			w.write(uint32(used[1]), 8)
+		}
+		return
+	}
+
+	w.write(0, 1)
+	hist := make([]uint32, len(vp8lCodeLengthOrder))
+	for _, l := range c.lengths {
+		hist[l]++
+	}
+	lengthCode := newVP8LCode(hist, vp8lMaxLengthCode)
+	n := len(vp8lCodeLengthOrder)
+	for n > 4 && lengthCode.lengths[vp8lCodeLengthOrder[n-1]] == 0 {
+		n--
+	}
+	w.write(uint32(n-4), 4)
+	for _, s := range vp8lCodeLengthOrder[:n] {
+		w.write(uint32(lengthCode.lengths[s]), 3)
+	}
+	w.write(0, 1) // every symbol has its length written
+	for _, l := range c.lengths {
+		w.writeSymbol(lengthCode, int(l))
+	}
+}
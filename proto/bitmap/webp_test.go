@@ -0,0 +1,90 @@
+package bitmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestBitMap_ToWebP(t *testing.T) {
+	bitmap := desktopBitmap(320, 240)
+	pngSize := len(bitmap.ToPng())
+
+	literal := bitmap.ToWebP(0)
+	data := bitmap.ToWebP(80)
+	t.Logf("png %d bytes, webp q0 %d bytes, webp q80 %d bytes", pngSize, len(literal), len(data))
+	if len(data) >= len(literal) {
+		t.Errorf("Expected quality 80 (%d bytes) to be smaller than quality 0 (%d bytes)", len(data), len(literal))
+	}
+	if len(data) >= pngSize {
+		t.Errorf("Expected WebP (%d bytes) to be smaller than PNG (%d bytes)", len(data), pngSize)
+	}
+
+	if string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" || string(data[12:16]) != "VP8L" {
+		t.Fatalf("Unexpected container header % x", data[:16])
+	}
+	if size := binary.LittleEndian.Uint32(data[4:8]); int(size) != len(data)-8 {
+		t.Errorf("Expected RIFF size %d, got %d", len(data)-8, size)
+	}
+	if data[20] != vp8lSignature {
+		t.Fatalf("Expected VP8L signature, got %#x", data[20])
+	}
+	header := binary.LittleEndian.Uint32(data[21:25])
+	if w, h := header&0x3fff+1, header>>14&0x3fff+1; w != 320 || h != 240 {
+		t.Errorf("Expected 320x240, got %dx%d", w, h)
+	}
+	if header>>28 != 0 {
+		t.Errorf("Expected opaque image with version 0, got %#x", header>>28)
+	}
+
+	for _, quality := range []int{0, 80} {
+		assertLossless(t, bitmap.Image, bitmap.ToWebP(quality))
+	}
+}
+
+// assertLossless decodes a WebP image and checks it has the pixels of want
+func assertLossless(t *testing.T, want image.Image, data []byte) {
+	t.Helper()
+	got, err := webp.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to decode WebP: %v", err)
+	}
+	if got.Bounds() != want.Bounds() {
+		t.Fatalf("Expected bounds %v, got %v", want.Bounds(), got.Bounds())
+	}
+	b := want.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			w := color.RGBAModel.Convert(want.At(x, y))
+			g := color.RGBAModel.Convert(got.At(x, y))
+			if w != g {
+				t.Fatalf("Pixel %d,%d: expected %v, got %v", x, y, w, g)
+			}
+		}
+	}
+}
+
+func TestVP8LPrefix(t *testing.T) {
+	// decode the way the VP8L spec does and check we get the value back
+	for v := 1; v <= vp8lMaxMatch; v++ {
+		code, extraBits, extra := vp8lPrefix(v)
+		got := code + 1
+		if code >= 4 {
+			n := uint(code-2) >> 1
+			if n != extraBits {
+				t.Fatalf("value %d: expected %d extra bits, got %d", v, n, extraBits)
+			}
+			got = (2+code&1)<<n + int(extra) + 1
+		}
+		if got != v {
+			t.Fatalf("value %d: prefix %d extra %d decodes to %d", v, code, extra, got)
+		}
+		if code >= vp8lNumLengthCodes {
+			t.Fatalf("value %d: prefix %d out of range", v, code)
+		}
+	}
+}
@@ -5,6 +5,16 @@ import (
 	"io"
 )
 
+// Rev2 bitmap cache flags
+const (
+	PERSISTENT_KEYS_EXPECTED_FLAG = 0x0001
+	ALLOW_CACHE_WAITING_LIST_FLAG = 0x0002
+)
+
+// BITMAP_CACHE_PERSISTENT marks a cell cache whose entries are kept across
+// sessions, in the cell info next to its number of entries
+const BITMAP_CACHE_PERSISTENT = 0x80000000
+
 // TsBitmapCacheCapabilitySetRev2
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/a5b9b9a6-5f67-4089-a95d-009bc8e25bfc
 type TsBitmapCacheCapabilitySetRev2 struct {
@@ -30,3 +40,22 @@ func (c *TsBitmapCacheCapabilitySetRev2) Read(r io.Reader) TsCapsSet {
 func (c *TsBitmapCacheCapabilitySetRev2) Write(w io.Writer) {
 	core.WriteLE(w, c)
 }
+
+// NewTsBitmapCacheCapabilitySetRev2 advertises up to five cell caches with
+// the given numbers of entries. With persistent set they are all kept across
+// sessions and the server expects a Persistent Key List PDU.
+func NewTsBitmapCacheCapabilitySetRev2(persistent bool, entries ...uint32) *TsBitmapCacheCapabilitySetRev2 {
+	c := &TsBitmapCacheCapabilitySetRev2{NumCellCaches: uint8(min(len(entries), 5))}
+	if persistent {
+		c.CacheFlags = PERSISTENT_KEYS_EXPECTED_FLAG
+	}
+	cells := []*uint32{&c.BitmapCache0CellInfo, &c.BitmapCache1CellInfo, &c.BitmapCache2CellInfo,
+		&c.BitmapCache3CellInfo, &c.BitmapCache4CellInfo}
+	for i := 0; i < int(c.NumCellCaches); i++ {
+		*cells[i] = entries[i] &^ BITMAP_CACHE_PERSISTENT
+		if persistent {
+			*cells[i] |= BITMAP_CACHE_PERSISTENT
+		}
+	}
+	return c
+}
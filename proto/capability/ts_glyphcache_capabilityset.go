@@ -5,11 +5,27 @@ import (
 	"io"
 )
 
+// Glyph support levels
+const (
+	GLYPH_SUPPORT_NONE    = 0x0000
+	GLYPH_SUPPORT_PARTIAL = 0x0001
+	GLYPH_SUPPORT_FULL    = 0x0002
+	GLYPH_SUPPORT_ENCODE  = 0x0003
+)
+
+// TsCacheDefinition is the size of a glyph cache: its number of entries and
+// the largest glyph bitmap, in bytes, an entry holds
+// See [MS-RDPBCGR] 2.2.7.1.8.1
+type TsCacheDefinition struct {
+	CacheEntries         uint16
+	CacheMaximumCellSize uint16
+}
+
 // TsGlyphCacheCapabilitySet
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/8e292483-9b0f-43b9-be14-dc6cd07e1615
 type TsGlyphCacheCapabilitySet struct {
-	GlyphCache        [40]byte
-	FragCache         uint32
+	GlyphCache        [10]TsCacheDefinition
+	FragCache         TsCacheDefinition
 	GlyphSupportLevel uint16
 	Pad2octets        uint16
 }
@@ -25,3 +41,16 @@ func (c *TsGlyphCacheCapabilitySet) Read(r io.Reader) TsCapsSet {
 func (c *TsGlyphCacheCapabilitySet) Write(w io.Writer) {
 	core.WriteLE(w, c)
 }
+
+// NewTsGlyphCacheCapabilitySet announces glyph caches for Cache Glyph
+// orders, growing from small glyphs to large ones
+func NewTsGlyphCacheCapabilitySet() *TsGlyphCacheCapabilitySet {
+	return &TsGlyphCacheCapabilitySet{
+		GlyphCache: [10]TsCacheDefinition{
+			{254, 4}, {254, 4}, {254, 8}, {254, 8}, {254, 16},
+			{254, 32}, {254, 64}, {254, 128}, {254, 256}, {64, 2048},
+		},
+		FragCache:         TsCacheDefinition{256, 256},
+		GlyphSupportLevel: GLYPH_SUPPORT_FULL,
+	}
+}
@@ -15,6 +15,7 @@ const (
 	INPUT_FLAG_FASTPATH_INPUT2        = 0x0020
 	INPUT_FLAG_UNUSED1                = 0x0040
 	INPUT_FLAG_UNUSED2                = 0x0080
+	INPUT_FLAG_MOUSE_RELATIVE         = 0x0080 // was unused before RDP 10.5
 	INPUT_FLAG_MOUSE_HWHEEL           = 0x0100
 )
 
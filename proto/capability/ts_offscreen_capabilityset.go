@@ -5,6 +5,13 @@ import (
 	"io"
 )
 
+// the largest offscreen bitmap cache the protocol allows, CacheSize being
+// in kilobytes
+const (
+	MaxOffscreenCacheSize    = 7680
+	MaxOffscreenCacheEntries = 500
+)
+
 // TsOffscreenCapabilitySet
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/412fa921-2faa-4f1b-ab5f-242cdabc04f9
 type TsOffscreenCapabilitySet struct {
@@ -13,6 +13,33 @@ const (
 	ORDERFLAGS_EXTRA_FLAGS  = 0x0080
 )
 
+// Indexes of OrderSupport, set to 1 for the drawing orders the client
+// supports. TS_NEG_PATBLT_INDEX covers OpaqueRect too.
+// See [MS-RDPBCGR] 2.2.7.1.3
+const (
+	TS_NEG_DSTBLT_INDEX             = 0x00
+	TS_NEG_PATBLT_INDEX             = 0x01
+	TS_NEG_SCRBLT_INDEX             = 0x02
+	TS_NEG_MEMBLT_INDEX             = 0x03
+	TS_NEG_MEM3BLT_INDEX            = 0x04
+	TS_NEG_DRAWNINEGRID_INDEX       = 0x07
+	TS_NEG_LINETO_INDEX             = 0x08
+	TS_NEG_MULTI_DRAWNINEGRID_INDEX = 0x09
+	TS_NEG_SAVEBITMAP_INDEX         = 0x0B
+	TS_NEG_MULTIDSTBLT_INDEX        = 0x0F
+	TS_NEG_MULTIPATBLT_INDEX        = 0x10
+	TS_NEG_MULTISCRBLT_INDEX        = 0x11
+	TS_NEG_MULTIOPAQUERECT_INDEX    = 0x12
+	TS_NEG_FAST_INDEX_INDEX         = 0x13
+	TS_NEG_POLYGON_SC_INDEX         = 0x14
+	TS_NEG_POLYGON_CB_INDEX         = 0x15
+	TS_NEG_POLYLINE_INDEX           = 0x16
+	TS_NEG_FAST_GLYPH_INDEX         = 0x18
+	TS_NEG_ELLIPSE_SC_INDEX         = 0x19
+	TS_NEG_ELLIPSE_CB_INDEX         = 0x1A
+	TS_NEG_GLYPH_INDEX_INDEX        = 0x1B
+)
+
 // TsOrderCapabilitySet
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/9f409c29-480c-4751-9665-510b8ffff294
 type TsOrderCapabilitySet struct {
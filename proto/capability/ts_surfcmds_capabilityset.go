@@ -5,6 +5,13 @@ import (
 	"io"
 )
 
+// CmdFlags
+const (
+	SURFCMDS_SETSURFACEBITS    = 0x00000002
+	SURFCMDS_FRAMEMARKER       = 0x00000010
+	SURFCMDS_STREAMSURFACEBITS = 0x00000040
+)
+
 // TsSurfCmdsCapabilitySet
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/aa953018-c0a8-4761-bb12-86586c2cd56a
 type TsSurfCmdsCapabilitySet struct {
@@ -5,6 +5,12 @@ import (
 	"io"
 )
 
+const (
+	WINDOW_LEVEL_NOT_SUPPORTED = 0x00000000
+	WINDOW_LEVEL_SUPPORTED     = 0x00000001
+	WINDOW_LEVEL_SUPPORTED_EX  = 0x00000002
+)
+
 // WindowListCapabilitySet
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdperp/82ec7a69-f7e3-4294-830d-666178b35d15
 type WindowListCapabilitySet struct {
@@ -24,3 +30,13 @@ func (c *WindowListCapabilitySet) Read(r io.Reader) TsCapsSet {
 func (c *WindowListCapabilitySet) Write(w io.Writer) {
 	core.WriteLE(w, c)
 }
+
+// NewWindowListCapabilitySet announces that the client takes the window
+// orders of RemoteApp sessions, with icon caches of the size mstsc uses
+func NewWindowListCapabilitySet() *WindowListCapabilitySet {
+	return &WindowListCapabilitySet{
+		WndSupportLevel:     WINDOW_LEVEL_SUPPORTED_EX,
+		NumIconCaches:       3,
+		NumIconCacheEntries: 12,
+	}
+}
@@ -2,13 +2,21 @@ package clipboard
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/glog"
 )
 
+// ErrFormatUnavailable is returned when asking for a format the server
+// does not offer
+var ErrFormatUnavailable = errors.New("clipboard format not available")
+
 // ClipboardFormat represents a clipboard format
 type ClipboardFormat uint32
 
@@ -50,6 +58,11 @@ const (
 	CLIPRDR_MSG_TYPE_UNLOCK_CLIPDATA       ClipboardMessageType = 0x000C
 )
 
+// CB_RESPONSE_FAIL in ClipboardMessage.MessageFlags marks a failed
+// response, e.g. a format data response without data
+// See [MS-RDPECLIP] 2.2.1
+const CB_RESPONSE_FAIL = 0x0002
+
 // ClipboardMessage represents a clipboard message header
 type ClipboardMessage struct {
 	MessageType  ClipboardMessageType
@@ -80,11 +93,35 @@ type ClipboardFormatData struct {
 	Data     []byte
 }
 
+// DefaultFormatListDebounce is the window within which repeated identical
+// format lists from the server are reported only once
+const DefaultFormatListDebounce = 250 * time.Millisecond
+
 // ClipboardManager manages clipboard operations
 type ClipboardManager struct {
 	capabilities *ClipboardCapabilities
 	formats      []ClipboardFormat
 	handler      ClipboardHandler
+
+	// format list debouncing
+	formatListDebounce time.Duration
+	lastFormatListAt   time.Time
+
+	// guards the fields below, used by the app as well as by ProcessMessage
+	mu sync.Mutex
+
+	// formats the server offers, fetched only when asked for
+	available []ClipboardFormat
+
+	// image conversion between CF_DIB and CF_PNG, for a side offering only
+	// CF_DIB as Windows applications do, or only CF_PNG
+	remoteDIBOnly   bool            // the server offers CF_DIB, CF_PNG is converted
+	localPNGOnly    bool            // the app offers CF_PNG, CF_DIB is converted
+	requested       ClipboardFormat // last format asked of the server
+	serverRequested ClipboardFormat // last format the server asked for
+
+	// data the app put on the clipboard with SetLocalData, by format
+	local map[ClipboardFormat][]byte
 }
 
 // ClipboardHandler handles clipboard events
@@ -92,6 +129,9 @@ type ClipboardHandler interface {
 	OnFormatList(formats []ClipboardFormat) error
 	OnFormatDataRequest(formatID ClipboardFormat) error
 	OnFormatDataResponse(formatID ClipboardFormat, data []byte) error
+	// OnHTMLData receives CF_HTML data in place of OnFormatDataResponse,
+	// as the HTML fragment without the CF_HTML header, see DecodeHTML
+	OnHTMLData(html string, sourceURL string) error
 	OnFileContentsRequest(streamID uint32, listIndex uint32, dwFlags uint32, nPositionLow uint32, nPositionHigh uint32, cbRequested uint32, clipDataID uint32) error
 }
 
@@ -121,6 +161,12 @@ func (h *DefaultClipboardHandler) OnFormatDataResponse(formatID ClipboardFormat,
 	return nil
 }
 
+// OnHTMLData handles HTML data events
+func (h *DefaultClipboardHandler) OnHTMLData(html string, sourceURL string) error {
+	glog.Debugf("Received clipboard HTML: %d bytes from %q", len(html), sourceURL)
+	return nil
+}
+
 // OnFileContentsRequest handles file contents request events
 func (h *DefaultClipboardHandler) OnFileContentsRequest(streamID uint32, listIndex uint32, dwFlags uint32, nPositionLow uint32, nPositionHigh uint32, cbRequested uint32, clipDataID uint32) error {
 	glog.Debugf("Received file contents request: streamID=%d, listIndex=%d, flags=%d, position=%d, requested=%d, clipDataID=%d",
@@ -138,31 +184,35 @@ func NewClipboardManager(handler ClipboardHandler) *ClipboardManager {
 		capabilities: &ClipboardCapabilities{
 			GeneralFlags: 0x00000001, // CB_USE_LONG_FORMAT_NAMES
 		},
-		handler: handler,
+		handler:            handler,
+		formatListDebounce: DefaultFormatListDebounce,
 	}
 }
 
+// SetFormatListDebounce sets the window within which identical format lists
+// are collapsed into a single OnFormatList call. Zero disables debouncing.
+func (cm *ClipboardManager) SetFormatListDebounce(d time.Duration) {
+	cm.formatListDebounce = d
+}
+
 // ReadClipboardMessage reads a clipboard message from the stream
 func ReadClipboardMessage(r io.Reader) (*ClipboardMessage, error) {
 	msg := &ClipboardMessage{}
 
 	// Read message header
-	if err := core.ReadLE(r, &msg.MessageType); err != nil {
-		return nil, fmt.Errorf("failed to read message type: %v", err)
-	}
-
-	if err := core.ReadLE(r, &msg.MessageFlags); err != nil {
-		return nil, fmt.Errorf("failed to read message flags: %v", err)
-	}
-
-	if err := core.ReadLE(r, &msg.DataLength); err != nil {
-		return nil, fmt.Errorf("failed to read data length: %v", err)
+	if err := core.Try(func() {
+		core.ReadLE(r, &msg.MessageType)
+		core.ReadLE(r, &msg.MessageFlags)
+		core.ReadLE(r, &msg.DataLength)
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read message header: %w", err)
 	}
 
-	// Read message data
+	// Read message data, not allocating more than a bytes.Reader holds
 	if msg.DataLength > 0 {
-		msg.Data = make([]byte, msg.DataLength)
-		if _, err := io.ReadFull(r, msg.Data); err != nil {
+		if err := core.Try(func() {
+			msg.Data = core.ReadBytes(r, int(msg.DataLength))
+		}); err != nil {
 			return nil, fmt.Errorf("failed to read message data: %w", err)
 		}
 	}
@@ -236,16 +286,33 @@ func (cm *ClipboardManager) handleFormatList(msg *ClipboardMessage) error {
 	formats := make([]ClipboardFormat, 0)
 	reader := bytes.NewReader(msg.Data)
 
-	for reader.Len() > 0 {
+	for reader.Len() >= 4 {
 		var formatID ClipboardFormat
-		if err := core.ReadLE(reader, &formatID); err != nil {
-			break
-		}
+		core.ReadLE(reader, &formatID)
 		formats = append(formats, formatID)
 	}
 
+	// servers may repeat the same list in bursts (e.g. on focus changes);
+	// reporting each one lets a handler that re-advertises feed a loop
+	now := time.Now()
+	duplicate := slices.Equal(formats, cm.formats) && now.Sub(cm.lastFormatListAt) < cm.formatListDebounce
 	cm.formats = formats
-	return cm.handler.OnFormatList(formats)
+	cm.lastFormatListAt = now
+	if duplicate {
+		glog.Debugf("Dropped duplicate clipboard format list: %v", formats)
+		return nil
+	}
+
+	// an image only offered as CF_DIB can be had as CF_PNG too
+	cm.mu.Lock()
+	cm.remoteDIBOnly = slices.Contains(formats, CLIPRDR_FORMAT_DIB) && !slices.Contains(formats, CLIPRDR_FORMAT_PNG)
+	if cm.remoteDIBOnly {
+		formats = append(slices.Clip(formats), CLIPRDR_FORMAT_PNG)
+	}
+	// delayed rendering: nothing is fetched until RequestFormatData
+	cm.available = formats
+	cm.mu.Unlock()
+	return cm.handler.OnFormatList(slices.Clone(formats))
 }
 
 // handleFormatDataRequest handles format data request message
@@ -258,6 +325,13 @@ func (cm *ClipboardManager) handleFormatDataRequest(msg *ClipboardMessage) error
 	reader := bytes.NewReader(msg.Data)
 	core.ReadLE(reader, &formatID)
 
+	cm.mu.Lock()
+	cm.serverRequested = formatID
+	if formatID == CLIPRDR_FORMAT_DIB && cm.localPNGOnly {
+		// answered with the PNG the app has, see CreateFormatDataResponseMessage
+		formatID = CLIPRDR_FORMAT_PNG
+	}
+	cm.mu.Unlock()
 	return cm.handler.OnFormatDataRequest(formatID)
 }
 
@@ -272,6 +346,24 @@ func (cm *ClipboardManager) handleFormatDataResponse(msg *ClipboardMessage) erro
 	core.ReadLE(reader, &formatID)
 
 	data := msg.Data[4:]
+	cm.mu.Lock()
+	requested := cm.requested
+	cm.requested = 0
+	cm.mu.Unlock()
+	if formatID == CLIPRDR_FORMAT_DIB && requested == CLIPRDR_FORMAT_PNG {
+		png, err := DIBToPNG(data)
+		if err != nil {
+			return fmt.Errorf("failed to convert clipboard image: %w", err)
+		}
+		formatID, data = CLIPRDR_FORMAT_PNG, png
+	}
+	if formatID == CLIPRDR_FORMAT_HTML {
+		html, sourceURL, err := DecodeHTML(data)
+		if err != nil {
+			return err
+		}
+		return cm.handler.OnHTMLData(html, sourceURL)
+	}
 	return cm.handler.OnFormatDataResponse(formatID, data)
 }
 
@@ -331,8 +423,17 @@ func (cm *ClipboardManager) CreateMonitorReadyMessage() *ClipboardMessage {
 	}
 }
 
-// CreateFormatListMessage creates a format list message
+// CreateFormatListMessage creates a format list message. A list with
+// CF_PNG but not CF_DIB offers CF_DIB too, converted from the PNG, as
+// Windows applications only paste that.
 func (cm *ClipboardManager) CreateFormatListMessage(formats []ClipboardFormat) *ClipboardMessage {
+	cm.mu.Lock()
+	cm.localPNGOnly = slices.Contains(formats, CLIPRDR_FORMAT_PNG) && !slices.Contains(formats, CLIPRDR_FORMAT_DIB)
+	if cm.localPNGOnly {
+		formats = append(slices.Clip(formats), CLIPRDR_FORMAT_DIB)
+	}
+	cm.mu.Unlock()
+
 	buf := new(bytes.Buffer)
 	for _, format := range formats {
 		core.WriteLE(buf, format)
@@ -346,8 +447,76 @@ func (cm *ClipboardManager) CreateFormatListMessage(formats []ClipboardFormat) *
 	}
 }
 
-// CreateFormatDataResponseMessage creates a format data response message
+// AvailableFormats returns the formats of the last format list from the
+// server, whose data is only transferred once asked for with
+// RequestFormatData
+func (cm *ClipboardManager) AvailableFormats() []ClipboardFormat {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return slices.Clone(cm.available)
+}
+
+// RequestFormatData creates the format data request for formatID, failing
+// with ErrFormatUnavailable unless the server offers it. The data comes in
+// through the handler, see ClipboardHandler.OnFormatDataResponse.
+func (cm *ClipboardManager) RequestFormatData(formatID ClipboardFormat) (*ClipboardMessage, error) {
+	cm.mu.Lock()
+	available := slices.Contains(cm.available, formatID)
+	cm.mu.Unlock()
+	if !available {
+		return nil, fmt.Errorf("%w: %s", ErrFormatUnavailable, GetFormatName(formatID))
+	}
+	return cm.CreateFormatDataRequestMessage(formatID), nil
+}
+
+// CreateFormatDataRequestMessage creates a format data request message.
+// Asking for CF_PNG when the server only offers CF_DIB asks for that, and
+// the response is converted to PNG before it reaches the handler.
+func (cm *ClipboardManager) CreateFormatDataRequestMessage(formatID ClipboardFormat) *ClipboardMessage {
+	cm.mu.Lock()
+	cm.requested = formatID
+	if formatID == CLIPRDR_FORMAT_PNG && cm.remoteDIBOnly {
+		formatID = CLIPRDR_FORMAT_DIB
+	}
+	cm.mu.Unlock()
+
+	buf := new(bytes.Buffer)
+	core.WriteLE(buf, formatID)
+
+	return &ClipboardMessage{
+		MessageType:  CLIPRDR_MSG_TYPE_FORMAT_DATA_REQUEST,
+		MessageFlags: 0,
+		DataLength:   uint32(buf.Len()),
+		Data:         buf.Bytes(),
+	}
+}
+
+// CreateFormatDataResponseMessage creates a format data response message.
+// CF_PNG data answering a request for the CF_DIB offered in its place is
+// converted to CF_DIB; if that fails the response is CB_RESPONSE_FAIL.
+// CF_HTML data without its header is wrapped with EncodeHTML.
 func (cm *ClipboardManager) CreateFormatDataResponseMessage(formatID ClipboardFormat, data []byte) *ClipboardMessage {
+	if formatID == CLIPRDR_FORMAT_HTML && !IsHTMLFormat(data) {
+		data = EncodeHTML(string(data), "")
+	}
+	cm.mu.Lock()
+	convert := formatID == CLIPRDR_FORMAT_PNG && cm.serverRequested == CLIPRDR_FORMAT_DIB && cm.localPNGOnly
+	if convert {
+		cm.serverRequested = 0
+	}
+	cm.mu.Unlock()
+	if convert {
+		dib, err := PNGToDIB(data)
+		if err != nil {
+			glog.Warnf("failed to convert clipboard image: %v", err)
+			return &ClipboardMessage{
+				MessageType:  CLIPRDR_MSG_TYPE_FORMAT_DATA_RESPONSE,
+				MessageFlags: CB_RESPONSE_FAIL,
+			}
+		}
+		formatID, data = CLIPRDR_FORMAT_DIB, dib
+	}
+
 	buf := new(bytes.Buffer)
 	core.WriteLE(buf, formatID)
 	buf.Write(data)
@@ -360,6 +529,50 @@ func (cm *ClipboardManager) CreateFormatDataResponseMessage(formatID ClipboardFo
 	}
 }
 
+// SetLocalData replaces the client's clipboard with data, by format, and
+// returns the format list announcing it to the server. Requests of the
+// server for these formats are then answered from data, see
+// LocalDataResponse, rather than passed to the handler.
+func (cm *ClipboardManager) SetLocalData(data map[ClipboardFormat][]byte) *ClipboardMessage {
+	formats := make([]ClipboardFormat, 0, len(data))
+	for format := range data {
+		formats = append(formats, format)
+	}
+	slices.Sort(formats)
+
+	cm.mu.Lock()
+	cm.local = data
+	cm.mu.Unlock()
+	return cm.CreateFormatListMessage(formats)
+}
+
+// LocalDataResponse returns the response to msg if it is a format data
+// request for data set with SetLocalData, and nil for any other message,
+// which is for ProcessMessage
+func (cm *ClipboardManager) LocalDataResponse(msg *ClipboardMessage) *ClipboardMessage {
+	if msg.MessageType != CLIPRDR_MSG_TYPE_FORMAT_DATA_REQUEST || len(msg.Data) < 4 {
+		return nil
+	}
+	var requested ClipboardFormat
+	core.ReadLE(bytes.NewReader(msg.Data), &requested)
+
+	formatID := requested
+	cm.mu.Lock()
+	if formatID == CLIPRDR_FORMAT_DIB && cm.localPNGOnly {
+		// answered with the PNG, converted by CreateFormatDataResponseMessage
+		formatID = CLIPRDR_FORMAT_PNG
+	}
+	data, ok := cm.local[formatID]
+	if ok {
+		cm.serverRequested = requested
+	}
+	cm.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return cm.CreateFormatDataResponseMessage(formatID, data)
+}
+
 // GetFormatName returns the name of a clipboard format
 func GetFormatName(format ClipboardFormat) string {
 	switch format {
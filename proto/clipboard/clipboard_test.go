@@ -0,0 +1,167 @@
+package clipboard
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingHandler records the format lists it is given
+type countingHandler struct {
+	DefaultClipboardHandler
+	formatLists [][]ClipboardFormat
+}
+
+func (h *countingHandler) OnFormatList(formats []ClipboardFormat) error {
+	h.formatLists = append(h.formatLists, formats)
+	return nil
+}
+
+func formatListMessage(formats ...ClipboardFormat) *ClipboardMessage {
+	buf := new(bytes.Buffer)
+	for _, f := range formats {
+		core.WriteLE(buf, f)
+	}
+	return &ClipboardMessage{
+		MessageType: CLIPRDR_MSG_TYPE_FORMAT_LIST,
+		DataLength:  uint32(buf.Len()),
+		Data:        buf.Bytes(),
+	}
+}
+
+func TestFormatListDebounce(t *testing.T) {
+	t.Run("IdenticalBurst", func(t *testing.T) {
+		handler := &countingHandler{}
+		cm := NewClipboardManager(handler)
+		for i := 0; i < 5; i++ {
+			require.NoError(t, cm.ProcessMessage(formatListMessage(CLIPRDR_FORMAT_OEMTEXT, CLIPRDR_FORMAT_UNICODETEXT)))
+		}
+		assert.Equal(t, [][]ClipboardFormat{{CLIPRDR_FORMAT_OEMTEXT, CLIPRDR_FORMAT_UNICODETEXT}}, handler.formatLists)
+	})
+
+	t.Run("ChangedListIsReported", func(t *testing.T) {
+		handler := &countingHandler{}
+		cm := NewClipboardManager(handler)
+		require.NoError(t, cm.ProcessMessage(formatListMessage(CLIPRDR_FORMAT_OEMTEXT)))
+		require.NoError(t, cm.ProcessMessage(formatListMessage(CLIPRDR_FORMAT_UNICODETEXT)))
+		require.NoError(t, cm.ProcessMessage(formatListMessage(CLIPRDR_FORMAT_OEMTEXT)))
+		assert.Len(t, handler.formatLists, 3)
+	})
+
+	t.Run("AfterWindow", func(t *testing.T) {
+		handler := &countingHandler{}
+		cm := NewClipboardManager(handler)
+		cm.SetFormatListDebounce(10 * time.Millisecond)
+		require.NoError(t, cm.ProcessMessage(formatListMessage(CLIPRDR_FORMAT_OEMTEXT)))
+		time.Sleep(20 * time.Millisecond)
+		require.NoError(t, cm.ProcessMessage(formatListMessage(CLIPRDR_FORMAT_OEMTEXT)))
+		assert.Len(t, handler.formatLists, 2)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		handler := &countingHandler{}
+		cm := NewClipboardManager(handler)
+		cm.SetFormatListDebounce(0)
+		for i := 0; i < 5; i++ {
+			require.NoError(t, cm.ProcessMessage(formatListMessage(CLIPRDR_FORMAT_OEMTEXT)))
+		}
+		assert.Len(t, handler.formatLists, 5)
+	})
+}
+
+func TestReadClipboardMessage(t *testing.T) {
+	cm := NewClipboardManager(nil)
+	want := cm.CreateFormatDataRequestMessage(CLIPRDR_FORMAT_UNICODETEXT)
+	msg, err := ReadClipboardMessage(bytes.NewReader(want.Serialize()))
+	require.NoError(t, err)
+	assert.Equal(t, want, msg)
+
+	_, err = ReadClipboardMessage(bytes.NewReader(want.Serialize()[:6]))
+	assert.Error(t, err)
+	_, err = ReadClipboardMessage(bytes.NewReader(want.Serialize()[:10]))
+	assert.Error(t, err)
+
+	// a data length beyond the message is not allocated
+	_, err = ReadClipboardMessage(bytes.NewReader([]byte{0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x7A, 0x0D}))
+	var lengthErr *core.LengthError
+	assert.ErrorAs(t, err, &lengthErr)
+}
+
+func TestDelayedRendering(t *testing.T) {
+	handler := &countingHandler{}
+	cm := NewClipboardManager(handler)
+	_, err := cm.RequestFormatData(CLIPRDR_FORMAT_UNICODETEXT)
+	assert.ErrorIs(t, err, ErrFormatUnavailable)
+
+	require.NoError(t, cm.ProcessMessage(formatListMessage(CLIPRDR_FORMAT_OEMTEXT, CLIPRDR_FORMAT_UNICODETEXT)))
+	assert.Equal(t, []ClipboardFormat{CLIPRDR_FORMAT_OEMTEXT, CLIPRDR_FORMAT_UNICODETEXT}, cm.AvailableFormats())
+	request, err := cm.RequestFormatData(CLIPRDR_FORMAT_UNICODETEXT)
+	require.NoError(t, err)
+	assert.Equal(t, CLIPRDR_MSG_TYPE_FORMAT_DATA_REQUEST, request.MessageType)
+
+	// a new copy replaces what is available
+	require.NoError(t, cm.ProcessMessage(formatListMessage(CLIPRDR_FORMAT_HTML)))
+	assert.Equal(t, []ClipboardFormat{CLIPRDR_FORMAT_HTML}, cm.AvailableFormats())
+	_, err = cm.RequestFormatData(CLIPRDR_FORMAT_UNICODETEXT)
+	assert.ErrorIs(t, err, ErrFormatUnavailable)
+}
+
+func TestLocalData(t *testing.T) {
+	cm := NewClipboardManager(nil)
+	text := EncodeUnicodeText("copied")
+	list := cm.SetLocalData(map[ClipboardFormat][]byte{CLIPRDR_FORMAT_HTML: []byte("<b>copied</b>"), CLIPRDR_FORMAT_UNICODETEXT: text})
+	assert.Equal(t, CLIPRDR_MSG_TYPE_FORMAT_LIST, list.MessageType)
+	assert.Equal(t, []byte{0x0D, 0, 0, 0, 0x0F, 0, 0, 0}, list.Data)
+
+	response := cm.LocalDataResponse(cm.CreateFormatDataRequestMessage(CLIPRDR_FORMAT_UNICODETEXT))
+	require.NotNil(t, response)
+	assert.Equal(t, CLIPRDR_MSG_TYPE_FORMAT_DATA_RESPONSE, response.MessageType)
+	assert.Equal(t, append([]byte{0x0D, 0, 0, 0}, text...), response.Data)
+
+	// formats not set, and other messages, are left to ProcessMessage
+	assert.Nil(t, cm.LocalDataResponse(cm.CreateFormatDataRequestMessage(CLIPRDR_FORMAT_PNG)))
+	assert.Nil(t, cm.LocalDataResponse(list))
+
+	// a PNG is offered and sent as a DIB too
+	dib := EncodeDIB(testImage())
+	png, err := DIBToPNG(dib)
+	require.NoError(t, err)
+	list = cm.SetLocalData(map[ClipboardFormat][]byte{CLIPRDR_FORMAT_PNG: png})
+	assert.Equal(t, []byte{0x13, 0, 0, 0, 0x08, 0, 0, 0}, list.Data)
+	response = cm.LocalDataResponse(cm.CreateFormatDataRequestMessage(CLIPRDR_FORMAT_DIB))
+	require.NotNil(t, response)
+	assert.Equal(t, append([]byte{0x08, 0, 0, 0}, dib...), response.Data)
+	assert.Nil(t, cm.LocalDataResponse(cm.CreateFormatDataRequestMessage(CLIPRDR_FORMAT_UNICODETEXT)))
+}
+
+// FuzzProcessMessage checks that no message from the server makes the
+// clipboard readers panic rather than return an error
+func FuzzProcessMessage(f *testing.F) {
+	cm := NewClipboardManager(nil)
+	for _, msg := range []*ClipboardMessage{
+		cm.CreateCapabilitiesMessage(),
+		cm.CreateFormatListMessage([]ClipboardFormat{CLIPRDR_FORMAT_UNICODETEXT, CLIPRDR_FORMAT_DIB}),
+		cm.CreateFormatDataRequestMessage(CLIPRDR_FORMAT_UNICODETEXT),
+		cm.CreateFormatDataResponseMessage(CLIPRDR_FORMAT_DIB, EncodeDIB(testImage())),
+		cm.CreateFormatDataResponseMessage(CLIPRDR_FORMAT_HTML, EncodeHTML("<b>copied</b>", "https://example.com/")),
+	} {
+		f.Add(msg.Serialize())
+	}
+	f.Add([]byte{0x05, 0x00, 0x01, 0x00, 0xFF, 0xFF, 0xFF, 0xFF})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ReadClipboardMessage(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		assert.LessOrEqual(t, len(msg.Data), len(data))
+		cm := NewClipboardManager(nil)
+		_ = cm.ProcessMessage(msg)
+		// a CF_DIB response to a CF_PNG request is converted
+		cm.CreateFormatDataRequestMessage(CLIPRDR_FORMAT_PNG)
+		_ = cm.ProcessMessage(msg)
+	})
+}
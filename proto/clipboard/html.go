@@ -0,0 +1,97 @@
+package clipboard
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidHTML is returned for CF_HTML data without a valid header
+var ErrInvalidHTML = errors.New("invalid CF_HTML data")
+
+// Markers around the fragment in the HTML of CF_HTML data
+const (
+	htmlStartFragment = "<!--StartFragment-->"
+	htmlEndFragment   = "<!--EndFragment-->"
+)
+
+// htmlHeader is the CF_HTML header, its offsets padded to ten digits so that
+// its length does not depend on them
+const htmlHeader = "Version:0.9\r\nStartHTML:%010d\r\nEndHTML:%010d\r\nStartFragment:%010d\r\nEndFragment:%010d\r\n"
+
+// IsHTMLFormat reports whether data starts with a CF_HTML header
+func IsHTMLFormat(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("Version:"))
+}
+
+// EncodeHTML wraps an HTML fragment, e.g. some formatted text, in the
+// document and header of the CF_HTML clipboard format, whose offsets count
+// the bytes of the UTF-8 encoding. sourceURL, the page the fragment was
+// copied from, may be empty.
+func EncodeHTML(fragment, sourceURL string) []byte {
+	var source string
+	if sourceURL != "" {
+		source = "SourceURL:" + sourceURL + "\r\n"
+	}
+	const prefix = "<html>\r\n<body>\r\n" + htmlStartFragment
+	const suffix = htmlEndFragment + "\r\n</body>\r\n</html>"
+
+	startHTML := len(fmt.Sprintf(htmlHeader, 0, 0, 0, 0)) + len(source)
+	startFragment := startHTML + len(prefix)
+	endFragment := startFragment + len(fragment)
+	endHTML := endFragment + len(suffix)
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, htmlHeader, startHTML, endHTML, startFragment, endFragment)
+	buf.WriteString(source)
+	buf.WriteString(prefix)
+	buf.WriteString(fragment)
+	buf.WriteString(suffix)
+	return buf.Bytes()
+}
+
+// DecodeHTML returns the fragment and source URL of CF_HTML data, going by
+// the byte offsets of its header. Data without fragment offsets gives the
+// whole HTML instead.
+// See HTML Clipboard Format in the Windows data exchange documentation
+func DecodeHTML(data []byte) (fragment, sourceURL string, err error) {
+	if !IsHTMLFormat(data) {
+		return "", "", fmt.Errorf("%w: no header", ErrInvalidHTML)
+	}
+	// the HTML may end in the terminating NUL of the Windows clipboard
+	data = bytes.TrimRight(data, "\x00")
+
+	offsets := map[string]int{"StartHTML": -1, "EndHTML": -1, "StartFragment": -1, "EndFragment": -1}
+	header := data
+	if i := bytes.IndexByte(header, '<'); i >= 0 {
+		header = header[:i]
+	}
+	for _, line := range strings.Split(string(header), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		if key == "SourceURL" {
+			sourceURL = value
+			continue
+		}
+		if _, known := offsets[key]; known {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return "", "", fmt.Errorf("%w: %s", ErrInvalidHTML, line)
+			}
+			offsets[key] = n
+		}
+	}
+
+	start, end := offsets["StartFragment"], offsets["EndFragment"]
+	if start < 0 || end < 0 {
+		start, end = offsets["StartHTML"], offsets["EndHTML"]
+	}
+	if start < 0 || end < start || end > len(data) {
+		return "", "", fmt.Errorf("%w: offsets %d-%d of %d bytes", ErrInvalidHTML, start, end, len(data))
+	}
+	return string(data[start:end]), sourceURL, nil
+}
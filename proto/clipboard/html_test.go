@@ -0,0 +1,114 @@
+package clipboard
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// offsetOf reads the offset named key from a CF_HTML header
+func offsetOf(t *testing.T, data []byte, key string) int {
+	var n int
+	i := strings.Index(string(data), key+":")
+	require.GreaterOrEqual(t, i, 0, key)
+	_, err := fmt.Sscanf(string(data[i+len(key)+1:]), "%d", &n)
+	require.NoError(t, err)
+	return n
+}
+
+func TestEncodeHTML(t *testing.T) {
+	fragment := "<b>Grüße</b> 日本"
+	data := EncodeHTML(fragment, "https://example.com/page")
+	assert.True(t, IsHTMLFormat(data))
+	assert.Contains(t, string(data), "SourceURL:https://example.com/page\r\n")
+
+	// byte offsets, which the multi-byte characters of the fragment shift
+	startHTML, endHTML := offsetOf(t, data, "StartHTML"), offsetOf(t, data, "EndHTML")
+	assert.Equal(t, "<html>", string(data[startHTML:startHTML+6]))
+	assert.Equal(t, len(data), endHTML)
+	assert.Equal(t, fragment, string(data[offsetOf(t, data, "StartFragment"):offsetOf(t, data, "EndFragment")]))
+
+	html, sourceURL, err := DecodeHTML(data)
+	require.NoError(t, err)
+	assert.Equal(t, fragment, html)
+	assert.Equal(t, "https://example.com/page", sourceURL)
+}
+
+func TestDecodeHTML(t *testing.T) {
+	t.Run("Windows", func(t *testing.T) {
+		// as copied from a browser on Windows, CRLF and a terminating NUL
+		body := "<html><body>\r\n<!--StartFragment--><i>x</i><!--EndFragment-->\r\n</body></html>"
+		header := "Version:0.9\r\nStartHTML:%08d\r\nEndHTML:%08d\r\nStartFragment:%08d\r\nEndFragment:%08d\r\n"
+		n := len(fmt.Sprintf(header, 0, 0, 0, 0))
+		start := n + strings.Index(body, "<i>")
+		data := fmt.Sprintf(header, n, n+len(body), start, start+len("<i>x</i>")) + body + "\x00"
+		html, sourceURL, err := DecodeHTML([]byte(data))
+		require.NoError(t, err)
+		assert.Equal(t, "<i>x</i>", html)
+		assert.Empty(t, sourceURL)
+	})
+
+	t.Run("NoFragment", func(t *testing.T) {
+		header := "Version:1.0\nStartHTML:%04d\nEndHTML:%04d\nStartFragment:-1\n"
+		n := len(fmt.Sprintf(header, 0, 0))
+		data := fmt.Sprintf(header, n, n+len("<p>whole</p>")) + "<p>whole</p>"
+		html, _, err := DecodeHTML([]byte(data))
+		require.NoError(t, err)
+		assert.Equal(t, "<p>whole</p>", html)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, data := range []string{
+			"<b>no header</b>",
+			"Version:0.9\r\nStartFragment:x\r\nEndFragment:10\r\n<b></b>",
+			"Version:0.9\r\nStartFragment:20\r\nEndFragment:10\r\n<b></b>",
+			"Version:0.9\r\nStartFragment:0\r\nEndFragment:1000\r\n<b></b>",
+			"Version:0.9\r\n<b></b>",
+		} {
+			_, _, err := DecodeHTML([]byte(data))
+			assert.ErrorIs(t, err, ErrInvalidHTML, data)
+		}
+	})
+}
+
+// htmlHandler records the HTML the manager hands it
+type htmlHandler struct {
+	DefaultClipboardHandler
+	html, sourceURL string
+	responses       int
+}
+
+func (h *htmlHandler) OnHTMLData(html string, sourceURL string) error {
+	h.html, h.sourceURL = html, sourceURL
+	return nil
+}
+
+func (h *htmlHandler) OnFormatDataResponse(formatID ClipboardFormat, data []byte) error {
+	h.responses++
+	return nil
+}
+
+func TestHTMLFormatData(t *testing.T) {
+	handler := &htmlHandler{}
+	cm := NewClipboardManager(handler)
+
+	data := EncodeHTML("<u>pasted</u>", "file:///doc.html")
+	require.NoError(t, cm.ProcessMessage(formatMessage(CLIPRDR_MSG_TYPE_FORMAT_DATA_RESPONSE, CLIPRDR_FORMAT_HTML, data)))
+	assert.Equal(t, "<u>pasted</u>", handler.html)
+	assert.Equal(t, "file:///doc.html", handler.sourceURL)
+	assert.Zero(t, handler.responses, "CF_HTML goes to OnHTMLData only")
+
+	err := cm.ProcessMessage(formatMessage(CLIPRDR_MSG_TYPE_FORMAT_DATA_RESPONSE, CLIPRDR_FORMAT_HTML, []byte("<b>raw</b>")))
+	assert.ErrorIs(t, err, ErrInvalidHTML)
+
+	// plain HTML from the app is wrapped, CF_HTML data is sent as it is
+	response := cm.CreateFormatDataResponseMessage(CLIPRDR_FORMAT_HTML, []byte("<b>copied</b>"))
+	html, _, err := DecodeHTML(response.Data[4:])
+	require.NoError(t, err)
+	assert.Equal(t, "<b>copied</b>", html)
+	response = cm.CreateFormatDataResponseMessage(CLIPRDR_FORMAT_HTML, data)
+	assert.Equal(t, data, response.Data[4:])
+}
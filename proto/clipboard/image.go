@@ -0,0 +1,173 @@
+package clipboard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math/bits"
+)
+
+// Errors returned when converting clipboard images
+var (
+	ErrInvalidDIB     = errors.New("invalid device-independent bitmap")
+	ErrUnsupportedDIB = errors.New("unsupported device-independent bitmap")
+)
+
+// Header sizes and compression types of a DIB.
+// See [MS-WMF] 2.2.2.3 and 2.1.1.7
+const (
+	bitmapInfoHeaderSize = 40  // BITMAPINFOHEADER
+	bitmapV4HeaderSize   = 108 // BITMAPV4HEADER, and the larger BITMAPV5HEADER
+
+	BI_RGB       = 0x0000
+	BI_BITFIELDS = 0x0003
+)
+
+// DecodeDIB decodes the packed DIB Windows puts on the clipboard as CF_DIB,
+// a BITMAPINFOHEADER, BITMAPV4HEADER or BITMAPV5HEADER followed by the
+// pixels. 24 and 32 bits per pixel are supported, which is what Windows
+// applications copy; a 32-bit image has alpha only when its header gives a
+// mask for it, otherwise it is opaque.
+func DecodeDIB(data []byte) (image.Image, error) {
+	if len(data) < bitmapInfoHeaderSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrInvalidDIB, len(data))
+	}
+	le := binary.LittleEndian
+	headerSize := le.Uint32(data[0:])
+	width := int32(le.Uint32(data[4:]))
+	height := int32(le.Uint32(data[8:]))
+	bitCount := le.Uint16(data[14:])
+	compression := le.Uint32(data[16:])
+	if headerSize < bitmapInfoHeaderSize || uint64(headerSize) > uint64(len(data)) {
+		return nil, fmt.Errorf("%w: header of %d bytes", ErrInvalidDIB, headerSize)
+	}
+	if width <= 0 || height == 0 || height == -1<<31 {
+		return nil, fmt.Errorf("%w: %dx%d", ErrInvalidDIB, width, height)
+	}
+
+	// BGR(A), the masks of BI_RGB
+	masks := [4]uint32{0x00FF0000, 0x0000FF00, 0x000000FF, 0}
+	offset := int(headerSize)
+	switch {
+	case compression == BI_RGB && (bitCount == 24 || bitCount == 32):
+	case compression == BI_BITFIELDS && bitCount == 32:
+		if headerSize == bitmapInfoHeaderSize {
+			// the masks follow a BITMAPINFOHEADER, and are part of the others
+			offset += 12
+		}
+		if len(data) < bitmapInfoHeaderSize+12 {
+			return nil, fmt.Errorf("%w: %d bytes", ErrInvalidDIB, len(data))
+		}
+		for i := 0; i < 3; i++ {
+			masks[i] = le.Uint32(data[bitmapInfoHeaderSize+4*i:])
+		}
+		if headerSize >= bitmapV4HeaderSize {
+			masks[3] = le.Uint32(data[bitmapInfoHeaderSize+12:])
+		}
+	default:
+		return nil, fmt.Errorf("%w: %d bits per pixel, compression %d", ErrUnsupportedDIB, bitCount, compression)
+	}
+
+	topDown := height < 0
+	if topDown {
+		height = -height
+	}
+	w, h := int(width), int(height)
+	stride := (w*int(bitCount) + 31) / 32 * 4
+	if offset > len(data) || uint64(len(data)-offset) < uint64(stride)*uint64(h) {
+		return nil, fmt.Errorf("%w: %d bytes of pixels for %dx%d at %d bits", ErrInvalidDIB, len(data)-offset, w, h, bitCount)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	step := int(bitCount / 8)
+	for y := 0; y < h; y++ {
+		row := data[offset+y*stride:]
+		if !topDown {
+			row = data[offset+(h-1-y)*stride:]
+		}
+		for x := 0; x < w; x++ {
+			p := row[x*step:]
+			var px uint32
+			if step == 4 {
+				px = le.Uint32(p)
+			} else {
+				px = uint32(p[0]) | uint32(p[1])<<8 | uint32(p[2])<<16
+			}
+			c := color.NRGBA{maskedValue(px, masks[0]), maskedValue(px, masks[1]), maskedValue(px, masks[2]), 0xFF}
+			if masks[3] != 0 {
+				c.A = maskedValue(px, masks[3])
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img, nil
+}
+
+// maskedValue extracts the channel of pixel px under mask, scaled to 8 bits
+func maskedValue(px, mask uint32) uint8 {
+	if mask == 0 {
+		return 0
+	}
+	shift := bits.TrailingZeros32(mask)
+	width := bits.OnesCount32(mask)
+	v := (px & mask) >> shift
+	if width == 8 {
+		return uint8(v)
+	}
+	return uint8(uint64(v) * 0xFF / (1<<width - 1))
+}
+
+// EncodeDIB encodes img as a packed DIB for CF_DIB: a BITMAPINFOHEADER and
+// bottom-up 32-bit BI_RGB pixels. Such a DIB has no alpha, so transparency
+// is dropped and every pixel keeps its colour.
+func EncodeDIB(img image.Image) []byte {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	stride := w * 4
+	buf := make([]byte, bitmapInfoHeaderSize+stride*h)
+
+	le := binary.LittleEndian
+	le.PutUint32(buf[0:], bitmapInfoHeaderSize)
+	le.PutUint32(buf[4:], uint32(w))
+	le.PutUint32(buf[8:], uint32(h)) // positive, bottom-up
+	le.PutUint16(buf[12:], 1)        // planes
+	le.PutUint16(buf[14:], 32)
+	le.PutUint32(buf[16:], BI_RGB)
+	le.PutUint32(buf[20:], uint32(stride*h))
+
+	for y := 0; y < h; y++ {
+		row := buf[bitmapInfoHeaderSize+(h-1-y)*stride:]
+		for x := 0; x < w; x++ {
+			c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			p := row[x*4 : x*4+4]
+			p[0], p[1], p[2] = c.B, c.G, c.R
+		}
+	}
+	return buf
+}
+
+// DIBToPNG converts CF_DIB data into CF_PNG data
+func DIBToPNG(data []byte) ([]byte, error) {
+	img, err := DecodeDIB(data)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// PNGToDIB converts CF_PNG data into CF_DIB data
+func PNGToDIB(data []byte) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode PNG: %w", err)
+	}
+	return EncodeDIB(img), nil
+}
@@ -0,0 +1,223 @@
+package clipboard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dibHeader returns a DIB header of size bytes for a w x h image
+func dibHeader(size uint32, w, h int32, bitCount uint16, compression uint32) []byte {
+	header := make([]byte, size)
+	le := binary.LittleEndian
+	le.PutUint32(header[0:], size)
+	le.PutUint32(header[4:], uint32(w))
+	le.PutUint32(header[8:], uint32(h))
+	le.PutUint16(header[12:], 1)
+	le.PutUint16(header[14:], bitCount)
+	le.PutUint32(header[16:], compression)
+	return header
+}
+
+// testImage is an opaque 3x2 image with a distinct colour per pixel
+func testImage() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i, c := range []color.NRGBA{
+		{0xFF, 0, 0, 0xFF}, {0, 0xFF, 0, 0xFF}, {0, 0, 0xFF, 0xFF},
+		{0x10, 0x20, 0x30, 0xFF}, {0xFF, 0xFF, 0xFF, 0xFF}, {0, 0, 0, 0xFF},
+	} {
+		img.SetNRGBA(i%3, i/3, c)
+	}
+	return img
+}
+
+func TestDecodeDIB(t *testing.T) {
+	t.Run("BottomUp24", func(t *testing.T) {
+		// rows padded to 4 bytes, the bottom row first
+		dib := dibHeader(bitmapInfoHeaderSize, 2, 2, 24, BI_RGB)
+		dib = append(dib, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 0, 0) // red, white
+		dib = append(dib, 0xFF, 0, 0, 0, 0xFF, 0, 0, 0)       // blue, green
+		img, err := DecodeDIB(dib)
+		require.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, 2, 2), img.Bounds())
+		assert.Equal(t, color.NRGBA{0, 0, 0xFF, 0xFF}, img.At(0, 0))
+		assert.Equal(t, color.NRGBA{0, 0xFF, 0, 0xFF}, img.At(1, 0))
+		assert.Equal(t, color.NRGBA{0xFF, 0, 0, 0xFF}, img.At(0, 1))
+		assert.Equal(t, color.NRGBA{0xFF, 0xFF, 0xFF, 0xFF}, img.At(1, 1))
+	})
+
+	t.Run("TopDownV5WithAlpha", func(t *testing.T) {
+		dib := dibHeader(124, 1, -2, 32, BI_BITFIELDS)
+		le := binary.LittleEndian
+		le.PutUint32(dib[40:], 0x00FF0000)
+		le.PutUint32(dib[44:], 0x0000FF00)
+		le.PutUint32(dib[48:], 0x000000FF)
+		le.PutUint32(dib[52:], 0xFF000000)
+		dib = append(dib, 0x30, 0x20, 0x10, 0x80, 0, 0, 0, 0)
+		img, err := DecodeDIB(dib)
+		require.NoError(t, err)
+		assert.Equal(t, color.NRGBA{0x10, 0x20, 0x30, 0x80}, img.At(0, 0))
+		assert.Equal(t, color.NRGBA{0, 0, 0, 0}, img.At(0, 1))
+	})
+
+	t.Run("RGB32IsOpaque", func(t *testing.T) {
+		dib := append(dibHeader(bitmapInfoHeaderSize, 1, 1, 32, BI_RGB), 0x30, 0x20, 0x10, 0)
+		img, err := DecodeDIB(dib)
+		require.NoError(t, err)
+		assert.Equal(t, color.NRGBA{0x10, 0x20, 0x30, 0xFF}, img.At(0, 0))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := DecodeDIB([]byte{40, 0, 0})
+		assert.ErrorIs(t, err, ErrInvalidDIB)
+		_, err = DecodeDIB(dibHeader(bitmapInfoHeaderSize, 0, 1, 32, BI_RGB))
+		assert.ErrorIs(t, err, ErrInvalidDIB)
+		_, err = DecodeDIB(append(dibHeader(bitmapInfoHeaderSize, 100, 100, 32, BI_RGB), 1, 2, 3, 4))
+		assert.ErrorIs(t, err, ErrInvalidDIB, "fewer pixels than the size needs")
+		_, err = DecodeDIB(dibHeader(bitmapInfoHeaderSize, 1, 1, 32, BI_BITFIELDS))
+		assert.ErrorIs(t, err, ErrInvalidDIB, "masks missing")
+		_, err = DecodeDIB(append(dibHeader(bitmapInfoHeaderSize, 1, 1, 8, BI_RGB), make([]byte, 8)...))
+		assert.ErrorIs(t, err, ErrUnsupportedDIB)
+	})
+}
+
+func TestImageConversion(t *testing.T) {
+	want := testImage()
+	img, err := DecodeDIB(EncodeDIB(want))
+	require.NoError(t, err)
+	assert.Equal(t, want, img)
+
+	translucent := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	translucent.SetNRGBA(0, 0, color.NRGBA{0x10, 0x20, 0x30, 0x80})
+	img, err = DecodeDIB(EncodeDIB(translucent))
+	require.NoError(t, err)
+	assert.Equal(t, color.NRGBA{0x10, 0x20, 0x30, 0xFF}, img.At(0, 0), "CF_DIB has no alpha")
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, png.Encode(buf, want))
+	dib, err := PNGToDIB(buf.Bytes())
+	require.NoError(t, err)
+	pngData, err := DIBToPNG(dib)
+	require.NoError(t, err)
+	img, err = png.Decode(bytes.NewReader(pngData))
+	require.NoError(t, err)
+
+	assert.Equal(t, want.Pix, toNRGBA(img).Pix)
+
+	_, err = PNGToDIB([]byte("not a png"))
+	assert.Error(t, err)
+}
+
+// toNRGBA converts img, which png.Decode returns as an RGBA image when opaque
+func toNRGBA(img image.Image) *image.NRGBA {
+	out := image.NewNRGBA(img.Bounds())
+	draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Src)
+	return out
+}
+
+// imageHandler records what the manager hands it
+type imageHandler struct {
+	DefaultClipboardHandler
+	formats   []ClipboardFormat
+	requested ClipboardFormat
+	format    ClipboardFormat
+	data      []byte
+}
+
+func (h *imageHandler) OnFormatList(formats []ClipboardFormat) error {
+	h.formats = formats
+	return nil
+}
+
+func (h *imageHandler) OnFormatDataRequest(formatID ClipboardFormat) error {
+	h.requested = formatID
+	return nil
+}
+
+func (h *imageHandler) OnFormatDataResponse(formatID ClipboardFormat, data []byte) error {
+	h.format, h.data = formatID, data
+	return nil
+}
+
+// formatMessage returns a message of typ carrying a format id and data
+func formatMessage(typ ClipboardMessageType, format ClipboardFormat, data []byte) *ClipboardMessage {
+	payload := binary.LittleEndian.AppendUint32(nil, uint32(format))
+	payload = append(payload, data...)
+	return &ClipboardMessage{MessageType: typ, DataLength: uint32(len(payload)), Data: payload}
+}
+
+func TestImageFormatConversion(t *testing.T) {
+	want := testImage()
+	buf := new(bytes.Buffer)
+	require.NoError(t, png.Encode(buf, want))
+	pngData := buf.Bytes()
+
+	t.Run("RemoteDIB", func(t *testing.T) {
+		handler := &imageHandler{}
+		cm := NewClipboardManager(handler)
+		require.NoError(t, cm.ProcessMessage(formatListMessage(CLIPRDR_FORMAT_UNICODETEXT, CLIPRDR_FORMAT_DIB)))
+		assert.Equal(t, []ClipboardFormat{CLIPRDR_FORMAT_UNICODETEXT, CLIPRDR_FORMAT_DIB, CLIPRDR_FORMAT_PNG}, handler.formats)
+
+		request := cm.CreateFormatDataRequestMessage(CLIPRDR_FORMAT_PNG)
+		assert.Equal(t, CLIPRDR_MSG_TYPE_FORMAT_DATA_REQUEST, request.MessageType)
+		assert.Equal(t, uint32(CLIPRDR_FORMAT_DIB), binary.LittleEndian.Uint32(request.Data), "the server is asked for its DIB")
+
+		require.NoError(t, cm.ProcessMessage(formatMessage(CLIPRDR_MSG_TYPE_FORMAT_DATA_RESPONSE, CLIPRDR_FORMAT_DIB, EncodeDIB(want))))
+		assert.Equal(t, CLIPRDR_FORMAT_PNG, handler.format)
+		img, err := png.Decode(bytes.NewReader(handler.data))
+		require.NoError(t, err)
+		assert.Equal(t, want.Pix, toNRGBA(img).Pix)
+
+		// asked for as a DIB, it stays one
+		cm.CreateFormatDataRequestMessage(CLIPRDR_FORMAT_DIB)
+		require.NoError(t, cm.ProcessMessage(formatMessage(CLIPRDR_MSG_TYPE_FORMAT_DATA_RESPONSE, CLIPRDR_FORMAT_DIB, []byte("dib"))))
+		assert.Equal(t, CLIPRDR_FORMAT_DIB, handler.format)
+		assert.Equal(t, []byte("dib"), handler.data)
+
+		cm.CreateFormatDataRequestMessage(CLIPRDR_FORMAT_PNG)
+		err = cm.ProcessMessage(formatMessage(CLIPRDR_MSG_TYPE_FORMAT_DATA_RESPONSE, CLIPRDR_FORMAT_DIB, []byte("garbage")))
+		assert.ErrorIs(t, err, ErrInvalidDIB)
+	})
+
+	t.Run("RemotePNG", func(t *testing.T) {
+		handler := &imageHandler{}
+		cm := NewClipboardManager(handler)
+		require.NoError(t, cm.ProcessMessage(formatListMessage(CLIPRDR_FORMAT_DIB, CLIPRDR_FORMAT_PNG)))
+		assert.Equal(t, []ClipboardFormat{CLIPRDR_FORMAT_DIB, CLIPRDR_FORMAT_PNG}, handler.formats)
+		request := cm.CreateFormatDataRequestMessage(CLIPRDR_FORMAT_PNG)
+		assert.Equal(t, uint32(CLIPRDR_FORMAT_PNG), binary.LittleEndian.Uint32(request.Data))
+	})
+
+	t.Run("LocalPNG", func(t *testing.T) {
+		handler := &imageHandler{}
+		cm := NewClipboardManager(handler)
+		list := cm.CreateFormatListMessage([]ClipboardFormat{CLIPRDR_FORMAT_PNG})
+		assert.Equal(t, formatListMessage(CLIPRDR_FORMAT_PNG, CLIPRDR_FORMAT_DIB).Data, list.Data)
+
+		require.NoError(t, cm.ProcessMessage(formatMessage(CLIPRDR_MSG_TYPE_FORMAT_DATA_REQUEST, CLIPRDR_FORMAT_DIB, nil)))
+		assert.Equal(t, CLIPRDR_FORMAT_PNG, handler.requested, "the app is asked for its PNG")
+
+		response := cm.CreateFormatDataResponseMessage(CLIPRDR_FORMAT_PNG, pngData)
+		assert.Equal(t, uint32(CLIPRDR_FORMAT_DIB), binary.LittleEndian.Uint32(response.Data))
+		img, err := DecodeDIB(response.Data[4:])
+		require.NoError(t, err)
+		assert.Equal(t, want, img)
+
+		require.NoError(t, cm.ProcessMessage(formatMessage(CLIPRDR_MSG_TYPE_FORMAT_DATA_REQUEST, CLIPRDR_FORMAT_DIB, nil)))
+		response = cm.CreateFormatDataResponseMessage(CLIPRDR_FORMAT_PNG, []byte("not a png"))
+		assert.Equal(t, uint16(CB_RESPONSE_FAIL), response.MessageFlags)
+		assert.Empty(t, response.Data)
+
+		// a PNG asked for as such is sent unchanged
+		require.NoError(t, cm.ProcessMessage(formatMessage(CLIPRDR_MSG_TYPE_FORMAT_DATA_REQUEST, CLIPRDR_FORMAT_PNG, nil)))
+		response = cm.CreateFormatDataResponseMessage(CLIPRDR_FORMAT_PNG, pngData)
+		assert.Equal(t, formatMessage(CLIPRDR_MSG_TYPE_FORMAT_DATA_RESPONSE, CLIPRDR_FORMAT_PNG, pngData).Data, response.Data)
+	})
+}
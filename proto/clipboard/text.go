@@ -0,0 +1,33 @@
+package clipboard
+
+import (
+	"encoding/binary"
+	"strings"
+	"unicode/utf16"
+)
+
+// EncodeUnicodeText encodes text as CF_UNICODETEXT: NUL-terminated UTF-16LE
+// with the CRLF line endings of Windows
+func EncodeUnicodeText(text string) []byte {
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")
+	units := utf16.Encode([]rune(text))
+	data := make([]byte, 2*len(units)+2)
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(data[2*i:], u)
+	}
+	return data
+}
+
+// DecodeUnicodeText decodes CF_UNICODETEXT data, up to its terminating NUL,
+// into text with LF line endings
+func DecodeUnicodeText(data []byte) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		u := binary.LittleEndian.Uint16(data[i:])
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+	return strings.ReplaceAll(string(utf16.Decode(units)), "\r\n", "\n")
+}
@@ -0,0 +1,18 @@
+package clipboard
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnicodeText(t *testing.T) {
+	data := EncodeUnicodeText("a\nb€")
+	assert.Equal(t, []byte{'a', 0, '\r', 0, '\n', 0, 'b', 0, 0xAC, 0x20, 0, 0}, data)
+	assert.Equal(t, "a\nb€", DecodeUnicodeText(data))
+
+	// CRLF is not doubled, and decoding stops at the NUL
+	assert.Equal(t, EncodeUnicodeText("x\ny"), EncodeUnicodeText("x\r\ny"))
+	assert.Equal(t, "x", DecodeUnicodeText([]byte{'x', 0, 0, 0, 'y', 0}))
+	assert.Equal(t, "😀", DecodeUnicodeText(EncodeUnicodeText("😀")))
+}
@@ -2,8 +2,11 @@ package device
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"sort"
 	"sync"
 
 	"github.com/kdsmith18542/gordp/core"
@@ -11,65 +14,104 @@ import (
 )
 
 // DeviceType represents the type of device being redirected
+// See [MS-RDPEFS] 2.2.1.3
 type DeviceType uint32
 
 const (
-	DeviceTypePrinter   DeviceType = 0x00000001
-	DeviceTypeDrive     DeviceType = 0x00000002
-	DeviceTypePort      DeviceType = 0x00000003
-	DeviceTypeSmartCard DeviceType = 0x00000004
+	DeviceTypePrinter   DeviceType = 0x00000004 // RDPDR_DTYP_PRINT
+	DeviceTypeDrive     DeviceType = 0x00000008 // RDPDR_DTYP_FILESYSTEM
+	DeviceTypePort      DeviceType = 0x00000001 // RDPDR_DTYP_SERIAL
+	DeviceTypeSmartCard DeviceType = 0x00000020 // RDPDR_DTYP_SMARTCARD
 	DeviceTypeAudio     DeviceType = 0x00000005
 	DeviceTypeVideo     DeviceType = 0x00000006
 	DeviceTypeUSB       DeviceType = 0x00000007
 )
 
-// DeviceMessageType represents the type of device redirection message
+// DeviceMessageType is the Component of the RDPDR_HEADER of a message
+// See [MS-RDPEFS] 2.2.1.1
 type DeviceMessageType uint16
 
 const (
-	RDPDR_CTYP_CORE  DeviceMessageType = 0x4472 // "Dr"
-	RDPDR_CTYP_PRN   DeviceMessageType = 0x5052 // "Pr"
-	RDPDR_CTYP_SCARD DeviceMessageType = 0x5343 // "Sc"
+	RDPDR_CTYP_CORE DeviceMessageType = 0x4472 // "Dr"
+	RDPDR_CTYP_PRN  DeviceMessageType = 0x5052 // "Pr"
 )
 
-// CoreMessageType represents the type of core device message
+// CoreMessageType is the PacketId of the RDPDR_HEADER of a core message
+// See [MS-RDPEFS] 2.2.1.1
 type CoreMessageType uint16
 
 const (
-	PAKID_CORE_DEVICE_ANNOUNCE                 CoreMessageType = 0x0001
-	PAKID_CORE_DEVICE_REPLY_ANNOUNCE           CoreMessageType = 0x0002
-	PAKID_CORE_DEVICE_IOREQUEST                CoreMessageType = 0x0003
-	PAKID_CORE_DEVICE_IOCOMPLETION             CoreMessageType = 0x0004
-	PAKID_CORE_DEVICE_CREATE                   CoreMessageType = 0x0005
-	PAKID_CORE_DEVICE_CLOSE                    CoreMessageType = 0x0006
-	PAKID_CORE_DEVICE_READ                     CoreMessageType = 0x0007
-	PAKID_CORE_DEVICE_WRITE                    CoreMessageType = 0x0008
-	PAKID_CORE_DEVICE_QUERY_INFORMATION        CoreMessageType = 0x0009
-	PAKID_CORE_DEVICE_SET_INFORMATION          CoreMessageType = 0x000A
-	PAKID_CORE_DEVICE_QUERY_VOLUME_INFORMATION CoreMessageType = 0x000B
-	PAKID_CORE_DEVICE_SET_VOLUME_INFORMATION   CoreMessageType = 0x000C
-	PAKID_CORE_DEVICE_QUERY_DIRECTORY          CoreMessageType = 0x000D
-	PAKID_CORE_DEVICE_NOTIFY_CHANGE_DIRECTORY  CoreMessageType = 0x000E
-	PAKID_CORE_DEVICE_LOCK_CONTROL             CoreMessageType = 0x000F
-	PAKID_CORE_DEVICE_QUERY_EA                 CoreMessageType = 0x0010
-	PAKID_CORE_DEVICE_SET_EA                   CoreMessageType = 0x0011
-	PAKID_CORE_DEVICE_FLUSH_BUFFERS            CoreMessageType = 0x0012
-	PAKID_CORE_DEVICE_QUERY_QUOTA              CoreMessageType = 0x0013
-	PAKID_CORE_DEVICE_SET_QUOTA                CoreMessageType = 0x0014
-	PAKID_CORE_DEVICE_QUERY_SECURITY           CoreMessageType = 0x0015
-	PAKID_CORE_DEVICE_SET_SECURITY             CoreMessageType = 0x0016
+	PAKID_CORE_SERVER_ANNOUNCE       CoreMessageType = 0x496E
+	PAKID_CORE_CLIENTID_CONFIRM      CoreMessageType = 0x4343
+	PAKID_CORE_CLIENT_NAME           CoreMessageType = 0x434E
+	PAKID_CORE_DEVICE_ANNOUNCE       CoreMessageType = 0x4441 // PAKID_CORE_DEVICELIST_ANNOUNCE
+	PAKID_CORE_DEVICE_REPLY_ANNOUNCE CoreMessageType = 0x6472 // PAKID_CORE_DEVICE_REPLY
+	PAKID_CORE_DEVICE_IOREQUEST      CoreMessageType = 0x4952
+	PAKID_CORE_DEVICE_IOCOMPLETION   CoreMessageType = 0x4943
+	PAKID_CORE_SERVER_CAPABILITY     CoreMessageType = 0x5350
+	PAKID_CORE_CLIENT_CAPABILITY     CoreMessageType = 0x4350
+	PAKID_CORE_USER_LOGGEDON         CoreMessageType = 0x554C
+	PAKID_CORE_DEVICE_REMOVE         CoreMessageType = 0x444D // PAKID_CORE_DEVICELIST_REMOVE
 )
 
-// PrinterMessageType represents the type of printer message
+// PrinterMessageType is the PacketId of the RDPDR_HEADER of a printer
+// message
 type PrinterMessageType uint16
 
 const (
-	PAKID_PRN_CACHE_DATA     PrinterMessageType = 0x0001
-	PAKID_PRN_USING_XPS      PrinterMessageType = 0x0002
-	PAKID_PRN_CACHE_DATA_XPS PrinterMessageType = 0x0003
+	PAKID_PRN_CACHE_DATA PrinterMessageType = 0x5043
+	PAKID_PRN_USING_XPS  PrinterMessageType = 0x5543
 )
 
-// DeviceMessage represents a device redirection message
+// Versions the client announces, those of RDP 6.0 and later clients
+// See [MS-RDPEFS] 2.2.2.3
+const (
+	rdpdrVersionMajor = 0x0001
+	rdpdrVersionMinor = 0x000C
+)
+
+// Capability sets of the Client Core Capability Response
+// See [MS-RDPEFS] 2.2.2.8 and 2.2.2.7.1
+const (
+	CAP_GENERAL_TYPE   = 0x0001
+	CAP_PRINTER_TYPE   = 0x0002
+	CAP_PORT_TYPE      = 0x0003
+	CAP_DRIVE_TYPE     = 0x0004
+	CAP_SMARTCARD_TYPE = 0x0005
+
+	GENERAL_CAPABILITY_VERSION_02 = 0x00000002
+	RDPDR_DEVICE_REMOVE_PDUS      = 0x00000001
+
+	// generalCapabilityLength is the CapabilityLength of GENERAL_CAPS_SET
+	generalCapabilityLength = 44
+)
+
+// dosNameLength is the size of the PreferredDosName of a device
+// announcement, a NUL terminated ASCII name
+const dosNameLength = 8
+
+// Major functions of device I/O requests
+// See [MS-RDPEFS] 2.2.1.4
+const (
+	IRP_MJ_CREATE         = 0x00000000
+	IRP_MJ_CLOSE          = 0x00000002
+	IRP_MJ_READ           = 0x00000003
+	IRP_MJ_WRITE          = 0x00000004
+	IRP_MJ_DEVICE_CONTROL = 0x0000000E
+)
+
+// NTSTATUS values of device I/O completions
+const (
+	STATUS_SUCCESS           = 0x00000000
+	STATUS_TIMEOUT           = 0x00000102
+	STATUS_UNSUCCESSFUL      = 0xC0000001
+	STATUS_INVALID_PARAMETER = 0xC000000D
+	STATUS_NOT_SUPPORTED     = 0xC00000BB
+	STATUS_CANCELLED         = 0xC0000120
+)
+
+// DeviceMessage represents a device redirection message: an RDPDR_HEADER
+// of ComponentID and PacketID, then the body of the message in Data
 type DeviceMessage struct {
 	ComponentID DeviceMessageType
 	PacketID    uint16
@@ -172,12 +214,26 @@ func (h *DefaultDeviceHandler) OnPortAccess(portName string, operation string) e
 	return nil
 }
 
+// ErrChannelNotOpen is returned by SendMessage when no RDPDR channel is
+// attached to the device manager
+var ErrChannelNotOpen = errors.New("rdpdr channel not open")
+
 // DeviceManager manages device redirection
 type DeviceManager struct {
 	devices map[uint32]*DeviceAnnounce
 	handler DeviceHandler
 	mutex   sync.RWMutex
 	nextID  uint32
+
+	// raw message transport
+	send      func(data []byte) error
+	listeners []func(*DeviceMessage)
+	replies   []func(*DeviceReplyAnnounce)
+
+	// local are the ids of the devices the client redirects, announced
+	// once the server confirms the client id and set ready
+	local map[uint32]bool
+	ready bool
 }
 
 // NewDeviceManager creates a new device manager
@@ -190,6 +246,7 @@ func NewDeviceManager(handler DeviceHandler) *DeviceManager {
 		devices: make(map[uint32]*DeviceAnnounce),
 		handler: handler,
 		nextID:  1,
+		local:   make(map[uint32]bool),
 	}
 }
 
@@ -198,8 +255,12 @@ func ReadDeviceMessage(r io.Reader) (*DeviceMessage, error) {
 	msg := &DeviceMessage{}
 
 	// Read message header
-	core.ReadLE(r, &msg.ComponentID)
-	core.ReadLE(r, &msg.PacketID)
+	if err := core.Try(func() {
+		core.ReadLE(r, &msg.ComponentID)
+		core.ReadLE(r, &msg.PacketID)
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read message header: %w", err)
+	}
 
 	// Read remaining data
 	data, err := io.ReadAll(r)
@@ -222,8 +283,63 @@ func (m *DeviceMessage) Serialize() []byte {
 	return buf.Bytes()
 }
 
+// SetHandler replaces the device handler
+func (dm *DeviceManager) SetHandler(handler DeviceHandler) {
+	if handler == nil {
+		handler = NewDefaultDeviceHandler()
+	}
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.handler = handler
+}
+
+// SetTransport attaches the function writing serialized messages on the
+// RDPDR channel. A nil send detaches the channel.
+func (dm *DeviceManager) SetTransport(send func(data []byte) error) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.send = send
+}
+
+// SendMessage writes an arbitrary RDPDR message on the channel
+func (dm *DeviceManager) SendMessage(msg *DeviceMessage) error {
+	if msg == nil {
+		return fmt.Errorf("device message must be non-nil")
+	}
+	dm.mutex.RLock()
+	send := dm.send
+	dm.mutex.RUnlock()
+	if send == nil {
+		return ErrChannelNotOpen
+	}
+	return send(msg.Serialize())
+}
+
+// OnMessage registers fn to be called with every inbound RDPDR message,
+// including those the built-in handlers process
+func (dm *DeviceManager) OnMessage(fn func(*DeviceMessage)) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.listeners = append(dm.listeners, fn)
+}
+
+// OnDeviceReply registers fn to be called, from the goroutine processing
+// messages, with every answer of the server to a device announcement
+func (dm *DeviceManager) OnDeviceReply(fn func(*DeviceReplyAnnounce)) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.replies = append(dm.replies, fn)
+}
+
 // ProcessMessage processes a device message
 func (dm *DeviceManager) ProcessMessage(msg *DeviceMessage) error {
+	dm.mutex.RLock()
+	listeners := dm.listeners
+	dm.mutex.RUnlock()
+	for _, fn := range listeners {
+		fn(msg)
+	}
+
 	switch msg.ComponentID {
 	case RDPDR_CTYP_CORE:
 		return dm.handleCoreMessage(msg)
@@ -237,87 +353,203 @@ func (dm *DeviceManager) ProcessMessage(msg *DeviceMessage) error {
 
 // handleCoreMessage handles core device messages
 func (dm *DeviceManager) handleCoreMessage(msg *DeviceMessage) error {
-	if len(msg.Data) < 2 {
-		return fmt.Errorf("invalid core message size")
-	}
-
 	reader := bytes.NewReader(msg.Data)
-	var messageType CoreMessageType
-	core.ReadLE(reader, &messageType)
-
-	switch messageType {
+	switch CoreMessageType(msg.PacketID) {
+	case PAKID_CORE_SERVER_ANNOUNCE:
+		return dm.handleServerAnnounce(reader)
+	case PAKID_CORE_SERVER_CAPABILITY:
+		return dm.sendCapabilities()
+	case PAKID_CORE_CLIENTID_CONFIRM:
+		return dm.handleClientIDConfirm()
 	case PAKID_CORE_DEVICE_ANNOUNCE:
 		return dm.handleDeviceAnnounce(reader)
+	case PAKID_CORE_DEVICE_REPLY_ANNOUNCE:
+		return dm.handleDeviceReply(reader)
 	case PAKID_CORE_DEVICE_IOREQUEST:
 		return dm.handleDeviceIORequest(reader)
 	default:
-		glog.Debugf("Unhandled core message type: 0x%04X", messageType)
+		glog.Debugf("Unhandled core message type: 0x%04X", msg.PacketID)
 		return nil
 	}
 }
 
 // handlePrinterMessage handles printer messages
 func (dm *DeviceManager) handlePrinterMessage(msg *DeviceMessage) error {
-	if len(msg.Data) < 2 {
-		return fmt.Errorf("invalid printer message size")
-	}
-
-	reader := bytes.NewReader(msg.Data)
-	var messageType PrinterMessageType
-	core.ReadLE(reader, &messageType)
-
-	switch messageType {
+	switch PrinterMessageType(msg.PacketID) {
 	case PAKID_PRN_CACHE_DATA:
-		return dm.handlePrinterData(reader)
+		return dm.handlePrinterData(bytes.NewReader(msg.Data))
 	default:
-		glog.Debugf("Unhandled printer message type: 0x%04X", messageType)
+		glog.Debugf("Unhandled printer message type: 0x%04X", msg.PacketID)
 		return nil
 	}
 }
 
-// handleDeviceAnnounce handles device announcement
-func (dm *DeviceManager) handleDeviceAnnounce(r io.Reader) error {
-	if len(dm.devices) >= 10 { // Limit number of devices
-		return fmt.Errorf("too many devices")
+// sendCore sends the core message of packetID with the body data
+func (dm *DeviceManager) sendCore(packetID CoreMessageType, data []byte) error {
+	return dm.SendMessage(&DeviceMessage{
+		ComponentID: RDPDR_CTYP_CORE,
+		PacketID:    uint16(packetID),
+		Data:        data,
+	})
+}
+
+// handleServerAnnounce answers the Server Announce Request, which sets up
+// the channel, with the Client Announce Reply and the Client Name Request.
+// Devices are announced again once the server confirms the client id.
+// See [MS-RDPEFS] 2.2.2.2 to 2.2.2.4
+func (dm *DeviceManager) handleServerAnnounce(r io.Reader) error {
+	var versionMajor, versionMinor uint16
+	var clientID uint32
+	if err := core.Try(func() {
+		core.ReadLE(r, &versionMajor)
+		core.ReadLE(r, &versionMinor)
+		core.ReadLE(r, &clientID)
+	}); err != nil {
+		return fmt.Errorf("invalid server announce: %w", err)
 	}
+	dm.mutex.Lock()
+	dm.ready = false
+	dm.mutex.Unlock()
 
-	device := &DeviceAnnounce{}
-	core.ReadLE(r, &device.DeviceType)
-	core.ReadLE(r, &device.DeviceID)
+	reply := new(bytes.Buffer)
+	core.WriteLE(reply, uint16(rdpdrVersionMajor))
+	core.WriteLE(reply, uint16(rdpdrVersionMinor))
+	core.WriteLE(reply, clientID)
+	if err := dm.sendCore(PAKID_CORE_CLIENTID_CONFIRM, reply.Bytes()); err != nil {
+		return err
+	}
 
-	// Read preferred DOS name (8 characters)
-	dosNameBytes := make([]byte, 8)
-	r.Read(dosNameBytes)
-	device.PreferredDosName = string(bytes.TrimRight(dosNameBytes, "\x00"))
+	// the computer name of the client, as in its core data
+	hostname, _ := os.Hostname()
+	computerName := append(core.UnicodeEncode(hostname), 0, 0)
+	name := new(bytes.Buffer)
+	core.WriteLE(name, uint32(1)) // UnicodeFlag
+	core.WriteLE(name, uint32(0)) // CodePage
+	core.WriteLE(name, uint32(len(computerName)))
+	name.Write(computerName)
+	return dm.sendCore(PAKID_CORE_CLIENT_NAME, name.Bytes())
+}
 
-	// Read device data
-	deviceData, err := io.ReadAll(r)
-	if err != nil {
-		return fmt.Errorf("failed to read device data: %w", err)
+// sendCapabilities answers the Server Core Capability Request with the
+// general capabilities of the client, and those of each type of device,
+// which have no more than a header
+// See [MS-RDPEFS] 2.2.2.8
+func (dm *DeviceManager) sendCapabilities() error {
+	buf := new(bytes.Buffer)
+	core.WriteLE(buf, uint16(5)) // numCapabilities
+	core.WriteLE(buf, uint16(0)) // Padding
+
+	// GENERAL_CAPS_SET
+	core.WriteLE(buf, uint16(CAP_GENERAL_TYPE))
+	core.WriteLE(buf, uint16(generalCapabilityLength))
+	core.WriteLE(buf, uint32(GENERAL_CAPABILITY_VERSION_02))
+	core.WriteLE(buf, uint32(0)) // osType, ignored
+	core.WriteLE(buf, uint32(0)) // osVersion, ignored
+	core.WriteLE(buf, uint16(rdpdrVersionMajor))
+	core.WriteLE(buf, uint16(rdpdrVersionMinor))
+	core.WriteLE(buf, uint32(0x0000FFFF)) // ioCode1, every I/O request
+	core.WriteLE(buf, uint32(0))          // ioCode2
+	core.WriteLE(buf, uint32(RDPDR_DEVICE_REMOVE_PDUS))
+	core.WriteLE(buf, uint32(0)) // extraFlags1
+	core.WriteLE(buf, uint32(0)) // extraFlags2
+	core.WriteLE(buf, uint32(0)) // SpecialTypeDeviceCap
+
+	for _, capabilityType := range []uint16{CAP_PRINTER_TYPE, CAP_PORT_TYPE, CAP_DRIVE_TYPE, CAP_SMARTCARD_TYPE} {
+		core.WriteLE(buf, capabilityType)
+		core.WriteLE(buf, uint16(8)) // CapabilityLength
+		core.WriteLE(buf, uint32(1)) // Version
 	}
-	device.DeviceData = string(deviceData)
+	return dm.sendCore(PAKID_CORE_CLIENT_CAPABILITY, buf.Bytes())
+}
 
+// handleClientIDConfirm ends setting up the channel: the devices added so
+// far are announced, and those added later as they are
+func (dm *DeviceManager) handleClientIDConfirm() error {
 	dm.mutex.Lock()
-	dm.devices[device.DeviceID] = device
+	dm.ready = true
+	devices := make([]*DeviceAnnounce, 0, len(dm.local))
+	for id := range dm.local {
+		devices = append(devices, dm.devices[id])
+	}
 	dm.mutex.Unlock()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+	return dm.SendMessage(newDeviceListAnnounce(devices))
+}
 
-	glog.GetStructuredLogger().InfoStructured("Device announced", map[string]interface{}{
-		"device_type": device.DeviceType,
-		"device_id":   device.DeviceID,
-		"dos_name":    device.PreferredDosName,
-	})
+// handleDeviceAnnounce handles a device list announcement
+func (dm *DeviceManager) handleDeviceAnnounce(r io.Reader) error {
+	var devices []*DeviceAnnounce
+	if err := core.Try(func() {
+		var count uint32
+		core.ReadLE(r, &count)
+		for i := uint32(0); i < count; i++ {
+			device := &DeviceAnnounce{}
+			core.ReadLE(r, &device.DeviceType)
+			core.ReadLE(r, &device.DeviceID)
+			dosName, _, _ := bytes.Cut(core.ReadBytes(r, dosNameLength), []byte{0})
+			device.PreferredDosName = string(dosName)
+			var length uint32
+			core.ReadLE(r, &length)
+			device.DeviceData = string(core.ReadBytes(r, int(length)))
+			devices = append(devices, device)
+		}
+	}); err != nil {
+		return fmt.Errorf("invalid device announce: %w", err)
+	}
 
-	return dm.handler.OnDeviceAnnounce(device)
+	for _, device := range devices {
+		dm.mutex.Lock()
+		if len(dm.devices) >= 10 { // Limit number of devices
+			dm.mutex.Unlock()
+			return fmt.Errorf("too many devices")
+		}
+		dm.devices[device.DeviceID] = device
+		dm.mutex.Unlock()
+
+		glog.GetStructuredLogger().InfoStructured("Device announced", map[string]interface{}{
+			"device_type": device.DeviceType,
+			"device_id":   device.DeviceID,
+			"dos_name":    device.PreferredDosName,
+		})
+		if err := dm.handler.OnDeviceAnnounce(device); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleDeviceReply passes the answer of the server to a device
+// announcement on to the OnDeviceReply listeners
+func (dm *DeviceManager) handleDeviceReply(r io.Reader) error {
+	reply := &DeviceReplyAnnounce{}
+	if err := core.Try(func() {
+		core.ReadLE(r, &reply.DeviceID)
+		core.ReadLE(r, &reply.ResultCode)
+	}); err != nil {
+		return fmt.Errorf("invalid device reply: %w", err)
+	}
+
+	dm.mutex.RLock()
+	replies := dm.replies
+	dm.mutex.RUnlock()
+	for _, fn := range replies {
+		fn(reply)
+	}
+	return nil
 }
 
 // handleDeviceIORequest handles device I/O request
 func (dm *DeviceManager) handleDeviceIORequest(r io.Reader) error {
 	request := &DeviceIORequest{}
-	core.ReadLE(r, &request.DeviceID)
-	core.ReadLE(r, &request.FileID)
-	core.ReadLE(r, &request.CompletionID)
-	core.ReadLE(r, &request.MajorFunction)
-	core.ReadLE(r, &request.MinorFunction)
+	if err := core.Try(func() {
+		core.ReadLE(r, &request.DeviceID)
+		core.ReadLE(r, &request.FileID)
+		core.ReadLE(r, &request.CompletionID)
+		core.ReadLE(r, &request.MajorFunction)
+		core.ReadLE(r, &request.MinorFunction)
+	}); err != nil {
+		return fmt.Errorf("invalid device I/O request: %w", err)
+	}
 
 	// Read request data
 	data, err := io.ReadAll(r)
@@ -335,7 +567,10 @@ func (dm *DeviceManager) handleDeviceIORequest(r io.Reader) error {
 		"data_size":      len(request.Data),
 	})
 
-	completion, err := dm.handler.OnDeviceIORequest(request)
+	dm.mutex.RLock()
+	handler := dm.handler
+	dm.mutex.RUnlock()
+	completion, err := handler.OnDeviceIORequest(request)
 	if err != nil {
 		glog.GetStructuredLogger().ErrorStructured("Device I/O request failed", err, map[string]interface{}{
 			"device_id": request.DeviceID,
@@ -344,15 +579,26 @@ func (dm *DeviceManager) handleDeviceIORequest(r io.Reader) error {
 		return err
 	}
 
-	// Send completion response
-	return dm.sendIOCompletion(completion)
+	// A handler without a completion yet sends it later with
+	// SendIOCompletion
+	if completion == nil {
+		return nil
+	}
+	if err := dm.SendIOCompletion(completion); err != nil && !errors.Is(err, ErrChannelNotOpen) {
+		return err
+	}
+	return nil
 }
 
 // handlePrinterData handles printer data
 func (dm *DeviceManager) handlePrinterData(r io.Reader) error {
 	data := &PrinterData{}
-	core.ReadLE(r, &data.JobID)
-	core.ReadLE(r, &data.Flags)
+	if err := core.Try(func() {
+		core.ReadLE(r, &data.JobID)
+		core.ReadLE(r, &data.Flags)
+	}); err != nil {
+		return fmt.Errorf("invalid printer data: %w", err)
+	}
 
 	// Read printer data
 	printerData, err := io.ReadAll(r)
@@ -370,10 +616,10 @@ func (dm *DeviceManager) handlePrinterData(r io.Reader) error {
 	return dm.handler.OnPrinterData(data)
 }
 
-// sendIOCompletion sends an I/O completion response
-func (dm *DeviceManager) sendIOCompletion(completion *DeviceIOCompletion) error {
+// SendIOCompletion sends the response to a device I/O request, e.g. one
+// its handler completes after returning from OnDeviceIORequest
+func (dm *DeviceManager) SendIOCompletion(completion *DeviceIOCompletion) error {
 	buf := new(bytes.Buffer)
-	core.WriteLE(buf, uint16(PAKID_CORE_DEVICE_IOCOMPLETION))
 	core.WriteLE(buf, completion.DeviceID)
 	core.WriteLE(buf, completion.CompletionID)
 	core.WriteLE(buf, completion.IoStatus)
@@ -381,35 +627,42 @@ func (dm *DeviceManager) sendIOCompletion(completion *DeviceIOCompletion) error
 		buf.Write(completion.Data)
 	}
 
-	// In a real implementation, this would be sent through the virtual channel
 	glog.Debugf("I/O completion: device=%d, completion=%d, status=0x%08X",
 		completion.DeviceID, completion.CompletionID, completion.IoStatus)
 
-	return nil
+	return dm.sendCore(PAKID_CORE_DEVICE_IOCOMPLETION, buf.Bytes())
 }
 
-// CreateDeviceAnnounceMessage creates a device announcement message
+// CreateDeviceAnnounceMessage creates a device list announcement of a
+// device, giving it the next device id
 func (dm *DeviceManager) CreateDeviceAnnounceMessage(deviceType DeviceType, preferredDosName, deviceData string) *DeviceMessage {
 	dm.mutex.Lock()
-	deviceID := dm.nextID
+	device := &DeviceAnnounce{
+		DeviceType:       deviceType,
+		DeviceID:         dm.nextID,
+		PreferredDosName: preferredDosName,
+		DeviceData:       deviceData,
+	}
 	dm.nextID++
 	dm.mutex.Unlock()
+	return newDeviceListAnnounce([]*DeviceAnnounce{device})
+}
 
+// newDeviceListAnnounce creates the Client Device List Announce of devices.
+// Their PreferredDosName is cut to the 7 characters that fit.
+// See [MS-RDPEFS] 2.2.2.9 and 2.2.1.3
+func newDeviceListAnnounce(devices []*DeviceAnnounce) *DeviceMessage {
 	buf := new(bytes.Buffer)
-	core.WriteLE(buf, uint16(PAKID_CORE_DEVICE_ANNOUNCE))
-	core.WriteLE(buf, deviceType)
-	core.WriteLE(buf, deviceID)
-
-	// Write DOS name (8 characters, padded with nulls)
-	dosNameBytes := make([]byte, 8)
-	copy(dosNameBytes, []byte(preferredDosName))
-	buf.Write(dosNameBytes)
-
-	// Write device data
-	if len(deviceData) > 0 {
-		buf.Write([]byte(deviceData))
+	core.WriteLE(buf, uint32(len(devices))) // DeviceCount
+	for _, device := range devices {
+		core.WriteLE(buf, device.DeviceType)
+		core.WriteLE(buf, device.DeviceID)
+		dosName := make([]byte, dosNameLength)
+		copy(dosName[:dosNameLength-1], device.PreferredDosName)
+		buf.Write(dosName)
+		core.WriteLE(buf, uint32(len(device.DeviceData))) // DeviceDataLength
+		buf.WriteString(device.DeviceData)
 	}
-
 	return &DeviceMessage{
 		ComponentID: RDPDR_CTYP_CORE,
 		PacketID:    uint16(PAKID_CORE_DEVICE_ANNOUNCE),
@@ -417,10 +670,70 @@ func (dm *DeviceManager) CreateDeviceAnnounceMessage(deviceType DeviceType, pref
 	}
 }
 
+// keepDevice gives device the next device id and keeps it in the list of
+// devices to announce, returning whether the channel is set up to announce
+// it now. dm.mutex is held.
+func (dm *DeviceManager) keepDevice(device *DeviceAnnounce) bool {
+	device.DeviceID = dm.nextID
+	dm.nextID++
+	dm.devices[device.DeviceID] = device
+	dm.local[device.DeviceID] = true
+	return dm.ready
+}
+
+// announceDevice announces device kept by keepDevice, if ready
+func (dm *DeviceManager) announceDevice(device *DeviceAnnounce, ready bool) error {
+	if !ready {
+		return nil
+	}
+	return dm.SendMessage(newDeviceListAnnounce([]*DeviceAnnounce{device}))
+}
+
+// AddDevice redirects a device, e.g. one plugged in while connected, giving
+// it the next device id, and keeps it in the list of devices. Its DeviceID
+// is set to that id. It is announced to the server once the channel is set
+// up, at once if it is, and the server answers with a DeviceReplyAnnounce
+// of it.
+func (dm *DeviceManager) AddDevice(device *DeviceAnnounce) error {
+	if device == nil {
+		return fmt.Errorf("device must be non-nil")
+	}
+	dm.mutex.Lock()
+	ready := dm.keepDevice(device)
+	dm.mutex.Unlock()
+	return dm.announceDevice(device, ready)
+}
+
+// WithdrawDevice tells the server devices announced before are gone, e.g.
+// unplugged, with a Client Drive Device List Remove, and removes them from
+// the list of devices
+// See [MS-RDPEFS] 2.2.3.2
+func (dm *DeviceManager) WithdrawDevice(deviceIDs ...uint32) error {
+	if len(deviceIDs) == 0 {
+		return nil
+	}
+	dm.mutex.RLock()
+	ready := dm.ready
+	dm.mutex.RUnlock()
+	if ready {
+		buf := new(bytes.Buffer)
+		core.WriteLE(buf, uint32(len(deviceIDs))) // DeviceCount
+		for _, deviceID := range deviceIDs {
+			core.WriteLE(buf, deviceID)
+		}
+		if err := dm.sendCore(PAKID_CORE_DEVICE_REMOVE, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	for _, deviceID := range deviceIDs {
+		dm.RemoveDevice(deviceID)
+	}
+	return nil
+}
+
 // CreatePrinterDataMessage creates a printer data message
 func (dm *DeviceManager) CreatePrinterDataMessage(jobID uint32, data []byte, flags uint32) *DeviceMessage {
 	buf := new(bytes.Buffer)
-	core.WriteLE(buf, uint16(PAKID_PRN_CACHE_DATA))
 	core.WriteLE(buf, jobID)
 	core.WriteLE(buf, flags)
 	buf.Write(data)
@@ -457,6 +770,7 @@ func (dm *DeviceManager) RemoveDevice(deviceID uint32) {
 	dm.mutex.Lock()
 	defer dm.mutex.Unlock()
 	delete(dm.devices, deviceID)
+	delete(dm.local, deviceID)
 }
 
 // GetDeviceCount returns the number of registered devices
@@ -3,6 +3,7 @@ package device
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"testing"
 
 	"github.com/kdsmith18542/gordp/core"
@@ -139,7 +140,6 @@ func TestDeviceIORequest(t *testing.T) {
 
 	// Create I/O request message
 	buf := new(bytes.Buffer)
-	core.WriteLE(buf, uint16(PAKID_CORE_DEVICE_IOREQUEST))
 	core.WriteLE(buf, uint32(1))        // Device ID
 	core.WriteLE(buf, uint32(1))        // File ID
 	core.WriteLE(buf, uint32(1))        // Completion ID
@@ -183,7 +183,6 @@ func TestCustomDeviceHandler(t *testing.T) {
 
 	// Test I/O request
 	buf := new(bytes.Buffer)
-	core.WriteLE(buf, uint16(PAKID_CORE_DEVICE_IOREQUEST))
 	core.WriteLE(buf, uint32(1))        // Device ID
 	core.WriteLE(buf, uint32(1))        // File ID
 	core.WriteLE(buf, uint32(1))        // Completion ID
@@ -306,6 +305,171 @@ func TestDeviceRemoval(t *testing.T) {
 	}
 }
 
+// recordTransport makes dm send its messages to the returned slice
+func recordTransport(dm *DeviceManager) *[]*DeviceMessage {
+	sent := new([]*DeviceMessage)
+	dm.SetTransport(func(data []byte) error {
+		msg, err := ReadDeviceMessage(bytes.NewReader(data))
+		*sent = append(*sent, msg)
+		return err
+	})
+	return sent
+}
+
+// coreMessage is the core message of packetID with body data
+func coreMessage(packetID CoreMessageType, data []byte) *DeviceMessage {
+	return &DeviceMessage{ComponentID: RDPDR_CTYP_CORE, PacketID: uint16(packetID), Data: data}
+}
+
+func TestDeviceChannelSetup(t *testing.T) {
+	dm := NewDeviceManager(nil)
+	printer := &DeviceAnnounce{DeviceType: DeviceTypePrinter, PreferredDosName: "PRINTER1", DeviceData: "xy"}
+	if err := dm.AddDevice(printer); err != nil {
+		t.Fatalf("Failed to add device before connecting: %v", err)
+	}
+	sent := recordTransport(dm)
+
+	// Server Announce Request of client id 3
+	if err := dm.ProcessMessage(coreMessage(PAKID_CORE_SERVER_ANNOUNCE, []byte{0x01, 0x00, 0x0D, 0x00, 0x03, 0x00, 0x00, 0x00})); err != nil {
+		t.Fatalf("Failed to process server announce: %v", err)
+	}
+	if len(*sent) != 2 {
+		t.Fatalf("Expected the announce reply and client name, got %v", *sent)
+	}
+	reply, name := (*sent)[0], (*sent)[1]
+	if reply.PacketID != uint16(PAKID_CORE_CLIENTID_CONFIRM) || !bytes.Equal(reply.Data, []byte{0x01, 0x00, 0x0C, 0x00, 0x03, 0x00, 0x00, 0x00}) {
+		t.Errorf("Client announce reply %04X %x", reply.PacketID, reply.Data)
+	}
+	hostname, _ := os.Hostname()
+	computerName := append(core.UnicodeEncode(hostname), 0, 0)
+	wantName := append([]byte{0x01, 0, 0, 0, 0, 0, 0, 0}, core.ToLE(uint32(len(computerName)))...)
+	if name.PacketID != uint16(PAKID_CORE_CLIENT_NAME) || !bytes.Equal(name.Data, append(wantName, computerName...)) {
+		t.Errorf("Client name request %04X %x", name.PacketID, name.Data)
+	}
+
+	// Server Core Capability Request, with only the general capabilities
+	server := []byte{0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x2C, 0x00, 0x02, 0x00, 0x00, 0x00}
+	if err := dm.ProcessMessage(coreMessage(PAKID_CORE_SERVER_CAPABILITY, append(server, make([]byte, 36)...))); err != nil {
+		t.Fatalf("Failed to process server capabilities: %v", err)
+	}
+	capabilities := (*sent)[2]
+	want := []byte{
+		0x05, 0x00, 0x00, 0x00,
+		0x01, 0x00, 0x2C, 0x00, 0x02, 0x00, 0x00, 0x00, // GENERAL_CAPS_SET
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x00, 0x0C, 0x00,
+		0xFF, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x02, 0x00, 0x08, 0x00, 0x01, 0x00, 0x00, 0x00, // printer
+		0x03, 0x00, 0x08, 0x00, 0x01, 0x00, 0x00, 0x00, // port
+		0x04, 0x00, 0x08, 0x00, 0x01, 0x00, 0x00, 0x00, // drive
+		0x05, 0x00, 0x08, 0x00, 0x01, 0x00, 0x00, 0x00, // smart card
+	}
+	if capabilities.PacketID != uint16(PAKID_CORE_CLIENT_CAPABILITY) || !bytes.Equal(capabilities.Data, want) {
+		t.Errorf("Client core capability response %04X %x", capabilities.PacketID, capabilities.Data)
+	}
+
+	// the devices added so far are announced once the client id is confirmed
+	if err := dm.ProcessMessage(coreMessage(PAKID_CORE_CLIENTID_CONFIRM, []byte{0x01, 0x00, 0x0C, 0x00, 0x03, 0x00, 0x00, 0x00})); err != nil {
+		t.Fatalf("Failed to process client id confirm: %v", err)
+	}
+	announce := (*sent)[3]
+	want = []byte{
+		0x01, 0x00, 0x00, 0x00, // DeviceCount
+		0x04, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		'P', 'R', 'I', 'N', 'T', 'E', 'R', 0x00,
+		0x02, 0x00, 0x00, 0x00, 'x', 'y',
+	}
+	if announce.ComponentID != RDPDR_CTYP_CORE || announce.PacketID != uint16(PAKID_CORE_DEVICE_ANNOUNCE) || !bytes.Equal(announce.Data, want) {
+		t.Errorf("Client device list announce %04X %x", announce.PacketID, announce.Data)
+	}
+	if got := (&DeviceMessage{ComponentID: RDPDR_CTYP_CORE, PacketID: uint16(PAKID_CORE_DEVICE_ANNOUNCE)}).Serialize(); !bytes.Equal(got, []byte{0x72, 0x44, 0x41, 0x44}) {
+		t.Errorf("RDPDR_HEADER %x", got)
+	}
+}
+
+func TestDeviceHotplug(t *testing.T) {
+	dm := NewDeviceManager(nil)
+	sent := recordTransport(dm)
+	var replies []*DeviceReplyAnnounce
+	dm.OnDeviceReply(func(reply *DeviceReplyAnnounce) {
+		replies = append(replies, reply)
+	})
+	if err := dm.ProcessMessage(coreMessage(PAKID_CORE_CLIENTID_CONFIRM, nil)); err != nil {
+		t.Fatalf("Failed to process client id confirm: %v", err)
+	}
+	*sent = nil
+
+	usb := &DeviceAnnounce{DeviceType: DeviceTypeDrive, PreferredDosName: "USB"}
+	if err := dm.AddDevice(usb); err != nil {
+		t.Fatalf("Failed to add device: %v", err)
+	}
+	if len(*sent) != 1 || (*sent)[0].PacketID != uint16(PAKID_CORE_DEVICE_ANNOUNCE) || !bytes.Equal((*sent)[0].Data[:12], []byte{1, 0, 0, 0, 8, 0, 0, 0, 1, 0, 0, 0}) {
+		t.Fatalf("Expected a device announcement, got %v", *sent)
+	}
+	if _, exists := dm.GetDevice(usb.DeviceID); !exists {
+		t.Error("Added device not listed")
+	}
+
+	// the server takes the device
+	reply := new(bytes.Buffer)
+	core.WriteLE(reply, usb.DeviceID)
+	core.WriteLE(reply, uint32(STATUS_SUCCESS))
+	if err := dm.ProcessMessage(coreMessage(PAKID_CORE_DEVICE_REPLY_ANNOUNCE, reply.Bytes())); err != nil {
+		t.Fatalf("Failed to process reply: %v", err)
+	}
+	if len(replies) != 1 || replies[0].DeviceID != usb.DeviceID || replies[0].ResultCode != STATUS_SUCCESS {
+		t.Errorf("Expected the reply of device %d, got %v", usb.DeviceID, replies)
+	}
+	if err := dm.ProcessMessage(coreMessage(PAKID_CORE_DEVICE_REPLY_ANNOUNCE, reply.Bytes()[:4])); err == nil {
+		t.Error("Expected an error for a short reply")
+	}
+
+	if err := dm.WithdrawDevice(usb.DeviceID); err != nil {
+		t.Fatalf("Failed to remove device: %v", err)
+	}
+	want := append(core.ToLE(uint32(1)), core.ToLE(usb.DeviceID)...)
+	if len(*sent) != 2 || (*sent)[1].PacketID != uint16(PAKID_CORE_DEVICE_REMOVE) || !bytes.Equal((*sent)[1].Data, want) {
+		t.Errorf("Expected a device removal %x, got %v", want, *sent)
+	}
+	if dm.GetDeviceCount() != 0 {
+		t.Errorf("Expected 0 devices after removal, got %d", dm.GetDeviceCount())
+	}
+	if got := (*sent)[1].Serialize(); !bytes.Equal(got[:4], []byte{0x72, 0x44, 0x4D, 0x44}) {
+		t.Errorf("Device list remove header %x", got[:4])
+	}
+
+	// several devices go in one removal
+	dm.AddDevice(&DeviceAnnounce{DeviceType: DeviceTypeDrive, PreferredDosName: "E:"})
+	dm.AddDevice(&DeviceAnnounce{DeviceType: DeviceTypeDrive, PreferredDosName: "F:"})
+	*sent = nil
+	if err := dm.WithdrawDevice(2, 3); err != nil {
+		t.Fatalf("Failed to remove devices: %v", err)
+	}
+	if len(*sent) != 1 || !bytes.Equal((*sent)[0].Data, []byte{2, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0}) {
+		t.Errorf("Expected a removal of devices 2 and 3, got %v", *sent)
+	}
+	if dm.GetDeviceCount() != 0 {
+		t.Errorf("Expected 0 devices after removal, got %d", dm.GetDeviceCount())
+	}
+
+	// a server announce sets up the channel again, announcing the devices
+	// again once it confirms the client id
+	if err := dm.AddDevice(usb); err != nil {
+		t.Fatalf("Failed to add device: %v", err)
+	}
+	dm.ProcessMessage(coreMessage(PAKID_CORE_SERVER_ANNOUNCE, []byte{0x01, 0x00, 0x0C, 0x00, 0x04, 0x00, 0x00, 0x00}))
+	*sent = nil
+	if err := dm.AddDevice(&DeviceAnnounce{DeviceType: DeviceTypeDrive, PreferredDosName: "USB2"}); err != nil || len(*sent) != 0 {
+		t.Errorf("Expected the device to wait for the channel, got %v, %v", err, *sent)
+	}
+	dm.ProcessMessage(coreMessage(PAKID_CORE_CLIENTID_CONFIRM, nil))
+	if len(*sent) != 1 || !bytes.Equal((*sent)[0].Data[:4], core.ToLE(uint32(2))) {
+		t.Errorf("Expected both devices announced, got %v", *sent)
+	}
+}
+
 func TestDeviceLimit(t *testing.T) {
 	dm := NewDeviceManager(nil)
 
@@ -344,6 +508,26 @@ func TestInvalidMessageHandling(t *testing.T) {
 		t.Error("Expected error for invalid message, but got none")
 	}
 
+	// Test truncated messages of each reader
+	for _, msg := range []*DeviceMessage{
+		{PacketID: uint16(PAKID_CORE_DEVICE_ANNOUNCE), Data: []byte{0x01, 0x00, 0x00, 0x00, 0x04, 0x00}},
+		{PacketID: uint16(PAKID_CORE_DEVICE_ANNOUNCE), Data: []byte{
+			0x01, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+			'D', ':', 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x64, 0x00, 0x00, 0x00, 'a', 'b',
+		}}, // DeviceDataLength beyond the message
+		{PacketID: uint16(PAKID_CORE_DEVICE_IOREQUEST), Data: []byte{0x01, 0x00, 0x00, 0x00, 0x07}},
+		{PacketID: uint16(PAKID_CORE_SERVER_ANNOUNCE), Data: []byte{0x01, 0x00, 0x0C, 0x00}},
+	} {
+		msg.ComponentID = RDPDR_CTYP_CORE
+		if err := dm.ProcessMessage(msg); err == nil {
+			t.Errorf("Expected error for truncated message %x, but got none", msg.Data)
+		}
+	}
+	_, err = ReadDeviceMessage(bytes.NewReader([]byte{0x72, 0x44, 0x6E}))
+	if err == nil {
+		t.Error("Expected error for truncated message header, but got none")
+	}
+
 	// Test unknown component ID
 	unknownMsg := &DeviceMessage{
 		ComponentID: 0x9999, // Unknown component
@@ -397,3 +581,68 @@ func TestMain(m *testing.M) {
 	glog.SetLevel(glog.ERROR)
 	m.Run()
 }
+
+func TestCustomMessageRoundTrip(t *testing.T) {
+	sender := NewDeviceManager(nil)
+	receiver := NewDeviceManager(nil)
+
+	msg := &DeviceMessage{
+		ComponentID: DeviceMessageType(0x4358), // "Cx", not a built-in component
+		PacketID:    0x0042,
+		Data:        []byte{0xDE, 0xAD, 0xBE, 0xEF},
+	}
+
+	if err := sender.SendMessage(msg); err != ErrChannelNotOpen {
+		t.Fatalf("expected ErrChannelNotOpen without a transport, got %v", err)
+	}
+
+	// wire the sender straight into the receiver, as the rdpdr channel would
+	sender.SetTransport(func(data []byte) error {
+		inbound, err := ReadDeviceMessage(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		return receiver.ProcessMessage(inbound)
+	})
+	var received []*DeviceMessage
+	receiver.OnMessage(func(m *DeviceMessage) {
+		received = append(received, m)
+	})
+
+	if err := sender.SendMessage(msg); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if len(received) != 1 {
+		t.Fatalf("expected 1 inbound message, got %d", len(received))
+	}
+	got := received[0]
+	if got.ComponentID != msg.ComponentID || got.PacketID != msg.PacketID || !bytes.Equal(got.Data, msg.Data) {
+		t.Errorf("round trip mismatch: sent %+v, got %+v", msg, got)
+	}
+
+	sender.SetTransport(nil)
+	if err := sender.SendMessage(msg); err != ErrChannelNotOpen {
+		t.Errorf("expected ErrChannelNotOpen after detaching, got %v", err)
+	}
+}
+
+// FuzzProcessMessage checks that no message from the server makes the
+// device readers panic rather than return an error
+func FuzzProcessMessage(f *testing.F) {
+	dm := NewDeviceManager(nil)
+	f.Add(dm.CreateDeviceAnnounceMessage(DeviceTypePrinter, "PRN1", "printer").Serialize())
+	f.Add(dm.CreatePrinterDataMessage(1, []byte("page"), 0).Serialize())
+	request := new(bytes.Buffer)
+	for _, v := range []uint32{1, 7, 1, IRP_MJ_CREATE, 0} {
+		core.WriteLE(request, v)
+	}
+	f.Add((&DeviceMessage{ComponentID: RDPDR_CTYP_CORE, PacketID: uint16(PAKID_CORE_DEVICE_IOREQUEST), Data: request.Bytes()}).Serialize())
+	f.Add([]byte{0x72, 0x44, 0x72, 0x64, 0x00, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ReadDeviceMessage(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		_ = NewDeviceManager(&TestDeviceHandler{}).ProcessMessage(msg)
+	})
+}
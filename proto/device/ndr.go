@@ -0,0 +1,166 @@
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// The calls and returns of smart card redirection are NDR encoded with the
+// type serialization version 1 of MS-RPCE: a common and a private header
+// before the data, which is padded to a multiple of 8 bytes.
+// See [MS-RPCE] 2.2.6
+const (
+	ndrHeaderLength = 16
+	ndrFiller       = 0xCCCCCCCC
+	ndrLittleEndian = 0x10
+)
+
+// ndrReferent is the first referent id of the pointers written by ndrWriter
+const ndrReferent = 0x00020000
+
+// ndrWriter encodes NDR data. Pointers write a referent id in place and
+// their pointees, deferred, at the next flush, in the order of the pointers.
+type ndrWriter struct {
+	buf      bytes.Buffer
+	deferred []func()
+	referent uint32
+}
+
+func (w *ndrWriter) align(n int) {
+	for w.buf.Len()%n != 0 {
+		w.buf.WriteByte(0)
+	}
+}
+
+func (w *ndrWriter) uint32(v uint32) {
+	w.align(4)
+	core.WriteLE(&w.buf, v)
+}
+
+func (w *ndrWriter) raw(b []byte) {
+	w.buf.Write(b)
+}
+
+// pointer writes a unique pointer, null unless present, to what pointee
+// writes later
+func (w *ndrWriter) pointer(present bool, pointee func()) {
+	if !present {
+		w.uint32(0)
+		return
+	}
+	w.uint32(ndrReferent + 4*w.referent)
+	w.referent++
+	w.deferred = append(w.deferred, pointee)
+}
+
+// byteArray writes a conformant array of bytes
+func (w *ndrWriter) byteArray(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.raw(b)
+}
+
+// wideString writes a NUL-terminated conformant varying string of UTF-16
+func (w *ndrWriter) wideString(s string) {
+	units := append(utf16.Encode([]rune(s)), 0)
+	w.uint32(uint32(len(units))) // maximum count
+	w.uint32(0)                  // offset
+	w.uint32(uint32(len(units))) // actual count
+	for _, u := range units {
+		core.WriteLE(&w.buf, u)
+	}
+}
+
+// flush writes the pointees of the pointers written so far, and those of
+// the pointers they write in turn
+func (w *ndrWriter) flush() {
+	for len(w.deferred) > 0 {
+		pointee := w.deferred[0]
+		w.deferred = w.deferred[1:]
+		pointee()
+	}
+}
+
+// Bytes returns the data written, flushed, after the type serialization
+// headers
+func (w *ndrWriter) Bytes() []byte {
+	w.flush()
+	w.align(8)
+	out := new(bytes.Buffer)
+	core.WriteLE(out, uint8(1)) // version
+	core.WriteLE(out, uint8(ndrLittleEndian))
+	core.WriteLE(out, uint16(8)) // common header length
+	core.WriteLE(out, uint32(ndrFiller))
+	core.WriteLE(out, uint32(w.buf.Len())) // object buffer length
+	core.WriteLE(out, uint32(0))           // filler
+	out.Write(w.buf.Bytes())
+	return out.Bytes()
+}
+
+// ndrReader decodes NDR data, throwing on data that ends short
+type ndrReader struct {
+	data []byte
+	pos  int
+}
+
+// newNdrReader reads the data after the type serialization headers of b
+func newNdrReader(b []byte) (*ndrReader, error) {
+	if len(b) < ndrHeaderLength {
+		return nil, fmt.Errorf("ndr data of %d bytes, want at least %d", len(b), ndrHeaderLength)
+	}
+	if b[0] != 1 || b[1] != ndrLittleEndian {
+		return nil, fmt.Errorf("unsupported ndr version %d, endianness 0x%02X", b[0], b[1])
+	}
+	length := binary.LittleEndian.Uint32(b[8:])
+	if uint64(length) > uint64(len(b)-ndrHeaderLength) {
+		return nil, fmt.Errorf("ndr object buffer of %d bytes, have %d", length, len(b)-ndrHeaderLength)
+	}
+	return &ndrReader{data: b[ndrHeaderLength : ndrHeaderLength+int(length)]}, nil
+}
+
+func (r *ndrReader) align(n int) {
+	r.pos += (n - r.pos%n) % n
+}
+
+func (r *ndrReader) raw(n int) []byte {
+	core.ThrowIf(n < 0 || r.pos+n > len(r.data), "ndr data ends short")
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *ndrReader) uint32() uint32 {
+	r.align(4)
+	return binary.LittleEndian.Uint32(r.raw(4))
+}
+
+// pointer reads a referent id, reporting whether the pointer is not null
+func (r *ndrReader) pointer() bool {
+	return r.uint32() != 0
+}
+
+// byteArray reads a conformant array of bytes
+func (r *ndrReader) byteArray() []byte {
+	return r.raw(int(r.uint32()))
+}
+
+// wideString reads a conformant varying string of UTF-16, up to its NUL
+func (r *ndrReader) wideString() string {
+	r.uint32() // maximum count
+	r.uint32() // offset
+	count := int(r.uint32())
+	core.ThrowIf(count < 0 || count > len(r.data), "ndr string too long")
+	b := r.raw(2 * count)
+	units := make([]uint16, 0, count)
+	for i := 0; i < len(b); i += 2 {
+		u := binary.LittleEndian.Uint16(b[i:])
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+	return string(utf16.Decode(units))
+}
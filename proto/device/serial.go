@@ -0,0 +1,564 @@
+package device
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/glog"
+)
+
+// I/O control codes of serial ports
+// See [MS-RDPESP] 2.2.2
+const (
+	IOCTL_SERIAL_SET_BAUD_RATE    = 0x001B0004
+	IOCTL_SERIAL_SET_QUEUE_SIZE   = 0x001B0008
+	IOCTL_SERIAL_SET_LINE_CONTROL = 0x001B000C
+	IOCTL_SERIAL_SET_BREAK_ON     = 0x001B0010
+	IOCTL_SERIAL_SET_BREAK_OFF    = 0x001B0014
+	IOCTL_SERIAL_IMMEDIATE_CHAR   = 0x001B0018
+	IOCTL_SERIAL_SET_TIMEOUTS     = 0x001B001C
+	IOCTL_SERIAL_GET_TIMEOUTS     = 0x001B0020
+	IOCTL_SERIAL_SET_DTR          = 0x001B0024
+	IOCTL_SERIAL_CLR_DTR          = 0x001B0028
+	IOCTL_SERIAL_RESET_DEVICE     = 0x001B002C
+	IOCTL_SERIAL_SET_RTS          = 0x001B0030
+	IOCTL_SERIAL_CLR_RTS          = 0x001B0034
+	IOCTL_SERIAL_SET_XOFF         = 0x001B0038
+	IOCTL_SERIAL_SET_XON          = 0x001B003C
+	IOCTL_SERIAL_GET_WAIT_MASK    = 0x001B0040
+	IOCTL_SERIAL_SET_WAIT_MASK    = 0x001B0044
+	IOCTL_SERIAL_WAIT_ON_MASK     = 0x001B0048
+	IOCTL_SERIAL_PURGE            = 0x001B004C
+	IOCTL_SERIAL_GET_BAUD_RATE    = 0x001B0050
+	IOCTL_SERIAL_GET_LINE_CONTROL = 0x001B0054
+	IOCTL_SERIAL_GET_CHARS        = 0x001B0058
+	IOCTL_SERIAL_SET_CHARS        = 0x001B005C
+	IOCTL_SERIAL_GET_HANDFLOW     = 0x001B0060
+	IOCTL_SERIAL_SET_HANDFLOW     = 0x001B0064
+	IOCTL_SERIAL_GET_MODEMSTATUS  = 0x001B0068
+	IOCTL_SERIAL_GET_COMMSTATUS   = 0x001B006C
+	IOCTL_SERIAL_GET_DTRRTS       = 0x001B0078
+)
+
+// Flags of the serial port I/O controls
+const (
+	SERIAL_EV_RXCHAR     = 0x00000001 // wait mask: a byte was received
+	SERIAL_PURGE_RXCLEAR = 0x00000008 // purge: drop what was received
+	SERIAL_DTR_STATE     = 0x00000001
+	SERIAL_RTS_STATE     = 0x00000002
+	SERIAL_MSR_CTS       = 0x00000010 // modem status: clear to send
+	SERIAL_MSR_DSR       = 0x00000020 // modem status: data set ready
+)
+
+const (
+	// serialInputLimit is how much of what the device sends is kept for
+	// the server to read
+	serialInputLimit = 1 << 20
+
+	// serialPendingWrites is how many writes may wait for the device
+	// before the session loop does
+	serialPendingWrites = 64
+
+	// serialMaxDword is MAXDWORD of the read timeouts
+	serialMaxDword = 0xFFFFFFFF
+
+	// sizes of the I/O control buffers
+	serialLineControlLength = 3
+	serialHandflowLength    = 16
+	serialCharsLength       = 6
+	serialCommStatusLength  = 18
+)
+
+// Line control of IOCTL_SERIAL_SET_LINE_CONTROL
+const (
+	STOP_BIT_1    = 0
+	STOP_BITS_1_5 = 1
+	STOP_BITS_2   = 2
+
+	NO_PARITY    = 0
+	ODD_PARITY   = 1
+	EVEN_PARITY  = 2
+	MARK_PARITY  = 3
+	SPACE_PARITY = 4
+)
+
+// SerialControl sets up the local serial device behind a SerialRedirector,
+// as the server asks, e.g. an adapter to a serial port library
+type SerialControl interface {
+	SetBaudRate(rate uint32) error
+	// SetLineControl sets the data bits, and the parity and stop bits as
+	// the constants above
+	SetLineControl(wordLength, parity, stopBits uint8) error
+	SetDTR(on bool) error
+	SetRTS(on bool) error
+	// ModemStatus returns the modem status register, of SERIAL_MSR_ bits
+	ModemStatus() (uint32, error)
+}
+
+// SerialTimeouts are the timeouts of a serial port, as SERIAL_TIMEOUTS, in
+// milliseconds. Only the read timeouts are kept to.
+type SerialTimeouts struct {
+	ReadIntervalTimeout         uint32
+	ReadTotalTimeoutMultiplier  uint32
+	ReadTotalTimeoutConstant    uint32
+	WriteTotalTimeoutMultiplier uint32
+	WriteTotalTimeoutConstant   uint32
+}
+
+// SerialRedirector redirects a local serial device into the session as a
+// COM port: it is the handler of the I/O requests of the port device it
+// announced, reading and writing the device and setting it up through a
+// SerialControl. What the device sends is buffered from its own goroutine
+// until the server reads it, and reads, writes and waits for events are
+// answered from their own goroutines.
+// See [MS-RDPESP]
+type SerialRedirector struct {
+	port     io.ReadWriteCloser
+	control  SerialControl
+	dm       *DeviceManager
+	deviceID uint32
+	next     DeviceHandler // of the other devices
+
+	writes    chan *DeviceIORequest
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	in       []byte        // received and not yet read
+	readErr  error         // that ended reading the device
+	changed  chan struct{} // closed when the above or the wait mask change
+	waitMask uint32
+	maskGen  int // counts wait masks set, ending waits on the one before
+
+	baudRate    uint32
+	lineControl [serialLineControlLength]byte // StopBits, Parity, WordLength
+	timeouts    SerialTimeouts
+	handflow    [serialHandflowLength]byte
+	chars       [serialCharsLength]byte
+	dtrRts      uint32
+}
+
+// RedirectSerialPort adds a serial port named dosName, e.g. "COM1", to dm,
+// announced on its rdpdr channel as AddDevice does, and makes a redirector
+// of port its handler. Port settings go to control, which may be nil for a
+// device without any. The handler dm had keeps the requests of other
+// devices. Close ends the redirection and closes port.
+func RedirectSerialPort(dm *DeviceManager, dosName string, port io.ReadWriteCloser, control SerialControl) (*SerialRedirector, error) {
+	if port == nil {
+		return nil, fmt.Errorf("serial port must be non-nil")
+	}
+	if dosName == "" || len(dosName) > 7 {
+		return nil, fmt.Errorf("invalid serial port name %q", dosName)
+	}
+	device := &DeviceAnnounce{DeviceType: DeviceTypePort, PreferredDosName: dosName}
+	dm.mutex.Lock()
+	ready := dm.keepDevice(device)
+	r := &SerialRedirector{
+		port:        port,
+		control:     control,
+		dm:          dm,
+		deviceID:    device.DeviceID,
+		next:        dm.handler,
+		writes:      make(chan *DeviceIORequest, serialPendingWrites),
+		done:        make(chan struct{}),
+		changed:     make(chan struct{}),
+		baudRate:    9600,
+		lineControl: [serialLineControlLength]byte{STOP_BIT_1, NO_PARITY, 8},
+	}
+	dm.handler = r
+	dm.mutex.Unlock()
+	go r.receive()
+	go r.writer()
+	return r, dm.announceDevice(device, ready)
+}
+
+// DeviceID returns the id the serial port was announced with
+func (r *SerialRedirector) DeviceID() uint32 {
+	return r.deviceID
+}
+
+// Close ends the requests in progress and closes the port
+func (r *SerialRedirector) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.done)
+		err = r.port.Close()
+	})
+	return err
+}
+
+// OnDeviceAnnounce passes announcements on to the handler of other devices
+func (r *SerialRedirector) OnDeviceAnnounce(device *DeviceAnnounce) error {
+	return r.next.OnDeviceAnnounce(device)
+}
+
+// OnDeviceIORequest answers the requests of the serial port, those that
+// may take long later from their own goroutine
+func (r *SerialRedirector) OnDeviceIORequest(request *DeviceIORequest) (*DeviceIOCompletion, error) {
+	if request.DeviceID != r.deviceID {
+		return r.next.OnDeviceIORequest(request)
+	}
+	completion := &DeviceIOCompletion{
+		DeviceID:     request.DeviceID,
+		CompletionID: request.CompletionID,
+		IoStatus:     STATUS_SUCCESS,
+	}
+	switch request.MajorFunction {
+	case IRP_MJ_CREATE:
+		// DR_CREATE_RSP: the file id and its Information
+		completion.Data = append(core.ToLE(request.FileID), 0)
+	case IRP_MJ_CLOSE:
+		completion.Data = make([]byte, 4) // DR_CLOSE_RSP padding
+	case IRP_MJ_READ:
+		go r.complete(r.read(request))
+		return nil, nil
+	case IRP_MJ_WRITE:
+		select {
+		case r.writes <- request:
+			return nil, nil
+		case <-r.done:
+			completion.IoStatus = STATUS_CANCELLED
+			completion.Data = make([]byte, 5) // DR_WRITE_RSP
+		}
+	case IRP_MJ_DEVICE_CONTROL:
+		return r.deviceControl(request), nil
+	default:
+		completion.IoStatus = STATUS_NOT_SUPPORTED
+	}
+	return completion, nil
+}
+
+// OnPrinterData passes printer data on to the handler of other devices
+func (r *SerialRedirector) OnPrinterData(data *PrinterData) error {
+	return r.next.OnPrinterData(data)
+}
+
+// OnDriveAccess passes drive access on to the handler of other devices
+func (r *SerialRedirector) OnDriveAccess(path string, operation string) error {
+	return r.next.OnDriveAccess(path, operation)
+}
+
+// OnPortAccess passes port access on to the handler of other devices
+func (r *SerialRedirector) OnPortAccess(portName string, operation string) error {
+	return r.next.OnPortAccess(portName, operation)
+}
+
+// complete sends the completion of a request answered later
+func (r *SerialRedirector) complete(completion *DeviceIOCompletion) {
+	if completion == nil {
+		return
+	}
+	if err := r.dm.SendIOCompletion(completion); err != nil {
+		glog.Warnf("serial port: %v", err)
+	}
+}
+
+// notify wakes those waiting for a change; r.mu must be held
+func (r *SerialRedirector) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// receive buffers what the device sends until reading it fails
+func (r *SerialRedirector) receive() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.port.Read(buf)
+		r.mu.Lock()
+		if len(r.in)+n > serialInputLimit {
+			// the server reads too slowly, drop the oldest input as a
+			// device would overrun
+			r.in = r.in[min(len(r.in), len(r.in)+n-serialInputLimit):]
+		}
+		r.in = append(r.in, buf[:n]...)
+		if err != nil {
+			r.readErr = err
+		}
+		r.notify()
+		r.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// read answers a DR_READ_REQ with what was received, waiting for input as
+// the read timeouts say: not at all for ReadIntervalTimeout MAXDWORD and
+// no total timeout, else up to the total timeout, if any, for the first
+// byte.
+// See [MS-RDPEFS] 2.2.1.4.3
+func (r *SerialRedirector) read(request *DeviceIORequest) *DeviceIOCompletion {
+	completion := &DeviceIOCompletion{
+		DeviceID:     request.DeviceID,
+		CompletionID: request.CompletionID,
+		IoStatus:     STATUS_SUCCESS,
+	}
+	var length uint32
+	if err := core.Try(func() { core.ReadLE(bytes.NewReader(request.Data), &length) }); err != nil {
+		completion.IoStatus = STATUS_INVALID_PARAMETER
+		completion.Data = core.ToLE(uint32(0))
+		return completion
+	}
+
+	r.mu.Lock()
+	t := r.timeouts
+	r.mu.Unlock()
+	immediate := t.ReadIntervalTimeout == serialMaxDword && t.ReadTotalTimeoutMultiplier == 0 && t.ReadTotalTimeoutConstant == 0
+	var timeout <-chan time.Time
+	if total := uint64(t.ReadTotalTimeoutMultiplier)*uint64(length) + uint64(t.ReadTotalTimeoutConstant); total > 0 && !immediate {
+		timer := time.NewTimer(time.Duration(total) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var data []byte
+	for {
+		r.mu.Lock()
+		if len(r.in) > 0 || r.readErr != nil || immediate || length == 0 {
+			n := min(int(length), len(r.in))
+			data = append(data, r.in[:n]...)
+			r.in = r.in[n:]
+			if n == 0 && r.readErr != nil {
+				completion.IoStatus = STATUS_UNSUCCESSFUL
+			}
+			r.mu.Unlock()
+			break
+		}
+		changed := r.changed
+		r.mu.Unlock()
+		select {
+		case <-changed:
+			continue
+		case <-timeout:
+		case <-r.done:
+			completion.IoStatus = STATUS_CANCELLED
+		}
+		break
+	}
+	// DR_READ_RSP
+	completion.Data = append(core.ToLE(uint32(len(data))), data...)
+	return completion
+}
+
+// writer writes the DR_WRITE_REQs of the server in order until Close
+func (r *SerialRedirector) writer() {
+	for {
+		select {
+		case request := <-r.writes:
+			r.complete(r.write(request))
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// write answers a DR_WRITE_REQ
+// See [MS-RDPEFS] 2.2.1.4.4
+func (r *SerialRedirector) write(request *DeviceIORequest) *DeviceIOCompletion {
+	completion := &DeviceIOCompletion{
+		DeviceID:     request.DeviceID,
+		CompletionID: request.CompletionID,
+		IoStatus:     STATUS_SUCCESS,
+	}
+	var written int
+	var data []byte
+	if err := core.Try(func() {
+		reader := bytes.NewReader(request.Data)
+		var length uint32
+		core.ReadLE(reader, &length)
+		core.ReadFull(reader, make([]byte, 8+20)) // Offset and padding
+		core.ThrowIf(int64(length) > int64(reader.Len()), "write request ends short")
+		data = core.ReadFull(reader, make([]byte, length))
+	}); err != nil {
+		completion.IoStatus = STATUS_INVALID_PARAMETER
+	} else {
+		var err error
+		if written, err = r.port.Write(data); err != nil {
+			glog.Warnf("serial port: %v", err)
+			completion.IoStatus = STATUS_UNSUCCESSFUL
+		}
+	}
+	// DR_WRITE_RSP: the length written and padding
+	completion.Data = append(core.ToLE(uint32(written)), 0)
+	return completion
+}
+
+// deviceControl answers a DR_CONTROL_REQ of a serial I/O control, those
+// waiting for events later from their own goroutine
+// See [MS-RDPESP] 3.2.5.1
+func (r *SerialRedirector) deviceControl(request *DeviceIORequest) *DeviceIOCompletion {
+	completion := &DeviceIOCompletion{
+		DeviceID:     request.DeviceID,
+		CompletionID: request.CompletionID,
+		IoStatus:     STATUS_SUCCESS,
+	}
+	var ioControlCode uint32
+	var input []byte
+	if err := core.Try(func() {
+		reader := bytes.NewReader(request.Data)
+		var outputLength, inputLength uint32
+		core.ReadLE(reader, &outputLength)
+		core.ReadLE(reader, &inputLength)
+		core.ReadLE(reader, &ioControlCode)
+		core.ReadFull(reader, make([]byte, 20)) // padding
+		core.ThrowIf(int64(inputLength) > int64(reader.Len()), "device control input ends short")
+		input = core.ReadFull(reader, make([]byte, inputLength))
+	}); err != nil {
+		glog.Warnf("serial port: invalid device control request: %v", err)
+		completion.IoStatus = STATUS_INVALID_PARAMETER
+		completion.Data = core.ToLE(uint32(0))
+		return completion
+	}
+	if ioControlCode == IOCTL_SERIAL_WAIT_ON_MASK {
+		go r.complete(r.waitOnMask(completion))
+		return nil
+	}
+
+	var output []byte
+	if err := core.Try(func() {
+		output, completion.IoStatus = r.ioControl(ioControlCode, bytes.NewReader(input))
+	}); err != nil {
+		glog.Warnf("serial port: invalid I/O control 0x%08X: %v", ioControlCode, err)
+		completion.IoStatus = STATUS_INVALID_PARAMETER
+		output = nil
+	}
+	completion.Data = append(core.ToLE(uint32(len(output))), output...)
+	return completion
+}
+
+// ioControl answers the I/O control of ioControlCode with its output and
+// status, throwing on input that ends short
+func (r *SerialRedirector) ioControl(ioControlCode uint32, input *bytes.Reader) ([]byte, uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	var output []byte
+	switch ioControlCode {
+	case IOCTL_SERIAL_SET_BAUD_RATE:
+		var rate uint32
+		core.ReadLE(input, &rate)
+		if err = r.setup(func(c SerialControl) error { return c.SetBaudRate(rate) }); err == nil {
+			r.baudRate = rate
+		}
+	case IOCTL_SERIAL_GET_BAUD_RATE:
+		output = core.ToLE(r.baudRate)
+	case IOCTL_SERIAL_SET_LINE_CONTROL:
+		var lineControl [serialLineControlLength]byte
+		core.ReadFull(input, lineControl[:])
+		stopBits, parity, wordLength := lineControl[0], lineControl[1], lineControl[2]
+		if err = r.setup(func(c SerialControl) error { return c.SetLineControl(wordLength, parity, stopBits) }); err == nil {
+			r.lineControl = lineControl
+		}
+	case IOCTL_SERIAL_GET_LINE_CONTROL:
+		output = append(output, r.lineControl[:]...)
+	case IOCTL_SERIAL_SET_TIMEOUTS:
+		var timeouts SerialTimeouts
+		core.ReadLE(input, &timeouts)
+		r.timeouts = timeouts
+	case IOCTL_SERIAL_GET_TIMEOUTS:
+		output = core.ToLE(r.timeouts)
+	case IOCTL_SERIAL_SET_HANDFLOW:
+		core.ReadFull(input, r.handflow[:])
+	case IOCTL_SERIAL_GET_HANDFLOW:
+		output = append(output, r.handflow[:]...)
+	case IOCTL_SERIAL_SET_CHARS:
+		core.ReadFull(input, r.chars[:])
+	case IOCTL_SERIAL_GET_CHARS:
+		output = append(output, r.chars[:]...)
+	case IOCTL_SERIAL_SET_DTR, IOCTL_SERIAL_CLR_DTR:
+		on := ioControlCode == IOCTL_SERIAL_SET_DTR
+		if err = r.setup(func(c SerialControl) error { return c.SetDTR(on) }); err == nil {
+			r.setDtrRts(SERIAL_DTR_STATE, on)
+		}
+	case IOCTL_SERIAL_SET_RTS, IOCTL_SERIAL_CLR_RTS:
+		on := ioControlCode == IOCTL_SERIAL_SET_RTS
+		if err = r.setup(func(c SerialControl) error { return c.SetRTS(on) }); err == nil {
+			r.setDtrRts(SERIAL_RTS_STATE, on)
+		}
+	case IOCTL_SERIAL_GET_DTRRTS:
+		output = core.ToLE(r.dtrRts)
+	case IOCTL_SERIAL_GET_MODEMSTATUS:
+		status := uint32(SERIAL_MSR_CTS | SERIAL_MSR_DSR) // a device without lines is always ready
+		if r.control != nil {
+			status, err = r.control.ModemStatus()
+		}
+		output = core.ToLE(status)
+	case IOCTL_SERIAL_GET_COMMSTATUS:
+		// SERIAL_STATUS: Errors, HoldReasons, AmountInInQueue,
+		// AmountInOutQueue, EofReceived and WaitForImmediate
+		output = make([]byte, serialCommStatusLength)
+		copy(output[8:], core.ToLE(uint32(len(r.in))))
+	case IOCTL_SERIAL_SET_WAIT_MASK:
+		core.ReadLE(input, &r.waitMask)
+		r.maskGen++
+		r.notify()
+	case IOCTL_SERIAL_GET_WAIT_MASK:
+		output = core.ToLE(r.waitMask)
+	case IOCTL_SERIAL_PURGE:
+		var mask uint32
+		core.ReadLE(input, &mask)
+		if mask&SERIAL_PURGE_RXCLEAR != 0 {
+			r.in = nil
+		}
+	case IOCTL_SERIAL_SET_QUEUE_SIZE, IOCTL_SERIAL_SET_BREAK_ON, IOCTL_SERIAL_SET_BREAK_OFF,
+		IOCTL_SERIAL_IMMEDIATE_CHAR, IOCTL_SERIAL_RESET_DEVICE, IOCTL_SERIAL_SET_XON, IOCTL_SERIAL_SET_XOFF:
+		// nothing to do for a device behind an io.ReadWriteCloser
+	default:
+		return nil, STATUS_NOT_SUPPORTED
+	}
+	if err != nil {
+		glog.Warnf("serial port: I/O control 0x%08X: %v", ioControlCode, err)
+		return nil, STATUS_UNSUCCESSFUL
+	}
+	return output, STATUS_SUCCESS
+}
+
+// setup sets up the device through its control, if it has one
+func (r *SerialRedirector) setup(set func(SerialControl) error) error {
+	if r.control == nil {
+		return nil
+	}
+	return set(r.control)
+}
+
+func (r *SerialRedirector) setDtrRts(state uint32, on bool) {
+	if on {
+		r.dtrRts |= state
+	} else {
+		r.dtrRts &^= state
+	}
+}
+
+// waitOnMask answers IOCTL_SERIAL_WAIT_ON_MASK with the events of the wait
+// mask that happened: SERIAL_EV_RXCHAR once there is input to read, none
+// once the mask is set again or the device can't be read anymore.
+func (r *SerialRedirector) waitOnMask(completion *DeviceIOCompletion) *DeviceIOCompletion {
+	r.mu.Lock()
+	gen := r.maskGen
+	var events uint32
+	for {
+		if r.maskGen != gen || r.readErr != nil {
+			break
+		}
+		if r.waitMask&SERIAL_EV_RXCHAR != 0 && len(r.in) > 0 {
+			events = SERIAL_EV_RXCHAR
+			break
+		}
+		changed := r.changed
+		r.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.done:
+			completion.IoStatus = STATUS_CANCELLED
+			completion.Data = core.ToLE(uint32(0))
+			return completion
+		}
+		r.mu.Lock()
+	}
+	r.mu.Unlock()
+	completion.Data = append(core.ToLE(uint32(4)), core.ToLE(events)...)
+	return completion
+}
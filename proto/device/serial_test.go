@@ -0,0 +1,161 @@
+package device
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// testSerialControl records how the device was set up
+type testSerialControl struct {
+	baudRate                     uint32
+	wordLength, parity, stopBits uint8
+	dtr                          bool
+}
+
+func (c *testSerialControl) SetBaudRate(rate uint32) error {
+	c.baudRate = rate
+	return nil
+}
+
+func (c *testSerialControl) SetLineControl(wordLength, parity, stopBits uint8) error {
+	c.wordLength, c.parity, c.stopBits = wordLength, parity, stopBits
+	return nil
+}
+
+func (c *testSerialControl) SetDTR(on bool) error {
+	c.dtr = on
+	return nil
+}
+
+func (c *testSerialControl) SetRTS(on bool) error {
+	return nil
+}
+
+func (c *testSerialControl) ModemStatus() (uint32, error) {
+	return SERIAL_MSR_CTS, nil
+}
+
+// serialControl makes the I/O control of ioControlCode and returns its
+// status and output
+func (s *smartCardSession) serialControl(deviceID, ioControlCode uint32, input []byte) (uint32, []byte) {
+	s.t.Helper()
+	buf := new(bytes.Buffer)
+	core.WriteLE(buf, uint32(64)) // OutputBufferLength
+	core.WriteLE(buf, uint32(len(input)))
+	core.WriteLE(buf, ioControlCode)
+	buf.Write(make([]byte, 20))
+	buf.Write(input)
+	status, data := s.request(deviceID, IRP_MJ_DEVICE_CONTROL, buf.Bytes())
+	if len(data) < 4 {
+		s.t.Fatalf("I/O control 0x%08X: output of %d bytes", ioControlCode, len(data))
+	}
+	return status, data[4:]
+}
+
+func TestSerialRedirector(t *testing.T) {
+	local, device := net.Pipe()
+	defer local.Close()
+	control := &testSerialControl{}
+	other := &TestDeviceHandler{}
+	s := &smartCardSession{t: t, dm: NewDeviceManager(other), sent: make(chan *DeviceMessage, 4)}
+	s.dm.SetTransport(func(data []byte) error {
+		msg, err := ReadDeviceMessage(bytes.NewReader(data))
+		if err == nil {
+			s.sent <- msg
+		}
+		return err
+	})
+	r, err := RedirectSerialPort(s.dm, "COM3", device, control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// a serial port, RDPDR_DTYP_SERIAL, without device data
+	announce := s.confirm()
+	want := append([]byte{1, 0, 0, 0, 1, 0, 0, 0}, core.ToLE(r.DeviceID())...)
+	if !bytes.Equal(announce.Data, append(want, "COM3\x00\x00\x00\x00\x00\x00\x00\x00"...)) {
+		t.Fatalf("announcement %x", announce.Data)
+	}
+	if _, err := RedirectSerialPort(s.dm, "COMPORT10", device, nil); err == nil {
+		t.Error("a name longer than 7 characters was accepted")
+	}
+
+	if status, data := s.request(r.DeviceID(), IRP_MJ_CREATE, nil); status != STATUS_SUCCESS || !bytes.Equal(data, []byte{7, 0, 0, 0, 0}) {
+		t.Fatalf("create: status 0x%08X, %x", status, data)
+	}
+	s.request(r.DeviceID()+1, IRP_MJ_CREATE, nil)
+	if other.ioRequestCount != 1 {
+		t.Errorf("%d requests reached the other handler, want 1", other.ioRequestCount)
+	}
+
+	// settings reach the control and read back
+	if status, _ := s.serialControl(r.DeviceID(), IOCTL_SERIAL_SET_BAUD_RATE, core.ToLE(uint32(115200))); status != STATUS_SUCCESS || control.baudRate != 115200 {
+		t.Errorf("set baud rate: status 0x%08X, rate %d", status, control.baudRate)
+	}
+	if _, data := s.serialControl(r.DeviceID(), IOCTL_SERIAL_GET_BAUD_RATE, nil); !bytes.Equal(data, core.ToLE(uint32(115200))) {
+		t.Errorf("baud rate %x", data)
+	}
+	s.serialControl(r.DeviceID(), IOCTL_SERIAL_SET_LINE_CONTROL, []byte{STOP_BITS_2, EVEN_PARITY, 7})
+	if control.wordLength != 7 || control.parity != EVEN_PARITY || control.stopBits != STOP_BITS_2 {
+		t.Errorf("line control %d %d %d", control.wordLength, control.parity, control.stopBits)
+	}
+	if _, data := s.serialControl(r.DeviceID(), IOCTL_SERIAL_GET_LINE_CONTROL, nil); !bytes.Equal(data, []byte{STOP_BITS_2, EVEN_PARITY, 7}) {
+		t.Errorf("line control %x", data)
+	}
+	s.serialControl(r.DeviceID(), IOCTL_SERIAL_SET_DTR, nil)
+	if _, data := s.serialControl(r.DeviceID(), IOCTL_SERIAL_GET_DTRRTS, nil); !control.dtr || !bytes.Equal(data, core.ToLE(uint32(SERIAL_DTR_STATE))) {
+		t.Errorf("DTR %v, DTR/RTS state %x", control.dtr, data)
+	}
+	if status, _ := s.serialControl(r.DeviceID(), 0x001B00FF, nil); status != STATUS_NOT_SUPPORTED {
+		t.Errorf("unknown I/O control: status 0x%08X", status)
+	}
+	if status, _ := s.serialControl(r.DeviceID(), IOCTL_SERIAL_SET_BAUD_RATE, []byte{1}); status != STATUS_INVALID_PARAMETER {
+		t.Errorf("short baud rate: status 0x%08X", status)
+	}
+
+	// writes reach the device
+	write := new(bytes.Buffer)
+	core.WriteLE(write, uint32(5))
+	write.Write(make([]byte, 8+20))
+	write.WriteString("hello")
+	received := make(chan []byte, 1)
+	go func() {
+		got := make([]byte, 5)
+		io.ReadFull(local, got)
+		received <- got
+	}()
+	if status, data := s.request(r.DeviceID(), IRP_MJ_WRITE, write.Bytes()); status != STATUS_SUCCESS || !bytes.Equal(data, []byte{5, 0, 0, 0, 0}) {
+		t.Errorf("write: status 0x%08X, %x", status, data)
+	}
+	if got := <-received; string(got) != "hello" {
+		t.Errorf("device received %q", got)
+	}
+
+	// a wait for a byte ends once one arrives, and reads get it
+	s.serialControl(r.DeviceID(), IOCTL_SERIAL_SET_WAIT_MASK, core.ToLE(uint32(SERIAL_EV_RXCHAR)))
+	go local.Write([]byte("ok"))
+	if status, events := s.serialControl(r.DeviceID(), IOCTL_SERIAL_WAIT_ON_MASK, nil); status != STATUS_SUCCESS || !bytes.Equal(events, core.ToLE(uint32(SERIAL_EV_RXCHAR))) {
+		t.Errorf("wait: status 0x%08X, events %x", status, events)
+	}
+	read := new(bytes.Buffer)
+	core.WriteLE(read, uint32(16))
+	read.Write(make([]byte, 8+20))
+	if status, data := s.request(r.DeviceID(), IRP_MJ_READ, read.Bytes()); status != STATUS_SUCCESS || !bytes.Equal(data, append(core.ToLE(uint32(2)), "ok"...)) {
+		t.Errorf("read: status 0x%08X, %x", status, data)
+	}
+
+	// a read with nothing received waits no longer than its timeout
+	timeouts := SerialTimeouts{ReadTotalTimeoutConstant: 10}
+	s.serialControl(r.DeviceID(), IOCTL_SERIAL_SET_TIMEOUTS, core.ToLE(timeouts))
+	if status, data := s.request(r.DeviceID(), IRP_MJ_READ, read.Bytes()); status != STATUS_SUCCESS || !bytes.Equal(data, core.ToLE(uint32(0))) {
+		t.Errorf("timed out read: status 0x%08X, %x", status, data)
+	}
+
+	if status, data := s.request(r.DeviceID(), IRP_MJ_CLOSE, nil); status != STATUS_SUCCESS || len(data) != 4 {
+		t.Errorf("close: status 0x%08X, %x", status, data)
+	}
+}
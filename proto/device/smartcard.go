@@ -0,0 +1,558 @@
+package device
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/glog"
+)
+
+// I/O control codes of the smart card calls redirected
+// See [MS-RDPESC] 3.1.4
+const (
+	SCARD_IOCTL_ESTABLISHCONTEXT   = 0x00090014
+	SCARD_IOCTL_RELEASECONTEXT     = 0x00090018
+	SCARD_IOCTL_ISVALIDCONTEXT     = 0x0009001C
+	SCARD_IOCTL_LISTREADERSW       = 0x0009002C
+	SCARD_IOCTL_GETSTATUSCHANGEW   = 0x000900A4
+	SCARD_IOCTL_CANCEL             = 0x000900A8
+	SCARD_IOCTL_CONNECTW           = 0x000900B0
+	SCARD_IOCTL_DISCONNECT         = 0x000900B8
+	SCARD_IOCTL_BEGINTRANSACTION   = 0x000900BC
+	SCARD_IOCTL_ENDTRANSACTION     = 0x000900C0
+	SCARD_IOCTL_STATUSW            = 0x000900CC
+	SCARD_IOCTL_TRANSMIT           = 0x000900D0
+	SCARD_IOCTL_ACCESSSTARTEDEVENT = 0x000900E0
+)
+
+// SmartCardError is a PC/SC return code. The SmartCard a redirector passes
+// calls on to returns one to have it reach the server as it is; any other
+// error reaches it as SCARD_F_INTERNAL_ERROR.
+type SmartCardError uint32
+
+const (
+	SCARD_F_INTERNAL_ERROR       SmartCardError = 0x80100001
+	SCARD_E_CANCELLED            SmartCardError = 0x80100002
+	SCARD_E_INVALID_HANDLE       SmartCardError = 0x80100003
+	SCARD_E_INVALID_PARAMETER    SmartCardError = 0x80100004
+	SCARD_E_UNKNOWN_READER       SmartCardError = 0x80100009
+	SCARD_E_TIMEOUT              SmartCardError = 0x8010000A
+	SCARD_E_SHARING_VIOLATION    SmartCardError = 0x8010000B
+	SCARD_E_NO_SMARTCARD         SmartCardError = 0x8010000C
+	SCARD_E_NOT_TRANSACTED       SmartCardError = 0x80100016
+	SCARD_E_READER_UNAVAILABLE   SmartCardError = 0x80100017
+	SCARD_E_UNSUPPORTED_FEATURE  SmartCardError = 0x80100022
+	SCARD_E_NO_READERS_AVAILABLE SmartCardError = 0x8010002E
+	SCARD_W_REMOVED_CARD         SmartCardError = 0x80100069
+)
+
+func (e SmartCardError) Error() string {
+	return fmt.Sprintf("smart card error 0x%08X", uint32(e))
+}
+
+// returnCode is the PC/SC return code of err
+func returnCode(err error) uint32 {
+	if err == nil {
+		return 0 // SCARD_S_SUCCESS
+	}
+	var code SmartCardError
+	if errors.As(err, &code) {
+		return uint32(code)
+	}
+	return uint32(SCARD_F_INTERNAL_ERROR)
+}
+
+// ReaderState is the state of a reader, as in SCARD_READERSTATE:
+// CurrentState is what the caller knows, EventState and ATR what
+// GetStatusChange found
+type ReaderState struct {
+	Reader       string
+	CurrentState uint32
+	EventState   uint32
+	ATR          []byte
+}
+
+// CardStatus is the status of a connected card, as SCardStatus returns it
+type CardStatus struct {
+	Reader   string
+	State    uint32
+	Protocol uint32
+	ATR      []byte
+}
+
+// SmartCard is the local PC/SC resource manager the calls of a
+// SmartCardRedirector are passed on to, e.g. an adapter to a PC/SC library.
+// Methods mirror the PC/SC calls of the same names and take their flags
+// and constants, and are called from their own goroutines.
+type SmartCard interface {
+	ListReaders() ([]string, error)
+	// GetStatusChange blocks until the state of a reader differs from
+	// its CurrentState, or the timeout passes; a negative timeout waits
+	// forever. It sets the EventState and ATR of states.
+	GetStatusChange(states []ReaderState, timeout time.Duration) error
+	// Cancel ends the GetStatusChange in progress with SCARD_E_CANCELLED
+	Cancel() error
+	// Connect connects to the card in reader, returning the protocol
+	// in use
+	Connect(reader string, shareMode, preferredProtocols uint32) (Card, uint32, error)
+}
+
+// Card is a connection to a smart card, see SmartCard.Connect
+type Card interface {
+	Status() (*CardStatus, error)
+	// Transmit sends an APDU and returns the response of the card
+	Transmit(command []byte) ([]byte, error)
+	BeginTransaction() error
+	EndTransaction(disposition uint32) error
+	Disconnect(disposition uint32) error
+}
+
+// smartCardInfinite is the timeout that never expires
+const smartCardInfinite = 0xFFFFFFFF
+
+// smartCardATRLength is the size of the ATR arrays of reader states
+const smartCardATRLength = 36
+
+// SmartCardRedirector redirects a local smart card into the session: it is
+// the handler of the I/O requests of the smart card device it announced,
+// passing the PC/SC calls of the server on to a SmartCard. Calls are
+// answered from their own goroutines, as GetStatusChange may block for as
+// long as no card is inserted. Only the Unicode calls are supported, those
+// Windows makes.
+// See [MS-RDPESC]
+type SmartCardRedirector struct {
+	card     SmartCard
+	dm       *DeviceManager
+	deviceID uint32
+	next     DeviceHandler // of the other devices
+
+	mu       sync.Mutex
+	nextID   uint32
+	contexts map[uint32]bool
+	cards    map[uint32]Card
+}
+
+// RedirectSmartCard adds a smart card device to dm, announced on its rdpdr
+// channel as AddDevice does, and makes a redirector of card its handler.
+// The handler dm had keeps the requests of other devices.
+func RedirectSmartCard(dm *DeviceManager, card SmartCard) (*SmartCardRedirector, error) {
+	if card == nil {
+		return nil, fmt.Errorf("smart card must be non-nil")
+	}
+	device := &DeviceAnnounce{DeviceType: DeviceTypeSmartCard, PreferredDosName: "SCARD"}
+	dm.mutex.Lock()
+	ready := dm.keepDevice(device)
+	r := &SmartCardRedirector{
+		card:     card,
+		dm:       dm,
+		deviceID: device.DeviceID,
+		next:     dm.handler,
+		nextID:   1,
+		contexts: make(map[uint32]bool),
+		cards:    make(map[uint32]Card),
+	}
+	dm.handler = r
+	dm.mutex.Unlock()
+	return r, dm.announceDevice(device, ready)
+}
+
+// DeviceID returns the id the smart card device was announced with
+func (r *SmartCardRedirector) DeviceID() uint32 {
+	return r.deviceID
+}
+
+// OnDeviceAnnounce passes announcements on to the handler of other devices
+func (r *SmartCardRedirector) OnDeviceAnnounce(device *DeviceAnnounce) error {
+	return r.next.OnDeviceAnnounce(device)
+}
+
+// OnDeviceIORequest answers the requests of the smart card device, device
+// controls later from their own goroutine
+func (r *SmartCardRedirector) OnDeviceIORequest(request *DeviceIORequest) (*DeviceIOCompletion, error) {
+	if request.DeviceID != r.deviceID {
+		return r.next.OnDeviceIORequest(request)
+	}
+	completion := &DeviceIOCompletion{
+		DeviceID:     request.DeviceID,
+		CompletionID: request.CompletionID,
+		IoStatus:     STATUS_SUCCESS,
+	}
+	switch request.MajorFunction {
+	case IRP_MJ_CREATE:
+		// DR_CREATE_RSP: the file id and its Information
+		completion.Data = append(core.ToLE(request.FileID), 0)
+	case IRP_MJ_CLOSE:
+		completion.Data = make([]byte, 4) // DR_CLOSE_RSP padding
+	case IRP_MJ_DEVICE_CONTROL:
+		go func() {
+			if err := r.dm.SendIOCompletion(r.deviceControl(request)); err != nil {
+				glog.Warnf("smart card: %v", err)
+			}
+		}()
+		return nil, nil
+	default:
+		completion.IoStatus = STATUS_NOT_SUPPORTED
+	}
+	return completion, nil
+}
+
+// OnPrinterData passes printer data on to the handler of other devices
+func (r *SmartCardRedirector) OnPrinterData(data *PrinterData) error {
+	return r.next.OnPrinterData(data)
+}
+
+// OnDriveAccess passes drive access on to the handler of other devices
+func (r *SmartCardRedirector) OnDriveAccess(path string, operation string) error {
+	return r.next.OnDriveAccess(path, operation)
+}
+
+// OnPortAccess passes port access on to the handler of other devices
+func (r *SmartCardRedirector) OnPortAccess(portName string, operation string) error {
+	return r.next.OnPortAccess(portName, operation)
+}
+
+// deviceControl answers a DR_CONTROL_REQ with a DR_CONTROL_RSP, holding
+// the NDR encoded return of the call
+// See [MS-RDPEFS] 2.2.1.4.5 and 2.2.1.5.5
+func (r *SmartCardRedirector) deviceControl(request *DeviceIORequest) *DeviceIOCompletion {
+	completion := &DeviceIOCompletion{
+		DeviceID:     request.DeviceID,
+		CompletionID: request.CompletionID,
+		IoStatus:     STATUS_SUCCESS,
+	}
+	var output []byte
+	err := core.Try(func() {
+		reader := bytes.NewReader(request.Data)
+		var outputLength, inputLength, ioControlCode uint32
+		core.ReadLE(reader, &outputLength)
+		core.ReadLE(reader, &inputLength)
+		core.ReadLE(reader, &ioControlCode)
+		core.ReadFull(reader, make([]byte, 20)) // padding
+		core.ThrowIf(int64(inputLength) > int64(reader.Len()), "device control input ends short")
+		input := make([]byte, inputLength)
+		core.ReadFull(reader, input)
+		call, err := newNdrReader(input)
+		core.ThrowError(err)
+		output = r.call(ioControlCode, call)
+	})
+	var code SmartCardError
+	if errors.As(err, &code) {
+		// a context or handle the call is not valid for
+		ret := &ndrWriter{}
+		ret.uint32(uint32(code))
+		output = ret.Bytes()
+	} else if err != nil {
+		glog.Warnf("smart card: invalid device control request: %v", err)
+		completion.IoStatus = STATUS_INVALID_PARAMETER
+		output = nil
+	}
+	completion.Data = append(core.ToLE(uint32(len(output))), output...)
+	return completion
+}
+
+// call makes the call of ioControlCode and returns its return
+func (r *SmartCardRedirector) call(ioControlCode uint32, call *ndrReader) []byte {
+	ret := &ndrWriter{}
+	switch ioControlCode {
+	case SCARD_IOCTL_ESTABLISHCONTEXT:
+		call.uint32() // dwScope
+		r.mu.Lock()
+		id := r.nextID
+		r.nextID++
+		r.contexts[id] = true
+		r.mu.Unlock()
+		ret.uint32(0)
+		r.writeContext(ret, id)
+	case SCARD_IOCTL_RELEASECONTEXT:
+		id := r.readContext(call)
+		r.mu.Lock()
+		delete(r.contexts, id)
+		r.mu.Unlock()
+		ret.uint32(0)
+	case SCARD_IOCTL_ISVALIDCONTEXT:
+		r.readContext(call)
+		ret.uint32(0)
+	case SCARD_IOCTL_ACCESSSTARTEDEVENT:
+		// Long_Call, the resource manager is always started
+		ret.uint32(0)
+	case SCARD_IOCTL_CANCEL:
+		r.readContext(call)
+		ret.uint32(returnCode(r.card.Cancel()))
+	case SCARD_IOCTL_LISTREADERSW:
+		r.listReaders(call, ret)
+	case SCARD_IOCTL_GETSTATUSCHANGEW:
+		r.getStatusChange(call, ret)
+	case SCARD_IOCTL_CONNECTW:
+		r.connect(call, ret)
+	case SCARD_IOCTL_DISCONNECT, SCARD_IOCTL_BEGINTRANSACTION, SCARD_IOCTL_ENDTRANSACTION:
+		context := readContextID(call)
+		call.uint32() // cbHandle
+		hasHandle := call.pointer()
+		disposition := call.uint32()
+		id, card := r.handle(call, context, hasHandle)
+		var err error
+		switch ioControlCode {
+		case SCARD_IOCTL_DISCONNECT:
+			if err = card.Disconnect(disposition); err == nil {
+				r.mu.Lock()
+				delete(r.cards, id)
+				r.mu.Unlock()
+			}
+		case SCARD_IOCTL_BEGINTRANSACTION:
+			err = card.BeginTransaction()
+		default:
+			err = card.EndTransaction(disposition)
+		}
+		ret.uint32(returnCode(err))
+	case SCARD_IOCTL_STATUSW:
+		r.status(call, ret)
+	case SCARD_IOCTL_TRANSMIT:
+		r.transmit(call, ret)
+	default:
+		glog.Debugf("smart card: unsupported call 0x%08X", ioControlCode)
+		ret.uint32(uint32(SCARD_E_UNSUPPORTED_FEATURE))
+	}
+	return ret.Bytes()
+}
+
+// writeContext writes a REDIR_SCARDCONTEXT of the context id
+func (r *SmartCardRedirector) writeContext(w *ndrWriter, id uint32) {
+	w.uint32(4)
+	w.pointer(true, func() { w.byteArray(core.ToLE(id)) })
+}
+
+// readContextID reads the id of a REDIR_SCARDCONTEXT. Its bytes are
+// deferred, so only after the rest of the call.
+func readContextID(call *ndrReader) func() uint32 {
+	call.uint32() // cbContext
+	if !call.pointer() {
+		return func() uint32 { return 0 }
+	}
+	return func() uint32 { return readID(call.byteArray()) }
+}
+
+// readID reads an id of the redirector from the bytes of a context or
+// handle, 0 if there are not 4 of them
+func readID(b []byte) uint32 {
+	if len(b) != 4 {
+		return 0
+	}
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
+
+// readContext reads a REDIR_SCARDCONTEXT that is all of the call, throwing
+// SCARD_E_INVALID_HANDLE if it is not a context of the redirector
+func (r *SmartCardRedirector) readContext(call *ndrReader) uint32 {
+	id := readContextID(call)()
+	r.checkContext(id)
+	return id
+}
+
+func (r *SmartCardRedirector) checkContext(id uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.contexts[id] {
+		core.ThrowError(SCARD_E_INVALID_HANDLE)
+	}
+}
+
+// multiString encodes names as a multi-string of UTF-16: each NUL
+// terminated, with an empty one at the end
+func multiString(names []string) []byte {
+	var units []uint16
+	for _, name := range names {
+		units = append(append(units, utf16.Encode([]rune(name))...), 0)
+	}
+	units = append(units, 0)
+	b := make([]byte, 0, 2*len(units))
+	for _, u := range units {
+		b = append(b, byte(u), byte(u>>8))
+	}
+	return b
+}
+
+// listReaders makes a ListReaders_Call and writes its ListReaders_Return
+func (r *SmartCardRedirector) listReaders(call *ndrReader, ret *ndrWriter) {
+	context := readContextID(call)
+	call.uint32() // cBytes of mszGroups
+	hasGroups := call.pointer()
+	call.uint32() // fmszReadersIsNULL
+	call.uint32() // cchReaders
+	r.checkContext(context())
+	if hasGroups {
+		call.byteArray()
+	}
+
+	readers, err := r.card.ListReaders()
+	if err == nil && len(readers) == 0 {
+		err = SCARD_E_NO_READERS_AVAILABLE
+	}
+	ret.uint32(returnCode(err))
+	if err != nil {
+		ret.uint32(0)
+		ret.pointer(false, nil)
+		return
+	}
+	names := multiString(readers)
+	ret.uint32(uint32(len(names)))
+	ret.pointer(true, func() { ret.byteArray(names) })
+}
+
+// getStatusChange makes a GetStatusChangeW_Call and writes its
+// GetStatusChange_Return
+func (r *SmartCardRedirector) getStatusChange(call *ndrReader, ret *ndrWriter) {
+	context := readContextID(call)
+	timeout := call.uint32()
+	count := call.uint32()
+	hasStates := call.pointer()
+	r.checkContext(context())
+	var states []ReaderState
+	if hasStates {
+		n := call.uint32()
+		core.ThrowIf(n != count || int(n) > len(call.data)/48, "invalid reader state count")
+		states = make([]ReaderState, n)
+		hasReader := make([]bool, n)
+		for i := range states {
+			hasReader[i] = call.pointer()
+			states[i].CurrentState = call.uint32()
+			states[i].EventState = call.uint32()
+			atrLength := call.uint32()
+			atr := call.raw(smartCardATRLength)
+			states[i].ATR = append([]byte(nil), atr[:min(int(atrLength), smartCardATRLength)]...)
+		}
+		for i := range states {
+			if hasReader[i] {
+				states[i].Reader = call.wideString()
+			}
+		}
+	}
+
+	wait := time.Duration(-1)
+	if timeout != smartCardInfinite {
+		wait = time.Duration(timeout) * time.Millisecond
+	}
+	err := r.card.GetStatusChange(states, wait)
+	ret.uint32(returnCode(err))
+	ret.uint32(uint32(len(states)))
+	ret.pointer(true, func() {
+		ret.uint32(uint32(len(states)))
+		for _, state := range states {
+			ret.uint32(state.CurrentState)
+			ret.uint32(state.EventState)
+			ret.uint32(uint32(min(len(state.ATR), smartCardATRLength)))
+			atr := make([]byte, smartCardATRLength)
+			copy(atr, state.ATR)
+			ret.raw(atr)
+		}
+	})
+}
+
+// connect makes a ConnectW_Call and writes its Connect_Return
+func (r *SmartCardRedirector) connect(call *ndrReader, ret *ndrWriter) {
+	hasReader := call.pointer()
+	context := readContextID(call)
+	shareMode := call.uint32()
+	protocols := call.uint32()
+	var reader string
+	if hasReader {
+		reader = call.wideString()
+	}
+	contextID := context()
+	r.checkContext(contextID)
+
+	card, protocol, err := r.card.Connect(reader, shareMode, protocols)
+	ret.uint32(returnCode(err))
+	if err != nil {
+		card, protocol = nil, 0
+	}
+	var id uint32
+	if card != nil {
+		r.mu.Lock()
+		id = r.nextID
+		r.nextID++
+		r.cards[id] = card
+		r.mu.Unlock()
+	}
+	r.writeContext(ret, contextID)
+	ret.uint32(4)
+	ret.pointer(true, func() { ret.byteArray(core.ToLE(id)) })
+	ret.uint32(protocol)
+}
+
+// status makes a Status_Call and writes its Status_Return
+func (r *SmartCardRedirector) status(call *ndrReader, ret *ndrWriter) {
+	context := readContextID(call)
+	call.uint32() // cbHandle
+	hasHandle := call.pointer()
+	call.uint32() // fmszReaderNamesIsNULL
+	call.uint32() // cchReaderLen
+	call.uint32() // cbAtrLen
+	_, card := r.handle(call, context, hasHandle)
+
+	status, err := card.Status()
+	ret.uint32(returnCode(err))
+	if err != nil {
+		status = &CardStatus{}
+	}
+	names := multiString([]string{status.Reader})
+	ret.uint32(uint32(len(names)))
+	ret.pointer(err == nil, func() { ret.byteArray(names) })
+	ret.uint32(status.State)
+	ret.uint32(status.Protocol)
+	atr := make([]byte, 32)
+	copy(atr, status.ATR)
+	ret.raw(atr)
+	ret.uint32(uint32(min(len(status.ATR), len(atr))))
+}
+
+// transmit makes a Transmit_Call and writes its Transmit_Return
+func (r *SmartCardRedirector) transmit(call *ndrReader, ret *ndrWriter) {
+	context := readContextID(call)
+	call.uint32() // cbHandle
+	hasHandle := call.pointer()
+	call.uint32() // ioSendPci.dwProtocol
+	call.uint32() // ioSendPci.cbExtraBytes
+	hasSendExtra := call.pointer()
+	call.uint32() // cbSendLength
+	hasSend := call.pointer()
+	call.pointer() // pioRecvPci
+	call.uint32()  // fpbRecvBufferIsNULL
+	call.uint32()  // cbRecvLength
+	_, card := r.handle(call, context, hasHandle)
+	if hasSendExtra {
+		call.byteArray()
+	}
+	var command []byte
+	if hasSend {
+		command = call.byteArray()
+	}
+
+	response, err := card.Transmit(command)
+	ret.uint32(returnCode(err))
+	ret.pointer(false, nil) // pioRecvPci
+	ret.uint32(uint32(len(response)))
+	ret.pointer(err == nil, func() { ret.byteArray(response) })
+}
+
+// handle reads the pointees of a REDIR_SCARDHANDLE, which follow the
+// fixed fields of the call, and returns its id and card. It throws
+// SCARD_E_INVALID_HANDLE for unknown ones.
+func (r *SmartCardRedirector) handle(call *ndrReader, context func() uint32, hasHandle bool) (uint32, Card) {
+	r.checkContext(context())
+	if !hasHandle {
+		core.ThrowError(SCARD_E_INVALID_HANDLE)
+	}
+	id := readID(call.byteArray())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	card, ok := r.cards[id]
+	if !ok {
+		core.ThrowError(SCARD_E_INVALID_HANDLE)
+	}
+	return id, card
+}
@@ -0,0 +1,309 @@
+package device
+
+import (
+	"bytes"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// testSmartCard is a reader with a card that answers every APDU with 90 00
+type testSmartCard struct {
+	transmitted [][]byte
+}
+
+var testATR = []byte{0x3B, 0x8F, 0x80, 0x01}
+
+func (c *testSmartCard) ListReaders() ([]string, error) {
+	return []string{"Test Reader 0"}, nil
+}
+
+func (c *testSmartCard) GetStatusChange(states []ReaderState, timeout time.Duration) error {
+	for i := range states {
+		if states[i].Reader != "Test Reader 0" {
+			return SCARD_E_UNKNOWN_READER
+		}
+		states[i].EventState = 0x22 // SCARD_STATE_CHANGED | SCARD_STATE_PRESENT
+		states[i].ATR = testATR
+	}
+	return nil
+}
+
+func (c *testSmartCard) Cancel() error {
+	return nil
+}
+
+func (c *testSmartCard) Connect(reader string, shareMode, preferredProtocols uint32) (Card, uint32, error) {
+	if reader != "Test Reader 0" {
+		return nil, 0, SCARD_E_UNKNOWN_READER
+	}
+	return c, 2, nil // SCARD_PROTOCOL_T1
+}
+
+func (c *testSmartCard) Status() (*CardStatus, error) {
+	return &CardStatus{Reader: "Test Reader 0", State: 6, Protocol: 2, ATR: testATR}, nil
+}
+
+func (c *testSmartCard) Transmit(command []byte) ([]byte, error) {
+	c.transmitted = append(c.transmitted, command)
+	return []byte{0x90, 0x00}, nil
+}
+
+func (c *testSmartCard) BeginTransaction() error                 { return nil }
+func (c *testSmartCard) EndTransaction(disposition uint32) error { return nil }
+func (c *testSmartCard) Disconnect(disposition uint32) error     { return nil }
+
+// smartCardSession sends device controls to a redirector and reads back
+// the returns of the calls
+type smartCardSession struct {
+	t          *testing.T
+	dm         *DeviceManager
+	r          *SmartCardRedirector
+	sent       chan *DeviceMessage
+	completion uint32
+}
+
+func newSmartCardSession(t *testing.T, card SmartCard, next DeviceHandler) *smartCardSession {
+	s := &smartCardSession{t: t, dm: NewDeviceManager(next), sent: make(chan *DeviceMessage, 4)}
+	s.dm.SetTransport(func(data []byte) error {
+		msg, err := ReadDeviceMessage(bytes.NewReader(data))
+		if err == nil {
+			s.sent <- msg
+		}
+		return err
+	})
+	var err error
+	if s.r, err = RedirectSmartCard(s.dm, card); err != nil {
+		t.Fatal(err)
+	}
+	announce := s.confirm()
+	if announce.PacketID != uint16(PAKID_CORE_DEVICE_ANNOUNCE) || !bytes.Equal(announce.Data[:12], append(core.ToLE(uint32(1)), append(core.ToLE(DeviceTypeSmartCard), core.ToLE(s.r.DeviceID())...)...)) {
+		t.Fatalf("announcement %x", announce.Data)
+	}
+	return s
+}
+
+// confirm ends setting up the channel, as the server does with the Server
+// Client ID Confirm, and returns the device list announcement answering it
+func (s *smartCardSession) confirm() *DeviceMessage {
+	s.t.Helper()
+	if err := s.dm.ProcessMessage(&DeviceMessage{
+		ComponentID: RDPDR_CTYP_CORE,
+		PacketID:    uint16(PAKID_CORE_CLIENTID_CONFIRM),
+		Data:        []byte{0x01, 0x00, 0x0C, 0x00, 0x03, 0x00, 0x00, 0x00},
+	}); err != nil {
+		s.t.Fatal(err)
+	}
+	return s.next()
+}
+
+func (s *smartCardSession) next() *DeviceMessage {
+	s.t.Helper()
+	select {
+	case msg := <-s.sent:
+		return msg
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("no message sent")
+		return nil
+	}
+}
+
+// request sends a device I/O request and returns the IoStatus and data of
+// its completion
+func (s *smartCardSession) request(deviceID, major uint32, data []byte) (uint32, []byte) {
+	s.t.Helper()
+	s.completion++
+	buf := new(bytes.Buffer)
+	for _, v := range []uint32{deviceID, 7, s.completion, major, 0} {
+		core.WriteLE(buf, v)
+	}
+	buf.Write(data)
+	if err := s.dm.ProcessMessage(&DeviceMessage{
+		ComponentID: RDPDR_CTYP_CORE,
+		PacketID:    uint16(PAKID_CORE_DEVICE_IOREQUEST),
+		Data:        buf.Bytes(),
+	}); err != nil {
+		s.t.Fatal(err)
+	}
+	msg := s.next()
+	reply := bytes.NewReader(msg.Data)
+	var device, completion, status uint32
+	core.ReadLE(reply, &device)
+	core.ReadLE(reply, &completion)
+	core.ReadLE(reply, &status)
+	if msg.PacketID != uint16(PAKID_CORE_DEVICE_IOCOMPLETION) || device != deviceID || completion != s.completion {
+		s.t.Fatalf("completion %d of device %d, want %d of %d", completion, device, s.completion, deviceID)
+	}
+	rest := make([]byte, reply.Len())
+	reply.Read(rest)
+	return status, rest
+}
+
+// call makes the smart card call of ioControlCode and returns its return,
+// after its return code
+func (s *smartCardSession) call(ioControlCode uint32, call *ndrWriter, wantCode uint32) *ndrReader {
+	s.t.Helper()
+	input := call.Bytes()
+	buf := new(bytes.Buffer)
+	core.WriteLE(buf, uint32(2048)) // OutputBufferLength
+	core.WriteLE(buf, uint32(len(input)))
+	core.WriteLE(buf, ioControlCode)
+	buf.Write(make([]byte, 20))
+	buf.Write(input)
+	status, data := s.request(s.r.DeviceID(), IRP_MJ_DEVICE_CONTROL, buf.Bytes())
+	if status != STATUS_SUCCESS || len(data) < 4 {
+		s.t.Fatalf("call 0x%08X: status 0x%08X", ioControlCode, status)
+	}
+	ret, err := newNdrReader(data[4:])
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if code := ret.uint32(); code != wantCode {
+		s.t.Fatalf("call 0x%08X: return code 0x%08X, want 0x%08X", ioControlCode, code, wantCode)
+	}
+	return ret
+}
+
+func writeTestHandle(w *ndrWriter, context, handle []byte) {
+	w.uint32(uint32(len(context)))
+	w.pointer(true, func() { w.byteArray(context) })
+	w.uint32(uint32(len(handle)))
+	w.pointer(true, func() { w.byteArray(handle) })
+}
+
+func TestSmartCardRedirector(t *testing.T) {
+	card := &testSmartCard{}
+	other := &TestDeviceHandler{}
+	s := newSmartCardSession(t, card, other)
+
+	// the device is opened first, and requests of other devices pass by
+	if status, data := s.request(s.r.DeviceID(), IRP_MJ_CREATE, nil); status != STATUS_SUCCESS || !bytes.Equal(data, []byte{7, 0, 0, 0, 0}) {
+		t.Fatalf("create: status 0x%08X, %x", status, data)
+	}
+	s.request(s.r.DeviceID()+1, IRP_MJ_CREATE, nil)
+	if other.ioRequestCount != 1 {
+		t.Errorf("%d requests reached the other handler, want 1", other.ioRequestCount)
+	}
+
+	call := &ndrWriter{}
+	call.uint32(2) // SCARD_SCOPE_SYSTEM
+	ret := s.call(SCARD_IOCTL_ESTABLISHCONTEXT, call, 0)
+	ret.uint32()
+	ret.pointer()
+	context := append([]byte(nil), ret.byteArray()...)
+
+	call = &ndrWriter{}
+	call.uint32(uint32(len(context)))
+	call.pointer(true, func() { call.byteArray(context) })
+	call.uint32(0)
+	call.pointer(false, nil)
+	call.uint32(0)
+	call.uint32(0xFFFFFFFF) // SCARD_AUTOALLOCATE
+	ret = s.call(SCARD_IOCTL_LISTREADERSW, call, 0)
+	ret.uint32()
+	ret.pointer()
+	readers := ret.byteArray()
+	want := utf16.Encode([]rune("Test Reader 0\x00\x00"))
+	if !bytes.Equal(readers, core.ToLE(want)) {
+		t.Errorf("readers %x", readers)
+	}
+
+	call = &ndrWriter{}
+	call.uint32(uint32(len(context)))
+	call.pointer(true, func() { call.byteArray(context) })
+	call.uint32(0xFFFFFFFF) // INFINITE
+	call.uint32(1)
+	call.pointer(true, func() {
+		call.uint32(1)
+		call.pointer(true, func() { call.wideString("Test Reader 0") })
+		call.uint32(0) // SCARD_STATE_UNAWARE
+		call.uint32(0)
+		call.uint32(0)
+		call.raw(make([]byte, smartCardATRLength))
+	})
+	ret = s.call(SCARD_IOCTL_GETSTATUSCHANGEW, call, 0)
+	if n := ret.uint32(); n != 1 || !ret.pointer() || ret.uint32() != 1 {
+		t.Fatalf("%d reader states", n)
+	}
+	ret.uint32() // dwCurrentState
+	if state, atrLength := ret.uint32(), ret.uint32(); state != 0x22 || !bytes.Equal(ret.raw(smartCardATRLength)[:atrLength], testATR) {
+		t.Errorf("event state 0x%X, ATR of %d bytes", state, atrLength)
+	}
+
+	call = &ndrWriter{}
+	call.pointer(true, func() { call.wideString("Test Reader 0") })
+	call.uint32(uint32(len(context)))
+	call.pointer(true, func() { call.byteArray(context) })
+	call.uint32(2) // SCARD_SHARE_SHARED
+	call.uint32(3) // SCARD_PROTOCOL_T0 | SCARD_PROTOCOL_T1
+	ret = s.call(SCARD_IOCTL_CONNECTW, call, 0)
+	ret.uint32()
+	ret.pointer()
+	ret.uint32()
+	ret.pointer()
+	if protocol := ret.uint32(); protocol != 2 {
+		t.Errorf("active protocol %d, want 2", protocol)
+	}
+	ret.byteArray()
+	handle := append([]byte(nil), ret.byteArray()...)
+
+	transmit := func(handle []byte, wantCode uint32) *ndrReader {
+		call := &ndrWriter{}
+		writeTestHandle(call, context, handle)
+		call.uint32(2) // ioSendPci.dwProtocol
+		call.uint32(0)
+		call.pointer(false, nil)
+		apdu := []byte{0x00, 0xA4, 0x04, 0x00}
+		call.uint32(uint32(len(apdu)))
+		call.pointer(true, func() { call.byteArray(apdu) })
+		call.pointer(false, nil)
+		call.uint32(0)
+		call.uint32(258)
+		return s.call(SCARD_IOCTL_TRANSMIT, call, wantCode)
+	}
+	ret = transmit(handle, 0)
+	ret.pointer()
+	ret.uint32()
+	ret.pointer()
+	if response := ret.byteArray(); !bytes.Equal(response, []byte{0x90, 0x00}) {
+		t.Errorf("response %x", response)
+	}
+	if len(card.transmitted) != 1 || !bytes.Equal(card.transmitted[0], []byte{0x00, 0xA4, 0x04, 0x00}) {
+		t.Errorf("transmitted %x", card.transmitted)
+	}
+	transmit([]byte{0xFF, 0, 0, 0}, uint32(SCARD_E_INVALID_HANDLE))
+
+	call = &ndrWriter{}
+	writeTestHandle(call, context, handle)
+	call.uint32(0) // fmszReaderNamesIsNULL
+	call.uint32(0xFFFFFFFF)
+	call.uint32(32)
+	ret = s.call(SCARD_IOCTL_STATUSW, call, 0)
+	ret.uint32()
+	ret.pointer()
+	if state, protocol := ret.uint32(), ret.uint32(); state != 6 || protocol != 2 {
+		t.Errorf("state %d, protocol %d", state, protocol)
+	}
+	if atr := ret.raw(32); ret.uint32() != uint32(len(testATR)) || !bytes.Equal(atr[:len(testATR)], testATR) {
+		t.Errorf("ATR %x", atr)
+	}
+
+	call = &ndrWriter{}
+	writeTestHandle(call, context, handle)
+	call.uint32(0) // SCARD_LEAVE_CARD
+	s.call(SCARD_IOCTL_DISCONNECT, call, 0)
+	transmit(handle, uint32(SCARD_E_INVALID_HANDLE))
+
+	call = &ndrWriter{}
+	call.uint32(uint32(len(context)))
+	call.pointer(true, func() { call.byteArray(context) })
+	s.call(SCARD_IOCTL_RELEASECONTEXT, call, 0)
+	s.call(SCARD_IOCTL_ISVALIDCONTEXT, call, uint32(SCARD_E_INVALID_HANDLE))
+
+	// a call cut short fails the request
+	if status, _ := s.request(s.r.DeviceID(), IRP_MJ_DEVICE_CONTROL, []byte{1, 2, 3}); status != STATUS_INVALID_PARAMETER {
+		t.Errorf("short request: status 0x%08X", status)
+	}
+}
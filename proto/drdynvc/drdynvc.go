@@ -2,11 +2,15 @@ package drdynvc
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/glog"
+	"github.com/kdsmith18542/gordp/proto/virtualchannel"
 )
 
 // Dynamic Virtual Channel Message Types
@@ -33,6 +37,17 @@ const (
 	DVCCLOSE_FAILED   = 0x00000001
 )
 
+// MaxChunkSize is the most data one data message carries, so that the
+// message fits a static channel chunk of 1600 bytes
+const MaxChunkSize = 1600 - 5
+
+// DefaultMaxMessageSize is the largest message Reassemble accepts
+var DefaultMaxMessageSize = 16 * 1024 * 1024
+
+// ErrMessageTooLarge is returned when the fragments of a message add up to
+// more than DefaultMaxMessageSize
+var ErrMessageTooLarge = errors.New("dynamic virtual channel message too large")
+
 // DynamicVirtualChannelMessage represents a dynamic virtual channel message
 type DynamicVirtualChannelMessage struct {
 	MessageType uint8
@@ -90,6 +105,8 @@ type DynamicVirtualChannelManager struct {
 	Channels      map[uint32]*DynamicVirtualChannel // Exported for enumeration
 	requests      map[uint32]chan interface{}       // Request ID to response channel
 	nextRequestId uint32
+	stats         map[string]*virtualchannel.ChannelStats // by channel name, kept once closed
+	mu            sync.Mutex
 }
 
 // DynamicVirtualChannel represents a dynamic virtual channel
@@ -98,6 +115,10 @@ type DynamicVirtualChannel struct {
 	ChannelName string
 	IsOpen      bool
 	Handler     DynamicVirtualChannelHandler
+
+	// fragments of the message being received
+	pending    []byte
+	assembling bool
 }
 
 // DynamicVirtualChannelHandler handles dynamic virtual channel events
@@ -146,6 +167,7 @@ func NewDynamicVirtualChannelManager() *DynamicVirtualChannelManager {
 		Channels:      make(map[uint32]*DynamicVirtualChannel),
 		requests:      make(map[uint32]chan interface{}),
 		nextRequestId: 1,
+		stats:         make(map[string]*virtualchannel.ChannelStats),
 	}
 }
 
@@ -174,16 +196,168 @@ func (m *DynamicVirtualChannelManager) RegisterChannelWithID(channelId uint32, c
 		channel.Handler = NewDefaultDynamicVirtualChannelHandler()
 	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.Channels[channelId] = channel
+	m.track(channelName)
+	return nil
+}
+
+// RemoveChannel forgets a closed channel
+func (m *DynamicVirtualChannelManager) RemoveChannel(channelId uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.Channels, channelId)
+}
+
+// track starts counting what the channels named name carry, unless it
+// already does
+func (m *DynamicVirtualChannelManager) track(name string) {
+	if _, ok := m.stats[name]; !ok {
+		m.stats[name] = &virtualchannel.ChannelStats{Since: time.Now()}
+	}
+}
+
+// channelStats returns the counts of channel channelId, nil for a channel
+// not registered
+func (m *DynamicVirtualChannelManager) channelStats(channelId uint32) *virtualchannel.ChannelStats {
+	if channel, ok := m.Channels[channelId]; ok {
+		return m.stats[channel.ChannelName]
+	}
 	return nil
 }
 
+// CountSent counts a message of n bytes sent on channel channelId
+func (m *DynamicVirtualChannelManager) CountSent(channelId uint32, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if stats := m.channelStats(channelId); stats != nil {
+		stats.Sent(n)
+	}
+}
+
+// CountReceived counts a fragment of n bytes received on channel
+// channelId, and a message when complete is set or err an error
+func (m *DynamicVirtualChannelManager) CountReceived(channelId uint32, n int, complete bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if stats := m.channelStats(channelId); stats != nil {
+		stats.Received(n, complete)
+		if err != nil {
+			stats.Errors++
+		}
+	}
+}
+
+// CountError counts a message received on channel channelId that its
+// handler failed on
+func (m *DynamicVirtualChannelManager) CountError(channelId uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if stats := m.channelStats(channelId); stats != nil {
+		stats.Errors++
+	}
+}
+
+// Stats returns what the channels carried, by channel name, including
+// channels closed since
+func (m *DynamicVirtualChannelManager) Stats() map[string]virtualchannel.ChannelStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make(map[string]virtualchannel.ChannelStats, len(m.stats))
+	for name, s := range m.stats {
+		stats[name] = *s
+	}
+	return stats
+}
+
+// ResetStats starts counting over, forgetting the channels closed
+func (m *DynamicVirtualChannelManager) ResetStats() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clear(m.stats)
+	for _, channel := range m.Channels {
+		m.track(channel.ChannelName)
+	}
+}
+
 // GetChannel retrieves a dynamic virtual channel by ID
 func (m *DynamicVirtualChannelManager) GetChannel(channelId uint32) (*DynamicVirtualChannel, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	channel, exists := m.Channels[channelId]
 	return channel, exists
 }
 
+// List returns the registered channels
+func (m *DynamicVirtualChannelManager) List() []*DynamicVirtualChannel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	channels := make([]*DynamicVirtualChannel, 0, len(m.Channels))
+	for _, channel := range m.Channels {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// Reassemble collects a message sent as data messages of type typ: one
+// DVCDATA_FIRST_LAST, or DVCDATA_FIRST, any number of DVCDATA and
+// DVCDATA_LAST. The whole message is returned with its last fragment, nil
+// before.
+func (ch *DynamicVirtualChannel) Reassemble(typ uint8, data []byte) ([]byte, error) {
+	switch typ {
+	case DVCDATA_FIRST_LAST:
+		if ch.assembling {
+			glog.Warnf("dynamic virtual channel %s: incomplete message discarded", ch.ChannelName)
+		}
+		ch.pending, ch.assembling = nil, false
+		return data, nil
+	case DVCDATA_FIRST:
+		if ch.assembling {
+			glog.Warnf("dynamic virtual channel %s: incomplete message discarded", ch.ChannelName)
+		}
+		ch.pending, ch.assembling = nil, true
+	case DVCDATA, DVCDATA_LAST:
+		if !ch.assembling {
+			return nil, fmt.Errorf("dynamic virtual channel %s: fragment without a first fragment", ch.ChannelName)
+		}
+	default:
+		return nil, fmt.Errorf("not a data message: %#x", typ)
+	}
+	if len(ch.pending)+len(data) > DefaultMaxMessageSize {
+		ch.pending, ch.assembling = nil, false
+		return nil, fmt.Errorf("%w: %s", ErrMessageTooLarge, ch.ChannelName)
+	}
+	ch.pending = append(ch.pending, data...)
+	if typ != DVCDATA_LAST {
+		return nil, nil
+	}
+	message := ch.pending
+	ch.pending, ch.assembling = nil, false
+	return message, nil
+}
+
+// DataMessages splits data into the data messages sending it on a channel,
+// each carrying at most MaxChunkSize bytes
+func DataMessages(channelId uint32, data []byte) []*DynamicVirtualChannelMessage {
+	var msgs []*DynamicVirtualChannelMessage
+	for pos := 0; pos == 0 || pos < len(data); pos += MaxChunkSize {
+		end := min(pos+MaxChunkSize, len(data))
+		typ := uint8(DVCDATA)
+		switch {
+		case pos == 0 && end == len(data):
+			typ = DVCDATA_FIRST_LAST
+		case pos == 0:
+			typ = DVCDATA_FIRST
+		case end == len(data):
+			typ = DVCDATA_LAST
+		}
+		msg := &DataMessage{ChannelId: channelId, Data: data[pos:end]}
+		msgs = append(msgs, &DynamicVirtualChannelMessage{MessageType: typ, Data: msg.Serialize()})
+	}
+	return msgs
+}
+
 // ReadDynamicVirtualChannelMessage reads a dynamic virtual channel message
 func ReadDynamicVirtualChannelMessage(r io.Reader) (*DynamicVirtualChannelMessage, error) {
 	msg := &DynamicVirtualChannelMessage{}
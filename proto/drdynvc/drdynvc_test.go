@@ -248,6 +248,37 @@ func TestDynamicVirtualChannelManager(t *testing.T) {
 	assert.False(t, exists)
 }
 
+func TestDynamicVirtualChannelManager_Stats(t *testing.T) {
+	manager := NewDynamicVirtualChannelManager()
+	require.NoError(t, manager.RegisterChannelWithID(1, "echo", nil))
+	require.NoError(t, manager.RegisterChannelWithID(2, "telemetry", nil))
+	channel, _ := manager.GetChannel(2)
+
+	manager.CountReceived(1, 4, false, nil)
+	manager.CountReceived(1, 2, true, nil)
+	manager.CountReceived(1, 3, false, ErrMessageTooLarge)
+	manager.CountSent(channel.ChannelId, 8)
+	manager.CountError(channel.ChannelId)
+	manager.CountSent(99, 1) // unknown channels are not counted
+
+	stats := manager.Stats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, uint64(9), stats["echo"].BytesReceived)
+	assert.Equal(t, uint64(1), stats["echo"].MessagesReceived)
+	assert.Equal(t, uint64(1), stats["echo"].Errors)
+	assert.Equal(t, uint64(8), stats["telemetry"].BytesSent)
+	assert.Equal(t, uint64(1), stats["telemetry"].MessagesSent)
+	assert.Equal(t, uint64(1), stats["telemetry"].Errors)
+
+	// closed channels keep their counts until reset
+	manager.RemoveChannel(1)
+	assert.Equal(t, uint64(9), manager.Stats()["echo"].BytesReceived)
+	manager.ResetStats()
+	stats = manager.Stats()
+	assert.NotContains(t, stats, "echo")
+	assert.Zero(t, stats["telemetry"].BytesSent)
+}
+
 func TestDefaultDynamicVirtualChannelHandler(t *testing.T) {
 	handler := NewDefaultDynamicVirtualChannelHandler()
 
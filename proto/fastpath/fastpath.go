@@ -20,6 +20,7 @@ func (h *Header) Read(r io.Reader) {
 	h.NumberEvents = (b & 0x3c) >> 2
 	h.Length = per.ReadLength(r)
 	h.Length = core.If(h.Length < 0x80, h.Length-2, h.Length-3)
+	core.CheckLength("fast-path", h.Length, 0, 0x7FFF)
 }
 
 func (h *Header) Write(w io.Writer) {
@@ -1,6 +1,7 @@
 package ber
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 
@@ -102,13 +103,20 @@ func WriteOctetstring(w io.Writer, str string) {
 	core.WriteFull(w, []byte(str))
 }
 
+func ReadBoolean(r io.Reader) bool {
+	core.ThrowIf(ReadUniversalTag(r, BER_TAG_BOOLEAN, false) == false, "invalid boolean tag")
+	core.ThrowIf(ReadLength(r) != 1, "invalid boolean length")
+	return ReadInteger8(r) != 0
+}
+
+func ReadOctetString(r io.Reader) []byte {
+	core.ThrowIf(ReadUniversalTag(r, BER_TAG_OCTET_STRING, false) == false, "invalid octet string tag")
+	return core.ReadBytes(r, ReadLength(r))
+}
+
 func ReadDomainParameters(r io.Reader) []byte {
 	core.ThrowIf(ReadUniversalTag(r, BER_TAG_SEQUENCE, true) == false, "invalid universal tag")
-	length := ReadLength(r)
-	buff := make([]byte, length)
-	_, err := io.ReadFull(r, buff)
-	core.ThrowError(err)
-	return buff
+	return core.ReadBytes(r, ReadLength(r))
 }
 
 func WriteDomainParameters(w io.Writer, data []byte) {
@@ -177,9 +185,21 @@ func ReadInteger(r io.Reader) int {
 	return 0
 }
 
+func WriteEnumerated(w io.Writer, n uint8) {
+	WriteUniversalTag(w, BER_TAG_ENUMERATED, false)
+	WriteLength(w, 1)
+	core.WriteBE(w, n)
+}
+
 func ReadEnumerated(r io.Reader) uint8 {
 	core.ThrowIf(ReadUniversalTag(r, BER_TAG_ENUMERATED, false) == false, "invalid enumerated tag")
 	length := ReadLength(r)
 	core.ThrowIf(length != 1, fmt.Errorf("invalid length %v, not 1", length))
 	return ReadInteger8(r)
 }
+
+// Decode reads data with read, returning what the readers of this package
+// throw on a malformed BER encoding as an error rather than a panic
+func Decode(data []byte, read func(r io.Reader)) error {
+	return core.TryRead(func() { read(bytes.NewReader(data)) })
+}
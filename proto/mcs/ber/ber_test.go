@@ -0,0 +1,51 @@
+package ber
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInteger(t *testing.T) {
+	for _, n := range []int{0, 0xFF, 0x100, 0xFFFF, 0x10000, 0x7FFFFFFF} {
+		buff := new(bytes.Buffer)
+		WriteInteger(buff, n)
+		assert.Equal(t, n, ReadInteger(bytes.NewReader(buff.Bytes())), "%#x", n)
+	}
+}
+
+func TestLength(t *testing.T) {
+	for _, n := range []int{0, 0x7F, 0x80, 0xFF, 0x100, 0xFFFF} {
+		buff := new(bytes.Buffer)
+		WriteLength(buff, n)
+		assert.Equal(t, n, ReadLength(bytes.NewReader(buff.Bytes())), "%#x", n)
+	}
+
+	err := Decode([]byte{0x83, 0x01, 0x00, 0x00}, func(r io.Reader) { ReadLength(r) })
+	assert.Error(t, err)
+}
+
+// FuzzRead checks that no input makes the BER readers fail other than with
+// the error Decode returns
+func FuzzRead(f *testing.F) {
+	f.Add([]byte{0x02, 0x01, 0x7F})
+	f.Add([]byte{0x02, 0x04, 0x7F, 0xFF, 0xFF, 0xFF})
+	f.Add([]byte{0x04, 0x82, 0xFF, 0xFF, 0x00})
+	f.Add([]byte{0x7F, 0x66, 0x81, 0x80})
+	f.Add([]byte{0x30, 0x03, 0x02, 0x01, 0x22})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, read := range []func(r io.Reader){
+			func(r io.Reader) { ReadInteger(r) },
+			func(r io.Reader) { ReadLength(r) },
+			func(r io.Reader) { ReadBoolean(r) },
+			func(r io.Reader) { ReadEnumerated(r) },
+			func(r io.Reader) { ReadOctetString(r) },
+			func(r io.Reader) { ReadDomainParameters(r) },
+			func(r io.Reader) { ReadApplicationTag(r, 102) },
+		} {
+			_ = Decode(data, read)
+		}
+	})
+}
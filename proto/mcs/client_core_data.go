@@ -54,6 +54,18 @@ const (
 	KOREAN                     = 0x00000412
 	DUTCH                      = 0x00000413
 	NORWEGIAN                  = 0x00000414
+	POLISH                     = 0x00000415
+	BRAZILIAN_ABNT             = 0x00000416
+	RUSSIAN                    = 0x00000419
+	SWEDISH                    = 0x0000041d
+	TURKISH                    = 0x0000041f
+	SWISS_GERMAN               = 0x00000807
+	UNITED_KINGDOM             = 0x00000809
+	BELGIAN_FRENCH             = 0x0000080c
+	PORTUGUESE                 = 0x00000816
+	CANADIAN_FRENCH            = 0x00001009
+	SWISS_FRENCH               = 0x0000100c
+	US_INTERNATIONAL           = 0x00020409
 )
 const (
 	KT_IBM_PC_XT_83_KEY = 0x00000001
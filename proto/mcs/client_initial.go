@@ -39,6 +39,18 @@ func (ci *ConnectInitial) Serialize() []byte {
 	return buff2.Bytes()
 }
 
+// Load parses a Connect Initial as the server receives it
+func (ci *ConnectInitial) Load(data []byte) {
+	r := bytes.NewReader(ber.ReadApplicationTag(bytes.NewReader(data), MCS_TYPE_CONNECT_INITIAL))
+	ci.CallingDomainSelector = ber.ReadOctetString(r)
+	ci.CalledDomainSelector = ber.ReadOctetString(r)
+	ci.UpwardFlag = ber.ReadBoolean(r)
+	ci.TargetDomainParameters.Read(r)
+	ci.MinimumDomainParameters.Read(r)
+	ci.MaximumDomainParameters.Read(r)
+	ci.UserData = ber.ReadOctetString(r)
+}
+
 func NewClientInitial() *ConnectInitial {
 	return &ConnectInitial{
 		CallingDomainSelector:   []byte{0x1},
@@ -0,0 +1,101 @@
+package mcs
+
+import (
+	"bytes"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// TS_MONITOR_ATTRIBUTES Orientation
+const (
+	ORIENTATION_LANDSCAPE         = 0
+	ORIENTATION_PORTRAIT          = 90
+	ORIENTATION_LANDSCAPE_FLIPPED = 180
+	ORIENTATION_PORTRAIT_FLIPPED  = 270
+)
+
+// ClientMonitorData lays out the monitors the session spans, in virtual
+// desktop coordinates with inclusive Right and Bottom
+// See [MS-RDPBCGR] 2.2.1.3.6
+type ClientMonitorData struct {
+	Header   UserDataHeader // CS_MONITOR
+	Flags    uint32         // unused, must be zero
+	Monitors []MonitorLayout
+}
+
+func NewClientMonitorData(monitors []MonitorLayout) *ClientMonitorData {
+	return &ClientMonitorData{
+		Header:   UserDataHeader{Type: CS_MONITOR, Len: uint16(12 + 20*len(monitors))},
+		Monitors: monitors,
+	}
+}
+
+func (d *ClientMonitorData) Serialize() []byte {
+	buf := new(bytes.Buffer)
+	core.WriteLE(buf, d.Header)
+	core.WriteLE(buf, d.Flags)
+	core.WriteLE(buf, uint32(len(d.Monitors)))
+	// TS_MONITOR_DEF, See [MS-RDPBCGR] 2.2.1.3.6.1
+	for _, m := range d.Monitors {
+		core.WriteLE(buf, m.Left)
+		core.WriteLE(buf, m.Top)
+		core.WriteLE(buf, m.Right)
+		core.WriteLE(buf, m.Bottom)
+		core.WriteLE(buf, m.Flags)
+	}
+	return buf.Bytes()
+}
+
+// ClientMonitorExtendedData gives the physical size, orientation and scale
+// of the monitors of ClientMonitorData, in the same order
+// See [MS-RDPBCGR] 2.2.1.3.9
+type ClientMonitorExtendedData struct {
+	Header   UserDataHeader // CS_MONITOR_EX
+	Flags    uint32         // unused, must be zero
+	Monitors []MonitorLayout
+}
+
+// NewClientMonitorExtendedData returns nil if no monitor sets any of these
+// attributes, leaving the server to its defaults
+func NewClientMonitorExtendedData(monitors []MonitorLayout) *ClientMonitorExtendedData {
+	if !hasAttributes(monitors) {
+		return nil
+	}
+	return &ClientMonitorExtendedData{
+		Header:   UserDataHeader{Type: CS_MONITOR_EX, Len: uint16(16 + 20*len(monitors))},
+		Monitors: monitors,
+	}
+}
+
+func (d *ClientMonitorExtendedData) Serialize() []byte {
+	buf := new(bytes.Buffer)
+	core.WriteLE(buf, d.Header)
+	core.WriteLE(buf, d.Flags)
+	core.WriteLE(buf, uint32(20)) // monitorAttributeSize
+	core.WriteLE(buf, uint32(len(d.Monitors)))
+	// TS_MONITOR_ATTRIBUTES, See [MS-RDPBCGR] 2.2.1.3.9.1
+	for _, m := range d.Monitors {
+		orientation := m.Orientation
+		if orientation == 1 { // MonitorLayout's own value for portrait
+			orientation = ORIENTATION_PORTRAIT
+		}
+		core.WriteLE(buf, m.PhysicalWidthMm)
+		core.WriteLE(buf, m.PhysicalHeightMm)
+		core.WriteLE(buf, orientation)
+		core.WriteLE(buf, m.DesktopScaleFactor)
+		core.WriteLE(buf, m.DeviceScaleFactor)
+	}
+	return buf.Bytes()
+}
+
+// hasAttributes reports whether any monitor sets an attribute of
+// ClientMonitorExtendedData
+func hasAttributes(monitors []MonitorLayout) bool {
+	for _, m := range monitors {
+		if m.PhysicalWidthMm != 0 || m.PhysicalHeightMm != 0 || m.Orientation != 0 ||
+			m.DesktopScaleFactor != 0 || m.DeviceScaleFactor != 0 {
+			return true
+		}
+	}
+	return false
+}
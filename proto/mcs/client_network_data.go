@@ -30,7 +30,7 @@ type ChannelDef struct {
 }
 
 func (d *ChannelDef) Write(w io.Writer) {
-	core.Throw("not implement")
+	core.WriteLE(w, d)
 }
 
 // ClientNetworkData
@@ -52,6 +52,16 @@ func (networkData *ClientNetworkData) Serialize() []byte {
 	return buff.Bytes()
 }
 
+// AddChannel offers the static virtual channel name, of at most 7 ASCII
+// characters
+func (networkData *ClientNetworkData) AddChannel(name string, options uint32) {
+	def := ChannelDef{Options: options}
+	copy(def.Name[:7], name)
+	networkData.ChannelDefArray = append(networkData.ChannelDefArray, def)
+	networkData.ChannelCount = uint32(len(networkData.ChannelDefArray))
+	networkData.Header.Len = uint16(8 + 12*len(networkData.ChannelDefArray))
+}
+
 func NewClientNetworkData() *ClientNetworkData {
 	return &ClientNetworkData{
 		Header: UserDataHeader{Type: CS_NET, Len: 0x08},
@@ -5,7 +5,6 @@ import (
 	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/glog"
 	"github.com/kdsmith18542/gordp/proto/mcs/ber"
-	"io"
 )
 
 // ConnectResponse
@@ -17,6 +16,28 @@ type ConnectResponse struct {
 	UserData         []byte
 }
 
+func (cr *ConnectResponse) Serialize() []byte {
+	buff := new(bytes.Buffer)
+	ber.WriteEnumerated(buff, cr.Result)
+	ber.WriteInteger(buff, cr.CalledConnectId)
+	ber.WriteDomainParameters(buff, cr.DomainParameters.Serialize())
+	ber.WriteOctetstring(buff, string(cr.UserData))
+
+	buff2 := new(bytes.Buffer)
+	ber.WriteApplicationTag(buff2, MCS_TYPE_CONNECT_RESPONSE, buff.Bytes())
+	return buff2.Bytes()
+}
+
+// LoadConnectResponse loads data like ConnectResponse.Load, returning a
+// malformed response as an error
+func LoadConnectResponse(data []byte) (*ConnectResponse, error) {
+	cr := &ConnectResponse{}
+	if err := core.TryRead(func() { cr.Load(data) }); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
 func (cr *ConnectResponse) Load(data []byte) {
 	r := bytes.NewReader(data)
 	userData := ber.ReadApplicationTag(r, MCS_TYPE_CONNECT_RESPONSE)
@@ -30,8 +51,5 @@ func (cr *ConnectResponse) Load(data []byte) {
 	cr.DomainParameters.Read(r)
 
 	core.ThrowIf(ber.ReadUniversalTag(r, ber.BER_TAG_OCTET_STRING, false) == false, "invalid universal tag")
-	length := ber.ReadLength(r)
-	cr.UserData = make([]byte, length)
-	_, err := io.ReadFull(r, cr.UserData)
-	core.ThrowError(err)
+	cr.UserData = core.ReadBytes(r, ber.ReadLength(r))
 }
@@ -2,6 +2,8 @@ package mcs
 
 import (
 	"bytes"
+	"fmt"
+	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/glog"
 	"github.com/kdsmith18542/gordp/proto/mcs/per"
 	"io"
@@ -33,6 +35,24 @@ func (req *GccConferenceCreateRequest) Write(w io.Writer, userData []byte) {
 	per.WriteOctetString(w, string(userData), 0)
 }
 
+// Read parses what Write wrote and returns the user data
+func (req *GccConferenceCreateRequest) Read(r io.Reader) []byte {
+	_ = per.ReadChoice(r)
+	if oid := per.ReadObjectIdentifier(r); !bytes.Equal(oid, t124_02_98_oid) {
+		core.Throw(fmt.Errorf("invalid oid: %x", oid))
+	}
+	_ = per.ReadLength(r)             // connectPDU length
+	_ = per.ReadChoice(r)             // conferenceCreateRequest
+	_ = per.ReadInteger8(r)           // selection
+	digits := per.ReadLength(r) + 1   // ConferenceName::numeric, of at least one digit
+	core.ReadBytes(r, (digits+1)/2+1) // two digits a byte, then the padding
+	_ = per.ReadNumberOfSet(r)
+	_ = per.ReadChoice(r)
+	oStr := per.ReadOctetString(r, 4)
+	core.ThrowIf(!bytes.Equal(oStr, []byte(h221_cs_key)), "invalid data")
+	return per.ReadOctetString(r, 0)
+}
+
 func (req *GccConferenceCreateRequest) Serialize(userData []byte) []byte {
 	buff := new(bytes.Buffer)
 	req.Write(buff, userData)
@@ -14,6 +14,27 @@ import (
 type GccConferenceCreateResponse struct {
 }
 
+// Write mirrors Read, as FreeRDP C.gcc_write_conference_create_response
+func (res *GccConferenceCreateResponse) Write(w io.Writer, userData []byte) {
+	per.WriteChoice(w, 0)
+	per.WriteObjectIdentifier(w, t124_02_98_oid)
+	per.WriteLength(w, len(userData)+14)
+	per.WriteChoice(w, 0x14)                              // conferenceCreateResponse
+	per.WriteInteger16(w, 0x79F3-MCS_CHANNEL_USERID_BASE) // nodeID
+	per.WriteInteger(w, 1)                                // tag
+	per.WriteEnumerated(w, 0)                             // result
+	per.WriteNumberOfSet(w, 1)
+	per.WriteChoice(w, 0xC0)
+	per.WriteOctetString(w, h221_sc_key, 4)
+	per.WriteOctetString(w, string(userData), 0)
+}
+
+func (res *GccConferenceCreateResponse) Serialize(userData []byte) []byte {
+	buff := new(bytes.Buffer)
+	res.Write(buff, userData)
+	return buff.Bytes()
+}
+
 func (res *GccConferenceCreateResponse) Read(r io.Reader) []byte {
 	_ = per.ReadChoice(r)
 	if oid := per.ReadObjectIdentifier(r); !bytes.Equal(oid, t124_02_98_oid) {
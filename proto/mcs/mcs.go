@@ -13,13 +13,23 @@ const (
 
 // for MCS PDU type
 const (
-	MCS_PDUTYPE_ERECT_DOMAIN_REQUEST = 1
-	MCS_PDUTYPE_ATTACH_USER_REQUEST  = 10
-	MCS_PDUTYPE_ATTACH_USER_CONFIRM  = 11
-	MCS_PDUTYPE_CHANNEL_JOIN_REQUEST = 14
-	MCS_PDUTYPE_CHANNEL_JOIN_CONFIRM = 15
-	MCS_PDUTYPE_SEND_DATA_REQUEST    = 25
-	MCS_PDUTYPE_SEND_DATA_INDICATION = 26
+	MCS_PDUTYPE_ERECT_DOMAIN_REQUEST          = 1
+	MCS_PDUTYPE_DISCONNECT_PROVIDER_ULTIMATUM = 8
+	MCS_PDUTYPE_ATTACH_USER_REQUEST           = 10
+	MCS_PDUTYPE_ATTACH_USER_CONFIRM           = 11
+	MCS_PDUTYPE_CHANNEL_JOIN_REQUEST          = 14
+	MCS_PDUTYPE_CHANNEL_JOIN_CONFIRM          = 15
+	MCS_PDUTYPE_SEND_DATA_REQUEST             = 25
+	MCS_PDUTYPE_SEND_DATA_INDICATION          = 26
+)
+
+// Disconnect Provider Ultimatum reasons
+const (
+	RN_DOMAIN_DISCONNECTED = 0
+	RN_PROVIDER_INITIATED  = 1
+	RN_TOKEN_PURGED        = 2
+	RN_USER_REQUESTED      = 3
+	RN_CHANNEL_PURGED      = 4
 )
 
 const (
@@ -0,0 +1,166 @@
+package mcs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// TS_MONITOR_PRIMARY marks the primary monitor in MonitorLayout.Flags
+const TS_MONITOR_PRIMARY = 0x00000001
+
+// Limits a server puts on the monitor layout.
+// See [MS-RDPBCGR] 2.2.1.3.6
+const (
+	MaxMonitors    = 16
+	MaxDesktopSize = 32766
+)
+
+// Errors returned by ValidateMonitors
+var (
+	ErrMonitorCount    = errors.New("monitor count out of range")
+	ErrMonitorPrimary  = errors.New("exactly one monitor must be primary")
+	ErrMonitorGeometry = errors.New("invalid monitor geometry")
+	ErrMonitorsOverlap = errors.New("monitors overlap")
+	ErrDesktopTooLarge = errors.New("virtual desktop too large")
+)
+
+// width and height of the monitor, whose Right and Bottom are inclusive
+func (m *MonitorLayout) width() int32  { return m.Right - m.Left + 1 }
+func (m *MonitorLayout) height() int32 { return m.Bottom - m.Top + 1 }
+
+// overlaps reports whether the two monitors share a pixel
+func (m *MonitorLayout) overlaps(o *MonitorLayout) bool {
+	return m.Left <= o.Right && o.Left <= m.Right && m.Top <= o.Bottom && o.Top <= m.Bottom
+}
+
+// ValidateMonitors checks a layout the way a server would: at most
+// MaxMonitors monitors, exactly one of them primary with its top-left corner
+// at the origin, none overlapping, and a virtual desktop spanning at most
+// MaxDesktopSize pixels either way. An empty layout is valid.
+// See [MS-RDPBCGR] 2.2.1.3.6.1
+func ValidateMonitors(monitors []MonitorLayout) error {
+	if len(monitors) == 0 {
+		return nil
+	}
+	if len(monitors) > MaxMonitors {
+		return fmt.Errorf("%w: %d, at most %d", ErrMonitorCount, len(monitors), MaxMonitors)
+	}
+	primary, err := primaryMonitor(monitors)
+	if err != nil {
+		return err
+	}
+	if m := monitors[primary]; m.Left != 0 || m.Top != 0 {
+		return fmt.Errorf("%w: primary monitor %d at %d,%d instead of 0,0", ErrMonitorGeometry, primary, m.Left, m.Top)
+	}
+
+	left, top, right, bottom := monitors[0].Left, monitors[0].Top, monitors[0].Right, monitors[0].Bottom
+	for i := range monitors {
+		m := &monitors[i]
+		if m.Right < m.Left || m.Bottom < m.Top {
+			return fmt.Errorf("%w: monitor %d is %d,%d-%d,%d", ErrMonitorGeometry, i, m.Left, m.Top, m.Right, m.Bottom)
+		}
+		for j := range monitors[:i] {
+			if m.overlaps(&monitors[j]) {
+				return fmt.Errorf("%w: monitors %d and %d", ErrMonitorsOverlap, j, i)
+			}
+		}
+		left, top = min(left, m.Left), min(top, m.Top)
+		right, bottom = max(right, m.Right), max(bottom, m.Bottom)
+	}
+	// int64, as a layout spanning the whole int32 range overflows
+	width, height := int64(right)-int64(left)+1, int64(bottom)-int64(top)+1
+	if width > MaxDesktopSize || height > MaxDesktopSize {
+		return fmt.Errorf("%w: %dx%d, at most %dx%d", ErrDesktopTooLarge, width, height, MaxDesktopSize, MaxDesktopSize)
+	}
+	return nil
+}
+
+// primaryMonitor returns the index of the one primary monitor
+func primaryMonitor(monitors []MonitorLayout) (int, error) {
+	primary := -1
+	for i, m := range monitors {
+		if m.Flags&TS_MONITOR_PRIMARY == 0 {
+			continue
+		}
+		if primary >= 0 {
+			return 0, fmt.Errorf("%w: monitors %d and %d are", ErrMonitorPrimary, primary, i)
+		}
+		primary = i
+	}
+	if primary < 0 {
+		return 0, fmt.Errorf("%w: none is", ErrMonitorPrimary)
+	}
+	return primary, nil
+}
+
+// ArrangeMonitors returns a copy of the layout with the primary monitor moved
+// to the origin and every other monitor snapped against it, on the side of
+// it that monitor was on. Monitors on the same side are lined up nearest
+// first: to the right and left in a row top-aligned with the primary
+// monitor, above and below that row left-aligned with it. Their sizes and
+// order are kept, so the result passes ValidateMonitors unless the desktop
+// gets too large.
+func ArrangeMonitors(monitors []MonitorLayout) ([]MonitorLayout, error) {
+	if len(monitors) == 0 {
+		return nil, nil
+	}
+	primary, err := primaryMonitor(monitors)
+	if err != nil {
+		return nil, err
+	}
+	p := monitors[primary]
+	abs := func(v int64) int64 { return max(v, -v) }
+	// offset of the centre of monitor i from that of the primary, doubled
+	offset := func(i int) (int64, int64) {
+		m := &monitors[i]
+		return int64(m.Left) + int64(m.Right) - int64(p.Left) - int64(p.Right),
+			int64(m.Top) + int64(m.Bottom) - int64(p.Top) - int64(p.Bottom)
+	}
+	beside := func(i int) bool {
+		dx, dy := offset(i)
+		return abs(dx) >= abs(dy)
+	}
+
+	order := make([]int, 0, len(monitors)-1)
+	for i := range monitors {
+		if i != primary {
+			order = append(order, i)
+		}
+	}
+	// the row first, so that monitors above and below clear all of it
+	sort.SliceStable(order, func(a, b int) bool {
+		if beside(order[a]) != beside(order[b]) {
+			return beside(order[a])
+		}
+		ax, ay := offset(order[a])
+		bx, by := offset(order[b])
+		return abs(ax)+abs(ay) < abs(bx)+abs(by)
+	})
+
+	arranged := make([]MonitorLayout, len(monitors))
+	copy(arranged, monitors)
+	a := &arranged[primary]
+	a.Left, a.Top, a.Right, a.Bottom = 0, 0, p.width()-1, p.height()-1
+	left, top, right, bottom := a.Left, a.Top, a.Right, a.Bottom
+	for _, i := range order {
+		m := &arranged[i]
+		w, h := m.width(), m.height()
+		dx, dy := offset(i)
+		switch {
+		case beside(i) && dx >= 0:
+			m.Left, m.Top = right+1, 0
+			right += w
+		case beside(i):
+			m.Left, m.Top = left-w, 0
+			left -= w
+		case dy > 0:
+			m.Left, m.Top = 0, bottom+1
+		default:
+			m.Left, m.Top = 0, top-h
+		}
+		m.Right, m.Bottom = m.Left+w-1, m.Top+h-1
+		top, bottom = min(top, m.Top), max(bottom, m.Bottom)
+	}
+	return arranged, nil
+}
@@ -1,6 +1,7 @@
 package per
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 
@@ -96,11 +97,7 @@ func WriteOctetString(w io.Writer, oStr string, minValue int) {
 }
 
 func ReadOctetString(r io.Reader, minValue int) []byte {
-	length := ReadLength(r)
-	buff := make([]byte, length+minValue)
-	_, err := io.ReadFull(r, buff)
-	core.ThrowError(err)
-	return buff
+	return core.ReadBytes(r, ReadLength(r)+minValue)
 }
 
 func ReadInteger8(r io.Reader) (length uint8) {
@@ -125,6 +122,12 @@ func WriteInteger16(w io.Writer, n uint16) {
 	core.WriteBE(w, n)
 }
 
+func ReadInteger32(r io.Reader) uint32 {
+	var i32 uint32
+	core.ReadBE(r, &i32)
+	return i32
+}
+
 func WriteInteger32(w io.Writer, n uint32) {
 	core.WriteBE(w, n)
 }
@@ -137,6 +140,8 @@ func ReadInteger(r io.Reader) uint32 {
 		return uint32(ReadInteger8(r))
 	} else if length == 2 {
 		return uint32(ReadInteger16(r, 0))
+	} else if length == 4 {
+		return ReadInteger32(r)
 	}
 	core.Throw(fmt.Errorf("invalid length of integer: %v", length))
 	return 0
@@ -158,3 +163,13 @@ func WriteInteger(w io.Writer, n uint32) {
 func ReadEnumerated(r io.Reader) uint8 {
 	return ReadInteger8(r)
 }
+
+func WriteEnumerated(w io.Writer, n uint8) {
+	WriteInteger8(w, n)
+}
+
+// Decode reads data with read, returning what the readers of this package
+// throw on a malformed PER encoding as an error rather than a panic
+func Decode(data []byte, read func(r io.Reader)) error {
+	return core.TryRead(func() { read(bytes.NewReader(data)) })
+}
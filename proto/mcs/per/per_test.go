@@ -0,0 +1,48 @@
+package per
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInteger(t *testing.T) {
+	for _, n := range []uint32{0, 0x7F, 0xFF, 0x100, 0xFFFF, 0x10000, 0xFFFFFFFF} {
+		buff := new(bytes.Buffer)
+		WriteInteger(buff, n)
+		assert.Equal(t, n, ReadInteger(bytes.NewReader(buff.Bytes())), "%#x", n)
+	}
+
+	err := Decode([]byte{0x03, 0x01, 0x02, 0x03}, func(r io.Reader) { ReadInteger(r) })
+	assert.ErrorContains(t, err, "invalid length of integer")
+}
+
+func TestLength(t *testing.T) {
+	for _, n := range []int{0, 0x7F, 0x80, 0x3FFF} {
+		buff := new(bytes.Buffer)
+		WriteLength(buff, n)
+		assert.Equal(t, n, ReadLength(bytes.NewReader(buff.Bytes())), "%#x", n)
+	}
+}
+
+// FuzzRead checks that no input makes the PER readers fail other than with
+// the error Decode returns
+func FuzzRead(f *testing.F) {
+	f.Add([]byte{0x01, 0x7F})
+	f.Add([]byte{0x04, 0xFF, 0xFF, 0xFF, 0xFF})
+	f.Add([]byte{0x05, 0x00, 0x14, 0x7C, 0x00, 0x01})
+	f.Add([]byte{0xBF, 0xFF, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, read := range []func(r io.Reader){
+			func(r io.Reader) { ReadInteger(r) },
+			func(r io.Reader) { ReadLength(r) },
+			func(r io.Reader) { ReadObjectIdentifier(r) },
+			func(r io.Reader) { ReadOctetString(r, 4) },
+			func(r io.Reader) { ReadInteger16(r, 1001) },
+		} {
+			_ = Decode(data, read)
+		}
+	})
+}
@@ -1,11 +1,14 @@
 package mcs
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/rsa"
 	"crypto/sha1"
+	"fmt"
 	"io"
 	"math/big"
+	"slices"
 
 	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/glog"
@@ -40,6 +43,44 @@ type ProprietaryServerCertificate struct {
 func (p *ProprietaryServerCertificate) GetPublicKey() (uint32, []byte) {
 	return p.PublicKeyBlob.PubExp, p.PublicKeyBlob.Modulus
 }
+
+// NewProprietaryServerCertificate returns a certificate of key with an
+// empty signature, as a test server sends
+func NewProprietaryServerCertificate(key *rsa.PublicKey) *ProprietaryServerCertificate {
+	modulus := key.N.FillBytes(make([]byte, key.Size()))
+	slices.Reverse(modulus)
+	return &ProprietaryServerCertificate{
+		DwSigAlgId:        1, // SIGNATURE_ALG_RSA
+		DwKeyAlgId:        1, // KEY_EXCHANGE_ALG_RSA
+		PublicKeyBlobType: 0x0006,
+		PublicKeyBlobLen:  uint16(20 + len(modulus) + 8),
+		PublicKeyBlob: RSAPublicKey{
+			Magic:   0x31415352,
+			KeyLen:  uint32(len(modulus) + 8),
+			BitLen:  uint32(8 * len(modulus)),
+			DataLen: uint32(len(modulus) - 1),
+			PubExp:  uint32(key.E),
+			Modulus: append(modulus, make([]byte, 8)...),
+		},
+		SignatureBlobType: 0x0008,
+		SignatureBlobLen:  72,
+		SignatureBlob:     make([]byte, 72),
+	}
+}
+
+// PublicKey returns the key of the certificate, whose modulus is
+// little-endian and zero padded
+func (p *ProprietaryServerCertificate) PublicKey() (*rsa.PublicKey, error) {
+	blob := &p.PublicKeyBlob
+	size := int(blob.BitLen / 8)
+	if blob.PubExp == 0 || size == 0 || size > len(blob.Modulus) {
+		return nil, fmt.Errorf("invalid proprietary certificate key: %d bits, %d bytes of modulus", blob.BitLen, len(blob.Modulus))
+	}
+	modulus := slices.Clone(blob.Modulus[:size])
+	slices.Reverse(modulus)
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: int(blob.PubExp)}, nil
+}
+
 func (p *ProprietaryServerCertificate) Verify() bool {
 	// Construct RSA public key
 	pubKey := &rsa.PublicKey{
@@ -83,3 +124,21 @@ func (p *ProprietaryServerCertificate) Read(r io.Reader) {
 	//core.ReadLE(r, &p.SignatureBlob)
 	//core.ReadLE(r, &p.Padding)
 }
+
+func (p *ProprietaryServerCertificate) Serialize() []byte {
+	buff := new(bytes.Buffer)
+	core.WriteLE(buff, p.DwSigAlgId)
+	core.WriteLE(buff, p.DwKeyAlgId)
+	core.WriteLE(buff, p.PublicKeyBlobType)
+	core.WriteLE(buff, p.PublicKeyBlobLen)
+	core.WriteLE(buff, p.PublicKeyBlob.Magic)
+	core.WriteLE(buff, p.PublicKeyBlob.KeyLen)
+	core.WriteLE(buff, p.PublicKeyBlob.BitLen)
+	core.WriteLE(buff, p.PublicKeyBlob.DataLen)
+	core.WriteLE(buff, p.PublicKeyBlob.PubExp)
+	core.WriteFull(buff, p.PublicKeyBlob.Modulus)
+	core.WriteLE(buff, p.SignatureBlobType)
+	core.WriteLE(buff, p.SignatureBlobLen)
+	core.WriteFull(buff, p.SignatureBlob)
+	return buff.Bytes()
+}
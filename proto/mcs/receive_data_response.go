@@ -10,17 +10,40 @@ import (
 	"io"
 )
 
+// DisconnectUltimatumError is raised when the server ends the MCS domain
+// with a Disconnect Provider Ultimatum instead of sending data
+type DisconnectUltimatumError struct {
+	Reason uint8
+}
+
+func (e *DisconnectUltimatumError) Error() string {
+	return fmt.Sprintf("mcs disconnect provider ultimatum, reason %d", e.Reason)
+}
+
 type ReceiveDataResponse struct{}
 
+// ReadReceiveData reads a Send Data Indication like ReceiveDataResponse.Read,
+// returning a malformed one, or a Disconnect Provider Ultimatum, as an error
+func ReadReceiveData(r io.Reader) (channelId uint16, data []byte, err error) {
+	err = core.TryRead(func() { channelId, data = (&ReceiveDataResponse{}).Read(r) })
+	return channelId, data, err
+}
+
 func (res *ReceiveDataResponse) Read(r io.Reader) (uint16, []byte) {
 	data := x224.Read(r)
-	r = bytes.NewReader(data)
-	pduHeader := ReadMcsPduHeader(r)
+	br := bytes.NewReader(data)
+	options := per.ReadChoice(br)
+	pduHeader := options >> 2
+	if pduHeader == MCS_PDUTYPE_DISCONNECT_PROVIDER_ULTIMATUM {
+		// the 3 bit reason straddles the choice and the next byte
+		reason := (options&0x03)<<1 | per.ReadInteger8(br)>>7
+		core.ThrowError(&DisconnectUltimatumError{Reason: reason})
+	}
 	core.ThrowIf(pduHeader != MCS_PDUTYPE_SEND_DATA_INDICATION, fmt.Errorf("invalid pdu header: %v", pduHeader))
-	userId := per.ReadInteger16(r, MCS_CHANNEL_USERID_BASE) // UserId
-	channelId := per.ReadInteger16(r, 0)
+	userId := per.ReadInteger16(br, MCS_CHANNEL_USERID_BASE) // UserId
+	channelId := per.ReadInteger16(br, 0)
 	glog.Debugf("userId: %v, channelId: %v", userId, channelId)
-	enumerated := per.ReadEnumerated(r)
+	enumerated := per.ReadEnumerated(br)
 	glog.Debugf("enumerated: %v", enumerated)
-	return channelId, per.ReadOctetString(r, 0)
+	return channelId, per.ReadOctetString(br, 0)
 }
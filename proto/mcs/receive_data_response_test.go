@@ -0,0 +1,52 @@
+package mcs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/proto/mcs/per"
+	"github.com/kdsmith18542/gordp/proto/x224"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sendDataIndication makes the packet of a Send Data Indication on
+// channelId, declaring length bytes of data and carrying data
+func sendDataIndication(channelId uint16, length int, data []byte) []byte {
+	buff := new(bytes.Buffer)
+	WriteMcsPduHeader(buff, MCS_PDUTYPE_SEND_DATA_INDICATION, 0)
+	per.WriteInteger16(buff, 1)
+	per.WriteInteger16(buff, channelId)
+	per.WriteInteger8(buff, 0x70)
+	per.WriteLength(buff, length)
+	buff.Write(data)
+	packet := new(bytes.Buffer)
+	x224.Write(packet, buff.Bytes())
+	return packet.Bytes()
+}
+
+func TestReceiveDataResponse(t *testing.T) {
+	channelId, data := (&ReceiveDataResponse{}).Read(bytes.NewReader(sendDataIndication(MCS_CHANNEL_GLOBAL, 5, []byte("hello"))))
+	assert.Equal(t, uint16(MCS_CHANNEL_GLOBAL), channelId)
+	assert.Equal(t, []byte("hello"), data)
+
+	// a length beyond the packet is not allocated
+	_, _, err := ReadReceiveData(bytes.NewReader(sendDataIndication(MCS_CHANNEL_GLOBAL, 0x7FFF, []byte("short"))))
+	var lengthErr *core.LengthError
+	require.ErrorAs(t, err, &lengthErr)
+	assert.Equal(t, 0x7FFF, lengthErr.Length)
+	assert.Equal(t, 5, lengthErr.Max)
+}
+
+// FuzzReceiveDataResponse checks that no packet makes the MCS readers of
+// the client fail other than with an error
+func FuzzReceiveDataResponse(f *testing.F) {
+	f.Add(sendDataIndication(MCS_CHANNEL_GLOBAL, 5, []byte("hello")))
+	f.Add(sendDataIndication(1004, 0x7FFF, []byte("short")))
+	f.Add([]byte{0x03, 0x00, 0x00, 0x09, 0x02, 0xF0, 0x80, 0x21, 0x80})
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		_, _, _ = ReadReceiveData(bytes.NewReader(packet))
+		_, _ = LoadConnectResponse(packet)
+	})
+}
@@ -1,6 +1,7 @@
 package mcs
 
 import (
+	"bytes"
 	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/glog"
 	"github.com/kdsmith18542/gordp/proto/mcs/per"
@@ -11,6 +12,14 @@ type ServerAttachUserConfirm struct {
 	UserId uint16
 }
 
+func (c *ServerAttachUserConfirm) Serialize() []byte {
+	buff := new(bytes.Buffer)
+	WriteMcsPduHeader(buff, MCS_PDUTYPE_ATTACH_USER_CONFIRM, 2) // initiator present
+	per.WriteEnumerated(buff, 0)
+	per.WriteInteger16(buff, c.UserId-MCS_CHANNEL_USERID_BASE)
+	return buff.Bytes()
+}
+
 func (c *ServerAttachUserConfirm) Read(r io.Reader) {
 	core.ThrowIf(ReadMcsPduHeader(r) != MCS_PDUTYPE_ATTACH_USER_CONFIRM, "invalid pdu TYPE")
 	core.ThrowIf(per.ReadEnumerated(r) != 0, "invalid enumerated")
@@ -1,6 +1,8 @@
 package mcs
 
 import (
+	"crypto/rsa"
+	"errors"
 	"io"
 
 	"github.com/kdsmith18542/gordp/core"
@@ -14,10 +16,14 @@ const (
 
 type CertData interface {
 	GetPublicKey() (uint32, []byte)
+	PublicKey() (*rsa.PublicKey, error)
 	Verify() bool
 	Read(io.Reader)
 }
 
+// ErrNoCertificate is returned for the key of a server that sent no certificate
+var ErrNoCertificate = errors.New("no server certificate")
+
 // ServerCertificate
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/54e72cc6-3422-404c-a6b4-2486db125342
 type ServerCertificate struct {
@@ -39,3 +45,19 @@ func (c *ServerCertificate) Read(r io.Reader) {
 	}
 	c.CertData.Read(r)
 }
+
+// PublicKey returns the RSA key of the server the client random is
+// encrypted with
+func (c *ServerCertificate) PublicKey() (*rsa.PublicKey, error) {
+	if c.CertData == nil {
+		return nil, ErrNoCertificate
+	}
+	return c.CertData.PublicKey()
+}
+
+// Serialize serializes a proprietary certificate; X.509 chains are only read
+func (c *ServerCertificate) Serialize() []byte {
+	cert, ok := c.CertData.(*ProprietaryServerCertificate)
+	core.ThrowIf(!ok, "only proprietary certificates can be serialized")
+	return append(core.ToLE(uint32(CERT_CHAIN_VERSION_1)), cert.Serialize()...)
+}
@@ -1,6 +1,7 @@
 package mcs
 
 import (
+	"bytes"
 	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/proto/mcs/per"
 	"io"
@@ -12,6 +13,16 @@ type ServerChannelJoinConfirm struct {
 	ChannelId uint16
 }
 
+func (c *ServerChannelJoinConfirm) Serialize() []byte {
+	buff := new(bytes.Buffer)
+	WriteMcsPduHeader(buff, MCS_PDUTYPE_CHANNEL_JOIN_CONFIRM, 2) // channelId present
+	per.WriteEnumerated(buff, c.Confirm)
+	per.WriteInteger16(buff, c.UserId-MCS_CHANNEL_USERID_BASE)
+	per.WriteInteger16(buff, c.ChannelId) // requested
+	per.WriteInteger16(buff, c.ChannelId)
+	return buff.Bytes()
+}
+
 func (c *ServerChannelJoinConfirm) Read(r io.Reader) {
 	core.ThrowIf(ReadMcsPduHeader(r) != MCS_PDUTYPE_CHANNEL_JOIN_CONFIRM, "invalid pdu Type")
 	c.Confirm = per.ReadEnumerated(r)
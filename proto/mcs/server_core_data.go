@@ -13,6 +13,10 @@ type ServerCoreData struct {
 	EarlyCapabilityFlags     uint32
 }
 
+func (d *ServerCoreData) Serialize() []byte {
+	return append(core.ToLE(&UserDataHeader{Type: SC_CORE, Len: 16}), core.ToLE(d)...)
+}
+
 func (d *ServerCoreData) Read(r io.Reader) {
 	core.ReadLE(r, d)
 }
@@ -1,8 +1,20 @@
 package mcs
 
+import (
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/glog"
+	"io"
+)
+
 // ServerMessageChannelData
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/9269d58a-3d85-48a2-942a-bb0bbe5a55aa
 type ServerMessageChannelData struct {
-	Header    uint32
+	Header    UserDataHeader
 	ChannelId uint16
 }
+
+// Read reads the data following the header
+func (d *ServerMessageChannelData) Read(r io.Reader) {
+	core.ReadLE(r, &d.ChannelId)
+	glog.Debugf("server message channel data: %+v", d)
+}
@@ -1,8 +1,20 @@
 package mcs
 
+import (
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/glog"
+	"io"
+)
+
 // ServerMultitransportChannelData
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/bf7201d4-9ed9-4dfe-9f6f-f2d68a7367ed
 type ServerMultitransportChannelData struct {
-	Header uint32
+	Header UserDataHeader
 	Flags  uint32
 }
+
+// Read reads the data following the header
+func (d *ServerMultitransportChannelData) Read(r io.Reader) {
+	core.ReadLE(r, &d.Flags)
+	glog.Debugf("server multitransport channel data: %+v", d)
+}
@@ -1,6 +1,7 @@
 package mcs
 
 import (
+	"bytes"
 	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/glog"
 	"io"
@@ -14,10 +15,24 @@ type ServerNetworkData struct {
 	ChannelIdArray []uint16
 }
 
+func (d *ServerNetworkData) Serialize() []byte {
+	buff := new(bytes.Buffer)
+	pad := len(d.ChannelIdArray) % 2
+	core.WriteLE(buff, &UserDataHeader{Type: SC_NET, Len: uint16(8 + 2*(len(d.ChannelIdArray)+pad))})
+	core.WriteLE(buff, d.McsChannelId)
+	core.WriteLE(buff, uint16(len(d.ChannelIdArray)))
+	core.WriteLE(buff, d.ChannelIdArray)
+	core.WriteLE(buff, make([]uint16, pad)) // pad to a multiple of 4 bytes
+	return buff.Bytes()
+}
+
 func (d *ServerNetworkData) Read(r io.Reader) {
 	core.ReadLE(r, &d.McsChannelId)
 	core.ReadLE(r, &d.ChannelCount)
 	d.ChannelIdArray = make([]uint16, d.ChannelCount)
 	core.ReadLE(r, d.ChannelIdArray)
+	if d.ChannelCount%2 != 0 {
+		core.ReadLE(r, new(uint16)) // pad to a multiple of 4 bytes
+	}
 	glog.Debugf("server network data: %+v", d)
 }
@@ -57,3 +57,18 @@ func (d *ServerSecurityData) Read(r io.Reader) {
 	serverCertData := core.ReadBytes(r, int(d.ServerCertLen))
 	d.ServerCertificate.Read(bytes.NewReader(serverCertData))
 }
+
+func (d *ServerSecurityData) Serialize() []byte {
+	buff := new(bytes.Buffer)
+	core.WriteLE(buff, d.EncryptionMethod)
+	core.WriteLE(buff, d.EncryptionLevel)
+	if d.EncryptionMethod != ENCRYPTION_METHOD_NONE || d.EncryptionLevel != ENCRYPTION_LEVEL_NONE {
+		cert := d.ServerCertificate.Serialize()
+		core.WriteLE(buff, uint32(len(d.ServerRandom)))
+		core.WriteLE(buff, uint32(len(cert)))
+		core.WriteFull(buff, d.ServerRandom)
+		core.WriteFull(buff, cert)
+	}
+	header := UserDataHeader{Type: SC_SECURITY, Len: uint16(4 + buff.Len())}
+	return append(core.ToLE(&header), buff.Bytes()...)
+}
@@ -8,11 +8,12 @@ import (
 // UserDataHeader Type
 const (
 	//client -> server
-	CS_CORE     = 0xC001
-	CS_SECURITY = 0xC002
-	CS_NET      = 0xC003
-	CS_CLUSTER  = 0xC004
-	CS_MONITOR  = 0xC005
+	CS_CORE       = 0xC001
+	CS_SECURITY   = 0xC002
+	CS_NET        = 0xC003
+	CS_CLUSTER    = 0xC004
+	CS_MONITOR    = 0xC005
+	CS_MONITOR_EX = 0xC008
 
 	//server -> client
 	SC_CORE           = 0x0C01
@@ -1,8 +1,12 @@
 package mcs
 
 import (
+	"crypto/rsa"
 	"crypto/x509"
+	"fmt"
 	"io"
+
+	"github.com/kdsmith18542/gordp/core"
 )
 
 // CertBlob
@@ -35,6 +39,23 @@ func (p *X509CertificateChain) GetPublicKey() (uint32, []byte) {
 	return uint32(len(pubKeyBytes)), pubKeyBytes
 }
 
+// PublicKey returns the RSA key of the last certificate of the chain, the
+// one of the server
+func (p *X509CertificateChain) PublicKey() (*rsa.PublicKey, error) {
+	if len(p.CertBlobArray) == 0 {
+		return nil, ErrNoCertificate
+	}
+	cert, err := x509.ParseCertificate(p.CertBlobArray[len(p.CertBlobArray)-1].AbCert)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("server certificate key of type %T, want RSA", cert.PublicKey)
+	}
+	return key, nil
+}
+
 func (p *X509CertificateChain) Verify() bool {
 	if len(p.CertBlobArray) < 2 {
 		return false
@@ -59,5 +80,12 @@ func (p *X509CertificateChain) Verify() bool {
 }
 
 func (p *X509CertificateChain) Read(r io.Reader) {
-	// TODO: Implement reading from io.Reader if needed
+	core.ReadLE(r, &p.NumCertBlobs)
+	core.ThrowIf(p.NumCertBlobs < 2 || p.NumCertBlobs > 200, fmt.Errorf("invalid number of certificates: %d", p.NumCertBlobs))
+	p.CertBlobArray = make([]CertBlob, p.NumCertBlobs)
+	for i := range p.CertBlobArray {
+		blob := &p.CertBlobArray[i]
+		core.ReadLE(r, &blob.CbCert)
+		blob.AbCert = core.ReadBytes(r, int(blob.CbCert))
+	}
 }
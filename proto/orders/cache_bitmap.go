@@ -0,0 +1,135 @@
+package orders
+
+import (
+	"bytes"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// CacheBitmap stores a bitmap in a cell of the bitmap cache, for MemBlt and
+// Mem3Blt orders to copy. It is a Cache Bitmap order of either revision.
+// See [MS-RDPEGDI] 2.2.2.2.1.2.2 and 2.2.2.2.1.2.3
+type CacheBitmap struct {
+	CacheId    uint8
+	CacheIndex uint16
+
+	// Key1 and Key2 are the persistent key of the bitmap, zero when the
+	// server sent none
+	Key1 uint32
+	Key2 uint32
+
+	Width  uint16
+	Height uint16
+
+	// BitsPerPixel is the color depth of Data, 0 for that of the session
+	BitsPerPixel int
+
+	// Compressed marks Data as compressed like the tiles of bitmap updates,
+	// without the compression header; it is bottom-up rows otherwise
+	Compressed bool
+	Data       []byte
+}
+
+func (o *CacheBitmap) iOrder() {}
+
+// NO_BITMAP_COMPRESSION_HDR in the extra flags of a Cache Bitmap
+// (Revision 1) order leaves out the compression header of the bitmap
+const NO_BITMAP_COMPRESSION_HDR = 0x0400
+
+func readCacheBitmap(r *bytes.Reader, orderType uint8, extraFlags uint16) *CacheBitmap {
+	var header struct {
+		CacheId      uint8
+		Pad1         uint8
+		Width        uint8
+		Height       uint8
+		BitsPerPixel uint8
+		Length       uint16
+		CacheIndex   uint16
+	}
+	core.ReadLE(r, &header)
+	o := &CacheBitmap{
+		CacheId:      header.CacheId,
+		CacheIndex:   header.CacheIndex,
+		Width:        uint16(header.Width),
+		Height:       uint16(header.Height),
+		BitsPerPixel: int(header.BitsPerPixel),
+		Compressed:   orderType == TS_CACHE_BITMAP_COMPRESSED,
+	}
+	o.Data = readCachedBitmapData(r, o.Compressed && extraFlags&NO_BITMAP_COMPRESSION_HDR == 0, int(header.Length))
+	return o
+}
+
+// Flags of a Cache Bitmap (Revision 2) order, in the extra flags above the
+// cache id and color depth
+const (
+	CBR2_HEIGHT_SAME_AS_WIDTH      = 0x01
+	CBR2_PERSISTENT_KEY_PRESENT    = 0x02
+	CBR2_NO_BITMAP_COMPRESSION_HDR = 0x08
+	CBR2_DO_NOT_CACHE              = 0x10
+)
+
+// cbr2Depths are the color depths of the BitsPerPixelId of a Cache Bitmap
+// (Revision 2) order
+var cbr2Depths = map[uint16]int{0x3: 8, 0x4: 16, 0x5: 24, 0x6: 32}
+
+func readCacheBitmapRev2(r *bytes.Reader, orderType uint8, extraFlags uint16) *CacheBitmap {
+	flags := extraFlags >> 7
+	o := &CacheBitmap{
+		CacheId:      uint8(extraFlags & 0x07),
+		BitsPerPixel: cbr2Depths[extraFlags>>3&0x0F],
+		Compressed:   orderType == TS_CACHE_BITMAP_COMPRESSED_REV2,
+	}
+	if flags&CBR2_PERSISTENT_KEY_PRESENT != 0 {
+		core.ReadLE(r, &o.Key1)
+		core.ReadLE(r, &o.Key2)
+	}
+	o.Width = readTwoByteUnsigned(r)
+	o.Height = o.Width
+	if flags&CBR2_HEIGHT_SAME_AS_WIDTH == 0 {
+		o.Height = readTwoByteUnsigned(r)
+	}
+	length := readFourByteUnsigned(r)
+	o.CacheIndex = readTwoByteUnsigned(r)
+	o.Data = readCachedBitmapData(r, o.Compressed && flags&CBR2_NO_BITMAP_COMPRESSION_HDR == 0, int(length))
+	return o
+}
+
+// readCachedBitmapData reads the length bytes of the bitmap of a Cache
+// Bitmap order, leaving out the compression header they begin with when
+// there is one
+func readCachedBitmapData(r *bytes.Reader, header bool, length int) []byte {
+	if header {
+		// TS_CD_HEADER, which only repeats the sizes
+		core.ReadBytes(r, 8)
+		length -= 8
+	}
+	return core.ReadBytes(r, length)
+}
+
+// readTwoByteUnsigned reads a value of one byte, or two when the high bit
+// of the first is set
+// See [MS-RDPEGDI] 2.2.2.2.1.2.1.2
+func readTwoByteUnsigned(r *bytes.Reader) uint16 {
+	var b [2]uint8
+	core.ReadLE(r, &b[0])
+	if b[0]&0x80 == 0 {
+		return uint16(b[0])
+	}
+	core.ReadLE(r, &b[1])
+	return uint16(b[0]&0x7F)<<8 | uint16(b[1])
+}
+
+// readFourByteUnsigned reads a value of one to four bytes, the two high
+// bits of the first counting the bytes that follow, most significant first
+// See [MS-RDPEGDI] 2.2.2.2.1.2.1.4
+func readFourByteUnsigned(r *bytes.Reader) uint32 {
+	var b uint8
+	core.ReadLE(r, &b)
+	v := uint32(b & 0x3F)
+	for i := 0; i < int(b>>6); i++ {
+		var next uint8
+		core.ReadLE(r, &next)
+		v = v<<8 | uint32(next)
+	}
+	return v
+}
@@ -0,0 +1,183 @@
+package orders
+
+import (
+	"image"
+	"image/color"
+)
+
+// Color is a Generic Color, its first byte in the lowest bits. What it
+// holds depends on the color depth of the session, see RGBA.
+// See [MS-RDPEGDI] 2.2.2.2.1.1.1.8
+type Color uint32
+
+// RGBA returns the color in a session of bpp bits per pixel: a palette
+// index at 8bpp, a 15 or 16 bits color, or red, green and blue bytes
+func (c Color) RGBA(bpp int, palette color.Palette) color.RGBA {
+	switch {
+	case bpp <= 8:
+		if i := int(c & 0xFF); i < len(palette) {
+			return color.RGBAModel.Convert(palette[i]).(color.RGBA)
+		}
+		return color.RGBA{A: 0xFF}
+	case bpp == 15:
+		return color.RGBA{expand(c>>10, 5), expand(c>>5, 5), expand(c, 5), 0xFF}
+	case bpp == 16:
+		return color.RGBA{expand(c>>11, 5), expand(c>>5, 6), expand(c, 5), 0xFF}
+	default:
+		return color.RGBA{uint8(c), uint8(c >> 8), uint8(c >> 16), 0xFF}
+	}
+}
+
+// expand scales the lowest bits of v to 8 bits
+func expand(v Color, bits int) uint8 {
+	v &= 1<<bits - 1
+	return uint8(v<<(8-bits) | v>>(2*bits-8))
+}
+
+// rgb returns the color as a pixel, see pixel
+func (c Color) rgb(bpp int, palette color.Palette) uint32 {
+	v := c.RGBA(bpp, palette)
+	return uint32(v.R)<<16 | uint32(v.G)<<8 | uint32(v.B)
+}
+
+// Brush styles
+// See [MS-RDPEGDI] 2.2.2.2.1.1.1.9
+const (
+	BS_SOLID   = 0x00
+	BS_NULL    = 0x01
+	BS_HATCHED = 0x02
+	BS_PATTERN = 0x03
+)
+
+// Brush is the brush of PatBlt and GlyphIndex orders
+// See [MS-RDPEGDI] 2.2.2.2.1.1.1.9
+type Brush struct {
+	OrgX  int8
+	OrgY  int8
+	Style uint8
+	Hatch uint8   // hatch style, or the first row of a pattern brush
+	Extra [7]byte // the other rows of a pattern brush
+}
+
+// hatches are the patterns of hatched brushes, by hatch style, bits set
+// being painted with the fore color
+var hatches = [6][8]byte{
+	{0x00, 0x00, 0x00, 0xFF, 0x00, 0x00, 0x00, 0x00}, // HS_HORIZONTAL
+	{0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08}, // HS_VERTICAL
+	{0x80, 0x40, 0x20, 0x10, 0x08, 0x04, 0x02, 0x01}, // HS_FDIAGONAL
+	{0x01, 0x02, 0x04, 0x08, 0x10, 0x20, 0x40, 0x80}, // HS_BDIAGONAL
+	{0x08, 0x08, 0x08, 0xFF, 0x08, 0x08, 0x08, 0x08}, // HS_CROSS
+	{0x81, 0x42, 0x24, 0x18, 0x18, 0x24, 0x42, 0x81}, // HS_DIAGCROSS
+}
+
+// pattern returns the pixels of the brush, fore and back being its colors.
+// Brushes that are not solid repeat an 8x8 pattern from their origin.
+func (b *Brush) pattern(fore, back uint32) func(x, y int) uint32 {
+	var rows [8]byte
+	switch {
+	case b.Style == BS_HATCHED && int(b.Hatch) < len(hatches):
+		rows = hatches[b.Hatch]
+	case b.Style == BS_PATTERN:
+		// the rows come bottom up, and bits set are the back color
+		rows[7] = b.Hatch
+		for i, row := range b.Extra {
+			rows[6-i] = row
+		}
+		fore, back = back, fore
+	default:
+		return func(x, y int) uint32 { return fore }
+	}
+	return func(x, y int) uint32 {
+		if rows[(y-int(b.OrgY))&7]&(0x80>>((x-int(b.OrgX))&7)) != 0 {
+			return fore
+		}
+		return back
+	}
+}
+
+// Ternary raster operations
+// See [MS-RDPEGDI] 2.2.2.2.1.1.1.7
+const (
+	ROP3_BLACKNESS = 0x00
+	ROP3_DSTINVERT = 0x55
+	ROP3_PATINVERT = 0x5A
+	ROP3_SRCINVERT = 0x66
+	ROP3_SRCAND    = 0x88
+	ROP3_DST       = 0xAA
+	ROP3_SRCCOPY   = 0xCC
+	ROP3_SRCPAINT  = 0xEE
+	ROP3_PATCOPY   = 0xF0
+	ROP3_WHITENESS = 0xFF
+)
+
+// R2_COPYPEN is the binary raster operation drawing with the pen as is
+const R2_COPYPEN = 0x0D
+
+// rop3 returns the pixel rop makes of the pattern p, source s and
+// destination d. Bit i of rop is the result where the pattern, source and
+// destination bits are those of i, from the highest.
+func rop3(rop uint8, p, s, d uint32) uint32 {
+	switch rop {
+	case ROP3_BLACKNESS:
+		return 0
+	case ROP3_DSTINVERT:
+		return ^d & 0xFFFFFF
+	case ROP3_PATINVERT:
+		return p ^ d
+	case ROP3_SRCINVERT:
+		return s ^ d
+	case ROP3_SRCAND:
+		return s & d
+	case ROP3_DST:
+		return d
+	case ROP3_SRCCOPY:
+		return s
+	case ROP3_SRCPAINT:
+		return s | d
+	case ROP3_PATCOPY:
+		return p
+	case ROP3_WHITENESS:
+		return 0xFFFFFF
+	}
+	var v uint32
+	for i := 0; i < 8; i++ {
+		if rop&(1<<i) == 0 {
+			continue
+		}
+		term := uint32(0xFFFFFF)
+		for bit, x := range [3]uint32{d, s, p} {
+			if i&(1<<bit) == 0 {
+				x = ^x
+			}
+			term &= x
+		}
+		v |= term
+	}
+	return v
+}
+
+// rop2 returns the ternary raster operation doing the binary raster
+// operation rop, 1 to 16, of the pen and the destination
+// See [MS-RDPEGDI] 2.2.2.2.1.1.1.6
+func rop2(rop uint8) uint8 {
+	var v uint8
+	for i := 0; i < 8; i++ {
+		// bit 2 of i is the pen, bit 0 the destination
+		if (rop-1)>>(i>>2<<1|i&1)&1 != 0 {
+			v |= 1 << i
+		}
+	}
+	return v
+}
+
+// pixel returns the pixel of img at x, y as its red, green and blue bytes
+func pixel(img *image.RGBA, x, y int) uint32 {
+	i := img.PixOffset(x, y)
+	return uint32(img.Pix[i])<<16 | uint32(img.Pix[i+1])<<8 | uint32(img.Pix[i+2])
+}
+
+// setPixel sets the pixel of img at x, y, which is opaque
+func setPixel(img *image.RGBA, x, y int, v uint32) {
+	i := img.PixOffset(x, y)
+	img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = byte(v>>16), byte(v>>8), byte(v), 0xFF
+}
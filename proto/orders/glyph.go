@@ -0,0 +1,185 @@
+package orders
+
+import (
+	"bytes"
+	"slices"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/glog"
+)
+
+// Glyph is a glyph of the glyph cache: a 1bpp bitmap, its rows padded to
+// bytes and its leftmost pixel in the highest bit, placed at X, Y from the
+// origin of the glyph
+// See [MS-RDPEGDI] 2.2.2.2.1.2.5.1
+type Glyph struct {
+	X      int16
+	Y      int16
+	Width  uint16
+	Height uint16
+	Data   []byte
+}
+
+// set reports whether the pixel of the glyph at x, y is set
+func (g *Glyph) set(x, y int) bool {
+	stride := (int(g.Width) + 7) / 8
+	i := y*stride + x/8
+	return i < len(g.Data) && g.Data[i]&(0x80>>(x%8)) != 0
+}
+
+// CG_GLYPH_UNICODE_PRESENT in the extra flags of a Cache Glyph order adds
+// the characters of the glyphs
+const CG_GLYPH_UNICODE_PRESENT = 0x0010
+
+// CacheGlyph stores glyphs in a glyph cache, by index
+// See [MS-RDPEGDI] 2.2.2.2.1.2.5
+type CacheGlyph struct {
+	CacheId uint8
+	Indices []uint16
+	Glyphs  []*Glyph
+}
+
+func (o *CacheGlyph) iOrder() {}
+
+func readCacheGlyph(r *bytes.Reader, extraFlags uint16) *CacheGlyph {
+	o := &CacheGlyph{}
+	var count uint8
+	core.ReadLE(r, &o.CacheId)
+	core.ReadLE(r, &count)
+	for i := 0; i < int(count); i++ {
+		var index uint16
+		g := &Glyph{}
+		core.ReadLE(r, &index)
+		core.ReadLE(r, &g.X)
+		core.ReadLE(r, &g.Y)
+		core.ReadLE(r, &g.Width)
+		core.ReadLE(r, &g.Height)
+		// the bitmap is padded to 4 bytes
+		size := ((int(g.Width)+7)/8*int(g.Height) + 3) &^ 3
+		g.Data = core.ReadBytes(r, size)
+		o.Indices = append(o.Indices, index)
+		o.Glyphs = append(o.Glyphs, g)
+	}
+	if extraFlags&CG_GLYPH_UNICODE_PRESENT != 0 {
+		glog.Debugf("glyph characters: %x", core.ReadBytes(r, 2*int(count)))
+	}
+	return o
+}
+
+// Glyph cache sizes, as announced in the glyph cache capability set
+const (
+	GlyphCaches        = 10
+	GlyphCacheEntries  = 254
+	GlyphFragments     = 256
+	GlyphFragmentBytes = 256
+)
+
+// GlyphCache keeps the glyphs of Cache Glyph orders and the fragments of
+// Glyph Index orders, which repeat strings of glyphs
+type GlyphCache struct {
+	glyphs    [GlyphCaches]map[uint16]*Glyph
+	fragments [GlyphFragments][]byte
+}
+
+// Put stores the glyphs of o
+func (c *GlyphCache) Put(o *CacheGlyph) {
+	if int(o.CacheId) >= GlyphCaches {
+		glog.Warnf("glyph cache %d out of range", o.CacheId)
+		return
+	}
+	if c.glyphs[o.CacheId] == nil {
+		c.glyphs[o.CacheId] = make(map[uint16]*Glyph)
+	}
+	for i, index := range o.Indices {
+		c.glyphs[o.CacheId][index] = o.Glyphs[i]
+	}
+}
+
+// Get returns the glyph at index of a cache, nil if there is none
+func (c *GlyphCache) Get(cacheId uint8, index uint16) *Glyph {
+	if int(cacheId) >= GlyphCaches {
+		return nil
+	}
+	return c.glyphs[cacheId][index]
+}
+
+// Glyph fragment operations, in the glyph indices of Glyph Index orders
+// See [MS-RDPEGDI] 2.2.2.2.1.1.2.13
+const (
+	GLYPH_FRAGMENT_USE = 0xFE
+	GLYPH_FRAGMENT_ADD = 0xFF
+)
+
+// Layout calls draw with every glyph of o and the position of its bitmap,
+// following the glyph indices and the fragments they add and use. Glyphs
+// not in the cache are left out.
+func (c *GlyphCache) Layout(o *GlyphIndex, draw func(g *Glyph, x, y int)) {
+	x, y := int(o.X), int(o.Y)
+	advance := func(delta int) {
+		if o.FlAccel&SO_VERTICAL != 0 {
+			y += delta
+		} else {
+			x += delta
+		}
+	}
+	// glyphs are followed by the distance from the previous one unless the
+	// font has a fixed pitch or glyphs advance by their width
+	deltas := o.CharInc == 0 && o.FlAccel&SO_CHAR_INC_EQUAL_BM_BASE == 0
+	readDelta := func(data []byte, i int) int {
+		if !deltas || i >= len(data) {
+			return i
+		}
+		if data[i] != 0x80 {
+			advance(int(int8(data[i])))
+			return i + 1
+		}
+		if i+2 < len(data) {
+			advance(int(int16(uint16(data[i+1]) | uint16(data[i+2])<<8)))
+		}
+		return i + 3
+	}
+	// glyph draws the glyph at data[i] and returns the index of the next one
+	glyph := func(data []byte, i int) int {
+		index := data[i]
+		i = readDelta(data, i+1)
+		g := c.Get(o.CacheId, uint16(index))
+		if g == nil {
+			glog.Debugf("glyph %d of cache %d not cached", index, o.CacheId)
+			return i
+		}
+		draw(g, x+int(g.X), y+int(g.Y))
+		if o.FlAccel&SO_CHAR_INC_EQUAL_BM_BASE != 0 {
+			advance(int(g.Width))
+		} else if o.CharInc != 0 {
+			advance(int(o.CharInc))
+		}
+		return i
+	}
+
+	data := o.GlyphIndices
+	start := 0 // of the glyphs the next added fragment holds
+	for i := 0; i < len(data); {
+		switch data[i] {
+		case GLYPH_FRAGMENT_ADD:
+			// the fragment repeats the glyphs since the previous one
+			if i+2 < len(data) {
+				id, size := data[i+1], int(data[i+2])
+				c.fragments[id] = slices.Clone(data[start:min(start+size, i)])
+			}
+			i += 3
+			start = i
+		case GLYPH_FRAGMENT_USE:
+			if i+1 >= len(data) {
+				return
+			}
+			fragment := c.fragments[data[i+1]]
+			i = readDelta(data, i+2)
+			for j := 0; j < len(fragment); {
+				j = glyph(fragment, j)
+			}
+			start = i
+		default:
+			i = glyph(data, i)
+		}
+	}
+}
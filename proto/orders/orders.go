@@ -0,0 +1,300 @@
+// Package orders reads the drawing orders of Orders updates, which draw on
+// the desktop with GDI operations instead of sending its bitmaps, and
+// paints them.
+// See [MS-RDPEGDI] 2.2.2
+package orders
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/glog"
+)
+
+// Control flags of a drawing order
+// See [MS-RDPEGDI] 2.2.2.2.1.1.2
+const (
+	TS_STANDARD             = 0x01
+	TS_SECONDARY            = 0x02
+	TS_BOUNDS               = 0x04
+	TS_TYPE_CHANGE          = 0x08
+	TS_DELTA_COORDINATES    = 0x10
+	TS_ZERO_BOUNDS_DELTAS   = 0x20
+	TS_ZERO_FIELD_BYTE_BIT0 = 0x40
+	TS_ZERO_FIELD_BYTE_BIT1 = 0x80
+)
+
+// Primary drawing order types
+// See [MS-RDPEGDI] 2.2.2.2.1.1.2
+const (
+	TS_ENC_DSTBLT_ORDER     = 0x00
+	TS_ENC_PATBLT_ORDER     = 0x01
+	TS_ENC_SCRBLT_ORDER     = 0x02
+	TS_ENC_MEMBLT_ORDER     = 0x0D
+	TS_ENC_MEM3BLT_ORDER    = 0x0E
+	TS_ENC_LINETO_ORDER     = 0x09
+	TS_ENC_OPAQUERECT_ORDER = 0x0A
+	TS_ENC_INDEX_ORDER      = 0x1B
+)
+
+// Secondary drawing order types
+// See [MS-RDPEGDI] 2.2.2.2.1.2.1.1
+const (
+	TS_CACHE_BITMAP_UNCOMPRESSED      = 0x00
+	TS_CACHE_BITMAP_COMPRESSED        = 0x02
+	TS_CACHE_GLYPH                    = 0x03
+	TS_CACHE_BITMAP_UNCOMPRESSED_REV2 = 0x04
+	TS_CACHE_BITMAP_COMPRESSED_REV2   = 0x05
+)
+
+// Alternate secondary drawing order types
+// See [MS-RDPEGDI] 2.2.2.2.1.3.1.1
+const (
+	TS_ALTSEC_SWITCH_SURFACE       = 0x00
+	TS_ALTSEC_CREATE_OFFSCR_BITMAP = 0x01
+	TS_ALTSEC_WINDOW               = 0x0B
+	TS_ALTSEC_FRAME_MARKER         = 0x0D
+)
+
+// Order is a drawing order read by a Decoder: a *Primary drawing order, or
+// a secondary or alternate secondary order
+type Order interface {
+	iOrder()
+}
+
+// Primary is a primary drawing order, clipped to Bounds when they are set
+type Primary struct {
+	Bounds *image.Rectangle
+	Order  PrimaryOrder
+}
+
+func (o *Primary) iOrder() {}
+
+// PrimaryOrder is one of the primary drawing orders, e.g. *OpaqueRect
+type PrimaryOrder interface {
+	// Type returns the order type, one of the TS_ENC_*_ORDER constants
+	Type() uint8
+
+	// fieldBytes returns the size of the field flags of the order
+	fieldBytes() int
+
+	// read reads the fields present into the order, which keeps the
+	// fields of the previous order of its type otherwise
+	read(f *fields)
+
+	// clone returns a copy of the order, so that the next order of its
+	// type does not change what was returned
+	clone() PrimaryOrder
+}
+
+// Decoder reads drawing orders. Primary orders leave out what did not
+// change since the previous order, so one Decoder reads all the orders of a
+// connection.
+type Decoder struct {
+	orderType uint8 // of the previous primary order
+	primary   map[uint8]PrimaryOrder
+
+	// inclusive bounds of the previous bounded primary order
+	left, top, right, bottom int16
+}
+
+// NewDecoder creates a Decoder for a new connection
+func NewDecoder() *Decoder {
+	return &Decoder{
+		orderType: TS_ENC_PATBLT_ORDER,
+		primary: map[uint8]PrimaryOrder{
+			TS_ENC_DSTBLT_ORDER:     &DstBlt{},
+			TS_ENC_PATBLT_ORDER:     &PatBlt{},
+			TS_ENC_SCRBLT_ORDER:     &ScrBlt{},
+			TS_ENC_MEMBLT_ORDER:     &MemBlt{},
+			TS_ENC_MEM3BLT_ORDER:    &Mem3Blt{},
+			TS_ENC_LINETO_ORDER:     &LineTo{},
+			TS_ENC_OPAQUERECT_ORDER: &OpaqueRect{},
+			TS_ENC_INDEX_ORDER:      &GlyphIndex{},
+		},
+	}
+}
+
+// Read reads the orders of an Orders update, data being count orders.
+// Primary and alternate secondary orders have no length, so an order the
+// decoder does not know ends the reading; the orders before it are returned
+// with the error.
+func (d *Decoder) Read(data []byte, count int) (orders []Order, err error) {
+	err = core.Try(func() {
+		r := bytes.NewReader(data)
+		for i := 0; i < count; i++ {
+			var controlFlags uint8
+			core.ReadLE(r, &controlFlags)
+			var order Order
+			switch controlFlags & (TS_STANDARD | TS_SECONDARY) {
+			case TS_STANDARD:
+				order = d.readPrimary(r, controlFlags)
+			case TS_STANDARD | TS_SECONDARY:
+				order = readSecondary(r)
+			case TS_SECONDARY:
+				order = readAltSec(r, controlFlags)
+			default:
+				core.Throw(fmt.Errorf("invalid drawing order control flags %#x", controlFlags))
+			}
+			if order != nil {
+				orders = append(orders, order)
+			}
+		}
+	})
+	return orders, err
+}
+
+// readPrimary reads a primary drawing order
+// See [MS-RDPEGDI] 2.2.2.2.1.1.2
+func (d *Decoder) readPrimary(r *bytes.Reader, controlFlags uint8) Order {
+	if controlFlags&TS_TYPE_CHANGE != 0 {
+		core.ReadLE(r, &d.orderType)
+	}
+	order, ok := d.primary[d.orderType]
+	if !ok {
+		core.Throw(fmt.Errorf("primary drawing order %#x not supported", d.orderType))
+	}
+
+	// the field flags bytes that are zero at the end are left out
+	f := &fields{r: r, delta: controlFlags&TS_DELTA_COORDINATES != 0}
+	size := order.fieldBytes() - int(controlFlags>>6)
+	for i := 0; i < size; i++ {
+		var b uint8
+		core.ReadLE(r, &b)
+		f.flags |= uint32(b) << (8 * i)
+	}
+
+	primary := &Primary{}
+	if controlFlags&TS_BOUNDS != 0 {
+		if controlFlags&TS_ZERO_BOUNDS_DELTAS == 0 {
+			d.readBounds(r)
+		}
+		bounds := image.Rect(int(d.left), int(d.top), int(d.right)+1, int(d.bottom)+1)
+		primary.Bounds = &bounds
+	}
+	order.read(f)
+	primary.Order = order.clone()
+	return primary
+}
+
+// readBounds reads the bounds of a primary drawing order, each given
+// anew or as a change of the previous one
+// See [MS-RDPEGDI] 2.2.2.2.1.1.1.4
+func (d *Decoder) readBounds(r *bytes.Reader) {
+	var flags uint8
+	core.ReadLE(r, &flags)
+	for i, v := range []*int16{&d.left, &d.top, &d.right, &d.bottom} {
+		switch {
+		case flags&(0x01<<i) != 0:
+			core.ReadLE(r, v)
+		case flags&(0x10<<i) != 0:
+			var delta int8
+			core.ReadLE(r, &delta)
+			*v += int16(delta)
+		}
+	}
+}
+
+// readSecondary reads a secondary drawing order, skipping those it does
+// not know
+// See [MS-RDPEGDI] 2.2.2.2.1.2.1.1
+func readSecondary(r *bytes.Reader) Order {
+	var header struct {
+		OrderLength int16
+		ExtraFlags  uint16
+		OrderType   uint8
+	}
+	core.ReadLE(r, &header)
+	// the length leaves out 13 bytes, 6 of them of the header
+	size := int(header.OrderLength) + 7
+	core.ThrowIf(size < 0 || size > r.Len(), fmt.Errorf("invalid secondary drawing order length %d", header.OrderLength))
+	body := bytes.NewReader(core.ReadBytes(r, size))
+	switch header.OrderType {
+	case TS_CACHE_BITMAP_UNCOMPRESSED, TS_CACHE_BITMAP_COMPRESSED:
+		return readCacheBitmap(body, header.OrderType, header.ExtraFlags)
+	case TS_CACHE_GLYPH:
+		return readCacheGlyph(body, header.ExtraFlags)
+	case TS_CACHE_BITMAP_UNCOMPRESSED_REV2, TS_CACHE_BITMAP_COMPRESSED_REV2:
+		return readCacheBitmapRev2(body, header.OrderType, header.ExtraFlags)
+	}
+	glog.Debugf("secondary drawing order %#x skipped", header.OrderType)
+	return nil
+}
+
+// readAltSec reads an alternate secondary drawing order, its type being
+// in the control flags
+// See [MS-RDPEGDI] 2.2.2.2.1.3.1.1
+func readAltSec(r *bytes.Reader, controlFlags uint8) Order {
+	switch orderType := controlFlags >> 2; orderType {
+	case TS_ALTSEC_SWITCH_SURFACE:
+		o := &SwitchSurface{}
+		core.ReadLE(r, &o.BitmapId)
+		return o
+	case TS_ALTSEC_CREATE_OFFSCR_BITMAP:
+		return readCreateOffscreenBitmap(r)
+	case TS_ALTSEC_WINDOW:
+		var size uint16
+		core.ReadLE(r, &size)
+		// the size counts the control flags and itself
+		core.ThrowIf(size < 3 || int(size)-3 > r.Len(), fmt.Errorf("invalid window order size %d", size))
+		data := append([]byte{controlFlags}, core.ToLE(size)...)
+		return &Window{Data: append(data, core.ReadBytes(r, int(size)-3)...)}
+	case TS_ALTSEC_FRAME_MARKER:
+		var action uint32
+		core.ReadLE(r, &action)
+		return nil
+	default:
+		core.Throw(fmt.Errorf("alternate secondary drawing order %#x not supported", orderType))
+	}
+	return nil
+}
+
+// Window is a Windowing Alternate Secondary Drawing Order of RemoteApp,
+// whole, to be read with rail.ReadWindowOrders
+type Window struct {
+	Data []byte
+}
+
+func (o *Window) iOrder() {}
+
+// SwitchSurface makes the orders that follow draw on an offscreen bitmap,
+// or on the desktop again when BitmapId is SCREEN_BITMAP_SURFACE
+// See [MS-RDPEGDI] 2.2.2.2.1.3.3
+type SwitchSurface struct {
+	BitmapId uint16
+}
+
+func (o *SwitchSurface) iOrder() {}
+
+// SCREEN_BITMAP_SURFACE is the BitmapId of SwitchSurface for the desktop
+const SCREEN_BITMAP_SURFACE = 0xFFFF
+
+// CreateOffscreenBitmap creates an offscreen bitmap, after deleting those
+// listed in Delete
+// See [MS-RDPEGDI] 2.2.2.2.1.3.2
+type CreateOffscreenBitmap struct {
+	Id     uint16
+	Width  uint16
+	Height uint16
+	Delete []uint16
+}
+
+func (o *CreateOffscreenBitmap) iOrder() {}
+
+func readCreateOffscreenBitmap(r *bytes.Reader) *CreateOffscreenBitmap {
+	var flags uint16
+	o := &CreateOffscreenBitmap{}
+	core.ReadLE(r, &flags)
+	core.ReadLE(r, &o.Width)
+	core.ReadLE(r, &o.Height)
+	o.Id = flags & 0x7FFF
+	if flags&0x8000 != 0 {
+		var count uint16
+		core.ReadLE(r, &count)
+		o.Delete = make([]uint16, count)
+		core.ReadLE(r, o.Delete)
+	}
+	return o
+}
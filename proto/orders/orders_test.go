@@ -0,0 +1,230 @@
+package orders
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// build concatenates the little endian encodings of values
+func build(values ...any) []byte {
+	b := new(bytes.Buffer)
+	for _, v := range values {
+		core.WriteLE(b, v)
+	}
+	return b.Bytes()
+}
+
+// cacheGlyph builds a Cache Glyph order of one glyph, 8 pixels wide and
+// drawn 2 pixels above the text origin
+func cacheGlyph(index uint16, rows ...byte) []byte {
+	data := append(rows, make([]byte, (4-len(rows)%4)%4)...)
+	body := build(uint8(7), uint8(1), index, int16(0), int16(-2), uint16(8), uint16(len(rows)), data)
+	return append(build(uint8(TS_STANDARD|TS_SECONDARY), int16(len(body)-7), uint16(0), uint8(TS_CACHE_GLYPH)), body...)
+}
+
+func TestDecoder(t *testing.T) {
+	d := NewDecoder()
+	data := build(
+		// opaque rect with all its fields
+		uint8(TS_STANDARD|TS_TYPE_CHANGE), uint8(TS_ENC_OPAQUERECT_ORDER), uint8(0x7F),
+		[4]int16{10, 20, 30, 40}, [3]uint8{1, 2, 3},
+		// moved by a delta, the rest kept
+		uint8(TS_STANDARD|TS_DELTA_COORDINATES), uint8(0x01), int8(-5),
+		// bounded, no field changed
+		uint8(TS_STANDARD|TS_BOUNDS|TS_ZERO_FIELD_BYTE_BIT0), uint8(0x0F), [4]int16{0, 0, 99, 49},
+		// bounds changed by deltas
+		uint8(TS_STANDARD|TS_BOUNDS|TS_ZERO_FIELD_BYTE_BIT0), uint8(0x20), int8(1),
+	)
+	data = append(data, cacheGlyph(3, 0xFF)...)
+	data = append(data, build(uint8(TS_ALTSEC_SWITCH_SURFACE<<2|TS_SECONDARY), uint16(5))...)
+	orders, err := d.Read(data, 6)
+	require.NoError(t, err)
+	require.Len(t, orders, 6)
+
+	rects := make([]*OpaqueRect, 4)
+	for i := range rects {
+		rects[i] = orders[i].(*Primary).Order.(*OpaqueRect)
+	}
+	assert.Equal(t, &OpaqueRect{Rect: Rect{10, 20, 30, 40}, Color: 0x030201}, rects[0])
+	assert.Equal(t, &OpaqueRect{Rect: Rect{5, 20, 30, 40}, Color: 0x030201}, rects[1])
+	assert.Equal(t, rects[1], rects[2])
+	assert.Nil(t, orders[1].(*Primary).Bounds)
+	assert.Equal(t, image.Rect(0, 0, 100, 50), *orders[2].(*Primary).Bounds)
+	assert.Equal(t, image.Rect(0, 1, 100, 50), *orders[3].(*Primary).Bounds)
+
+	glyph := orders[4].(*CacheGlyph)
+	assert.Equal(t, uint8(7), glyph.CacheId)
+	assert.Equal(t, []uint16{3}, glyph.Indices)
+	assert.Equal(t, &Glyph{X: 0, Y: -2, Width: 8, Height: 1, Data: []byte{0xFF, 0, 0, 0}}, glyph.Glyphs[0])
+	assert.Equal(t, &SwitchSurface{BitmapId: 5}, orders[5])
+
+	// the type is kept from the previous order
+	orders, err = d.Read(build(uint8(TS_STANDARD), uint8(0x01), int16(7)), 1)
+	require.NoError(t, err)
+	assert.Equal(t, int16(7), orders[0].(*Primary).Order.(*OpaqueRect).Left)
+	assert.Equal(t, int16(5), rects[1].Left, "orders returned before are not changed")
+
+	orders, err = d.Read(append(build(uint8(TS_STANDARD), uint8(0x01), int16(8)), build(uint8(TS_STANDARD|TS_TYPE_CHANGE), uint8(0x1F))...), 2)
+	assert.Error(t, err, "unknown primary order")
+	assert.Len(t, orders, 1)
+}
+
+func TestLayout(t *testing.T) {
+	var cache GlyphCache
+	cache.Put(&CacheGlyph{CacheId: 1, Indices: []uint16{1, 2}, Glyphs: []*Glyph{{Y: -2, Width: 4}, {X: 1, Width: 6}}})
+
+	type position struct {
+		width, x, y int
+	}
+	layout := func(o *GlyphIndex) (positions []position) {
+		o.CacheId = 1
+		cache.Layout(o, func(g *Glyph, x, y int) { positions = append(positions, position{int(g.Width), x, y}) })
+		return positions
+	}
+
+	// each glyph followed by its distance from the previous one, the two
+	// first added as fragment 9 then used again 20 pixels further
+	positions := layout(&GlyphIndex{X: 10, Y: 20, GlyphIndices: []byte{1, 0, 2, 5, 0xFF, 9, 4, 0xFE, 9, 20, 3, 0x80, 0x00, 0x01}})
+	assert.Equal(t, []position{{4, 10, 18}, {6, 16, 20}, {4, 35, 18}, {6, 41, 20}}, positions, "glyph 3 is not cached")
+
+	positions = layout(&GlyphIndex{X: 10, FlAccel: SO_CHAR_INC_EQUAL_BM_BASE, GlyphIndices: []byte{1, 2, 1}})
+	assert.Equal(t, []position{{4, 10, -2}, {6, 15, 0}, {4, 20, -2}}, positions)
+
+	positions = layout(&GlyphIndex{Y: 10, FlAccel: SO_VERTICAL, CharInc: 8, GlyphIndices: []byte{2, 2, 0xFE, 9}})
+	assert.Equal(t, []position{{6, 1, 10}, {6, 1, 18}, {4, 0, 24}, {6, 1, 34}}, positions)
+}
+
+func TestPainter(t *testing.T) {
+	p := NewPainter()
+	screen := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	paint := func(order Order) image.Rectangle { return p.Paint(screen, order) }
+	at := func(x, y int) uint32 { return pixel(screen, x, y) }
+
+	bounds := image.Rect(0, 0, 16, 16)
+	assert.Equal(t, image.Rect(2, 2, 16, 6), paint(&Primary{Bounds: &bounds, Order: &OpaqueRect{Rect: Rect{2, 2, 20, 4}, Color: 0x0000FF}}))
+	assert.Equal(t, uint32(0xFF0000), at(2, 2))
+	assert.Equal(t, uint32(0), at(16, 2), "clipped")
+
+	// the source overlaps the destination
+	assert.Equal(t, image.Rect(4, 2, 20, 6), paint(&Primary{Order: &ScrBlt{Rect: Rect{4, 2, 16, 4}, Rop: ROP3_SRCCOPY, XSrc: 2, YSrc: 2}}))
+	assert.Equal(t, uint32(0xFF0000), at(17, 2))
+	assert.Equal(t, uint32(0), at(18, 2))
+
+	paint(&Primary{Order: &DstBlt{Rect: Rect{0, 2, 3, 1}, Rop: ROP3_DSTINVERT}})
+	assert.Equal(t, []uint32{0xFFFFFF, 0xFFFFFF, 0x00FFFF}, []uint32{at(0, 2), at(1, 2), at(2, 2)})
+
+	// hatched brush of horizontal lines, the fourth row being the fore color
+	paint(&Primary{Order: &PatBlt{Rect: Rect{24, 0, 8, 8}, Rop: ROP3_PATCOPY, ForeColor: 0x00FF00, BackColor: 0x0000FF, Brush: Brush{Style: BS_HATCHED}}})
+	assert.Equal(t, uint32(0x00FF00), at(24, 3))
+	assert.Equal(t, uint32(0xFF0000), at(24, 4))
+
+	assert.Equal(t, image.Rect(0, 10, 4, 11), paint(&Primary{Order: &LineTo{XStart: 0, YStart: 10, XEnd: 4, YEnd: 10, Rop2: R2_COPYPEN, PenColor: 0xFFFFFF}}))
+	assert.Equal(t, uint32(0xFFFFFF), at(3, 10))
+	assert.Equal(t, uint32(0), at(4, 10), "end point left out")
+	assert.Equal(t, image.Rect(0, 11, 4, 15), paint(&Primary{Order: &LineTo{XStart: 0, YStart: 11, XEnd: 4, YEnd: 15, Rop2: R2_COPYPEN, PenColor: 0xFFFFFF}}))
+	assert.Equal(t, uint32(0xFFFFFF), at(2, 13))
+
+	// text over an opaque rectangle, clipped by the background rectangle
+	paint(&CacheGlyph{CacheId: 0, Indices: []uint16{1}, Glyphs: []*Glyph{{Y: -2, Width: 8, Height: 2, Data: []byte{0xFF, 0x81, 0, 0}}}})
+	text := &GlyphIndex{
+		FlAccel: SO_CHAR_INC_EQUAL_BM_BASE, OpRedundant: 1, BackColor: 0xFFFFFF, ForeColor: 0x0000FF,
+		BkLeft: 0, BkTop: 8, BkRight: 13, BkBottom: 9, X: 0, Y: 10, GlyphIndices: []byte{1, 1},
+	}
+	assert.Equal(t, image.Rect(0, 8, 14, 10), paint(&Primary{Order: text}))
+	assert.Equal(t, []uint32{0xFFFFFF, 0xFFFFFF, 0xFF0000, 0xFFFFFF, 0xFF0000}, []uint32{at(0, 9), at(7, 9), at(9, 9), at(8, 9), at(13, 9)})
+	assert.Equal(t, uint32(0), at(14, 9), "clipped")
+
+	// orders drawing offscreen leave the desktop alone
+	paint(&CreateOffscreenBitmap{Id: 2, Width: 4, Height: 4})
+	paint(&SwitchSurface{BitmapId: 2})
+	assert.True(t, paint(&Primary{Order: &OpaqueRect{Rect: Rect{0, 0, 4, 4}, Color: 0xFFFFFF}}).Empty())
+	assert.Equal(t, uint32(0xFFFFFF), pixel(p.offscreen[2], 3, 3))
+	assert.Equal(t, uint32(0xFFFFFF), at(0, 2))
+	paint(&SwitchSurface{BitmapId: SCREEN_BITMAP_SURFACE})
+	paint(&CreateOffscreenBitmap{Id: 3, Width: 1, Height: 1, Delete: []uint16{2}})
+	assert.Len(t, p.offscreen, 1)
+
+	// but no more than the offscreen cache holds
+	p.OffscreenCacheSize, p.OffscreenCacheEntries = 4*4*4, 8
+	paint(&CreateOffscreenBitmap{Id: 8, Width: 1, Height: 1})
+	paint(&CreateOffscreenBitmap{Id: 4, Width: 0xFFFF, Height: 0xFFFF})
+	paint(&CreateOffscreenBitmap{Id: 5, Width: 4, Height: 4})
+	assert.Len(t, p.offscreen, 1)
+	paint(&CreateOffscreenBitmap{Id: 5, Width: 4, Height: 4, Delete: []uint16{3}})
+	assert.Len(t, p.offscreen, 1)
+	assert.NotNil(t, p.offscreen[5])
+}
+
+func TestRop(t *testing.T) {
+	p, s, d := uint32(0x123456), uint32(0xABCDEF), uint32(0x0F0F0F)
+	assert.Equal(t, ((d^p)&s)^p, rop3(0xB8, p, s, d))
+	assert.Equal(t, ^(s|d)&0xFFFFFF, rop3(0x11, p, s, d))
+	assert.Equal(t, uint8(ROP3_PATCOPY), rop2(R2_COPYPEN))
+	assert.Equal(t, uint8(ROP3_PATINVERT), rop2(7), "R2_XORPEN")
+	assert.Equal(t, uint8(ROP3_DST), rop2(11), "R2_NOP")
+
+	assert.Equal(t, color.RGBA{0xFF, 0, 0, 0xFF}, Color(0xF800).RGBA(16, nil))
+	assert.Equal(t, color.RGBA{0, 0xFF, 0, 0xFF}, Color(0x03E0).RGBA(15, nil))
+	assert.Equal(t, color.RGBA{1, 2, 3, 0xFF}, Color(0x030201).RGBA(24, nil))
+	assert.Equal(t, color.RGBA{9, 9, 9, 0xFF}, Color(1).RGBA(8, color.Palette{color.Black, color.RGBA{9, 9, 9, 0xFF}}))
+}
+
+func TestCacheBitmap(t *testing.T) {
+	// revision 1, compressed with a header the length counts
+	rev1 := build(uint8(2), uint8(0), uint8(4), uint8(2), uint8(16), uint16(8+3), uint16(9), [8]byte{}, [3]byte{1, 2, 3})
+	// revision 2, with a persistent key, a square 200 pixels wide whose
+	// width takes two bytes, a length of one byte and index 300 of two
+	rev2 := build([2]uint32{0x11, 0x22}, [2]uint8{0x80, 200}, uint8(2), [2]uint8{0x81, 0x2C}, [2]uint8{5, 6})
+	flags := uint16(1 | 0x4<<3 | (CBR2_PERSISTENT_KEY_PRESENT|CBR2_HEIGHT_SAME_AS_WIDTH|CBR2_NO_BITMAP_COMPRESSION_HDR)<<7)
+	data := append(build(uint8(TS_STANDARD|TS_SECONDARY), int16(len(rev1)-7), uint16(0), uint8(TS_CACHE_BITMAP_COMPRESSED)), rev1...)
+	data = append(data, build(uint8(TS_STANDARD|TS_SECONDARY), int16(len(rev2)-7), flags, uint8(TS_CACHE_BITMAP_COMPRESSED_REV2))...)
+	data = append(data, rev2...)
+
+	orders, err := NewDecoder().Read(data, 2)
+	require.NoError(t, err)
+	require.Len(t, orders, 2)
+	assert.Equal(t, &CacheBitmap{CacheId: 2, CacheIndex: 9, Width: 4, Height: 2, BitsPerPixel: 16, Compressed: true, Data: []byte{1, 2, 3}}, orders[0])
+	assert.Equal(t, &CacheBitmap{CacheId: 1, CacheIndex: 300, Key1: 0x11, Key2: 0x22, Width: 200, Height: 200, BitsPerPixel: 16, Compressed: true, Data: []byte{5, 6}}, orders[1])
+	assert.Equal(t, uint32(0x010203), readFourByteUnsigned(bytes.NewReader([]byte{0x81, 0x02, 0x03})))
+}
+
+func TestMemBlt(t *testing.T) {
+	cached := image.NewRGBA(image.Rect(0, 0, 4, 1))
+	setPixel(cached, 2, 0, 0x00FF00)
+	p := NewPainter()
+	p.Bitmap = func(cacheId uint8, index uint16) *image.RGBA {
+		if cacheId == 1 && index == 7 {
+			return cached
+		}
+		return nil
+	}
+	screen := image.NewRGBA(image.Rect(0, 0, 8, 8))
+
+	order := build(uint8(TS_STANDARD|TS_TYPE_CHANGE), uint8(TS_ENC_MEMBLT_ORDER), uint16(0x01FF),
+		uint16(0x0201), [4]int16{4, 4, 2, 1}, uint8(ROP3_SRCCOPY), [2]int16{2, 0}, uint16(7))
+	orders, err := NewDecoder().Read(order, 1)
+	require.NoError(t, err)
+	memBlt := orders[0].(*Primary).Order.(*MemBlt)
+	assert.Equal(t, &MemBlt{Rect: Rect{4, 4, 2, 1}, CacheId: 0x0201, Rop: ROP3_SRCCOPY, XSrc: 2, CacheIndex: 7}, memBlt)
+	assert.Equal(t, image.Rect(4, 4, 6, 5), p.Paint(screen, orders[0]))
+	assert.Equal(t, uint32(0x00FF00), pixel(screen, 4, 4))
+
+	// mixed with a brush, where the bitmap is black
+	mem3Blt := &Mem3Blt{MemBlt: MemBlt{Rect: Rect{0, 0, 2, 1}, CacheId: 1, Rop: 0xB8, CacheIndex: 7}, ForeColor: 0x0000FF}
+	p.Paint(screen, &Primary{Order: mem3Blt})
+	assert.Equal(t, uint32(0xFF0000), pixel(screen, 0, 0))
+
+	// from an offscreen bitmap
+	p.Paint(screen, &CreateOffscreenBitmap{Id: 3, Width: 1, Height: 1})
+	p.offscreen[3].Pix[0] = 0xFF
+	p.Paint(screen, &Primary{Order: &MemBlt{Rect: Rect{7, 7, 1, 1}, CacheId: TS_BITMAPCACHE_SCREEN_ID, Rop: ROP3_SRCCOPY, CacheIndex: 3}})
+	assert.Equal(t, uint32(0xFF0000), pixel(screen, 7, 7))
+
+	assert.True(t, p.Paint(screen, &Primary{Order: &MemBlt{Rect: Rect{0, 0, 1, 1}, CacheId: 2, Rop: ROP3_SRCCOPY}}).Empty(), "not cached")
+}
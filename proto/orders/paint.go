@@ -0,0 +1,266 @@
+package orders
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/kdsmith18542/gordp/glog"
+	"github.com/kdsmith18542/gordp/proto/capability"
+)
+
+// Painter paints drawing orders on the desktop and on the offscreen
+// bitmaps the orders create. Like a Decoder, one Painter follows all the
+// orders of a connection, which fill its caches.
+type Painter struct {
+	// BitsPerPixel and Palette are those of the session, giving the colors
+	// of the orders
+	BitsPerPixel int
+	Palette      color.Palette
+
+	// Bitmap returns the bitmap of a cell of the bitmap cache for MemBlt and
+	// Mem3Blt orders to copy, nil when there is none. The orders filling the
+	// cache are left to its owner, Paint ignores them.
+	Bitmap func(cacheId uint8, index uint16) *image.RGBA
+
+	// OffscreenCacheSize, in bytes at BitsPerPixel, and
+	// OffscreenCacheEntries bound the offscreen bitmaps as announced to the
+	// server. Bitmaps beyond them are not created.
+	OffscreenCacheSize    int
+	OffscreenCacheEntries int
+
+	glyphs        GlyphCache
+	offscreen     map[uint16]*image.RGBA
+	offscreenSize int    // bytes of the offscreen bitmaps
+	target        uint16 // surface the primary orders draw on
+}
+
+// NewPainter creates a Painter drawing on the desktop, with the largest
+// offscreen cache the protocol allows
+func NewPainter() *Painter {
+	return &Painter{
+		BitsPerPixel:          32,
+		OffscreenCacheSize:    capability.MaxOffscreenCacheSize * 1024,
+		OffscreenCacheEntries: capability.MaxOffscreenCacheEntries,
+		offscreen:             make(map[uint16]*image.RGBA),
+		target:                SCREEN_BITMAP_SURFACE,
+	}
+}
+
+// Paint paints order on screen, the desktop, and returns the part of it
+// that changed. Orders drawing on an offscreen bitmap and those filling a
+// cache change nothing of the desktop.
+func (p *Painter) Paint(screen *image.RGBA, order Order) image.Rectangle {
+	switch o := order.(type) {
+	case *CacheGlyph:
+		p.glyphs.Put(o)
+	case *CreateOffscreenBitmap:
+		for _, id := range o.Delete {
+			p.deleteOffscreen(id)
+		}
+		p.deleteOffscreen(o.Id)
+		size := p.offscreenBytes(image.Rect(0, 0, int(o.Width), int(o.Height)))
+		if int(o.Id) >= p.OffscreenCacheEntries || p.offscreenSize+size > p.OffscreenCacheSize {
+			glog.Warnf("offscreen bitmap %d of %dx%d exceeds the offscreen cache", o.Id, o.Width, o.Height)
+			return image.Rectangle{}
+		}
+		img := image.NewRGBA(image.Rect(0, 0, int(o.Width), int(o.Height)))
+		draw.Draw(img, img.Rect, image.Black, image.Point{}, draw.Src)
+		p.offscreen[o.Id] = img
+		p.offscreenSize += size
+	case *SwitchSurface:
+		p.target = o.BitmapId
+	case *Primary:
+		img := screen
+		if p.target != SCREEN_BITMAP_SURFACE {
+			img = p.offscreen[p.target]
+			if img == nil {
+				glog.Warnf("offscreen bitmap %d to draw on does not exist", p.target)
+				return image.Rectangle{}
+			}
+		}
+		clip := img.Rect
+		if o.Bounds != nil {
+			clip = clip.Intersect(*o.Bounds)
+		}
+		r := p.paint(img, clip, o.Order)
+		if img != screen {
+			return image.Rectangle{}
+		}
+		return r
+	}
+	return image.Rectangle{}
+}
+
+// deleteOffscreen deletes an offscreen bitmap, if it exists
+func (p *Painter) deleteOffscreen(id uint16) {
+	if img, ok := p.offscreen[id]; ok {
+		p.offscreenSize -= p.offscreenBytes(img.Rect)
+		delete(p.offscreen, id)
+	}
+}
+
+// offscreenBytes returns the bytes an offscreen bitmap of size r takes in
+// the offscreen cache, at the color depth of the session
+func (p *Painter) offscreenBytes(r image.Rectangle) int {
+	return r.Dx() * r.Dy() * ((p.BitsPerPixel + 7) / 8)
+}
+
+// paint paints a primary order on img, within clip
+func (p *Painter) paint(img *image.RGBA, clip image.Rectangle, order PrimaryOrder) image.Rectangle {
+	switch o := order.(type) {
+	case *DstBlt:
+		r := o.Rectangle().Intersect(clip)
+		blt(img, r, o.Rop, nil, nil)
+		return r
+	case *PatBlt:
+		if o.Brush.Style == BS_NULL {
+			return image.Rectangle{}
+		}
+		r := o.Rectangle().Intersect(clip)
+		blt(img, r, o.Rop, o.Brush.pattern(p.rgb(o.ForeColor), p.rgb(o.BackColor)), nil)
+		return r
+	case *ScrBlt:
+		r := o.Rectangle().Intersect(clip)
+		// the source may overlap the rectangle, so it is copied first
+		src := image.NewRGBA(r.Sub(r.Min))
+		offset := image.Pt(int(o.XSrc)-int(o.Left), int(o.YSrc)-int(o.Top))
+		draw.Draw(src, src.Rect, img, r.Min.Add(offset), draw.Src)
+		blt(img, r, o.Rop, nil, func(x, y int) uint32 { return pixel(src, x-r.Min.X, y-r.Min.Y) })
+		return r
+	case *OpaqueRect:
+		r := o.Rectangle().Intersect(clip)
+		c := p.rgb(o.Color)
+		blt(img, r, ROP3_PATCOPY, func(x, y int) uint32 { return c }, nil)
+		return r
+	case *MemBlt:
+		return p.memBlt(img, clip, o, nil)
+	case *Mem3Blt:
+		return p.memBlt(img, clip, &o.MemBlt, o.Brush.pattern(p.rgb(o.ForeColor), p.rgb(o.BackColor)))
+	case *LineTo:
+		return p.line(img, clip, o)
+	case *GlyphIndex:
+		return p.text(img, clip, o)
+	}
+	return image.Rectangle{}
+}
+
+// rgb returns a color of an order as a pixel
+func (p *Painter) rgb(c Color) uint32 {
+	return c.rgb(p.BitsPerPixel, p.Palette)
+}
+
+// blt sets the pixels of r in img with rop, pattern and source giving the
+// pattern and source pixels when the operation needs them
+func blt(img *image.RGBA, r image.Rectangle, rop uint8, pattern, source func(x, y int) uint32) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			var pat, src uint32
+			if pattern != nil {
+				pat = pattern(x, y)
+			}
+			if source != nil {
+				src = source(x, y)
+			}
+			setPixel(img, x, y, rop3(rop, pat, src, pixel(img, x, y)))
+		}
+	}
+}
+
+// memBlt copies the bitmap of o, its pixels mixed with those of pattern by
+// the raster operation
+func (p *Painter) memBlt(img *image.RGBA, clip image.Rectangle, o *MemBlt, pattern func(x, y int) uint32) image.Rectangle {
+	var src *image.RGBA
+	switch cacheId := uint8(o.CacheId); {
+	case cacheId == TS_BITMAPCACHE_SCREEN_ID:
+		src = p.offscreen[o.CacheIndex]
+	case p.Bitmap != nil:
+		src = p.Bitmap(cacheId, o.CacheIndex)
+	}
+	if src == nil {
+		glog.Warnf("bitmap %d of cache %d to copy not found", o.CacheIndex, uint8(o.CacheId))
+		return image.Rectangle{}
+	}
+	r := o.Rectangle().Intersect(clip)
+	offset := image.Pt(int(o.XSrc)-int(o.Left), int(o.YSrc)-int(o.Top))
+	if o.Rop == ROP3_SRCCOPY {
+		draw.Draw(img, r, src, r.Min.Add(offset), draw.Src)
+		return r
+	}
+	source := func(x, y int) uint32 {
+		if pt := image.Pt(x, y).Add(offset); pt.In(src.Rect) {
+			return pixel(src, pt.X, pt.Y)
+		}
+		return 0
+	}
+	blt(img, r, o.Rop, pattern, source)
+	return r
+}
+
+// line draws a one pixel wide line, leaving out its end point
+func (p *Painter) line(img *image.RGBA, clip image.Rectangle, o *LineTo) image.Rectangle {
+	rop := rop2(o.Rop2)
+	pen := p.rgb(o.PenColor)
+	x, y := int(o.XStart), int(o.YStart)
+	x1, y1 := int(o.XEnd), int(o.YEnd)
+	dx, dy := abs(x1-x), -abs(y1-y)
+	sx, sy := sign(x1-x), sign(y1-y)
+	var changed image.Rectangle
+	for e := dx + dy; x != x1 || y != y1; {
+		if pt := image.Pt(x, y); pt.In(clip) {
+			setPixel(img, x, y, rop3(rop, pen, 0, pixel(img, x, y)))
+			changed = changed.Union(image.Rectangle{pt, pt.Add(image.Pt(1, 1))})
+		}
+		if 2*e >= dy {
+			e += dy
+			x += sx
+		}
+		if 2*e <= dx {
+			e += dx
+			y += sy
+		}
+	}
+	return changed
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func sign(v int) int {
+	switch {
+	case v < 0:
+		return -1
+	case v > 0:
+		return 1
+	}
+	return 0
+}
+
+// text fills the opaque rectangle of o then draws its glyphs over it,
+// within its background rectangle
+func (p *Painter) text(img *image.RGBA, clip image.Rectangle, o *GlyphIndex) image.Rectangle {
+	changed := o.opaque().Intersect(clip)
+	fill := p.rgb(o.ForeColor)
+	blt(img, changed, ROP3_PATCOPY, func(x, y int) uint32 { return fill }, nil)
+
+	if bk := o.background(); !bk.Empty() {
+		clip = clip.Intersect(bk)
+	}
+	fore := p.rgb(o.BackColor)
+	p.glyphs.Layout(o, func(g *Glyph, left, top int) {
+		r := image.Rect(left, top, left+int(g.Width), top+int(g.Height)).Intersect(clip)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if g.set(x-left, y-top) {
+					setPixel(img, x, y, fore)
+				}
+			}
+		}
+		changed = changed.Union(r)
+	})
+	return changed
+}
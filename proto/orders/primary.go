@@ -0,0 +1,333 @@
+package orders
+
+import (
+	"bytes"
+	"image"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// fields reads the fields of a primary drawing order that its field flags
+// mark present
+// See [MS-RDPEGDI] 2.2.2.2.1.1.2
+type fields struct {
+	r     *bytes.Reader
+	flags uint32
+	delta bool // coordinates are changes of the previous ones
+}
+
+// coord reads a coordinate, 2 bytes or a 1 byte change
+// See [MS-RDPEGDI] 2.2.2.2.1.1.1.1
+func (f *fields) coord(field uint32, v *int16) {
+	if f.flags&field == 0 {
+		return
+	}
+	if f.delta {
+		var delta int8
+		core.ReadLE(f.r, &delta)
+		*v += int16(delta)
+		return
+	}
+	core.ReadLE(f.r, v)
+}
+
+// value reads a field of fixed size, e.g. *uint8 or *int16
+func (f *fields) value(field uint32, v any) {
+	if f.flags&field != 0 {
+		core.ReadLE(f.r, v)
+	}
+}
+
+// color reads a 3 bytes Generic Color
+// See [MS-RDPEGDI] 2.2.2.2.1.1.1.8
+func (f *fields) color(field uint32, v *Color) {
+	if f.flags&field != 0 {
+		var rgb [3]byte
+		core.ReadLE(f.r, &rgb)
+		*v = Color(rgb[0]) | Color(rgb[1])<<8 | Color(rgb[2])<<16
+	}
+}
+
+// brush reads the five fields of a brush, the first being field
+// See [MS-RDPEGDI] 2.2.2.2.1.1.1.9
+func (f *fields) brush(field uint32, b *Brush) {
+	f.value(field, &b.OrgX)
+	f.value(field<<1, &b.OrgY)
+	f.value(field<<2, &b.Style)
+	f.value(field<<3, &b.Hatch)
+	f.value(field<<4, &b.Extra)
+}
+
+// Rect is the rectangle of an order, as its left, top, width and height
+type Rect struct {
+	Left, Top, Width, Height int16
+}
+
+// Rectangle returns r as an image.Rectangle
+func (r Rect) Rectangle() image.Rectangle {
+	return image.Rect(int(r.Left), int(r.Top), int(r.Left)+int(r.Width), int(r.Top)+int(r.Height))
+}
+
+// read reads the four coordinates of r, the first being field
+func (r *Rect) read(f *fields, field uint32) {
+	f.coord(field, &r.Left)
+	f.coord(field<<1, &r.Top)
+	f.coord(field<<2, &r.Width)
+	f.coord(field<<3, &r.Height)
+}
+
+// DstBlt paints a rectangle with a raster operation on what it covers
+// See [MS-RDPEGDI] 2.2.2.2.1.1.2.1
+type DstBlt struct {
+	Rect
+	Rop uint8 // ternary raster operation
+}
+
+func (o *DstBlt) Type() uint8         { return TS_ENC_DSTBLT_ORDER }
+func (o *DstBlt) fieldBytes() int     { return 1 }
+func (o *DstBlt) clone() PrimaryOrder { c := *o; return &c }
+
+func (o *DstBlt) read(f *fields) {
+	o.Rect.read(f, 0x01)
+	f.value(0x10, &o.Rop)
+}
+
+// PatBlt paints a rectangle with a brush
+// See [MS-RDPEGDI] 2.2.2.2.1.1.2.3
+type PatBlt struct {
+	Rect
+	Rop       uint8
+	BackColor Color
+	ForeColor Color
+	Brush     Brush
+}
+
+func (o *PatBlt) Type() uint8         { return TS_ENC_PATBLT_ORDER }
+func (o *PatBlt) fieldBytes() int     { return 2 }
+func (o *PatBlt) clone() PrimaryOrder { c := *o; return &c }
+
+func (o *PatBlt) read(f *fields) {
+	o.Rect.read(f, 0x0001)
+	f.value(0x0010, &o.Rop)
+	f.color(0x0020, &o.BackColor)
+	f.color(0x0040, &o.ForeColor)
+	f.brush(0x0080, &o.Brush)
+}
+
+// ScrBlt copies a rectangle of the desktop to another place
+// See [MS-RDPEGDI] 2.2.2.2.1.1.2.7
+type ScrBlt struct {
+	Rect
+	Rop  uint8
+	XSrc int16
+	YSrc int16
+}
+
+func (o *ScrBlt) Type() uint8         { return TS_ENC_SCRBLT_ORDER }
+func (o *ScrBlt) fieldBytes() int     { return 1 }
+func (o *ScrBlt) clone() PrimaryOrder { c := *o; return &c }
+
+func (o *ScrBlt) read(f *fields) {
+	o.Rect.read(f, 0x01)
+	f.value(0x10, &o.Rop)
+	f.coord(0x20, &o.XSrc)
+	f.coord(0x40, &o.YSrc)
+}
+
+// TS_BITMAPCACHE_SCREEN_ID is the cache id of MemBlt and Mem3Blt copying
+// the offscreen bitmap whose id is CacheIndex
+const TS_BITMAPCACHE_SCREEN_ID = 0xFF
+
+// MemBlt copies a bitmap of the bitmap cache, or of an offscreen bitmap,
+// to a rectangle
+// See [MS-RDPEGDI] 2.2.2.2.1.1.2.9
+type MemBlt struct {
+	Rect
+	CacheId    uint16 // the cache in the low byte, then the color table
+	Rop        uint8
+	XSrc       int16 // in the bitmap
+	YSrc       int16
+	CacheIndex uint16
+}
+
+func (o *MemBlt) Type() uint8         { return TS_ENC_MEMBLT_ORDER }
+func (o *MemBlt) fieldBytes() int     { return 2 }
+func (o *MemBlt) clone() PrimaryOrder { c := *o; return &c }
+
+func (o *MemBlt) read(f *fields) {
+	f.value(0x0001, &o.CacheId)
+	o.Rect.read(f, 0x0002)
+	f.value(0x0020, &o.Rop)
+	f.coord(0x0040, &o.XSrc)
+	f.coord(0x0080, &o.YSrc)
+	f.value(0x0100, &o.CacheIndex)
+}
+
+// Mem3Blt copies a bitmap like MemBlt, with a raster operation that mixes
+// in a brush
+// See [MS-RDPEGDI] 2.2.2.2.1.1.2.10
+type Mem3Blt struct {
+	MemBlt
+	BackColor Color
+	ForeColor Color
+	Brush     Brush
+}
+
+func (o *Mem3Blt) Type() uint8         { return TS_ENC_MEM3BLT_ORDER }
+func (o *Mem3Blt) fieldBytes() int     { return 3 }
+func (o *Mem3Blt) clone() PrimaryOrder { c := *o; return &c }
+
+func (o *Mem3Blt) read(f *fields) {
+	f.value(0x000001, &o.CacheId)
+	o.Rect.read(f, 0x000002)
+	f.value(0x000020, &o.Rop)
+	f.coord(0x000040, &o.XSrc)
+	f.coord(0x000080, &o.YSrc)
+	f.color(0x000100, &o.BackColor)
+	f.color(0x000200, &o.ForeColor)
+	f.brush(0x000400, &o.Brush)
+	f.value(0x008000, &o.CacheIndex)
+}
+
+// LineTo draws a line, leaving out its end point
+// See [MS-RDPEGDI] 2.2.2.2.1.1.2.11
+type LineTo struct {
+	BackMode  uint16
+	XStart    int16
+	YStart    int16
+	XEnd      int16
+	YEnd      int16
+	BackColor Color
+	Rop2      uint8 // binary raster operation, R2_COPYPEN for plain drawing
+	PenStyle  uint8
+	PenWidth  uint8
+	PenColor  Color
+}
+
+func (o *LineTo) Type() uint8         { return TS_ENC_LINETO_ORDER }
+func (o *LineTo) fieldBytes() int     { return 2 }
+func (o *LineTo) clone() PrimaryOrder { c := *o; return &c }
+
+func (o *LineTo) read(f *fields) {
+	f.value(0x0001, &o.BackMode)
+	f.coord(0x0002, &o.XStart)
+	f.coord(0x0004, &o.YStart)
+	f.coord(0x0008, &o.XEnd)
+	f.coord(0x0010, &o.YEnd)
+	f.color(0x0020, &o.BackColor)
+	f.value(0x0040, &o.Rop2)
+	f.value(0x0080, &o.PenStyle)
+	f.value(0x0100, &o.PenWidth)
+	f.color(0x0200, &o.PenColor)
+}
+
+// OpaqueRect fills a rectangle with a color
+// See [MS-RDPEGDI] 2.2.2.2.1.1.2.5
+type OpaqueRect struct {
+	Rect
+	Color Color
+}
+
+func (o *OpaqueRect) Type() uint8         { return TS_ENC_OPAQUERECT_ORDER }
+func (o *OpaqueRect) fieldBytes() int     { return 1 }
+func (o *OpaqueRect) clone() PrimaryOrder { c := *o; return &c }
+
+func (o *OpaqueRect) read(f *fields) {
+	o.Rect.read(f, 0x01)
+	// each component of the color is a field of its own
+	for i, field := range []uint32{0x10, 0x20, 0x40} {
+		if f.flags&field != 0 {
+			var b uint8
+			core.ReadLE(f.r, &b)
+			shift := 8 * i
+			o.Color = o.Color&^(0xFF<<shift) | Color(b)<<shift
+		}
+	}
+}
+
+// GlyphIndex draws a string of glyphs of the glyph cache
+// See [MS-RDPEGDI] 2.2.2.2.1.1.2.13
+type GlyphIndex struct {
+	CacheId      uint8
+	FlAccel      uint8 // SO_* flags
+	CharInc      uint8 // advance of fixed pitch fonts, 0 otherwise
+	OpRedundant  uint8 // the opaque rectangle is the background one
+	BackColor    Color // of the text
+	ForeColor    Color // of the opaque rectangle
+	BkLeft       int16 // inclusive background rectangle, clipping the text
+	BkTop        int16
+	BkRight      int16
+	BkBottom     int16
+	OpLeft       int16 // inclusive opaque rectangle, filled before the text
+	OpTop        int16
+	OpRight      int16
+	OpBottom     int16
+	Brush        Brush
+	X            int16 // origin of the text
+	Y            int16
+	GlyphIndices []byte // the glyphs, see GlyphCache.Layout
+}
+
+// Flags of GlyphIndex.FlAccel
+// See [MS-RDPEGDI] 2.2.2.2.1.1.2.13
+const (
+	SO_FLAG_DEFAULT_PLACEMENT = 0x01
+	SO_HORIZONTAL             = 0x02
+	SO_VERTICAL               = 0x04
+	SO_REVERSED               = 0x08
+	SO_ZERO_BEARINGS          = 0x10
+	SO_CHAR_INC_EQUAL_BM_BASE = 0x20
+	SO_MAXEXT_EQUAL_BM_SIDE   = 0x40
+)
+
+func (o *GlyphIndex) Type() uint8         { return TS_ENC_INDEX_ORDER }
+func (o *GlyphIndex) fieldBytes() int     { return 3 }
+func (o *GlyphIndex) clone() PrimaryOrder { c := *o; return &c }
+
+func (o *GlyphIndex) read(f *fields) {
+	f.value(0x000001, &o.CacheId)
+	f.value(0x000002, &o.FlAccel)
+	f.value(0x000004, &o.CharInc)
+	f.value(0x000008, &o.OpRedundant)
+	f.color(0x000010, &o.BackColor)
+	f.color(0x000020, &o.ForeColor)
+	f.value(0x000040, &o.BkLeft)
+	f.value(0x000080, &o.BkTop)
+	f.value(0x000100, &o.BkRight)
+	f.value(0x000200, &o.BkBottom)
+	f.value(0x000400, &o.OpLeft)
+	f.value(0x000800, &o.OpTop)
+	f.value(0x001000, &o.OpRight)
+	f.value(0x002000, &o.OpBottom)
+	f.brush(0x004000, &o.Brush)
+	f.value(0x080000, &o.X)
+	f.value(0x100000, &o.Y)
+	if f.flags&0x200000 != 0 {
+		var size uint8
+		core.ReadLE(f.r, &size)
+		// a new slice, the clones returned before keep theirs
+		o.GlyphIndices = core.ReadBytes(f.r, int(size))
+	}
+}
+
+// background returns the background rectangle, which clips the text
+func (o *GlyphIndex) background() image.Rectangle {
+	return inclusiveRect(o.BkLeft, o.BkTop, o.BkRight, o.BkBottom)
+}
+
+// opaque returns the opaque rectangle, empty when there is none
+func (o *GlyphIndex) opaque() image.Rectangle {
+	if o.OpRedundant != 0 {
+		return o.background()
+	}
+	return inclusiveRect(o.OpLeft, o.OpTop, o.OpRight, o.OpBottom)
+}
+
+// inclusiveRect returns the rectangle of inclusive bounds, empty unless
+// right and bottom are beyond left and top
+func inclusiveRect(left, top, right, bottom int16) image.Rectangle {
+	if right <= left || bottom <= top {
+		return image.Rectangle{}
+	}
+	return image.Rect(int(left), int(top), int(right)+1, int(bottom)+1)
+}
@@ -24,6 +24,32 @@ const (
 	PROTOCOL_RDSAAD           = 0x00000010 //https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/dc43f040-d75d-49a9-90c6-0c9999281136
 )
 
+// Flags of a negotiation request
+// See [MS-RDPBCGR] 2.2.1.1.1
+const (
+	RESTRICTED_ADMIN_MODE_REQUIRED = 0x01
+	CORRELATION_INFO_PRESENT       = 0x08
+)
+
+// Flags of a negotiation response
+// See [MS-RDPBCGR] 2.2.1.2.1
+const (
+	EXTENDED_CLIENT_DATA_SUPPORTED  = 0x01
+	DYNVC_GFX_PROTOCOL_SUPPORTED    = 0x02
+	RESTRICTED_ADMIN_MODE_SUPPORTED = 0x08
+)
+
+// Negotiation failure codes, in Result when Type is TYPE_RDP_NEG_FAILURE
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/1b3920e7-0116-4345-bc45-f2c4ad012761
+const (
+	SSL_REQUIRED_BY_SERVER                = 0x00000001
+	SSL_NOT_ALLOWED_BY_SERVER             = 0x00000002
+	SSL_CERT_NOT_ON_SERVER                = 0x00000003
+	INCONSISTENT_FLAGS                    = 0x00000004
+	HYBRID_REQUIRED_BY_SERVER             = 0x00000005
+	SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER = 0x00000006
+)
+
 // Negotiation
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/b2975bdc-6d56-49ee-9c57-f2ff3a0b6817
 type Negotiation struct {
@@ -35,6 +61,7 @@ type Negotiation struct {
 
 func (nego *Negotiation) Read(r io.Reader) {
 	core.ReadLE(r, nego)
+	core.ThrowIf(nego.Type == TYPE_RDP_NEG_FAILURE, fmt.Errorf("negotiation failure: %#x", nego.Result))
 	core.ThrowIf(nego.Type != TYPE_RDP_NEG_RSP, fmt.Errorf("invalid nego type: %v", nego.Type))
 	core.ThrowIf(nego.Length != 8, fmt.Errorf("invalid nego.length: %v", nego.Length))
 }
@@ -16,6 +16,9 @@ type ClientInfoPDU struct {
 	McsSDrq        *mcs.SendDataRequest // MCS Send Data Request
 	SecurityHeader *sec.TsSecurityHeader
 	InfoPacket     *TsInfoPacket
+
+	// Encryption encrypts the info packet under Standard RDP Security
+	Encryption *sec.Encryption
 }
 
 func NewClientInfoPDU(userId uint16, username, password string) *ClientInfoPDU {
@@ -42,10 +45,11 @@ func NewClientInfoPDU(userId uint16, username, password string) *ClientInfoPDU {
 }
 
 func (pdu *ClientInfoPDU) Serialize() []byte {
+	info := new(bytes.Buffer)
+	pdu.InfoPacket.Write(info)
+	glog.Debugf("client info pdu data: %v - %x", info.Len(), info.Bytes())
 	buff := new(bytes.Buffer)
-	pdu.SecurityHeader.Write(buff)
-	pdu.InfoPacket.Write(buff)
-	glog.Debugf("client info pdu data: %v - %x", buff.Len(), buff.Bytes())
+	sec.WriteSecured(buff, pdu.SecurityHeader.Flags, info.Bytes(), pdu.Encryption)
 	return buff.Bytes()
 }
 
@@ -1,6 +1,8 @@
 package licPdu
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 
 	"github.com/kdsmith18542/gordp/core"
@@ -24,6 +26,7 @@ const (
 
 // flags
 const (
+	PREAMBLE_VERSION_3_0          = 0x03 // RDP 5.0 and later
 	LICENSE_PROTOCOL_VERSION_MASK = 0x0f
 	EXTENDED_ERROR_MSG_SUPPORTED  = 0x80
 )
@@ -47,6 +50,23 @@ type LicenseValidClientData struct {
 	ErrorMessage LicensingErrorMessage
 }
 
+// NewLicenseValidClientData returns the message a server sends to skip
+// licensing
+func NewLicenseValidClientData() *LicenseValidClientData {
+	return &LicenseValidClientData{
+		Preamble:     LicensingPreamble{BMsgType: ERROR_ALERT, Flags: PREAMBLE_VERSION_3_0, WMsgSize: 16},
+		ErrorMessage: LicensingErrorMessage{DwErrorCode: STATUS_VALID_CLIENT, DwStateTransaction: ST_NO_TRANSITION},
+	}
+}
+
+func (d *LicenseValidClientData) Serialize() []byte {
+	buff := new(bytes.Buffer)
+	core.WriteLE(buff, &d.Preamble)
+	core.WriteLE(buff, &d.ErrorMessage)
+	core.WriteLE(buff, [2]uint16{BB_ERROR_BLOB, 0}) // empty bbErrorInfo
+	return buff.Bytes()
+}
+
 func (d *LicenseValidClientData) Read(r io.Reader) {
 	d.Preamble.Read(r)
 	switch d.Preamble.BMsgType {
@@ -61,7 +81,8 @@ func (d *LicenseValidClientData) Read(r io.Reader) {
 			// Valid client with no state transition - this is a normal condition
 			return
 		}
-		fallthrough
+		core.Throw(fmt.Errorf("license error %#x, state transition %#x",
+			d.ErrorMessage.DwErrorCode, d.ErrorMessage.DwStateTransaction))
 	case LICENSE_REQUEST:
 		fallthrough
 	case PLATFORM_CHALLENGE:
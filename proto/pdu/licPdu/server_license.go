@@ -15,6 +15,9 @@ type ServerLicensingPDU struct {
 	McsSDin                mcs.ReceiveDataResponse
 	SecurityHeader         sec.TsSecurityHeader
 	ValidClientLicenseData LicenseValidClientData
+
+	// Encryption decrypts the PDU under Standard RDP Security
+	Encryption *sec.Encryption
 }
 
 func (p *ServerLicensingPDU) Read(r io.Reader) {
@@ -22,8 +25,7 @@ func (p *ServerLicensingPDU) Read(r io.Reader) {
 	channelId, data := p.McsSDin.Read(r)
 	core.ThrowIf(channelId != mcs.MCS_CHANNEL_GLOBAL, "invalid channel id")
 	glog.Debugf("mcs read: [%v] %v - %x", channelId, len(data), data)
-	r = bytes.NewReader(data)
-	p.SecurityHeader.Read(r)
+	p.SecurityHeader, data = sec.ReadSecured(bytes.NewReader(data), p.Encryption)
 	core.ThrowIf(p.SecurityHeader.Flags&sec.SEC_LICENSE_PKT == 0, "invalid security header")
-	p.ValidClientLicenseData.Read(r)
+	p.ValidClientLicenseData.Read(bytes.NewReader(data))
 }
@@ -1,9 +1,11 @@
 package licPdu
 
 import (
+	"fmt"
+	"io"
+
 	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/proto/sec"
-	"io"
 )
 
 /* Client Info Packet Flags */
@@ -27,8 +29,16 @@ const (
 	INFO_AUDIOCAPTURE           = 0x00200000
 	INFO_VIDEO_DISABLE          = 0x00400000
 	INFO_HIDEF_RAIL_SUPPORTED   = 0x02000000
+
+	// CompressionTypeMask holds the highest bulk compression type the
+	// client supports, valid with INFO_COMPRESSION
+	CompressionTypeMask = 0x00001E00
 )
 
+// MaxShellLength is the longest AlternateShell or WorkingDir the server
+// accepts, in bytes of UTF-16 including the null terminator
+const MaxShellLength = 512
+
 // TsInfoPacket
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/732394f5-e2b5-4ac5-8a0a-35345386b0d1
 type TsInfoPacket struct {
@@ -47,6 +57,35 @@ type TsInfoPacket struct {
 	ExtendedInfo     *sec.TsExtendedInfoPacket
 }
 
+// SetCompression advertises bulk compression up to comprType
+func (p *TsInfoPacket) SetCompression(comprType uint8) {
+	p.Flag = p.Flag&^CompressionTypeMask | INFO_COMPRESSION | uint32(comprType)<<9&CompressionTypeMask
+}
+
+// SetAlternateShell sets the program started on logon in place of the
+// desktop shell, and the directory it starts in. Either may be empty.
+func (p *TsInfoPacket) SetAlternateShell(shell, workingDir string) error {
+	encode := func(name, s string) ([]byte, error) {
+		b := append(core.UnicodeEncode(s), 0, 0)
+		if len(b) > MaxShellLength {
+			return nil, fmt.Errorf("%s is %d bytes in UTF-16, at most %d are allowed", name, len(b), MaxShellLength)
+		}
+		return b, nil
+	}
+	shellBytes, err := encode("alternate shell", shell)
+	if err != nil {
+		return err
+	}
+	dirBytes, err := encode("working directory", workingDir)
+	if err != nil {
+		return err
+	}
+
+	p.AlternateShell, p.CbAlternateShell = shellBytes, uint16(len(shellBytes)-2)
+	p.WorkingDir, p.CbWorkingDir = dirBytes, uint16(len(dirBytes)-2)
+	return nil
+}
+
 func (p *TsInfoPacket) Write(w io.Writer) {
 	core.WriteLE(w, p.CodePage)
 	core.WriteLE(w, p.Flag)
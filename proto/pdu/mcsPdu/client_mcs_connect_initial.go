@@ -11,16 +11,15 @@ import (
 // ClientMcsConnectInitialPDU
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/db6713ee-1c0e-4064-a3b3-0fac30b4037b
 type ClientMcsConnectInitialPDU struct {
-	McsCi                           *mcs.ConnectInitial            //  [T125] section 11.1
-	GccCCrq                         mcs.GccConferenceCreateRequest //  [T124] section 8.7
-	ClientCoreData                  *mcs.ClientCoreData
-	ClientSecurityData              *mcs.ClientSecurityData
-	ClientNetworkData               *mcs.ClientNetworkData
-	ClientClusterData               interface{}
-	ClientMonitorData               interface{}
-	ClientMessageChannelData        interface{}
-	ClientMultitransportChannelData interface{}
-	ClientMonitorExtendedData       interface{}
+	McsCi                     *mcs.ConnectInitial            //  [T125] section 11.1
+	GccCCrq                   mcs.GccConferenceCreateRequest //  [T124] section 8.7
+	ClientCoreData            *mcs.ClientCoreData
+	ClientSecurityData        *mcs.ClientSecurityData
+	ClientNetworkData         *mcs.ClientNetworkData
+	ClientClusterData         interface{}
+	ClientMonitorData         *mcs.ClientMonitorData // optional
+	ClientMessageChannelData  interface{}
+	ClientMonitorExtendedData *mcs.ClientMonitorExtendedData // optional
 }
 
 func (pdu *ClientMcsConnectInitialPDU) Write(w io.Writer) {
@@ -28,6 +27,12 @@ func (pdu *ClientMcsConnectInitialPDU) Write(w io.Writer) {
 	arr = append(arr, pdu.ClientCoreData.Serialize())
 	arr = append(arr, pdu.ClientNetworkData.Serialize())
 	arr = append(arr, pdu.ClientSecurityData.Serialize())
+	if pdu.ClientMonitorData != nil {
+		arr = append(arr, pdu.ClientMonitorData.Serialize())
+	}
+	if pdu.ClientMonitorExtendedData != nil {
+		arr = append(arr, pdu.ClientMonitorExtendedData.Serialize())
+	}
 	pdu.McsCi.UserData = pdu.GccCCrq.Serialize(bytes.Join(arr, nil))
 	glog.Debugf("GccCCrq: %x", pdu.McsCi.UserData)
 	x224.Write(w, pdu.McsCi.Serialize())
@@ -2,6 +2,7 @@ package mcsPdu
 
 import (
 	"bytes"
+	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/glog"
 	"github.com/kdsmith18542/gordp/proto/mcs"
 	"github.com/kdsmith18542/gordp/proto/x224"
@@ -20,6 +21,16 @@ type ServerMcsConnectResponsePDU struct {
 	ServerMultitransportChannelData mcs.ServerMultitransportChannelData
 }
 
+// ReadServerMcsConnectResponse reads the PDU like
+// ServerMcsConnectResponsePDU.Read, returning a malformed one as an error
+func ReadServerMcsConnectResponse(r io.Reader) (*ServerMcsConnectResponsePDU, error) {
+	pdu := &ServerMcsConnectResponsePDU{}
+	if err := core.TryRead(func() { pdu.Read(r) }); err != nil {
+		return nil, err
+	}
+	return pdu, nil
+}
+
 func (pdu *ServerMcsConnectResponsePDU) Read(r io.Reader) {
 	data := x224.Read(r)
 	glog.Debugf("recv McsConnectResponse: %v", len(data))
@@ -42,6 +53,12 @@ func (pdu *ServerMcsConnectResponsePDU) Read(r io.Reader) {
 			pdu.ServerSecurityData.Read(rd)
 		case mcs.SC_NET:
 			pdu.ServerNetworkData.Read(rd)
+		case mcs.SC_MCS_MSGCHANNEL:
+			pdu.ServerMessageChannelData.Header = header
+			pdu.ServerMessageChannelData.Read(rd)
+		case mcs.SC_MULTITRANSPORT:
+			pdu.ServerMultitransportChannelData.Header = header
+			pdu.ServerMultitransportChannelData.Read(rd)
 		}
 	}
 }
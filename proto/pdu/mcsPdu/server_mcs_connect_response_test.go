@@ -0,0 +1,74 @@
+package mcsPdu
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/proto/mcs"
+	"github.com/kdsmith18542/gordp/proto/x224"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectResponse makes the packet of a Connect Response carrying the
+// given server data blocks
+func connectResponse(blocks ...[]byte) []byte {
+	userData := (&mcs.GccConferenceCreateResponse{}).Serialize(bytes.Join(blocks, nil))
+	packet := new(bytes.Buffer)
+	x224.Write(packet, (&mcs.ConnectResponse{UserData: userData}).Serialize())
+	return packet.Bytes()
+}
+
+func TestServerMcsConnectResponsePDU(t *testing.T) {
+	network := mcs.ServerNetworkData{McsChannelId: 1003, ChannelCount: 3, ChannelIdArray: []uint16{1004, 1005, 1006}}
+	pdu := ServerMcsConnectResponsePDU{}
+	pdu.Read(bytes.NewReader(connectResponse(
+		(&mcs.ServerCoreData{Version: 0x80004}).Serialize(),
+		(&mcs.ServerSecurityData{}).Serialize(),
+		network.Serialize(),
+	)))
+	assert.Equal(t, uint32(0x80004), pdu.ServerCoreData.Version)
+	assert.Equal(t, network, pdu.ServerNetworkData)
+}
+
+// FuzzServerMcsPDUs checks that no packet makes the readers of the MCS
+// PDUs of the server fail other than by throwing
+func FuzzServerMcsPDUs(f *testing.F) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(f, err)
+	security := mcs.ServerSecurityData{
+		EncryptionMethod: mcs.ENCRYPTION_METHOD_128BIT,
+		EncryptionLevel:  mcs.ENCRYPTION_LEVEL_CLIENT_COMPATIBLE,
+		ServerRandom:     make([]byte, 32),
+		ServerCertificate: mcs.ServerCertificate{
+			DwVersion: mcs.CERT_CHAIN_VERSION_1,
+			CertData:  mcs.NewProprietaryServerCertificate(&key.PublicKey),
+		},
+	}
+	f.Add(connectResponse(
+		(&mcs.ServerCoreData{}).Serialize(),
+		security.Serialize(),
+		(&mcs.ServerNetworkData{McsChannelId: 1003, ChannelCount: 1, ChannelIdArray: []uint16{1004}}).Serialize(),
+	))
+	for _, pdu := range [][]byte{
+		(&mcs.ServerAttachUserConfirm{UserId: 1007}).Serialize(),
+		(&mcs.ServerChannelJoinConfirm{UserId: 1007, ChannelId: 1003}).Serialize(),
+	} {
+		packet := new(bytes.Buffer)
+		x224.Write(packet, pdu)
+		f.Add(packet.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		if pdu, err := ReadServerMcsConnectResponse(bytes.NewReader(packet)); err == nil {
+			if cert := pdu.ServerSecurityData.ServerCertificate; cert.CertData != nil {
+				_, _ = cert.PublicKey()
+				_ = core.TryRead(func() { cert.CertData.Verify() })
+			}
+		}
+		_ = core.TryRead(func() { (&ServerMcsAttachUserConfirmPDU{}).Read(bytes.NewReader(packet)) })
+		_ = core.TryRead(func() { (&ServerMcsChannelJoinConfirmPDU{}).Read(bytes.NewReader(packet)) })
+	})
+}
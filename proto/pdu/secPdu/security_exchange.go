@@ -1,5 +1,13 @@
 package secPdu
 
+import (
+	"bytes"
+	"io"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/proto/sec"
+)
+
 // SecurityExchangePDU
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/ca73831d-3661-4700-9357-8f247640c02e
 type SecurityExchangePDU struct {
@@ -7,3 +15,28 @@ type SecurityExchangePDU struct {
 	Length                uint32
 	EncryptedClientRandom []byte
 }
+
+// NewSecurityExchangePDU carries the client random encrypted with the key
+// of the server, padding included
+func NewSecurityExchangePDU(encryptedClientRandom []byte) *SecurityExchangePDU {
+	return &SecurityExchangePDU{
+		BasicSecurityHeader:   sec.SEC_EXCHANGE_PKT,
+		Length:                uint32(len(encryptedClientRandom)),
+		EncryptedClientRandom: encryptedClientRandom,
+	}
+}
+
+func (pdu *SecurityExchangePDU) Serialize() []byte {
+	buff := new(bytes.Buffer)
+	core.WriteLE(buff, pdu.BasicSecurityHeader)
+	core.WriteLE(buff, pdu.Length)
+	core.WriteFull(buff, pdu.EncryptedClientRandom)
+	return buff.Bytes()
+}
+
+func (pdu *SecurityExchangePDU) Read(r io.Reader) {
+	core.ReadLE(r, &pdu.BasicSecurityHeader)
+	core.ThrowIf(pdu.BasicSecurityHeader&sec.SEC_EXCHANGE_PKT == 0, "expected security exchange pdu")
+	core.ReadLE(r, &pdu.Length)
+	pdu.EncryptedClientRandom = core.ReadBytes(r, int(pdu.Length))
+}
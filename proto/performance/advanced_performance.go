@@ -5,12 +5,17 @@
 package performance
 
 import (
+	"bytes"
+	"compress/zlib"
 	"fmt"
+	"io"
+	"os"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/glog"
 )
 
@@ -106,9 +111,11 @@ type AdvancedPerformanceManager struct {
 	monitorChan chan *PerformanceMetric
 
 	// GPU acceleration
-	gpuEnabled bool
-	gpuInfo    *GPUInfo
-	gpuContext interface{} // Platform-specific GPU context
+	gpuEnabled  bool
+	gpuInfo     *GPUInfo
+	gpuContext  interface{} // Platform-specific GPU context
+	gpuUsage    float64
+	hasGPUUsage bool
 
 	// Caching system
 	cache        map[string]*CacheEntry
@@ -119,6 +126,7 @@ type AdvancedPerformanceManager struct {
 
 	// Bandwidth optimization
 	bandwidthLimit   int64
+	limiter          core.RateLimiter
 	compressionLevel int
 	adaptiveQuality  bool
 
@@ -133,6 +141,13 @@ type AdvancedPerformanceManager struct {
 	// Statistics tracking
 	startTime  time.Time
 	statistics *PerformanceStatistics
+
+	// Sampling state for rate and usage metrics
+	frames        int64 // since the last sample, updated atomically
+	lastRDPSample time.Time
+	lastBytes     int64
+	lastCPUSample time.Time
+	lastCPUTime   time.Duration
 }
 
 // GPUInfo represents GPU information
@@ -194,6 +209,7 @@ func NewAdvancedPerformanceManager() *AdvancedPerformanceManager {
 		alerts:              make([]*PerformanceAlert, 0),
 		thresholds:          make(map[MetricType]float64),
 		startTime:           time.Now(),
+		lastRDPSample:       time.Now(),
 		statistics:          &PerformanceStatistics{},
 	}
 
@@ -624,38 +640,56 @@ func (manager *AdvancedPerformanceManager) collectMetrics() {
 
 // collectSystemMetrics collects system performance metrics
 func (manager *AdvancedPerformanceManager) collectSystemMetrics() {
-	// CPU usage
+	// CPU usage of this process since the previous sample
+	if cpuUsage, ok := manager.getCPUUsage(); ok {
+		manager.recordMetric(MetricTypeCPU, "cpu_usage", cpuUsage, "%", nil)
+	}
+
+	// Memory usage: the live heap as a share of the memory held from the
+	// OS, less what the heap has returned to it
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
-
-	cpuUsage := manager.getCPUUsage()
-	manager.recordMetric(MetricTypeCPU, "cpu_usage", cpuUsage, "%", nil)
-
-	// Memory usage
-	memoryUsage := float64(m.Alloc) / float64(m.Sys) * 100
-	manager.recordMetric(MetricTypeMemory, "memory_usage", memoryUsage, "%", nil)
-
-	// GPU usage (if available)
-	if manager.gpuEnabled {
-		gpuUsage := manager.getGPUUsage()
+	held := m.Sys - m.HeapReleased
+	memoryUsage := float64(m.HeapAlloc) / float64(held) * 100
+	manager.recordMetric(MetricTypeMemory, "memory_usage", memoryUsage, "%", map[string]string{
+		"heap_alloc_mb": fmt.Sprintf("%.1f", float64(m.HeapAlloc)/(1024*1024)),
+		"held_mb":       fmt.Sprintf("%.1f", float64(held)/(1024*1024)),
+	})
+
+	// GPU usage (if available), as last reported with RecordGPUUsage
+	manager.mutex.Lock()
+	manager.statistics.PeakMemoryUsage = max(manager.statistics.PeakMemoryUsage, memoryUsage)
+	gpuUsage, hasGPUUsage := manager.gpuUsage, manager.gpuEnabled && manager.hasGPUUsage
+	manager.mutex.Unlock()
+	if hasGPUUsage {
 		manager.recordMetric(MetricTypeGPU, "gpu_usage", gpuUsage, "%", nil)
 	}
 }
 
-// collectRDPMetrics collects RDP-specific performance metrics
+// collectRDPMetrics collects RDP-specific performance metrics. Latency is
+// recorded as it is measured, see RecordLatency.
 func (manager *AdvancedPerformanceManager) collectRDPMetrics() {
-	// This is a simplified implementation
-	// In a real implementation, this would collect actual RDP metrics
-
-	// Simulate RDP metrics
-	latency := manager.getSimulatedLatency()
-	manager.recordMetric(MetricTypeLatency, "rdp_latency", latency, "ms", nil)
-
-	fps := manager.getSimulatedFPS()
-	manager.recordMetric(MetricTypeFPS, "rdp_fps", fps, "fps", nil)
+	now := time.Now()
+	frames := atomic.SwapInt64(&manager.frames, 0)
 
-	bandwidth := manager.getSimulatedBandwidth()
-	manager.recordMetric(MetricTypeBandwidth, "rdp_bandwidth", bandwidth, "KB/s", nil)
+	manager.mutex.Lock()
+	total := manager.statistics.TotalBytesSent + manager.statistics.TotalBytesReceived
+	elapsed := now.Sub(manager.lastRDPSample).Seconds()
+	lastBytes := manager.lastBytes
+	manager.lastRDPSample, manager.lastBytes = now, total
+	manager.mutex.Unlock()
+
+	if elapsed > 0 {
+		fps := float64(frames) / elapsed
+		manager.recordMetric(MetricTypeFPS, "rdp_fps", fps, "fps", nil)
+
+		bandwidth := float64(total-lastBytes) / 1024 / elapsed
+		manager.recordMetric(MetricTypeBandwidth, "rdp_bandwidth", bandwidth, "KB/s", nil)
+
+		manager.mutex.Lock()
+		manager.statistics.AverageFPS = smooth(manager.statistics.AverageFPS, fps)
+		manager.mutex.Unlock()
+	}
 
 	// Cache metrics
 	cacheStats := manager.GetCacheStats()
@@ -663,36 +697,67 @@ func (manager *AdvancedPerformanceManager) collectRDPMetrics() {
 	manager.recordMetric(MetricTypeCache, "cache_hit_rate", hitRate, "%", nil)
 }
 
-// getCPUUsage gets current CPU usage
-func (manager *AdvancedPerformanceManager) getCPUUsage() float64 {
-	// This is a simplified implementation
-	// In a real implementation, this would use platform-specific APIs
-	return 15.0 + float64(time.Now().Unix()%10) // Simulate varying CPU usage
+// getCPUUsage returns the CPU time used by the process since the previous
+// call, as a percentage of the time available on all CPUs. It reports false
+// on the first call and where process CPU time is not available.
+func (manager *AdvancedPerformanceManager) getCPUUsage() (float64, bool) {
+	cpuTime, ok := processCPUTime()
+	if !ok {
+		return 0, false
+	}
+	now := time.Now()
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	lastTime, lastCPU := manager.lastCPUSample, manager.lastCPUTime
+	manager.lastCPUSample, manager.lastCPUTime = now, cpuTime
+	if lastTime.IsZero() {
+		return 0, false
+	}
+	wall := now.Sub(lastTime) * time.Duration(runtime.NumCPU())
+	if wall <= 0 {
+		return 0, false
+	}
+
+	usage := min(100, float64(cpuTime-lastCPU)/float64(wall)*100)
+	manager.statistics.PeakCPUUsage = max(manager.statistics.PeakCPUUsage, usage)
+	return usage, true
 }
 
-// getGPUUsage gets current GPU usage
-func (manager *AdvancedPerformanceManager) getGPUUsage() float64 {
-	// This is a simplified implementation
-	// In a real implementation, this would use GPU APIs
-	return 25.0 + float64(time.Now().Unix()%15) // Simulate varying GPU usage
+// RecordLatency records a round-trip time measured on the connection, such
+// as those reported by the client's OnRoundTrip option
+func (manager *AdvancedPerformanceManager) RecordLatency(rtt time.Duration) {
+	latency := float64(rtt) / float64(time.Millisecond)
+	manager.recordMetric(MetricTypeLatency, "rdp_latency", latency, "ms", nil)
+
+	manager.mutex.Lock()
+	manager.statistics.AverageLatency = smooth(manager.statistics.AverageLatency, latency)
+	manager.mutex.Unlock()
 }
 
-// getSimulatedLatency gets simulated RDP latency
-func (manager *AdvancedPerformanceManager) getSimulatedLatency() float64 {
-	// Simulate network latency
-	return 20.0 + float64(time.Now().Unix()%30)
+// RecordGPUUsage reports the GPU utilization in percent, sampled with the
+// platform's GPU API, for the gpu_usage metric. The metric is collected
+// while GPU acceleration is enabled, from the last usage reported.
+func (manager *AdvancedPerformanceManager) RecordGPUUsage(usage float64) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	manager.gpuUsage, manager.hasGPUUsage = usage, true
 }
 
-// getSimulatedFPS gets simulated RDP FPS
-func (manager *AdvancedPerformanceManager) getSimulatedFPS() float64 {
-	// Simulate frame rate
-	return 30.0 + float64(time.Now().Unix()%10)
+// RecordFrame counts a frame presented to the user, for the FPS metric, e.g.
+// from the client's OnFrameDecoded option
+func (manager *AdvancedPerformanceManager) RecordFrame() {
+	atomic.AddInt64(&manager.frames, 1)
 }
 
-// getSimulatedBandwidth gets simulated RDP bandwidth
-func (manager *AdvancedPerformanceManager) getSimulatedBandwidth() float64 {
-	// Simulate bandwidth usage
-	return 500.0 + float64(time.Now().Unix()%200)
+// smooth folds a sample into a running average the way TCP smooths RTT
+// samples, starting from the first sample
+func smooth(average, sample float64) float64 {
+	if average == 0 {
+		return sample
+	}
+	return average*7/8 + sample/8
 }
 
 // recordMetric records a performance metric
@@ -812,7 +877,7 @@ func (manager *AdvancedPerformanceManager) checkThresholds() {
 			manager.alerts = manager.alerts[1:]
 		}
 
-		glog.Warningf("Performance alert: %s", alert.Message)
+		glog.Warnf("Performance alert: %s", alert.Message)
 	}
 }
 
@@ -855,12 +920,21 @@ func (manager *AdvancedPerformanceManager) GetThreshold(metricType MetricType) f
 // Bandwidth Optimization
 // ============================================================================
 
-// SetBandwidthLimit sets the bandwidth limit
+// SetBandwidthLimit sets the bandwidth limit in bytes per second, zero for
+// none. The limit paces the writes of streams using BandwidthLimiter.
 func (manager *AdvancedPerformanceManager) SetBandwidthLimit(limit int64) {
 	manager.mutex.Lock()
 	defer manager.mutex.Unlock()
 
 	manager.bandwidthLimit = limit
+	manager.limiter.SetLimit(limit)
+}
+
+// BandwidthLimiter returns the limiter following SetBandwidthLimit, e.g. for
+// core.Stream.SetRateLimiter. Data is delayed to keep to the limit, never
+// dropped.
+func (manager *AdvancedPerformanceManager) BandwidthLimiter() *core.RateLimiter {
+	return &manager.limiter
 }
 
 // GetBandwidthLimit returns the bandwidth limit
@@ -906,44 +980,48 @@ func (manager *AdvancedPerformanceManager) OptimizeData(data []byte) ([]byte, er
 		data = compressed
 	}
 
-	// Apply bandwidth optimization if limit is set
-	if manager.bandwidthLimit > 0 {
-		data = manager.applyBandwidthOptimization(data)
-	}
-
 	return data, nil
 }
 
-// compressData compresses data using the current compression level
+// compressData compresses data with zlib using the current compression level
 func (manager *AdvancedPerformanceManager) compressData(data []byte) ([]byte, error) {
-	// This is a simplified implementation
-	// In a real implementation, this would use proper compression libraries
-	// like zlib, lz4, etc.
+	manager.mutex.RLock()
+	level := manager.compressionLevel
+	manager.mutex.RUnlock()
 
-	// Simulate compression
-	compressedSize := len(data) * manager.compressionLevel / 10
-	compressed := make([]byte, compressedSize)
-	copy(compressed, data[:compressedSize])
+	if level < zlib.BestSpeed || level > zlib.BestCompression {
+		level = zlib.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compressor: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress data: %w", err)
+	}
 
-	return compressed, nil
+	return buf.Bytes(), nil
 }
 
-// applyBandwidthOptimization applies bandwidth optimization
-func (manager *AdvancedPerformanceManager) applyBandwidthOptimization(data []byte) []byte {
-	// This is a simplified implementation
-	// In a real implementation, this would implement bandwidth throttling
-	// and quality adaptation
-
-	if int64(len(data)) > manager.bandwidthLimit {
-		// Reduce data size to fit within bandwidth limit
-		reducedSize := int(manager.bandwidthLimit)
-		if reducedSize > len(data) {
-			reducedSize = len(data)
-		}
-		return data[:reducedSize]
+// DecompressData reverses the compression applied by OptimizeData
+func (manager *AdvancedPerformanceManager) DecompressData(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decompressor: %w", err)
 	}
+	defer r.Close()
 
-	return data
+	decompressed, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress data: %w", err)
+	}
+
+	return decompressed, nil
 }
 
 // ============================================================================
@@ -988,14 +1066,29 @@ func (manager *AdvancedPerformanceManager) UpdateStatistics(updates map[string]i
 	}
 }
 
-// ExportMetrics exports performance metrics
+// ExportMetrics exports performance metrics. The "prometheus" format writes
+// the text exposition format, e.g. for the node exporter's textfile
+// collector.
 func (manager *AdvancedPerformanceManager) ExportMetrics(format string, filename string) error {
-	// This is a simplified implementation
-	// In a real implementation, this would export metrics in various formats
-	// like JSON, CSV, Prometheus, etc.
-
 	glog.Infof("Exporting metrics in %s format to %s", format, filename)
-	return nil
+
+	switch format {
+	case "prometheus":
+		f, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		if _, err := NewPrometheusExporter(manager).WriteTo(f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	default:
+		// This is a simplified implementation
+		// In a real implementation, this would export metrics in other
+		// formats like JSON and CSV
+		return nil
+	}
 }
 
 // GenerateReport generates a performance report
@@ -0,0 +1,178 @@
+package performance
+
+import (
+	"bytes"
+	"math/rand"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// screenData mimics a desktop update: long runs with some noise
+func screenData(n int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, 0, n)
+	for len(data) < n {
+		run := bytes.Repeat([]byte{byte(rnd.Intn(8))}, 1+rnd.Intn(64))
+		data = append(data, run...)
+		data = append(data, byte(rnd.Intn(256)))
+	}
+	return data[:n]
+}
+
+func TestOptimizeDataRoundTrip(t *testing.T) {
+	data := screenData(64 * 1024)
+	for level := 1; level <= 9; level++ {
+		manager := NewAdvancedPerformanceManager()
+		manager.SetCompressionLevel(level)
+
+		compressed, err := manager.OptimizeData(data)
+		require.NoError(t, err, "level %d", level)
+		assert.Less(t, len(compressed), len(data), "level %d", level)
+
+		decompressed, err := manager.DecompressData(compressed)
+		require.NoError(t, err, "level %d", level)
+		assert.Equal(t, data, decompressed, "level %d", level)
+	}
+}
+
+func TestOptimizeDataCompressionLevel(t *testing.T) {
+	data := screenData(64 * 1024)
+	manager := NewAdvancedPerformanceManager()
+
+	manager.SetCompressionLevel(1)
+	fast, err := manager.OptimizeData(data)
+	require.NoError(t, err)
+
+	manager.SetCompressionLevel(9)
+	best, err := manager.OptimizeData(data)
+	require.NoError(t, err)
+
+	assert.LessOrEqual(t, len(best), len(fast))
+}
+
+func TestOptimizeDataEmpty(t *testing.T) {
+	manager := NewAdvancedPerformanceManager()
+	compressed, err := manager.OptimizeData(nil)
+	require.NoError(t, err)
+	decompressed, err := manager.DecompressData(compressed)
+	require.NoError(t, err)
+	assert.Empty(t, decompressed)
+}
+
+func TestDecompressDataInvalid(t *testing.T) {
+	manager := NewAdvancedPerformanceManager()
+	_, err := manager.DecompressData([]byte("not compressed"))
+	assert.Error(t, err)
+
+	compressed, err := manager.OptimizeData(screenData(4096))
+	require.NoError(t, err)
+	_, err = manager.DecompressData(compressed[:len(compressed)/2])
+	assert.Error(t, err)
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	data := screenData(64 * 1024)
+	manager := NewAdvancedPerformanceManager()
+	manager.SetBandwidthLimit(1000)
+	assert.Equal(t, int64(1000), manager.GetBandwidthLimit())
+
+	// a limit far below the payload delays it but keeps it whole
+	compressed, err := manager.OptimizeData(data)
+	require.NoError(t, err)
+	decompressed, err := manager.DecompressData(compressed)
+	require.NoError(t, err)
+	assert.Equal(t, data, decompressed)
+
+	limiter := manager.BandwidthLimiter()
+	assert.Equal(t, int64(1000), limiter.Limit())
+	assert.Zero(t, limiter.Reserve(1000), "a full bucket takes a second of bytes")
+	wait := limiter.Reserve(500)
+	assert.InDelta(t, 500*time.Millisecond, wait, float64(50*time.Millisecond))
+	wait = limiter.Reserve(1000)
+	assert.InDelta(t, 1500*time.Millisecond, wait, float64(50*time.Millisecond), "the debt carries over")
+
+	manager.SetBandwidthLimit(0)
+	assert.Zero(t, limiter.Reserve(1<<20))
+}
+
+func TestCPUUsage(t *testing.T) {
+	if _, ok := processCPUTime(); !ok {
+		t.Skip("process CPU time not available")
+	}
+	manager := NewAdvancedPerformanceManager()
+	_, ok := manager.getCPUUsage()
+	assert.False(t, ok, "the first call only takes a baseline")
+
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for n := 0; time.Now().Before(deadline); n++ {
+		_ = n * n
+	}
+	usage, ok := manager.getCPUUsage()
+	require.True(t, ok)
+	assert.Greater(t, usage, 0.0)
+	assert.LessOrEqual(t, usage, 100.0)
+	assert.Equal(t, usage, manager.GetStatistics().PeakCPUUsage)
+}
+
+func TestRecordLatency(t *testing.T) {
+	manager := NewAdvancedPerformanceManager()
+	manager.RecordLatency(40 * time.Millisecond)
+	manager.RecordLatency(120 * time.Millisecond)
+
+	latest := manager.GetLatestMetrics()[MetricTypeLatency]
+	require.NotNil(t, latest)
+	assert.Equal(t, "rdp_latency", latest.Name)
+	assert.Equal(t, 120.0, latest.Value)
+	assert.Equal(t, 50.0, manager.GetStatistics().AverageLatency)
+}
+
+func TestCollectMetrics(t *testing.T) {
+	manager := NewAdvancedPerformanceManager()
+	manager.collectMetrics() // baseline for the rates
+	for i := 0; i < 30; i++ {
+		manager.RecordFrame()
+	}
+	manager.UpdateStatistics(map[string]interface{}{"bytes_received": int64(512 * 1024)})
+	time.Sleep(100 * time.Millisecond)
+	manager.collectMetrics()
+
+	latest := manager.GetLatestMetrics()
+	_, hasLatency := latest[MetricTypeLatency]
+	assert.False(t, hasLatency, "no latency is reported before one is measured")
+
+	// 30 frames and 512KB within a little over 100ms
+	fps, bandwidth := latest[MetricTypeFPS].Value, latest[MetricTypeBandwidth].Value
+	assert.Greater(t, fps, 0.0)
+	assert.LessOrEqual(t, fps, 300.0)
+	assert.InDelta(t, 512.0/30, bandwidth/fps, 0.001)
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	assert.Equal(t, "memory_usage", latest[MetricTypeMemory].Name)
+	assert.Equal(t, "%", latest[MetricTypeMemory].Unit)
+	assert.InDelta(t, float64(m.HeapAlloc)/float64(m.Sys-m.HeapReleased)*100, latest[MetricTypeMemory].Value, 25)
+	assert.LessOrEqual(t, latest[MetricTypeMemory].Value, 100.0)
+}
+
+func TestGPUUsage(t *testing.T) {
+	manager := NewAdvancedPerformanceManager()
+	manager.gpuEnabled = true
+	manager.collectMetrics()
+	assert.Empty(t, manager.GetMetrics(MetricTypeGPU), "no usage is reported before one is measured")
+
+	manager.RecordGPUUsage(42)
+	manager.collectMetrics()
+	latest := manager.GetLatestMetrics()[MetricTypeGPU]
+	require.NotNil(t, latest)
+	assert.Equal(t, "gpu_usage", latest.Name)
+	assert.Equal(t, "%", latest.Unit)
+	assert.Equal(t, 42.0, latest.Value)
+
+	manager.gpuEnabled = false
+	manager.collectMetrics()
+	assert.Len(t, manager.GetMetrics(MetricTypeGPU), 1, "not collected without GPU acceleration")
+}
@@ -0,0 +1,23 @@
+package performance
+
+import (
+	"syscall"
+	"time"
+)
+
+// processCPUTime returns the user and kernel CPU time used by the process
+func processCPUTime() (time.Duration, bool) {
+	var creation, exit, kernel, user syscall.Filetime
+	handle, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0, false
+	}
+	if err := syscall.GetProcessTimes(handle, &creation, &exit, &kernel, &user); err != nil {
+		return 0, false
+	}
+	// FILETIME durations count 100ns intervals
+	ticks := func(ft syscall.Filetime) int64 {
+		return int64(ft.HighDateTime)<<32 | int64(ft.LowDateTime)
+	}
+	return time.Duration((ticks(kernel) + ticks(user)) * 100), true
+}
@@ -0,0 +1,171 @@
+package performance
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PrometheusContentType is the content type of the text exposition format
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// prometheusCollector reads one metric from a manager. ok is false when the
+// manager has nothing to report yet, e.g. no latency was measured.
+type prometheusCollector struct {
+	name  string
+	help  string
+	typ   string // gauge or counter
+	value func(manager *AdvancedPerformanceManager) (v float64, ok bool)
+}
+
+// latestMetric reads the most recent sample of a metric type
+func latestMetric(metricType MetricType, scale float64) func(*AdvancedPerformanceManager) (float64, bool) {
+	return func(manager *AdvancedPerformanceManager) (float64, bool) {
+		metric, ok := manager.GetLatestMetrics()[metricType]
+		if !ok {
+			return 0, false
+		}
+		return metric.Value * scale, true
+	}
+}
+
+var prometheusCollectors = []prometheusCollector{
+	{"gordp_latency_seconds", "Last round-trip time measured to the server.", "gauge",
+		latestMetric(MetricTypeLatency, 1.0/1000)},
+	{"gordp_frames_per_second", "Frames presented per second over the last sample.", "gauge",
+		latestMetric(MetricTypeFPS, 1)},
+	{"gordp_bandwidth_bytes_per_second", "Bytes sent and received per second over the last sample.", "gauge",
+		latestMetric(MetricTypeBandwidth, 1024)},
+	{"gordp_cache_hit_ratio", "Share of cache lookups that hit.", "gauge",
+		func(manager *AdvancedPerformanceManager) (float64, bool) {
+			return manager.GetCacheStats()["hitRate"].(float64) / 100, true
+		}},
+	{"gordp_bytes_sent_total", "Bytes sent to the server.", "counter",
+		func(manager *AdvancedPerformanceManager) (float64, bool) {
+			return float64(manager.GetStatistics().TotalBytesSent), true
+		}},
+	{"gordp_bytes_received_total", "Bytes received from the server.", "counter",
+		func(manager *AdvancedPerformanceManager) (float64, bool) {
+			return float64(manager.GetStatistics().TotalBytesReceived), true
+		}},
+}
+
+// prometheusSession is a manager exported with a fixed set of labels
+type prometheusSession struct {
+	labels  string // rendered, e.g. {session="a"}
+	manager *AdvancedPerformanceManager
+}
+
+// PrometheusExporter serves the metrics of one or more performance managers
+// in the Prometheus text exposition format
+type PrometheusExporter struct {
+	mutex    sync.RWMutex
+	sessions []prometheusSession
+}
+
+// NewPrometheusExporter creates an exporter for manager. Further sessions
+// can be added with AddSession.
+func NewPrometheusExporter(manager *AdvancedPerformanceManager) *PrometheusExporter {
+	e := &PrometheusExporter{}
+	if manager != nil {
+		e.sessions = append(e.sessions, prometheusSession{manager: manager})
+	}
+	return e
+}
+
+// AddSession exports manager as well, with its samples told apart by the
+// given labels, e.g. {"session": "host-a"} for each client in a pool.
+// Label names must be valid Prometheus label names.
+func (e *PrometheusExporter) AddSession(labels map[string]string, manager *AdvancedPerformanceManager) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.sessions = append(e.sessions, prometheusSession{labels: formatLabels(labels), manager: manager})
+}
+
+// RemoveSession stops exporting manager
+func (e *PrometheusExporter) RemoveSession(manager *AdvancedPerformanceManager) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for i, s := range e.sessions {
+		if s.manager == manager {
+			e.sessions = append(e.sessions[:i], e.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// WriteTo writes the current metrics in the text exposition format
+func (e *PrometheusExporter) WriteTo(w io.Writer) (int64, error) {
+	e.mutex.RLock()
+	sessions := append([]prometheusSession(nil), e.sessions...)
+	e.mutex.RUnlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, c := range prometheusCollectors {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, c.typ)
+		for _, s := range sessions {
+			if v, ok := c.value(s.manager); ok {
+				fmt.Fprintf(cw, "%s%s %s\n", c.name, s.labels, strconv.FormatFloat(v, 'g', -1, 64))
+			}
+		}
+	}
+	if err := cw.w.Flush(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP serves the metrics, for use as a scrape target
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", PrometheusContentType)
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = e.WriteTo(w)
+}
+
+// formatLabels renders labels in a stable order, escaping their values
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, escaper.Replace(labels[name]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// countingWriter remembers the bytes written and the first error
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,66 @@
+package performance
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusExporter(t *testing.T) {
+	manager := NewAdvancedPerformanceManager()
+	manager.RecordLatency(25 * time.Millisecond)
+	manager.UpdateStatistics(map[string]interface{}{"bytes_sent": int64(100), "bytes_received": int64(2048)})
+
+	other := NewAdvancedPerformanceManager()
+	exporter := NewPrometheusExporter(manager)
+	exporter.AddSession(map[string]string{"session": `host "b"`}, other)
+
+	rec := httptest.NewRecorder()
+	exporter.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, PrometheusContentType, rec.Header().Get("Content-Type"))
+
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE gordp_latency_seconds gauge",
+		"gordp_latency_seconds 0.025",
+		"# TYPE gordp_bytes_sent_total counter",
+		"gordp_bytes_sent_total 100",
+		"gordp_bytes_received_total 2048",
+		`gordp_bytes_received_total{session="host \"b\""} 0`,
+		"gordp_cache_hit_ratio 0",
+	} {
+		assert.Contains(t, strings.Split(body, "\n"), line)
+	}
+	// nothing measured yet for the second session
+	assert.NotContains(t, body, `gordp_latency_seconds{`)
+
+	exporter.RemoveSession(other)
+	rec = httptest.NewRecorder()
+	exporter.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.NotContains(t, rec.Body.String(), "session=")
+
+	rec = httptest.NewRecorder()
+	exporter.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestExportMetricsPrometheus(t *testing.T) {
+	manager := NewAdvancedPerformanceManager()
+	manager.RecordLatency(time.Second)
+
+	filename := filepath.Join(t.TempDir(), "gordp.prom")
+	require.NoError(t, manager.ExportMetrics("prometheus", filename))
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "\ngordp_latency_seconds 1\n")
+
+	assert.Error(t, manager.ExportMetrics("prometheus", filepath.Join(t.TempDir(), "missing", "gordp.prom")))
+}
@@ -0,0 +1,299 @@
+package rail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/glog"
+)
+
+// CHANNEL_NAME is the static virtual channel of Remote Programs (MS-RDPERP)
+const CHANNEL_NAME = "rail"
+
+// Order types of TS_RAIL_PDU_HEADER
+const (
+	TS_RAIL_ORDER_EXEC          = 0x0001
+	TS_RAIL_ORDER_ACTIVATE      = 0x0002
+	TS_RAIL_ORDER_SYSPARAM      = 0x0003
+	TS_RAIL_ORDER_SYSCOMMAND    = 0x0004
+	TS_RAIL_ORDER_HANDSHAKE     = 0x0005
+	TS_RAIL_ORDER_NOTIFY_EVENT  = 0x0006
+	TS_RAIL_ORDER_WINDOWMOVE    = 0x0008
+	TS_RAIL_ORDER_LOCALMOVESIZE = 0x0009
+	TS_RAIL_ORDER_MINMAXINFO    = 0x000a
+	TS_RAIL_ORDER_CLIENTSTATUS  = 0x000b
+	TS_RAIL_ORDER_SYSMENU       = 0x000c
+	TS_RAIL_ORDER_LANGBARINFO   = 0x000d
+	TS_RAIL_ORDER_HANDSHAKE_EX  = 0x0013
+	TS_RAIL_ORDER_EXEC_RESULT   = 0x0080
+)
+
+// Flags of the Client Information PDU
+const (
+	TS_RAIL_CLIENTSTATUS_ALLOWLOCALMOVESIZE = 0x00000001
+	TS_RAIL_CLIENTSTATUS_AUTORECONNECT      = 0x00000002
+)
+
+// Flags of the Client Execute PDU
+const (
+	TS_RAIL_EXEC_FLAG_EXPAND_WORKINGDIRECTORY = 0x0001
+	TS_RAIL_EXEC_FLAG_TRANSLATE_FILES         = 0x0002
+	TS_RAIL_EXEC_FLAG_FILE                    = 0x0004
+	TS_RAIL_EXEC_FLAG_EXPAND_ARGUMENTS        = 0x0008
+)
+
+// Results of the Server Execute Result PDU
+const (
+	RAIL_EXEC_S_OK                = 0x0000
+	RAIL_EXEC_E_HOOK_NOT_LOADED   = 0x0001
+	RAIL_EXEC_E_DECODE_FAILED     = 0x0002
+	RAIL_EXEC_E_NOT_IN_ALLOWLIST  = 0x0003
+	RAIL_EXEC_E_FILE_NOT_FOUND    = 0x0005
+	RAIL_EXEC_E_FAIL              = 0x0006
+	RAIL_EXEC_E_SESSION_LOCKED    = 0x0007
+	RAIL_EXEC_E_PROGRAM_NOT_FOUND = 0x0008
+)
+
+// System parameters of the Client System Parameters Update PDU
+const (
+	SPI_SETMOUSEBUTTONSWAP = 0x00000021
+	SPI_SETDRAGFULLWINDOWS = 0x00000025
+	SPI_SETWORKAREA        = 0x0000002F
+	SPI_SETHIGHCONTRAST    = 0x00000043
+	SPI_SETKEYBOARDPREF    = 0x00000045
+	SPI_SETKEYBOARDCUES    = 0x0000100B
+	RAIL_SPI_TASKBARPOS    = 0x0000F000
+)
+
+// clientBuildNumber is the build number the client announces in its
+// Handshake PDU
+const clientBuildNumber = 7600
+
+// Limits of the strings of the Client Execute PDU, in bytes of UTF-16
+const (
+	maxExeOrFileLength  = 520
+	maxWorkingDirLength = 520
+	maxArgumentsLength  = 16000
+)
+
+// ErrExecTooLong is returned when a program, working directory or argument
+// string is longer than the Client Execute PDU can carry
+var ErrExecTooLong = errors.New("remote application string too long")
+
+// PduHeader TS_RAIL_PDU_HEADER, OrderLength includes the header
+type PduHeader struct {
+	OrderType   uint16
+	OrderLength uint16
+}
+
+// Exec is a program for the server to start in a RemoteApp session
+type Exec struct {
+	Flags      uint16 // TS_RAIL_EXEC_FLAG_*
+	ExeOrFile  string
+	WorkingDir string
+	Arguments  string
+}
+
+// Validate returns an error wrapping ErrExecTooLong if the Client Execute
+// PDU cannot carry e, and an error if it has no program
+func (e *Exec) Validate() error {
+	if e.ExeOrFile == "" {
+		return errors.New("remote application without a program")
+	}
+	if len(core.UnicodeEncode(e.ExeOrFile)) > maxExeOrFileLength ||
+		len(core.UnicodeEncode(e.WorkingDir)) > maxWorkingDirLength ||
+		len(core.UnicodeEncode(e.Arguments)) > maxArgumentsLength {
+		return fmt.Errorf("%w: %q", ErrExecTooLong, e.ExeOrFile)
+	}
+	return nil
+}
+
+// Serialize builds the Client Execute PDU
+// See [MS-RDPERP] 2.2.2.3.1
+func (e *Exec) Serialize() ([]byte, error) {
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	exe, dir, args := core.UnicodeEncode(e.ExeOrFile), core.UnicodeEncode(e.WorkingDir), core.UnicodeEncode(e.Arguments)
+	body := new(bytes.Buffer)
+	core.WriteLE(body, e.Flags)
+	core.WriteLE(body, uint16(len(exe)))
+	core.WriteLE(body, uint16(len(dir)))
+	core.WriteLE(body, uint16(len(args)))
+	body.Write(exe)
+	body.Write(dir)
+	body.Write(args)
+	return newPdu(TS_RAIL_ORDER_EXEC, body.Bytes()), nil
+}
+
+// ExecResult is the outcome of starting the program of an Exec, sent by
+// the server in its Server Execute Result PDU
+// See [MS-RDPERP] 2.2.2.3.2
+type ExecResult struct {
+	Flags      uint16
+	ExecResult uint16 // RAIL_EXEC_*
+	RawResult  uint32 // the error code of the server, e.g. from ShellExecute
+	ExeOrFile  string
+}
+
+var execResults = map[uint16]string{
+	RAIL_EXEC_S_OK:                "the program was started",
+	RAIL_EXEC_E_HOOK_NOT_LOADED:   "the shell hook of the server is not loaded",
+	RAIL_EXEC_E_DECODE_FAILED:     "the server could not decode the request",
+	RAIL_EXEC_E_NOT_IN_ALLOWLIST:  "the program is not allowed on the server",
+	RAIL_EXEC_E_FILE_NOT_FOUND:    "the file was not found",
+	RAIL_EXEC_E_FAIL:              "the program could not be started",
+	RAIL_EXEC_E_SESSION_LOCKED:    "the session is locked",
+	RAIL_EXEC_E_PROGRAM_NOT_FOUND: "the program was not found",
+}
+
+// OK reports whether the program was started
+func (r *ExecResult) OK() bool {
+	return r.ExecResult == RAIL_EXEC_S_OK
+}
+
+// String describes the result
+func (r *ExecResult) String() string {
+	if desc, ok := execResults[r.ExecResult]; ok {
+		return fmt.Sprintf("%s: %s", r.ExeOrFile, desc)
+	}
+	return fmt.Sprintf("%s: exec result %#x, %#x", r.ExeOrFile, r.ExecResult, r.RawResult)
+}
+
+func (r *ExecResult) Read(rd io.Reader) {
+	var padding, length uint16
+	core.ReadLE(rd, &r.Flags)
+	core.ReadLE(rd, &r.ExecResult)
+	core.ReadLE(rd, &r.RawResult)
+	core.ReadLE(rd, &padding)
+	core.ReadLE(rd, &length)
+	core.ThrowIf(length > maxExeOrFileLength, fmt.Errorf("invalid exec result length %d", length))
+	r.ExeOrFile = core.UnicodeDecode(core.ReadBytes(rd, int(length)))
+}
+
+// newPdu prefixes body with the header of an order of type orderType
+func newPdu(orderType uint16, body []byte) []byte {
+	return append(core.ToLE(PduHeader{OrderType: orderType, OrderLength: uint16(4 + len(body))}), body...)
+}
+
+// newSysParamPdu builds a Client System Parameters Update PDU setting param
+// to body
+// See [MS-RDPERP] 2.2.2.4.1
+func newSysParamPdu(param uint32, body ...any) []byte {
+	buf := new(bytes.Buffer)
+	core.WriteLE(buf, param)
+	for _, v := range body {
+		core.WriteLE(buf, v)
+	}
+	return newPdu(TS_RAIL_ORDER_SYSPARAM, buf.Bytes())
+}
+
+// rectangle16 TS_RECTANGLE_16, right and bottom exclusive
+type rectangle16 struct {
+	Left, Top, Right, Bottom uint16
+}
+
+// Manager drives the rail channel of a RemoteApp session: it answers the
+// handshake of the server with the state of the client, then asks it to
+// start the program, and reports the result. It is registered as the
+// static virtual channel handler for CHANNEL_NAME.
+type Manager struct {
+	mu          sync.Mutex
+	send        func(data []byte) error
+	exec        Exec
+	desktopSize func() (width, height uint16)
+
+	onExecResult func(*ExecResult)
+}
+
+// NewManager creates a manager starting exec once the server is ready, and
+// writing channel data with send. desktopSize returns the size of the
+// desktop, announced as the work area of the programs.
+func NewManager(exec Exec, desktopSize func() (width, height uint16), send func(data []byte) error) *Manager {
+	return &Manager{send: send, exec: exec, desktopSize: desktopSize}
+}
+
+// OnExecResult sets the function called with the result of starting the
+// program
+func (m *Manager) OnExecResult(fn func(*ExecResult)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onExecResult = fn
+}
+
+// OnChannelOpen handles channel open events
+func (m *Manager) OnChannelOpen(channelID uint16, channelName string) error {
+	return nil
+}
+
+// OnChannelClose handles channel close events
+func (m *Manager) OnChannelClose(channelID uint16) error {
+	return nil
+}
+
+// HandleData handles the server PDUs of the channel
+func (m *Manager) HandleData(channelID uint16, data []byte) error {
+	return core.Try(func() {
+		r := bytes.NewReader(data)
+		header := core.ReadLE(r, &PduHeader{})
+		core.ThrowIf(int(header.OrderLength) != len(data), fmt.Errorf("invalid rail pdu length %d of %d", header.OrderLength, len(data)))
+
+		switch header.OrderType {
+		case TS_RAIL_ORDER_HANDSHAKE, TS_RAIL_ORDER_HANDSHAKE_EX:
+			var buildNumber uint32
+			core.ReadLE(r, &buildNumber)
+			glog.Debugf("rail handshake, server build %d", buildNumber)
+			core.ThrowError(m.start())
+		case TS_RAIL_ORDER_EXEC_RESULT:
+			result := &ExecResult{}
+			result.Read(r)
+			if result.OK() {
+				glog.Infof("remote application %s", result)
+			} else {
+				glog.Warnf("remote application %s", result)
+			}
+			m.mu.Lock()
+			onExecResult := m.onExecResult
+			m.mu.Unlock()
+			if onExecResult != nil {
+				onExecResult(result)
+			}
+		default:
+			glog.Debugf("rail: unhandled order type %#x", header.OrderType)
+		}
+	})
+}
+
+// start sends what the client has to after the handshake of the server,
+// ending with the program to start
+// See [MS-RDPERP] 1.3.2.1
+func (m *Manager) start() error {
+	width, height := m.desktopSize()
+	exec, err := m.exec.Serialize()
+	if err != nil {
+		return err
+	}
+	workArea := rectangle16{Right: width, Bottom: height}
+	for _, pdu := range [][]byte{
+		newPdu(TS_RAIL_ORDER_HANDSHAKE, core.ToLE(uint32(clientBuildNumber))),
+		newPdu(TS_RAIL_ORDER_CLIENTSTATUS, core.ToLE(uint32(TS_RAIL_CLIENTSTATUS_ALLOWLOCALMOVESIZE))),
+		// HIGHCONTRASTW with the flags off and an empty color scheme
+		newSysParamPdu(SPI_SETHIGHCONTRAST, uint32(0), uint32(2), uint16(0)),
+		newSysParamPdu(SPI_SETMOUSEBUTTONSWAP, uint8(0)),
+		newSysParamPdu(SPI_SETKEYBOARDPREF, uint8(0)),
+		newSysParamPdu(SPI_SETDRAGFULLWINDOWS, uint8(0)),
+		newSysParamPdu(SPI_SETKEYBOARDCUES, uint8(0)),
+		newSysParamPdu(SPI_SETWORKAREA, workArea),
+		newSysParamPdu(RAIL_SPI_TASKBARPOS, rectangle16{Top: height, Right: width, Bottom: height}),
+		exec,
+	} {
+		if err := m.send(pdu); err != nil {
+			return err
+		}
+	}
+	return nil
+}
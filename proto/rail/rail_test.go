@@ -0,0 +1,121 @@
+package rail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager(t *testing.T) {
+	var sent [][]byte
+	m := NewManager(Exec{ExeOrFile: "||calc"}, func() (uint16, uint16) { return 1024, 768 }, func(data []byte) error {
+		sent = append(sent, data)
+		return nil
+	})
+	var results []*ExecResult
+	m.OnExecResult(func(result *ExecResult) { results = append(results, result) })
+
+	require.NoError(t, m.HandleData(1005, newPdu(TS_RAIL_ORDER_HANDSHAKE_EX, core.ToLE([2]uint32{7601, 0}))))
+	var orders []uint16
+	for _, pdu := range sent {
+		header := core.ReadLE(bytes.NewReader(pdu), &PduHeader{})
+		assert.Equal(t, len(pdu), int(header.OrderLength))
+		orders = append(orders, header.OrderType)
+	}
+	require.Len(t, orders, 10)
+	assert.Equal(t, []uint16{TS_RAIL_ORDER_HANDSHAKE, TS_RAIL_ORDER_CLIENTSTATUS}, orders[:2])
+	assert.Equal(t, uint16(TS_RAIL_ORDER_EXEC), orders[9])
+	assert.Equal(t, append([]byte{0x03, 0x00, 0x10, 0x00, 0x2F, 0x00, 0x00, 0x00}, core.ToLE([4]uint16{0, 0, 1024, 768})...), sent[7], "work area")
+	exec := []byte{0x01, 0x00, 0x18, 0x00, 0x00, 0x00, 0x0C, 0x00, 0x00, 0x00, 0x00, 0x00}
+	assert.Equal(t, append(exec, core.UnicodeEncode("||calc")...), sent[9])
+
+	result := new(bytes.Buffer)
+	core.WriteLE(result, [2]uint16{0, RAIL_EXEC_E_NOT_IN_ALLOWLIST})
+	core.WriteLE(result, uint32(0))
+	core.WriteLE(result, [2]uint16{0, 12})
+	result.Write(core.UnicodeEncode("||calc"))
+	require.NoError(t, m.HandleData(1005, newPdu(TS_RAIL_ORDER_EXEC_RESULT, result.Bytes())))
+	require.Len(t, results, 1)
+	assert.False(t, results[0].OK())
+	assert.Equal(t, "||calc: the program is not allowed on the server", results[0].String())
+
+	assert.Error(t, m.HandleData(1005, []byte{0x05, 0x00, 0x10, 0x00}), "length beyond the data")
+	assert.ErrorIs(t, (&Exec{ExeOrFile: string(make([]rune, 261))}).Validate(), ErrExecTooLong)
+	assert.Error(t, (&Exec{}).Validate())
+}
+
+// windowOrder builds a window order of fields followed by body
+func windowOrder(fields, windowId uint32, body []byte) []byte {
+	order := core.ToLE(uint8(TS_ALTSEC_WINDOW<<2 | TS_SECONDARY))
+	order = append(order, core.ToLE(uint16(11+len(body)))...)
+	order = append(order, core.ToLE([2]uint32{fields, windowId})...)
+	return append(order, body...)
+}
+
+func TestReadWindowOrders(t *testing.T) {
+	created := new(bytes.Buffer)
+	core.WriteLE(created, uint32(0x10)) // owner
+	core.WriteLE(created, [2]uint32{0x14CF0000, 0x100})
+	core.WriteLE(created, uint8(SW_SHOW))
+	core.WriteLE(created, uint16(len(core.UnicodeEncode("Notepad"))))
+	created.Write(core.UnicodeEncode("Notepad"))
+	core.WriteLE(created, [2]int32{-8, 20}) // client area offset
+	core.WriteLE(created, [2]uint32{0, 0})  // resize margin x
+	core.WriteLE(created, [2]int32{-10, 0}) // window offset
+	core.WriteLE(created, [2]uint32{640, 480})
+	core.WriteLE(created, uint16(1))
+	core.WriteLE(created, [4]uint16{0, 0, 640, 480})
+
+	icon := new(bytes.Buffer)
+	core.WriteLE(icon, uint16(2)) // cache entry
+	core.WriteLE(icon, uint8(1))  // cache id
+	core.WriteLE(icon, uint8(32))
+	core.WriteLE(icon, [2]uint16{2, 1})
+	core.WriteLE(icon, [2]uint16{4, 8})
+	icon.Write([]byte{0x40, 0, 0, 0})                                  // second pixel masked
+	icon.Write([]byte{0x00, 0x00, 0xFF, 0xFF, 0xFF, 0x00, 0x00, 0xFF}) // red, blue
+
+	data := bytes.Join([][]byte{
+		windowOrder(WINDOW_ORDER_TYPE_WINDOW|WINDOW_ORDER_STATE_NEW|WINDOW_ORDER_FIELD_OWNER|WINDOW_ORDER_FIELD_STYLE|
+			WINDOW_ORDER_FIELD_SHOW|WINDOW_ORDER_FIELD_TITLE|WINDOW_ORDER_FIELD_CLIENTAREAOFFSET|WINDOW_ORDER_FIELD_RESIZE_MARGIN_X|
+			WINDOW_ORDER_FIELD_WNDOFFSET|WINDOW_ORDER_FIELD_WNDSIZE|WINDOW_ORDER_FIELD_WNDRECTS, 0x20, created.Bytes()),
+		windowOrder(WINDOW_ORDER_TYPE_NOTIFY|WINDOW_ORDER_STATE_NEW, 0x30, make([]byte, 4)),
+		windowOrder(WINDOW_ORDER_TYPE_WINDOW|WINDOW_ORDER_ICON, 0x20, icon.Bytes()),
+		windowOrder(WINDOW_ORDER_TYPE_WINDOW|WINDOW_ORDER_CACHEDICON, 0x20, []byte{2, 0, 1}),
+		windowOrder(WINDOW_ORDER_TYPE_WINDOW|WINDOW_ORDER_STATE_DELETED, 0x20, nil),
+		{0x09, 0x00}, // a primary drawing order ends the window orders
+	}, nil)
+	orders, err := ReadWindowOrders(data, 6)
+	require.NoError(t, err)
+	require.Len(t, orders, 4)
+
+	w := orders[0]
+	assert.True(t, w.New())
+	assert.Equal(t, uint32(0x20), w.WindowId)
+	assert.Equal(t, uint32(0x10), w.OwnerWindowId)
+	assert.Equal(t, uint32(0x14CF0000), w.Style)
+	assert.Equal(t, uint8(SW_SHOW), w.ShowState)
+	assert.Equal(t, "Notepad", w.Title)
+	assert.Equal(t, image.Pt(-8, 20), w.ClientOffset)
+	assert.Equal(t, image.Rect(-10, 0, 630, 480), w.Bounds())
+	assert.Equal(t, []image.Rectangle{image.Rect(0, 0, 640, 480)}, w.WindowRects)
+
+	require.NotNil(t, orders[1].Icon)
+	assert.False(t, orders[1].Icon.Cached())
+	img, err := orders[1].Icon.Image()
+	require.NoError(t, err)
+	assert.Equal(t, color.NRGBA{R: 0xFF, A: 0xFF}, img.At(0, 0))
+	assert.Equal(t, uint8(0), img.At(1, 0).(color.NRGBA).A)
+
+	assert.True(t, orders[2].Icon.Cached())
+	assert.Equal(t, uint16(2), orders[2].Icon.CacheEntry)
+	assert.True(t, orders[3].Deleted())
+
+	_, err = ReadWindowOrders(windowOrder(WINDOW_ORDER_TYPE_WINDOW|WINDOW_ORDER_FIELD_TITLE, 1, []byte{0xFF}), 1)
+	assert.Error(t, err, "truncated")
+}
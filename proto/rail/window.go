@@ -0,0 +1,336 @@
+package rail
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// TS_ALTSEC_WINDOW is the order type of Windowing Alternate Secondary
+// Drawing Orders, in the control flags of the order
+const TS_ALTSEC_WINDOW = 0x0B
+
+// Control flags of a drawing order
+const (
+	TS_STANDARD  = 0x01
+	TS_SECONDARY = 0x02
+)
+
+// Kind and state of a window order, in its fields present flags
+const (
+	WINDOW_ORDER_TYPE_WINDOW   = 0x01000000
+	WINDOW_ORDER_TYPE_NOTIFY   = 0x02000000
+	WINDOW_ORDER_TYPE_DESKTOP  = 0x04000000
+	WINDOW_ORDER_STATE_NEW     = 0x10000000
+	WINDOW_ORDER_STATE_DELETED = 0x20000000
+	WINDOW_ORDER_ICON          = 0x40000000
+	WINDOW_ORDER_CACHEDICON    = 0x80000000
+)
+
+// Fields of a window order, in its fields present flags
+const (
+	WINDOW_ORDER_FIELD_APPBAR_EDGE           = 0x00000001
+	WINDOW_ORDER_FIELD_OWNER                 = 0x00000002
+	WINDOW_ORDER_FIELD_TITLE                 = 0x00000004
+	WINDOW_ORDER_FIELD_STYLE                 = 0x00000008
+	WINDOW_ORDER_FIELD_SHOW                  = 0x00000010
+	WINDOW_ORDER_FIELD_APPBAR_STATE          = 0x00000040
+	WINDOW_ORDER_FIELD_RESIZE_MARGIN_X       = 0x00000080
+	WINDOW_ORDER_FIELD_WNDRECTS              = 0x00000100
+	WINDOW_ORDER_FIELD_VISIBILITY            = 0x00000200
+	WINDOW_ORDER_FIELD_WNDSIZE               = 0x00000400
+	WINDOW_ORDER_FIELD_WNDOFFSET             = 0x00000800
+	WINDOW_ORDER_FIELD_VISOFFSET             = 0x00001000
+	WINDOW_ORDER_FIELD_ICON_BIG              = 0x00002000
+	WINDOW_ORDER_FIELD_CLIENTAREAOFFSET      = 0x00004000
+	WINDOW_ORDER_FIELD_WNDCLIENTDELTA        = 0x00008000
+	WINDOW_ORDER_FIELD_CLIENTAREASIZE        = 0x00010000
+	WINDOW_ORDER_FIELD_RPCONTENT             = 0x00020000
+	WINDOW_ORDER_FIELD_ROOTPARENT            = 0x00040000
+	WINDOW_ORDER_FIELD_ENFORCE_SERVER_ZORDER = 0x00080000
+	WINDOW_ORDER_FIELD_OVERLAY_DESCRIPTION   = 0x00400000
+	WINDOW_ORDER_FIELD_TASKBAR_BUTTON        = 0x00800000
+	WINDOW_ORDER_FIELD_RESIZE_MARGIN_Y       = 0x08000000
+)
+
+// Window show states
+const (
+	SW_HIDE     = 0
+	SW_MINIMIZE = 2
+	SW_MAXIMIZE = 3
+	SW_SHOW     = 5
+)
+
+// maxTitleLength is the most bytes of UTF-16 a window title may have
+const maxTitleLength = 520
+
+// WindowOrder is the server creating, changing or deleting one of the
+// windows of a RemoteApp session, or setting its icon. Only the fields
+// named in FieldsPresent are set.
+// See [MS-RDPERP] 2.2.1.3.1
+type WindowOrder struct {
+	FieldsPresent uint32 // WINDOW_ORDER_*
+	WindowId      uint32
+
+	OwnerWindowId uint32
+	Style         uint32
+	ExtendedStyle uint32
+	ShowState     uint8 // SW_*
+	Title         string
+
+	// ClientOffset is the client area of the window on the desktop, and
+	// ClientSize its size
+	ClientOffset image.Point
+	ClientSize   image.Point
+
+	// WindowOffset is the window on the desktop, and WindowSize its size
+	WindowOffset image.Point
+	WindowSize   image.Point
+	// WindowRects is the shape of the window, relative to WindowOffset
+	WindowRects []image.Rectangle
+
+	// VisibleOffset is the visible region of the window on the desktop, and
+	// VisibilityRects the region, relative to it
+	VisibleOffset   image.Point
+	VisibilityRects []image.Rectangle
+
+	// Icon is set by icon orders, WINDOW_ORDER_ICON and
+	// WINDOW_ORDER_CACHEDICON; a cached icon has no image data but the cache
+	// entry of an earlier icon
+	Icon *Icon
+}
+
+// Has reports whether all of flags are in FieldsPresent
+func (w *WindowOrder) Has(flags uint32) bool {
+	return w.FieldsPresent&flags == flags
+}
+
+// New reports whether the order creates the window
+func (w *WindowOrder) New() bool {
+	return w.Has(WINDOW_ORDER_STATE_NEW)
+}
+
+// Deleted reports whether the order deletes the window
+func (w *WindowOrder) Deleted() bool {
+	return w.Has(WINDOW_ORDER_STATE_DELETED)
+}
+
+// Bounds returns the window on the desktop, if WindowOffset and WindowSize
+// are set
+func (w *WindowOrder) Bounds() image.Rectangle {
+	return image.Rectangle{Min: w.WindowOffset, Max: w.WindowOffset.Add(w.WindowSize)}
+}
+
+// Icon TS_ICON_INFO, an icon of a window. The bitmaps are bottom-up device
+// independent bitmaps of Bpp bits per pixel, with rows padded to 4 bytes,
+// the mask being 1 bit per pixel.
+// See [MS-RDPERP] 2.2.1.2.3
+type Icon struct {
+	CacheEntry uint16
+	CacheId    uint8
+	Bpp        uint8
+	Width      uint16
+	Height     uint16
+	ColorTable []byte
+	BitsMask   []byte
+	BitsColor  []byte
+}
+
+// Cached reports whether the icon is the cache entry of an earlier icon,
+// without image data
+func (i *Icon) Cached() bool {
+	return i.BitsColor == nil
+}
+
+// Image decodes the icon, transparent where the mask is set. Only icons of
+// 24 and 32 bits per pixel are decoded.
+func (i *Icon) Image() (image.Image, error) {
+	if i.Bpp != 24 && i.Bpp != 32 {
+		return nil, fmt.Errorf("icon of %d bpp not supported", i.Bpp)
+	}
+	width, height := int(i.Width), int(i.Height)
+	stride, maskStride := (width*int(i.Bpp)/8+3)&^3, ((width+7)/8+3)&^3
+	if len(i.BitsColor) < stride*height {
+		return nil, fmt.Errorf("icon of %dx%d with %d bytes", width, height, len(i.BitsColor))
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := i.BitsColor[(height-1-y)*stride:]
+		for x := 0; x < width; x++ {
+			px := row[x*int(i.Bpp)/8:]
+			c := color.NRGBA{R: px[2], G: px[1], B: px[0], A: 0xFF}
+			if i.Bpp == 32 {
+				c.A = px[3]
+			}
+			if len(i.BitsMask) >= maskStride*height && i.BitsMask[(height-1-y)*maskStride+x/8]&(0x80>>(x%8)) != 0 {
+				c.A = 0
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img, nil
+}
+
+// readIcon reads TS_ICON_INFO
+func readIcon(r io.Reader) *Icon {
+	icon := &Icon{}
+	core.ReadLE(r, &icon.CacheEntry)
+	core.ReadLE(r, &icon.CacheId)
+	core.ReadLE(r, &icon.Bpp)
+	core.ReadLE(r, &icon.Width)
+	core.ReadLE(r, &icon.Height)
+	var colorTableLength, maskLength, colorLength uint16
+	if icon.Bpp <= 8 {
+		core.ReadLE(r, &colorTableLength)
+	}
+	core.ReadLE(r, &maskLength)
+	core.ReadLE(r, &colorLength)
+	icon.BitsMask = core.ReadBytes(r, int(maskLength))
+	icon.ColorTable = core.ReadBytes(r, int(colorTableLength))
+	icon.BitsColor = core.ReadBytes(r, int(colorLength))
+	return icon
+}
+
+// readRects reads a count of TS_RECTANGLE_16
+func readRects(r io.Reader) []image.Rectangle {
+	var count uint16
+	core.ReadLE(r, &count)
+	rects := make([]image.Rectangle, count)
+	for i := range rects {
+		rect := core.ReadLE(r, &rectangle16{})
+		rects[i] = image.Rect(int(rect.Left), int(rect.Top), int(rect.Right), int(rect.Bottom))
+	}
+	return rects
+}
+
+// readPoint reads a pair of signed coordinates
+func readPoint(r io.Reader) image.Point {
+	var p [2]int32
+	core.ReadLE(r, &p)
+	return image.Pt(int(p[0]), int(p[1]))
+}
+
+// readSize reads a width and height
+func readSize(r io.Reader) image.Point {
+	var size [2]uint32
+	core.ReadLE(r, &size)
+	return image.Pt(int(size[0]), int(size[1]))
+}
+
+// readString reads UNICODE_STRING
+func readString(r io.Reader) string {
+	var length uint16
+	core.ReadLE(r, &length)
+	core.ThrowIf(length > maxTitleLength, fmt.Errorf("invalid window order string length %d", length))
+	return core.UnicodeDecode(core.ReadBytes(r, int(length)))
+}
+
+// skip reads and drops n bytes
+func skip(r io.Reader, n int) {
+	core.ReadBytes(r, n)
+}
+
+// read reads the window order after its fields present flags, the fields
+// coming in the order of [MS-RDPERP] 2.2.1.3.1.2.1 rather than that of
+// their flags
+func (w *WindowOrder) read(r io.Reader) {
+	core.ReadLE(r, &w.WindowId)
+	switch {
+	case w.Has(WINDOW_ORDER_ICON):
+		w.Icon = readIcon(r)
+		return
+	case w.Has(WINDOW_ORDER_CACHEDICON):
+		w.Icon = &Icon{}
+		core.ReadLE(r, &w.Icon.CacheEntry)
+		core.ReadLE(r, &w.Icon.CacheId)
+		return
+	case w.Deleted():
+		return
+	}
+	if w.Has(WINDOW_ORDER_FIELD_OWNER) {
+		core.ReadLE(r, &w.OwnerWindowId)
+	}
+	if w.Has(WINDOW_ORDER_FIELD_STYLE) {
+		core.ReadLE(r, &w.Style)
+		core.ReadLE(r, &w.ExtendedStyle)
+	}
+	if w.Has(WINDOW_ORDER_FIELD_SHOW) {
+		core.ReadLE(r, &w.ShowState)
+	}
+	if w.Has(WINDOW_ORDER_FIELD_TITLE) {
+		w.Title = readString(r)
+	}
+	if w.Has(WINDOW_ORDER_FIELD_CLIENTAREAOFFSET) {
+		w.ClientOffset = readPoint(r)
+	}
+	if w.Has(WINDOW_ORDER_FIELD_CLIENTAREASIZE) {
+		w.ClientSize = readSize(r)
+	}
+	if w.Has(WINDOW_ORDER_FIELD_RESIZE_MARGIN_X) {
+		skip(r, 8)
+	}
+	if w.Has(WINDOW_ORDER_FIELD_RESIZE_MARGIN_Y) {
+		skip(r, 8)
+	}
+	if w.Has(WINDOW_ORDER_FIELD_RPCONTENT) {
+		skip(r, 1)
+	}
+	if w.Has(WINDOW_ORDER_FIELD_ROOTPARENT) {
+		skip(r, 4)
+	}
+	if w.Has(WINDOW_ORDER_FIELD_WNDOFFSET) {
+		w.WindowOffset = readPoint(r)
+	}
+	if w.Has(WINDOW_ORDER_FIELD_WNDCLIENTDELTA) {
+		skip(r, 8)
+	}
+	if w.Has(WINDOW_ORDER_FIELD_WNDSIZE) {
+		w.WindowSize = readSize(r)
+	}
+	if w.Has(WINDOW_ORDER_FIELD_WNDRECTS) {
+		w.WindowRects = readRects(r)
+	}
+	if w.Has(WINDOW_ORDER_FIELD_VISOFFSET) {
+		w.VisibleOffset = readPoint(r)
+	}
+	if w.Has(WINDOW_ORDER_FIELD_VISIBILITY) {
+		w.VisibilityRects = readRects(r)
+	}
+	// the overlay, taskbar button, z-order and app bar fields that follow
+	// are not kept, the rest of the order is dropped by the caller
+}
+
+// ReadWindowOrders reads the window orders of the orders of an Orders
+// update, data being count orders. Orders of other kinds have no length
+// and end the reading; the orders of windows before them are returned
+// with a nil error. Notification area and desktop orders are skipped.
+func ReadWindowOrders(data []byte, count int) (orders []*WindowOrder, err error) {
+	err = core.Try(func() {
+		r := bytes.NewReader(data)
+		for i := 0; i < count; i++ {
+			var controlFlags uint8
+			core.ReadLE(r, &controlFlags)
+			if controlFlags&(TS_STANDARD|TS_SECONDARY) != TS_SECONDARY || controlFlags>>2 != TS_ALTSEC_WINDOW {
+				return
+			}
+			var size uint16
+			core.ReadLE(r, &size)
+			// the size counts the control flags and itself
+			core.ThrowIf(size < 11 || int(size)-3 > r.Len(), fmt.Errorf("invalid window order size %d", size))
+			order := bytes.NewReader(core.ReadBytes(r, int(size)-3))
+
+			w := &WindowOrder{}
+			core.ReadLE(order, &w.FieldsPresent)
+			if !w.Has(WINDOW_ORDER_TYPE_WINDOW) {
+				continue
+			}
+			w.read(order)
+			orders = append(orders, w)
+		}
+	})
+	return orders, err
+}
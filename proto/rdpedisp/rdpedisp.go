@@ -0,0 +1,190 @@
+package rdpedisp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/glog"
+	"github.com/kdsmith18542/gordp/proto/mcs"
+)
+
+// CHANNEL_NAME is the dynamic virtual channel carrying monitor layout
+// changes (MS-RDPEDISP)
+const CHANNEL_NAME = "Microsoft::Windows::RDS::DisplayControl"
+
+// PDU types
+const (
+	DISPLAYCONTROL_PDU_TYPE_MONITOR_LAYOUT = 0x00000002
+	DISPLAYCONTROL_PDU_TYPE_CAPS           = 0x00000005
+)
+
+// DISPLAYCONTROL_MONITOR_LAYOUT Flags
+const DISPLAYCONTROL_MONITOR_PRIMARY = 0x00000001
+
+// Monitor size limits
+// See [MS-RDPEDISP] 2.2.2.2.1
+const (
+	MinMonitorSize = 200
+	MaxMonitorSize = 8192
+)
+
+// monitorLayoutSize is the size of a DISPLAYCONTROL_MONITOR_LAYOUT
+const monitorLayoutSize = 40
+
+// ErrNotReady is returned when a layout is sent before the server has
+// opened the channel and sent its capabilities
+var ErrNotReady = errors.New("rdpedisp channel not ready")
+
+// DisplayControlHeader DISPLAYCONTROL_HEADER
+type DisplayControlHeader struct {
+	Type   uint32
+	Length uint32
+}
+
+func (h *DisplayControlHeader) Read(r io.Reader) {
+	core.ReadLE(r, h)
+}
+
+// Caps DISPLAYCONTROL_CAPS_PDU, the limits of the layouts the server takes
+type Caps struct {
+	MaxNumMonitors        uint32
+	MaxMonitorAreaFactorA uint32
+	MaxMonitorAreaFactorB uint32
+}
+
+// NewMonitorLayoutPdu builds DISPLAYCONTROL_MONITOR_LAYOUT_PDU of monitors
+// See [MS-RDPEDISP] 2.2.2.2
+func NewMonitorLayoutPdu(monitors []mcs.MonitorLayout) []byte {
+	buf := new(bytes.Buffer)
+	core.WriteLE(buf, DisplayControlHeader{
+		Type:   DISPLAYCONTROL_PDU_TYPE_MONITOR_LAYOUT,
+		Length: uint32(16 + monitorLayoutSize*len(monitors)),
+	})
+	core.WriteLE(buf, uint32(monitorLayoutSize))
+	core.WriteLE(buf, uint32(len(monitors)))
+	for _, m := range monitors {
+		orientation := m.Orientation
+		if orientation == 1 { // MonitorLayout's own value for portrait
+			orientation = mcs.ORIENTATION_PORTRAIT
+		}
+		var flags uint32
+		if m.Flags&mcs.TS_MONITOR_PRIMARY != 0 {
+			flags |= DISPLAYCONTROL_MONITOR_PRIMARY
+		}
+		core.WriteLE(buf, flags)
+		core.WriteLE(buf, m.Left)
+		core.WriteLE(buf, m.Top)
+		core.WriteLE(buf, uint32(m.Right-m.Left+1))
+		core.WriteLE(buf, uint32(m.Bottom-m.Top+1))
+		core.WriteLE(buf, m.PhysicalWidthMm)
+		core.WriteLE(buf, m.PhysicalHeightMm)
+		core.WriteLE(buf, orientation)
+		core.WriteLE(buf, m.DesktopScaleFactor)
+		core.WriteLE(buf, m.DeviceScaleFactor)
+	}
+	return buf.Bytes()
+}
+
+// DisplayManager drives the RDPEDISP channel. It is registered as the
+// dynamic virtual channel handler for CHANNEL_NAME and keeps the
+// capabilities the server sends.
+type DisplayManager struct {
+	mu        sync.Mutex
+	send      func(channelId uint32, data []byte) error
+	channelId uint32
+	caps      *Caps
+}
+
+// NewDisplayManager creates a display manager writing channel data with send
+func NewDisplayManager(send func(channelId uint32, data []byte) error) *DisplayManager {
+	return &DisplayManager{send: send}
+}
+
+// Ready reports whether monitor layouts can be sent
+func (m *DisplayManager) Ready() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.caps != nil
+}
+
+// Caps returns the capabilities the server sent, and whether it has
+func (m *DisplayManager) Caps() (Caps, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.caps == nil {
+		return Caps{}, false
+	}
+	return *m.caps, true
+}
+
+// OnChannelCreated remembers the channel id assigned by the server
+func (m *DisplayManager) OnChannelCreated(channelId uint32, channelName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.channelId = channelId
+	return nil
+}
+
+// OnChannelOpened handles channel open events
+func (m *DisplayManager) OnChannelOpened(channelId uint32) error {
+	return nil
+}
+
+// OnChannelClosed stops layout changes until the channel is opened again
+func (m *DisplayManager) OnChannelClosed(channelId uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.caps = nil
+	return nil
+}
+
+// OnDataReceived handles the server PDUs of the channel
+func (m *DisplayManager) OnDataReceived(channelId uint32, data []byte) error {
+	if len(data) < 8 {
+		return fmt.Errorf("invalid rdpedisp pdu size: %d", len(data))
+	}
+	r := bytes.NewReader(data)
+	header := DisplayControlHeader{}
+	header.Read(r)
+
+	switch header.Type {
+	case DISPLAYCONTROL_PDU_TYPE_CAPS:
+		caps := &Caps{}
+		if err := core.Try(func() { core.ReadLE(r, caps) }); err != nil {
+			return fmt.Errorf("failed to parse caps pdu: %w", err)
+		}
+		glog.Debugf("rdpedisp server caps: %+v", *caps)
+		m.mu.Lock()
+		m.channelId = channelId
+		m.caps = caps
+		m.mu.Unlock()
+	default:
+		glog.Debugf("rdpedisp: unhandled pdu type %#x", header.Type)
+	}
+	return nil
+}
+
+// SendMonitorLayout asks the server to change the layout of the session to
+// monitors, each of them MinMonitorSize to MaxMonitorSize pixels wide and
+// high, and of an even width
+func (m *DisplayManager) SendMonitorLayout(monitors []mcs.MonitorLayout) error {
+	for i, monitor := range monitors {
+		width, height := int64(monitor.Right)-int64(monitor.Left)+1, int64(monitor.Bottom)-int64(monitor.Top)+1
+		if width < MinMonitorSize || width > MaxMonitorSize || height < MinMonitorSize || height > MaxMonitorSize || width%2 != 0 {
+			return fmt.Errorf("monitor %d of %dx%d: %w", i, width, height, mcs.ErrMonitorGeometry)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.caps == nil {
+		return ErrNotReady
+	}
+	if uint32(len(monitors)) > m.caps.MaxNumMonitors {
+		return fmt.Errorf("%w: %d, the server takes at most %d", mcs.ErrMonitorCount, len(monitors), m.caps.MaxNumMonitors)
+	}
+	return m.send(m.channelId, NewMonitorLayoutPdu(monitors))
+}
@@ -0,0 +1,51 @@
+package rdpedisp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/proto/mcs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisplayManager(t *testing.T) {
+	var sent []byte
+	var sentChannel uint32
+	m := NewDisplayManager(func(channelId uint32, data []byte) error {
+		sentChannel, sent = channelId, data
+		return nil
+	})
+	portrait := []mcs.MonitorLayout{{
+		Right: 1079, Bottom: 1919, Flags: mcs.TS_MONITOR_PRIMARY,
+		PhysicalWidthMm: 300, PhysicalHeightMm: 500, Orientation: 1,
+		DesktopScaleFactor: 100, DeviceScaleFactor: 100,
+	}}
+
+	require.NoError(t, m.OnChannelCreated(7, CHANNEL_NAME))
+	assert.ErrorIs(t, m.SendMonitorLayout(portrait), ErrNotReady)
+
+	caps := new(bytes.Buffer)
+	core.WriteLE(caps, DisplayControlHeader{Type: DISPLAYCONTROL_PDU_TYPE_CAPS, Length: 20})
+	core.WriteLE(caps, Caps{MaxNumMonitors: 1, MaxMonitorAreaFactorA: 8192, MaxMonitorAreaFactorB: 8192})
+	require.NoError(t, m.OnDataReceived(7, caps.Bytes()))
+	assert.True(t, m.Ready())
+
+	require.NoError(t, m.SendMonitorLayout(portrait))
+	assert.Equal(t, uint32(7), sentChannel)
+	want := new(bytes.Buffer)
+	for _, v := range []uint32{DISPLAYCONTROL_PDU_TYPE_MONITOR_LAYOUT, 56, 40, 1,
+		DISPLAYCONTROL_MONITOR_PRIMARY, 0, 0, 1080, 1920, 300, 500, mcs.ORIENTATION_PORTRAIT, 100, 100} {
+		core.WriteLE(want, v)
+	}
+	assert.Equal(t, want.Bytes(), sent)
+
+	assert.ErrorIs(t, m.SendMonitorLayout(append(portrait, portrait[0])), mcs.ErrMonitorCount)
+	odd := portrait[0]
+	odd.Right = 1080
+	assert.ErrorIs(t, m.SendMonitorLayout([]mcs.MonitorLayout{odd}), mcs.ErrMonitorGeometry)
+
+	require.NoError(t, m.OnChannelClosed(7))
+	assert.False(t, m.Ready())
+}
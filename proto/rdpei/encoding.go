@@ -0,0 +1,106 @@
+package rdpei
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// RDPEI packs integers into a variable number of bytes. The top bits of the
+// first byte hold the byte count (and sign), the value follows big-endian.
+
+// WriteTwoByteUnsigned writes a TWO_BYTE_UNSIGNED_INTEGER (0 to 0x7FFF)
+func WriteTwoByteUnsigned(buf *bytes.Buffer, v uint16) {
+	if v <= 0x7F {
+		buf.WriteByte(uint8(v))
+		return
+	}
+	buf.WriteByte(0x80 | uint8(v>>8&0x7F))
+	buf.WriteByte(uint8(v))
+}
+
+// ReadTwoByteUnsigned reads a TWO_BYTE_UNSIGNED_INTEGER
+func ReadTwoByteUnsigned(r io.Reader) uint16 {
+	b := core.ReadBytes(r, 1)[0]
+	v := uint16(b & 0x7F)
+	if b&0x80 != 0 {
+		v = v<<8 | uint16(core.ReadBytes(r, 1)[0])
+	}
+	return v
+}
+
+// WriteFourByteUnsigned writes a FOUR_BYTE_UNSIGNED_INTEGER (0 to 0x3FFFFFFF)
+func WriteFourByteUnsigned(buf *bytes.Buffer, v uint32) {
+	n := 0
+	for n < 3 && v > uint32(1)<<(6+8*n)-1 {
+		n++
+	}
+	buf.WriteByte(uint8(n)<<6 | uint8(v>>(8*n)&0x3F))
+	for i := n - 1; i >= 0; i-- {
+		buf.WriteByte(uint8(v >> (8 * i)))
+	}
+}
+
+// ReadFourByteUnsigned reads a FOUR_BYTE_UNSIGNED_INTEGER
+func ReadFourByteUnsigned(r io.Reader) uint32 {
+	b := core.ReadBytes(r, 1)[0]
+	v := uint32(b & 0x3F)
+	for _, next := range core.ReadBytes(r, int(b>>6)) {
+		v = v<<8 | uint32(next)
+	}
+	return v
+}
+
+// WriteFourByteSigned writes a FOUR_BYTE_SIGNED_INTEGER (-0x1FFFFFFF to 0x1FFFFFFF)
+func WriteFourByteSigned(buf *bytes.Buffer, v int32) {
+	var sign uint8
+	mag := uint32(v)
+	if v < 0 {
+		sign = 0x20
+		mag = uint32(-v)
+	}
+	n := 0
+	for n < 3 && mag > uint32(1)<<(5+8*n)-1 {
+		n++
+	}
+	buf.WriteByte(uint8(n)<<6 | sign | uint8(mag>>(8*n)&0x1F))
+	for i := n - 1; i >= 0; i-- {
+		buf.WriteByte(uint8(mag >> (8 * i)))
+	}
+}
+
+// ReadFourByteSigned reads a FOUR_BYTE_SIGNED_INTEGER
+func ReadFourByteSigned(r io.Reader) int32 {
+	b := core.ReadBytes(r, 1)[0]
+	mag := uint32(b & 0x1F)
+	for _, next := range core.ReadBytes(r, int(b>>6)) {
+		mag = mag<<8 | uint32(next)
+	}
+	if b&0x20 != 0 {
+		return -int32(mag)
+	}
+	return int32(mag)
+}
+
+// WriteEightByteUnsigned writes an EIGHT_BYTE_UNSIGNED_INTEGER (0 to 0x1FFFFFFFFFFFFFFF)
+func WriteEightByteUnsigned(buf *bytes.Buffer, v uint64) {
+	n := 0
+	for n < 7 && v > uint64(1)<<(5+8*n)-1 {
+		n++
+	}
+	buf.WriteByte(uint8(n)<<5 | uint8(v>>(8*n)&0x1F))
+	for i := n - 1; i >= 0; i-- {
+		buf.WriteByte(uint8(v >> (8 * i)))
+	}
+}
+
+// ReadEightByteUnsigned reads an EIGHT_BYTE_UNSIGNED_INTEGER
+func ReadEightByteUnsigned(r io.Reader) uint64 {
+	b := core.ReadBytes(r, 1)[0]
+	v := uint64(b & 0x1F)
+	for _, next := range core.ReadBytes(r, int(b>>5)) {
+		v = v<<8 | uint64(next)
+	}
+	return v
+}
@@ -0,0 +1,247 @@
+package rdpei
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/glog"
+)
+
+// CHANNEL_NAME is the dynamic virtual channel carrying touch input (MS-RDPEI)
+const CHANNEL_NAME = "Microsoft::Windows::RDS::Input"
+
+// Event identifiers
+const (
+	EVENTID_SC_READY                 = 0x0001
+	EVENTID_CS_READY                 = 0x0002
+	EVENTID_TOUCH                    = 0x0003
+	EVENTID_SUSPEND_TOUCH            = 0x0004
+	EVENTID_RESUME_TOUCH             = 0x0005
+	EVENTID_DISMISS_HOVERING_CONTACT = 0x0006
+)
+
+// Protocol versions
+const (
+	RDPINPUT_PROTOCOL_V100 = 0x00010000
+	RDPINPUT_PROTOCOL_V101 = 0x00010001
+	RDPINPUT_PROTOCOL_V200 = 0x00020000
+	RDPINPUT_PROTOCOL_V300 = 0x00030000
+)
+
+// CS Ready flags
+const (
+	CS_READY_FLAGS_SHOW_TOUCH_VISUALS          = 0x00000001
+	CS_READY_FLAGS_DISABLE_TIMESTAMP_INJECTION = 0x00000002
+)
+
+// Touch contact flags
+const (
+	CONTACT_FLAG_DOWN      = 0x0001
+	CONTACT_FLAG_UPDATE    = 0x0002
+	CONTACT_FLAG_UP        = 0x0004
+	CONTACT_FLAG_INRANGE   = 0x0008
+	CONTACT_FLAG_INCONTACT = 0x0010
+	CONTACT_FLAG_CANCELED  = 0x0020
+)
+
+// Optional touch contact fields
+const (
+	CONTACT_DATA_CONTACTRECT_PRESENT = 0x0001
+	CONTACT_DATA_ORIENTATION_PRESENT = 0x0002
+	CONTACT_DATA_PRESSURE_PRESENT    = 0x0004
+)
+
+// MaxTouchContacts is the number of simultaneous contacts announced to the server
+const MaxTouchContacts = 10
+
+// ErrNotReady is returned when touch input is sent before the server has
+// opened the channel and completed the ready handshake
+var ErrNotReady = errors.New("rdpei channel not ready")
+
+// TouchState is the state of a touch contact within a frame
+type TouchState int
+
+const (
+	TouchDown TouchState = iota
+	TouchUpdate
+	TouchUp
+	TouchHover
+	TouchCancel
+)
+
+// contactFlags maps a TouchState to one of the valid contact flag
+// combinations allowed by MS-RDPEI
+func (s TouchState) contactFlags() uint32 {
+	switch s {
+	case TouchDown:
+		return CONTACT_FLAG_DOWN | CONTACT_FLAG_INRANGE | CONTACT_FLAG_INCONTACT
+	case TouchUpdate:
+		return CONTACT_FLAG_UPDATE | CONTACT_FLAG_INRANGE | CONTACT_FLAG_INCONTACT
+	case TouchHover:
+		return CONTACT_FLAG_UPDATE | CONTACT_FLAG_INRANGE
+	case TouchCancel:
+		return CONTACT_FLAG_UP | CONTACT_FLAG_CANCELED
+	default:
+		return CONTACT_FLAG_UP
+	}
+}
+
+// TouchContact is one finger of a touch frame
+type TouchContact struct {
+	ID       uint8
+	X        int32
+	Y        int32
+	Pressure uint32 // 0 to 1024, 0 leaves the field out
+	State    TouchState
+}
+
+// RdpInputHeader RDPINPUT_HEADER
+type RdpInputHeader struct {
+	EventId   uint16
+	PduLength uint32
+}
+
+func (h *RdpInputHeader) Read(r io.Reader) {
+	core.ReadLE(r, h)
+}
+
+// writePdu prefixes body with an RDPINPUT_HEADER
+func writePdu(eventId uint16, body []byte) []byte {
+	buf := new(bytes.Buffer)
+	core.WriteLE(buf, RdpInputHeader{EventId: eventId, PduLength: uint32(len(body) + 6)})
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// NewCsReadyPdu builds RDPINPUT_CS_READY_PDU
+func NewCsReadyPdu(flags uint32, protocolVersion uint32, maxTouchContacts uint16) []byte {
+	buf := new(bytes.Buffer)
+	core.WriteLE(buf, flags)
+	core.WriteLE(buf, protocolVersion)
+	core.WriteLE(buf, maxTouchContacts)
+	return writePdu(EVENTID_CS_READY, buf.Bytes())
+}
+
+// NewTouchEventPdu builds RDPINPUT_TOUCH_EVENT_PDU carrying
+// a single frame
+func NewTouchEventPdu(contacts []TouchContact) []byte {
+	buf := new(bytes.Buffer)
+	WriteFourByteUnsigned(buf, 0) // encodeTime
+	WriteTwoByteUnsigned(buf, 1)  // frameCount
+
+	// RDPINPUT_TOUCH_FRAME
+	WriteTwoByteUnsigned(buf, uint16(len(contacts)))
+	WriteEightByteUnsigned(buf, 0) // frameOffset
+	for _, contact := range contacts {
+		var fields uint16
+		if contact.Pressure != 0 {
+			fields |= CONTACT_DATA_PRESSURE_PRESENT
+		}
+		buf.WriteByte(contact.ID)
+		WriteTwoByteUnsigned(buf, fields)
+		WriteFourByteSigned(buf, contact.X)
+		WriteFourByteSigned(buf, contact.Y)
+		WriteFourByteUnsigned(buf, contact.State.contactFlags())
+		if fields&CONTACT_DATA_PRESSURE_PRESENT != 0 {
+			WriteFourByteUnsigned(buf, contact.Pressure)
+		}
+	}
+	return writePdu(EVENTID_TOUCH, buf.Bytes())
+}
+
+// TouchManager drives the RDPEI channel. It is registered as the dynamic
+// virtual channel handler for CHANNEL_NAME and answers the server ready PDU.
+type TouchManager struct {
+	mu              sync.Mutex
+	send            func(channelId uint32, data []byte) error
+	channelId       uint32
+	ready           bool
+	suspended       bool
+	protocolVersion uint32
+}
+
+// NewTouchManager creates a touch manager writing channel data with send
+func NewTouchManager(send func(channelId uint32, data []byte) error) *TouchManager {
+	return &TouchManager{send: send}
+}
+
+// Ready reports whether touch frames can be sent
+func (m *TouchManager) Ready() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ready && !m.suspended
+}
+
+// OnChannelCreated remembers the channel id assigned by the server
+func (m *TouchManager) OnChannelCreated(channelId uint32, channelName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.channelId = channelId
+	return nil
+}
+
+// OnChannelOpened handles channel open events
+func (m *TouchManager) OnChannelOpened(channelId uint32) error {
+	return nil
+}
+
+// OnChannelClosed stops touch input until the channel is negotiated again
+func (m *TouchManager) OnChannelClosed(channelId uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ready = false
+	return nil
+}
+
+// OnDataReceived handles the server PDUs of the channel
+func (m *TouchManager) OnDataReceived(channelId uint32, data []byte) error {
+	if len(data) < 6 {
+		return fmt.Errorf("invalid rdpei pdu size: %d", len(data))
+	}
+	r := bytes.NewReader(data)
+	header := RdpInputHeader{}
+	header.Read(r)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch header.EventId {
+	case EVENTID_SC_READY:
+		var version uint32
+		if err := core.Try(func() { core.ReadLE(r, &version) }); err != nil {
+			return fmt.Errorf("failed to parse sc ready pdu: %w", err)
+		}
+		// answer with the highest version both sides speak
+		m.protocolVersion = min(version, RDPINPUT_PROTOCOL_V101)
+		glog.Debugf("rdpei server ready, version %#x", version)
+		pdu := NewCsReadyPdu(CS_READY_FLAGS_SHOW_TOUCH_VISUALS, m.protocolVersion, MaxTouchContacts)
+		if err := m.send(channelId, pdu); err != nil {
+			return err
+		}
+		m.channelId = channelId
+		m.ready = true
+	case EVENTID_SUSPEND_TOUCH:
+		m.suspended = true
+	case EVENTID_RESUME_TOUCH:
+		m.suspended = false
+	default:
+		glog.Debugf("rdpei: unhandled event id %#x", header.EventId)
+	}
+	return nil
+}
+
+// SendTouchFrame sends one frame of touch contacts to the server
+func (m *TouchManager) SendTouchFrame(contacts []TouchContact) error {
+	if len(contacts) > MaxTouchContacts {
+		return fmt.Errorf("too many touch contacts: %d > %d", len(contacts), MaxTouchContacts)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.ready || m.suspended {
+		return ErrNotReady
+	}
+	return m.send(m.channelId, NewTouchEventPdu(contacts))
+}
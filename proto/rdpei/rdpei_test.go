@@ -0,0 +1,138 @@
+package rdpei
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTwoByteUnsigned(t *testing.T) {
+	for _, tc := range []struct {
+		value uint16
+		wire  []byte
+	}{
+		{0x00, []byte{0x00}},
+		{0x7F, []byte{0x7F}},
+		{0x80, []byte{0x80, 0x80}},
+		{0x7FFF, []byte{0xFF, 0xFF}},
+	} {
+		buf := new(bytes.Buffer)
+		WriteTwoByteUnsigned(buf, tc.value)
+		assert.Equal(t, tc.wire, buf.Bytes(), "value %#x", tc.value)
+		assert.Equal(t, tc.value, ReadTwoByteUnsigned(bytes.NewReader(tc.wire)))
+	}
+}
+
+func TestFourByteUnsigned(t *testing.T) {
+	for _, tc := range []struct {
+		value uint32
+		wire  []byte
+	}{
+		{0x3F, []byte{0x3F}},
+		{0x40, []byte{0x40, 0x40}},
+		{0x3FFF, []byte{0x7F, 0xFF}},
+		{0x4000, []byte{0x80, 0x40, 0x00}},
+		{0x3FFFFFFF, []byte{0xFF, 0xFF, 0xFF, 0xFF}},
+	} {
+		buf := new(bytes.Buffer)
+		WriteFourByteUnsigned(buf, tc.value)
+		assert.Equal(t, tc.wire, buf.Bytes(), "value %#x", tc.value)
+		assert.Equal(t, tc.value, ReadFourByteUnsigned(bytes.NewReader(tc.wire)))
+	}
+}
+
+func TestFourByteSigned(t *testing.T) {
+	for _, tc := range []struct {
+		value int32
+		wire  []byte
+	}{
+		{0, []byte{0x00}},
+		{0x1F, []byte{0x1F}},
+		{-1, []byte{0x21}},
+		{0x20, []byte{0x40, 0x20}},
+		{-0x1FFF, []byte{0x7F, 0xFF}},
+		{0x1FFFFFFF, []byte{0xDF, 0xFF, 0xFF, 0xFF}},
+	} {
+		buf := new(bytes.Buffer)
+		WriteFourByteSigned(buf, tc.value)
+		assert.Equal(t, tc.wire, buf.Bytes(), "value %d", tc.value)
+		assert.Equal(t, tc.value, ReadFourByteSigned(bytes.NewReader(tc.wire)))
+	}
+}
+
+func TestEightByteUnsigned(t *testing.T) {
+	for _, value := range []uint64{0, 0x1F, 0x20, 0x1FFF, 0x12345678, 0x1FFFFFFFFFFFFFFF} {
+		buf := new(bytes.Buffer)
+		WriteEightByteUnsigned(buf, value)
+		assert.Equal(t, value, ReadEightByteUnsigned(bytes.NewReader(buf.Bytes())))
+	}
+}
+
+// scReadyPdu builds the server ready PDU the way a server sends it
+func scReadyPdu(version uint32) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{byte(version), byte(version >> 8), byte(version >> 16), byte(version >> 24)})
+	return writePdu(EVENTID_SC_READY, buf.Bytes())
+}
+
+func TestTouchManager(t *testing.T) {
+	type sent struct {
+		channelId uint32
+		data      []byte
+	}
+	var out []sent
+	m := NewTouchManager(func(channelId uint32, data []byte) error {
+		out = append(out, sent{channelId, data})
+		return nil
+	})
+
+	contacts := []TouchContact{{ID: 0, X: 100, Y: 200, State: TouchDown}}
+	assert.ErrorIs(t, m.SendTouchFrame(contacts), ErrNotReady)
+
+	require.NoError(t, m.OnChannelCreated(7, CHANNEL_NAME))
+	require.NoError(t, m.OnDataReceived(7, scReadyPdu(RDPINPUT_PROTOCOL_V200)))
+	require.Len(t, out, 1)
+	assert.Equal(t, uint32(7), out[0].channelId)
+	assert.Equal(t, NewCsReadyPdu(CS_READY_FLAGS_SHOW_TOUCH_VISUALS, RDPINPUT_PROTOCOL_V101, MaxTouchContacts), out[0].data)
+	assert.True(t, m.Ready())
+
+	contacts = []TouchContact{
+		{ID: 0, X: 100, Y: 200, State: TouchDown},
+		{ID: 1, X: 300, Y: 400, Pressure: 512, State: TouchUpdate},
+	}
+	require.NoError(t, m.SendTouchFrame(contacts))
+	require.Len(t, out, 2)
+
+	r := bytes.NewReader(out[1].data)
+	header := RdpInputHeader{}
+	header.Read(r)
+	assert.Equal(t, uint16(EVENTID_TOUCH), header.EventId)
+	assert.Equal(t, uint32(len(out[1].data)), header.PduLength)
+	assert.Equal(t, uint32(0), ReadFourByteUnsigned(r))  // encodeTime
+	assert.Equal(t, uint16(1), ReadTwoByteUnsigned(r))   // frameCount
+	assert.Equal(t, uint16(2), ReadTwoByteUnsigned(r))   // contactCount
+	assert.Equal(t, uint64(0), ReadEightByteUnsigned(r)) // frameOffset
+	for _, contact := range contacts {
+		id, _ := r.ReadByte()
+		assert.Equal(t, contact.ID, id)
+		fields := ReadTwoByteUnsigned(r)
+		assert.Equal(t, contact.X, ReadFourByteSigned(r))
+		assert.Equal(t, contact.Y, ReadFourByteSigned(r))
+		assert.Equal(t, contact.State.contactFlags(), ReadFourByteUnsigned(r))
+		if fields&CONTACT_DATA_PRESSURE_PRESENT != 0 {
+			assert.Equal(t, contact.Pressure, ReadFourByteUnsigned(r))
+		}
+	}
+	assert.Zero(t, r.Len())
+
+	// the server may suspend touch input at any time
+	require.NoError(t, m.OnDataReceived(7, writePdu(EVENTID_SUSPEND_TOUCH, nil)))
+	assert.ErrorIs(t, m.SendTouchFrame(contacts), ErrNotReady)
+	require.NoError(t, m.OnDataReceived(7, writePdu(EVENTID_RESUME_TOUCH, nil)))
+	assert.NoError(t, m.SendTouchFrame(contacts))
+
+	require.NoError(t, m.OnChannelClosed(7))
+	assert.False(t, m.Ready())
+}
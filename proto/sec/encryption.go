@@ -0,0 +1,294 @@
+package sec
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rc4"
+	"crypto/rsa"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// Encryption methods of Standard RDP Security, as in the Server Security
+// Data (TS_UD_SC_SEC1)
+const (
+	encryptionMethod40Bit  = 0x00000001
+	encryptionMethod128Bit = 0x00000002
+	encryptionMethod56Bit  = 0x00000008
+)
+
+const (
+	// ClientRandomLength is the size of the client and server randoms
+	ClientRandomLength = 32
+
+	// SignatureLength is the size of the MAC in front of encrypted data
+	SignatureLength = 8
+)
+
+// keyUpdateInterval is the number of packets encrypted or decrypted with a
+// session key before it is updated
+// See [MS-RDPBCGR] 5.3.7
+const keyUpdateInterval = 4096
+
+var (
+	// ErrSignature is returned when decrypted data does not match its MAC
+	ErrSignature = errors.New("invalid data signature")
+
+	// ErrEncryptionMethod is returned for FIPS and unknown encryption methods
+	ErrEncryptionMethod = errors.New("unsupported encryption method")
+
+	// ErrNotEncrypted is returned for encrypted data received before
+	// the session keys were derived
+	ErrNotEncrypted = errors.New("encrypted data without session keys")
+)
+
+var (
+	pad1 = bytes.Repeat([]byte{0x36}, 40)
+	pad2 = bytes.Repeat([]byte{0x5C}, 48)
+)
+
+// rc4Key is the RC4 state of one direction of the session
+type rc4Key struct {
+	initial []byte // the key derived at connection, for updates
+	current []byte
+	cipher  *rc4.Cipher
+	uses    int    // packets since the last update
+	count   uint32 // packets in total, for salted MACs
+}
+
+func newRC4Key(key []byte) rc4Key {
+	cipher, _ := rc4.NewCipher(key)
+	return rc4Key{initial: key, current: key, cipher: cipher}
+}
+
+// Encryption encrypts, decrypts and signs the PDUs of a session protected
+// by Standard RDP Security rather than TLS. Encrypt and Decrypt keep the
+// state of their own direction, so one goroutine can encrypt while another
+// decrypts, but calls of each must be serialized in the order the data goes
+// on the wire.
+// See [MS-RDPBCGR] 5.3
+type Encryption struct {
+	method  uint32
+	macKey  []byte
+	encrypt rc4Key
+	decrypt rc4Key
+}
+
+// NewClientEncryption derives the session keys of the client from the two
+// randoms exchanged at connection
+// See [MS-RDPBCGR] 5.3.5
+func NewClientEncryption(method uint32, clientRandom, serverRandom []byte) (*Encryption, error) {
+	return newEncryption(method, clientRandom, serverRandom, false)
+}
+
+// NewServerEncryption derives the session keys of the server, which
+// encrypts with the key the client decrypts with and the other way round
+func NewServerEncryption(method uint32, clientRandom, serverRandom []byte) (*Encryption, error) {
+	return newEncryption(method, clientRandom, serverRandom, true)
+}
+
+func newEncryption(method uint32, clientRandom, serverRandom []byte, server bool) (*Encryption, error) {
+	switch method {
+	case encryptionMethod40Bit, encryptionMethod56Bit, encryptionMethod128Bit:
+	default:
+		return nil, fmt.Errorf("%w: %#x", ErrEncryptionMethod, method)
+	}
+	if len(clientRandom) != ClientRandomLength || len(serverRandom) != ClientRandomLength {
+		return nil, fmt.Errorf("invalid random length: client %d, server %d", len(clientRandom), len(serverRandom))
+	}
+
+	preMasterSecret := append(slices.Clone(clientRandom[:24]), serverRandom[:24]...)
+	masterSecret := bytes.Join([][]byte{
+		saltedHash(preMasterSecret, []byte("A"), clientRandom, serverRandom),
+		saltedHash(preMasterSecret, []byte("BB"), clientRandom, serverRandom),
+		saltedHash(preMasterSecret, []byte("CCC"), clientRandom, serverRandom),
+	}, nil)
+	sessionKeyBlob := bytes.Join([][]byte{
+		saltedHash(masterSecret, []byte("X"), serverRandom, clientRandom),
+		saltedHash(masterSecret, []byte("YY"), serverRandom, clientRandom),
+		saltedHash(masterSecret, []byte("ZZZ"), serverRandom, clientRandom),
+	}, nil)
+	decryptKey := md5Sum(sessionKeyBlob[16:32], clientRandom, serverRandom)
+	encryptKey := md5Sum(sessionKeyBlob[32:48], clientRandom, serverRandom)
+	if server {
+		encryptKey, decryptKey = decryptKey, encryptKey
+	}
+
+	return &Encryption{
+		method:  method,
+		macKey:  reduceKey(sessionKeyBlob[:16], method),
+		encrypt: newRC4Key(reduceKey(encryptKey, method)),
+		decrypt: newRC4Key(reduceKey(decryptKey, method)),
+	}, nil
+}
+
+// saltedHash is SaltedHash(S, I) of the key derivation, with the randoms in
+// the order given
+func saltedHash(s, i, random1, random2 []byte) []byte {
+	sha := sha1.New()
+	sha.Write(i)
+	sha.Write(s)
+	sha.Write(random1)
+	sha.Write(random2)
+	return md5Sum(s, sha.Sum(nil))
+}
+
+func md5Sum(data ...[]byte) []byte {
+	h := md5.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// reduceKey cuts a 128-bit key to the strength of method, salting the
+// 40-bit and 56-bit keys
+// See [MS-RDPBCGR] 5.3.5.1
+func reduceKey(key []byte, method uint32) []byte {
+	switch method {
+	case encryptionMethod40Bit:
+		return append([]byte{0xD1, 0x26, 0x9E}, key[3:8]...)
+	case encryptionMethod56Bit:
+		return append([]byte{0xD1}, key[1:8]...)
+	}
+	return slices.Clone(key[:16])
+}
+
+// update derives the next key of the direction
+// See [MS-RDPBCGR] 5.3.7
+func (k *rc4Key) update(method uint32) {
+	sha := sha1.New()
+	sha.Write(k.initial)
+	sha.Write(pad1)
+	sha.Write(k.current)
+	key := md5Sum(k.initial, pad2, sha.Sum(nil))[:len(k.current)]
+	cipher, _ := rc4.NewCipher(key)
+	cipher.XORKeyStream(key, key)
+	if method != encryptionMethod128Bit {
+		key = reduceKey(key, method)
+	}
+	k.current = key
+	k.cipher, _ = rc4.NewCipher(key)
+	k.uses = 0
+}
+
+// next readies the key for one more packet
+func (k *rc4Key) next(method uint32) {
+	if k.uses == keyUpdateInterval {
+		k.update(method)
+	}
+	k.uses++
+}
+
+// sign computes the MAC of data, salted with the number of packets sent or
+// received before it for the salted MAC
+// See [MS-RDPBCGR] 5.3.6.1
+func (e *Encryption) sign(data []byte, count uint32, salted bool) []byte {
+	sha := sha1.New()
+	sha.Write(e.macKey)
+	sha.Write(pad1)
+	sha.Write(core.ToLE(uint32(len(data))))
+	sha.Write(data)
+	if salted {
+		sha.Write(core.ToLE(count))
+	}
+	return md5Sum(e.macKey, pad2, sha.Sum(nil))[:SignatureLength]
+}
+
+// Encrypt encrypts data in place and returns its MAC, the salted MAC when
+// salted is set
+func (e *Encryption) Encrypt(data []byte, salted bool) []byte {
+	k := &e.encrypt
+	k.next(e.method)
+	signature := e.sign(data, k.count, salted)
+	k.cipher.XORKeyStream(data, data)
+	k.count++
+	return signature
+}
+
+// Decrypt decrypts data in place and checks it against signature, the
+// salted MAC when salted is set
+func (e *Encryption) Decrypt(data, signature []byte, salted bool) error {
+	k := &e.decrypt
+	k.next(e.method)
+	k.cipher.XORKeyStream(data, data)
+	count := k.count
+	k.count++
+	if !hmac.Equal(e.sign(data, count, salted), signature) {
+		return ErrSignature
+	}
+	return nil
+}
+
+// WriteSecured writes data behind a security header of flags, encrypted and
+// signed with e when it is not nil
+// See [MS-RDPBCGR] 2.2.8.1.1.2
+func WriteSecured(w io.Writer, flags uint16, data []byte, e *Encryption) {
+	if e == nil {
+		NewTsSecurityHeader(flags).Write(w)
+		core.WriteFull(w, data)
+		return
+	}
+	data = slices.Clone(data)
+	signature := e.Encrypt(data, false)
+	NewTsSecurityHeader(flags | SEC_ENCRYPT).Write(w)
+	core.WriteFull(w, signature)
+	core.WriteFull(w, data)
+}
+
+// ReadSecured reads a security header and the rest of r, the data of one
+// PDU, decrypting it with e when the header says it is encrypted
+func ReadSecured(r io.Reader, e *Encryption) (TsSecurityHeader, []byte) {
+	header := TsSecurityHeader{}
+	header.Read(r)
+	data, err := io.ReadAll(r)
+	core.ThrowError(err)
+	if header.Flags&SEC_ENCRYPT == 0 {
+		return header, data
+	}
+	core.ThrowIf(e == nil, ErrNotEncrypted)
+	core.ThrowIf(len(data) < SignatureLength, io.ErrUnexpectedEOF)
+	core.ThrowError(e.Decrypt(data[SignatureLength:], data[:SignatureLength], header.Flags&SEC_SECURE_CHECKSUM != 0))
+	return header, data[SignatureLength:]
+}
+
+// EncryptClientRandom encrypts random with the public key of the server
+// certificate for the Security Exchange PDU. Both are little-endian on the
+// wire, and the result is followed by 8 bytes of padding.
+// See [MS-RDPBCGR] 5.3.4.1
+func EncryptClientRandom(key *rsa.PublicKey, random []byte) []byte {
+	m := new(big.Int).SetBytes(reversed(random))
+	c := new(big.Int).Exp(m, big.NewInt(int64(key.E)), key.N)
+	out := make([]byte, key.Size()+8)
+	c.FillBytes(out[:key.Size()])
+	slices.Reverse(out[:key.Size()])
+	return out
+}
+
+// DecryptClientRandom is the server side of EncryptClientRandom
+func DecryptClientRandom(key *rsa.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) < key.Size() {
+		return nil, fmt.Errorf("encrypted client random of %d bytes, want %d", len(data), key.Size())
+	}
+	c := new(big.Int).SetBytes(reversed(data[:key.Size()]))
+	m := new(big.Int).Exp(c, key.D, key.N)
+	if m.BitLen() > 8*ClientRandomLength {
+		return nil, errors.New("invalid client random")
+	}
+	random := m.FillBytes(make([]byte, ClientRandomLength))
+	slices.Reverse(random)
+	return random, nil
+}
+
+func reversed(b []byte) []byte {
+	b = slices.Clone(b)
+	slices.Reverse(b)
+	return b
+}
@@ -0,0 +1,130 @@
+package sec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+)
+
+func newTestEncryption(t *testing.T, method uint32) (client, server *Encryption) {
+	t.Helper()
+	clientRandom := bytes.Repeat([]byte{0x11}, ClientRandomLength)
+	serverRandom := bytes.Repeat([]byte{0x22}, ClientRandomLength)
+	client, err := NewClientEncryption(method, clientRandom, serverRandom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewServerEncryption(method, clientRandom, serverRandom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestEncryption(t *testing.T) {
+	for _, method := range []uint32{encryptionMethod40Bit, encryptionMethod56Bit, encryptionMethod128Bit} {
+		client, server := newTestEncryption(t, method)
+		switch method {
+		case encryptionMethod40Bit:
+			if !bytes.Equal(client.encrypt.current[:3], []byte{0xD1, 0x26, 0x9E}) || len(client.encrypt.current) != 8 {
+				t.Errorf("40-bit key %x", client.encrypt.current)
+			}
+		case encryptionMethod56Bit:
+			if client.encrypt.current[0] != 0xD1 || len(client.encrypt.current) != 8 {
+				t.Errorf("56-bit key %x", client.encrypt.current)
+			}
+		}
+
+		// both directions, past a key update
+		for i := 0; i < keyUpdateInterval+2; i++ {
+			data := []byte("hello, world")
+			signature := client.Encrypt(data, false)
+			if bytes.Equal(data, []byte("hello, world")) {
+				t.Fatalf("method %#x: data not encrypted", method)
+			}
+			if err := server.Decrypt(data, signature, false); err != nil || string(data) != "hello, world" {
+				t.Fatalf("method %#x, packet %d: %q, %v", method, i, data, err)
+			}
+			data = []byte("reply")
+			signature = server.Encrypt(data, false)
+			if err := client.Decrypt(data, signature, false); err != nil || string(data) != "reply" {
+				t.Fatalf("method %#x, reply %d: %q, %v", method, i, data, err)
+			}
+		}
+		if bytes.Equal(client.encrypt.current, client.encrypt.initial) {
+			t.Errorf("method %#x: key not updated after %d packets", method, keyUpdateInterval)
+		}
+	}
+}
+
+func TestEncryptionSignature(t *testing.T) {
+	client, server := newTestEncryption(t, encryptionMethod128Bit)
+	data := []byte("data")
+	signature := server.Encrypt(data, false)
+	data[0] ^= 1
+	if err := client.Decrypt(data, signature, false); !errors.Is(err, ErrSignature) {
+		t.Errorf("tampered data: %v", err)
+	}
+
+	// the salted MAC counts the packets before it
+	data = []byte("data")
+	unsalted := client.sign(data, 1, false)
+	salted := client.sign(data, 1, true)
+	if bytes.Equal(unsalted, salted) || bytes.Equal(salted, client.sign(data, 2, true)) {
+		t.Error("salted MAC does not depend on the packet count")
+	}
+	for i := 0; i < 3; i++ {
+		data = []byte("salted")
+		signature = server.Encrypt(data, true)
+		if err := client.Decrypt(data, signature, true); err != nil || string(data) != "salted" {
+			t.Errorf("salted %d: %q, %v", i, data, err)
+		}
+	}
+}
+
+func TestNewEncryptionMethod(t *testing.T) {
+	random := make([]byte, ClientRandomLength)
+	if _, err := NewClientEncryption(0x10, random, random); !errors.Is(err, ErrEncryptionMethod) {
+		t.Errorf("FIPS: %v", err)
+	}
+	if _, err := NewClientEncryption(encryptionMethod128Bit, random[:8], random); err == nil {
+		t.Error("short random accepted")
+	}
+}
+
+func TestSecured(t *testing.T) {
+	client, server := newTestEncryption(t, encryptionMethod56Bit)
+	buff := new(bytes.Buffer)
+	WriteSecured(buff, SEC_INFO_PKT, []byte("info"), client)
+	if buff.Len() != 4+SignatureLength+4 {
+		t.Fatalf("%d bytes written", buff.Len())
+	}
+	header, data := ReadSecured(buff, server)
+	if header.Flags != SEC_INFO_PKT|SEC_ENCRYPT || string(data) != "info" {
+		t.Errorf("flags %#x, %q", header.Flags, data)
+	}
+
+	WriteSecured(buff, SEC_LICENSE_PKT, []byte("clear"), nil)
+	if header, data := ReadSecured(buff, nil); header.Flags != SEC_LICENSE_PKT || string(data) != "clear" {
+		t.Errorf("flags %#x, %q", header.Flags, data)
+	}
+}
+
+func TestClientRandom(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, ClientRandomLength)
+	rand.Read(random)
+	encrypted := EncryptClientRandom(&key.PublicKey, random)
+	if len(encrypted) != key.Size()+8 {
+		t.Fatalf("%d bytes", len(encrypted))
+	}
+	decrypted, err := DecryptClientRandom(key, encrypted)
+	if err != nil || !bytes.Equal(decrypted, random) {
+		t.Errorf("%x, %v", decrypted, err)
+	}
+}
@@ -83,9 +83,11 @@ func (bcm *BitmapCacheManager) ProcessBitmap(data []byte, width, height, bpp uin
 	// Generate cache key
 	key := GenerateCacheKey(data, width, height, bpp)
 
-	// Get appropriate cache
-	cache := bcm.GetCache(width, height)
+	// Get appropriate cache, locked since lookups count and reorder
 	cacheIndex := bcm.GetCacheIndex(width, height)
+	bcm.mutex.Lock()
+	defer bcm.mutex.Unlock()
+	cache := bcm.caches[cacheIndex]
 
 	// Try to get from cache
 	if entry, found := cache.Get(key); found {
@@ -168,27 +170,55 @@ func (cm *CompressionManager) Decompress(data []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// GetCacheStats returns statistics about all caches
+// GetCacheStats returns statistics about all caches, each under its name,
+// and the hits, misses, stores and evictions of all of them together
 func (bcm *BitmapCacheManager) GetCacheStats() map[string]interface{} {
 	bcm.mutex.RLock()
 	defer bcm.mutex.RUnlock()
 
 	stats := make(map[string]interface{})
 
+	var hits, misses, stores, evictions int
 	for i, cache := range bcm.caches {
+		hits += int(cache.HitCount)
+		misses += int(cache.MissCount)
+		stores += int(cache.StoreCount)
+		evictions += int(cache.EvictionCount)
+
 		cacheName := fmt.Sprintf("cache_%d", i)
+		hitRate := 0.0
+		if lookups := cache.HitCount + cache.MissCount; lookups > 0 {
+			hitRate = float64(cache.HitCount) / float64(lookups) * 100
+		}
 		stats[cacheName] = map[string]interface{}{
-			"entries":     len(cache.Entries),
-			"max_entries": cache.MaxEntries,
-			"hit_count":   cache.HitCount,
-			"miss_count":  cache.MissCount,
-			"hit_rate":    float64(cache.HitCount) / float64(cache.HitCount+cache.MissCount) * 100,
+			"entries":        len(cache.Entries),
+			"max_entries":    cache.MaxEntries,
+			"hit_count":      cache.HitCount,
+			"miss_count":     cache.MissCount,
+			"store_count":    cache.StoreCount,
+			"eviction_count": cache.EvictionCount,
+			"hit_rate":       hitRate,
 		}
 	}
+	stats["hits"] = hits
+	stats["misses"] = misses
+	stats["stores"] = stores
+	stats["evictions"] = evictions
 
 	return stats
 }
 
+// ResetStats zeroes the counters of all caches, keeping their entries, e.g.
+// to measure a cache size from a known point
+func (bcm *BitmapCacheManager) ResetStats() {
+	bcm.mutex.Lock()
+	defer bcm.mutex.Unlock()
+
+	for _, cache := range bcm.caches {
+		cache.ResetStats()
+	}
+}
+
 // ClearCache clears all bitmap caches
 func (bcm *BitmapCacheManager) ClearCache() {
 	bcm.mutex.Lock()
@@ -196,8 +226,7 @@ func (bcm *BitmapCacheManager) ClearCache() {
 
 	for i, cache := range bcm.caches {
 		cache.Entries = make(map[uint64]*BitmapCacheEntry)
-		cache.HitCount = 0
-		cache.MissCount = 0
+		cache.ResetStats()
 		glog.Debugf("Cleared bitmap cache %d", i)
 	}
 }
@@ -238,8 +267,8 @@ func (bcm *BitmapCacheManager) OptimizeBitmapData(bitmapData *TsBitmapData) (*Ts
 
 // GetCachedBitmap retrieves a cached bitmap by cache ID and index
 func (bcm *BitmapCacheManager) GetCachedBitmap(cacheId uint16, cacheIndex uint16, key1, key2 uint32) *TsBitmapData {
-	bcm.mutex.RLock()
-	defer bcm.mutex.RUnlock()
+	bcm.mutex.Lock()
+	defer bcm.mutex.Unlock()
 
 	// Convert cache ID to array index
 	if cacheId >= 3 {
@@ -279,6 +308,47 @@ func (bcm *BitmapCacheManager) GetCachedBitmap(cacheId uint16, cacheIndex uint16
 	return nil
 }
 
+// PutCachedBitmap stores a bitmap in cache cacheId under the key made of
+// key1 and key2, where GetCachedBitmap finds it
+func (bcm *BitmapCacheManager) PutCachedBitmap(cacheId uint16, key1, key2 uint32, bitmapData *TsBitmapData) bool {
+	bcm.mutex.Lock()
+	defer bcm.mutex.Unlock()
+
+	if cacheId >= 3 {
+		glog.Warnf("Invalid cache ID: %d", cacheId)
+		return false
+	}
+	key := uint64(key2)<<32 | uint64(key1)
+	bcm.caches[cacheId].Put(key, bitmapData.BitmapDataStream, bitmapData.Width, bitmapData.Height, bitmapData.BitsPerPixel)
+	glog.Debugf("Stored cached bitmap: cache=%d, key=%016X, size=%dx%d", cacheId, key, bitmapData.Width, bitmapData.Height)
+	return true
+}
+
+// PinCachedBitmap keeps the bitmap under key1 and key2 in cache cacheId
+// while a cell of a client refers to it, so that the clients sharing the
+// manager do not evict each other's bitmaps
+func (bcm *BitmapCacheManager) PinCachedBitmap(cacheId uint16, key1, key2 uint32) {
+	bcm.mutex.Lock()
+	defer bcm.mutex.Unlock()
+	if cacheId < 3 {
+		bcm.caches[cacheId].Pin(uint64(key2)<<32 | uint64(key1))
+	}
+}
+
+// UnpinCachedBitmap drops a reference taken by PinCachedBitmap. With drop
+// the bitmap is removed too, unless another client still refers to it.
+func (bcm *BitmapCacheManager) UnpinCachedBitmap(cacheId uint16, key1, key2 uint32, drop bool) {
+	bcm.mutex.Lock()
+	defer bcm.mutex.Unlock()
+	if cacheId >= 3 {
+		return
+	}
+	key := uint64(key2)<<32 | uint64(key1)
+	if bcm.caches[cacheId].Unpin(key) == 0 && drop {
+		delete(bcm.caches[cacheId].Entries, key)
+	}
+}
+
 // CreateCachedBitmapUpdate creates a cached bitmap update PDU
 func (bcm *BitmapCacheManager) CreateCachedBitmapUpdate(bitmapData *TsBitmapData, key uint64, cacheIndex uint8) *TsFpUpdateCachedBitmap {
 	return &TsFpUpdateCachedBitmap{
@@ -2,7 +2,11 @@ package t128
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -306,3 +310,179 @@ func TestBitmapCacheManager_ClearCache(t *testing.T) {
 		t.Error("Miss count should be reset after clearing")
 	}
 }
+
+func TestBitmapCacheManagerPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bitmaps.cache")
+
+	saved := NewBitmapCacheManager()
+	small := []byte{1, 2, 3, 4}
+	large := bytes.Repeat([]byte{5}, 300*200*2)
+	saved.ProcessBitmap(small, 2, 1, 16)
+	saved.ProcessBitmap(large, 300, 200, 16)
+	if err := saved.SaveToDisk(path); err != nil {
+		t.Fatalf("SaveToDisk: %v", err)
+	}
+
+	loaded := NewBitmapCacheManager()
+	if err := loaded.LoadFromDisk(path); err != nil {
+		t.Fatalf("LoadFromDisk: %v", err)
+	}
+	for _, tc := range []struct {
+		cacheId uint16
+		data    []byte
+		w, h    uint16
+	}{{0, small, 2, 1}, {2, large, 300, 200}} {
+		key := GenerateCacheKey(tc.data, tc.w, tc.h, 16)
+		bmp := loaded.GetCachedBitmap(tc.cacheId, 0, uint32(key), uint32(key>>32))
+		if bmp == nil {
+			t.Fatalf("cache %d: key %016X not loaded", tc.cacheId, key)
+		}
+		if !bytes.Equal(bmp.BitmapDataStream, tc.data) || bmp.Width != tc.w || bmp.Height != tc.h || bmp.BitsPerPixel != 16 {
+			t.Errorf("cache %d: loaded %dx%d %dbpp, %d bytes", tc.cacheId, bmp.Width, bmp.Height, bmp.BitsPerPixel, len(bmp.BitmapDataStream))
+		}
+	}
+
+	if err := loaded.LoadFromDisk(filepath.Join(t.TempDir(), "missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	for _, broken := range [][]byte{[]byte("not a cache"), data[:len(data)-1]} {
+		if err := os.WriteFile(path, broken, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := NewBitmapCacheManager().LoadFromDisk(path); !errors.Is(err, ErrCacheFormat) {
+			t.Errorf("broken file: %v", err)
+		}
+	}
+}
+
+func TestBitmapCachePersistentListPDUs(t *testing.T) {
+	manager := NewBitmapCacheManager()
+	if pdus := manager.PersistentListPDUs(); len(pdus) != 1 || pdus[0].BitMask != PERSIST_FIRST_PDU|PERSIST_LAST_PDU || len(pdus[0].Entries) != 0 {
+		t.Fatalf("empty cache: %+v", pdus)
+	}
+
+	for i := 0; i < 200; i++ {
+		manager.ProcessBitmap([]byte{byte(i), byte(i >> 8)}, 1, 1, 16)
+	}
+	manager.ProcessBitmap(make([]byte, 64*64), 64, 64, 8)
+
+	pdus := manager.PersistentListPDUs()
+	if len(pdus) != 2 {
+		t.Fatalf("got %d PDUs", len(pdus))
+	}
+	if pdus[0].BitMask != PERSIST_FIRST_PDU || pdus[1].BitMask != PERSIST_LAST_PDU {
+		t.Errorf("flags %x %x", pdus[0].BitMask, pdus[1].BitMask)
+	}
+	if pdus[0].NumEntries != [5]uint16{MaxPersistentListEntries} || pdus[1].NumEntries != [5]uint16{200 - MaxPersistentListEntries, 1} {
+		t.Errorf("entries %v %v", pdus[0].NumEntries, pdus[1].NumEntries)
+	}
+	for _, pdu := range pdus {
+		if pdu.TotalEntries != [5]uint16{200, 1} {
+			t.Errorf("total %v", pdu.TotalEntries)
+		}
+		read := (&TsBitmapCachePersistentListPDU{}).Read(bytes.NewReader(pdu.Serialize()))
+		if fmt.Sprint(read) != fmt.Sprint(pdu) {
+			t.Errorf("round trip: %+v", read)
+		}
+	}
+}
+
+func TestBitmapCacheManager_Counters(t *testing.T) {
+	manager := NewBitmapCacheManager()
+	manager.caches[0].MaxEntries = 2
+	counts := func() [4]int64 {
+		stats := manager.GetCacheStats()["cache_0"].(map[string]interface{})
+		return [4]int64{stats["hit_count"].(int64), stats["miss_count"].(int64),
+			stats["store_count"].(int64), stats["eviction_count"].(int64)}
+	}
+	if rate := manager.GetCacheStats()["cache_0"].(map[string]interface{})["hit_rate"]; rate != 0.0 {
+		t.Errorf("hit rate without lookups: %v", rate)
+	}
+
+	// three distinct tiles in a cache of two, then the last one again
+	for _, b := range []byte{1, 2, 3, 3} {
+		manager.ProcessBitmap([]byte{b}, 1, 1, 8)
+	}
+	if got, want := counts(), [4]int64{1, 3, 3, 1}; got != want {
+		t.Errorf("hits, misses, stores, evictions: got %v, want %v", got, want)
+	}
+
+	key := GenerateCacheKey([]byte{3}, 1, 1, 8)
+	manager.GetCachedBitmap(0, 0, uint32(key), uint32(key>>32))
+	manager.GetCachedBitmap(0, 0, 0, 0)
+	if got, want := counts(), [4]int64{2, 4, 3, 1}; got != want {
+		t.Errorf("after cached bitmap lookups: got %v, want %v", got, want)
+	}
+	if rate := manager.GetCacheStats()["cache_0"].(map[string]interface{})["hit_rate"]; fmt.Sprintf("%.1f", rate) != "33.3" {
+		t.Errorf("hit rate: %v", rate)
+	}
+
+	stats := manager.GetCacheStats()
+	if stats["hits"] != 2 || stats["misses"] != 4 || stats["stores"] != 3 || stats["evictions"] != 1 {
+		t.Errorf("totals: %v %v %v %v", stats["hits"], stats["misses"], stats["stores"], stats["evictions"])
+	}
+
+	manager.ResetStats()
+	if got := counts(); got != [4]int64{} {
+		t.Errorf("after reset: %v", got)
+	}
+	if stats := manager.GetCacheStats()["cache_0"].(map[string]interface{}); stats["entries"] != 2 {
+		t.Errorf("reset dropped entries: %v", stats["entries"])
+	}
+}
+
+func TestBitmapCacheManager_PutCachedBitmap(t *testing.T) {
+	manager := NewBitmapCacheManager()
+	data := []byte{1, 2, 3, 4}
+	if !manager.PutCachedBitmap(1, 7, 9, &TsBitmapData{Width: 1, Height: 1, BitsPerPixel: 32, BitmapDataStream: data}) {
+		t.Fatal("cache 1 refused")
+	}
+	data[0] = 0
+	bmp := manager.GetCachedBitmap(1, 0, 7, 9)
+	if bmp == nil || !bytes.Equal(bmp.BitmapDataStream, []byte{1, 2, 3, 4}) || bmp.BitsPerPixel != 32 {
+		t.Errorf("stored bitmap: %+v", bmp)
+	}
+	if manager.GetCachedBitmap(0, 0, 7, 9) != nil {
+		t.Error("found in another cache")
+	}
+	if manager.PutCachedBitmap(3, 7, 9, &TsBitmapData{}) {
+		t.Error("cache 3 does not exist")
+	}
+}
+
+func TestSharedBitmapCache(t *testing.T) {
+	shared := NewSharedBitmapCache()
+	a, b := shared.Acquire(), shared.Acquire()
+	if a != b || a != shared.Manager() {
+		t.Fatal("Acquire should return the one shared manager")
+	}
+
+	// a tile stored by one holder hits for the other, from several goroutines
+	a.ProcessBitmap([]byte{1, 2, 3, 4}, 2, 2, 16)
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			_, cached, _, _, _ := b.ProcessBitmap([]byte{1, 2, 3, 4}, 2, 2, 16)
+			done <- cached
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if !<-done {
+			t.Error("tile stored through another reference should hit")
+		}
+	}
+
+	shared.Release()
+	if shared.Refs() != 1 || a.GetCacheStats()["cache_0"].(map[string]interface{})["entries"].(int) != 1 {
+		t.Error("cache should be kept while a reference is held")
+	}
+	shared.Release()
+	if shared.Refs() != 0 || a.GetCacheStats()["cache_0"].(map[string]interface{})["entries"].(int) != 0 {
+		t.Error("cache should be cleared once the last reference is released")
+	}
+	shared.Release()
+	if shared.Refs() != 0 {
+		t.Error("releasing more often than acquired should keep the count at zero")
+	}
+}
@@ -0,0 +1,154 @@
+package t128
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// persistMagic starts every saved bitmap cache
+var persistMagic = [8]byte{'G', 'O', 'R', 'D', 'P', 'B', 'M', 'C'}
+
+// ErrCacheFormat is returned by LoadFromDisk for a file that is not a saved
+// bitmap cache
+var ErrCacheFormat = errors.New("not a saved bitmap cache")
+
+// persistEntry precedes the data of each saved cache entry
+type persistEntry struct {
+	CacheId uint8
+	Key1    uint32
+	Key2    uint32
+	Width   uint16
+	Height  uint16
+	Bpp     uint16
+	Length  uint32
+}
+
+// SaveToDisk writes the entries of all caches, keyed by Key1 and Key2, to
+// path. The file is replaced only once it was written in full, so a session
+// that ends midway leaves the previous one in place.
+func (bcm *BitmapCacheManager) SaveToDisk(path string) error {
+	bcm.mutex.RLock()
+	defer bcm.mutex.RUnlock()
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	err = core.Try(func() {
+		core.WriteFull(w, persistMagic[:])
+		for id, cache := range bcm.caches {
+			// least recently used first, so loading keeps the order
+			for _, key := range cache.keysByAge() {
+				entry := cache.Entries[key]
+				core.WriteLE(w, &persistEntry{
+					CacheId: uint8(id),
+					Key1:    uint32(key),
+					Key2:    uint32(key >> 32),
+					Width:   entry.Width,
+					Height:  entry.Height,
+					Bpp:     entry.Bpp,
+					Length:  uint32(len(entry.Data)),
+				})
+				core.WriteFull(w, entry.Data)
+			}
+		}
+		core.ThrowError(w.Flush())
+	})
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("save bitmap cache: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadFromDisk adds the entries saved to path by SaveToDisk to the caches,
+// evicting as usual when a cache is full
+func (bcm *BitmapCacheManager) LoadFromDisk(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bcm.mutex.Lock()
+	defer bcm.mutex.Unlock()
+
+	r := bufio.NewReader(f)
+	var magic [8]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil || magic != persistMagic {
+		return fmt.Errorf("%s: %w", path, ErrCacheFormat)
+	}
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			return nil
+		}
+		var entry persistEntry
+		var data []byte
+		err := core.Try(func() {
+			core.ReadLE(r, &entry)
+			data = core.ReadBytes(r, int(entry.Length))
+		})
+		if err != nil || int(entry.CacheId) >= len(bcm.caches) {
+			return fmt.Errorf("%s: %w", path, ErrCacheFormat)
+		}
+		key := uint64(entry.Key2)<<32 | uint64(entry.Key1)
+		bcm.caches[entry.CacheId].Put(key, data, entry.Width, entry.Height, entry.Bpp)
+	}
+}
+
+// PersistentListPDUs lists the keys of all cached bitmaps in as many
+// Persistent Key List PDUs as they take, for the server to reuse them
+func (bcm *BitmapCacheManager) PersistentListPDUs() []*TsBitmapCachePersistentListPDU {
+	bcm.mutex.RLock()
+	defer bcm.mutex.RUnlock()
+
+	var total [5]uint16
+	var pdus []*TsBitmapCachePersistentListPDU
+	pdu := &TsBitmapCachePersistentListPDU{BitMask: PERSIST_FIRST_PDU}
+	for id, cache := range bcm.caches {
+		for _, key := range cache.keysByAge() {
+			if len(pdu.Entries) == MaxPersistentListEntries {
+				pdus = append(pdus, pdu)
+				pdu = &TsBitmapCachePersistentListPDU{}
+			}
+			pdu.NumEntries[id]++
+			total[id]++
+			pdu.Entries = append(pdu.Entries, TsBitmapCachePersistentEntry{Key1: uint32(key), Key2: uint32(key >> 32)})
+		}
+	}
+	pdus = append(pdus, pdu)
+	pdus[len(pdus)-1].BitMask |= PERSIST_LAST_PDU
+	for _, pdu := range pdus {
+		pdu.TotalEntries = total
+	}
+	return pdus
+}
+
+// keysByAge returns the keys of the cache, least recently used first
+func (bc *BitmapCache) keysByAge() []uint64 {
+	keys := make([]uint64, 0, len(bc.Entries))
+	for key := range bc.Entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := bc.Entries[keys[i]], bc.Entries[keys[j]]
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp < b.Timestamp
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
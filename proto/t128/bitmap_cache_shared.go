@@ -0,0 +1,60 @@
+package t128
+
+import (
+	"sync"
+
+	"github.com/kdsmith18542/gordp/glog"
+)
+
+// SharedBitmapCache lends one BitmapCacheManager to several clients, e.g.
+// the sessions a proxy opens to the same desktop, so that a tile they all
+// receive is kept once. The manager locks its caches, so the clients may
+// use it at once. Each client holds a reference from Acquire to Release,
+// and the caches are cleared once the last one let go.
+type SharedBitmapCache struct {
+	manager *BitmapCacheManager
+	mutex   sync.Mutex
+	refs    int
+}
+
+// NewSharedBitmapCache creates a shared cache nobody holds yet
+func NewSharedBitmapCache() *SharedBitmapCache {
+	return &SharedBitmapCache{manager: NewBitmapCacheManager()}
+}
+
+// Acquire takes a reference to the cache and returns its manager
+func (s *SharedBitmapCache) Acquire() *BitmapCacheManager {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.refs++
+	return s.manager
+}
+
+// Release drops a reference taken by Acquire, clearing the caches when it
+// was the last one
+func (s *SharedBitmapCache) Release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.refs == 0 {
+		glog.Warnf("shared bitmap cache released more often than acquired")
+		return
+	}
+	s.refs--
+	if s.refs == 0 {
+		s.manager.ClearCache()
+	}
+}
+
+// Refs returns how many references are held
+func (s *SharedBitmapCache) Refs() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.refs
+}
+
+// Manager returns the manager of the cache without taking a reference,
+// e.g. to read its statistics or load it from disk before the first client
+// connects
+func (s *SharedBitmapCache) Manager() *BitmapCacheManager {
+	return s.manager
+}
@@ -3,11 +3,16 @@ package t128
 import (
 	"bytes"
 	"crypto/md5"
+	"image"
+	"image/draw"
 	"io"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/glog"
+	"github.com/kdsmith18542/gordp/proto/bitmap"
 )
 
 // Offscreen Bitmap Support Level
@@ -90,6 +95,27 @@ func (c *OffscreenBitmapCache) AddEntry(data []byte, width, height, bpp uint16)
 	return id
 }
 
+// SetEntry stores data under a fixed id, replacing what was there, e.g. for
+// a surface the server created with its own id
+func (c *OffscreenBitmapCache) SetEntry(id uint16, data []byte, width, height, bpp uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.entries[id]; !exists && uint16(len(c.entries)) >= c.maxEntries {
+		c.evictOldest()
+	}
+	c.entries[id] = &OffscreenCacheEntry{
+		ID:       id,
+		Data:     bytes.Clone(data),
+		Width:    width,
+		Height:   height,
+		Bpp:      bpp,
+		Hash:     md5.Sum(data),
+		LastUsed: core.GetCurrentTimestamp(),
+	}
+	glog.Debugf("Set offscreen cache entry: ID=%d, size=%d bytes", id, len(data))
+}
+
 // Get Entry from Cache
 func (c *OffscreenBitmapCache) GetEntry(id uint16) *OffscreenCacheEntry {
 	c.mu.RLock()
@@ -145,6 +171,37 @@ func (c *OffscreenBitmapCache) Clear() {
 	glog.Debugf("Cleared offscreen bitmap cache")
 }
 
+// List describes the entries in the cache by id, without marking them used
+func (c *OffscreenBitmapCache) List() []OffscreenSurfaceInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	infos := make([]OffscreenSurfaceInfo, 0, len(c.entries))
+	for _, entry := range c.entries {
+		infos = append(infos, OffscreenSurfaceInfo{
+			ID:       entry.ID,
+			Width:    entry.Width,
+			Height:   entry.Height,
+			Bpp:      entry.Bpp,
+			LastUsed: time.UnixMilli(entry.LastUsed),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// peekEntry gets an entry without marking it used
+func (c *OffscreenBitmapCache) peekEntry(id uint16) (OffscreenCacheEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, exists := c.entries[id]
+	if !exists {
+		return OffscreenCacheEntry{}, false
+	}
+	return *entry, true
+}
+
 // Get Cache Statistics
 func (c *OffscreenBitmapCache) GetStats() (count, maxEntries uint16) {
 	c.mu.RLock()
@@ -204,15 +261,30 @@ func (p *TsOffscreenBitmapCachePdu) Write(w io.Writer) {
 	p.Data.Write(w)
 }
 
+// OffscreenSurfaceInfo describes an offscreen surface, for inspection
+type OffscreenSurfaceInfo struct {
+	ID       uint16
+	Width    uint16
+	Height   uint16
+	Bpp      uint16
+	LastUsed time.Time
+}
+
 // Offscreen Bitmap Cache Manager
 type OffscreenBitmapManager struct {
 	cache *OffscreenBitmapCache
+
+	mu      sync.Mutex
+	slots   map[uint16]*image.RGBA // surface cache slots, by slot
+	outputs map[uint16]image.Point // desktop origin of mapped surfaces, by id
 }
 
 // New Offscreen Bitmap Manager
 func NewOffscreenBitmapManager(cacheSize, maxEntries uint16) *OffscreenBitmapManager {
 	return &OffscreenBitmapManager{
-		cache: NewOffscreenBitmapCache(cacheSize, maxEntries),
+		cache:   NewOffscreenBitmapCache(cacheSize, maxEntries),
+		slots:   make(map[uint16]*image.RGBA),
+		outputs: make(map[uint16]image.Point),
 	}
 }
 
@@ -226,13 +298,176 @@ func (m *OffscreenBitmapManager) GetOffscreenBitmap(id uint16) *OffscreenCacheEn
 	return m.cache.GetEntry(id)
 }
 
-// Remove Offscreen Bitmap
+// CreateSurface stores the contents of a surface created by the server
+func (m *OffscreenBitmapManager) CreateSurface(cmd *TsCreateSurfaceCommand) {
+	m.cache.SetEntry(cmd.SurfaceId, cmd.SurfaceData, cmd.Width, cmd.Height, cmd.BitsPerPixel())
+}
+
+// List describes the stored surfaces by id
+func (m *OffscreenBitmapManager) List() []OffscreenSurfaceInfo {
+	return m.cache.List()
+}
+
+// Get converts the contents of a surface to an image. It reports false
+// when there is no such surface, or its contents can not be converted,
+// e.g. because the server sent none.
+func (m *OffscreenBitmapManager) Get(id uint16) (*bitmap.BitMap, bool) {
+	entry, ok := m.cache.peekEntry(id)
+	if !ok {
+		return nil, false
+	}
+	var bm *bitmap.BitMap
+	err := core.Try(func() {
+		bm = bitmap.NewBitMapFromRaw(&bitmap.Option{
+			Width:       int(entry.Width),
+			Height:      int(entry.Height),
+			BitPerPixel: int(entry.Bpp),
+			Data:        entry.Data,
+		})
+	})
+	if err != nil {
+		glog.Debugf("offscreen surface %d: %v", id, err)
+		return nil, false
+	}
+	return bm, true
+}
+
+// MapToOutput shows surface id on the desktop with its top left corner at
+// origin, until it is deleted
+func (m *OffscreenBitmapManager) MapToOutput(id uint16, origin image.Point) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outputs[id] = origin
+}
+
+// Output returns the desktop origin of surface id, false when the surface is
+// not mapped to the desktop
+func (m *OffscreenBitmapManager) Output(id uint16) (image.Point, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	origin, ok := m.outputs[id]
+	return origin, ok
+}
+
+// OutputRegion returns the part r of surface id and where on the desktop it
+// shows. It reports false when the surface is not mapped to the desktop or r
+// is outside of it.
+func (m *OffscreenBitmapManager) OutputRegion(id uint16, r image.Rectangle) (image.Rectangle, *bitmap.BitMap, bool) {
+	origin, ok := m.Output(id)
+	if !ok {
+		return image.Rectangle{}, nil, false
+	}
+	surface, ok := m.image(id)
+	if !ok {
+		return image.Rectangle{}, nil, false
+	}
+	r = r.Intersect(surface.Rect)
+	if r.Empty() {
+		return image.Rectangle{}, nil, false
+	}
+	return r.Add(origin), &bitmap.BitMap{Image: crop(surface, r)}, true
+}
+
+// SurfaceToSurface copies the source rectangle of one surface to the
+// destination of another, or of the same one. It returns the changed part
+// of the destination surface, false when either surface is unknown.
+func (m *OffscreenBitmapManager) SurfaceToSurface(cmd *TsSurfaceToSurfaceCommand) (image.Rectangle, bool) {
+	src, ok := m.image(cmd.SourceSurfaceId)
+	if !ok {
+		return image.Rectangle{}, false
+	}
+	tile := crop(src, rect(cmd.SourceRect))
+	return m.blit(cmd.DestSurfaceId, tile, image.Pt(int(cmd.DestRect.Left), int(cmd.DestRect.Top)))
+}
+
+// SurfaceToCache stores the source rectangle of a surface in a cache slot,
+// replacing what was there. It reports false when the surface is unknown.
+func (m *OffscreenBitmapManager) SurfaceToCache(cmd *TsSurfaceToCacheCommand) bool {
+	src, ok := m.image(cmd.SurfaceId)
+	if !ok {
+		return false
+	}
+	tile := crop(src, rect(cmd.SourceRect))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.slots[cmd.CacheSlot] = tile
+	return true
+}
+
+// CacheToSurface draws a cache slot onto a surface at the top left of the
+// destination rectangle. It returns the changed part of the surface, false
+// when the slot or the surface is unknown.
+func (m *OffscreenBitmapManager) CacheToSurface(cmd *TsCacheToSurfaceCommand) (image.Rectangle, bool) {
+	m.mu.Lock()
+	tile, ok := m.slots[cmd.CacheSlot]
+	m.mu.Unlock()
+	if !ok {
+		return image.Rectangle{}, false
+	}
+	return m.blit(cmd.SurfaceId, tile, image.Pt(int(cmd.DestRect.Left), int(cmd.DestRect.Top)))
+}
+
+// image converts surface id to RGBA. A surface the server sent no contents
+// for starts out black.
+func (m *OffscreenBitmapManager) image(id uint16) (*image.RGBA, bool) {
+	entry, ok := m.cache.peekEntry(id)
+	if !ok {
+		return nil, false
+	}
+	img := image.NewRGBA(image.Rect(0, 0, int(entry.Width), int(entry.Height)))
+	if bm, ok := m.Get(id); ok {
+		draw.Draw(img, img.Rect, bm.Image, bm.Image.Bounds().Min, draw.Src)
+	} else {
+		draw.Draw(img, img.Rect, image.Black, image.Point{}, draw.Src)
+	}
+	return img, true
+}
+
+// blit draws tile onto surface id at at, storing the surface back as 32bpp
+func (m *OffscreenBitmapManager) blit(id uint16, tile *image.RGBA, at image.Point) (image.Rectangle, bool) {
+	dst, ok := m.image(id)
+	if !ok {
+		return image.Rectangle{}, false
+	}
+	r := image.Rectangle{Min: at, Max: at.Add(tile.Rect.Size())}.Intersect(dst.Rect)
+	draw.Draw(dst, r, tile, tile.Rect.Min, draw.Src)
+
+	// stored the way NewBitMapFromRaw reads 32bpp surfaces: B, G, R, X
+	data := make([]byte, len(dst.Pix))
+	for i := 0; i < len(data); i += 4 {
+		data[i], data[i+1], data[i+2], data[i+3] = dst.Pix[i+2], dst.Pix[i+1], dst.Pix[i], 0xFF
+	}
+	m.cache.SetEntry(id, data, uint16(dst.Rect.Dx()), uint16(dst.Rect.Dy()), 32)
+	return r, true
+}
+
+// crop copies the part r of img, with its top left at 0, 0
+func crop(img *image.RGBA, r image.Rectangle) *image.RGBA {
+	r = r.Intersect(img.Rect)
+	tile := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(tile, tile.Rect, img, r.Min, draw.Src)
+	return tile
+}
+
+// rect converts an exclusive Rectangle
+func rect(r Rectangle) image.Rectangle {
+	return image.Rect(int(r.Left), int(r.Top), int(r.Right), int(r.Bottom))
+}
+
+// Remove Offscreen Bitmap, and its mapping to the desktop
 func (m *OffscreenBitmapManager) RemoveOffscreenBitmap(id uint16) bool {
+	m.mu.Lock()
+	delete(m.outputs, id)
+	m.mu.Unlock()
 	return m.cache.RemoveEntry(id)
 }
 
-// Clear All Offscreen Bitmaps
+// Clear All Offscreen Bitmaps, cache slots and mappings to the desktop
 func (m *OffscreenBitmapManager) Clear() {
+	m.mu.Lock()
+	clear(m.slots)
+	clear(m.outputs)
+	m.mu.Unlock()
 	m.cache.Clear()
 }
 
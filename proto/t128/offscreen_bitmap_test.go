@@ -1,7 +1,10 @@
 package t128
 
 import (
+	"image"
+	"image/color"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -245,3 +248,86 @@ func BenchmarkOffscreenBitmapManager_ProcessBitmap(b *testing.B) {
 		manager.ProcessOffscreenBitmap(data)
 	}
 }
+
+func TestOffscreenBitmapManager_List(t *testing.T) {
+	manager := NewOffscreenBitmapManager(100, 10)
+
+	// a 2x1 XRGB surface, red then blue, and an empty 16bpp one
+	manager.CreateSurface(&TsCreateSurfaceCommand{
+		SurfaceId: 7, Width: 2, Height: 1, PixelFormat: PIXEL_FORMAT_XRGB_8888,
+		SurfaceData: []byte{0x00, 0x00, 0xFF, 0x00, 0xFF, 0x00, 0x00, 0x00},
+	})
+	manager.CreateSurface(&TsCreateSurfaceCommand{SurfaceId: 3, Width: 64, Height: 32, PixelFormat: 16})
+
+	list := manager.List()
+	if assert.Len(t, list, 2) {
+		assert.Equal(t, OffscreenSurfaceInfo{ID: 3, Width: 64, Height: 32, Bpp: 16, LastUsed: list[0].LastUsed}, list[0])
+		assert.Equal(t, OffscreenSurfaceInfo{ID: 7, Width: 2, Height: 1, Bpp: 32, LastUsed: list[1].LastUsed}, list[1])
+		assert.WithinDuration(t, time.Now(), list[0].LastUsed, time.Second)
+	}
+
+	bm, ok := manager.Get(7)
+	if assert.True(t, ok) {
+		assert.Equal(t, color.RGBA{R: 0xFF, A: 0xFF}, bm.Image.At(0, 0))
+		assert.Equal(t, color.RGBA{B: 0xFF, A: 0xFF}, bm.Image.At(1, 0))
+	}
+	_, ok = manager.Get(3)
+	assert.False(t, ok, "a surface without contents")
+	_, ok = manager.Get(5)
+	assert.False(t, ok)
+
+	assert.True(t, manager.RemoveOffscreenBitmap(7))
+	assert.Len(t, manager.List(), 1)
+}
+
+func TestOffscreenBitmapManager_Blits(t *testing.T) {
+	manager := NewOffscreenBitmapManager(100, 10)
+	red, blue := color.RGBA{R: 0xFF, A: 0xFF}, color.RGBA{B: 0xFF, A: 0xFF}
+
+	// a 2x1 surface, red then blue, and an empty 4x2 one
+	manager.CreateSurface(&TsCreateSurfaceCommand{
+		SurfaceId: 1, Width: 2, Height: 1, PixelFormat: PIXEL_FORMAT_XRGB_8888,
+		SurfaceData: []byte{0x00, 0x00, 0xFF, 0x00, 0xFF, 0x00, 0x00, 0x00},
+	})
+	manager.CreateSurface(&TsCreateSurfaceCommand{SurfaceId: 2, Width: 4, Height: 2, PixelFormat: PIXEL_FORMAT_XRGB_8888})
+
+	r, ok := manager.SurfaceToSurface(&TsSurfaceToSurfaceCommand{
+		SourceSurfaceId: 1, DestSurfaceId: 2,
+		SourceRect: Rectangle{Left: 1, Right: 2, Bottom: 1},
+		DestRect:   Rectangle{Left: 3, Top: 1, Right: 4, Bottom: 2},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, image.Rect(3, 1, 4, 2), r)
+
+	assert.True(t, manager.SurfaceToCache(&TsSurfaceToCacheCommand{
+		SurfaceId: 1, CacheSlot: 5, SourceRect: Rectangle{Right: 2, Bottom: 1},
+	}))
+	// clipped to the surface
+	r, ok = manager.CacheToSurface(&TsCacheToSurfaceCommand{CacheSlot: 5, SurfaceId: 2, DestRect: Rectangle{Left: 3}})
+	assert.True(t, ok)
+	assert.Equal(t, image.Rect(3, 0, 4, 1), r)
+
+	bm, ok := manager.Get(2)
+	if assert.True(t, ok) {
+		assert.Equal(t, color.RGBA{A: 0xFF}, bm.Image.At(0, 0))
+		assert.Equal(t, red, bm.Image.At(3, 0))
+		assert.Equal(t, blue, bm.Image.At(3, 1))
+	}
+
+	_, ok = manager.CacheToSurface(&TsCacheToSurfaceCommand{CacheSlot: 6, SurfaceId: 2})
+	assert.False(t, ok, "an empty slot")
+	assert.False(t, manager.SurfaceToCache(&TsSurfaceToCacheCommand{SurfaceId: 9}))
+
+	// only mapped surfaces show on the desktop
+	_, _, ok = manager.OutputRegion(2, image.Rect(0, 0, 4, 2))
+	assert.False(t, ok)
+	manager.MapToOutput(2, image.Pt(100, 50))
+	dest, region, ok := manager.OutputRegion(2, image.Rect(2, 0, 8, 8))
+	if assert.True(t, ok) {
+		assert.Equal(t, image.Rect(102, 50, 104, 52), dest)
+		assert.Equal(t, red, region.Image.At(1, 0))
+	}
+	manager.RemoveOffscreenBitmap(2)
+	_, ok = manager.Output(2)
+	assert.False(t, ok)
+}
@@ -4,15 +4,18 @@ import (
 	"bytes"
 	"crypto/rc4"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
 	"time"
 
 	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/core/compression"
 	"github.com/kdsmith18542/gordp/glog"
 	"github.com/kdsmith18542/gordp/proto/fastpath"
 	"github.com/kdsmith18542/gordp/proto/mcs"
+	"github.com/kdsmith18542/gordp/proto/sec"
 	"github.com/kdsmith18542/gordp/proto/x224"
 )
 
@@ -189,7 +192,7 @@ type DataPDU interface {
 var pduMap = map[uint16]PDU{
 	PDUTYPE_DEMANDACTIVEPDU:  &TsDemandActivePduData{},
 	PDUTYPE_CONFIRMACTIVEPDU: &TsConfirmActivePduData{},
-	PDUTYPE_DEACTIVATEALLPDU: nil,
+	PDUTYPE_DEACTIVATEALLPDU: &TsDeactivateAllPDU{},
 	PDUTYPE_DATAPDU:          &TsDataPduData{},
 	PDUTYPE_SERVER_REDIR_PKT: nil,
 }
@@ -202,9 +205,23 @@ var pduMap2 = map[uint8]DataPDU{
 	PDUTYPE2_SAVE_SESSION_INFO:           &TsSaveSessionInfoPDU{},
 	PDUTYPE2_BITMAPCACHE_PERSISTENT_LIST: &TsBitmapCachePersistentListPDU{},
 	PDUTYPE2_BITMAPCACHE_ERROR_PDU:       &TsBitmapCacheErrorPDU{},
+	PDUTYPE2_REFRESH_RECT:                &TsRefreshRectPDU{},
+	PDUTYPE2_UPDATE:                      &TsUpdatePDU{},
+	PDUTYPE2_SHUTDOWN_REQUEST:            &TsShutdownRequestPDU{},
+	PDUTYPE2_SHUTDOWN_DENIED:             &TsShutdownDeniedPDU{},
+	PDUTYPE2_SET_KEYBOARD_INDICATORS:     &TsSetKeyboardIndicatorsPDU{},
+	PDUTYPE2_PLAY_SOUND:                  &TsPlaySoundPDU{},
+	PDUTYPE2_FRAME_ACKNOWLEDGE:           &TsFrameAcknowledgePDU{},
 }
 
+// ErrServerRedirect is thrown for an Enhanced Security Server Redirection
+// PDU, the server asking the client to connect to another host instead
+var ErrServerRedirect = errors.New("server redirection requested")
+
 func readPDU(r io.Reader, typ uint16) PDU {
+	if typ == PDUTYPE_SERVER_REDIR_PKT {
+		core.ThrowError(ErrServerRedirect)
+	}
 	if _, ok := pduMap[typ]; !ok {
 		core.Throw(fmt.Errorf("invalid pdu type: %v", typ))
 	}
@@ -219,7 +236,13 @@ func readMcsSdin(r io.Reader) []byte {
 }
 
 func ReadExpectedPDU(r io.Reader, typ uint16) PDU {
-	r = bytes.NewReader(readMcsSdin(r))
+	return ParseExpectedPDU(readMcsSdin(r), typ)
+}
+
+// ParseExpectedPDU parses a PDU of type typ out of the data of an MCS Send
+// Data Indication
+func ParseExpectedPDU(data []byte, typ uint16) PDU {
+	r := bytes.NewReader(data)
 	header := TsShareControlHeader{}
 	header.Read(r)
 	glog.Debugf("share ctrl header: %+v", header)
@@ -228,13 +251,28 @@ func ReadExpectedPDU(r io.Reader, typ uint16) PDU {
 }
 
 func ReadPDU(r io.Reader) PDU {
-	r = bytes.NewReader(readMcsSdin(r))
+	return ReadPDUWith(r, nil)
+}
+
+// ReadPDUWith reads a slow-path PDU, decompressing data PDUs with bulk
+func ReadPDUWith(r io.Reader, bulk *compression.Decompressor) PDU {
+	return ParsePDUWith(readMcsSdin(r), bulk)
+}
+
+// ParsePDUWith parses a slow-path PDU out of the data of an MCS Send Data
+// Indication, decompressing data PDUs with bulk
+func ParsePDUWith(data []byte, bulk *compression.Decompressor) PDU {
+	r := bytes.NewReader(data)
 	header := TsShareControlHeader{}
 	header.Read(r)
+	if header.PDUType == PDUTYPE_DATAPDU {
+		return (&TsDataPduData{}).read(r, bulk)
+	}
 	return readPDU(r, header.PDUType)
 }
 
-func WritePDU(w io.Writer, userId uint16, pdu PDU) {
+// SerializePDU serializes pdu behind its share control header
+func SerializePDU(userId uint16, pdu PDU) []byte {
 	data := pdu.Serialize()
 	header := TsShareControlHeader{
 		PDUType:     pdu.Type(),
@@ -242,10 +280,12 @@ func WritePDU(w io.Writer, userId uint16, pdu PDU) {
 		TotalLength: uint16(len(data) + 6),
 	}
 	glog.Debugf("pdu.Serialize: %v - %x", len(data), data)
+	return append(header.Serialize(), data...)
+}
 
+func WritePDU(w io.Writer, userId uint16, pdu PDU) {
 	mcsSDrq := mcs.NewSendDataRequest(userId, mcs.MCS_CHANNEL_GLOBAL)
-	data = mcsSDrq.Serialize(append(header.Serialize(), data...))
-	x224.Write(w, data)
+	x224.Write(w, mcsSDrq.Serialize(SerializePDU(userId, pdu)))
 }
 
 func ReadExpectedDataPDU(r io.Reader, typ2 uint8) DataPDU {
@@ -272,10 +312,33 @@ func GetFastPathEncryptionManager() *FastPathEncryptionManager {
 }
 
 func ReadFastPathPDU(r io.Reader) PDU {
+	return ReadFastPathPDUWith(r, nil)
+}
+
+// ReadFastPathPDUWith reads a fast-path update, decompressing it with bulk
+func ReadFastPathPDUWith(r io.Reader, bulk *compression.Decompressor) PDU {
+	return ReadFastPathPDUFragments(r, bulk, nil)
+}
+
+// ReadFastPathPDUFragments reads a fast-path update as ReadFastPathPDUWith,
+// rejoining fragmented updates in fragments. The update of a fragment
+// other than the last has no PDU.
+func ReadFastPathPDUFragments(r io.Reader, bulk *compression.Decompressor, fragments *FpFragments) PDU {
+	return ReadFastPathPDUSecured(r, bulk, fragments, nil)
+}
+
+// ReadFastPathPDUSecured reads a fast-path update as ReadFastPathPDUFragments,
+// decrypting it with e under Standard RDP Security
+// See [MS-RDPBCGR] 2.2.9.1.2
+func ReadFastPathPDUSecured(r io.Reader, bulk *compression.Decompressor, fragments *FpFragments, e *sec.Encryption) PDU {
 	fp := fastpath.Read(r)
 
-	// Handle encryption if present
-	if fp.Header.EncryptionFlags != 0 {
+	if e != nil && fp.Header.EncryptionFlags&FASTPATH_OUTPUT_ENCRYPTED != 0 {
+		core.ThrowIf(len(fp.Data) < sec.SignatureLength, "fast-path update too short for its signature")
+		data := fp.Data[sec.SignatureLength:]
+		core.ThrowError(e.Decrypt(data, fp.Data[:sec.SignatureLength], fp.Header.EncryptionFlags&FASTPATH_OUTPUT_SECURE_CHECKSUM != 0))
+		fp.Data = data
+	} else if fp.Header.EncryptionFlags != 0 {
 		glog.Debugf("FastPath encryption detected (flags: %d), decrypting data", fp.Header.EncryptionFlags)
 
 		if !fastPathEncryptionManager.IsInitialized() {
@@ -293,7 +356,7 @@ func ReadFastPathPDU(r io.Reader) PDU {
 	}
 
 	glog.Debugf("analyse FastPathPDU")
-	return (&TsFpUpdatePDU{}).Read(bytes.NewReader(fp.Data))
+	return (&TsFpUpdatePDU{}).read(bytes.NewReader(fp.Data), bulk, fragments)
 }
 
 func WriteFastPathInputPDU(w io.Writer, pdu *TsFpInputPdu) {
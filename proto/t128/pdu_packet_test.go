@@ -0,0 +1,63 @@
+package t128
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/proto/fastpath"
+	"github.com/kdsmith18542/gordp/proto/sec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFastPathPDUSecured(t *testing.T) {
+	clientRandom, serverRandom := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	client, err := sec.NewClientEncryption(0x2, clientRandom, serverRandom)
+	require.NoError(t, err)
+	server, err := sec.NewServerEncryption(0x2, clientRandom, serverRandom)
+	require.NoError(t, err)
+
+	// a surface commands update holding a frame marker, salted and encrypted
+	update := new(bytes.Buffer)
+	update.WriteByte(FASTPATH_UPDATETYPE_SURFCMDS)
+	core.WriteLE(update, uint16(8))
+	update.Write([]byte{0x04, 0x00, 0x01, 0x00, 0x2A, 0x00, 0x00, 0x00})
+	data := update.Bytes()
+	signature := server.Encrypt(data, true)
+	wire := new(bytes.Buffer)
+	header := fastpath.Header{EncryptionFlags: FASTPATH_OUTPUT_ENCRYPTED | FASTPATH_OUTPUT_SECURE_CHECKSUM, Length: len(signature) + len(data)}
+	header.Write(wire)
+	wire.Write(signature)
+	wire.Write(data)
+
+	pdu := ReadFastPathPDUSecured(wire, nil, nil, client).(*TsFpUpdatePDU)
+	commands, ok := pdu.PDU.(*TsFpUpdateSurfaceCommands)
+	require.True(t, ok, "%T", pdu.PDU)
+	assert.Equal(t, []SurfaceCommand{&TsFrameMarkerCommand{
+		Header:      TsSurfaceCommandHeader{CommandType: SURFCMD_FRAME_MARKER},
+		FrameAction: SURFACECMD_FRAMEACTION_END,
+		FrameId:     42,
+	}}, commands.Commands)
+}
+
+func TestFastPathInputEncrypted(t *testing.T) {
+	clientRandom, serverRandom := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	client, err := sec.NewClientEncryption(0x1, clientRandom, serverRandom)
+	require.NoError(t, err)
+	server, err := sec.NewServerEncryption(0x1, clientRandom, serverRandom)
+	require.NoError(t, err)
+
+	pdu := NewFastPathMouseInputPDU(0x0800, 10, 20)
+	plain := pdu.Serialize()
+	wire := pdu.SerializeEncrypted(client)
+	assert.Equal(t, len(plain)+sec.SignatureLength, len(wire))
+
+	header := FpInputHeader{}
+	header.Read(bytes.NewReader(wire))
+	assert.Equal(t, FpInputHeader{Action: FASTPATH_INPUT_ACTION_FASTPATH, NumEvents: 1, Flags: FASTPATH_INPUT_ENCRYPTED}, header)
+	assert.Equal(t, uint16(len(wire))|0x8000, uint16(wire[1])<<8|uint16(wire[2]))
+	events := wire[3+sec.SignatureLength:]
+	require.NoError(t, server.Decrypt(events, wire[3:3+sec.SignatureLength], false))
+	assert.Equal(t, plain[3:], events)
+}
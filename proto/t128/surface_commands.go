@@ -43,6 +43,18 @@ const (
 	SURFCMD_FLAG_FRAME_MARKER_V2            = 0x0002
 )
 
+// TsFrameMarkerCommand FrameAction
+const (
+	SURFACECMD_FRAMEACTION_BEGIN = 0x0000
+	SURFACECMD_FRAMEACTION_END   = 0x0001
+)
+
+// Surface pixel formats
+const (
+	PIXEL_FORMAT_XRGB_8888 = 0x20
+	PIXEL_FORMAT_ARGB_8888 = 0x21
+)
+
 // Surface Command Header
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpegdi/2c3c3c41-1d54-4254-bb62-bc082a3c1f10
 type TsSurfaceCommandHeader struct {
@@ -68,15 +80,67 @@ type SurfaceCommand interface {
 	Serialize() []byte
 }
 
-// Set Surface Bits Command
-// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpegdi/2c3c3c41-1d54-4254-bb62-bc082a3c1f10
+// TS_BITMAP_DATA_EX flags and codecs
+const (
+	EX_COMPRESSED_BITMAP_HEADER_PRESENT = 0x01
+
+	CODEC_ID_NONE = 0x00
+)
+
+// TsBitmapDataEx is the bitmap of a surface bits command. Only bitmaps of
+// CODEC_ID_NONE are drawn, their pixels are top-down without row padding;
+// the others are read by their length and skipped.
+// See [MS-RDPBCGR] 2.2.9.2.1.1
+type TsBitmapDataEx struct {
+	Bpp              uint8
+	Flags            uint8
+	Reserved         uint8
+	CodecID          uint8
+	Width            uint16
+	Height           uint16
+	BitmapDataLength uint32
+	ExBitmapHeader   []byte // TS_COMPRESSED_BITMAP_HEADER_EX, when present
+	BitmapData       []byte
+}
+
+func (d *TsBitmapDataEx) Read(r io.Reader) {
+	core.ReadLE(r, &d.Bpp)
+	core.ReadLE(r, &d.Flags)
+	core.ReadLE(r, &d.Reserved)
+	core.ReadLE(r, &d.CodecID)
+	core.ReadLE(r, &d.Width)
+	core.ReadLE(r, &d.Height)
+	core.ReadLE(r, &d.BitmapDataLength)
+	if d.Flags&EX_COMPRESSED_BITMAP_HEADER_PRESENT != 0 {
+		d.ExBitmapHeader = core.ReadBytes(r, 24)
+	}
+	d.BitmapData = core.ReadBytes(r, int(d.BitmapDataLength))
+}
+
+func (d *TsBitmapDataEx) Write(w io.Writer) {
+	core.WriteLE(w, d.Bpp)
+	core.WriteLE(w, d.Flags)
+	core.WriteLE(w, d.Reserved)
+	core.WriteLE(w, d.CodecID)
+	core.WriteLE(w, d.Width)
+	core.WriteLE(w, d.Height)
+	core.WriteLE(w, uint32(len(d.BitmapData)))
+	if d.Flags&EX_COMPRESSED_BITMAP_HEADER_PRESENT != 0 {
+		core.WriteFull(w, d.ExBitmapHeader)
+	}
+	core.WriteFull(w, d.BitmapData)
+}
+
+// Set Surface Bits Command, also read for Stream Surface Bits. Like the
+// frame marker it has no size, the bitmap follows the destination
+// See [MS-RDPBCGR] 2.2.9.2.1
 type TsSetSurfaceBitsCommand struct {
 	Header     TsSurfaceCommandHeader
 	DestLeft   uint16
 	DestTop    uint16
 	DestRight  uint16
 	DestBottom uint16
-	BitmapData TsBitmapData
+	BitmapData TsBitmapDataEx
 }
 
 func (c *TsSetSurfaceBitsCommand) Type() uint16 {
@@ -84,7 +148,7 @@ func (c *TsSetSurfaceBitsCommand) Type() uint16 {
 }
 
 func (c *TsSetSurfaceBitsCommand) Read(r io.Reader) SurfaceCommand {
-	c.Header.Read(r)
+	core.ReadLE(r, &c.Header.CommandType)
 	core.ReadLE(r, &c.DestLeft)
 	core.ReadLE(r, &c.DestTop)
 	core.ReadLE(r, &c.DestRight)
@@ -94,24 +158,27 @@ func (c *TsSetSurfaceBitsCommand) Read(r io.Reader) SurfaceCommand {
 }
 
 func (c *TsSetSurfaceBitsCommand) Write(w io.Writer) {
-	c.Header.Write(w)
+	cmdType := c.Header.CommandType
+	if cmdType == 0 {
+		cmdType = SURFCMD_SET_SURFACE_BITS
+	}
+	core.WriteLE(w, cmdType)
 	core.WriteLE(w, c.DestLeft)
 	core.WriteLE(w, c.DestTop)
 	core.WriteLE(w, c.DestRight)
 	core.WriteLE(w, c.DestBottom)
-	// BitmapData is written separately
+	c.BitmapData.Write(w)
 }
 
 func (c *TsSetSurfaceBitsCommand) Serialize() []byte {
 	buff := new(bytes.Buffer)
 	c.Write(buff)
-	// Add bitmap data
-	buff.Write(c.BitmapData.BitmapDataStream)
 	return buff.Bytes()
 }
 
-// Frame Marker Command
-// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpegdi/2c3c3c41-1d54-4254-bb62-bc082a3c1f10
+// Frame Marker Command, whose FrameAction takes the place of the size in
+// the header of the other commands
+// See [MS-RDPBCGR] 2.2.9.2.3
 type TsFrameMarkerCommand struct {
 	Header      TsSurfaceCommandHeader
 	FrameAction uint16
@@ -123,14 +190,14 @@ func (c *TsFrameMarkerCommand) Type() uint16 {
 }
 
 func (c *TsFrameMarkerCommand) Read(r io.Reader) SurfaceCommand {
-	c.Header.Read(r)
+	core.ReadLE(r, &c.Header.CommandType)
 	core.ReadLE(r, &c.FrameAction)
 	core.ReadLE(r, &c.FrameId)
 	return c
 }
 
 func (c *TsFrameMarkerCommand) Write(w io.Writer) {
-	c.Header.Write(w)
+	core.WriteLE(w, uint16(SURFCMD_FRAME_MARKER))
 	core.WriteLE(w, c.FrameAction)
 	core.WriteLE(w, c.FrameId)
 }
@@ -158,6 +225,15 @@ func (c *TsCreateSurfaceCommand) Type() uint16 {
 	return SURFCMD_CREATE_SURFACE
 }
 
+// BitsPerPixel is the color depth of the surface pixel format
+func (c *TsCreateSurfaceCommand) BitsPerPixel() uint16 {
+	switch c.PixelFormat {
+	case PIXEL_FORMAT_XRGB_8888, PIXEL_FORMAT_ARGB_8888:
+		return 32
+	}
+	return uint16(c.PixelFormat)
+}
+
 func (c *TsCreateSurfaceCommand) Read(r io.Reader) SurfaceCommand {
 	c.Header.Read(r)
 	core.ReadLE(r, &c.SurfaceId)
@@ -373,35 +449,79 @@ func (c *TsCacheToSurfaceCommand) Serialize() []byte {
 	return buff.Bytes()
 }
 
-// Surface Command Map
-var surfaceCommandMap = map[uint16]SurfaceCommand{
-	SURFCMD_SET_SURFACE_BITS:   &TsSetSurfaceBitsCommand{},
-	SURFCMD_FRAME_MARKER:       &TsFrameMarkerCommand{},
-	SURFCMD_CREATE_SURFACE:     &TsCreateSurfaceCommand{},
-	SURFCMD_DELETE_SURFACE:     &TsDeleteSurfaceCommand{},
-	SURFCMD_SOLID_FILL:         &TsSolidFillCommand{},
-	SURFCMD_SURFACE_TO_SURFACE: &TsSurfaceToSurfaceCommand{},
-	SURFCMD_SURFACE_TO_CACHE:   &TsSurfaceToCacheCommand{},
-	SURFCMD_CACHE_TO_SURFACE:   &TsCacheToSurfaceCommand{},
+// MapSurfaceToOutput Command shows a surface on the desktop with its top
+// left corner at the output origin
+type TsMapSurfaceToOutputCommand struct {
+	Header        TsSurfaceCommandHeader
+	SurfaceId     uint16
+	Reserved      uint16
+	OutputOriginX uint32
+	OutputOriginY uint32
+}
+
+func (c *TsMapSurfaceToOutputCommand) Type() uint16 {
+	return SURFCMD_MAP_SURFACE_TO_OUTPUT
 }
 
-// Read Surface Command
+func (c *TsMapSurfaceToOutputCommand) Read(r io.Reader) SurfaceCommand {
+	c.Header.Read(r)
+	core.ReadLE(r, &c.SurfaceId)
+	core.ReadLE(r, &c.Reserved)
+	core.ReadLE(r, &c.OutputOriginX)
+	core.ReadLE(r, &c.OutputOriginY)
+	return c
+}
+
+func (c *TsMapSurfaceToOutputCommand) Write(w io.Writer) {
+	c.Header.Write(w)
+	core.WriteLE(w, c.SurfaceId)
+	core.WriteLE(w, c.Reserved)
+	core.WriteLE(w, c.OutputOriginX)
+	core.WriteLE(w, c.OutputOriginY)
+}
+
+func (c *TsMapSurfaceToOutputCommand) Serialize() []byte {
+	buff := new(bytes.Buffer)
+	c.Write(buff)
+	return buff.Bytes()
+}
+
+// Surface Command Map, a new command per read since an update may carry
+// several of the same type
+var surfaceCommandMap = map[uint16]func() SurfaceCommand{
+	SURFCMD_SET_SURFACE_BITS:      func() SurfaceCommand { return &TsSetSurfaceBitsCommand{} },
+	SURFCMD_STREAM_SURFACE_BITS:   func() SurfaceCommand { return &TsSetSurfaceBitsCommand{} },
+	SURFCMD_FRAME_MARKER:          func() SurfaceCommand { return &TsFrameMarkerCommand{} },
+	SURFCMD_CREATE_SURFACE:        func() SurfaceCommand { return &TsCreateSurfaceCommand{} },
+	SURFCMD_DELETE_SURFACE:        func() SurfaceCommand { return &TsDeleteSurfaceCommand{} },
+	SURFCMD_SOLID_FILL:            func() SurfaceCommand { return &TsSolidFillCommand{} },
+	SURFCMD_SURFACE_TO_SURFACE:    func() SurfaceCommand { return &TsSurfaceToSurfaceCommand{} },
+	SURFCMD_SURFACE_TO_CACHE:      func() SurfaceCommand { return &TsSurfaceToCacheCommand{} },
+	SURFCMD_CACHE_TO_SURFACE:      func() SurfaceCommand { return &TsCacheToSurfaceCommand{} },
+	SURFCMD_MAP_SURFACE_TO_OUTPUT: func() SurfaceCommand { return &TsMapSurfaceToOutputCommand{} },
+}
+
+// Read Surface Command. The header is peeked at for the type, the command
+// reads it again itself.
 func ReadSurfaceCommand(r io.Reader) SurfaceCommand {
 	header := &TsSurfaceCommandHeader{}
 	header.Read(r)
 
-	command, exists := surfaceCommandMap[header.CommandType]
+	newCommand, exists := surfaceCommandMap[header.CommandType]
 	if !exists {
 		glog.Warnf("Unknown surface command type: 0x%04X", header.CommandType)
 		return nil
 	}
 
-	return command.Read(r)
+	headerBuff := new(bytes.Buffer)
+	header.Write(headerBuff)
+	return newCommand().Read(io.MultiReader(headerBuff, r))
 }
 
-// FastPath Surface Commands Update
+// FastPath Surface Commands Update. The commands have no count, they run
+// to the end of the update.
+// See [MS-RDPBCGR] 2.2.9.1.2.1.10
 type TsFpUpdateSurfaceCommands struct {
-	UpdateType     int16 // This field MUST be set to FASTPATH_UPDATETYPE_SURFCMDS (0x0004).
 	NumberCommands uint16
 	Commands       []SurfaceCommand
 }
@@ -409,20 +529,19 @@ type TsFpUpdateSurfaceCommands struct {
 func (t *TsFpUpdateSurfaceCommands) iUpdatePDU() {}
 
 func (t *TsFpUpdateSurfaceCommands) Read(r io.Reader) UpdatePDU {
-	var updateType int16
-	core.ReadLE(r, &updateType)
-	core.ReadLE(r, &t.NumberCommands)
-
-	glog.Debugf("Surface commands update: %d commands", t.NumberCommands)
-
-	t.Commands = make([]SurfaceCommand, t.NumberCommands)
-	for i := range t.Commands {
-		command := ReadSurfaceCommand(r)
-		if command != nil {
-			t.Commands[i] = command
-			glog.Debugf("Surface command %d: type=0x%04X", i, command.Type())
+	data, err := io.ReadAll(r)
+	core.ThrowError(err)
+	br := bytes.NewReader(data)
+	for br.Len() > 0 {
+		command := ReadSurfaceCommand(br)
+		if command == nil {
+			// the length of an unknown command is unknown, so are the
+			// commands after it
+			break
 		}
+		glog.Debugf("Surface command %d: type=0x%04X", len(t.Commands), command.Type())
+		t.Commands = append(t.Commands, command)
 	}
-
+	t.NumberCommands = uint16(len(t.Commands))
 	return t
 }
@@ -6,6 +6,7 @@ import (
 
 	"github.com/kdsmith18542/gordp/core"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSurfaceCommandTypes(t *testing.T) {
@@ -41,34 +42,79 @@ func TestSurfaceCommandHeader(t *testing.T) {
 
 func TestSetSurfaceBitsCommand(t *testing.T) {
 	cmd := &TsSetSurfaceBitsCommand{
-		Header: TsSurfaceCommandHeader{
-			CommandType: SURFCMD_SET_SURFACE_BITS,
-			CommandSize: 12,
-		},
-		DestLeft:   0,
-		DestTop:    0,
-		DestRight:  100,
-		DestBottom: 100,
-		BitmapData: TsBitmapData{
-			BitmapDataStream: []byte{0x01, 0x02, 0x03, 0x04}, // Sample bitmap data
+		DestLeft:   10,
+		DestTop:    20,
+		DestRight:  12,
+		DestBottom: 21,
+		BitmapData: TsBitmapDataEx{
+			Bpp:        32,
+			CodecID:    CODEC_ID_NONE,
+			Width:      2,
+			Height:     1,
+			BitmapData: []byte{0x00, 0x00, 0xFF, 0x00, 0xFF, 0x00, 0x00, 0x00},
 		},
 	}
 
 	assert.Equal(t, uint16(SURFCMD_SET_SURFACE_BITS), cmd.Type())
 
 	data := cmd.Serialize()
-	assert.Greater(t, len(data), 0)
+	assert.Equal(t, 2+8+12+8, len(data))
 
-	// Test reading back - but skip the bitmap data part to avoid EOF
-	reader := bytes.NewReader(data[:12]) // Only read header and basic fields
-	readCmd := &TsSetSurfaceBitsCommand{}
-	readCmd.Header.Read(reader)
-	core.ReadLE(reader, &readCmd.DestLeft)
-	core.ReadLE(reader, &readCmd.DestTop)
-	core.ReadLE(reader, &readCmd.DestRight)
-	core.ReadLE(reader, &readCmd.DestBottom)
+	readCmd := ReadSurfaceCommand(bytes.NewReader(data)).(*TsSetSurfaceBitsCommand)
+	cmd.Header.CommandType = SURFCMD_SET_SURFACE_BITS
+	cmd.BitmapData.BitmapDataLength = 8
+	assert.Equal(t, cmd, readCmd)
+}
+
+// TestSurfaceCommandsUpdateWire reads a surface commands update as a
+// server sends it: an uncompressed and a codec bitmap, the latter with the
+// extended header, and a frame marker, with no count in front
+func TestSurfaceCommandsUpdateWire(t *testing.T) {
+	wire := []byte{
+		// TS_SURFCMD_SET_SURF_BITS at (10,20)-(12,21)
+		0x01, 0x00, 0x0A, 0x00, 0x14, 0x00, 0x0C, 0x00, 0x15, 0x00,
+		// TS_BITMAP_DATA_EX: 32bpp, CODEC_ID_NONE, 2x1, 8 bytes
+		0x20, 0x00, 0x00, 0x00, 0x02, 0x00, 0x01, 0x00, 0x08, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0xFF, 0x00, 0xFF, 0x00, 0x00, 0x00,
+		// TS_SURFCMD_STREAM_SURF_BITS at (0,0)-(4,4)
+		0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x04, 0x00,
+		// TS_BITMAP_DATA_EX: 32bpp, header present, codec 3, 4x4, 3 bytes
+		0x20, 0x01, 0x00, 0x03, 0x04, 0x00, 0x04, 0x00, 0x03, 0x00, 0x00, 0x00,
+		// TS_COMPRESSED_BITMAP_HEADER_EX
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C,
+		0x0D, 0x0E, 0x0F, 0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18,
+		0xAA, 0xBB, 0xCC,
+		// TS_FRAME_MARKER: end of frame 7
+		0x04, 0x00, 0x01, 0x00, 0x07, 0x00, 0x00, 0x00,
+	}
+
+	update := (&TsFpUpdateSurfaceCommands{}).Read(bytes.NewReader(wire)).(*TsFpUpdateSurfaceCommands)
+	require.Len(t, update.Commands, 3)
+	assert.Equal(t, uint16(3), update.NumberCommands)
 
-	assert.Equal(t, uint16(SURFCMD_SET_SURFACE_BITS), readCmd.Type())
+	bits := update.Commands[0].(*TsSetSurfaceBitsCommand)
+	assert.Equal(t, [4]uint16{10, 20, 12, 21}, [4]uint16{bits.DestLeft, bits.DestTop, bits.DestRight, bits.DestBottom})
+	assert.Equal(t, TsBitmapDataEx{Bpp: 32, CodecID: CODEC_ID_NONE, Width: 2, Height: 1, BitmapDataLength: 8,
+		BitmapData: []byte{0x00, 0x00, 0xFF, 0x00, 0xFF, 0x00, 0x00, 0x00}}, bits.BitmapData)
+
+	stream := update.Commands[1].(*TsSetSurfaceBitsCommand)
+	assert.Equal(t, uint16(SURFCMD_STREAM_SURFACE_BITS), stream.Header.CommandType)
+	assert.Equal(t, uint8(3), stream.BitmapData.CodecID)
+	assert.Len(t, stream.BitmapData.ExBitmapHeader, 24)
+	assert.Equal(t, []byte{0xAA, 0xBB, 0xCC}, stream.BitmapData.BitmapData)
+
+	assert.Equal(t, &TsFrameMarkerCommand{
+		Header:      TsSurfaceCommandHeader{CommandType: SURFCMD_FRAME_MARKER},
+		FrameAction: SURFACECMD_FRAMEACTION_END,
+		FrameId:     7,
+	}, update.Commands[2])
+
+	// written back, the commands are the same bytes
+	out := new(bytes.Buffer)
+	for _, cmd := range update.Commands {
+		cmd.Write(out)
+	}
+	assert.Equal(t, wire, out.Bytes())
 }
 
 func TestCreateSurfaceCommand(t *testing.T) {
@@ -190,3 +236,37 @@ func BenchmarkSurfaceCommand_Read(b *testing.B) {
 		ReadSurfaceCommand(reader)
 	}
 }
+
+func TestReadSurfaceCommand(t *testing.T) {
+	var buf bytes.Buffer
+	for _, cmd := range []SurfaceCommand{
+		&TsCacheToSurfaceCommand{Header: TsSurfaceCommandHeader{CommandType: SURFCMD_CACHE_TO_SURFACE}, CacheSlot: 1, SurfaceId: 2},
+		&TsCacheToSurfaceCommand{Header: TsSurfaceCommandHeader{CommandType: SURFCMD_CACHE_TO_SURFACE}, CacheSlot: 3, SurfaceId: 4},
+		&TsMapSurfaceToOutputCommand{Header: TsSurfaceCommandHeader{CommandType: SURFCMD_MAP_SURFACE_TO_OUTPUT}, SurfaceId: 2, OutputOriginX: 640, OutputOriginY: 480},
+	} {
+		cmd.Write(&buf)
+	}
+
+	first := ReadSurfaceCommand(&buf)
+	second := ReadSurfaceCommand(&buf)
+	assert.Equal(t, &TsCacheToSurfaceCommand{Header: TsSurfaceCommandHeader{CommandType: SURFCMD_CACHE_TO_SURFACE}, CacheSlot: 1, SurfaceId: 2}, first)
+	assert.Equal(t, &TsCacheToSurfaceCommand{Header: TsSurfaceCommandHeader{CommandType: SURFCMD_CACHE_TO_SURFACE}, CacheSlot: 3, SurfaceId: 4}, second)
+	assert.Equal(t, &TsMapSurfaceToOutputCommand{
+		Header:    TsSurfaceCommandHeader{CommandType: SURFCMD_MAP_SURFACE_TO_OUTPUT},
+		SurfaceId: 2, OutputOriginX: 640, OutputOriginY: 480,
+	}, ReadSurfaceCommand(&buf))
+	assert.Zero(t, buf.Len())
+}
+
+func TestFrameMarkerCommand(t *testing.T) {
+	wire := []byte{0x04, 0x00, 0x01, 0x00, 0x2A, 0x00, 0x00, 0x00, 0xFF}
+	r := bytes.NewReader(wire)
+	cmd := ReadSurfaceCommand(r)
+	assert.Equal(t, &TsFrameMarkerCommand{
+		Header:      TsSurfaceCommandHeader{CommandType: SURFCMD_FRAME_MARKER},
+		FrameAction: SURFACECMD_FRAMEACTION_END,
+		FrameId:     42,
+	}, cmd)
+	assert.Equal(t, 1, r.Len())
+	assert.Equal(t, wire[:8], cmd.Serialize())
+}
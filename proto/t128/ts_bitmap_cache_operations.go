@@ -282,10 +282,15 @@ type BitmapCacheEntry struct {
 
 // BitmapCache represents a bitmap cache with multiple entries
 type BitmapCache struct {
-	Entries    map[uint64]*BitmapCacheEntry
-	MaxEntries int
-	HitCount   int64
-	MissCount  int64
+	Entries       map[uint64]*BitmapCacheEntry
+	MaxEntries    int
+	HitCount      int64 // lookups that found an entry
+	MissCount     int64 // lookups that found none
+	StoreCount    int64 // entries stored
+	EvictionCount int64 // entries dropped to make room for another
+	// Pins counts the references to an entry from the cells of the clients
+	// sharing the cache; a pinned entry is not evicted
+	Pins map[uint64]int
 }
 
 // NewBitmapCache creates a new bitmap cache with the specified maximum entries
@@ -325,18 +330,24 @@ func (bc *BitmapCache) Get(key uint64) (*BitmapCacheEntry, bool) {
 
 // Put stores a bitmap in the cache
 func (bc *BitmapCache) Put(key uint64, data []byte, width, height, bpp uint16) {
-	// If cache is full, remove oldest entry
-	if len(bc.Entries) >= bc.MaxEntries {
+	// If cache is full, remove oldest entry, unless the key is replaced.
+	// Pinned entries stay, the cache outgrows MaxEntries when all are.
+	if _, exists := bc.Entries[key]; !exists && len(bc.Entries) >= bc.MaxEntries {
 		var oldestKey uint64
 		var oldestTime int64 = 1<<63 - 1
+		found := false
 
 		for k, entry := range bc.Entries {
-			if entry.Timestamp < oldestTime {
+			if bc.Pins[k] == 0 && entry.Timestamp < oldestTime {
 				oldestTime = entry.Timestamp
 				oldestKey = k
+				found = true
 			}
 		}
-		delete(bc.Entries, oldestKey)
+		if found {
+			delete(bc.Entries, oldestKey)
+			bc.EvictionCount++
+		}
 	}
 
 	// Add new entry
@@ -349,23 +360,59 @@ func (bc *BitmapCache) Put(key uint64, data []byte, width, height, bpp uint16) {
 		Timestamp: core.GetCurrentTimestamp(),
 	}
 	copy(bc.Entries[key].Data, data)
+	bc.StoreCount++
 }
 
-// TsBitmapCachePersistentListPDU represents a bitmap cache persistent list PDU
-// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/7c5b3cf5-6868-4c5a-80d9-5f8b7d20c3e1
+// Pin keeps the entry of key from being evicted until Unpin
+func (bc *BitmapCache) Pin(key uint64) {
+	if bc.Pins == nil {
+		bc.Pins = make(map[uint64]int)
+	}
+	bc.Pins[key]++
+}
+
+// Unpin drops a reference taken by Pin and returns how many are left
+func (bc *BitmapCache) Unpin(key uint64) int {
+	n := bc.Pins[key] - 1
+	if n <= 0 {
+		delete(bc.Pins, key)
+		return 0
+	}
+	bc.Pins[key] = n
+	return n
+}
+
+// ResetStats zeroes the counters, keeping the entries
+func (bc *BitmapCache) ResetStats() {
+	bc.HitCount, bc.MissCount, bc.StoreCount, bc.EvictionCount = 0, 0, 0, 0
+}
+
+// Persistent Key List PDU flags
+const (
+	PERSIST_FIRST_PDU = 0x01
+	PERSIST_LAST_PDU  = 0x02
+)
+
+// MaxPersistentListEntries is the most keys one Persistent Key List PDU
+// carries
+const MaxPersistentListEntries = 169
+
+// TsBitmapCachePersistentListPDU lists the keys of bitmaps the client kept
+// from an earlier session, so the server can draw them from the cache
+// See [MS-RDPBCGR] 2.2.1.17.1
 type TsBitmapCachePersistentListPDU struct {
-	NumEntries   uint16
-	TotalEntries uint16
-	MapFlags     uint16
-	EntrySize    uint16
-	CacheEntries []TsBitmapCachePersistentEntry
+	NumEntries   [5]uint16 // keys in this PDU, per cache
+	TotalEntries [5]uint16 // keys in all PDUs, per cache
+	BitMask      uint8     // PERSIST_FIRST_PDU and PERSIST_LAST_PDU
+	Pad2         uint8
+	Pad3         uint16
+	Entries      []TsBitmapCachePersistentEntry
 }
 
-// TsBitmapCachePersistentEntry represents a persistent bitmap cache entry
+// TsBitmapCachePersistentEntry is the 64-bit key of a cached bitmap
 type TsBitmapCachePersistentEntry struct {
-	Key1        uint32
-	Key2        uint32
-	MruPosition uint32
+	Key1 uint32
+	Key2 uint32
 }
 
 func (p *TsBitmapCachePersistentListPDU) iDataPDU() {}
@@ -373,15 +420,20 @@ func (p *TsBitmapCachePersistentListPDU) iDataPDU() {}
 func (p *TsBitmapCachePersistentListPDU) Read(r io.Reader) DataPDU {
 	core.ReadLE(r, &p.NumEntries)
 	core.ReadLE(r, &p.TotalEntries)
-	core.ReadLE(r, &p.MapFlags)
-	core.ReadLE(r, &p.EntrySize)
+	core.ReadLE(r, &p.BitMask)
+	core.ReadLE(r, &p.Pad2)
+	core.ReadLE(r, &p.Pad3)
 
-	p.CacheEntries = make([]TsBitmapCachePersistentEntry, p.NumEntries)
-	for i := range p.CacheEntries {
-		core.ReadLE(r, &p.CacheEntries[i])
+	n := 0
+	for _, num := range p.NumEntries {
+		n += int(num)
+	}
+	p.Entries = make([]TsBitmapCachePersistentEntry, n)
+	for i := range p.Entries {
+		core.ReadLE(r, &p.Entries[i])
 	}
 
-	glog.Debugf("Bitmap cache persistent list: %d entries", p.NumEntries)
+	glog.Debugf("Bitmap cache persistent list: %d entries", n)
 	return p
 }
 
@@ -389,10 +441,11 @@ func (p *TsBitmapCachePersistentListPDU) Serialize() []byte {
 	buff := new(bytes.Buffer)
 	core.WriteLE(buff, p.NumEntries)
 	core.WriteLE(buff, p.TotalEntries)
-	core.WriteLE(buff, p.MapFlags)
-	core.WriteLE(buff, p.EntrySize)
+	core.WriteLE(buff, p.BitMask)
+	core.WriteLE(buff, p.Pad2)
+	core.WriteLE(buff, p.Pad3)
 
-	for _, entry := range p.CacheEntries {
+	for _, entry := range p.Entries {
 		core.WriteLE(buff, entry)
 	}
 
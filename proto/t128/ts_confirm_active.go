@@ -89,7 +89,7 @@ func NewTsConfirmActivePduData(demandActivePdu *TsDemandActivePduData) *TsConfir
 				Cache2Entries:         100,
 				Cache2MaximumCellSize: 4096,
 			},
-			&capability.TsPointerCapabilitySet{ColorPointerCacheSize: 20},
+			&capability.TsPointerCapabilitySet{ColorPointerCacheSize: ColorPointerCacheSize},
 			capability.NewTsInputCapabilitySet(),
 			&capability.TsBrushCapabilitySet{},
 			&capability.TsGlyphCacheCapabilitySet{},
@@ -99,7 +99,7 @@ func NewTsConfirmActivePduData(demandActivePdu *TsDemandActivePduData) *TsConfir
 				VCChunkSize: 0x4000, // 16384 bytes, production default
 			},
 			&capability.TsSoundCapabilitySet{},
-			&capability.TsMultiFragmentUpdateCapabilitySet{},
+			&capability.TsMultiFragmentUpdateCapabilitySet{MaxRequestSize: fpMaxRequestSize},
 			capability.NewRemoteProgramsCapabilitySet(),
 		},
 	}
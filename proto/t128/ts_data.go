@@ -2,9 +2,11 @@ package t128
 
 import (
 	"bytes"
+	"io"
+
 	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/core/compression"
 	"github.com/kdsmith18542/gordp/glog"
-	"io"
 )
 
 type TsDataPduData struct {
@@ -20,15 +22,37 @@ func (t *TsDataPduData) Type() uint16 {
 }
 
 func (t *TsDataPduData) Read(r io.Reader) PDU {
+	return t.read(r, nil)
+}
+
+// read parses the PDU, decompressing its body with bulk if the server
+// compressed it
+func (t *TsDataPduData) read(r io.Reader, bulk *compression.Decompressor) PDU {
 	t.Header.Read(r)
 	glog.Debugf("data header: %+v", t.Header)
-	t.Pdu = pduMap2[t.Header.PDUType2].Read(r)
+	if bulk != nil {
+		body, err := io.ReadAll(r)
+		core.ThrowError(err)
+		body, err = bulk.Decompress(body, t.Header.CompressedType)
+		core.ThrowError(err)
+		r = bytes.NewReader(body)
+	} else {
+		core.ThrowIf(t.Header.CompressedType&PACKET_COMPRESSED != 0, "compressed data pdu without a decompressor")
+	}
+	proto, ok := pduMap2[t.Header.PDUType2]
+	if !ok || proto == nil {
+		// keep the raw body so callers can still inspect or skip it
+		glog.Debugf("pdutype2 [%x] not implement", t.Header.PDUType2)
+		t.PduData, _ = io.ReadAll(r)
+		return t
+	}
+	t.Pdu = proto.Read(r)
 	return t
 }
 
 func (t *TsDataPduData) Serialize() []byte {
 	buff := new(bytes.Buffer)
-	core.WriteLE(buff, t.Header)
+	t.Header.Write(buff)
 	core.WriteFull(buff, t.PduData)
 	return buff.Bytes()
 }
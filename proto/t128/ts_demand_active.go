@@ -1,6 +1,7 @@
 package t128
 
 import (
+	"bytes"
 	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/proto/capability"
 	"io"
@@ -25,9 +26,25 @@ func (d *TsDemandActivePduData) Type() uint16 {
 
 func (d *TsDemandActivePduData) iPDU() {}
 
+func (d *TsDemandActivePduData) Write(w io.Writer) {
+	capsBytes := capability.Serialize(d.CapabilitySets)
+	d.LengthSourceDescriptor = uint16(len(d.SourceDescriptor))
+	d.LengthCombinedCapabilities = uint16(len(capsBytes)) + 2 + 2 // NumberCapabilities, Pad2Octets and the sets
+	d.NumberCapabilities = uint16(len(d.CapabilitySets))
+	core.WriteLE(w, d.SharedId)
+	core.WriteLE(w, d.LengthSourceDescriptor)
+	core.WriteLE(w, d.LengthCombinedCapabilities)
+	core.WriteFull(w, d.SourceDescriptor)
+	core.WriteLE(w, d.NumberCapabilities)
+	core.WriteLE(w, d.Pad2Octets)
+	core.WriteFull(w, capsBytes)
+	core.WriteLE(w, d.SessionId)
+}
+
 func (d *TsDemandActivePduData) Serialize() []byte {
-	core.Throw("not implement")
-	return nil
+	buff := new(bytes.Buffer)
+	d.Write(buff)
+	return buff.Bytes()
 }
 
 func (d *TsDemandActivePduData) Read(r io.Reader) PDU {
@@ -37,7 +54,7 @@ func (d *TsDemandActivePduData) Read(r io.Reader) PDU {
 	d.SourceDescriptor = core.ReadBytes(r, int(d.LengthSourceDescriptor))
 	core.ReadLE(r, &d.NumberCapabilities)
 	core.ReadLE(r, &d.Pad2Octets)
-	d.CapabilitySets = make([]capability.TsCapsSet, d.NumberCapabilities)
+	d.CapabilitySets = make([]capability.TsCapsSet, 0, d.NumberCapabilities)
 	for i := 0; i < int(d.NumberCapabilities); i++ {
 		d.CapabilitySets = append(d.CapabilitySets, capability.Read(r))
 	}
@@ -2,10 +2,12 @@ package t128
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
 
 	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/glog"
+	"github.com/kdsmith18542/gordp/proto/sec"
 )
 
 // TsFpInputPdu
@@ -80,9 +82,13 @@ func readFastPathInputEvent(r io.Reader) TsFpInputEvent {
 	case FASTPATH_INPUT_EVENT_MOUSEX:
 		return readFastPathPointerEvent(r) // Extended mouse events use same format
 	case FASTPATH_INPUT_EVENT_SYNC:
-		return readFastPathSyncEvent(r)
+		return readFastPathSyncEvent(r, eventFlags)
 	case FASTPATH_INPUT_EVENT_UNICODE:
 		return readFastPathUnicodeEvent(r, eventFlags)
+	case FASTPATH_INPUT_EVENT_RELMOUSE:
+		event := &TsFpRelPointerEvent{}
+		core.ReadLE(r, event)
+		return event
 	default:
 		glog.Errorf("Unknown FastPath input event code: %d", eventCode)
 		return nil
@@ -110,9 +116,9 @@ func readFastPathPointerEvent(r io.Reader) TsFpInputEvent {
 }
 
 // readFastPathSyncEvent reads a sync event
-func readFastPathSyncEvent(r io.Reader) TsFpInputEvent {
+func readFastPathSyncEvent(r io.Reader, eventFlags uint8) TsFpInputEvent {
 	// Sync events are just the event header, no additional data
-	return &TsFpSyncEvent{}
+	return &TsFpSyncEvent{EventFlags: eventFlags}
 }
 
 // readFastPathUnicodeEvent reads a Unicode event
@@ -128,13 +134,20 @@ func readFastPathUnicodeEvent(r io.Reader, eventFlags uint8) TsFpInputEvent {
 	}
 }
 
-// TsFpSyncEvent represents a sync event (no additional data)
-type TsFpSyncEvent struct{}
+// TsFpSyncEvent sets the toggle keys on the server and releases all keys
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/6c5d0ef9-4653-4d69-9ba9-09ba3acd660f
+type TsFpSyncEvent struct {
+	EventFlags uint8 // FASTPATH_INPUT_SYNC_ flags of the toggle keys that are on
+}
+
+func NewFastPathSyncEvent(flags uint8) *TsFpSyncEvent {
+	return &TsFpSyncEvent{EventFlags: flags}
+}
 
 func (e *TsFpSyncEvent) iInputEvent() {}
 
 func (e *TsFpSyncEvent) Serialize() []byte {
-	return []byte{FASTPATH_INPUT_EVENT_SYNC << 5}
+	return []byte{FASTPATH_INPUT_EVENT_SYNC<<5 | e.EventFlags&0x1F}
 }
 
 // TsFpUnicodeEvent represents a Unicode input event
@@ -143,12 +156,22 @@ type TsFpUnicodeEvent struct {
 	UnicodeCode uint16
 }
 
+// NewFastPathUnicodeEvent creates a keyboard event typing one UTF-16 code
+// unit, whatever the keyboard layout of the session
+func NewFastPathUnicodeEvent(code uint16, down bool) *TsFpUnicodeEvent {
+	var flags uint8
+	if !down {
+		flags = FASTPATH_INPUT_KBDFLAGS_RELEASE
+	}
+	return &TsFpUnicodeEvent{EventHeader: flags, UnicodeCode: code}
+}
+
 func (e *TsFpUnicodeEvent) iInputEvent() {}
 
 func (e *TsFpUnicodeEvent) Serialize() []byte {
 	b := make([]byte, 3)
 	b[0] = (FASTPATH_INPUT_EVENT_UNICODE << 5) | (e.EventHeader & 0x1F)
-	core.WriteLE(bytes.NewBuffer(b[1:]), e.UnicodeCode)
+	binary.LittleEndian.PutUint16(b[1:], e.UnicodeCode)
 	return b
 }
 
@@ -190,6 +213,12 @@ func (e *TsFpUnicodeEvent) Serialize() []byte {
 //    - yPos = 2
 
 func (pdu *TsFpInputPdu) Serialize() []byte {
+	return pdu.SerializeEncrypted(nil)
+}
+
+// SerializeEncrypted serializes the PDU with its events encrypted and
+// signed with e under Standard RDP Security, in the clear when e is nil
+func (pdu *TsFpInputPdu) SerializeEncrypted(e *sec.Encryption) []byte {
 	var events [][]byte
 	for _, v := range pdu.FpInputEvents {
 		events = append(events, v.Serialize())
@@ -199,12 +228,21 @@ func (pdu *TsFpInputPdu) Serialize() []byte {
 
 	pdu.Header.Action = FASTPATH_INPUT_ACTION_FASTPATH
 	pdu.Header.NumEvents = uint8(len(pdu.FpInputEvents))
+	length := pdu.Length + 3
+	if e != nil {
+		pdu.Header.Flags = FASTPATH_INPUT_ENCRYPTED
+		copy(pdu.DataSignature[:], e.Encrypt(eventsData, false))
+		length += sec.SignatureLength
+	}
 
 	buff := new(bytes.Buffer)
 	pdu.Header.Write(buff)
 
-	core.WriteBE(buff, (pdu.Length+3)|0x8000) // copy from FreeRDP
+	core.WriteBE(buff, length|0x8000) // copy from FreeRDP
 	//per.WriteLength(buff, int(pdu.Length))
+	if e != nil {
+		buff.Write(pdu.DataSignature[:])
+	}
 	buff.Write(eventsData)
 
 	return buff.Bytes()
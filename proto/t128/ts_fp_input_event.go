@@ -7,6 +7,15 @@ const (
 	FASTPATH_INPUT_EVENT_MOUSEX   = 0x2
 	FASTPATH_INPUT_EVENT_SYNC     = 0x3
 	FASTPATH_INPUT_EVENT_UNICODE  = 0x4
+	FASTPATH_INPUT_EVENT_RELMOUSE = 0x7
+)
+
+// Toggle key flags of a FastPath sync event
+const (
+	FASTPATH_INPUT_SYNC_SCROLL_LOCK = 0x01
+	FASTPATH_INPUT_SYNC_NUM_LOCK    = 0x02
+	FASTPATH_INPUT_SYNC_CAPS_LOCK   = 0x04
+	FASTPATH_INPUT_SYNC_KANA_LOCK   = 0x08
 )
 
 // TsFpInputEvent
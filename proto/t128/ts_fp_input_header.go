@@ -31,12 +31,12 @@ func (h *FpInputHeader) Read(r io.Reader) {
 	core.ReadLE(r, &inputHeader)
 
 	// Extract fields from the packed header
-	h.Action = (inputHeader >> 6) & 0x03
+	h.Action = inputHeader & 0x03
 	h.NumEvents = (inputHeader >> 2) & 0x0F
-	h.Flags = inputHeader & 0x03
+	h.Flags = (inputHeader >> 6) & 0x03
 }
 
 func (h *FpInputHeader) Write(w io.Writer) {
-	inputHeader := uint8(h.Action<<6 | h.NumEvents<<2 | h.Flags)
+	inputHeader := uint8(h.Flags<<6 | h.NumEvents<<2 | h.Action)
 	core.WriteLE(w, inputHeader)
 }
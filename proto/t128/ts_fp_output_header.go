@@ -41,6 +41,12 @@ const (
 	FASTPATH_OUTPUT_COMPRESSION_USED = 0x2
 )
 
+// encryption flags of the fast-path output header
+const (
+	FASTPATH_OUTPUT_SECURE_CHECKSUM = 0x1
+	FASTPATH_OUTPUT_ENCRYPTED       = 0x2
+)
+
 // FastPathCompressionManager handles RDP6.1 compression for FastPath
 type FastPathCompressionManager struct {
 	history    []byte
@@ -75,6 +75,33 @@ func NewFastPathPointerEvent(pointerFlags uint16, xPos, yPos uint16) *TsFpPointe
 	}
 }
 
+// TsFpRelPointerEvent moves the pointer by a distance rather than to a
+// position, for applications that capture the mouse. Its PointerFlags are
+// those of TsFpPointerEvent without the wheel flags.
+// See [MS-RDPBCGR] 2.2.8.1.2.2.7
+type TsFpRelPointerEvent struct {
+	PointerFlags   uint16
+	XDelta, YDelta int16
+}
+
+func (e *TsFpRelPointerEvent) iInputEvent() {}
+
+func (e *TsFpRelPointerEvent) Serialize() []byte {
+	buff := new(bytes.Buffer)
+	core.WriteLE(buff, uint8(FASTPATH_INPUT_EVENT_RELMOUSE<<5))
+	core.WriteLE(buff, e)
+	return buff.Bytes()
+}
+
+// NewFastPathRelPointerEvent creates a relative pointer event
+func NewFastPathRelPointerEvent(pointerFlags uint16, xDelta, yDelta int16) *TsFpRelPointerEvent {
+	return &TsFpRelPointerEvent{
+		PointerFlags: pointerFlags,
+		XDelta:       xDelta,
+		YDelta:       yDelta,
+	}
+}
+
 // NewFastPathMouseMoveEvent creates a mouse movement event
 func NewFastPathMouseMoveEvent(xPos, yPos uint16) *TsFpPointerEvent {
 	return NewFastPathPointerEvent(PTRFLAGS_MOVE, xPos, yPos)
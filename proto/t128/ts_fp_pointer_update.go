@@ -0,0 +1,207 @@
+package t128
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// System pointer types
+const (
+	SYSPTR_NULL    = 0x00000000
+	SYSPTR_DEFAULT = 0x00007F00
+)
+
+// ColorPointerCacheSize is the number of pointer shapes the client caches,
+// announced in the pointer capability set
+const ColorPointerCacheSize = 20
+
+// maxPointerSize is the largest width and height of a pointer shape, that
+// of a large pointer
+const maxPointerSize = 384
+
+// TsFpUpdatePointerPosition moves the pointer to X, Y
+// See [MS-RDPBCGR] 2.2.9.1.1.4
+type TsFpUpdatePointerPosition struct {
+	X uint16
+	Y uint16
+}
+
+func (t *TsFpUpdatePointerPosition) iUpdatePDU() {}
+
+func (t *TsFpUpdatePointerPosition) Read(r io.Reader) UpdatePDU {
+	return core.ReadLE(r, t)
+}
+
+// TsFpUpdateSystemPointer hides the pointer, SYSPTR_NULL, or shows the
+// default pointer of the client, SYSPTR_DEFAULT. The fast-path updates
+// carry no data, their update code gives SystemPointerType.
+type TsFpUpdateSystemPointer struct {
+	SystemPointerType uint32
+}
+
+func (t *TsFpUpdateSystemPointer) iUpdatePDU() {}
+
+func (t *TsFpUpdateSystemPointer) Read(r io.Reader) UpdatePDU {
+	return t
+}
+
+// TsFpUpdateCachedPointer shows the pointer shape cached at CacheIndex
+type TsFpUpdateCachedPointer struct {
+	CacheIndex uint16
+}
+
+func (t *TsFpUpdateCachedPointer) iUpdatePDU() {}
+
+func (t *TsFpUpdateCachedPointer) Read(r io.Reader) UpdatePDU {
+	return core.ReadLE(r, t)
+}
+
+// TsFpUpdatePointer shows a new pointer shape and caches it at CacheIndex.
+// It is read from the color, new and large pointer updates, color pointers
+// being of 24 bpp. XorMask holds the colors and AndMask, which may be
+// empty, the transparent pixels, each padded to 2 bytes a scanline.
+type TsFpUpdatePointer struct {
+	XorBpp     uint16
+	CacheIndex uint16
+	HotSpotX   uint16
+	HotSpotY   uint16
+	Width      uint16
+	Height     uint16
+	XorMask    []byte
+	AndMask    []byte
+}
+
+func (t *TsFpUpdatePointer) iUpdatePDU() {}
+
+// Read reads a new pointer update, the xorBpp of which precedes the color
+// pointer attributes
+func (t *TsFpUpdatePointer) Read(r io.Reader) UpdatePDU {
+	core.ReadLE(r, &t.XorBpp)
+	return t.readColor(r)
+}
+
+// readColor reads the color pointer attributes, at XorBpp
+func (t *TsFpUpdatePointer) readColor(r io.Reader) UpdatePDU {
+	var header struct {
+		CacheIndex    uint16
+		HotSpotX      uint16
+		HotSpotY      uint16
+		Width         uint16
+		Height        uint16
+		LengthAndMask uint16
+		LengthXorMask uint16
+	}
+	core.ReadLE(r, &header)
+	t.CacheIndex, t.HotSpotX, t.HotSpotY = header.CacheIndex, header.HotSpotX, header.HotSpotY
+	t.Width, t.Height = header.Width, header.Height
+	t.readMasks(r, int(header.LengthXorMask), int(header.LengthAndMask))
+	return t
+}
+
+// readLarge reads a large pointer update
+func (t *TsFpUpdatePointer) readLarge(r io.Reader) UpdatePDU {
+	var header struct {
+		XorBpp        uint16
+		CacheIndex    uint16
+		HotSpotX      uint16
+		HotSpotY      uint16
+		Width         uint16
+		Height        uint16
+		LengthAndMask uint32
+		LengthXorMask uint32
+	}
+	core.ReadLE(r, &header)
+	t.XorBpp, t.CacheIndex, t.HotSpotX, t.HotSpotY = header.XorBpp, header.CacheIndex, header.HotSpotX, header.HotSpotY
+	t.Width, t.Height = header.Width, header.Height
+	t.readMasks(r, int(header.LengthXorMask), int(header.LengthAndMask))
+	return t
+}
+
+// readMasks checks the masks are as long as the shape takes before
+// reading them
+func (t *TsFpUpdatePointer) readMasks(r io.Reader, xorLength, andLength int) {
+	switch t.XorBpp {
+	case 1, 4, 8, 15, 16, 24, 32:
+	default:
+		core.Throw("invalid pointer xorBpp")
+	}
+	core.ThrowIf(t.Width > maxPointerSize || t.Height > maxPointerSize, "pointer shape too large")
+	core.ThrowIf(xorLength != maskStride(int(t.Width), int(t.XorBpp))*int(t.Height), "invalid pointer xor mask length")
+	core.ThrowIf(andLength != 0 && andLength != maskStride(int(t.Width), 1)*int(t.Height), "invalid pointer and mask length")
+	t.XorMask = core.ReadBytes(r, xorLength)
+	t.AndMask = core.ReadBytes(r, andLength)
+}
+
+// maskStride returns the bytes of a scanline of a mask, padded to 2 bytes
+func maskStride(width, bpp int) int {
+	return (width*bpp + 15) / 16 * 2
+}
+
+// Image returns the pointer shape, palette giving the colors of pointers
+// of 8 bpp or less but monochrome ones. Pixels the and mask sets are
+// transparent where the color is black, and those inverting the screen
+// are drawn black.
+func (t *TsFpUpdatePointer) Image(palette color.Palette) *image.RGBA {
+	width, height, bpp := int(t.Width), int(t.Height), int(t.XorBpp)
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	xorStride, andStride := maskStride(width, bpp), maskStride(width, 1)
+	for y := 0; y < height; y++ {
+		// scanlines are bottom-up but those of monochrome pointers
+		row := height - 1 - y
+		if bpp == 1 {
+			row = y
+		}
+		xor := t.XorMask[row*xorStride:]
+		for x := 0; x < width; x++ {
+			c := pointerColor(xor, x, bpp, palette)
+			if len(t.AndMask) != 0 && t.AndMask[row*andStride+x/8]&(0x80>>(x%8)) != 0 {
+				if c.R == 0 && c.G == 0 && c.B == 0 {
+					c = color.RGBA{}
+				} else {
+					c = color.RGBA{A: 0xFF}
+				}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// pointerColor returns pixel x of a scanline of the xor mask
+func pointerColor(xor []byte, x, bpp int, palette color.Palette) color.RGBA {
+	indexed := func(i int) color.RGBA {
+		if i >= len(palette) {
+			return color.RGBA{A: 0xFF}
+		}
+		r, g, b, _ := palette[i].RGBA()
+		return color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: 0xFF}
+	}
+	switch bpp {
+	case 1:
+		if xor[x/8]&(0x80>>(x%8)) != 0 {
+			return color.RGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF}
+		}
+		return color.RGBA{A: 0xFF}
+	case 4:
+		return indexed(int(xor[x/2]>>(4*(1-x%2))) & 0x0F)
+	case 8:
+		return indexed(int(xor[x]))
+	case 15:
+		v := binary.LittleEndian.Uint16(xor[x*2:])
+		return color.RGBA{R: uint8(v>>10&0x1F) << 3, G: uint8(v>>5&0x1F) << 3, B: uint8(v&0x1F) << 3, A: 0xFF}
+	case 16:
+		v := binary.LittleEndian.Uint16(xor[x*2:])
+		return color.RGBA{R: uint8(v>>11&0x1F) << 3, G: uint8(v>>5&0x3F) << 2, B: uint8(v&0x1F) << 3, A: 0xFF}
+	case 24:
+		return color.RGBA{R: xor[x*3+2], G: xor[x*3+1], B: xor[x*3], A: 0xFF}
+	default:
+		// premultiplied, as image.RGBA
+		a := xor[x*4+3]
+		mul := func(v byte) uint8 { return uint8(int(v) * int(a) / 0xFF) }
+		return color.RGBA{R: mul(xor[x*4+2]), G: mul(xor[x*4+1]), B: mul(xor[x*4]), A: a}
+	}
+}
@@ -0,0 +1,65 @@
+package t128
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"testing"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fpUpdate reads a fast-path update of code carrying data
+func fpUpdate(t *testing.T, code uint8, data []byte) UpdatePDU {
+	pdu := binary.LittleEndian.AppendUint16([]byte{code}, uint16(len(data)))
+	var update UpdatePDU
+	require.NoError(t, core.Try(func() {
+		update = (&TsFpUpdatePDU{}).Read(bytes.NewReader(append(pdu, data...))).(*TsFpUpdatePDU).PDU
+	}))
+	return update
+}
+
+func TestPointerUpdates(t *testing.T) {
+	assert.Equal(t, &TsFpUpdateSystemPointer{SystemPointerType: SYSPTR_NULL}, fpUpdate(t, FASTPATH_UPDATETYPE_PTR_NULL, nil))
+	assert.Equal(t, &TsFpUpdatePointerPosition{X: 10, Y: 20}, fpUpdate(t, FASTPATH_UPDATETYPE_PTR_POSITION, []byte{10, 0, 20, 0}))
+	assert.Equal(t, &TsFpUpdateCachedPointer{CacheIndex: 3}, fpUpdate(t, FASTPATH_UPDATETYPE_CACHED, []byte{3, 0}))
+
+	// a 2x2 color pointer, its scanlines bottom-up and padded to 2 bytes:
+	// green and white over red and black, the and mask set on the right
+	color24 := []byte{3, 0, 1, 0, 0, 0, 2, 0, 2, 0, 4, 0, 12, 0}
+	color24 = append(color24, 0, 0, 0xFF, 0, 0, 0, 0, 0xFF, 0, 0xFF, 0xFF, 0xFF)
+	color24 = append(color24, 0x40, 0, 0x40, 0, 0)
+	pointer := fpUpdate(t, FASTPATH_UPDATETYPE_COLOR, color24).(*TsFpUpdatePointer)
+	assert.Equal(t, uint16(24), pointer.XorBpp)
+	assert.Equal(t, uint16(3), pointer.CacheIndex)
+	assert.Equal(t, uint16(1), pointer.HotSpotX)
+	img := pointer.Image(nil)
+	assert.Equal(t, color.RGBA{G: 0xFF, A: 0xFF}, img.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{A: 0xFF}, img.RGBAAt(1, 0), "inverted")
+	assert.Equal(t, color.RGBA{R: 0xFF, A: 0xFF}, img.RGBAAt(0, 1))
+	assert.Equal(t, color.RGBA{}, img.RGBAAt(1, 1), "transparent")
+
+	// monochrome pointers are top-down
+	mono := []byte{1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 2, 0, 0, 0, 4, 0, 0x80, 0, 0, 0}
+	img = fpUpdate(t, FASTPATH_UPDATETYPE_POINTER, mono).(*TsFpUpdatePointer).Image(nil)
+	assert.Equal(t, color.RGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF}, img.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{A: 0xFF}, img.RGBAAt(0, 1))
+
+	// a large pointer with alpha and no and mask
+	large := []byte{32, 0, 0, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0xFF, 0x80}
+	img = fpUpdate(t, FASTPATH_UPDATETYPE_LARGE_POINTER, large).(*TsFpUpdatePointer).Image(nil)
+	assert.Equal(t, color.RGBA{R: 0x80, A: 0x80}, img.RGBAAt(0, 0))
+
+	for name, data := range map[string][]byte{
+		"xor mask length": {1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 2, 0, 0, 0, 8, 0},
+		"and mask length": {1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 2, 0, 2, 0, 4, 0},
+		"xorBpp":          {2, 0, 0, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 2, 0},
+		"size":            {1, 0, 0, 0, 0, 0, 0, 0, 0xFF, 0xFF, 1, 0, 0, 0, 0, 0x20},
+	} {
+		pdu := binary.LittleEndian.AppendUint16([]byte{FASTPATH_UPDATETYPE_POINTER}, uint16(len(data)))
+		err := core.Try(func() { (&TsFpUpdatePDU{}).Read(bytes.NewReader(append(pdu, data...))) })
+		assert.Error(t, err, name)
+	}
+}
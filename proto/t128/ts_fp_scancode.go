@@ -0,0 +1,229 @@
+package t128
+
+// eventFlags of the Fast-Path Keyboard Event
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/089d362b-31eb-4a1a-b6fa-92fe61bb5dbf
+const (
+	FASTPATH_INPUT_KBDFLAGS_RELEASE   = 0x01
+	FASTPATH_INPUT_KBDFLAGS_EXTENDED  = 0x02
+	FASTPATH_INPUT_KBDFLAGS_EXTENDED1 = 0x04
+)
+
+// Scancodes (set 1) of the modifier keys used to type layout characters
+const (
+	SCANCODE_LSHIFT = 0x2A
+	SCANCODE_RSHIFT = 0x36
+	SCANCODE_LCTRL  = 0x1D
+	SCANCODE_LALT   = 0x38
+	SCANCODE_ALTGR  = 0xE038 // right Alt, extended
+)
+
+// NewFastPathScanCodeEvent creates a keyboard event carrying a raw scancode.
+// A 0xE0 or 0xE1 prefix in the high byte of scanCode selects the extended
+// flags, so codes can be given the way they appear in scancode tables.
+func NewFastPathScanCodeEvent(scanCode uint16, down, extended bool) *TsFpKeyboardEvent {
+	var flags uint8
+	if !down {
+		flags |= FASTPATH_INPUT_KBDFLAGS_RELEASE
+	}
+	switch scanCode >> 8 {
+	case 0xE0:
+		extended = true
+	case 0xE1:
+		flags |= FASTPATH_INPUT_KBDFLAGS_EXTENDED1
+	}
+	if extended {
+		flags |= FASTPATH_INPUT_KBDFLAGS_EXTENDED
+	}
+	return &TsFpKeyboardEvent{
+		EventHeader: flags,
+		KeyCode:     uint8(scanCode),
+	}
+}
+
+// VirtualKeyScanCodes maps virtual key codes to the scancodes (set 1) of
+// their keys on a US keyboard, a 0xE0 or 0xE1 prefix marking the extended
+// keys as for NewFastPathScanCodeEvent
+var VirtualKeyScanCodes = map[uint8]uint16{
+	VK_BACK: 0x0E, VK_TAB: 0x0F, VK_CLEAR: 0x4C, VK_RETURN: 0x1C,
+	VK_SHIFT: 0x2A, VK_CONTROL: 0x1D, VK_MENU: 0x38, VK_PAUSE: 0xE11D,
+	VK_CAPITAL: 0x3A, VK_ESCAPE: 0x01, VK_SPACE: 0x39,
+	VK_PRIOR: 0xE049, VK_NEXT: 0xE051, VK_END: 0xE04F, VK_HOME: 0xE047,
+	VK_LEFT: 0xE04B, VK_UP: 0xE048, VK_RIGHT: 0xE04D, VK_DOWN: 0xE050,
+	VK_SNAPSHOT: 0xE037, VK_INSERT: 0xE052, VK_DELETE: 0xE053,
+	VK_LWIN: 0xE05B, VK_RWIN: 0xE05C, VK_APPS: 0xE05D,
+	VK_NUMLOCK: 0x45, VK_SCROLL: 0x46,
+
+	VK_0: 0x0B, VK_1: 0x02, VK_2: 0x03, VK_3: 0x04, VK_4: 0x05,
+	VK_5: 0x06, VK_6: 0x07, VK_7: 0x08, VK_8: 0x09, VK_9: 0x0A,
+
+	VK_A: 0x1E, VK_B: 0x30, VK_C: 0x2E, VK_D: 0x20, VK_E: 0x12, VK_F: 0x21,
+	VK_G: 0x22, VK_H: 0x23, VK_I: 0x17, VK_J: 0x24, VK_K: 0x25, VK_L: 0x26,
+	VK_M: 0x32, VK_N: 0x31, VK_O: 0x18, VK_P: 0x19, VK_Q: 0x10, VK_R: 0x13,
+	VK_S: 0x1F, VK_T: 0x14, VK_U: 0x16, VK_V: 0x2F, VK_W: 0x11, VK_X: 0x2D,
+	VK_Y: 0x15, VK_Z: 0x2C,
+
+	VK_NUMPAD0: 0x52, VK_NUMPAD1: 0x4F, VK_NUMPAD2: 0x50, VK_NUMPAD3: 0x51,
+	VK_NUMPAD4: 0x4B, VK_NUMPAD5: 0x4C, VK_NUMPAD6: 0x4D, VK_NUMPAD7: 0x47,
+	VK_NUMPAD8: 0x48, VK_NUMPAD9: 0x49, VK_MULTIPLY: 0x37, VK_ADD: 0x4E,
+	VK_SUBTRACT: 0x4A, VK_DECIMAL: 0x53, VK_DIVIDE: 0xE035,
+
+	// F1 to F12
+	0x70: 0x3B, 0x71: 0x3C, 0x72: 0x3D, 0x73: 0x3E, 0x74: 0x3F, 0x75: 0x40,
+	0x76: 0x41, 0x77: 0x42, 0x78: 0x43, 0x79: 0x44, 0x7A: 0x57, 0x7B: 0x58,
+
+	VK_LSHIFT: 0x2A, VK_RSHIFT: 0x36, VK_LCONTROL: 0x1D, VK_RCONTROL: 0xE01D,
+	VK_LMENU: 0x38, VK_RMENU: 0xE038,
+
+	VK_BROWSER_BACK: 0xE06A, VK_BROWSER_FORWARD: 0xE069, VK_BROWSER_REFRESH: 0xE067,
+	VK_BROWSER_STOP: 0xE068, VK_BROWSER_SEARCH: 0xE065, VK_BROWSER_FAVORITES: 0xE066,
+	VK_BROWSER_HOME: 0xE032, VK_VOLUME_MUTE: 0xE020, VK_VOLUME_DOWN: 0xE02E,
+	VK_VOLUME_UP: 0xE030, VK_MEDIA_NEXT_TRACK: 0xE019, VK_MEDIA_PREV_TRACK: 0xE010,
+	VK_MEDIA_STOP: 0xE024, VK_MEDIA_PLAY_PAUSE: 0xE022, VK_LAUNCH_MAIL: 0xE06C,
+	VK_LAUNCH_MEDIA_SELECT: 0xE06D, VK_LAUNCH_APP1: 0xE06B, VK_LAUNCH_APP2: 0xE021,
+
+	VK_OEM_1: 0x27, VK_OEM_PLUS: 0x0D, VK_OEM_COMMA: 0x33, VK_OEM_MINUS: 0x0C,
+	VK_OEM_PERIOD: 0x34, VK_OEM_2: 0x35, VK_OEM_3: 0x29, VK_OEM_4: 0x1A,
+	VK_OEM_5: 0x2B, VK_OEM_6: 0x1B, VK_OEM_7: 0x28,
+}
+
+// NewFastPathVirtualKeyEvent creates a scancode event pressing or releasing
+// the key of the virtual key code vk, as VirtualKeyScanCodes maps it. It
+// returns false for a virtual key with no key there.
+func NewFastPathVirtualKeyEvent(vk uint8, down bool) (*TsFpKeyboardEvent, bool) {
+	scanCode, ok := VirtualKeyScanCodes[vk]
+	if !ok {
+		return nil, false
+	}
+	return NewFastPathScanCodeEvent(scanCode, down, false), true
+}
+
+// ScanCodeKey is the physical key, plus the modifiers to hold, that types a
+// character on a given layout
+type ScanCodeKey struct {
+	ScanCode uint16
+	Shift    bool
+	AltGr    bool
+}
+
+// ScanCodeLayout maps characters to physical keys. Because scancodes name
+// keys rather than characters, the layout must match the keyboard layout of
+// the remote session for text to come out right.
+type ScanCodeLayout struct {
+	Name      string
+	KbdLayout uint32 // keyboard layout identifier, as in ClientCoreData.KbdLayout
+	Keys      map[rune]ScanCodeKey
+}
+
+// Lookup returns the key that types char on this layout
+func (l *ScanCodeLayout) Lookup(char rune) (ScanCodeKey, bool) {
+	key, ok := l.Keys[char]
+	return key, ok
+}
+
+// scanCodeRow lays a run of characters over consecutive scancodes. A zero
+// rune leaves the position unmapped (used for dead keys).
+type scanCodeRow struct {
+	first   uint16
+	plain   string
+	shifted string
+}
+
+func newScanCodeLayout(name string, kbdLayout uint32, rows []scanCodeRow, altGr map[rune]uint16) *ScanCodeLayout {
+	l := &ScanCodeLayout{Name: name, KbdLayout: kbdLayout, Keys: map[rune]ScanCodeKey{
+		' ':  {ScanCode: 0x39},
+		'\t': {ScanCode: 0x0F},
+		'\n': {ScanCode: 0x1C},
+		'\r': {ScanCode: 0x1C},
+		'\b': {ScanCode: 0x0E},
+	}}
+	for _, row := range rows {
+		for i, r := range []rune(row.plain) {
+			if r != 0 {
+				l.Keys[r] = ScanCodeKey{ScanCode: row.first + uint16(i)}
+			}
+		}
+		for i, r := range []rune(row.shifted) {
+			if r != 0 {
+				l.Keys[r] = ScanCodeKey{ScanCode: row.first + uint16(i), Shift: true}
+			}
+		}
+	}
+	for r, code := range altGr {
+		l.Keys[r] = ScanCodeKey{ScanCode: code, AltGr: true}
+	}
+	return l
+}
+
+// ScanCodeLayoutUS is the US QWERTY layout (00000409)
+var ScanCodeLayoutUS = newScanCodeLayout("US", 0x00000409, []scanCodeRow{
+	{0x02, "1234567890-=", "!@#$%^&*()_+"},
+	{0x10, "qwertyuiop[]", "QWERTYUIOP{}"},
+	{0x1E, "asdfghjkl;'`", "ASDFGHJKL:\"~"},
+	{0x2B, "\\zxcvbnm,./", "|ZXCVBNM<>?"},
+}, nil)
+
+// ScanCodeLayoutUK is the United Kingdom layout (00000809)
+var ScanCodeLayoutUK = newScanCodeLayout("UK", 0x00000809, []scanCodeRow{
+	{0x02, "1234567890-=", "!\"£$%^&*()_+"},
+	{0x10, "qwertyuiop[]", "QWERTYUIOP{}"},
+	{0x1E, "asdfghjkl;'`", "ASDFGHJKL:@¬"},
+	{0x2B, "#zxcvbnm,./", "~ZXCVBNM<>?"},
+	{0x56, "\\", "|"},
+}, map[rune]uint16{
+	'€': 0x05,
+	'¦': 0x29,
+})
+
+// ScanCodeLayoutDE is the German QWERTZ layout (00000407). The ^ and accent
+// keys are dead keys and are not mapped.
+var ScanCodeLayoutDE = newScanCodeLayout("DE", 0x00000407, []scanCodeRow{
+	{0x02, "1234567890ß", "!\"§$%&/()=?"},
+	{0x10, "qwertzuiopü+", "QWERTZUIOPÜ*"},
+	{0x1E, "asdfghjklöä", "ASDFGHJKLÖÄ"},
+	{0x29, "\x00", "°"},
+	{0x2B, "#yxcvbnm,.-", "'YXCVBNM;:_"},
+	{0x56, "<", ">"},
+}, map[rune]uint16{
+	'²':  0x03,
+	'³':  0x04,
+	'{':  0x08,
+	'[':  0x09,
+	']':  0x0A,
+	'}':  0x0B,
+	'\\': 0x0C,
+	'@':  0x10,
+	'€':  0x12,
+	'~':  0x1B,
+	'µ':  0x32,
+	'|':  0x56,
+})
+
+// ScanCodeLayoutFR is the French AZERTY layout (0000040C). The ^ and ¨ key
+// is a dead key and is not mapped.
+var ScanCodeLayoutFR = newScanCodeLayout("FR", 0x0000040C, []scanCodeRow{
+	{0x02, "&é\"'(-è_çà)=", "1234567890°+"},
+	{0x10, "azertyuiop\x00$", "AZERTYUIOP\x00£"},
+	{0x1E, "qsdfghjklmù²", "QSDFGHJKLM%"},
+	{0x2B, "*wxcvbn,;:!", "µWXCVBN?./§"},
+	{0x56, "<", ">"},
+}, map[rune]uint16{
+	'#':  0x04,
+	'{':  0x05,
+	'[':  0x06,
+	'|':  0x07,
+	'\\': 0x09,
+	'^':  0x0A,
+	'@':  0x0B,
+	']':  0x0C,
+	'}':  0x0D,
+	'€':  0x12,
+	'¤':  0x1B,
+})
+
+// ScanCodeLayouts lists the built-in layouts by name
+var ScanCodeLayouts = map[string]*ScanCodeLayout{
+	ScanCodeLayoutUS.Name: ScanCodeLayoutUS,
+	ScanCodeLayoutUK.Name: ScanCodeLayoutUK,
+	ScanCodeLayoutDE.Name: ScanCodeLayoutDE,
+	ScanCodeLayoutFR.Name: ScanCodeLayoutFR,
+}
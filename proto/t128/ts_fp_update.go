@@ -5,6 +5,7 @@ import (
 	"io"
 
 	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/core/compression"
 	"github.com/kdsmith18542/gordp/glog"
 )
 
@@ -16,9 +17,10 @@ type UpdatePDU interface {
 // TsFpUpdatePDU
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/68b5ee54-d0d5-4d65-8d81-e1c4025f7597
 type TsFpUpdatePDU struct {
-	Header FpOutputHeader
-	Length uint16
-	PDU    UpdatePDU
+	Header           FpOutputHeader
+	CompressionFlags uint8 // present when Header.Compression is FASTPATH_OUTPUT_COMPRESSION_USED
+	Length           uint16
+	PDU              UpdatePDU
 }
 
 func (p *TsFpUpdatePDU) iPDU() {}
@@ -44,25 +46,118 @@ func (p *TsFpUpdatePDU) Type() uint16 {
 }
 
 func (p *TsFpUpdatePDU) Read(r io.Reader) PDU {
+	return p.read(r, nil, nil)
+}
+
+// fpMaxRequestSize is the largest update the client takes, announced in
+// the multifragment update capability set: the size fragments are
+// reassembled to
+const fpMaxRequestSize = 0x3F0000
+
+// FpFragments rejoins an update the server split over several fast-path
+// PDUs, because it is larger than a PDU can carry, keeping the fragments
+// received until the last one
+// See [MS-RDPBCGR] 2.2.9.1.2.1
+type FpFragments struct {
+	updateCode uint8
+	data       []byte
+	started    bool
+}
+
+// add adds the data of an update with fragmentation to what was received
+// before, returning the whole update once its last fragment arrives
+func (f *FpFragments) add(updateCode, fragmentation uint8, data []byte) ([]byte, bool) {
+	switch fragmentation {
+	case FASTPATH_FRAGMENT_FIRST:
+		if f.started {
+			glog.Warnf("fast-path update %x dropped, unfinished", f.updateCode)
+		}
+		f.updateCode, f.data, f.started = updateCode, append(f.data[:0], data...), true
+		return nil, false
+	case FASTPATH_FRAGMENT_NEXT, FASTPATH_FRAGMENT_LAST:
+		if !f.started || updateCode != f.updateCode {
+			glog.Warnf("fast-path update %x fragment out of sequence, dropped", updateCode)
+			f.Reset()
+			return nil, false
+		}
+		core.ThrowIf(len(f.data)+len(data) > fpMaxRequestSize, "fragmented fast-path update too large")
+		f.data = append(f.data, data...)
+		if fragmentation == FASTPATH_FRAGMENT_NEXT {
+			return nil, false
+		}
+		whole := f.data
+		f.data, f.started = nil, false
+		return whole, true
+	}
+	return data, true // FASTPATH_FRAGMENT_SINGLE
+}
+
+// Reset drops the fragments received, e.g. when connecting again
+func (f *FpFragments) Reset() {
+	f.data, f.started = nil, false
+}
+
+// read parses the update, decompressing it with bulk if the server
+// compressed it. A fragment is kept in fragments, and the update is parsed
+// once its last fragment is read; until then PDU stays nil. Without
+// fragments, fragmented updates are dropped.
+func (p *TsFpUpdatePDU) read(r io.Reader, bulk *compression.Decompressor, fragments *FpFragments) PDU {
 	p.Header.Read(r)
+	if p.Header.Compression == FASTPATH_OUTPUT_COMPRESSION_USED {
+		core.ReadLE(r, &p.CompressionFlags)
+	}
 
 	core.ReadLE(r, &p.Length)
-	if p.Length == 0 {
+	// the system pointer updates carry no data
+	if p.Length == 0 && p.Header.UpdateCode != FASTPATH_UPDATETYPE_PTR_NULL && p.Header.UpdateCode != FASTPATH_UPDATETYPE_PTR_DEFAULT {
 		glog.Debugf("length = 0")
 		return p
 	}
 
 	data := core.ReadBytes(r, int(p.Length))
+	if bulk != nil {
+		var err error
+		data, err = bulk.Decompress(data, p.CompressionFlags)
+		core.ThrowError(err)
+	} else {
+		core.ThrowIf(p.CompressionFlags&PACKET_COMPRESSED != 0, "compressed fast-path update without a decompressor")
+	}
+	if p.Header.Fragmentation != FASTPATH_FRAGMENT_SINGLE {
+		if fragments == nil {
+			glog.Warnf("fragmented fast-path update %x dropped", p.Header.UpdateCode)
+			return p
+		}
+		var whole bool
+		if data, whole = fragments.add(p.Header.UpdateCode, p.Header.Fragmentation, data); !whole {
+			return p
+		}
+	}
 	//glog.Debugf("fastpath pdu data: %v - %x", len(data), data)
 
 	glog.Debugf("updateCode: %v", p.Header.UpdateCode)
 	switch p.Header.UpdateCode {
+	case FASTPATH_UPDATETYPE_ORDERS:
+		p.PDU = (&TsFpUpdateOrders{}).Read(bytes.NewReader(data))
 	case FASTPATH_UPDATETYPE_BITMAP:
 		p.PDU = (&TsFpUpdateBitmap{}).Read(bytes.NewReader(data))
-	case FASTPATH_UPDATETYPE_CACHED:
-		p.PDU = (&TsFpUpdateCachedBitmap{}).Read(bytes.NewReader(data))
+	case FASTPATH_UPDATETYPE_PALETTE:
+		p.PDU = (&TsUpdatePalette{}).Read(bytes.NewReader(data))
 	case FASTPATH_UPDATETYPE_SURFCMDS:
 		p.PDU = (&TsFpUpdateSurfaceCommands{}).Read(bytes.NewReader(data))
+	case FASTPATH_UPDATETYPE_PTR_NULL:
+		p.PDU = &TsFpUpdateSystemPointer{SystemPointerType: SYSPTR_NULL}
+	case FASTPATH_UPDATETYPE_PTR_DEFAULT:
+		p.PDU = &TsFpUpdateSystemPointer{SystemPointerType: SYSPTR_DEFAULT}
+	case FASTPATH_UPDATETYPE_PTR_POSITION:
+		p.PDU = (&TsFpUpdatePointerPosition{}).Read(bytes.NewReader(data))
+	case FASTPATH_UPDATETYPE_COLOR:
+		p.PDU = (&TsFpUpdatePointer{XorBpp: 24}).readColor(bytes.NewReader(data))
+	case FASTPATH_UPDATETYPE_CACHED:
+		p.PDU = (&TsFpUpdateCachedPointer{}).Read(bytes.NewReader(data))
+	case FASTPATH_UPDATETYPE_POINTER:
+		p.PDU = (&TsFpUpdatePointer{}).Read(bytes.NewReader(data))
+	case FASTPATH_UPDATETYPE_LARGE_POINTER:
+		p.PDU = (&TsFpUpdatePointer{}).readLarge(bytes.NewReader(data))
 	default:
 		glog.Warnf("updateCode [%x] not implement", p.Header.UpdateCode)
 	}
@@ -0,0 +1,23 @@
+package t128
+
+import (
+	"io"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// TsFpUpdateOrders is a fast-path update of drawing orders. The orders are
+// kept as they came, to be read by the kind of order they are.
+// See [MS-RDPBCGR] 2.2.9.1.2.1.1
+type TsFpUpdateOrders struct {
+	NumberOrders uint16
+	OrderData    []byte
+}
+
+func (t *TsFpUpdateOrders) iUpdatePDU() {}
+
+func (t *TsFpUpdateOrders) Read(r io.Reader) UpdatePDU {
+	core.ReadLE(r, &t.NumberOrders)
+	t.OrderData, _ = io.ReadAll(r)
+	return t
+}
@@ -0,0 +1,29 @@
+package t128
+
+import (
+	"io"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// TsFrameAcknowledgePDU tells the server the client is done with the frame
+// of FrameId, so it may send more of those it holds back
+// See [MS-RDPRFX] 2.2.3.1
+type TsFrameAcknowledgePDU struct {
+	FrameId uint32
+}
+
+func (t *TsFrameAcknowledgePDU) iDataPDU() {}
+
+func (t *TsFrameAcknowledgePDU) Read(r io.Reader) DataPDU {
+	core.ReadLE(r, t)
+	return t
+}
+
+func (t *TsFrameAcknowledgePDU) Serialize() []byte {
+	return core.ToLE(t)
+}
+
+func (t *TsFrameAcknowledgePDU) Type2() uint8 {
+	return PDUTYPE2_FRAME_ACKNOWLEDGE
+}
@@ -0,0 +1,30 @@
+package t128
+
+import (
+	"io"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// TsPlaySoundPDU is the server asking the client to play a beep, e.g. for
+// the bell of a console application
+// See [MS-RDPBCGR] 2.2.9.1.1.5.1
+type TsPlaySoundPDU struct {
+	Duration  uint32 // in milliseconds
+	Frequency uint32 // in hertz
+}
+
+func (t *TsPlaySoundPDU) iDataPDU() {}
+
+func (t *TsPlaySoundPDU) Read(r io.Reader) DataPDU {
+	core.ReadLE(r, t)
+	return t
+}
+
+func (t *TsPlaySoundPDU) Serialize() []byte {
+	return core.ToLE(t)
+}
+
+func (t *TsPlaySoundPDU) Type2() uint8 {
+	return PDUTYPE2_PLAY_SOUND
+}
@@ -0,0 +1,61 @@
+package t128
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// TsRectangle16 is an inclusive rectangle
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/1fe36b4d-b3c4-4be0-ae86-f9627ce9a2f5
+type TsRectangle16 struct {
+	Left   uint16
+	Top    uint16
+	Right  uint16
+	Bottom uint16
+}
+
+// TsRefreshRectPDU asks the server to repaint the given areas
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/fe04a39d-dc10-489f-bea7-08dad5538547
+type TsRefreshRectPDU struct {
+	NumberOfAreas  uint8
+	Pad3Octets     [3]byte
+	AreasToRefresh []TsRectangle16
+}
+
+func (t *TsRefreshRectPDU) iDataPDU() {}
+
+func (t *TsRefreshRectPDU) Read(r io.Reader) DataPDU {
+	core.ReadLE(r, &t.NumberOfAreas)
+	core.ReadLE(r, &t.Pad3Octets)
+	t.AreasToRefresh = make([]TsRectangle16, t.NumberOfAreas)
+	for i := range t.AreasToRefresh {
+		core.ReadLE(r, &t.AreasToRefresh[i])
+	}
+	return t
+}
+
+func (t *TsRefreshRectPDU) Serialize() []byte {
+	buff := new(bytes.Buffer)
+	core.WriteLE(buff, uint8(len(t.AreasToRefresh)))
+	core.WriteLE(buff, t.Pad3Octets)
+	for _, area := range t.AreasToRefresh {
+		core.WriteLE(buff, area)
+	}
+	return buff.Bytes()
+}
+
+func (t *TsRefreshRectPDU) Type2() uint8 {
+	return PDUTYPE2_REFRESH_RECT
+}
+
+// NewTsRefreshRectPDU creates a refresh request covering a width x height desktop
+func NewTsRefreshRectPDU(width, height uint16) *TsRefreshRectPDU {
+	return &TsRefreshRectPDU{
+		NumberOfAreas: 1,
+		AreasToRefresh: []TsRectangle16{
+			{Left: 0, Top: 0, Right: width - 1, Bottom: height - 1},
+		},
+	}
+}
@@ -1,10 +1,44 @@
 package t128
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 
 	"github.com/kdsmith18542/gordp/core"
-	"github.com/kdsmith18542/gordp/glog"
+)
+
+// Save session info types
+const (
+	INFOTYPE_LOGON               = 0x00000000
+	INFOTYPE_LOGON_LONG          = 0x00000001
+	INFOTYPE_LOGON_PLAINNOTIFY   = 0x00000002
+	INFOTYPE_LOGON_EXTENDED_INFO = 0x00000003
+)
+
+// Fields present in TS_LOGON_INFO_EXTENDED
+const (
+	LOGON_EX_AUTORECONNECTCOOKIE = 0x00000001
+	LOGON_EX_LOGONERRORS         = 0x00000002
+)
+
+// Logon error notification types of TS_LOGON_ERRORS_INFO
+const (
+	LOGON_MSG_DISCONNECT_REFUSED = 0xFFFFFFF9
+	LOGON_MSG_NO_PERMISSION      = 0xFFFFFFFA
+	LOGON_MSG_BUMP_OPTIONS       = 0xFFFFFFFB
+	LOGON_MSG_RECONNECT_OPTIONS  = 0xFFFFFFFC
+	LOGON_MSG_SESSION_TERMINATE  = 0xFFFFFFFD
+	LOGON_MSG_SESSION_CONTINUE   = 0xFFFFFFFE
+)
+
+// Logon error notification data of TS_LOGON_ERRORS_INFO, when not a
+// session id
+const (
+	LOGON_FAILED_BAD_PASSWORD    = 0x00000000
+	LOGON_FAILED_UPDATE_PASSWORD = 0x00000001
+	LOGON_FAILED_OTHER           = 0x00000002
+	LOGON_WARNING                = 0x00000003
 )
 
 // TsSaveSessionInfoPDU
@@ -17,7 +51,8 @@ type TsSaveSessionInfoPDU struct {
 func (t *TsSaveSessionInfoPDU) iDataPDU() {}
 
 func (t *TsSaveSessionInfoPDU) Read(r io.Reader) DataPDU {
-	glog.Warnf("not implement")
+	core.ReadLE(r, &t.InfoType)
+	t.InfoData, _ = io.ReadAll(r)
 	return t
 }
 
@@ -36,3 +71,126 @@ func (t *TsSaveSessionInfoPDU) Serialize() []byte {
 func (t *TsSaveSessionInfoPDU) Type2() uint8 {
 	return PDUTYPE2_SAVE_SESSION_INFO
 }
+
+// IsLogon reports whether the PDU notifies that a user has logged on.
+// Extended info is not counted, it may carry logon errors sent while the
+// logon screen is still up.
+func (t *TsSaveSessionInfoPDU) IsLogon() bool {
+	switch t.InfoType {
+	case INFOTYPE_LOGON, INFOTYPE_LOGON_LONG, INFOTYPE_LOGON_PLAINNOTIFY:
+		return true
+	}
+	return false
+}
+
+// TsLogonInfo is the session and account of a logon notification, or the
+// logon error of an extended info notification
+type TsLogonInfo struct {
+	SessionId uint32
+	Domain    string
+	UserName  string
+	Error     *TsLogonErrorsInfo
+}
+
+// TsLogonErrorsInfo TS_LOGON_ERRORS_INFO, a logon error or warning the
+// server reports, e.g. a wrong password or one about to expire
+type TsLogonErrorsInfo struct {
+	ErrorNotificationType uint32 // LOGON_MSG_* or LOGON_FAILED_*
+	ErrorNotificationData uint32 // LOGON_FAILED_*, LOGON_WARNING or a session id
+}
+
+var logonMessages = map[uint32]string{
+	LOGON_MSG_DISCONNECT_REFUSED: "the user refused to disconnect the other session",
+	LOGON_MSG_NO_PERMISSION:      "the user has no permission to log on to the session",
+	LOGON_MSG_BUMP_OPTIONS:       "the user is asked to disconnect another session",
+	LOGON_MSG_RECONNECT_OPTIONS:  "the user is asked to reconnect to a disconnected session",
+	LOGON_MSG_SESSION_TERMINATE:  "the logon failed and the session is ending",
+	LOGON_MSG_SESSION_CONTINUE:   "the logon continues in the session",
+}
+
+var logonFailures = map[uint32]string{
+	LOGON_FAILED_BAD_PASSWORD:    "wrong user name or password",
+	LOGON_FAILED_UPDATE_PASSWORD: "the password must be changed",
+	LOGON_FAILED_OTHER:           "the logon failed",
+	LOGON_WARNING:                "the logon succeeded with a warning",
+}
+
+// String describes the error. The notification type is either one of the
+// LOGON_MSG_* codes or, when the logon failed outright, a LOGON_FAILED_*
+// code itself.
+func (e TsLogonErrorsInfo) String() string {
+	if msg, ok := logonMessages[e.ErrorNotificationType]; ok {
+		if failure, ok := logonFailures[e.ErrorNotificationData]; ok && e.ErrorNotificationType != LOGON_MSG_SESSION_CONTINUE {
+			return msg + ": " + failure
+		}
+		return msg
+	}
+	if failure, ok := logonFailures[e.ErrorNotificationType]; ok {
+		return failure
+	}
+	return fmt.Sprintf("unknown logon error %#x, %#x", e.ErrorNotificationType, e.ErrorNotificationData)
+}
+
+// tsLogonInfoV1 TS_LOGON_INFO
+type tsLogonInfoV1 struct {
+	CbDomain   uint32
+	Domain     [52]byte
+	CbUserName uint32
+	UserName   [512]byte
+	SessionId  uint32
+}
+
+// tsLogonInfoV2 TS_LOGON_INFO_VERSION_2, the domain and user name follow
+type tsLogonInfoV2 struct {
+	Version    uint16
+	Size       uint32
+	SessionId  uint32
+	CbDomain   uint32
+	CbUserName uint32
+	Pad        [558]byte
+}
+
+// tsLogonInfoExtended TS_LOGON_INFO_EXTENDED, the fields present follow
+// in the order of their flags, each preceded by its length
+type tsLogonInfoExtended struct {
+	Length        uint16
+	FieldsPresent uint32
+}
+
+// LogonInfo decodes the account details of INFOTYPE_LOGON and
+// INFOTYPE_LOGON_LONG notifications and the logon error of
+// INFOTYPE_LOGON_EXTENDED_INFO ones. Plain notifications carry none and
+// return an empty TsLogonInfo.
+func (t *TsSaveSessionInfoPDU) LogonInfo() (info TsLogonInfo, err error) {
+	err = core.Try(func() {
+		r := bytes.NewReader(t.InfoData)
+		switch t.InfoType {
+		case INFOTYPE_LOGON:
+			v1 := core.ReadLE(r, &tsLogonInfoV1{})
+			info.SessionId = v1.SessionId
+			info.Domain = core.UnicodeDecode(v1.Domain[:min(v1.CbDomain, uint32(len(v1.Domain)))])
+			info.UserName = core.UnicodeDecode(v1.UserName[:min(v1.CbUserName, uint32(len(v1.UserName)))])
+		case INFOTYPE_LOGON_LONG:
+			v2 := core.ReadLE(r, &tsLogonInfoV2{})
+			core.ThrowIf(v2.CbDomain > 52 || v2.CbUserName > 512, fmt.Errorf("invalid logon info lengths %d, %d", v2.CbDomain, v2.CbUserName))
+			info.SessionId = v2.SessionId
+			info.Domain = core.UnicodeDecode(core.ReadBytes(r, int(v2.CbDomain)))
+			info.UserName = core.UnicodeDecode(core.ReadBytes(r, int(v2.CbUserName)))
+		case INFOTYPE_LOGON_EXTENDED_INFO:
+			ext := core.ReadLE(r, &tsLogonInfoExtended{})
+			for _, field := range []uint32{LOGON_EX_AUTORECONNECTCOOKIE, LOGON_EX_LOGONERRORS} {
+				if ext.FieldsPresent&field == 0 {
+					continue
+				}
+				var size uint32
+				core.ReadLE(r, &size)
+				core.ThrowIf(int64(size) > int64(r.Len()), fmt.Errorf("invalid logon info field length %d", size))
+				data := bytes.NewReader(core.ReadBytes(r, int(size)))
+				if field == LOGON_EX_LOGONERRORS {
+					info.Error = core.ReadLE(data, &TsLogonErrorsInfo{})
+				}
+			}
+		}
+	})
+	return info, err
+}
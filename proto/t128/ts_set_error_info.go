@@ -1,11 +1,66 @@
 package t128
 
 import (
+	"fmt"
 	"io"
 
 	"github.com/kdsmith18542/gordp/core"
 )
 
+// Error info codes sent by the server before it disconnects
+const (
+	ERRINFO_NONE                                = 0x00000000
+	ERRINFO_RPC_INITIATED_DISCONNECT            = 0x00000001
+	ERRINFO_RPC_INITIATED_LOGOFF                = 0x00000002
+	ERRINFO_IDLE_TIMEOUT                        = 0x00000003
+	ERRINFO_LOGON_TIMEOUT                       = 0x00000004
+	ERRINFO_DISCONNECTED_BY_OTHERCONNECTION     = 0x00000005
+	ERRINFO_OUT_OF_MEMORY                       = 0x00000006
+	ERRINFO_SERVER_DENIED_CONNECTION            = 0x00000007
+	ERRINFO_SERVER_INSUFFICIENT_PRIVILEGES      = 0x00000009
+	ERRINFO_SERVER_FRESH_CREDENTIALS_REQUIRED   = 0x0000000A
+	ERRINFO_RPC_INITIATED_DISCONNECT_BYUSER     = 0x0000000B
+	ERRINFO_LOGOFF_BY_USER                      = 0x0000000C
+	ERRINFO_CLOSE_STACK_ON_DRIVER_NOT_READY     = 0x0000000F
+	ERRINFO_SERVER_DWM_CRASH                    = 0x00000010
+	ERRINFO_CLOSE_STACK_ON_DRIVER_FAILURE       = 0x00000011
+	ERRINFO_CLOSE_STACK_ON_DRIVER_IFACE_FAILURE = 0x00000012
+	ERRINFO_SERVER_WINLOGON_CRASH               = 0x00000017
+	ERRINFO_SERVER_CSRSS_CRASH                  = 0x00000018
+
+	// licensing
+	ERRINFO_LICENSE_INTERNAL                  = 0x00000100
+	ERRINFO_LICENSE_NO_LICENSE_SERVER         = 0x00000101
+	ERRINFO_LICENSE_NO_LICENSE                = 0x00000102
+	ERRINFO_LICENSE_BAD_CLIENT_MSG            = 0x00000103
+	ERRINFO_LICENSE_HWID_DOESNT_MATCH_LICENSE = 0x00000104
+	ERRINFO_LICENSE_BAD_CLIENT_LICENSE        = 0x00000105
+	ERRINFO_LICENSE_CANT_FINISH_PROTOCOL      = 0x00000106
+	ERRINFO_LICENSE_CLIENT_ENDED_PROTOCOL     = 0x00000107
+	ERRINFO_LICENSE_BAD_CLIENT_ENCRYPTION     = 0x00000108
+	ERRINFO_LICENSE_CANT_UPGRADE_LICENSE      = 0x00000109
+	ERRINFO_LICENSE_NO_REMOTE_CONNECTIONS     = 0x0000010A
+
+	// connection broker
+	ERRINFO_CB_DESTINATION_NOT_FOUND             = 0x00000400
+	ERRINFO_CB_LOADING_DESTINATION               = 0x00000402
+	ERRINFO_CB_REDIRECTING_TO_DESTINATION        = 0x00000404
+	ERRINFO_CB_SESSION_ONLINE_VM_WAKE            = 0x00000405
+	ERRINFO_CB_SESSION_ONLINE_VM_BOOT            = 0x00000406
+	ERRINFO_CB_SESSION_ONLINE_VM_NO_DNS          = 0x00000407
+	ERRINFO_CB_DESTINATION_POOL_NOT_FREE         = 0x00000408
+	ERRINFO_CB_CONNECTION_CANCELLED              = 0x00000409
+	ERRINFO_CB_CONNECTION_ERROR_INVALID_SETTINGS = 0x00000410
+	ERRINFO_CB_SESSION_ONLINE_VM_BOOT_TIMEOUT    = 0x00000411
+	ERRINFO_CB_SESSION_ONLINE_VM_SESSMON_FAILED  = 0x00000412
+
+	// protocol errors the server found in what the client sent, from
+	// ERRINFO_UNKNOWNPDUTYPE2 on
+	ERRINFO_UNKNOWNPDUTYPE2 = 0x000010C9
+	ERRINFO_UNKNOWNPDUTYPE  = 0x000010CA
+	ERRINFO_DATAPDUSEQUENCE = 0x000010CB
+)
+
 // TsSetErrorInfoPDU
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/a21a1bd9-2303-49c1-90ec-3932435c248c
 type TsSetErrorInfoPDU struct {
@@ -26,3 +81,79 @@ func (t *TsSetErrorInfoPDU) Serialize() []byte {
 func (t *TsSetErrorInfoPDU) Type2() uint8 {
 	return PDUTYPE2_SET_ERROR_INFO_PDU
 }
+
+// ReconnectExpected reports whether the error info describes a disconnect
+// the session survives, such as a crash of the server side graphics or
+// logon stack, rather than a deliberate logoff or disconnect
+func (t *TsSetErrorInfoPDU) ReconnectExpected() bool {
+	switch t.ErrorInfo {
+	case ERRINFO_CLOSE_STACK_ON_DRIVER_NOT_READY,
+		ERRINFO_SERVER_DWM_CRASH,
+		ERRINFO_CLOSE_STACK_ON_DRIVER_FAILURE,
+		ERRINFO_CLOSE_STACK_ON_DRIVER_IFACE_FAILURE,
+		ERRINFO_SERVER_WINLOGON_CRASH,
+		ERRINFO_SERVER_CSRSS_CRASH:
+		return true
+	}
+	return false
+}
+
+var errorInfoReasons = map[uint32]string{
+	ERRINFO_NONE:                                "no error",
+	ERRINFO_RPC_INITIATED_DISCONNECT:            "disconnected by an administrative tool on the server",
+	ERRINFO_RPC_INITIATED_LOGOFF:                "logged off by an administrative tool on the server",
+	ERRINFO_IDLE_TIMEOUT:                        "the idle session limit was reached",
+	ERRINFO_LOGON_TIMEOUT:                       "the active session limit was reached",
+	ERRINFO_DISCONNECTED_BY_OTHERCONNECTION:     "another user connected to the session",
+	ERRINFO_OUT_OF_MEMORY:                       "the server ran out of memory",
+	ERRINFO_SERVER_DENIED_CONNECTION:            "the server denied the connection",
+	ERRINFO_SERVER_INSUFFICIENT_PRIVILEGES:      "the user has insufficient privileges to connect",
+	ERRINFO_SERVER_FRESH_CREDENTIALS_REQUIRED:   "the server requires credentials to be entered again",
+	ERRINFO_RPC_INITIATED_DISCONNECT_BYUSER:     "disconnected by the user through an administrative tool",
+	ERRINFO_LOGOFF_BY_USER:                      "the user logged off",
+	ERRINFO_CLOSE_STACK_ON_DRIVER_NOT_READY:     "the server display driver was not ready",
+	ERRINFO_SERVER_DWM_CRASH:                    "the desktop window manager on the server crashed",
+	ERRINFO_CLOSE_STACK_ON_DRIVER_FAILURE:       "the server display driver failed",
+	ERRINFO_CLOSE_STACK_ON_DRIVER_IFACE_FAILURE: "the server display driver interface failed",
+	ERRINFO_SERVER_WINLOGON_CRASH:               "winlogon on the server crashed",
+	ERRINFO_SERVER_CSRSS_CRASH:                  "csrss on the server crashed",
+
+	ERRINFO_LICENSE_INTERNAL:                  "internal error in the licensing protocol",
+	ERRINFO_LICENSE_NO_LICENSE_SERVER:         "no license server was available",
+	ERRINFO_LICENSE_NO_LICENSE:                "no client access licenses are available",
+	ERRINFO_LICENSE_BAD_CLIENT_MSG:            "the server received an invalid licensing message",
+	ERRINFO_LICENSE_HWID_DOESNT_MATCH_LICENSE: "the client access license was issued to another computer",
+	ERRINFO_LICENSE_BAD_CLIENT_LICENSE:        "the client access license is invalid",
+	ERRINFO_LICENSE_CANT_FINISH_PROTOCOL:      "the licensing protocol could not be completed",
+	ERRINFO_LICENSE_CLIENT_ENDED_PROTOCOL:     "the client ended the licensing protocol",
+	ERRINFO_LICENSE_BAD_CLIENT_ENCRYPTION:     "a licensing message was incorrectly encrypted",
+	ERRINFO_LICENSE_CANT_UPGRADE_LICENSE:      "the client access license could not be upgraded",
+	ERRINFO_LICENSE_NO_REMOTE_CONNECTIONS:     "the server is not licensed to accept remote connections",
+
+	ERRINFO_CB_DESTINATION_NOT_FOUND:             "the connection broker found no target endpoint",
+	ERRINFO_CB_LOADING_DESTINATION:               "the target endpoint is disconnecting from the connection broker",
+	ERRINFO_CB_REDIRECTING_TO_DESTINATION:        "redirecting to the target endpoint failed",
+	ERRINFO_CB_SESSION_ONLINE_VM_WAKE:            "waking the target virtual machine failed",
+	ERRINFO_CB_SESSION_ONLINE_VM_BOOT:            "booting the target virtual machine failed",
+	ERRINFO_CB_SESSION_ONLINE_VM_NO_DNS:          "the IP address of the target virtual machine could not be found",
+	ERRINFO_CB_DESTINATION_POOL_NOT_FREE:         "no virtual machine is free in the pool",
+	ERRINFO_CB_CONNECTION_CANCELLED:              "the connection broker cancelled the connection",
+	ERRINFO_CB_CONNECTION_ERROR_INVALID_SETTINGS: "the connection broker settings are invalid",
+	ERRINFO_CB_SESSION_ONLINE_VM_BOOT_TIMEOUT:    "the target virtual machine took too long to boot",
+	ERRINFO_CB_SESSION_ONLINE_VM_SESSMON_FAILED:  "the session monitor of the target virtual machine failed",
+
+	ERRINFO_UNKNOWNPDUTYPE2: "the server received an unknown data PDU type",
+	ERRINFO_UNKNOWNPDUTYPE:  "the server received an unknown PDU type",
+	ERRINFO_DATAPDUSEQUENCE: "the server received a data PDU out of sequence",
+}
+
+// Reason describes the error info code
+func (t *TsSetErrorInfoPDU) Reason() string {
+	if reason, ok := errorInfoReasons[t.ErrorInfo]; ok {
+		return reason
+	}
+	if t.ErrorInfo >= ERRINFO_UNKNOWNPDUTYPE2 {
+		return fmt.Sprintf("the server found protocol error %#x in what the client sent", t.ErrorInfo)
+	}
+	return fmt.Sprintf("unknown error info %#x", t.ErrorInfo)
+}
@@ -0,0 +1,38 @@
+package t128
+
+import (
+	"io"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// LedFlags of the Set Keyboard Indicators PDU
+const (
+	TS_SYNC_SCROLL_LOCK = 0x01
+	TS_SYNC_NUM_LOCK    = 0x02
+	TS_SYNC_CAPS_LOCK   = 0x04
+	TS_SYNC_KANA_LOCK   = 0x08
+)
+
+// TsSetKeyboardIndicatorsPDU is the server telling which keyboard LEDs are
+// lit, i.e. which lock keys are on in the session
+// See [MS-RDPBCGR] 2.2.8.2.1.1
+type TsSetKeyboardIndicatorsPDU struct {
+	UnitId   uint16 // must be zero
+	LedFlags uint16
+}
+
+func (t *TsSetKeyboardIndicatorsPDU) iDataPDU() {}
+
+func (t *TsSetKeyboardIndicatorsPDU) Read(r io.Reader) DataPDU {
+	core.ReadLE(r, t)
+	return t
+}
+
+func (t *TsSetKeyboardIndicatorsPDU) Serialize() []byte {
+	return core.ToLE(t)
+}
+
+func (t *TsSetKeyboardIndicatorsPDU) Type2() uint8 {
+	return PDUTYPE2_SET_KEYBOARD_INDICATORS
+}
@@ -37,6 +37,7 @@ const (
 	PDUTYPE2_ARC_STATUS_PDU              = 0x32
 	PDUTYPE2_STATUS_INFO_PDU             = 0x36
 	PDUTYPE2_MONITOR_LAYOUT_PDU          = 0x37
+	PDUTYPE2_FRAME_ACKNOWLEDGE           = 0x38
 )
 
 // StreamId
@@ -378,8 +379,15 @@ func NewTsShareDataHeader() *TsShareDataHeader {
 	}
 }
 
+// wire fields only; the compressor pointer must not reach encoding/binary
 func (h *TsShareDataHeader) Read(r io.Reader) {
-	core.ReadLE(r, h)
+	core.ReadLE(r, &h.SharedId)
+	core.ReadLE(r, &h.Padding1)
+	core.ReadLE(r, &h.StreamId)
+	core.ReadLE(r, &h.UncompressedLength)
+	core.ReadLE(r, &h.PDUType2)
+	core.ReadLE(r, &h.CompressedType)
+	core.ReadLE(r, &h.CompressedLength)
 	glog.Debugf("[!] compressedType: %x", h.CompressedType)
 
 	// Check if compression is used
@@ -414,7 +422,13 @@ func (h *TsShareDataHeader) ReadCompressedData(r io.Reader) ([]byte, error) {
 
 // Write writes the share data header
 func (h *TsShareDataHeader) Write(w io.Writer) {
-	core.WriteLE(w, h)
+	core.WriteLE(w, h.SharedId)
+	core.WriteLE(w, h.Padding1)
+	core.WriteLE(w, h.StreamId)
+	core.WriteLE(w, h.UncompressedLength)
+	core.WriteLE(w, h.PDUType2)
+	core.WriteLE(w, h.CompressedType)
+	core.WriteLE(w, h.CompressedLength)
 }
 
 // WriteCompressedData writes and compresses share data
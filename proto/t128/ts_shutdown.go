@@ -0,0 +1,75 @@
+package t128
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/kdsmith18542/gordp/core"
+)
+
+// TsShutdownRequestPDU asks the server to end the session. It has no body.
+// See [MS-RDPBCGR] 2.2.2.2
+type TsShutdownRequestPDU struct{}
+
+func (t *TsShutdownRequestPDU) iDataPDU() {}
+
+func (t *TsShutdownRequestPDU) Read(r io.Reader) DataPDU {
+	return t
+}
+
+func (t *TsShutdownRequestPDU) Serialize() []byte {
+	return nil
+}
+
+func (t *TsShutdownRequestPDU) Type2() uint8 {
+	return PDUTYPE2_SHUTDOWN_REQUEST
+}
+
+// TsShutdownDeniedPDU is the server refusing a Shutdown Request PDU, e.g.
+// because a user is logged on. It has no body.
+// See [MS-RDPBCGR] 2.2.2.3
+type TsShutdownDeniedPDU struct{}
+
+func (t *TsShutdownDeniedPDU) iDataPDU() {}
+
+func (t *TsShutdownDeniedPDU) Read(r io.Reader) DataPDU {
+	return t
+}
+
+func (t *TsShutdownDeniedPDU) Serialize() []byte {
+	return nil
+}
+
+func (t *TsShutdownDeniedPDU) Type2() uint8 {
+	return PDUTYPE2_SHUTDOWN_DENIED
+}
+
+// TsDeactivateAllPDU is the server deactivating the session, before it
+// ends or reactivates it with a Demand Active PDU
+// See [MS-RDPBCGR] 2.2.3.1
+type TsDeactivateAllPDU struct {
+	SharedId               uint32
+	LengthSourceDescriptor uint16
+	SourceDescriptor       []byte
+}
+
+func (t *TsDeactivateAllPDU) iPDU() {}
+
+func (t *TsDeactivateAllPDU) Type() uint16 {
+	return PDUTYPE_DEACTIVATEALLPDU
+}
+
+func (t *TsDeactivateAllPDU) Read(r io.Reader) PDU {
+	core.ReadLE(r, &t.SharedId)
+	core.ReadLE(r, &t.LengthSourceDescriptor)
+	t.SourceDescriptor = core.ReadBytes(r, int(t.LengthSourceDescriptor))
+	return t
+}
+
+func (t *TsDeactivateAllPDU) Serialize() []byte {
+	buff := new(bytes.Buffer)
+	core.WriteLE(buff, t.SharedId)
+	core.WriteLE(buff, uint16(len(t.SourceDescriptor)))
+	core.WriteFull(buff, t.SourceDescriptor)
+	return buff.Bytes()
+}
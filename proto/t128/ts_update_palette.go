@@ -0,0 +1,102 @@
+package t128
+
+import (
+	"bytes"
+	"image/color"
+	"io"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/glog"
+)
+
+// Slow-path update types
+const (
+	UPDATETYPE_ORDERS      = 0x0000
+	UPDATETYPE_BITMAP      = 0x0001
+	UPDATETYPE_PALETTE     = 0x0002
+	UPDATETYPE_SYNCHRONIZE = 0x0003
+)
+
+// TsPaletteEntry TS_PALETTE_ENTRY
+type TsPaletteEntry struct {
+	Red   uint8
+	Green uint8
+	Blue  uint8
+}
+
+// TsUpdatePalette TS_UPDATE_PALETTE_DATA, sent as a fast-path update or
+// inside a slow-path TS_UPDATE_PALETTE
+type TsUpdatePalette struct {
+	UpdateType     uint16 // This field MUST be set to UPDATETYPE_PALETTE (0x0002).
+	Pad2Octets     uint16
+	NumberColors   uint32
+	PaletteEntries []TsPaletteEntry
+}
+
+func (t *TsUpdatePalette) iUpdatePDU() {}
+
+func (t *TsUpdatePalette) Read(r io.Reader) UpdatePDU {
+	core.ReadLE(r, &t.UpdateType)
+	core.ReadLE(r, &t.Pad2Octets)
+	core.ReadLE(r, &t.NumberColors)
+	core.ThrowIf(t.NumberColors > 256, "invalid palette size")
+	t.PaletteEntries = make([]TsPaletteEntry, t.NumberColors)
+	core.ReadLE(r, t.PaletteEntries)
+	return t
+}
+
+func (t *TsUpdatePalette) Serialize() []byte {
+	buff := new(bytes.Buffer)
+	core.WriteLE(buff, t.UpdateType)
+	core.WriteLE(buff, t.Pad2Octets)
+	core.WriteLE(buff, uint32(len(t.PaletteEntries)))
+	core.WriteLE(buff, t.PaletteEntries)
+	return buff.Bytes()
+}
+
+// Palette returns the entries as a 256 color palette, unset entries are black
+func (t *TsUpdatePalette) Palette() color.Palette {
+	palette := make(color.Palette, 256)
+	for i := range palette {
+		palette[i] = color.RGBA{A: 255}
+	}
+	for i, e := range t.PaletteEntries {
+		palette[i] = color.RGBA{R: e.Red, G: e.Green, B: e.Blue, A: 255}
+	}
+	return palette
+}
+
+// TsUpdatePDU slow-path graphics update (PDUTYPE2_UPDATE). Only palette
+// updates are decoded, the data of other update types is kept raw.
+type TsUpdatePDU struct {
+	UpdateType uint16
+	Palette    *TsUpdatePalette
+	Data       []byte
+}
+
+func (t *TsUpdatePDU) iDataPDU() {}
+
+func (t *TsUpdatePDU) Read(r io.Reader) DataPDU {
+	t.Data, _ = io.ReadAll(r)
+	t.Palette = nil
+	core.ThrowIf(len(t.Data) < 2, "invalid update pdu")
+	t.UpdateType = uint16(t.Data[0]) | uint16(t.Data[1])<<8
+	switch t.UpdateType {
+	case UPDATETYPE_PALETTE:
+		t.Palette = (&TsUpdatePalette{}).Read(bytes.NewReader(t.Data)).(*TsUpdatePalette)
+	default:
+		glog.Debugf("slow-path update type [%x] not implement", t.UpdateType)
+	}
+	return t
+}
+
+func (t *TsUpdatePDU) Serialize() []byte {
+	if t.Palette != nil {
+		return t.Palette.Serialize()
+	}
+	return t.Data
+}
+
+func (t *TsUpdatePDU) Type2() uint8 {
+	return PDUTYPE2_UPDATE
+}
@@ -0,0 +1,45 @@
+package t128
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdatePalette(t *testing.T) {
+	update := &TsUpdatePalette{
+		UpdateType: UPDATETYPE_PALETTE,
+		PaletteEntries: []TsPaletteEntry{
+			{Red: 0xFF},
+			{Green: 0x80, Blue: 0x40},
+		},
+	}
+	data := update.Serialize()
+	assert.Equal(t, 8+2*3, len(data))
+
+	// fast-path carries the palette data as is
+	fp := (&TsUpdatePalette{}).Read(bytes.NewReader(data)).(*TsUpdatePalette)
+	assert.Equal(t, uint32(2), fp.NumberColors)
+	assert.Equal(t, update.PaletteEntries, fp.PaletteEntries)
+
+	palette := fp.Palette()
+	require.Len(t, palette, 256)
+	assert.Equal(t, color.RGBA{R: 0xFF, A: 0xFF}, palette[0])
+	assert.Equal(t, color.RGBA{G: 0x80, B: 0x40, A: 0xFF}, palette[1])
+	assert.Equal(t, color.RGBA{A: 0xFF}, palette[255])
+
+	// slow-path wraps it in an update PDU
+	pdu := (&TsUpdatePDU{}).Read(bytes.NewReader(data)).(*TsUpdatePDU)
+	assert.Equal(t, uint16(UPDATETYPE_PALETTE), pdu.UpdateType)
+	require.NotNil(t, pdu.Palette)
+	assert.Equal(t, update.PaletteEntries, pdu.Palette.PaletteEntries)
+	assert.Equal(t, data, pdu.Serialize())
+
+	// other update types are kept raw
+	pdu = (&TsUpdatePDU{}).Read(bytes.NewReader([]byte{UPDATETYPE_SYNCHRONIZE, 0, 0, 0})).(*TsUpdatePDU)
+	assert.Nil(t, pdu.Palette)
+	assert.Equal(t, []byte{UPDATETYPE_SYNCHRONIZE, 0, 0, 0}, pdu.Data)
+}
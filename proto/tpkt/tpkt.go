@@ -5,6 +5,7 @@ import (
 	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/glog"
 	"io"
+	"math"
 )
 
 // Header --- TPKT Header, as specified in [T123] section 8.
@@ -22,7 +23,8 @@ func (header *Header) Write(w io.Writer) {
 func (header *Header) Read(r io.Reader) {
 	core.ReadBE(r, header)
 	glog.Debugf("tpkt header: %+v", header)
-	core.ThrowIf(header.Version != 3 || header.Length <= 4, fmt.Errorf("invalid tpkt packet"))
+	core.ThrowIf(header.Version != 3, fmt.Errorf("invalid tpkt packet"))
+	core.CheckLength("TPKT", int(header.Length), 5, math.MaxUint16)
 }
 
 // Read TPKT Packet data
@@ -203,3 +203,24 @@ func BenchmarkWriteTPKTPacket(b *testing.B) {
 		Write(&buf, data)
 	}
 }
+
+func TestReadLengthOutOfBounds(t *testing.T) {
+	// a length below the header itself
+	err := core.Try(func() { Read(bytes.NewReader([]byte{0x03, 0x00, 0x00, 0x04})) })
+	var lengthErr *core.LengthError
+	assert.ErrorAs(t, err, &lengthErr)
+	assert.Equal(t, "TPKT", lengthErr.Field)
+}
+
+// FuzzRead checks that no packet makes Read fail other than by throwing,
+// or return more than the packet carries
+func FuzzRead(f *testing.F) {
+	f.Add([]byte{0x03, 0x00, 0x00, 0x0A, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06})
+	f.Add([]byte{0x03, 0x00, 0x00, 0x04})
+	f.Add([]byte{0x03, 0x00, 0xFF, 0xFF, 0x01})
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		var data []byte
+		_ = core.TryRead(func() { data = Read(bytes.NewReader(packet)) })
+		assert.LessOrEqual(t, len(data), max(0, len(packet)-4))
+	})
+}
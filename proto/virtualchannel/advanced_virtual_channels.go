@@ -5,15 +5,21 @@
 package virtualchannel
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -91,7 +97,7 @@ type AdvancedVirtualChannelManager struct {
 	// USB management
 	usbManager *AdvancedUSBManager
 
-	// Security and encryption
+	// Security and encryption, see VirtualChannelConfig.EncryptionKey
 	encryptionEnabled bool
 	encryptionKey     []byte
 
@@ -161,10 +167,16 @@ type VirtualChannelConfig struct {
 	EnableCompression bool
 	EnableEncryption  bool
 	CompressionLevel  int
-	EncryptionKey     []byte
-	Timeout           time.Duration
-	RetryCount        int
-	BufferSize        int
+
+	// EncryptionKey is the AES key of the data the channels keep in memory,
+	// such as clipboard contents. It never leaves the client: data goes to
+	// the peer in the clear, protected by the security of the connection.
+	// When empty, a random key is generated for each session.
+	EncryptionKey []byte
+
+	Timeout    time.Duration
+	RetryCount int
+	BufferSize int
 }
 
 // NewAdvancedVirtualChannelManager creates a new advanced virtual channel manager
@@ -203,12 +215,28 @@ func (manager *AdvancedVirtualChannelManager) initializeVirtualChannels() {
 	// Load configuration
 	manager.loadConfiguration()
 
+	// Key the data kept encrypted for this session
+	manager.encryptionKey = manager.config.EncryptionKey
+	if len(manager.encryptionKey) == 0 {
+		manager.encryptionKey = newEncryptionKey()
+	}
+	if err := manager.clipboardManager.SetEncryptionKey(manager.encryptionKey); err != nil {
+		glog.Warnf("Invalid virtual channel encryption key, using a session key: %v", err)
+		manager.encryptionKey = manager.clipboardManager.encryptionKey
+	}
+
 	// Initialize default channels
 	manager.initializeDefaultChannels()
 
 	glog.Info("Advanced virtual channel manager initialized")
 }
 
+// FileTransferManager returns the file transfer manager, which sends
+// nothing until given a channel, e.g. with Client.RegisterFileTransfer
+func (manager *AdvancedVirtualChannelManager) FileTransferManager() *AdvancedFileTransferManager {
+	return manager.fileTransferManager
+}
+
 // loadConfiguration loads virtual channel configuration
 func (manager *AdvancedVirtualChannelManager) loadConfiguration() {
 	// This is a simplified implementation
@@ -220,7 +248,6 @@ func (manager *AdvancedVirtualChannelManager) loadConfiguration() {
 		EnableCompression: true,
 		EnableEncryption:  true,
 		CompressionLevel:  6,
-		EncryptionKey:     []byte("default-encryption-key-32-bytes-long"),
 		Timeout:           30 * time.Second,
 		RetryCount:        3,
 		BufferSize:        64 * 1024, // 64KB
@@ -274,7 +301,9 @@ func (manager *AdvancedVirtualChannelManager) createChannel(id, name string, cha
 // Advanced Clipboard Manager
 // ============================================================================
 
-// AdvancedClipboardManager manages advanced clipboard functionality
+// AdvancedClipboardManager manages advanced clipboard functionality. Copied
+// data is kept encrypted at rest with a key of the session that is never
+// shared with the peer, which gets the data back in the clear on paste.
 type AdvancedClipboardManager struct {
 	mutex sync.RWMutex
 
@@ -329,12 +358,55 @@ func NewAdvancedClipboardManager() *AdvancedClipboardManager {
 	}
 
 	// Generate encryption key
-	manager.encryptionKey = make([]byte, 32)
-	rand.Read(manager.encryptionKey)
+	manager.encryptionKey = newEncryptionKey()
 
 	return manager
 }
 
+// newEncryptionKey generates a random AES-256 key
+func newEncryptionKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// SetEncryptionKey replaces the AES key of the data kept at rest, which must
+// be 16, 24 or 32 bytes long. Data already stored is encrypted again with it.
+func (manager *AdvancedClipboardManager) SetEncryptionKey(key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+	key = bytes.Clone(key)
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if manager.encryptionEnabled {
+		formats := make(map[string][]byte, len(manager.formats))
+		for format, data := range manager.formats {
+			rekeyed, err := rekey(data, manager.encryptionKey, key)
+			if err != nil {
+				return err
+			}
+			formats[format] = rekeyed
+		}
+		history := make([][]byte, len(manager.history))
+		for i, entry := range manager.history {
+			rekeyed, err := rekey(entry.Data, manager.encryptionKey, key)
+			if err != nil {
+				return err
+			}
+			history[i] = rekeyed
+		}
+		manager.formats = formats
+		for i, entry := range manager.history {
+			entry.Data = history[i]
+		}
+	}
+	manager.encryptionKey = key
+	return nil
+}
+
 // HandleData handles clipboard data
 func (manager *AdvancedClipboardManager) HandleData(data []byte) ([]byte, error) {
 	manager.mutex.Lock()
@@ -561,7 +633,26 @@ func (manager *AdvancedClipboardManager) addToHistory(entry *ClipboardEntry) {
 
 // encryptData encrypts clipboard data
 func (manager *AdvancedClipboardManager) encryptData(data []byte) ([]byte, error) {
-	block, err := aes.NewCipher(manager.encryptionKey)
+	return sealData(manager.encryptionKey, data)
+}
+
+// decryptData decrypts clipboard data
+func (manager *AdvancedClipboardManager) decryptData(data []byte) ([]byte, error) {
+	return openData(manager.encryptionKey, data)
+}
+
+// rekey decrypts data with one key and encrypts it with another
+func rekey(data, from, to []byte) ([]byte, error) {
+	plaintext, err := openData(from, data)
+	if err != nil {
+		return nil, err
+	}
+	return sealData(to, plaintext)
+}
+
+// sealData encrypts data with AES-GCM, the nonce in front
+func sealData(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
@@ -583,9 +674,9 @@ func (manager *AdvancedClipboardManager) encryptData(data []byte) ([]byte, error
 	return ciphertext, nil
 }
 
-// decryptData decrypts clipboard data
-func (manager *AdvancedClipboardManager) decryptData(data []byte) ([]byte, error) {
-	block, err := aes.NewCipher(manager.encryptionKey)
+// openData decrypts data sealed with key
+func openData(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
@@ -617,15 +708,49 @@ func (manager *AdvancedClipboardManager) decryptData(data []byte) ([]byte, error
 // Advanced File Transfer Manager
 // ============================================================================
 
-// AdvancedFileTransferManager manages advanced file transfer functionality
+// FileTransferChannelName is the dynamic virtual channel the file transfer
+// manager exchanges its messages on
+const FileTransferChannelName = "GoRDP::FileTransfer"
+
+// defaultChunkSize is the size of the file data sent in one chunk message
+const defaultChunkSize = 32 * 1024
+
+var (
+	// ErrChecksumMismatch is returned when a received file does not match
+	// the checksum announced by its sender
+	ErrChecksumMismatch = errors.New("file transfer checksum mismatch")
+
+	// ErrFileTransferChannelNotOpen is returned when data is sent before the
+	// file transfer channel is opened or after it is closed, or without a
+	// transport set with SetTransport
+	ErrFileTransferChannelNotOpen = errors.New("file transfer channel not open")
+)
+
+// errTransferCancelled stops the goroutine sending a cancelled transfer
+var errTransferCancelled = errors.New("file transfer cancelled")
+
+// AdvancedFileTransferManager manages advanced file transfer functionality.
+// The peer uploads files with an upload message followed by chunk messages,
+// and downloads them with a download message answered by chunk messages and
+// a complete message carrying the checksum of the file.
 type AdvancedFileTransferManager struct {
 	mutex sync.RWMutex
 
 	// Transfer management
 	transfers map[string]*FileTransfer
 	queue     []*FileTransfer
+	cancels   map[string]chan struct{}
+
+	// Channel transport, sendMutex keeps the response to a message ahead of
+	// the chunks of the transfer it starts
+	send      func(channelId uint32, data []byte) error
+	channelId uint32
+	open      bool
+	sendMutex sync.Mutex
 
 	// Configuration
+	directory              string
+	chunkSize              int
 	maxConcurrentTransfers int
 	maxFileSize            int64
 	enableResume           bool
@@ -671,6 +796,9 @@ func NewAdvancedFileTransferManager() *AdvancedFileTransferManager {
 	manager := &AdvancedFileTransferManager{
 		transfers:              make(map[string]*FileTransfer),
 		queue:                  make([]*FileTransfer, 0),
+		cancels:                make(map[string]chan struct{}),
+		directory:              "./uploads",
+		chunkSize:              defaultChunkSize,
 		maxConcurrentTransfers: 3,
 		maxFileSize:            100 * 1024 * 1024, // 100MB
 		enableResume:           true,
@@ -682,7 +810,104 @@ func NewAdvancedFileTransferManager() *AdvancedFileTransferManager {
 	return manager
 }
 
-// HandleData handles file transfer data
+// SetTransport attaches the function writing messages on the dynamic
+// virtual channel, such as Client.SendDynamicVirtualChannelData
+func (manager *AdvancedFileTransferManager) SetTransport(send func(channelId uint32, data []byte) error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	manager.send = send
+}
+
+// SetDirectory sets the directory uploaded files are written to and
+// downloaded files are read from
+func (manager *AdvancedFileTransferManager) SetDirectory(directory string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	manager.directory = directory
+}
+
+// GetTransfer returns a copy of the state of a transfer
+func (manager *AdvancedFileTransferManager) GetTransfer(transferID string) (FileTransfer, bool) {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	transfer, exists := manager.transfers[transferID]
+	if !exists {
+		return FileTransfer{}, false
+	}
+	return *transfer, true
+}
+
+// OnChannelCreated handles channel creation events
+func (manager *AdvancedFileTransferManager) OnChannelCreated(channelId uint32, channelName string) error {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	manager.channelId = channelId
+	manager.open = true
+	return nil
+}
+
+// OnChannelOpened handles channel open events
+func (manager *AdvancedFileTransferManager) OnChannelOpened(channelId uint32) error {
+	return nil
+}
+
+// OnChannelClosed stops sending until the channel is opened again. Transfers
+// in progress fail and can be resumed on the next channel.
+func (manager *AdvancedFileTransferManager) OnChannelClosed(channelId uint32) error {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	manager.open = false
+	return nil
+}
+
+// OnDataReceived handles a message of the peer and writes the response on
+// the channel, an error response when the message fails
+func (manager *AdvancedFileTransferManager) OnDataReceived(channelId uint32, data []byte) error {
+	manager.sendMutex.Lock()
+	defer manager.sendMutex.Unlock()
+
+	response, err := manager.HandleData(data)
+	if err != nil {
+		response, _ = json.Marshal(map[string]interface{}{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
+	if response != nil {
+		if sendErr := manager.writeMessage(response); sendErr != nil && err == nil {
+			err = sendErr
+		}
+	}
+	return err
+}
+
+// sendMessage writes a message on the channel
+func (manager *AdvancedFileTransferManager) sendMessage(data []byte) error {
+	manager.sendMutex.Lock()
+	defer manager.sendMutex.Unlock()
+	return manager.writeMessage(data)
+}
+
+// connected reports whether messages can be sent, mutex held
+func (manager *AdvancedFileTransferManager) connected() bool {
+	return manager.send != nil && manager.open
+}
+
+// writeMessage writes a message on the channel, sendMutex held
+func (manager *AdvancedFileTransferManager) writeMessage(data []byte) error {
+	manager.mutex.RLock()
+	send, channelId, open := manager.send, manager.channelId, manager.open
+	manager.mutex.RUnlock()
+
+	if send == nil || !open {
+		return ErrFileTransferChannelNotOpen
+	}
+	return send(channelId, data)
+}
+
+// HandleData handles file transfer data. It returns no response for the
+// chunks before the last one of an upload.
 func (manager *AdvancedFileTransferManager) HandleData(data []byte) ([]byte, error) {
 	manager.mutex.Lock()
 	defer manager.mutex.Unlock()
@@ -697,23 +922,38 @@ func (manager *AdvancedFileTransferManager) HandleData(data []byte) ([]byte, err
 	return manager.processFileTransferData(transferData)
 }
 
-// HandleEvent handles file transfer events
+// HandleEvent handles file transfer events. Cancelling or resuming a
+// transfer tells the peer, ahead of the chunks of a resumed transfer.
 func (manager *AdvancedFileTransferManager) HandleEvent(event *VirtualChannelEvent) error {
-	manager.mutex.Lock()
-	defer manager.mutex.Unlock()
+	var notice []byte
+	var err error
 
+	manager.sendMutex.Lock()
+	defer manager.sendMutex.Unlock()
+
+	manager.mutex.Lock()
 	switch event.Type {
 	case "upload":
-		return manager.handleUploadEvent(event)
+		err = manager.handleUploadEvent(event)
 	case "download":
-		return manager.handleDownloadEvent(event)
+		err = manager.handleDownloadEvent(event)
 	case "cancel":
-		return manager.handleCancelEvent(event)
+		notice, err = manager.handleCancelEvent(event)
 	case "resume":
-		return manager.handleResumeEvent(event)
+		notice, err = manager.handleResumeEvent(event)
 	default:
-		return fmt.Errorf("unknown file transfer event: %s", event.Type)
+		err = fmt.Errorf("unknown file transfer event: %s", event.Type)
 	}
+	manager.mutex.Unlock()
+
+	if err != nil || notice == nil {
+		return err
+	}
+	// The transfer changed locally whether or not the peer can be told
+	if err := manager.writeMessage(notice); err != nil && !errors.Is(err, ErrFileTransferChannelNotOpen) {
+		return err
+	}
+	return nil
 }
 
 // GetStatistics returns file transfer statistics
@@ -750,6 +990,8 @@ func (manager *AdvancedFileTransferManager) processFileTransferData(transferData
 	switch action {
 	case "upload":
 		return manager.processUpload(transferData)
+	case "chunk":
+		return manager.processChunk(transferData)
 	case "download":
 		return manager.processDownload(transferData)
 	case "cancel":
@@ -761,7 +1003,32 @@ func (manager *AdvancedFileTransferManager) processFileTransferData(transferData
 	}
 }
 
-// processUpload processes an upload operation
+// transferPath returns the path of filename in the transfer directory,
+// refusing names that leave it
+func (manager *AdvancedFileTransferManager) transferPath(filename string) (string, error) {
+	if !filepath.IsLocal(filename) {
+		return "", fmt.Errorf("invalid filename: %q", filename)
+	}
+	return filepath.Join(manager.directory, filename), nil
+}
+
+// lookupTransfer returns the transfer named by the transfer_id of a message
+func (manager *AdvancedFileTransferManager) lookupTransfer(transferData map[string]interface{}) (*FileTransfer, error) {
+	transferID, ok := transferData["transfer_id"].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid transfer ID")
+	}
+
+	transfer, exists := manager.transfers[transferID]
+	if !exists {
+		return nil, fmt.Errorf("transfer not found: %s", transferID)
+	}
+	return transfer, nil
+}
+
+// processUpload processes an upload operation, creating the file the chunks
+// of the peer are written to. A file that exists already is not
+// overwritten, the upload fails instead.
 func (manager *AdvancedFileTransferManager) processUpload(transferData map[string]interface{}) ([]byte, error) {
 	filename, ok := transferData["filename"].(string)
 	if !ok {
@@ -769,34 +1036,56 @@ func (manager *AdvancedFileTransferManager) processUpload(transferData map[strin
 	}
 
 	size, ok := transferData["size"].(float64)
-	if !ok {
+	if !ok || size < 0 {
 		return nil, fmt.Errorf("invalid file size")
 	}
+	if int64(size) > manager.maxFileSize {
+		return nil, fmt.Errorf("file too large: %d bytes, at most %d", int64(size), manager.maxFileSize)
+	}
 
-	// Create transfer
+	checksum, ok := transferData["checksum"].(string)
+	if !ok || checksum == "" {
+		return nil, fmt.Errorf("invalid checksum")
+	}
+
+	destination, err := manager.transferPath(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	// Create transfer, in progress until its last chunk arrives
 	transfer := &FileTransfer{
 		ID:          fmt.Sprintf("transfer_%d", time.Now().UnixNano()),
 		Filename:    filename,
 		Size:        int64(size),
-		Status:      TransferStatusPending,
+		Status:      TransferStatusInProgress,
 		StartTime:   time.Now(),
 		Source:      "remote",
-		Destination: filepath.Join("./uploads", filename),
+		Destination: destination,
+		Checksum:    checksum,
 		Metadata:    transferData,
 	}
 
 	// Add to transfers
 	manager.transfers[transfer.ID] = transfer
-	manager.queue = append(manager.queue, transfer)
-
-	// Start transfer if possible
-	manager.processQueue()
 
 	// Update statistics
 	manager.statistics.TotalTransfers++
 	manager.statistics.TotalBytes += transfer.Size
 	manager.statistics.LastActivity = time.Now()
 
+	if transfer.Size == 0 {
+		return manager.finishUpload(transfer)
+	}
+
 	// Return transfer info
 	response := map[string]interface{}{
 		"status":      "success",
@@ -804,6 +1093,85 @@ func (manager *AdvancedFileTransferManager) processUpload(transferData map[strin
 		"transfer_id": transfer.ID,
 		"filename":    filename,
 		"size":        size,
+		"offset":      0,
+	}
+
+	return json.Marshal(response)
+}
+
+// processChunk writes a chunk of an upload to its file. Chunks come in
+// order, but a chunk sent again after a resume rewrites data already
+// received.
+func (manager *AdvancedFileTransferManager) processChunk(transferData map[string]interface{}) ([]byte, error) {
+	transfer, err := manager.lookupTransfer(transferData)
+	if err != nil {
+		return nil, err
+	}
+	if transfer.Source != "remote" {
+		return nil, fmt.Errorf("transfer %s does not receive data", transfer.ID)
+	}
+	if transfer.Status != TransferStatusInProgress {
+		return nil, fmt.Errorf("transfer %s is not in progress", transfer.ID)
+	}
+
+	offset, ok := transferData["offset"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("invalid chunk offset")
+	}
+	encoded, ok := transferData["data"].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid chunk data")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk data: %w", err)
+	}
+
+	start := int64(offset)
+	end := start + int64(len(data))
+	if start < 0 || start > transfer.Transferred {
+		return nil, fmt.Errorf("chunk at offset %d of transfer %s, expected %d", start, transfer.ID, transfer.Transferred)
+	}
+	if end > transfer.Size {
+		return nil, fmt.Errorf("chunk past the end of transfer %s: %d > %d", transfer.ID, end, transfer.Size)
+	}
+
+	if err := writeFileAt(transfer.Destination, data, start); err != nil {
+		manager.failTransfer(transfer, err)
+		return nil, err
+	}
+	if end > transfer.Transferred {
+		manager.updateProgress(transfer, end)
+	}
+
+	if transfer.Transferred < transfer.Size {
+		return nil, nil
+	}
+	return manager.finishUpload(transfer)
+}
+
+// finishUpload checks a received file against the checksum of its sender
+func (manager *AdvancedFileTransferManager) finishUpload(transfer *FileTransfer) ([]byte, error) {
+	checksum, err := fileChecksum(transfer.Destination)
+	if err != nil {
+		manager.failTransfer(transfer, err)
+		return nil, err
+	}
+	if !strings.EqualFold(checksum, transfer.Checksum) {
+		// The data cannot be trusted, a resume starts over
+		manager.updateProgress(transfer, 0)
+		err := fmt.Errorf("%w: %s", ErrChecksumMismatch, transfer.Filename)
+		manager.failTransfer(transfer, err)
+		return nil, err
+	}
+
+	manager.completeTransfer(transfer)
+
+	response := map[string]interface{}{
+		"status":      "success",
+		"action":      "complete",
+		"transfer_id": transfer.ID,
+		"checksum":    checksum,
 	}
 
 	return json.Marshal(response)
@@ -815,9 +1183,15 @@ func (manager *AdvancedFileTransferManager) processDownload(transferData map[str
 	if !ok {
 		return nil, fmt.Errorf("invalid filename")
 	}
+	if !manager.connected() {
+		return nil, ErrFileTransferChannelNotOpen
+	}
 
 	// Check if file exists
-	filePath := filepath.Join("./uploads", filename)
+	filePath, err := manager.transferPath(filename)
+	if err != nil {
+		return nil, err
+	}
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		return nil, fmt.Errorf("file not found: %s", filename)
 	}
@@ -827,6 +1201,10 @@ func (manager *AdvancedFileTransferManager) processDownload(transferData map[str
 	if err != nil {
 		return nil, err
 	}
+	checksum, err := fileChecksum(filePath)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create transfer
 	transfer := &FileTransfer{
@@ -837,6 +1215,7 @@ func (manager *AdvancedFileTransferManager) processDownload(transferData map[str
 		StartTime:   time.Now(),
 		Source:      "local",
 		Destination: filePath,
+		Checksum:    checksum,
 		Metadata:    transferData,
 	}
 
@@ -859,6 +1238,7 @@ func (manager *AdvancedFileTransferManager) processDownload(transferData map[str
 		"transfer_id": transfer.ID,
 		"filename":    filename,
 		"size":        transfer.Size,
+		"checksum":    checksum,
 	}
 
 	return json.Marshal(response)
@@ -866,30 +1246,21 @@ func (manager *AdvancedFileTransferManager) processDownload(transferData map[str
 
 // processCancel processes a cancel operation
 func (manager *AdvancedFileTransferManager) processCancel(transferData map[string]interface{}) ([]byte, error) {
-	transferID, ok := transferData["transfer_id"].(string)
-	if !ok {
-		return nil, fmt.Errorf("invalid transfer ID")
+	transfer, err := manager.lookupTransfer(transferData)
+	if err != nil {
+		return nil, err
 	}
 
-	transfer, exists := manager.transfers[transferID]
-	if !exists {
-		return nil, fmt.Errorf("transfer not found: %s", transferID)
+	if err := manager.cancelTransfer(transfer); err != nil {
+		return nil, err
 	}
 
-	// Cancel transfer
-	transfer.Status = TransferStatusCancelled
-	transfer.EndTime = time.Now()
-	transfer.Duration = transfer.EndTime.Sub(transfer.StartTime)
-
-	// Update statistics
-	manager.statistics.FailedTransfers++
-	manager.statistics.LastActivity = time.Now()
-
 	// Return success response
 	response := map[string]interface{}{
 		"status":      "success",
 		"action":      "cancel",
-		"transfer_id": transferID,
+		"transfer_id": transfer.ID,
+		"offset":      transfer.Transferred,
 	}
 
 	return json.Marshal(response)
@@ -897,33 +1268,83 @@ func (manager *AdvancedFileTransferManager) processCancel(transferData map[strin
 
 // processResume processes a resume operation
 func (manager *AdvancedFileTransferManager) processResume(transferData map[string]interface{}) ([]byte, error) {
-	transferID, ok := transferData["transfer_id"].(string)
-	if !ok {
-		return nil, fmt.Errorf("invalid transfer ID")
-	}
-
-	transfer, exists := manager.transfers[transferID]
-	if !exists {
-		return nil, fmt.Errorf("transfer not found: %s", transferID)
+	transfer, err := manager.lookupTransfer(transferData)
+	if err != nil {
+		return nil, err
 	}
 
-	if !manager.enableResume {
-		return nil, fmt.Errorf("resume not enabled")
+	offset, err := manager.resumeTransfer(transfer)
+	if err != nil {
+		return nil, err
 	}
 
-	// Resume transfer
-	transfer.Status = TransferStatusInProgress
-
-	// Return success response
+	// Return success response, with the offset the peer sends an upload from
 	response := map[string]interface{}{
 		"status":      "success",
 		"action":      "resume",
-		"transfer_id": transferID,
+		"transfer_id": transfer.ID,
+		"offset":      offset,
 	}
 
 	return json.Marshal(response)
 }
 
+// cancelTransfer stops a pending or active transfer, keeping its offset for
+// a resume
+func (manager *AdvancedFileTransferManager) cancelTransfer(transfer *FileTransfer) error {
+	if transfer.Status != TransferStatusPending && transfer.Status != TransferStatusInProgress {
+		return fmt.Errorf("transfer %s is not active", transfer.ID)
+	}
+
+	// Cancel transfer
+	transfer.Status = TransferStatusCancelled
+	transfer.EndTime = time.Now()
+	transfer.Duration = transfer.EndTime.Sub(transfer.StartTime)
+	transfer.ResumeData = encodeResumeOffset(transfer.Transferred)
+	if cancel, ok := manager.cancels[transfer.ID]; ok {
+		close(cancel)
+		delete(manager.cancels, transfer.ID)
+	}
+
+	// Update statistics
+	manager.statistics.FailedTransfers++
+	manager.statistics.LastActivity = time.Now()
+
+	// Give the slot to the next transfer
+	manager.processQueue()
+	return nil
+}
+
+// resumeTransfer restarts a cancelled or failed transfer from the offset in
+// its ResumeData and returns that offset
+func (manager *AdvancedFileTransferManager) resumeTransfer(transfer *FileTransfer) (int64, error) {
+	if !manager.enableResume {
+		return 0, fmt.Errorf("resume not enabled")
+	}
+	if transfer.Status != TransferStatusCancelled && transfer.Status != TransferStatusFailed {
+		return 0, fmt.Errorf("transfer %s cannot be resumed", transfer.ID)
+	}
+	if transfer.Source == "local" && !manager.connected() {
+		return 0, ErrFileTransferChannelNotOpen
+	}
+
+	offset := resumeOffset(transfer)
+	manager.updateProgress(transfer, offset)
+	transfer.EndTime = time.Time{}
+	transfer.Duration = 0
+
+	if transfer.Source == "local" {
+		// Sent from the offset once a slot is free
+		transfer.Status = TransferStatusPending
+		manager.queue = append(manager.queue, transfer)
+		manager.processQueue()
+	} else {
+		// Received from the offset as the peer sends it
+		transfer.Status = TransferStatusInProgress
+	}
+	return offset, nil
+}
+
 // processQueue processes the transfer queue
 func (manager *AdvancedFileTransferManager) processQueue() {
 	// Count active transfers
@@ -934,40 +1355,141 @@ func (manager *AdvancedFileTransferManager) processQueue() {
 		}
 	}
 
-	// Start transfers if possible
+	// Start transfers if possible, keeping the rest queued
+	pending := manager.queue[:0]
 	for _, transfer := range manager.queue {
+		if transfer.Status != TransferStatusPending {
+			continue
+		}
 		if activeCount >= manager.maxConcurrentTransfers {
-			break
+			pending = append(pending, transfer)
+			continue
 		}
 
-		if transfer.Status == TransferStatusPending {
-			transfer.Status = TransferStatusInProgress
-			activeCount++
+		transfer.Status = TransferStatusInProgress
+		activeCount++
 
-			// Start transfer in goroutine
-			go manager.executeTransfer(transfer)
-		}
+		// Start transfer in goroutine
+		cancel := make(chan struct{})
+		manager.cancels[transfer.ID] = cancel
+		go manager.executeTransfer(transfer, cancel)
 	}
+	manager.queue = pending
 }
 
-// executeTransfer executes a file transfer
-func (manager *AdvancedFileTransferManager) executeTransfer(transfer *FileTransfer) {
-	// This is a simplified implementation
-	// In a real implementation, this would perform actual file transfer
-
-	// Simulate transfer
-	time.Sleep(2 * time.Second)
+// executeTransfer sends a file to the peer until it is done, fails or
+// cancel is closed
+func (manager *AdvancedFileTransferManager) executeTransfer(transfer *FileTransfer, cancel chan struct{}) {
+	err := manager.sendFile(transfer, cancel)
 
 	manager.mutex.Lock()
 	defer manager.mutex.Unlock()
 
-	// Complete transfer
+	switch {
+	case errors.Is(err, errTransferCancelled) || manager.cancels[transfer.ID] != cancel:
+		// Cancelled, and maybe already resumed by another goroutine
+		glog.Infof("File transfer cancelled: %s at %d bytes", transfer.Filename, transfer.Transferred)
+		return
+	case err != nil:
+		manager.failTransfer(transfer, err)
+	default:
+		manager.completeTransfer(transfer)
+	}
+	delete(manager.cancels, transfer.ID)
+	manager.processQueue()
+}
+
+// sendFile sends the chunks of a transfer from its resume offset and then
+// the complete message with the checksum of the file
+func (manager *AdvancedFileTransferManager) sendFile(transfer *FileTransfer, cancel chan struct{}) error {
+	manager.mutex.RLock()
+	offset := transfer.Transferred
+	chunkSize := manager.chunkSize
+	manager.mutex.RUnlock()
+
+	file, err := os.Open(transfer.Destination)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, chunkSize)
+	for offset < transfer.Size {
+		select {
+		case <-cancel:
+			return errTransferCancelled
+		default:
+		}
+
+		n := int(min(int64(chunkSize), transfer.Size-offset))
+		if _, err := io.ReadFull(file, buffer[:n]); err != nil {
+			return fmt.Errorf("failed to read %s: %w", transfer.Filename, err)
+		}
+		chunk, err := json.Marshal(map[string]interface{}{
+			"action":      "chunk",
+			"transfer_id": transfer.ID,
+			"offset":      offset,
+			"data":        buffer[:n],
+		})
+		if err != nil {
+			return err
+		}
+		if err := manager.sendMessage(chunk); err != nil {
+			return err
+		}
+		offset += int64(n)
+
+		manager.mutex.Lock()
+		select {
+		case <-cancel:
+			// The peer has the chunk, resuming sends it again
+			manager.mutex.Unlock()
+			return errTransferCancelled
+		default:
+		}
+		manager.updateProgress(transfer, offset)
+		manager.mutex.Unlock()
+	}
+
+	complete, err := json.Marshal(map[string]interface{}{
+		"status":      "success",
+		"action":      "complete",
+		"transfer_id": transfer.ID,
+		"size":        transfer.Size,
+		"checksum":    transfer.Checksum,
+	})
+	if err != nil {
+		return err
+	}
+	return manager.sendMessage(complete)
+}
+
+// updateProgress records the bytes of a transfer moved so far
+func (manager *AdvancedFileTransferManager) updateProgress(transfer *FileTransfer, transferred int64) {
+	transfer.Transferred = transferred
+	if transfer.Size > 0 {
+		transfer.Progress = float64(transferred) * 100 / float64(transfer.Size)
+	}
+	if elapsed := time.Since(transfer.StartTime).Seconds(); elapsed > 0 {
+		transfer.Speed = float64(transferred) / elapsed
+	}
+	manager.statistics.LastActivity = time.Now()
+}
+
+// completeTransfer marks a transfer successful
+func (manager *AdvancedFileTransferManager) completeTransfer(transfer *FileTransfer) {
 	transfer.Status = TransferStatusCompleted
 	transfer.EndTime = time.Now()
 	transfer.Duration = transfer.EndTime.Sub(transfer.StartTime)
 	transfer.Transferred = transfer.Size
 	transfer.Progress = 100.0
-	transfer.Speed = float64(transfer.Size) / transfer.Duration.Seconds()
+	transfer.ResumeData = nil
+	if seconds := transfer.Duration.Seconds(); seconds > 0 {
+		transfer.Speed = float64(transfer.Size) / seconds
+	}
 
 	// Update statistics
 	manager.statistics.SuccessfulTransfers++
@@ -978,6 +1500,66 @@ func (manager *AdvancedFileTransferManager) executeTransfer(transfer *FileTransf
 	glog.Infof("File transfer completed: %s", transfer.Filename)
 }
 
+// failTransfer marks a transfer failed, keeping its offset for a resume
+func (manager *AdvancedFileTransferManager) failTransfer(transfer *FileTransfer, err error) {
+	transfer.Status = TransferStatusFailed
+	transfer.EndTime = time.Now()
+	transfer.Duration = transfer.EndTime.Sub(transfer.StartTime)
+	transfer.ResumeData = encodeResumeOffset(transfer.Transferred)
+
+	// Update statistics
+	manager.statistics.FailedTransfers++
+	manager.statistics.LastActivity = time.Now()
+
+	glog.Warnf("File transfer failed: %s: %v", transfer.Filename, err)
+}
+
+// encodeResumeOffset is the ResumeData of a transfer stopped at offset
+func encodeResumeOffset(offset int64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(offset))
+}
+
+// resumeOffset is the offset in the ResumeData of a transfer, 0 when it has
+// none or it does not fit the file
+func resumeOffset(transfer *FileTransfer) int64 {
+	if len(transfer.ResumeData) != 8 {
+		return 0
+	}
+	offset := int64(binary.LittleEndian.Uint64(transfer.ResumeData))
+	if offset < 0 || offset > transfer.Size {
+		return 0
+	}
+	return offset
+}
+
+// writeFileAt writes data at offset of an existing file
+func writeFileAt(path string, data []byte, offset int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(data, offset); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// fileChecksum is the hex SHA-256 of a file
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 // handleUploadEvent handles upload events
 func (manager *AdvancedFileTransferManager) handleUploadEvent(event *VirtualChannelEvent) error {
 	// This is a simplified implementation
@@ -992,18 +1574,41 @@ func (manager *AdvancedFileTransferManager) handleDownloadEvent(event *VirtualCh
 	return nil
 }
 
-// handleCancelEvent handles cancel events
-func (manager *AdvancedFileTransferManager) handleCancelEvent(event *VirtualChannelEvent) error {
-	// This is a simplified implementation
-	// In a real implementation, this would handle cancel events
-	return nil
+// handleCancelEvent cancels the transfer in the event data and returns the
+// message telling the peer
+func (manager *AdvancedFileTransferManager) handleCancelEvent(event *VirtualChannelEvent) ([]byte, error) {
+	transfer, err := manager.lookupTransfer(event.Data)
+	if err != nil {
+		return nil, err
+	}
+	if err := manager.cancelTransfer(transfer); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"action":      "cancel",
+		"transfer_id": transfer.ID,
+		"offset":      transfer.Transferred,
+	})
 }
 
-// handleResumeEvent handles resume events
-func (manager *AdvancedFileTransferManager) handleResumeEvent(event *VirtualChannelEvent) error {
-	// This is a simplified implementation
-	// In a real implementation, this would handle resume events
-	return nil
+// handleResumeEvent resumes the transfer in the event data and returns the
+// message telling the peer the offset to continue from
+func (manager *AdvancedFileTransferManager) handleResumeEvent(event *VirtualChannelEvent) ([]byte, error) {
+	transfer, err := manager.lookupTransfer(event.Data)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := manager.resumeTransfer(transfer)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"action":      "resume",
+		"transfer_id": transfer.ID,
+		"offset":      offset,
+	})
 }
 
 // ============================================================================
@@ -0,0 +1,277 @@
+package virtualchannel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// transferMessage is any message of the file transfer channel
+type transferMessage struct {
+	Status     string `json:"status"`
+	Error      string `json:"error"`
+	Action     string `json:"action"`
+	TransferID string `json:"transfer_id"`
+	Offset     int64  `json:"offset"`
+	Data       []byte `json:"data"`
+	Checksum   string `json:"checksum"`
+}
+
+// newTestFileTransfer returns a manager on an open channel writing its
+// messages to the returned channel
+func newTestFileTransfer(t *testing.T) (*AdvancedFileTransferManager, chan transferMessage) {
+	manager := NewAdvancedFileTransferManager()
+	manager.SetDirectory(t.TempDir())
+	manager.chunkSize = 16
+	messages := make(chan transferMessage, 64)
+	manager.SetTransport(func(channelId uint32, data []byte) error {
+		assert.Equal(t, uint32(7), channelId)
+		msg := transferMessage{}
+		require.NoError(t, json.Unmarshal(data, &msg))
+		messages <- msg
+		return nil
+	})
+	require.NoError(t, manager.OnChannelCreated(7, FileTransferChannelName))
+	return manager, messages
+}
+
+func receiveMessage(t *testing.T, messages chan transferMessage) transferMessage {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message")
+		return transferMessage{}
+	}
+}
+
+func sendMessage(t *testing.T, manager *AdvancedFileTransferManager, msg map[string]interface{}) error {
+	t.Helper()
+	data, err := json.Marshal(msg)
+	require.NoError(t, err)
+	return manager.OnDataReceived(7, data)
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFileTransferUpload(t *testing.T) {
+	manager, messages := newTestFileTransfer(t)
+	content := bytes.Repeat([]byte("0123456789"), 5)
+
+	require.NoError(t, sendMessage(t, manager, map[string]interface{}{
+		"action": "upload", "filename": "file.txt", "size": len(content), "checksum": checksum(content),
+	}))
+	response := receiveMessage(t, messages)
+	require.Equal(t, "success", response.Status)
+	id := response.TransferID
+
+	for offset := 0; offset < len(content); offset += 20 {
+		end := min(offset+20, len(content))
+		require.NoError(t, sendMessage(t, manager, map[string]interface{}{
+			"action": "chunk", "transfer_id": id, "offset": offset, "data": content[offset:end],
+		}))
+		transfer, ok := manager.GetTransfer(id)
+		require.True(t, ok)
+		assert.Equal(t, int64(end), transfer.Transferred)
+	}
+
+	response = receiveMessage(t, messages)
+	assert.Equal(t, "complete", response.Action)
+	assert.Equal(t, checksum(content), response.Checksum)
+	transfer, _ := manager.GetTransfer(id)
+	assert.Equal(t, TransferStatusCompleted, transfer.Status)
+	assert.Equal(t, 100.0, transfer.Progress)
+	written, err := os.ReadFile(filepath.Join(manager.directory, "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, content, written)
+	assert.Empty(t, messages)
+}
+
+func TestFileTransferUploadChecksum(t *testing.T) {
+	manager, messages := newTestFileTransfer(t)
+
+	require.NoError(t, sendMessage(t, manager, map[string]interface{}{
+		"action": "upload", "filename": "file.txt", "size": 4, "checksum": checksum([]byte("good")),
+	}))
+	id := receiveMessage(t, messages).TransferID
+
+	err := sendMessage(t, manager, map[string]interface{}{
+		"action": "chunk", "transfer_id": id, "offset": 0, "data": []byte("evil"),
+	})
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	response := receiveMessage(t, messages)
+	assert.Equal(t, "error", response.Status)
+	transfer, _ := manager.GetTransfer(id)
+	assert.Equal(t, TransferStatusFailed, transfer.Status)
+	assert.Zero(t, resumeOffset(&transfer))
+
+	// a gap in the chunks
+	_, err = manager.resumeTransfer(manager.transfers[id])
+	require.NoError(t, err)
+	assert.Error(t, sendMessage(t, manager, map[string]interface{}{
+		"action": "chunk", "transfer_id": id, "offset": 2, "data": []byte("od"),
+	}))
+	receiveMessage(t, messages)
+
+	// names leaving the directory
+	assert.Error(t, sendMessage(t, manager, map[string]interface{}{
+		"action": "upload", "filename": "../file.txt", "size": 4, "checksum": checksum([]byte("good")),
+	}))
+}
+
+// TestFileTransferUploadExisting checks that an upload does not overwrite a
+// file of the directory
+func TestFileTransferUploadExisting(t *testing.T) {
+	manager, messages := newTestFileTransfer(t)
+	path := filepath.Join(manager.directory, "file.txt")
+	require.NoError(t, os.WriteFile(path, []byte("kept"), 0644))
+
+	err := sendMessage(t, manager, map[string]interface{}{
+		"action": "upload", "filename": "file.txt", "size": 4, "checksum": checksum([]byte("evil")),
+	})
+	assert.ErrorIs(t, err, os.ErrExist)
+	assert.Equal(t, "error", receiveMessage(t, messages).Status)
+	assert.Empty(t, manager.transfers)
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("kept"), content)
+}
+
+func TestFileTransferDownload(t *testing.T) {
+	manager, messages := newTestFileTransfer(t)
+	content := bytes.Repeat([]byte("abcdefg"), 10)
+	require.NoError(t, os.WriteFile(filepath.Join(manager.directory, "file.bin"), content, 0644))
+
+	require.NoError(t, sendMessage(t, manager, map[string]interface{}{
+		"action": "download", "filename": "file.bin",
+	}))
+	response := receiveMessage(t, messages)
+	require.Equal(t, "download", response.Action)
+	assert.Equal(t, checksum(content), response.Checksum)
+
+	received := []byte{}
+	for {
+		msg := receiveMessage(t, messages)
+		assert.Equal(t, response.TransferID, msg.TransferID)
+		if msg.Action == "complete" {
+			assert.Equal(t, checksum(content), msg.Checksum)
+			break
+		}
+		require.Equal(t, "chunk", msg.Action)
+		require.Equal(t, int64(len(received)), msg.Offset)
+		received = append(received, msg.Data...)
+	}
+	assert.Equal(t, content, received)
+
+	require.Eventually(t, func() bool {
+		transfer, _ := manager.GetTransfer(response.TransferID)
+		return transfer.Status == TransferStatusCompleted
+	}, 5*time.Second, 10*time.Millisecond)
+	transfer, _ := manager.GetTransfer(response.TransferID)
+	assert.Equal(t, int64(len(content)), transfer.Transferred)
+}
+
+func TestFileTransferCancelResume(t *testing.T) {
+	manager, messages := newTestFileTransfer(t)
+	content := bytes.Repeat([]byte("xyz"), 30)
+	require.NoError(t, os.WriteFile(filepath.Join(manager.directory, "file.bin"), content, 0644))
+
+	// hold the first chunk on the wire until the transfer is cancelled
+	held, release := make(chan struct{}), make(chan struct{})
+	send := manager.send
+	manager.SetTransport(func(channelId uint32, data []byte) error {
+		msg := transferMessage{}
+		require.NoError(t, json.Unmarshal(data, &msg))
+		if msg.Action == "chunk" && msg.Offset == 0 {
+			close(held)
+			<-release
+		}
+		return send(channelId, data)
+	})
+
+	require.NoError(t, sendMessage(t, manager, map[string]interface{}{
+		"action": "download", "filename": "file.bin",
+	}))
+	id := receiveMessage(t, messages).TransferID
+	<-held
+
+	response, err := manager.HandleData([]byte(`{"action":"cancel","transfer_id":"` + id + `"}`))
+	require.NoError(t, err)
+	assert.Contains(t, string(response), `"cancel"`)
+	close(release)
+	assert.Equal(t, "chunk", receiveMessage(t, messages).Action)
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, messages, "chunks sent after cancel")
+
+	transfer, _ := manager.GetTransfer(id)
+	assert.Equal(t, TransferStatusCancelled, transfer.Status)
+	assert.Zero(t, resumeOffset(&transfer))
+
+	// resume from an offset in ResumeData
+	manager.mutex.Lock()
+	manager.transfers[id].ResumeData = encodeResumeOffset(32)
+	manager.mutex.Unlock()
+	require.NoError(t, manager.HandleEvent(&VirtualChannelEvent{Type: "resume", Data: map[string]interface{}{"transfer_id": id}}))
+	notice := receiveMessage(t, messages)
+	assert.Equal(t, "resume", notice.Action)
+	assert.Equal(t, int64(32), notice.Offset)
+
+	received := bytes.Clone(content[:32])
+	for {
+		msg := receiveMessage(t, messages)
+		if msg.Action == "complete" {
+			break
+		}
+		require.Equal(t, int64(len(received)), msg.Offset)
+		received = append(received, msg.Data...)
+	}
+	assert.Equal(t, content, received)
+	require.Eventually(t, func() bool {
+		transfer, _ := manager.GetTransfer(id)
+		return transfer.Status == TransferStatusCompleted
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// finished transfers cannot be cancelled
+	assert.Error(t, manager.HandleEvent(&VirtualChannelEvent{Type: "cancel", Data: map[string]interface{}{"transfer_id": id}}))
+}
+
+func TestFileTransferWithoutTransport(t *testing.T) {
+	manager := NewAdvancedVirtualChannelManager().FileTransferManager()
+	_, err := manager.HandleData([]byte(`{"action":"download","filename":"file.txt"}`))
+	assert.ErrorIs(t, err, ErrFileTransferChannelNotOpen)
+}
+
+func TestClipboardEncryptionKey(t *testing.T) {
+	manager := NewAdvancedClipboardManager()
+	copied, err := manager.HandleData([]byte(`{"action":"copy","format":"text","data":"` + base64.StdEncoding.EncodeToString([]byte("secret")) + `"}`))
+	require.NoError(t, err)
+	assert.Contains(t, string(copied), `"success"`)
+	assert.NotContains(t, string(manager.formats["text"]), "secret")
+
+	// data stored with the previous key is still pasted
+	require.NoError(t, manager.SetEncryptionKey(bytes.Repeat([]byte{1}, 16)))
+	pasted, err := manager.HandleData([]byte(`{"action":"paste","format":"text"}`))
+	require.NoError(t, err)
+	assert.Contains(t, string(pasted), base64.StdEncoding.EncodeToString([]byte("secret")))
+	assert.Error(t, manager.SetEncryptionKey([]byte("short")))
+
+	// each session has its own key
+	first, second := NewAdvancedVirtualChannelManager(), NewAdvancedVirtualChannelManager()
+	assert.Empty(t, first.config.EncryptionKey)
+	assert.Len(t, first.encryptionKey, 32)
+	assert.Equal(t, first.encryptionKey, first.clipboardManager.encryptionKey)
+	assert.NotEqual(t, first.encryptionKey, second.encryptionKey)
+}
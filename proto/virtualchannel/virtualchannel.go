@@ -2,32 +2,99 @@ package virtualchannel
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/kdsmith18542/gordp/core"
 	"github.com/kdsmith18542/gordp/glog"
 )
 
+// DefaultMaxMessageSize is the largest reassembled message accepted on
+// channels that don't set MaxMessageSize
+var DefaultMaxMessageSize uint32 = 16 * 1024 * 1024
+
+// ErrMessageTooLarge is returned when a channel message announces a total
+// length above the channel's limit
+var ErrMessageTooLarge = errors.New("virtual channel message too large")
+
 // VirtualChannel represents a virtual channel in RDP
 type VirtualChannel struct {
 	ID       uint16
 	Name     string
 	Priority uint8
 	Flags    uint32
+
+	// MaxMessageSize bounds reassembled messages, 0 uses DefaultMaxMessageSize
+	MaxMessageSize uint32
 }
 
 // VirtualChannelManager manages virtual channels
 type VirtualChannelManager struct {
 	channels map[uint16]*VirtualChannel
+	pending  map[uint16]*pendingMessage
+	stats    map[uint16]*ChannelStats
 	mutex    sync.RWMutex
 }
 
+// ChannelStats is what a channel carried, see VirtualChannelManager.Stats
+type ChannelStats struct {
+	BytesSent     uint64 // channel data, without channel headers
+	BytesReceived uint64
+
+	// MessagesSent counts the data sent, MessagesReceived the messages
+	// received, whole once reassembled from their chunks
+	MessagesSent     uint64
+	MessagesReceived uint64
+
+	// Errors counts the messages dropped as malformed or too large, and
+	// those their handler failed on
+	Errors uint64
+
+	Since        time.Time // when counting started
+	LastActivity time.Time // zero before anything was carried
+}
+
+// Throughput returns the bytes carried both ways per second from Since
+// to now
+func (s ChannelStats) Throughput(now time.Time) float64 {
+	elapsed := now.Sub(s.Since).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(s.BytesSent+s.BytesReceived) / elapsed
+}
+
+// Sent counts a message of n bytes sent
+func (s *ChannelStats) Sent(n int) {
+	s.BytesSent += uint64(n)
+	s.MessagesSent++
+	s.LastActivity = time.Now()
+}
+
+// Received counts n bytes received, and a message when complete is set
+func (s *ChannelStats) Received(n int, complete bool) {
+	s.BytesReceived += uint64(n)
+	if complete {
+		s.MessagesReceived++
+	}
+	s.LastActivity = time.Now()
+}
+
+// pendingMessage is a channel message whose last chunk has not arrived yet
+type pendingMessage struct {
+	length uint32
+	data   []byte
+}
+
 // NewVirtualChannelManager creates a new virtual channel manager
 func NewVirtualChannelManager() *VirtualChannelManager {
 	return &VirtualChannelManager{
 		channels: make(map[uint16]*VirtualChannel),
+		pending:  make(map[uint16]*pendingMessage),
+		stats:    make(map[uint16]*ChannelStats),
 	}
 }
 
@@ -41,6 +108,7 @@ func (m *VirtualChannelManager) RegisterChannel(channel *VirtualChannel) error {
 	}
 
 	m.channels[channel.ID] = channel
+	m.stats[channel.ID] = &ChannelStats{Since: time.Now()}
 	glog.Debugf("Registered virtual channel: %s (ID: %d)", channel.Name, channel.ID)
 	return nil
 }
@@ -78,6 +146,126 @@ func (m *VirtualChannelManager) ListChannels() []*VirtualChannel {
 	return channels
 }
 
+// SetMaxMessageSize changes the reassembly limit of a channel, 0 restores
+// DefaultMaxMessageSize
+func (m *VirtualChannelManager) SetMaxMessageSize(id uint16, size uint32) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	channel, exists := m.channels[id]
+	if !exists {
+		return fmt.Errorf("unknown virtual channel ID: %d", id)
+	}
+	channel.MaxMessageSize = size
+	return nil
+}
+
+// Reassemble collects the chunks of a channel message. The Length of every
+// packet is the total length of the message, as in CHANNEL_PDU_HEADER. The
+// chunk flagged CHANNEL_FLAG_FIRST starts a message and the one flagged
+// CHANNEL_FLAG_LAST completes it; the whole message is returned then, nil
+// before. A message announcing more than the channel's MaxMessageSize is
+// dropped with ErrMessageTooLarge before anything is buffered.
+func (m *VirtualChannelManager) Reassemble(packet *VirtualChannelPacket) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	channel, exists := m.channels[packet.ChannelID]
+	if !exists {
+		return nil, fmt.Errorf("unknown virtual channel ID: %d", packet.ChannelID)
+	}
+	message, err := m.reassemble(channel, packet)
+	stats := m.stats[channel.ID]
+	stats.Received(len(packet.Data), message != nil)
+	if err != nil {
+		stats.Errors++
+	}
+	return message, err
+}
+
+// reassemble adds the chunk of packet to the message being received on
+// channel
+func (m *VirtualChannelManager) reassemble(channel *VirtualChannel, packet *VirtualChannelPacket) ([]byte, error) {
+	limit := channel.MaxMessageSize
+	if limit == 0 {
+		limit = DefaultMaxMessageSize
+	}
+
+	if packet.Flags&CHANNEL_FLAG_FIRST != 0 {
+		if _, busy := m.pending[channel.ID]; busy {
+			glog.Warnf("virtual channel %s: incomplete message discarded", channel.Name)
+			delete(m.pending, channel.ID)
+		}
+		if packet.Length > limit {
+			glog.Warnf("virtual channel %s: message of %d bytes exceeds limit of %d bytes, dropped",
+				channel.Name, packet.Length, limit)
+			return nil, fmt.Errorf("%w: %s announced %d bytes, limit %d", ErrMessageTooLarge, channel.Name, packet.Length, limit)
+		}
+		m.pending[channel.ID] = &pendingMessage{length: packet.Length}
+	}
+
+	msg, exists := m.pending[channel.ID]
+	if !exists {
+		return nil, fmt.Errorf("virtual channel %s: chunk without a first chunk", channel.Name)
+	}
+	if uint64(len(msg.data))+uint64(len(packet.Data)) > uint64(msg.length) {
+		delete(m.pending, channel.ID)
+		return nil, fmt.Errorf("virtual channel %s: chunks exceed announced length %d", channel.Name, msg.length)
+	}
+	msg.data = append(msg.data, packet.Data...)
+	if packet.Flags&CHANNEL_FLAG_LAST == 0 {
+		return nil, nil
+	}
+
+	delete(m.pending, channel.ID)
+	if uint32(len(msg.data)) != msg.length {
+		return nil, fmt.Errorf("virtual channel %s: got %d of %d bytes", channel.Name, len(msg.data), msg.length)
+	}
+	return msg.data, nil
+}
+
+// CountSent counts a message of n bytes sent on channel id
+func (m *VirtualChannelManager) CountSent(id uint16, n int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if stats, ok := m.stats[id]; ok {
+		stats.Sent(n)
+	}
+}
+
+// CountError counts a message received on channel id that its handler
+// failed on
+func (m *VirtualChannelManager) CountError(id uint16) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if stats, ok := m.stats[id]; ok {
+		stats.Errors++
+	}
+}
+
+// Stats returns what each registered channel carried, by channel name
+func (m *VirtualChannelManager) Stats() map[string]ChannelStats {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	stats := make(map[string]ChannelStats, len(m.channels))
+	for id, channel := range m.channels {
+		if channel.ID != id {
+			continue // registered again under the id of a new connection
+		}
+		stats[channel.Name] = *m.stats[id]
+	}
+	return stats
+}
+
+// ResetStats starts counting over on every channel
+func (m *VirtualChannelManager) ResetStats() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id := range m.stats {
+		m.stats[id] = &ChannelStats{Since: time.Now()}
+	}
+}
+
 // VirtualChannelData represents data sent over a virtual channel
 type VirtualChannelData struct {
 	ChannelID uint16
@@ -131,7 +319,8 @@ func (h *DefaultVirtualChannelHandler) OnChannelClose(channelID uint16) error {
 	return nil
 }
 
-// VirtualChannelPacket represents a virtual channel packet header
+// VirtualChannelPacket represents a virtual channel packet header. Length
+// is the total length of the message, Data the chunk carried by this packet.
 type VirtualChannelPacket struct {
 	Length    uint32
 	Flags     uint32
@@ -139,29 +328,28 @@ type VirtualChannelPacket struct {
 	Data      []byte
 }
 
-// ReadVirtualChannelPacket reads a virtual channel packet from the stream
+// ReadVirtualChannelPacket reads a virtual channel packet from the stream.
+// The chunk is whatever follows the header, up to Length bytes; Length comes
+// from the peer, so nothing is allocated from it up front.
 func ReadVirtualChannelPacket(r io.Reader) (*VirtualChannelPacket, error) {
 	packet := &VirtualChannelPacket{}
 
 	// Read packet header
-	if err := core.ReadLE(r, &packet.Length); err != nil {
-		return nil, fmt.Errorf("failed to read packet length: %v", err)
-	}
-
-	if err := core.ReadLE(r, &packet.Flags); err != nil {
-		return nil, fmt.Errorf("failed to read packet flags: %v", err)
-	}
-
-	if err := core.ReadLE(r, &packet.ChannelID); err != nil {
-		return nil, fmt.Errorf("failed to read channel ID: %v", err)
+	if err := core.Try(func() {
+		core.ReadLE(r, &packet.Length)
+		core.ReadLE(r, &packet.Flags)
+		core.ReadLE(r, &packet.ChannelID)
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read packet header: %w", err)
 	}
 
 	// Read packet data
-	if packet.Length > 0 {
-		packet.Data = make([]byte, packet.Length)
-		if _, err := io.ReadFull(r, packet.Data); err != nil {
-			return nil, fmt.Errorf("failed to read packet data: %w", err)
-		}
+	data, err := io.ReadAll(io.LimitReader(r, int64(packet.Length)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read packet data: %w", err)
+	}
+	if len(data) > 0 {
+		packet.Data = data
 	}
 
 	return packet, nil
@@ -179,6 +367,11 @@ func (p *VirtualChannelPacket) Serialize() []byte {
 	return buf.Bytes()
 }
 
+// CHANNEL_CHUNK_LENGTH is the size of the chunks channel data is sent in
+// when the peer announced none
+// See [MS-RDPBCGR] 2.2.7.1.10
+const CHANNEL_CHUNK_LENGTH = 1600
+
 // VirtualChannelFlags
 const (
 	CHANNEL_FLAG_FIRST             = 0x00000001
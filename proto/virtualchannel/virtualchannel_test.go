@@ -0,0 +1,124 @@
+package virtualchannel
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestManager(t *testing.T) *VirtualChannelManager {
+	m := NewVirtualChannelManager()
+	require.NoError(t, m.RegisterChannel(&VirtualChannel{ID: 1, Name: CHANNEL_NAME_CLIPRDR}))
+	return m
+}
+
+func TestReassemble(t *testing.T) {
+	m := newTestManager(t)
+
+	data, err := m.Reassemble(&VirtualChannelPacket{Length: 6, Flags: CHANNEL_FLAG_FIRST, ChannelID: 1, Data: []byte("abc")})
+	require.NoError(t, err)
+	assert.Nil(t, data)
+	data, err = m.Reassemble(&VirtualChannelPacket{Length: 6, ChannelID: 1, Data: []byte("de")})
+	require.NoError(t, err)
+	assert.Nil(t, data)
+	data, err = m.Reassemble(&VirtualChannelPacket{Length: 6, Flags: CHANNEL_FLAG_LAST, ChannelID: 1, Data: []byte("f")})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("abcdef"), data)
+
+	// single chunk message
+	data, err = m.Reassemble(&VirtualChannelPacket{Length: 2, Flags: CHANNEL_FLAG_FIRST | CHANNEL_FLAG_LAST, ChannelID: 1, Data: []byte("xy")})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("xy"), data)
+
+	// chunks may not outgrow the announced length
+	_, err = m.Reassemble(&VirtualChannelPacket{Length: 2, Flags: CHANNEL_FLAG_FIRST, ChannelID: 1, Data: []byte("xyz")})
+	assert.Error(t, err)
+
+	// a continuation without a first chunk is rejected
+	_, err = m.Reassemble(&VirtualChannelPacket{Length: 2, Flags: CHANNEL_FLAG_LAST, ChannelID: 1, Data: []byte("xy")})
+	assert.Error(t, err)
+}
+
+func TestReassembleMaxMessageSize(t *testing.T) {
+	m := newTestManager(t)
+
+	// a header claiming a huge total length is dropped before buffering
+	wire := new(bytes.Buffer)
+	core.WriteLE(wire, uint32(0xFFFFFFFF))
+	core.WriteLE(wire, uint32(CHANNEL_FLAG_FIRST))
+	core.WriteLE(wire, uint16(1))
+	wire.WriteString("chunk")
+	packet, err := ReadVirtualChannelPacket(wire)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("chunk"), packet.Data)
+
+	_, err = m.Reassemble(packet)
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+	assert.Empty(t, m.pending)
+
+	// the rest of the dropped message is not accepted either
+	_, err = m.Reassemble(&VirtualChannelPacket{Length: 0xFFFFFFFF, Flags: CHANNEL_FLAG_LAST, ChannelID: 1, Data: []byte("more")})
+	assert.Error(t, err)
+
+	// per-channel limit overrides the default
+	require.NoError(t, m.SetMaxMessageSize(1, 4))
+	_, err = m.Reassemble(&VirtualChannelPacket{Length: 5, Flags: CHANNEL_FLAG_FIRST | CHANNEL_FLAG_LAST, ChannelID: 1, Data: []byte("12345")})
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+	data, err := m.Reassemble(&VirtualChannelPacket{Length: 4, Flags: CHANNEL_FLAG_FIRST | CHANNEL_FLAG_LAST, ChannelID: 1, Data: []byte("1234")})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1234"), data)
+
+	// and the global default applies when unset
+	require.NoError(t, m.SetMaxMessageSize(1, 0))
+	limit := DefaultMaxMessageSize
+	DefaultMaxMessageSize = 3
+	defer func() { DefaultMaxMessageSize = limit }()
+	_, err = m.Reassemble(&VirtualChannelPacket{Length: 4, Flags: CHANNEL_FLAG_FIRST | CHANNEL_FLAG_LAST, ChannelID: 1, Data: []byte("1234")})
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+}
+
+func TestStats(t *testing.T) {
+	m := newTestManager(t)
+	require.NoError(t, m.RegisterChannel(&VirtualChannel{ID: 2, Name: CHANNEL_NAME_RDPDR}))
+
+	_, err := m.Reassemble(&VirtualChannelPacket{Length: 5, Flags: CHANNEL_FLAG_FIRST, ChannelID: 1, Data: []byte("abc")})
+	require.NoError(t, err)
+	_, err = m.Reassemble(&VirtualChannelPacket{Length: 5, Flags: CHANNEL_FLAG_LAST, ChannelID: 1, Data: []byte("de")})
+	require.NoError(t, err)
+	_, err = m.Reassemble(&VirtualChannelPacket{Length: 2, Flags: CHANNEL_FLAG_LAST, ChannelID: 1, Data: []byte("xy")})
+	assert.Error(t, err)
+	m.CountSent(1, 10)
+	m.CountError(2)
+
+	stats := m.Stats()
+	require.Len(t, stats, 2)
+	cliprdr := stats[CHANNEL_NAME_CLIPRDR]
+	assert.Equal(t, uint64(7), cliprdr.BytesReceived)
+	assert.Equal(t, uint64(1), cliprdr.MessagesReceived)
+	assert.Equal(t, uint64(10), cliprdr.BytesSent)
+	assert.Equal(t, uint64(1), cliprdr.MessagesSent)
+	assert.Equal(t, uint64(1), cliprdr.Errors)
+	assert.InDelta(t, 17.0, cliprdr.Throughput(cliprdr.Since.Add(time.Second)), 0.001)
+	assert.Equal(t, uint64(1), stats[CHANNEL_NAME_RDPDR].Errors)
+	assert.True(t, stats[CHANNEL_NAME_RDPDR].LastActivity.IsZero())
+
+	m.ResetStats()
+	assert.Zero(t, m.Stats()[CHANNEL_NAME_CLIPRDR].BytesReceived)
+
+	// unknown channels are not counted
+	m.CountSent(9, 1)
+	m.CountError(9)
+	_, err = m.Reassemble(&VirtualChannelPacket{Length: 1, Flags: CHANNEL_FLAG_FIRST | CHANNEL_FLAG_LAST, ChannelID: 9, Data: []byte("x")})
+	assert.Error(t, err)
+	assert.Len(t, m.Stats(), 2)
+}
+
+func TestThroughput(t *testing.T) {
+	stats := ChannelStats{BytesSent: 100, BytesReceived: 300, Since: time.Now()}
+	assert.InDelta(t, 200.0, stats.Throughput(stats.Since.Add(2*time.Second)), 0.001)
+	assert.Zero(t, stats.Throughput(stats.Since))
+}
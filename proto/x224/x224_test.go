@@ -100,3 +100,19 @@ func BenchmarkWriteX224Header(b *testing.B) {
 		header.Write(&buf)
 	}
 }
+
+// FuzzRead checks that no packet makes Read or ReadConfirm fail other
+// than by throwing
+func FuzzRead(f *testing.F) {
+	data := new(bytes.Buffer)
+	Write(data, []byte{0x7F, 0x65})
+	f.Add(data.Bytes())
+	confirm := new(bytes.Buffer)
+	Connect(confirm, TPDU_CONNECTION_CONFIRM, []byte{0x02, 0x00, 0x08, 0x00, 0x01, 0x00, 0x00, 0x00})
+	f.Add(confirm.Bytes())
+	f.Add([]byte{0x03, 0x00, 0x00, 0x07, 0x02, 0xF0, 0x80})
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		_ = core.TryRead(func() { Read(bytes.NewReader(packet)) })
+		_ = core.TryRead(func() { ReadConfirm(bytes.NewReader(packet)) })
+	})
+}
@@ -0,0 +1,260 @@
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"time"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/proto/bitmap"
+	"github.com/kdsmith18542/gordp/proto/mcs"
+)
+
+// ErrNoFrame is returned when stepping past either end of a recording
+var ErrNoFrame = errors.New("no such frame")
+
+// frameIndex locates a frame in the recording
+type frameIndex struct {
+	offset   int64 // of its frameHeader
+	keyframe bool
+	time     time.Duration
+
+	// the last frames at or before this one giving the pointer shape and
+	// moving the pointer, -1 for none
+	pointer int
+	moved   int
+}
+
+// Player reconstructs the screen and the pointer of a recording frame by
+// frame. Seeking replays from the nearest keyframe at or before the target
+// frame.
+type Player struct {
+	r      io.ReadSeeker
+	width  int
+	height int
+	frames []frameIndex
+
+	fb      *bitmap.Framebuffer
+	pointer bitmap.Pointer
+	pos     int // frame shown, -1 before the first
+}
+
+// NewPlayer indexes the recording read from r and positions the player
+// before its first frame
+func NewPlayer(r io.ReadSeeker) (*Player, error) {
+	p := &Player{r: r, pos: -1}
+	err := core.Try(func() {
+		header := readFileHeader(r)
+		p.width, p.height = int(header.Width), int(header.Height)
+		p.index()
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.fb = bitmap.NewFramebuffer(p.width, p.height)
+	return p, nil
+}
+
+// index records where each frame starts, skipping over the pixels
+func (p *Player) index() {
+	pointer, moved := -1, -1
+	for {
+		offset, err := p.r.Seek(0, io.SeekCurrent)
+		core.ThrowError(err)
+		var header frameHeader
+		if err := core.Try(func() { core.ReadLE(p.r, &header) }); err != nil {
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			core.ThrowError(err)
+		}
+		checkFrame(&header, p.width, p.height)
+		switch header.Kind {
+		case framePointer, framePointerHidden:
+			pointer = len(p.frames)
+		case framePointerMoved:
+			moved = len(p.frames)
+		}
+		p.frames = append(p.frames, frameIndex{
+			offset:   offset,
+			keyframe: header.Kind == frameKeyframe,
+			time:     time.Duration(header.Time),
+			pointer:  pointer,
+			moved:    moved,
+		})
+		_, err = p.r.Seek(int64(header.Width)*int64(header.Height)*4, io.SeekCurrent)
+		core.ThrowError(err)
+	}
+}
+
+// FrameCount returns the number of frames in the recording
+func (p *Player) FrameCount() int {
+	return len(p.frames)
+}
+
+// Frame returns the index of the frame shown, -1 before the first
+func (p *Player) Frame() int {
+	return p.pos
+}
+
+// Time returns when the frame shown was recorded, relative to the start
+func (p *Player) Time() time.Duration {
+	if p.pos < 0 {
+		return 0
+	}
+	return p.frames[p.pos].time
+}
+
+// Image returns a copy of the screen at the frame shown
+func (p *Player) Image() image.Image {
+	return p.fb.Snapshot()
+}
+
+// Pointer returns the pointer at the frame shown, the default pointer at
+// 0, 0 before the recording changed it. Its Image is not to be modified.
+func (p *Player) Pointer() bitmap.Pointer {
+	return p.pointer
+}
+
+// StepForward shows the next frame
+func (p *Player) StepForward() error {
+	if p.pos+1 >= len(p.frames) {
+		return ErrNoFrame
+	}
+	return core.Try(func() { p.apply(p.pos + 1) })
+}
+
+// StepBackward shows the previous frame
+func (p *Player) StepBackward() error {
+	if p.pos <= 0 {
+		return ErrNoFrame
+	}
+	return p.SeekToFrame(p.pos - 1)
+}
+
+// SeekToFrame shows frame n, counting from 0
+func (p *Player) SeekToFrame(n int) error {
+	if n < 0 || n >= len(p.frames) {
+		return fmt.Errorf("%w: %d of %d", ErrNoFrame, n, len(p.frames))
+	}
+	from := 0
+	for i := n; i >= 0; i-- {
+		if p.frames[i].keyframe {
+			from = i
+			break
+		}
+	}
+	// play on from the frame shown when no keyframe lies in between
+	restart := true
+	if p.pos >= from && p.pos <= n {
+		from, restart = p.pos+1, false
+	} else if !p.frames[from].keyframe {
+		p.fb = bitmap.NewFramebuffer(p.width, p.height)
+	}
+	return core.Try(func() {
+		// keyframes leave the pointer out, it is as the frames before left it
+		if restart {
+			p.pointer = bitmap.Pointer{}
+			if from > 0 {
+				for _, i := range []int{p.frames[from-1].pointer, p.frames[from-1].moved} {
+					if i >= 0 {
+						p.apply(i)
+					}
+				}
+			}
+		}
+		for i := from; i <= n; i++ {
+			p.apply(i)
+		}
+	})
+}
+
+// apply paints frame i over the screen, or applies it to the pointer
+func (p *Player) apply(i int) {
+	_, err := p.r.Seek(p.frames[i].offset, io.SeekStart)
+	core.ThrowError(err)
+	var header frameHeader
+	core.ReadLE(p.r, &header)
+	if isPointerFrame(&header) {
+		readPointer(p.r, &header, &p.pointer)
+	} else {
+		p.fb.ApplyUpdate(readFrame(p.r, &header, p.width, p.height))
+	}
+	p.pos = i
+}
+
+// readFileHeader reads the start of a recording, up to its first frame
+func readFileHeader(r io.Reader) *fileHeader {
+	var m [8]byte
+	core.ReadFull(r, m[:])
+	if m != magic {
+		core.ThrowError(ErrFormat)
+	}
+	header := core.ReadLE(r, &fileHeader{})
+	if header.Width > mcs.MaxDesktopSize || header.Height > mcs.MaxDesktopSize {
+		core.ThrowError(fmt.Errorf("%w: screen of %dx%d", ErrFormat, header.Width, header.Height))
+	}
+	return header
+}
+
+// checkFrame throws ErrFormat for a frame larger than a screen of width x
+// height, than a pointer shape for pointer frames, or with pixels for the
+// frames that have none
+func checkFrame(header *frameHeader, width, height int) {
+	switch header.Kind {
+	case frameUpdate, frameKeyframe:
+	case framePointer:
+		width, height = maxPointerSize, maxPointerSize
+	default:
+		width, height = 0, 0
+	}
+	if int64(header.Width) > int64(width) || int64(header.Height) > int64(height) {
+		core.ThrowError(fmt.Errorf("%w: frame of %dx%d", ErrFormat, header.Width, header.Height))
+	}
+}
+
+// isPointerFrame reports whether the frame of header is of the pointer
+// rather than of the screen
+func isPointerFrame(header *frameHeader) bool {
+	return header.Kind != frameUpdate && header.Kind != frameKeyframe
+}
+
+// readPointer reads the pointer frame of header and applies it to pointer
+func readPointer(r io.Reader, header *frameHeader, pointer *bitmap.Pointer) {
+	switch header.Kind {
+	case framePointer:
+		_, bmp := readFrame(r, header, maxPointerSize, maxPointerSize)
+		*pointer = bitmap.Pointer{Position: pointer.Position}
+		if header.Width != 0 && header.Height != 0 {
+			pointer.Image = bmp.Image.(*image.RGBA)
+			pointer.HotSpot = image.Pt(int(header.Left), int(header.Top))
+		}
+	case framePointerHidden:
+		checkFrame(header, 0, 0)
+		*pointer = bitmap.Pointer{Position: pointer.Position, Hidden: true}
+	case framePointerMoved:
+		checkFrame(header, 0, 0)
+		pointer.Position = image.Pt(int(header.Left), int(header.Top))
+	default:
+		checkFrame(header, 0, 0)
+	}
+}
+
+// readFrame reads the pixels of the frame of header, of a screen of width
+// x height at most, returning it as the update it paints
+func readFrame(r io.Reader, header *frameHeader, width, height int) (*bitmap.Option, *bitmap.BitMap) {
+	checkFrame(header, width, height)
+	img := &image.RGBA{
+		Pix:    core.ReadBytes(r, int(header.Width)*int(header.Height)*4),
+		Stride: int(header.Width) * 4,
+		Rect:   image.Rect(0, 0, int(header.Width), int(header.Height)),
+	}
+	return &bitmap.Option{
+		Left:   int(header.Left),
+		Top:    int(header.Top),
+		Width:  int(header.Width),
+		Height: int(header.Height),
+	}, &bitmap.BitMap{Image: img}
+}
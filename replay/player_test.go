@@ -0,0 +1,222 @@
+package replay
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+	"time"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/proto/bitmap"
+	"github.com/stretchr/testify/assert"
+)
+
+// record writes n overlapping updates of a 64x48 screen, each in its own
+// color
+func record(t *testing.T, n, keyframeInterval int) []byte {
+	buff := new(bytes.Buffer)
+	rec, err := NewRecorder(buff, 64, 48)
+	assert.NoError(t, err)
+	rec.KeyframeInterval = keyframeInterval
+	for i := 0; i < n; i++ {
+		img := image.NewRGBA(image.Rect(0, 0, 16, 12))
+		c := color.RGBA{R: uint8(i * 10), G: uint8(255 - i*7), B: uint8(i * 3), A: 0xFF}
+		draw.Draw(img, img.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+		rec.ProcessBitmap(&bitmap.Option{Left: i * 5 % 56, Top: i * 3 % 40, Width: 16, Height: 12}, &bitmap.BitMap{Image: img})
+	}
+	assert.NoError(t, rec.Close())
+	return buff.Bytes()
+}
+
+func TestPlayerSeek(t *testing.T) {
+	data := record(t, 25, 10)
+
+	linear, err := NewPlayer(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, 25, linear.FrameCount())
+	var images []image.Image
+	for linear.StepForward() == nil {
+		images = append(images, linear.Image())
+	}
+	assert.Len(t, images, 25)
+	assert.Equal(t, 24, linear.Frame())
+
+	p, err := NewPlayer(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, -1, p.Frame())
+	assert.NoError(t, p.SeekToFrame(17))
+	assert.Equal(t, 17, p.Frame())
+	assert.Equal(t, images[17], p.Image())
+
+	assert.NoError(t, p.StepBackward())
+	assert.Equal(t, images[16], p.Image())
+	assert.NoError(t, p.StepForward())
+	assert.Equal(t, images[17], p.Image())
+
+	// back past a keyframe and forward again
+	assert.NoError(t, p.SeekToFrame(3))
+	assert.Equal(t, images[3], p.Image())
+	assert.NoError(t, p.SeekToFrame(24))
+	assert.Equal(t, images[24], p.Image())
+
+	assert.ErrorIs(t, p.StepForward(), ErrNoFrame)
+	assert.ErrorIs(t, p.SeekToFrame(25), ErrNoFrame)
+	assert.NoError(t, p.SeekToFrame(0))
+	assert.ErrorIs(t, p.StepBackward(), ErrNoFrame)
+}
+
+func TestPlayerFormat(t *testing.T) {
+	_, err := NewPlayer(bytes.NewReader([]byte("not a recording")))
+	assert.ErrorIs(t, err, ErrFormat)
+
+	// sizes beyond the screen are refused before their pixels are read
+	buff := new(bytes.Buffer)
+	buff.Write(magic[:])
+	core.WriteLE(buff, &fileHeader{Width: 1 << 20, Height: 1 << 20})
+	_, err = NewPlayer(bytes.NewReader(buff.Bytes()))
+	assert.ErrorIs(t, err, ErrFormat)
+	assert.ErrorIs(t, Replay(bytes.NewReader(buff.Bytes()), &framebufferProcessor{}), ErrFormat)
+
+	for _, header := range []frameHeader{
+		{Kind: frameUpdate, Width: 65, Height: 1},
+		{Kind: framePointer, Width: maxPointerSize + 1, Height: 1},
+		{Kind: framePointerMoved, Width: 1, Height: 1},
+	} {
+		buff.Reset()
+		buff.Write(magic[:])
+		core.WriteLE(buff, &fileHeader{Width: 64, Height: 48})
+		core.WriteLE(buff, &header)
+		_, err = NewPlayer(bytes.NewReader(buff.Bytes()))
+		assert.ErrorIs(t, err, ErrFormat, header.Kind)
+		assert.ErrorIs(t, Replay(bytes.NewReader(buff.Bytes()), &framebufferProcessor{}), ErrFormat, header.Kind)
+	}
+}
+
+// recordPointer writes 25 updates, as record does, changing the pointer
+// along the way
+func recordPointer(t *testing.T, shape *image.RGBA) []byte {
+	buff := new(bytes.Buffer)
+	rec, err := NewRecorder(buff, 64, 48)
+	assert.NoError(t, err)
+	rec.KeyframeInterval = 10
+	img := image.NewRGBA(image.Rect(0, 0, 16, 12))
+	for i := 0; i < 25; i++ {
+		switch i {
+		case 2:
+			rec.ProcessPointer(&bitmap.Pointer{Image: shape, HotSpot: image.Pt(1, 2), Position: image.Pt(5, 6)})
+		case 13:
+			rec.ProcessPointer(&bitmap.Pointer{Image: shape, HotSpot: image.Pt(1, 2), Position: image.Pt(7, 8)})
+		case 21:
+			rec.ProcessPointer(&bitmap.Pointer{Hidden: true, Position: image.Pt(7, 8)})
+		}
+		rec.ProcessBitmap(&bitmap.Option{Width: 16, Height: 12}, &bitmap.BitMap{Image: img})
+	}
+	assert.NoError(t, rec.Close())
+	return buff.Bytes()
+}
+
+func TestPlayerPointer(t *testing.T) {
+	shape := image.NewRGBA(image.Rect(0, 0, 3, 4))
+	shape.Pix[0], shape.Pix[3] = 0xFF, 0xFF
+	p, err := NewPlayer(bytes.NewReader(recordPointer(t, shape)))
+	assert.NoError(t, err)
+	// the shape and the two moves, the hidden pointer
+	assert.Equal(t, 29, p.FrameCount())
+
+	assert.NoError(t, p.SeekToFrame(1))
+	assert.Equal(t, bitmap.Pointer{}, p.Pointer())
+
+	// past keyframes the pointer is as the frames before left it
+	moved := bitmap.Pointer{Image: shape, HotSpot: image.Pt(1, 2), Position: image.Pt(7, 8)}
+	assert.NoError(t, p.SeekToFrame(20))
+	assert.Equal(t, moved, p.Pointer())
+	assert.NoError(t, p.SeekToFrame(28))
+	assert.Equal(t, bitmap.Pointer{Hidden: true, Position: image.Pt(7, 8)}, p.Pointer())
+	assert.NoError(t, p.SeekToFrame(12))
+	assert.Equal(t, image.Pt(5, 6), p.Pointer().Position)
+	assert.Equal(t, shape, p.Pointer().Image)
+	assert.NoError(t, p.SeekToFrame(0))
+	assert.Equal(t, bitmap.Pointer{}, p.Pointer())
+}
+
+// pointerProcessor collects the pointers Replay plays
+type pointerProcessor struct {
+	framebufferProcessor
+	pointers []bitmap.Pointer
+}
+
+func (p *pointerProcessor) ProcessPointer(pointer *bitmap.Pointer) {
+	p.pointers = append(p.pointers, *pointer)
+}
+
+func TestReplayPointer(t *testing.T) {
+	shape := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	data := recordPointer(t, shape)
+	processor := &pointerProcessor{framebufferProcessor: framebufferProcessor{fb: bitmap.NewFramebuffer(64, 48)}}
+	assert.NoError(t, Replay(bytes.NewReader(data), processor))
+	assert.Equal(t, 25, processor.updates)
+	assert.Equal(t, []bitmap.Pointer{
+		{Image: shape, HotSpot: image.Pt(1, 2)},
+		{Image: shape, HotSpot: image.Pt(1, 2), Position: image.Pt(5, 6)},
+		{Image: shape, HotSpot: image.Pt(1, 2), Position: image.Pt(7, 8)},
+		{Hidden: true, Position: image.Pt(7, 8)},
+	}, processor.pointers)
+
+	// a plain Processor only gets the updates
+	plain := &framebufferProcessor{fb: bitmap.NewFramebuffer(64, 48)}
+	assert.NoError(t, Replay(bytes.NewReader(data), plain))
+	assert.Equal(t, 25, plain.updates)
+}
+
+// framebufferProcessor composites what Replay plays into a framebuffer
+type framebufferProcessor struct {
+	fb      *bitmap.Framebuffer
+	updates int
+}
+
+func (p *framebufferProcessor) ProcessBitmap(option *bitmap.Option, bmp *bitmap.BitMap) {
+	p.fb.ApplyUpdate(option, bmp)
+	p.updates++
+}
+
+func TestReplay(t *testing.T) {
+	data := record(t, 25, 10)
+	p, err := NewPlayer(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.NoError(t, p.SeekToFrame(24))
+
+	processor := &framebufferProcessor{fb: bitmap.NewFramebuffer(64, 48)}
+	assert.NoError(t, Replay(bytes.NewReader(data), processor))
+	assert.Equal(t, 25, processor.updates)
+	assert.Equal(t, p.Image(), processor.fb.Snapshot())
+
+	// a truncated recording plays up to where it ends
+	processor = &framebufferProcessor{fb: bitmap.NewFramebuffer(64, 48)}
+	assert.Error(t, Replay(bytes.NewReader(data[:len(data)-10]), processor))
+	assert.Equal(t, 24, processor.updates)
+
+	assert.ErrorIs(t, Replay(bytes.NewReader([]byte("not a recording")), processor), ErrFormat)
+}
+
+func TestReplayPace(t *testing.T) {
+	buff := new(bytes.Buffer)
+	rec, err := NewRecorder(buff, 16, 16)
+	assert.NoError(t, err)
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		rec.ProcessBitmap(&bitmap.Option{Width: 4, Height: 4}, &bitmap.BitMap{Image: img})
+	}
+	assert.NoError(t, rec.Close())
+	rec.ProcessBitmap(&bitmap.Option{Width: 4, Height: 4}, &bitmap.BitMap{Image: img})
+
+	processor := &framebufferProcessor{fb: bitmap.NewFramebuffer(16, 16)}
+	start := time.Now()
+	assert.NoError(t, Replay(bytes.NewReader(buff.Bytes()), processor))
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+	assert.Equal(t, 3, processor.updates, "updates after Close are not recorded")
+}
@@ -0,0 +1,186 @@
+// Package replay records the screen updates of a session to a file and
+// plays them back, stepping and seeking through them for debugging.
+package replay
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/proto/bitmap"
+)
+
+// DefaultKeyframeInterval is how many frames a Recorder writes between two
+// keyframes
+const DefaultKeyframeInterval = 100
+
+// magic starts every recording
+var magic = [8]byte{'G', 'O', 'R', 'D', 'P', 'R', 'E', 'C'}
+
+// ErrFormat is returned for a file that is not a recording
+var ErrFormat = errors.New("not a session recording")
+
+// Frame kinds
+const (
+	frameUpdate        = 0 // a rectangle painted over the previous frame
+	frameKeyframe      = 1 // the whole screen
+	framePointer       = 2 // the pointer shape, its hot spot at Left, Top; none for the default pointer
+	framePointerHidden = 3 // the pointer hidden
+	framePointerMoved  = 4 // the pointer moved to Left, Top
+)
+
+// maxPointerSize is the largest width and height of a pointer shape
+const maxPointerSize = 384
+
+// fileHeader starts a recording after magic
+type fileHeader struct {
+	Width  uint32
+	Height uint32
+}
+
+// frameHeader precedes the RGBA pixels of each frame
+type frameHeader struct {
+	Kind   uint8
+	Time   int64 // since the recording started, in nanoseconds
+	Left   int32
+	Top    int32
+	Width  uint32
+	Height uint32
+}
+
+// Recorder writes the bitmap updates of a session as frames, one for each
+// update, and the changes of its pointer. Set it as the session's
+// processor, or call ProcessBitmap and ProcessPointer from one. Every
+// KeyframeInterval updates it writes the whole screen instead, which lets
+// a Player seek without replaying from the start.
+type Recorder struct {
+	mu sync.Mutex
+
+	// KeyframeInterval is the number of frames between two keyframes,
+	// DefaultKeyframeInterval when 0
+	KeyframeInterval int
+
+	w       *bufio.Writer
+	fb      *bitmap.Framebuffer
+	start   time.Time
+	frames  int            // updates, which keyframes are counted in
+	pointer bitmap.Pointer // as recorded last
+	closed  bool
+	err     error
+}
+
+// NewRecorder starts a recording of a width x height screen to w
+func NewRecorder(w io.Writer, width, height int) (*Recorder, error) {
+	rec := &Recorder{
+		w:     bufio.NewWriter(w),
+		fb:    bitmap.NewFramebuffer(width, height),
+		start: time.Now(),
+	}
+	err := core.Try(func() {
+		core.WriteFull(rec.w, magic[:])
+		core.WriteLE(rec.w, &fileHeader{Width: uint32(width), Height: uint32(height)})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// ProcessBitmap records one update. Writing errors are kept and returned
+// by Close.
+func (r *Recorder) ProcessBitmap(option *bitmap.Option, bmp *bitmap.BitMap) {
+	if option == nil || bmp == nil || bmp.Image == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil || r.closed {
+		return
+	}
+	r.fb.ApplyUpdate(option, bmp)
+
+	interval := r.KeyframeInterval
+	if interval <= 0 {
+		interval = DefaultKeyframeInterval
+	}
+	header := &frameHeader{Time: int64(time.Since(r.start))}
+	var img *image.RGBA
+	if r.frames%interval == 0 {
+		header.Kind = frameKeyframe
+		img = r.fb.Snapshot().(*image.RGBA)
+	} else {
+		header.Kind = frameUpdate
+		img = image.NewRGBA(image.Rect(0, 0, option.Width, option.Height))
+		draw.Draw(img, img.Rect, bmp.Image, bmp.Image.Bounds().Min, draw.Src)
+		header.Left, header.Top = int32(option.Left), int32(option.Top)
+	}
+	header.Width, header.Height = uint32(img.Rect.Dx()), uint32(img.Rect.Dy())
+	r.write(header, img.Pix)
+	r.frames++
+}
+
+// ProcessPointer records what changed of the pointer since it was last
+// recorded, starting from the default pointer at 0, 0. Shapes larger than
+// a pointer can be are left out.
+func (r *Recorder) ProcessPointer(pointer *bitmap.Pointer) {
+	if pointer == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil || r.closed {
+		return
+	}
+	now := int64(time.Since(r.start))
+	if pointer.Hidden != r.pointer.Hidden || pointer.Image != r.pointer.Image || pointer.HotSpot != r.pointer.HotSpot {
+		header := &frameHeader{Kind: framePointer, Time: now}
+		var pix []byte
+		size := image.Point{}
+		switch {
+		case pointer.Hidden:
+			header.Kind = framePointerHidden
+		case pointer.Image != nil:
+			size = pointer.Image.Rect.Size()
+			img := image.NewRGBA(image.Rectangle{Max: size})
+			draw.Draw(img, img.Rect, pointer.Image, pointer.Image.Rect.Min, draw.Src)
+			header.Left, header.Top = int32(pointer.HotSpot.X), int32(pointer.HotSpot.Y)
+			header.Width, header.Height = uint32(size.X), uint32(size.Y)
+			pix = img.Pix
+		}
+		if size.X <= maxPointerSize && size.Y <= maxPointerSize {
+			r.write(header, pix)
+		}
+	}
+	if pointer.Position != r.pointer.Position {
+		r.write(&frameHeader{Kind: framePointerMoved, Time: now, Left: int32(pointer.Position.X), Top: int32(pointer.Position.Y)}, nil)
+	}
+	r.pointer = *pointer
+}
+
+// write writes a frame, keeping the first error
+func (r *Recorder) write(header *frameHeader, pix []byte) {
+	if r.err != nil {
+		return
+	}
+	r.err = core.Try(func() {
+		core.WriteLE(r.w, header)
+		core.WriteFull(r.w, pix)
+	})
+}
+
+// Close flushes the recording and returns the first error writing it.
+// Later updates are not recorded. It does not close the underlying writer.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil && !r.closed {
+		r.err = r.w.Flush()
+	}
+	r.closed = true
+	return r.err
+}
@@ -0,0 +1,69 @@
+package replay
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/proto/bitmap"
+)
+
+// Processor receives the frames of a recording from Replay, as a
+// gordp.Processor receives the bitmap updates of a session from Run
+type Processor interface {
+	ProcessBitmap(*bitmap.Option, *bitmap.BitMap)
+}
+
+// PointerProcessor is a Processor that Replay also gives the pointer each
+// time a frame changes it, as a gordp.PointerProcessor
+type PointerProcessor interface {
+	Processor
+	ProcessPointer(pointer *bitmap.Pointer)
+}
+
+// Replay plays the recording read from r back to processor, each frame as
+// long after the first as it was recorded: keyframes as an update of the
+// whole screen, the other frames as the update they recorded, and the
+// pointer frames as the pointer if processor is a PointerProcessor. Unlike
+// a Player it needs no seeking, so r may be a network stream or a pipe.
+func Replay(r io.Reader, processor Processor) error {
+	br := bufio.NewReader(r)
+	return core.Try(func() {
+		file := readFileHeader(br)
+
+		pointers, _ := processor.(PointerProcessor)
+		var pointer bitmap.Pointer
+		var start time.Time
+		var first time.Duration
+		for {
+			var header frameHeader
+			if err := core.Try(func() { core.ReadLE(br, &header) }); err != nil {
+				if errors.Is(err, io.EOF) {
+					return
+				}
+				core.ThrowError(err)
+			}
+			var play func()
+			if isPointerFrame(&header) {
+				readPointer(br, &header, &pointer)
+				current := pointer
+				play = func() {
+					if pointers != nil {
+						pointers.ProcessPointer(&current)
+					}
+				}
+			} else {
+				option, bmp := readFrame(br, &header, int(file.Width), int(file.Height))
+				play = func() { processor.ProcessBitmap(option, bmp) }
+			}
+			if start.IsZero() {
+				start, first = time.Now(), time.Duration(header.Time)
+			} else if wait := time.Until(start.Add(time.Duration(header.Time) - first)); wait > 0 {
+				time.Sleep(wait)
+			}
+			play()
+		}
+	})
+}
@@ -0,0 +1,58 @@
+//go:build linux
+
+package gordp
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// sockopt reads an integer socket option of conn
+func sockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	assert.NoError(t, err)
+	var value int
+	var optErr error
+	assert.NoError(t, raw.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}))
+	assert.NoError(t, optErr)
+	return value
+}
+
+// TestTCPOptions checks that the socket options of Option reach the dialed
+// connection
+func TestTCPOptions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	dial := func(opt *Option) net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		assert.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		assert.NoError(t, core.SetTCPOptions(conn, NewClient(opt).tcpOptions()))
+		return conn
+	}
+
+	conn := dial(&Option{Addr: l.Addr().String(), TCPKeepAlive: 15 * time.Second})
+	assert.Equal(t, 1, sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY))
+	assert.Equal(t, 1, sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+	assert.Equal(t, 15, sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL))
+
+	noDelay := false
+	conn = dial(&Option{Addr: l.Addr().String(), TCPNoDelay: &noDelay, TCPKeepAlive: -1})
+	assert.Equal(t, 0, sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY))
+	assert.Equal(t, 0, sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+
+	// other transports are left alone
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	assert.NoError(t, core.SetTCPOptions(client, core.TCPOptions{NoDelay: true}))
+}
@@ -0,0 +1,173 @@
+package testutil
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/proto/mcs"
+	"github.com/kdsmith18542/gordp/proto/mcs/per"
+	"github.com/kdsmith18542/gordp/proto/sec"
+	"github.com/kdsmith18542/gordp/proto/t128"
+	"github.com/kdsmith18542/gordp/proto/x224"
+)
+
+// Conn is the server end of a connection whose sequence got as far as the
+// MCS channels: it reads the PDUs the client sends and writes those of the
+// server, e.g. to drive a client wired to it in a test. The methods throw
+// with core.Throw on malformed PDUs. Conn is an io.ReadWriter too, for the
+// PDUs it has no method for, its reads going through the same buffer.
+type Conn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	writeM sync.Mutex
+
+	// encrypts and decrypts once the session is, see SetEncryption
+	encryption *sec.Encryption
+}
+
+// NewConn returns the server end of conn
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.conn.Write(b)
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Peek returns the next n bytes without reading them
+func (c *Conn) Peek(n int) ([]byte, error) {
+	return c.r.Peek(n)
+}
+
+// SetEncryption makes the MCS data and fast-path input encrypted under
+// Standard RDP Security with e from now on
+func (c *Conn) SetEncryption(e *sec.Encryption) {
+	c.writeM.Lock()
+	defer c.writeM.Unlock()
+	c.encryption = e
+}
+
+// ReadMcsData reads one MCS Send Data Request and returns its channel and
+// data, decrypted when the session is encrypted
+func (c *Conn) ReadMcsData() (uint16, []byte) {
+	r := bytes.NewReader(x224.Read(c.r))
+	typ := mcs.ReadMcsPduHeader(r)
+	core.ThrowIf(typ != mcs.MCS_PDUTYPE_SEND_DATA_REQUEST, fmt.Errorf("expected send data request, got mcs pdu %d", typ))
+	per.ReadInteger16(r, mcs.MCS_CHANNEL_USERID_BASE) // initiator
+	channelId := per.ReadInteger16(r, 0)
+	per.ReadEnumerated(r) // dataPriority + segmentation
+	data := core.ReadBytes(r, per.ReadLength(r))
+	if c.encryption != nil {
+		_, data = sec.ReadSecured(bytes.NewReader(data), c.encryption)
+	}
+	return channelId, data
+}
+
+// ReadPdu reads one share control PDU and returns its header and the rest
+func (c *Conn) ReadPdu() (t128.TsShareControlHeader, io.Reader) {
+	_, data := c.ReadMcsData()
+	r := bytes.NewReader(data)
+	header := t128.TsShareControlHeader{}
+	header.Read(r)
+	return header, r
+}
+
+// ReadDataPdu reads one data PDU
+func (c *Conn) ReadDataPdu() *t128.TsDataPduData {
+	header, r := c.ReadPdu()
+	core.ThrowIf(header.PDUType != t128.PDUTYPE_DATAPDU, fmt.Errorf("expected data pdu, got pdu type %#x", header.PDUType))
+	return (&t128.TsDataPduData{}).Read(r).(*t128.TsDataPduData)
+}
+
+// ReadFastPathInput reads one fast-path input PDU and returns its header
+// and events, decrypted when they are encrypted
+func (c *Conn) ReadFastPathInput() (t128.FpInputHeader, []byte) {
+	header := t128.FpInputHeader{}
+	header.Read(c.r)
+	length := int(per.ReadInteger8(c.r))
+	headerLen := 2
+	if length&0x80 != 0 {
+		length = (length&0x7F)<<8 | int(per.ReadInteger8(c.r))
+		headerLen = 3
+	}
+	data := core.ReadBytes(c.r, length-headerLen)
+	if header.Flags&t128.FASTPATH_INPUT_ENCRYPTED != 0 {
+		core.ThrowIf(c.encryption == nil || len(data) < sec.SignatureLength, "unexpected encrypted input")
+		core.ThrowError(c.encryption.Decrypt(data[sec.SignatureLength:], data[:sec.SignatureLength], header.Flags&t128.FASTPATH_INPUT_SECURE_CHECKSUM != 0))
+		data = data[sec.SignatureLength:]
+	}
+	return header, data
+}
+
+// WriteMcsData sends data to the client as an MCS Send Data Indication,
+// encrypted when the session is
+func (c *Conn) WriteMcsData(channelId uint16, data []byte) {
+	c.writeM.Lock()
+	defer c.writeM.Unlock()
+	if c.encryption != nil {
+		buff := new(bytes.Buffer)
+		sec.WriteSecured(buff, 0, data, c.encryption)
+		data = buff.Bytes()
+	}
+	c.writeMcs(channelId, data)
+}
+
+// WriteMcs sends data as an MCS Send Data Indication as it is, e.g. a
+// licensing PDU, which is not encrypted with the session
+func (c *Conn) WriteMcs(channelId uint16, data []byte) {
+	c.writeM.Lock()
+	defer c.writeM.Unlock()
+	c.writeMcs(channelId, data)
+}
+
+// writeMcs sends data as it is; the caller holds writeM
+func (c *Conn) writeMcs(channelId uint16, data []byte) {
+	buff := new(bytes.Buffer)
+	mcs.WriteMcsPduHeader(buff, mcs.MCS_PDUTYPE_SEND_DATA_INDICATION, 0)
+	per.WriteInteger16(buff, ServerChannel-mcs.MCS_CHANNEL_USERID_BASE)
+	per.WriteInteger16(buff, channelId)
+	per.WriteEnumerated(buff, 0x70) // dataPriority + segmentation
+	per.WriteLength(buff, len(data))
+	core.WriteFull(buff, data)
+	x224.Write(c.conn, buff.Bytes())
+}
+
+// WritePdu sends a share control PDU on the global channel
+func (c *Conn) WritePdu(pduType uint16, data []byte) {
+	header := t128.TsShareControlHeader{
+		PDUType:     pduType,
+		PDUSource:   ServerChannel,
+		TotalLength: uint16(len(data) + 6),
+	}
+	c.WriteMcsData(mcs.MCS_CHANNEL_GLOBAL, append(header.Serialize(), data...))
+}
+
+// WriteDataPdu sends a data PDU on the global channel
+func (c *Conn) WriteDataPdu(pdu t128.DataPDU) {
+	c.WritePdu(t128.PDUTYPE_DATAPDU, t128.NewDataPdu(pdu, ShareId).Serialize())
+}
+
+// Finalize answers the client's synchronize, control, persistent key list
+// and font list PDUs of the connection finalization
+func (c *Conn) Finalize() {
+	for c.ReadDataPdu().Header.PDUType2 != t128.PDUTYPE2_FONTLIST {
+	}
+	c.WriteDataPdu(t128.NewTsSynchronizePduData(UserId))
+	c.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_COOPERATE})
+	c.WriteDataPdu(&t128.TsControlPDU{Action: t128.CTRLACTION_GRANTED_CONTROL, GrantId: UserId, ControlId: ServerChannel})
+	c.WriteDataPdu(&t128.TsFontMapPDU{MapFlags: 0x0003, EntrySize: 0x0004})
+}
@@ -0,0 +1,405 @@
+// Package testutil provides an in-memory RDP server to test the client
+// against without a Windows host. The server completes the connection
+// sequence with Standard RDP Security, no licensing and, unless
+// EncryptionMethod is set, no encryption, then echoes every message the
+// client sends on a static virtual channel, so the handshake and channel
+// code can be tested deterministically:
+//
+//	server := testutil.NewServer()
+//	client := gordp.NewClientWithConn(server.Pipe(), &gordp.Option{})
+//	err := client.Connect()
+//
+// Tests that drive the PDUs of a session themselves use a Conn instead.
+package testutil
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/kdsmith18542/gordp/core"
+	"github.com/kdsmith18542/gordp/proto/capability"
+	"github.com/kdsmith18542/gordp/proto/mcs"
+	"github.com/kdsmith18542/gordp/proto/pdu/connPdu"
+	"github.com/kdsmith18542/gordp/proto/pdu/licPdu"
+	"github.com/kdsmith18542/gordp/proto/pdu/secPdu"
+	"github.com/kdsmith18542/gordp/proto/sec"
+	"github.com/kdsmith18542/gordp/proto/t128"
+	"github.com/kdsmith18542/gordp/proto/virtualchannel"
+	"github.com/kdsmith18542/gordp/proto/x224"
+)
+
+// Identifiers the server hands out. Static channels get the ids following
+// UserId, in the order the client offered them.
+const (
+	UserId        = 1007
+	ShareId       = 0x000103EA
+	ServerChannel = 0x03EA
+)
+
+// chunkLength is the size of the static channel chunks the server sends
+// See [MS-RDPBCGR] 2.2.7.1.10
+const chunkLength = 1600
+
+// ErrNotActive is returned by SendChannelData before the client finished
+// the connection sequence or after the connection ended
+var ErrNotActive = errors.New("session not active")
+
+// Server is the server side of one RDP connection
+type Server struct {
+	// Width and Height of the desktop announced in the Demand Active PDU.
+	// Zero announces the size the client asked for.
+	Width, Height uint16
+
+	// OnChannelData, if set, is called with each message the client sends
+	// on a static virtual channel and returns the reply, nil for none.
+	// Unset, the message is sent back unchanged.
+	OnChannelData func(channel string, data []byte) []byte
+
+	// EncryptionMethod, if set, is the mcs.ENCRYPTION_METHOD_ the server
+	// encrypts the session with under Standard RDP Security
+	EncryptionMethod uint32
+
+	c *Conn
+
+	// RSA key of the server certificate, when EncryptionMethod is set
+	key          *rsa.PrivateKey
+	serverRandom []byte
+
+	mu       sync.Mutex
+	coreData mcs.ClientCoreData
+	channels map[uint16]string // static channels by id
+	pending  map[uint16][]byte // messages still missing chunks
+
+	active chan struct{} // closed once the client finished connecting
+	done   chan struct{} // closed when Serve returns
+	err    error
+}
+
+// NewServer returns a server ready to serve one connection
+func NewServer() *Server {
+	return &Server{
+		channels: make(map[uint16]string),
+		pending:  make(map[uint16][]byte),
+		active:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Pipe serves the server end of a new in-memory connection on its own
+// goroutine and returns the client end, for gordp.NewClientWithConn
+func (s *Server) Pipe() net.Conn {
+	client, server := net.Pipe()
+	go func() { _ = s.Serve(server) }()
+	return client
+}
+
+// Serve runs the server side of the connection sequence on conn and then
+// answers the client until it hangs up, which ends Serve with nil
+func (s *Server) Serve(conn net.Conn) error {
+	defer close(s.done)
+	defer conn.Close()
+	s.c = NewConn(conn)
+	err := core.Try(func() {
+		s.negotiation()
+		s.basicSettingsExchange()
+		s.channelConnect()
+		s.securityExchange()
+		s.c.ReadMcsData() // Client Info PDU
+		s.licensing()
+		s.capabilitiesExchange()
+		s.c.Finalize()
+		close(s.active)
+		for s.serveOne() {
+		}
+	})
+	if isClosed(err) {
+		err = nil
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+	return err
+}
+
+// Done is closed when Serve returns
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why Serve ended, nil while it runs or when the client hung up
+func (s *Server) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// ClientCoreData returns the client core data the client connected with
+func (s *Server) ClientCoreData() mcs.ClientCoreData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.coreData
+}
+
+// ChannelId returns the id the static channel name was given
+func (s *Server) ChannelId(name string) (uint16, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, n := range s.channels {
+		if n == name {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// SendChannelData sends a message to the client on the static channel name,
+// once the client finished connecting
+func (s *Server) SendChannelData(name string, data []byte) error {
+	select {
+	case <-s.active:
+	case <-s.done:
+		return ErrNotActive
+	}
+	id, ok := s.ChannelId(name)
+	if !ok {
+		return fmt.Errorf("static channel %s not joined", name)
+	}
+	return core.Try(func() { s.writeChannelData(id, data) })
+}
+
+// isClosed reports whether err is the client hanging up
+func isClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed)
+}
+
+// negotiation picks Standard RDP Security, which all clients support
+func (s *Server) negotiation() {
+	typ, _ := x224.ReadConfirm(s.c)
+	core.ThrowIf(typ != x224.TPDU_CONNECTION_REQUEST, fmt.Errorf("expected connection request, got tpdu %#x", typ))
+	rsp := connPdu.Negotiation{Type: connPdu.TYPE_RDP_NEG_RSP, Length: 8, Result: connPdu.PROTOCOL_RDP}
+	x224.Connect(s.c, x224.TPDU_CONNECTION_CONFIRM, core.ToLE(&rsp))
+}
+
+// basicSettingsExchange reads the client data and gives every static
+// channel offered an id
+func (s *Server) basicSettingsExchange() {
+	ci := mcs.ConnectInitial{}
+	ci.Load(x224.Read(s.c))
+	r := bytes.NewReader((&mcs.GccConferenceCreateRequest{}).Read(bytes.NewReader(ci.UserData)))
+
+	network := mcs.ServerNetworkData{McsChannelId: mcs.MCS_CHANNEL_GLOBAL}
+	for r.Len() > 0 {
+		header := mcs.UserDataHeader{}
+		header.Read(r)
+		block := core.ReadBytes(r, int(header.Len)-4)
+		switch header.Type {
+		case mcs.CS_CORE:
+			// clients may leave out the fields at the end
+			data := append(core.ToLE(&header), block...)
+			data = append(data, make([]byte, max(0, len(core.ToLE(&s.coreData))-len(data)))...)
+			s.mu.Lock()
+			core.ReadLE(bytes.NewReader(data), &s.coreData)
+			s.mu.Unlock()
+		case mcs.CS_NET:
+			block := bytes.NewReader(block)
+			var count uint32
+			core.ReadLE(block, &count)
+			for i := uint32(0); i < count; i++ {
+				def := mcs.ChannelDef{}
+				core.ReadLE(block, &def)
+				id := uint16(UserId + 1 + i)
+				s.mu.Lock()
+				s.channels[id] = string(bytes.TrimRight(def.Name[:], "\x00"))
+				s.mu.Unlock()
+				network.ChannelIdArray = append(network.ChannelIdArray, id)
+			}
+		}
+	}
+
+	serverCore := mcs.ServerCoreData{Version: mcs.RDP_VERSION_5_PLUS, ClientRequestedProtocols: connPdu.PROTOCOL_RDP}
+	security := mcs.ServerSecurityData{}
+	if s.EncryptionMethod != mcs.ENCRYPTION_METHOD_NONE {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		core.ThrowError(err)
+		s.key, s.serverRandom = key, make([]byte, sec.ClientRandomLength)
+		_, err = rand.Read(s.serverRandom)
+		core.ThrowError(err)
+		security = mcs.ServerSecurityData{
+			EncryptionMethod:  s.EncryptionMethod,
+			EncryptionLevel:   mcs.ENCRYPTION_LEVEL_CLIENT_COMPATIBLE,
+			ServerRandom:      s.serverRandom,
+			ServerCertificate: mcs.ServerCertificate{CertData: mcs.NewProprietaryServerCertificate(&key.PublicKey)},
+		}
+	}
+	userData := bytes.Join([][]byte{serverCore.Serialize(), security.Serialize(), network.Serialize()}, nil)
+	rsp := mcs.ConnectResponse{
+		DomainParameters: mcs.DomainParameters{
+			MaxChannelIds:   22,
+			MaxUserIds:      3,
+			NumPriorities:   1,
+			MaxHeight:       1,
+			MaxMCSPDUsize:   0xfff8,
+			ProtocolVersion: 2,
+		},
+		UserData: (&mcs.GccConferenceCreateResponse{}).Serialize(userData),
+	}
+	x224.Write(s.c, rsp.Serialize())
+}
+
+// channelConnect answers the erect domain, attach user and channel join
+// requests; the client joins the global and user channels and every static
+// channel it was given
+func (s *Server) channelConnect() {
+	x224.Read(s.c) // Erect Domain Request
+	r := bytes.NewReader(x224.Read(s.c))
+	typ := mcs.ReadMcsPduHeader(r)
+	core.ThrowIf(typ != mcs.MCS_PDUTYPE_ATTACH_USER_REQUEST, fmt.Errorf("expected attach user request, got mcs pdu %d", typ))
+	x224.Write(s.c, (&mcs.ServerAttachUserConfirm{UserId: UserId}).Serialize())
+
+	s.mu.Lock()
+	joins := 2 + len(s.channels)
+	s.mu.Unlock()
+	for i := 0; i < joins; i++ {
+		r := bytes.NewReader(x224.Read(s.c))
+		typ := mcs.ReadMcsPduHeader(r)
+		core.ThrowIf(typ != mcs.MCS_PDUTYPE_CHANNEL_JOIN_REQUEST, fmt.Errorf("expected channel join request, got mcs pdu %d", typ))
+		join := mcs.ClientChannelJoin{}
+		core.ReadBE(r, &join)
+		x224.Write(s.c, (&mcs.ServerChannelJoinConfirm{UserId: UserId, ChannelId: join.ChannelId}).Serialize())
+	}
+}
+
+// securityExchange reads the client random of an encrypted session and
+// derives the session keys from it
+func (s *Server) securityExchange() {
+	if s.EncryptionMethod == mcs.ENCRYPTION_METHOD_NONE {
+		return
+	}
+	exchange := secPdu.SecurityExchangePDU{}
+	_, data := s.c.ReadMcsData()
+	exchange.Read(bytes.NewReader(data))
+	clientRandom, err := sec.DecryptClientRandom(s.key, exchange.EncryptedClientRandom)
+	core.ThrowError(err)
+	encryption, err := sec.NewServerEncryption(s.EncryptionMethod, clientRandom, s.serverRandom)
+	core.ThrowError(err)
+	s.c.SetEncryption(encryption)
+}
+
+// licensing skips licensing the way servers do for clients holding a
+// license, with the PDU in the clear as encrypting it is optional
+func (s *Server) licensing() {
+	buff := new(bytes.Buffer)
+	sec.NewTsSecurityHeader(sec.SEC_LICENSE_PKT).Write(buff)
+	core.WriteFull(buff, licPdu.NewLicenseValidClientData().Serialize())
+	s.c.WriteMcs(mcs.MCS_CHANNEL_GLOBAL, buff.Bytes())
+}
+
+// capabilitiesExchange sends the Demand Active PDU and waits for the
+// client's Confirm Active PDU
+func (s *Server) capabilitiesExchange() {
+	coreData := s.ClientCoreData()
+	bitmap := capability.NewTsBitmapCapabilitySet()
+	bitmap.DesktopWidth, bitmap.DesktopHeight = coreData.DesktopWidth, coreData.DesktopHeight
+	if s.Width != 0 && s.Height != 0 {
+		bitmap.DesktopWidth, bitmap.DesktopHeight = s.Width, s.Height
+	}
+	demand := &t128.TsDemandActivePduData{
+		SharedId:         ShareId,
+		SourceDescriptor: []byte("RDP\x00"),
+		CapabilitySets: []capability.TsCapsSet{
+			capability.NewTsGeneralCapabilitySet(),
+			bitmap,
+			capability.NewTsOrderCapabilitySet(),
+			capability.NewTsInputCapabilitySet(),
+			&capability.TsVirtualChannelCapabilitySet{VCChunkSize: chunkLength},
+		},
+	}
+	s.c.WritePdu(t128.PDUTYPE_DEMANDACTIVEPDU, demand.Serialize())
+
+	header, _ := s.c.ReadPdu()
+	core.ThrowIf(header.PDUType != t128.PDUTYPE_CONFIRMACTIVEPDU, fmt.Errorf("expected confirm active pdu, got pdu type %#x", header.PDUType))
+}
+
+// serveOne answers one PDU of the active session. Input is accepted and
+// dropped, a shutdown request denied and static channel messages echoed.
+func (s *Server) serveOne() bool {
+	b, err := s.c.Peek(1)
+	core.ThrowError(err)
+	if b[0] != 3 {
+		s.c.ReadFastPathInput()
+		return true
+	}
+	channelId, data := s.c.ReadMcsData()
+	if channelId != mcs.MCS_CHANNEL_GLOBAL {
+		s.handleChannelData(channelId, data)
+		return true
+	}
+	r := bytes.NewReader(data)
+	header := t128.TsShareControlHeader{}
+	header.Read(r)
+	if header.PDUType == t128.PDUTYPE_DATAPDU {
+		shareData := t128.TsShareDataHeader{}
+		shareData.Read(r)
+		if shareData.PDUType2 == t128.PDUTYPE2_SHUTDOWN_REQUEST {
+			s.c.WriteDataPdu(&t128.TsShutdownDeniedPDU{})
+		}
+	}
+	return true
+}
+
+// handleChannelData collects the chunks of a static channel message and
+// answers the complete message
+func (s *Server) handleChannelData(channelId uint16, data []byte) {
+	s.mu.Lock()
+	name, ok := s.channels[channelId]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	var length, flags uint32
+	r := bytes.NewReader(data)
+	core.ReadLE(r, &length) // CHANNEL_PDU_HEADER
+	core.ReadLE(r, &flags)
+	if flags&virtualchannel.CHANNEL_FLAG_FIRST != 0 {
+		s.pending[channelId] = nil
+	}
+	message := append(s.pending[channelId], data[8:]...)
+	s.pending[channelId] = message
+	if flags&virtualchannel.CHANNEL_FLAG_LAST == 0 {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.pending, channelId)
+	s.mu.Unlock()
+
+	reply := message
+	if s.OnChannelData != nil {
+		reply = s.OnChannelData(name, message)
+	}
+	if reply != nil {
+		s.writeChannelData(channelId, reply)
+	}
+}
+
+// writeChannelData sends a static channel message in chunks
+func (s *Server) writeChannelData(channelId uint16, data []byte) {
+	length, flags := len(data), uint32(virtualchannel.CHANNEL_FLAG_FIRST)
+	for first := true; first || len(data) > 0; first = false {
+		n := min(len(data), chunkLength)
+		if n == len(data) {
+			flags |= virtualchannel.CHANNEL_FLAG_LAST
+		}
+		buff := new(bytes.Buffer)
+		core.WriteLE(buff, uint32(length)) // CHANNEL_PDU_HEADER
+		core.WriteLE(buff, flags)
+		core.WriteFull(buff, data[:n])
+		s.c.WriteMcsData(channelId, buff.Bytes())
+		data, flags = data[n:], 0
+	}
+}